@@ -0,0 +1,8 @@
+module github.com/google/perforce-utils/p4_archive_perms_audit
+
+go 1.21
+
+require (
+	github.com/google/perforce-utils/perforceutils v0.0.0
+	github.com/karrick/godirwalk v1.16.1
+)
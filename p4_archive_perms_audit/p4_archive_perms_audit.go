@@ -0,0 +1,278 @@
+//go:build !windows
+
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_archive_perms_audit walks Perforce depot roots and reports librarian
+// files and directories that the p4d service account cannot access.
+// Archive files need to be readable by the service account, and directories need to be
+// readable, writable and traversable since p4d creates and renames files inside them.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/karrick/godirwalk"
+)
+
+const (
+	ReadPermission    os.FileMode = 04
+	WritePermission   os.FileMode = 02
+	ExecutePermission os.FileMode = 01
+)
+
+// The identity of the account p4d runs as
+type serviceAccount struct {
+	name   string
+	uid    uint32
+	gids   map[uint32]bool
+	isRoot bool
+}
+
+func lookupServiceAccount(name string) (*serviceAccount, error) {
+	var u *user.User
+	var err error
+	if len(name) > 0 {
+		u, err = user.Lookup(name)
+	} else {
+		u, err = user.Current()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error looking up user %v: %v", name, err)
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected uid %v for user %v", u.Uid, u.Username)
+	}
+
+	account := &serviceAccount{
+		name:   u.Username,
+		uid:    uint32(uid),
+		gids:   make(map[uint32]bool),
+		isRoot: uid == 0,
+	}
+
+	groupIds, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("error listing groups of user %v: %v", u.Username, err)
+	}
+	for _, groupId := range groupIds {
+		gid, err := strconv.ParseUint(groupId, 10, 32)
+		if err != nil {
+			continue
+		}
+		account.gids[uint32(gid)] = true
+	}
+
+	return account, nil
+}
+
+// Returns the permission bits (a combination of read/write/execute) that apply to the account
+func (a *serviceAccount) effectivePermissions(mode os.FileMode, uid uint32, gid uint32) os.FileMode {
+	if a.isRoot {
+		return ReadPermission | WritePermission | ExecutePermission
+	}
+	perm := mode.Perm()
+	if uid == a.uid {
+		return (perm >> 6) & 07
+	}
+	if a.gids[gid] {
+		return (perm >> 3) & 07
+	}
+	return perm & 07
+}
+
+func ownerName(uid uint32) string {
+	if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+		return u.Username
+	}
+	return strconv.FormatUint(uint64(uid), 10)
+}
+
+func groupName(gid uint32) string {
+	if g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10)); err == nil {
+		return g.Name
+	}
+	return strconv.FormatUint(uint64(gid), 10)
+}
+
+// Walks a depot root and writes a CSV row for every entry with an ownership or permission problem
+func auditDepotRoot(depotRoot string, account *serviceAccount, checkOwner bool, out output.Writer) (int, int, error) {
+	entryCount := 0
+	issueCount := 0
+
+	report := func(path string, entryType string, info os.FileInfo, stat *syscall.Stat_t, issue string) {
+		issueCount++
+		slog.Debug("Found issue", logging.PathKey, path, "issue", issue)
+		out.Write([]string{
+			path,
+			entryType,
+			ownerName(stat.Uid),
+			groupName(stat.Gid),
+			info.Mode().Perm().String(),
+			issue})
+	}
+
+	err := godirwalk.Walk(depotRoot, &godirwalk.Options{
+		Callback: func(osPathname string, de *godirwalk.Dirent) error {
+			info, err := os.Lstat(osPathname)
+			if err != nil {
+				slog.Warn("Could not stat", logging.PathKey, osPathname, logging.Err(err))
+				return nil
+			}
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if !ok {
+				return fmt.Errorf("unsupported file information for %v", osPathname)
+			}
+			entryCount++
+
+			if info.Mode()&os.ModeSymlink != 0 {
+				// The target is audited where it lives, if it lives under a depot root
+				return nil
+			}
+
+			entryType := "file"
+			required := ReadPermission
+			if info.IsDir() {
+				entryType = "directory"
+				required = ReadPermission | WritePermission | ExecutePermission
+			}
+
+			if checkOwner && stat.Uid != account.uid {
+				report(osPathname, entryType, info, stat, "not owned by "+account.name)
+			}
+
+			if effective := account.effectivePermissions(info.Mode(), stat.Uid, stat.Gid); effective&required != required {
+				report(osPathname, entryType, info, stat,
+					fmt.Sprintf("%v has %v access, needs %v", account.name, permissionString(effective), permissionString(required)))
+			}
+			return nil
+		},
+		ErrorCallback: func(osPathname string, err error) godirwalk.ErrorAction {
+			// Unreadable directories are exactly what we're looking for, keep going
+			slog.Warn("Could not read", logging.PathKey, osPathname, logging.Err(err))
+			issueCount++
+			out.Write([]string{osPathname, "unknown", "", "", "", err.Error()})
+			return godirwalk.SkipNode
+		},
+		Unsorted: true,
+	})
+
+	return entryCount, issueCount, err
+}
+
+func permissionString(perm os.FileMode) string {
+	s := []byte("---")
+	if perm&ReadPermission != 0 {
+		s[0] = 'r'
+	}
+	if perm&WritePermission != 0 {
+		s[1] = 'w'
+	}
+	if perm&ExecutePermission != 0 {
+		s[2] = 'x'
+	}
+	return string(s)
+}
+
+func main() {
+	flags := struct {
+		user       string
+		checkOwner bool
+		output     string
+		format     string
+		verbose    bool
+	}{}
+
+	flag.StringVar(&flags.user, "user", "", "Account p4d runs as (defaults to the current user).")
+	flag.BoolVar(&flags.checkOwner, "check-owner", true, "Report entries not owned by the service account.")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File, or table for the database formats, to write the issues to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage())
+	flag.BoolVar(&flags.verbose, "verbose", false, "Verbose output.")
+	logging.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(flags.verbose); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(flags.format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+
+	account, err := lookupServiceAccount(flags.user)
+	if err != nil {
+		logging.Fatal("Error resolving service account", logging.Err(err))
+	}
+
+	start := time.Now()
+
+	out, err := output.NewWriter(flags.format, flags.output, output.Table{Name: "archive_perms"})
+	if err != nil {
+		logging.Fatal("Error creating output", logging.Err(err))
+	}
+	out.Write([]string{"Path", "Type", "Owner", "Group", "Mode", "Issue"})
+
+	entryCount := 0
+	issueCount := 0
+	for _, depotRoot := range flag.Args() {
+		entries, issues, walkErr := auditDepotRoot(depotRoot, account, flags.checkOwner, out)
+		entryCount += entries
+		issueCount += issues
+		if walkErr != nil {
+			slog.Error("Error walking depot root", logging.PathKey, depotRoot, logging.Err(walkErr))
+			err = walkErr
+		}
+	}
+
+	// The report of a failed run is incomplete, and os.Exit skips deferred calls
+	if err != nil {
+		out.Close()
+	} else if err = out.Commit(); err != nil {
+		slog.Error("Error writing output", logging.Err(err))
+	}
+
+	slog.Info("Audited entries", logging.CountKey, entryCount)
+	slog.Info("Found issues", logging.CountKey, issueCount)
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+
+	if err != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Keeps the rows written, in place of a file
+type rowsWriter struct{ rows [][]string }
+
+func (w *rowsWriter) Write(row []string) error { w.rows = append(w.rows, row); return nil }
+func (w *rowsWriter) Commit() error            { return nil }
+func (w *rowsWriter) Close() error             { return nil }
+
+func TestEffectivePermissions(t *testing.T) {
+	account := &serviceAccount{name: "perforce", uid: 1000, gids: map[uint32]bool{100: true}}
+	tests := []struct {
+		mode os.FileMode
+		uid  uint32
+		gid  uint32
+		want os.FileMode
+	}{
+		{0o640, 1000, 200, ReadPermission | WritePermission},
+		{0o640, 1001, 100, ReadPermission},
+		{0o640, 1001, 200, 0},
+		{os.ModeDir | 0o755, 1001, 200, ReadPermission | ExecutePermission},
+	}
+	for _, test := range tests {
+		if got := account.effectivePermissions(test.mode, test.uid, test.gid); got != test.want {
+			t.Errorf("effectivePermissions(%v, %v, %v) = %v, want %v", test.mode, test.uid, test.gid,
+				permissionString(got), permissionString(test.want))
+		}
+	}
+
+	root := &serviceAccount{name: "root", isRoot: true}
+	if got := root.effectivePermissions(0, 1000, 100); got != ReadPermission|WritePermission|ExecutePermission {
+		t.Errorf("effectivePermissions() of root = %v, want rwx", permissionString(got))
+	}
+}
+
+func TestAuditDepotRoot(t *testing.T) {
+	depotRoot := t.TempDir()
+	files := map[string]os.FileMode{
+		"depot/path1/README.txt,v": 0o644,
+		"depot/path1/data1.dat,d":  0o200,
+	}
+	for name, mode := range files {
+		path := filepath.Join(depotRoot, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("MkdirAll() returned %v", err)
+		}
+		if err := os.WriteFile(path, nil, mode); err != nil {
+			t.Fatalf("WriteFile() returned %v", err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatalf("Chmod() returned %v", err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(depotRoot, "depot"), 0o555); err != nil {
+		t.Fatalf("Chmod() returned %v", err)
+	}
+	t.Cleanup(func() { os.Chmod(filepath.Join(depotRoot, "depot"), 0o755) })
+
+	// Audits as the owner of the files without the privileges of root, who could read them anyway
+	account := &serviceAccount{name: "perforce", uid: uint32(os.Getuid()), gids: map[uint32]bool{}}
+	out := &rowsWriter{}
+	entryCount, issueCount, err := auditDepotRoot(depotRoot, account, false, out)
+	if err != nil {
+		t.Fatalf("auditDepotRoot() returned %v", err)
+	}
+	if entryCount != 5 || issueCount != 2 {
+		t.Errorf("auditDepotRoot() = %v, %v, want 5, 2", entryCount, issueCount)
+	}
+	var got [][]string
+	for _, row := range out.rows {
+		got = append(got, []string{row[0], row[1], row[4], row[5]})
+	}
+	want := [][]string{
+		{filepath.Join(depotRoot, "depot"), "directory", "-r-xr-xr-x", "perforce has r-x access, needs rwx"},
+		{filepath.Join(depotRoot, "depot/path1/data1.dat,d"), "file", "--w-------", "perforce has -w- access, needs r--"},
+	}
+	if len(got) == 2 && got[0][1] == "file" {
+		got[0], got[1] = got[1], got[0]
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("auditDepotRoot() wrote %q, want %q", got, want)
+	}
+
+	// Every entry has another owner than the service account
+	account.uid++
+	out = &rowsWriter{}
+	if _, issueCount, err = auditDepotRoot(depotRoot, account, true, out); err != nil {
+		t.Fatalf("auditDepotRoot() returned %v", err)
+	}
+	notOwned := 0
+	for _, row := range out.rows {
+		if row[5] == "not owned by perforce" {
+			notOwned++
+		}
+	}
+	if notOwned != 5 {
+		t.Errorf("auditDepotRoot() reported %v entries not owned by the account, want 5", notOwned)
+	}
+}
@@ -0,0 +1,392 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_archive_rebalance plans moving the largest archive directories of a depot root to
+// other volumes, so that their usage evens out, and writes the script doing the moves.
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+const (
+	// The whole depot moves, and the Map field of its spec points to the new location
+	depotMapMethod = "depot-map"
+	// The directory moves, and a symlink to the new location takes its place under the depot root
+	symlinkMethod = "symlink"
+)
+
+// The archives of a directory, at the depth given by -depth
+type directory struct {
+	// The depot path, such as //depot/project
+	path  string
+	bytes int64
+}
+
+// The depot root, or a volume archives may be moved to
+type volume struct {
+	path     string
+	capacity int64
+	// The bytes of archives on the volume, before and after the moves planned so far
+	initial int64
+	used    int64
+}
+
+// A directory to move, and where to
+type move struct {
+	directory directory
+	target    *volume
+	method    string
+}
+
+type volumeList []string
+
+func (l *volumeList) String() string {
+	return strings.Join(*l, "; ")
+}
+
+func (l *volumeList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+const bytesPerGB = 1 << 30
+
+func gigabytes(bytes int64) string {
+	return strconv.FormatFloat(float64(bytes)/bytesPerGB, 'f', 1, 64)
+}
+
+// Parses a volume given as PATH=GB
+func parseVolume(text string) (*volume, error) {
+	separator := strings.LastIndex(text, "=")
+	if separator <= 0 {
+		return nil, fmt.Errorf("invalid volume %q, expected PATH=GB", text)
+	}
+	size, err := strconv.ParseFloat(text[separator+1:], 64)
+	if err != nil || size <= 0 {
+		return nil, fmt.Errorf("invalid capacity of volume %q, expected PATH=GB", text)
+	}
+	return &volume{path: filepath.Clean(text[:separator]), capacity: int64(size * bytesPerGB)}, nil
+}
+
+// Returns the directory of an archive at depth, such as //depot/project for
+// //depot/project/src/main.c,v at depth 1, or false when the archive isn't that deep
+func archiveDirectory(lbrFile string, depth int) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(lbrFile, "//"), "/")
+	if len(parts) < depth+2 {
+		return "", false
+	}
+	return "//" + strings.Join(parts[:depth+1], "/"), true
+}
+
+// Sums the sizes of the archives of a p4_storage_to_csv extraction by directory at depth (0 for
+// depots), largest first, and returns them with the size of the archives outside of any, which
+// stay where they are
+func readDirectories(path string, depth int) ([]directory, int64, error) {
+	file, err := journal.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading %v: %v", path, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"LibrarianFile", "FileSize", "FileSizeOnServer"} {
+		if _, ok := columns[name]; !ok {
+			return nil, 0, fmt.Errorf("%v is not a p4_storage_to_csv extraction: no %v column", path, name)
+		}
+	}
+
+	sizes := make(map[string]int64)
+	unmovable := int64(0)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("error reading %v: %v", path, err)
+		}
+		size, _ := strconv.ParseInt(row[columns["FileSizeOnServer"]], 10, 64)
+		if size <= 0 {
+			size, _ = strconv.ParseInt(row[columns["FileSize"]], 10, 64)
+		}
+		name, ok := archiveDirectory(row[columns["LibrarianFile"]], depth)
+		if !ok {
+			unmovable += size
+			continue
+		}
+		sizes[name] += size
+	}
+
+	directories := make([]directory, 0, len(sizes))
+	for name, size := range sizes {
+		directories = append(directories, directory{name, size})
+	}
+	sort.Slice(directories, func(i, j int) bool {
+		if directories[i].bytes != directories[j].bytes {
+			return directories[i].bytes > directories[j].bytes
+		}
+		return directories[i].path < directories[j].path
+	})
+	return directories, unmovable, nil
+}
+
+// Moves directories, largest first, from the source to the target volumes as long as each move
+// brings the source closer to the fill of the whole set of volumes. A directory goes to the target
+// left the least full by it, without filling any beyond maxFill (a fraction of its capacity).
+func planMoves(directories []directory, source *volume, targets []*volume, maxFill float64, minBytes int64, method string) []move {
+	capacity, used := source.capacity, source.used
+	for _, target := range targets {
+		capacity += target.capacity
+		used += target.used
+	}
+	goal := float64(used) / float64(capacity)
+
+	var moves []move
+	for _, d := range directories {
+		if d.bytes < minBytes {
+			break
+		}
+		excess := source.used - int64(goal*float64(source.capacity))
+		if excess <= 0 {
+			break
+		}
+		// A directory of twice the excess or more would leave the source as far from the goal, or
+		// further
+		if d.bytes >= 2*excess {
+			continue
+		}
+		var best *volume
+		for _, target := range targets {
+			after := target.used + d.bytes
+			if float64(after) > maxFill*float64(target.capacity) {
+				continue
+			}
+			if best == nil || float64(after)/float64(target.capacity) < float64(best.used+d.bytes)/float64(best.capacity) {
+				best = target
+			}
+		}
+		if best == nil {
+			slog.Debug("No volume has room for the directory", logging.PathKey, d.path, logging.BytesKey, d.bytes)
+			continue
+		}
+		best.used += d.bytes
+		source.used -= d.bytes
+		moves = append(moves, move{d, best, method})
+	}
+	return moves
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// The location of a directory under the depot root, or under another volume
+func directoryPath(root string, depotPath string) string {
+	return filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(depotPath, "//")))
+}
+
+// Describes the usage of a volume before and after the moves
+func volumeOutcome(v *volume) string {
+	return fmt.Sprintf("%v: %v GB of %v GB (%.1f%%) -> %v GB (%.1f%%), %v GB free", v.path,
+		gigabytes(v.initial), gigabytes(v.capacity), 100*float64(v.initial)/float64(v.capacity),
+		gigabytes(v.used), 100*float64(v.used)/float64(v.capacity), gigabytes(v.capacity-v.used))
+}
+
+// Writes the shell script doing the moves, with the expected usage of the volumes in its header.
+// Each directory is copied, then the original is renamed with a .rebalance suffix, to be removed by
+// hand once the server is verified to read the new location.
+func writeScript(w io.Writer, depotRoot string, volumes []*volume, moves []move) error {
+	fmt.Fprintf(w, "#!/bin/sh\n")
+	fmt.Fprintf(w, "# Rebalancing of the archives of %v, written by p4_archive_rebalance.\n", depotRoot)
+	fmt.Fprintf(w, "#\n# Expected usage of the volumes, counting only the archives of the extraction:\n")
+	for _, v := range volumes {
+		fmt.Fprintf(w, "#   %v\n", volumeOutcome(v))
+	}
+	fmt.Fprintf(w, "#\n# Stop the server, or lock the depots, before running it: archives written during the copy\n")
+	fmt.Fprintf(w, "# would be lost. Remove the .rebalance directories once \"p4 verify -q\" passes.\n")
+	fmt.Fprintf(w, "set -e\n")
+	for _, m := range moves {
+		from := directoryPath(depotRoot, m.directory.path)
+		to := directoryPath(m.target.path, m.directory.path)
+		fmt.Fprintf(w, "\n# %v: %v GB to %v (%v)\n", m.directory.path, gigabytes(m.directory.bytes), m.target.path, m.method)
+		fmt.Fprintf(w, "mkdir -p %v\n", shellQuote(filepath.Dir(to)))
+		fmt.Fprintf(w, "rsync -a %v %v\n", shellQuote(from+"/"), shellQuote(to+"/"))
+		if m.method == depotMapMethod {
+			depot := strings.TrimPrefix(m.directory.path, "//")
+			fmt.Fprintf(w, "p4 depot -o %v | sed %v | p4 depot -i\n", shellQuote(depot),
+				shellQuote("s#^Map:.*#Map: "+filepath.ToSlash(to)+"/...#"))
+			fmt.Fprintf(w, "mv %v %v\n", shellQuote(from), shellQuote(from+".rebalance"))
+		} else {
+			fmt.Fprintf(w, "mv %v %v\n", shellQuote(from), shellQuote(from+".rebalance"))
+			fmt.Fprintf(w, "ln -s %v %v\n", shellQuote(to), shellQuote(from))
+		}
+	}
+	return nil
+}
+
+func main() {
+	flags := struct {
+		volumes        volumeList
+		sourceCapacity float64
+		depth          int
+		maxFill        float64
+		minSize        float64
+		script         string
+		output         string
+		format         string
+		verbose        bool
+	}{}
+
+	flag.Var(&flags.volumes, "volume", "Volume archives may be moved to, with the space available for them in GB, such as /mnt/archives2=4000 (repeatable).")
+	flag.Float64Var(&flags.sourceCapacity, "source-capacity", 0, "Capacity in GB of the volume of the depot root (read from the volume by default).")
+	flag.IntVar(&flags.depth, "depth", 1, "Depth of the directories moved: 0 moves whole depots by changing their Map, 1 their top-level directories, and so on, replaced by symlinks.")
+	flag.Float64Var(&flags.maxFill, "max-fill", 90, "Percentage of the capacity of a volume the moves may fill it up to.")
+	flag.Float64Var(&flags.minSize, "min-size", 1, "Size in GB under which directories aren't worth moving.")
+	flag.StringVar(&flags.script, "script", "", "File to write the shell script doing the moves to.")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File, or table for the database formats, to write the plan to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage())
+	flag.BoolVar(&flags.verbose, "verbose", false, "Verbose output.")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(flags.verbose); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 2 || len(flags.volumes) == 0 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(flags.format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+	if flags.depth < 0 {
+		logging.Fatal("Invalid -depth", "depth", flags.depth)
+	}
+	if flags.maxFill <= 0 || flags.maxFill > 100 {
+		logging.Fatal("Invalid -max-fill, expected a percentage", "max_fill", flags.maxFill)
+	}
+	depotRoot := filepath.Clean(flag.Arg(1))
+
+	source := &volume{path: depotRoot, capacity: int64(flags.sourceCapacity * bytesPerGB)}
+	if source.capacity <= 0 {
+		total, _, err := volumeSpace(depotRoot)
+		if err != nil {
+			logging.Fatal("Error reading the capacity of the depot root, specify -source-capacity", logging.Err(err))
+		}
+		source.capacity = total
+	}
+	var targets []*volume
+	for _, text := range flags.volumes {
+		target, err := parseVolume(text)
+		if err != nil {
+			logging.Fatal("Invalid -volume", logging.Err(err))
+		}
+		targets = append(targets, target)
+	}
+
+	start := time.Now()
+	directories, unmovable, err := readDirectories(flag.Arg(0), flags.depth)
+	if err != nil {
+		logging.Fatal("Error reading extraction", logging.PathKey, flag.Arg(0), logging.Err(err))
+	}
+	source.used = unmovable
+	for _, d := range directories {
+		source.used += d.bytes
+	}
+	source.initial = source.used
+	slog.Info("Read archive directories", logging.CountKey, len(directories), "depth", flags.depth,
+		"archives_gb", gigabytes(source.used), "unmovable_gb", gigabytes(unmovable))
+
+	method := symlinkMethod
+	if flags.depth == 0 {
+		method = depotMapMethod
+	}
+	moves := planMoves(directories, source, targets, flags.maxFill/100, int64(flags.minSize*bytesPerGB), method)
+
+	err = output.WriteTable(flags.format, flags.output, output.Table{Name: "rebalance_plan"}, func(out output.Writer) error {
+		out.Write([]string{"Path", "Bytes", "Method", "From", "To"})
+		for _, m := range moves {
+			out.Write([]string{
+				m.directory.path,
+				strconv.FormatInt(m.directory.bytes, 10),
+				m.method,
+				directoryPath(depotRoot, m.directory.path),
+				directoryPath(m.target.path, m.directory.path)})
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Fatal("Error writing plan", logging.Err(err))
+	}
+	volumes := append([]*volume{source}, targets...)
+	if len(flags.script) > 0 {
+		err = output.WriteFile(flags.script, func(w io.Writer) error {
+			return writeScript(w, depotRoot, volumes, moves)
+		})
+		if err != nil {
+			logging.Fatal("Error writing script", logging.PathKey, flags.script, logging.Err(err))
+		}
+	}
+
+	moved := int64(0)
+	for _, m := range moves {
+		moved += m.directory.bytes
+	}
+	slog.Info("Planned moves", logging.CountKey, len(moves), "moved_gb", gigabytes(moved))
+	for _, v := range volumes {
+		slog.Info("Expected volume usage", logging.PathKey, v.path, "capacity_gb", gigabytes(v.capacity),
+			"before_gb", gigabytes(v.initial), "after_gb", gigabytes(v.used), "free_after_gb", gigabytes(v.capacity-v.used))
+	}
+	if float64(source.used) > flags.maxFill/100*float64(source.capacity) {
+		slog.Warn("The depot root stays above -max-fill, add volumes or raise -depth to move smaller directories",
+			"fill_percent", strconv.FormatFloat(100*float64(source.used)/float64(source.capacity), 'f', 1, 64))
+	}
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+}
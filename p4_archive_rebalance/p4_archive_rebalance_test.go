@@ -0,0 +1,137 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVolume(t *testing.T) {
+	v, err := parseVolume("/mnt/archives=2=1.5")
+	if err != nil {
+		t.Fatalf("parseVolume() returned %v", err)
+	}
+	if v.path != "/mnt/archives=2" || v.capacity != 3*bytesPerGB/2 {
+		t.Errorf("parseVolume() = %v, %v, want /mnt/archives=2, %v", v.path, v.capacity, 3*bytesPerGB/2)
+	}
+	for _, text := range []string{"/mnt/archives", "=10", "/mnt/archives=0", "/mnt/archives=big"} {
+		if _, err := parseVolume(text); err == nil {
+			t.Errorf("parseVolume(%q) succeeded, want an error", text)
+		}
+	}
+}
+
+func TestArchiveDirectory(t *testing.T) {
+	tests := []struct {
+		lbrFile string
+		depth   int
+		want    string
+		wantOk  bool
+	}{
+		{"//depot/project/src/main.c,v", 0, "//depot", true},
+		{"//depot/project/src/main.c,v", 1, "//depot/project", true},
+		{"//depot/project/src/main.c,v", 2, "//depot/project/src", true},
+		{"//depot/project/src/main.c,v", 3, "", false},
+		{"//depot/README.txt,v", 1, "", false},
+	}
+	for _, test := range tests {
+		got, ok := archiveDirectory(test.lbrFile, test.depth)
+		if got != test.want || ok != test.wantOk {
+			t.Errorf("archiveDirectory(%q, %v) = %q, %v, want %q, %v", test.lbrFile, test.depth, got, ok, test.want, test.wantOk)
+		}
+	}
+}
+
+func TestReadDirectories(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.csv")
+	extraction := `LibrarianFile,LibrarianRevision,FileSize,FileSizeOnServer
+//depot/path1/README.txt,1.1,9,203
+//depot/path1/data1.dat,1.1,10485760,0
+//depot/path2/More.txt,1.3,13,120
+//depot/top.txt,1.1,5,50
+`
+	if err := os.WriteFile(path, []byte(extraction), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+	directories, unmovable, err := readDirectories(path, 1)
+	if err != nil {
+		t.Fatalf("readDirectories() returned %v", err)
+	}
+	want := []directory{{"//depot/path1", 10485963}, {"//depot/path2", 120}}
+	if !reflect.DeepEqual(directories, want) || unmovable != 50 {
+		t.Errorf("readDirectories() = %v, %v, want %v, 50", directories, unmovable, want)
+	}
+
+	if err := os.WriteFile(path, []byte("LibrarianFile,FileSize\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+	if _, _, err := readDirectories(path, 1); err == nil {
+		t.Errorf("readDirectories() of a CSV without FileSizeOnServer succeeded, want an error")
+	}
+}
+
+func TestPlanMoves(t *testing.T) {
+	directories := []directory{{"//depot/big", 8 * bytesPerGB}, {"//depot/a", bytesPerGB}, {"//depot/b", bytesPerGB}}
+	source := &volume{path: "/p4/depots", capacity: 10 * bytesPerGB, used: 10 * bytesPerGB}
+	full := &volume{path: "/mnt/full", capacity: 10 * bytesPerGB, used: 9 * bytesPerGB}
+	target := &volume{path: "/mnt/archives", capacity: 10 * bytesPerGB, used: 5 * bytesPerGB}
+	// The goal is 24 GB of 30 GB: //depot/big would leave the source further from it, and the full
+	// volume has no room under 90%
+	moves := planMoves(directories, source, []*volume{full, target}, 0.9, bytesPerGB, symlinkMethod)
+	want := []move{{directories[1], target, symlinkMethod}, {directories[2], target, symlinkMethod}}
+	if !reflect.DeepEqual(moves, want) {
+		t.Errorf("planMoves() = %v, want %v", moves, want)
+	}
+	if source.used != 8*bytesPerGB || target.used != 7*bytesPerGB || full.used != 9*bytesPerGB {
+		t.Errorf("planMoves() left %v, %v and %v bytes used, want %v, %v and %v", source.used, full.used, target.used,
+			8*bytesPerGB, 9*bytesPerGB, 7*bytesPerGB)
+	}
+
+	source.used = 10 * bytesPerGB
+	if moves := planMoves(directories, source, []*volume{target}, 0.9, 2*bytesPerGB, symlinkMethod); len(moves) != 0 {
+		t.Errorf("planMoves() with a minimum size of 2 GB = %v, want no moves", moves)
+	}
+}
+
+func TestWriteScript(t *testing.T) {
+	target := &volume{path: "/mnt/archives", capacity: 10 * bytesPerGB, initial: 5 * bytesPerGB, used: 6 * bytesPerGB}
+	moves := []move{
+		{directory{"//depot/it's", bytesPerGB}, target, symlinkMethod},
+		{directory{"//archive", bytesPerGB}, target, depotMapMethod},
+	}
+	var script bytes.Buffer
+	if err := writeScript(&script, "/p4/depots", []*volume{target}, moves); err != nil {
+		t.Fatalf("writeScript() returned %v", err)
+	}
+	for _, want := range []string{
+		"#   /mnt/archives: 5.0 GB of 10.0 GB (50.0%) -> 6.0 GB (60.0%), 4.0 GB free\n",
+		"rsync -a '/p4/depots/depot/it'\\''s/' '/mnt/archives/depot/it'\\''s/'\n" +
+			"mv '/p4/depots/depot/it'\\''s' '/p4/depots/depot/it'\\''s.rebalance'\n" +
+			"ln -s '/mnt/archives/depot/it'\\''s' '/p4/depots/depot/it'\\''s'\n",
+		"p4 depot -o 'archive' | sed 's#^Map:.*#Map: /mnt/archives/archive/...#' | p4 depot -i\n" +
+			"mv '/p4/depots/archive' '/p4/depots/archive.rebalance'\n",
+	} {
+		if !strings.Contains(script.String(), want) {
+			t.Errorf("writeScript() wrote %q, want it to contain %q", script.String(), want)
+		}
+	}
+}
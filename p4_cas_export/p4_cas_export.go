@@ -0,0 +1,452 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_cas_export copies the archive files of a depot root to a content-addressable store,
+// once per content: each unique archive is stored as objects/ab/cdef..., named after the MD5 digest
+// of the file, and a manifest maps the archive paths to their object. Depots branched without lazy
+// copies (across depots, or from remote depots) store the same content many times, which the store
+// keeps once, and later runs only copy the objects the store doesn't have yet.
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// An archive file to store: its path relative to the depot root (or absolute for depots mapped
+// elsewhere), and the MD5 digest of the file as stored, when db.storage records it
+type archiveFile struct {
+	path string
+	md5  string
+}
+
+// A line of the manifest, mapping an archive to its object
+type manifestEntry struct {
+	Path   string `json:"path"`
+	Object string `json:"object"`
+	Size   int64  `json:"size"`
+}
+
+// The totals of an export
+type exportStats struct {
+	archives     int
+	objects      int
+	copiedBytes  int64
+	dedupedBytes int64
+	missing      int
+	// Archives whose content doesn't match the digest of db.storage
+	mismatched int
+	failed     int
+}
+
+// Copies archives to the objects of a store
+type store struct {
+	depotRoot string
+	dir       string
+
+	mu      sync.Mutex
+	stats   exportStats
+	entries []manifestEntry
+	// The objects of the store, known to exist or being copied, with their size
+	objects map[string]int64
+}
+
+// Returns the name of the object of a digest, such as ab/cdef...
+func objectName(digest string) string {
+	return digest[:2] + "/" + digest[2:]
+}
+
+// Returns the size of an object already in the store, or false when it isn't
+func (s *store) lookup(digest string) (int64, bool) {
+	s.mu.Lock()
+	size, ok := s.objects[digest]
+	s.mu.Unlock()
+	if ok {
+		return size, true
+	}
+	info, err := os.Stat(filepath.Join(s.dir, "objects", filepath.FromSlash(objectName(digest))))
+	if err != nil {
+		return 0, false
+	}
+	s.mu.Lock()
+	s.objects[digest] = info.Size()
+	s.mu.Unlock()
+	return info.Size(), true
+}
+
+// Returns the MD5 digest of a file
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Copies a file to a temporary file of the store, returning its MD5 digest
+func (s *store) copyFile(path string) (string, string, int64, error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer source.Close()
+	temp, err := os.CreateTemp(filepath.Join(s.dir, "objects"), ".object.*.tmp")
+	if err != nil {
+		return "", "", 0, err
+	}
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(temp, hash), source)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return "", "", 0, err
+	}
+	return temp.Name(), hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// Moves a temporary file to the object of its digest, unless the store already has it
+func (s *store) addObject(tempPath string, digest string, size int64) (bool, error) {
+	s.mu.Lock()
+	_, exists := s.objects[digest]
+	if !exists {
+		s.objects[digest] = size
+	}
+	s.mu.Unlock()
+	objectPath := filepath.Join(s.dir, "objects", filepath.FromSlash(objectName(digest)))
+	if !exists {
+		if _, err := os.Stat(objectPath); err == nil {
+			exists = true
+		}
+	}
+	if exists {
+		return false, os.Remove(tempPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		os.Remove(tempPath)
+		return false, err
+	}
+	if err := os.Chmod(tempPath, 0444); err != nil {
+		os.Remove(tempPath)
+		return false, err
+	}
+	if err := os.Rename(tempPath, objectPath); err != nil {
+		os.Remove(tempPath)
+		return false, err
+	}
+	return true, nil
+}
+
+// Stores an archive, copying it only when the store doesn't have its content yet
+func (s *store) export(a archiveFile) {
+	path := a.path
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(s.depotRoot, path)
+	}
+	digest := a.md5
+	size, ok := int64(0), false
+	if len(digest) > 0 {
+		size, ok = s.lookup(digest)
+	}
+	copied := false
+	var err error
+	if ok {
+		// The content is in the store, as long as the archive is still there
+		_, err = os.Stat(path)
+	} else if len(digest) == 0 {
+		// Without a recorded digest, the archive is read to know whether the store has its content,
+		// which is cheaper than writing it again
+		if digest, err = fileDigest(path); err == nil {
+			size, ok = s.lookup(digest)
+		}
+	}
+	if !ok && err == nil {
+		var tempPath, actual string
+		var copiedSize int64
+		tempPath, actual, copiedSize, err = s.copyFile(path)
+		if err == nil && actual != digest {
+			s.mu.Lock()
+			s.stats.mismatched++
+			s.mu.Unlock()
+			slog.Warn("Archive doesn't match its digest, stored under its actual digest",
+				logging.PathKey, path, "expected_md5", digest, "md5", actual)
+		}
+		if err == nil {
+			digest, size = actual, copiedSize
+			copied, err = s.addObject(tempPath, digest, size)
+		}
+	}
+	if err != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if errors.Is(err, fs.ErrNotExist) {
+			s.stats.missing++
+			slog.Warn("Missing archive", logging.PathKey, path, logging.Err(err))
+		} else {
+			s.stats.failed++
+			slog.Error("Error storing archive", logging.PathKey, path, logging.Err(err))
+		}
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.archives++
+	if copied {
+		s.stats.objects++
+		s.stats.copiedBytes += size
+	} else {
+		s.stats.dedupedBytes += size
+	}
+	s.entries = append(s.entries, manifestEntry{Path: filepath.ToSlash(a.path), Object: objectName(digest), Size: size})
+}
+
+// Lists the archive files of a checkpoint from db.storage and db.storagesh, each RCS file once
+func listArchives(checkpointPath string, depots archive.DepotMaps, fn func(a archiveFile) error) (int, error) {
+	records := 0
+	// The archives of db.storage that belong to shelved files, which db.revsh lists first
+	shelved := make(map[string]bool)
+	listedShelves := make(map[string]bool)
+	// db.storage lists the revisions of an RCS file one after the other
+	lastRCSFile := ""
+	tables := map[string]bool{"db.revsh": true, "db.storage": true, "db.storagesh": true}
+	err := journal.ScanFile(checkpointPath, tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		if record.Table == "db.revsh" {
+			rev, err := archive.ParseRevRecord(record.Fields)
+			if err != nil {
+				slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			shelved[rev.LbrFile+"\x00"+rev.LbrRev] = true
+			return nil
+		}
+		storage, err := archive.ParseStorageRecord(record.Fields)
+		if err != nil {
+			slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		records++
+		lbrType := storage.LbrType
+		if record.Table == "db.storagesh" || shelved[storage.LbrFile+"\x00"+storage.LbrRev] {
+			lbrType = archive.ShelvedStorageType(lbrType)
+			key := archive.VersionedFilePath(storage.LbrFile, storage.LbrRev, lbrType)
+			if listedShelves[key] {
+				return nil
+			}
+			listedShelves[key] = true
+		}
+
+		path := archive.ArchiveFilePath("", depots, storage.LbrFile, storage.LbrRev, lbrType)
+		a := archiveFile{path: path}
+		switch archive.StorageType(lbrType) {
+		case archive.RCSStorageType:
+			// RCS files hold several revisions, so their digest isn't recorded
+			a.path = filepath.Dir(path)
+			if a.path == lastRCSFile {
+				return nil
+			}
+			lastRCSFile = a.path
+		case archive.BinaryStorageType, archive.TempObjStorageType:
+			a.md5 = storage.Digest
+		case archive.CompressedStorageType, archive.CompressedTempObj:
+			a.md5 = storage.CompCksum
+		default:
+			// Not stored in a file of its own, such as tiny files stored in db.revtx
+			return nil
+		}
+		// Servers leave the digests empty or zeroed when unknown
+		if len(strings.Trim(a.md5, "0")) == 0 {
+			a.md5 = ""
+		}
+		a.md5 = strings.ToLower(a.md5)
+		return fn(a)
+	})
+	return records, err
+}
+
+// Returns the path of the manifest of interrupted runs: manifest.partial.jsonl for manifest.jsonl
+func partialManifestPath(manifest string) string {
+	extension := filepath.Ext(manifest)
+	return strings.TrimSuffix(manifest, extension) + ".partial" + extension
+}
+
+func writeManifest(w io.Writer, entries []manifestEntry) error {
+	encoder := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	flags := struct {
+		depotRoot string
+		dest      string
+		manifest  string
+		workers   int
+	}{}
+
+	flag.StringVar(&flags.depotRoot, "depot-root", "", "Depot root to copy the archives of the checkpoint given as argument from.")
+	flag.StringVar(&flags.dest, "dest", "", "Directory of the content-addressable store, created if needed.")
+	flag.StringVar(&flags.manifest, "manifest", "", "File to write the manifest to, replaced only once complete (manifest.jsonl in -dest by default).")
+	flag.IntVar(&flags.workers, "workers", 4, "Number of archives copied at once.")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(false); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 || len(flags.depotRoot) == 0 || len(flags.dest) == 0 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if flags.workers < 1 {
+		logging.Fatal("Invalid number of workers", "workers", flags.workers)
+	}
+	checkpointPath := flag.Arg(0)
+	if checkpointPath == journal.Stdin {
+		logging.Fatal("The checkpoint is read twice, so it can't be the standard input")
+	}
+	if len(flags.manifest) == 0 {
+		flags.manifest = filepath.Join(flags.dest, "manifest.jsonl")
+	}
+
+	start := time.Now()
+	file, err := journal.Open(checkpointPath)
+	if err != nil {
+		logging.Fatal("Error opening checkpoint", logging.PathKey, checkpointPath, logging.Err(err))
+	}
+	depots, err := archive.ReadDepotMaps(file)
+	file.Close()
+	if err != nil {
+		logging.Fatal("Error reading depot maps", logging.PathKey, checkpointPath, logging.Err(err))
+	}
+	for depot, dir := range depots {
+		slog.Info("Remapped depot", logging.DepotKey, depot, logging.PathKey, dir)
+	}
+	if err := os.MkdirAll(filepath.Join(flags.dest, "objects"), 0755); err != nil {
+		logging.Fatal("Error creating the store", logging.PathKey, flags.dest, logging.Err(err))
+	}
+
+	// Interrupting the run stops it cleanly: the partial manifest lists the archives stored so far
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	s := &store{depotRoot: flags.depotRoot, dir: flags.dest, objects: make(map[string]int64)}
+	archives := make(chan archiveFile, flags.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < flags.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range archives {
+				s.export(a)
+			}
+		}()
+	}
+	records, err := listArchives(checkpointPath, depots, func(a archiveFile) error {
+		select {
+		case archives <- a:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(archives)
+	wg.Wait()
+	// The manifest of an interrupted run goes next to the manifest, which keeps listing every archive
+	// of the last complete run
+	manifestPath := flags.manifest
+	interrupted := errors.Is(err, context.Canceled)
+	if interrupted {
+		manifestPath = partialManifestPath(flags.manifest)
+		slog.Warn("Interrupted, writing the partial manifest of the archives stored so far", logging.PathKey, manifestPath)
+	} else if err != nil {
+		logging.Fatal("Error processing checkpoint", logging.PathKey, checkpointPath, logging.Err(err))
+	}
+	if records == 0 && !interrupted {
+		logging.Fatal("No db.storage records, servers before 2019.1 are not supported")
+	}
+
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].Path < s.entries[j].Path })
+	err = output.WriteFile(manifestPath, func(w io.Writer) error {
+		return writeManifest(w, s.entries)
+	})
+	if err != nil {
+		logging.Fatal("Error writing manifest", logging.PathKey, manifestPath, logging.Err(err))
+	}
+	if !interrupted {
+		// The partial manifest of an earlier run is superseded
+		partial := partialManifestPath(flags.manifest)
+		if err := os.Remove(partial); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Error removing partial manifest", logging.PathKey, partial, logging.Err(err))
+		}
+	}
+
+	stats := s.stats
+	slog.Info("Stored archives", logging.CountKey, stats.archives, "new_objects", stats.objects,
+		"copied_bytes", stats.copiedBytes, "deduplicated_bytes", stats.dedupedBytes)
+	if stats.missing > 0 || stats.mismatched > 0 || stats.failed > 0 {
+		slog.Warn("Archives not stored as recorded", "missing", stats.missing, "mismatched", stats.mismatched, "failed", stats.failed)
+	}
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+	if stats.missing > 0 || stats.failed > 0 || interrupted {
+		os.Exit(1)
+	}
+}
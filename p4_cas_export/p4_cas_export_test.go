@@ -0,0 +1,148 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+)
+
+// A binary archive stored in full, with its digest in uppercase as servers record it
+const binaryStorage = "@pv@ 1 @db.storage@ @//depot/path3/file.bin@ @1.1@ 65537 1 " +
+	"5D41402ABC4B2A76B9719D911017C592 5 5 00000000000000000000000000000000 1611008048 \n"
+
+func TestListArchives(t *testing.T) {
+	example, err := os.ReadFile("../perforceutils/testdata/example_journal.txt")
+	if err != nil {
+		t.Fatalf("ReadFile() returned %v", err)
+	}
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	if err := os.WriteFile(checkpoint, append(example, binaryStorage...), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+	file, err := journal.Open(checkpoint)
+	if err != nil {
+		t.Fatalf("Open() returned %v", err)
+	}
+	depots, err := archive.ReadDepotMaps(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("ReadDepotMaps() returned %v", err)
+	}
+
+	var archives []archiveFile
+	records, err := listArchives(checkpoint, depots, func(a archiveFile) error {
+		archives = append(archives, a)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("listArchives() returned %v", err)
+	}
+	if records != 7 {
+		t.Errorf("listArchives() read %v records, want 7", records)
+	}
+	// The RCS files are listed once, and the zeroed digests of the compressed archives are dropped
+	want := []archiveFile{
+		{"depot/path1/data1.dat,d/1.1.gz", ""},
+		{"depot/path1/data1.dat,d/1.2.gz", ""},
+		{"depot/path1/data2.dat,d/1.1.gz", ""},
+		{"depot/path1/README.txt,v", ""},
+		{"depot/path2/More.txt,v", ""},
+		{"depot/path3/file.bin,d/1.1", "5d41402abc4b2a76b9719d911017c592"},
+	}
+	if !reflect.DeepEqual(archives, want) {
+		t.Errorf("listArchives() = %q, want %q", archives, want)
+	}
+}
+
+func TestExport(t *testing.T) {
+	depotRoot := t.TempDir()
+	archives := map[string]string{
+		"depot/a,d/1.1": "hello",
+		"depot/b,d/1.1": "hello",
+		"other/c,d/1.1": "world",
+		"depot/wrong,v": "hello",
+		"depot/empty,v": "",
+	}
+	for name, content := range archives {
+		path := filepath.Join(depotRoot, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("MkdirAll() returned %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile() returned %v", err)
+		}
+	}
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0o755); err != nil {
+		t.Fatalf("MkdirAll() returned %v", err)
+	}
+	s := &store{depotRoot: depotRoot, dir: dir, objects: make(map[string]int64)}
+
+	const hello = "5d41402abc4b2a76b9719d911017c592"
+	const world = "7d793037a0760186574b0282f2f435e7"
+	s.export(archiveFile{"depot/a,d/1.1", hello})
+	s.export(archiveFile{"depot/b,d/1.1", hello})
+	s.export(archiveFile{"other/c,d/1.1", ""})
+	// Stored under the digest of its content, which the store already has
+	s.export(archiveFile{"depot/wrong,v", "0123456789abcdef0123456789abcdef"})
+	s.export(archiveFile{"depot/missing,d/1.1", ""})
+	want := exportStats{archives: 4, objects: 2, copiedBytes: 10, dedupedBytes: 10, missing: 1, mismatched: 1}
+	if s.stats != want {
+		t.Errorf("export() stats = %+v, want %+v", s.stats, want)
+	}
+	for digest, content := range map[string]string{hello: "hello", world: "world"} {
+		object, err := os.ReadFile(filepath.Join(dir, "objects", filepath.FromSlash(objectName(digest))))
+		if err != nil || string(object) != content {
+			t.Errorf("object %v = %q, %v, want %q", digest, object, err, content)
+		}
+	}
+
+	// Later runs find the objects of earlier ones in the store
+	s = &store{depotRoot: depotRoot, dir: dir, objects: make(map[string]int64)}
+	s.export(archiveFile{"depot/b,d/1.1", ""})
+	s.export(archiveFile{"depot/empty,v", ""})
+	want = exportStats{archives: 2, objects: 1, dedupedBytes: 5}
+	if s.stats != want {
+		t.Errorf("export() stats of the second run = %+v, want %+v", s.stats, want)
+	}
+
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].Path < s.entries[j].Path })
+	var manifest bytes.Buffer
+	if err := writeManifest(&manifest, s.entries); err != nil {
+		t.Fatalf("writeManifest() returned %v", err)
+	}
+	wantManifest := `{"path":"depot/b,d/1.1","object":"5d/41402abc4b2a76b9719d911017c592","size":5}
+{"path":"depot/empty,v","object":"d4/1d8cd98f00b204e9800998ecf8427e","size":0}
+`
+	if manifest.String() != wantManifest {
+		t.Errorf("writeManifest() wrote %v, want %v", manifest.String(), wantManifest)
+	}
+}
+
+func TestPartialManifestPath(t *testing.T) {
+	if got, want := partialManifestPath("/cas/manifest.jsonl"), "/cas/manifest.partial.jsonl"; got != want {
+		t.Errorf("partialManifestPath() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,11 @@
+module github.com/google/perforce-utils/p4_change_to_git_fastexport
+
+go 1.21
+
+require github.com/google/perforce-utils/perforceutils v0.0.0
+
+require (
+	github.com/karrick/godirwalk v1.16.1 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	golang.org/x/text v0.3.6 // indirect
+)
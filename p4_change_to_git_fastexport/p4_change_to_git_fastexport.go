@@ -0,0 +1,526 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_change_to_git_fastexport converts the history of a depot path into a git
+// fast-import stream, from a checkpoint and the archives of the depot root. It migrates or mirrors
+// small projects to Git without a running server.
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/lbr"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/rcs"
+	"github.com/google/perforce-utils/perforceutils/schema"
+	"github.com/google/perforce-utils/perforceutils/wildcard"
+)
+
+// Git file modes of fast-import
+const (
+	regularMode    = "100644"
+	executableMode = "100755"
+	symlinkMode    = "120000"
+)
+
+// A file revision of db.rev under the exported path
+type revision struct {
+	depotFile string
+	// The path of the file in the Git repository
+	path     string
+	fileType int
+	action   archive.FileAction
+	lbrFile  string
+	lbrRev   string
+	lbrType  int
+}
+
+// A submitted changelist, with its full description from db.desc
+type change struct {
+	number      int
+	user        string
+	date        int64
+	description string
+	revisions   []revision
+}
+
+// Depot paths escape @, #, % and * as %40, %23, %25 and %2A
+var depotPathUnescaper = strings.NewReplacer("%40", "@", "%23", "#", "%2A", "*", "%2a", "*", "%25", "%")
+
+// Returns the path of a depot file relative to the exported depot path, such as src/main.c for
+// //depot/project/src/main.c under //depot/project, or false if it's outside of it
+func relativePath(depotFile string, depotPath string) (string, bool) {
+	if !strings.HasPrefix(depotFile, depotPath+"/") {
+		return "", false
+	}
+	return depotPathUnescaper.Replace(depotFile[len(depotPath)+1:]), true
+}
+
+// Reads the revisions of the files under a depot path from db.rev, grouped by changelist. Changes
+// up to afterChange are left out.
+func readRevisions(checkpointPath string, depotPath string, filter *wildcard.Filter, afterChange int) (map[int]*change, error) {
+	changes := make(map[int]*change)
+	err := journal.ScanFile(checkpointPath, map[string]bool{"db.rev": true}, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		var rev schema.Rev
+		if err := schema.Unmarshal(record, &rev); err != nil || len(rev.DepotFile) == 0 {
+			slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		path, ok := relativePath(rev.DepotFile, depotPath)
+		if !ok || rev.Change <= afterChange || !filter.Match(rev.DepotFile) {
+			return nil
+		}
+		c := changes[rev.Change]
+		if c == nil {
+			c = &change{number: rev.Change, date: rev.Date}
+			changes[rev.Change] = c
+		}
+		c.revisions = append(c.revisions, revision{
+			depotFile: rev.DepotFile,
+			path:      path,
+			fileType:  rev.Type,
+			action:    archive.FileAction(rev.Action),
+			lbrFile:   rev.LbrFile,
+			lbrRev:    rev.LbrRev,
+			lbrType:   rev.LbrType,
+		})
+		return nil
+	})
+	return changes, err
+}
+
+// Fills the user, date and description of changes from db.change and db.desc, and returns the
+// users of db.user
+func readChanges(checkpointPath string, changes map[int]*change) (map[string]schema.User, error) {
+	users := make(map[string]schema.User)
+	// Descriptions are keyed by the original number of the changelist, renumbered on submit.
+	// Checkpoints list db.change before db.desc.
+	descKeys := make(map[int]*change)
+	tables := map[string]bool{"db.change": true, "db.desc": true, "db.user": true}
+	err := journal.ScanFile(checkpointPath, tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		var err error
+		switch record.Table {
+		case "db.change":
+			var c schema.Change
+			if err = schema.Unmarshal(record, &c); err == nil && changes[c.Change] != nil {
+				changes[c.Change].user = c.User
+				changes[c.Change].date = c.Date
+				// Truncated to 31 characters, replaced by the one of db.desc when found
+				changes[c.Change].description = c.Description
+				descKeys[c.DescKey] = changes[c.Change]
+			}
+		case "db.desc":
+			var desc schema.Desc
+			if err = schema.Unmarshal(record, &desc); err == nil {
+				if c := descKeys[desc.DescKey]; c != nil {
+					c.description = desc.Description
+				}
+			}
+		case "db.user":
+			var user schema.User
+			if err = schema.Unmarshal(record, &user); err == nil {
+				users[user.User] = user
+			}
+		}
+		if err != nil {
+			slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+		}
+		return nil
+	})
+	return users, err
+}
+
+// Reads a full file archive, uncompressing it when its name ends with .gz
+func readArchive(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var content io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("error uncompressing %v: %v", path, err)
+		}
+		defer gzipReader.Close()
+		content = gzipReader
+	}
+	return io.ReadAll(content)
+}
+
+// Writes changes as a git fast-import stream
+type exporter struct {
+	w         io.Writer
+	depotRoot string
+	depots    lbr.DepotMaps
+	branch    string
+	// The parent of the first commit, when appending to an existing branch
+	from        string
+	emailDomain string
+	trailer     bool
+	users       map[string]schema.User
+
+	// The last RCS file read, since the revisions of a file often follow each other
+	rcsFile *rcs.File
+	rcsPath string
+	rcsErr  error
+
+	commits int
+	files   int
+	// Revisions whose content couldn't be exported, such as missing archives
+	skipped int
+}
+
+// Reads the content of a revision from its archive
+func (e *exporter) content(rev revision) ([]byte, error) {
+	path := e.depots.Path(e.depotRoot, lbr.VersionedFilePath(rev.lbrFile, rev.lbrRev, rev.lbrType))
+	switch lbr.StorageType(rev.lbrType) {
+	case lbr.RCSStorageType:
+		// All the revisions are in the ,v file
+		path = filepath.Dir(path)
+		if path != e.rcsPath {
+			e.rcsFile, e.rcsErr = rcs.ReadFile(path)
+			e.rcsPath = path
+		}
+		if e.rcsErr != nil {
+			return nil, e.rcsErr
+		}
+		return e.rcsFile.Content(rev.lbrRev)
+	case lbr.TinyStorageType:
+		return nil, errors.New("tiny files are stored in db.revtx, which isn't read")
+	}
+	// Compressed types may have been restored uncompressed, and the other way around
+	content, err := readArchive(path + ".gz")
+	if errors.Is(err, fs.ErrNotExist) {
+		content, err = readArchive(path)
+	}
+	return content, err
+}
+
+// Returns the git mode of a db.rev file type
+func fileMode(fileType int) string {
+	t, err := lbr.DecodeFileType(fileType)
+	switch {
+	case err != nil:
+		return regularMode
+	case t.Base == "symlink":
+		return symlinkMode
+	case t.Executable:
+		return executableMode
+	}
+	return regularMode
+}
+
+// Quotes a path for fast-import when it can't be given as is
+func quotePath(path string) string {
+	if !strings.ContainsAny(path, "\"\n\\") {
+		return path
+	}
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(path); i++ {
+		switch path[i] {
+		case '"', '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(path[i])
+		case '\n':
+			quoted.WriteString("\\n")
+		default:
+			quoted.WriteByte(path[i])
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// Returns the "Name <email>" identity of a user, from db.user
+func (e *exporter) identity(name string) string {
+	user, ok := e.users[name]
+	fullName, email := name, user.Email
+	if ok && len(strings.TrimSpace(user.FullName)) > 0 {
+		fullName = user.FullName
+	}
+	if len(email) == 0 {
+		email = name
+		if len(e.emailDomain) > 0 {
+			email += "@" + e.emailDomain
+		}
+	}
+	// Angle brackets and line breaks would end the identity
+	clean := strings.NewReplacer("<", "", ">", "", "\n", " ")
+	return fmt.Sprintf("%v <%v>", clean.Replace(fullName), clean.Replace(email))
+}
+
+// Writes the data command of fast-import
+func writeData(w io.Writer, data []byte) error {
+	if _, err := fmt.Fprintf(w, "data %d\n", len(data)); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// Writes a changelist as a commit
+func (e *exporter) writeCommit(c *change) error {
+	message := strings.TrimRight(strings.ReplaceAll(c.description, "\r\n", "\n"), " \t\n") + "\n"
+	if e.trailer {
+		message += fmt.Sprintf("\nPerforce-Change: %d\n", c.number)
+	}
+	identity := fmt.Sprintf("%v %d +0000", e.identity(c.user), c.date)
+	_, err := fmt.Fprintf(e.w, "commit %v\nauthor %v\ncommitter %v\n", e.branch, identity, identity)
+	if err != nil {
+		return err
+	}
+	if err := writeData(e.w, []byte(message)); err != nil {
+		return err
+	}
+	if len(e.from) > 0 {
+		if _, err := fmt.Fprintf(e.w, "from %v\n", e.from); err != nil {
+			return err
+		}
+		e.from = ""
+	}
+
+	sort.Slice(c.revisions, func(i, j int) bool { return c.revisions[i].path < c.revisions[j].path })
+	for _, rev := range c.revisions {
+		switch rev.action {
+		case archive.DeleteFileAction, archive.MoveFromFileAction:
+			if _, err := fmt.Fprintf(e.w, "D %v\n", quotePath(rev.path)); err != nil {
+				return err
+			}
+			e.files++
+			continue
+		case archive.PurgeFileAction, archive.ArchiveFileAction:
+			slog.Warn("Skipping revision without content", logging.PathKey, rev.depotFile, "change", c.number,
+				"action", int(rev.action))
+			e.skipped++
+			continue
+		}
+		content, err := e.content(rev)
+		if err != nil {
+			slog.Warn("Could not read archive", logging.PathKey, rev.depotFile, "change", c.number,
+				logging.RevisionKey, rev.lbrRev, logging.Err(err))
+			e.skipped++
+			continue
+		}
+		if _, err := fmt.Fprintf(e.w, "M %v inline %v\n", fileMode(rev.fileType), quotePath(rev.path)); err != nil {
+			return err
+		}
+		if err := writeData(e.w, content); err != nil {
+			return err
+		}
+		e.files++
+	}
+	if _, err := io.WriteString(e.w, "\n"); err != nil {
+		return err
+	}
+	e.commits++
+	return nil
+}
+
+// Writes changes in order. The stream ends with "done", so that git fast-import rejects a
+// truncated one.
+func (e *exporter) writeChanges(changes map[int]*change) error {
+	numbers := make([]int, 0, len(changes))
+	for number := range changes {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	if _, err := io.WriteString(e.w, "feature done\n"); err != nil {
+		return err
+	}
+	for _, number := range numbers {
+		if err := e.writeCommit(changes[number]); err != nil {
+			return err
+		}
+		if e.commits%1000 == 0 {
+			slog.Info("Exported changes", logging.CountKey, e.commits, "change", number)
+		}
+	}
+	_, err := io.WriteString(e.w, "done\n")
+	return err
+}
+
+// Reads the depots stored outside of a directory named after them, from the start of a checkpoint
+func readDepotMaps(checkpointPath string) lbr.DepotMaps {
+	file, err := journal.Open(checkpointPath)
+	if err != nil {
+		slog.Warn("Could not read depot maps", logging.Err(err))
+		return nil
+	}
+	defer file.Close()
+
+	depots, err := lbr.ReadDepotMaps(file)
+	if err != nil {
+		slog.Warn("Could not read depot maps", logging.Err(err))
+		return nil
+	}
+	for depot, dir := range depots {
+		slog.Info("Remapped depot", "depot", depot, logging.PathKey, dir)
+	}
+	return depots
+}
+
+type filterList []string
+
+func (f *filterList) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *filterList) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func main() {
+	flags := struct {
+		branch        string
+		afterChange   int
+		emailDomain   string
+		trailer       bool
+		filters       filterList
+		caseSensitive bool
+		depotMaps     bool
+		output        string
+		verbose       bool
+	}{}
+
+	flag.StringVar(&flags.branch, "branch", "refs/heads/main", "Git branch to write the commits to.")
+	flag.IntVar(&flags.afterChange, "after-change", 0, "Only export the changes after this one, appending them to the existing branch (for incremental mirroring).")
+	flag.StringVar(&flags.emailDomain, "email-domain", "", "Domain of the email of users without one in db.user, such as example.com for user@example.com.")
+	flag.BoolVar(&flags.trailer, "trailer", true, "Add a Perforce-Change trailer with the changelist number to the commit messages.")
+	flag.Var(&flags.filters, "filter", "Depot path pattern narrowing the export, such as //depot/project/src/..., or excluding paths when starting with -, such as -//depot/project/.../*.zip (repeatable, last match wins).")
+	flag.BoolVar(&flags.caseSensitive, "case-sensitive", false, "Match -filter patterns case sensitively.")
+	flag.BoolVar(&flags.depotMaps, "depot-maps", true, "Locate the archives of depots from their Map field in db.depot.")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File to write the fast-import stream to, replaced only once complete (the standard output by default).")
+	flag.BoolVar(&flags.verbose, "verbose", false, "Verbose output.")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(flags.verbose); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 3 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	checkpointPath, depotRoot := flag.Arg(0), flag.Arg(1)
+	depotPath := strings.TrimSuffix(strings.TrimSuffix(flag.Arg(2), "..."), "/")
+	if !strings.HasPrefix(depotPath, "//") || len(depotPath) == len("//") {
+		logging.Fatal("The depot path must be a depot or a directory, such as //depot/project", logging.PathKey, flag.Arg(2))
+	}
+	// The checkpoint is read twice
+	if checkpointPath == journal.Stdin {
+		logging.Fatal("The checkpoint can't be read from the standard input")
+	}
+
+	var filter *wildcard.Filter
+	if len(flags.filters) > 0 {
+		var err error
+		if filter, err = wildcard.NewFilter(flags.filters, !flags.caseSensitive); err != nil {
+			logging.Fatal("Invalid -filter", logging.Err(err))
+		}
+	}
+
+	start := time.Now()
+	var depots lbr.DepotMaps
+	if flags.depotMaps {
+		depots = readDepotMaps(checkpointPath)
+	}
+	changes, err := readRevisions(checkpointPath, depotPath, filter, flags.afterChange)
+	if err != nil {
+		logging.Fatal("Error reading revisions", logging.PathKey, checkpointPath, logging.Err(err))
+	}
+	slog.Info("Read revisions", logging.PathKey, depotPath, "changes", len(changes))
+	users, err := readChanges(checkpointPath, changes)
+	if err != nil {
+		logging.Fatal("Error reading changes", logging.PathKey, checkpointPath, logging.Err(err))
+	}
+
+	e := &exporter{
+		depotRoot:   depotRoot,
+		depots:      depots,
+		branch:      flags.branch,
+		emailDomain: flags.emailDomain,
+		trailer:     flags.trailer,
+		users:       users,
+	}
+	if flags.afterChange > 0 {
+		e.from = flags.branch + "^0"
+	}
+	err = output.WriteFile(flags.output, func(w io.Writer) error {
+		e.w = w
+		return e.writeChanges(changes)
+	})
+	if err != nil {
+		logging.Fatal("Error writing the fast-import stream", logging.PathKey, flags.output, logging.Err(err))
+	}
+
+	slog.Info("Exported changes", logging.CountKey, e.commits, "files", e.files, "skipped", e.skipped,
+		"last_change", lastChange(changes))
+	slog.Info("Execution took", logging.DurationKey, time.Since(start).String())
+
+	if e.skipped > 0 {
+		os.Exit(2)
+	}
+}
+
+// Returns the highest changelist exported, to pass as -after-change to the next run
+func lastChange(changes map[int]*change) int {
+	last := 0
+	for number := range changes {
+		if number > last {
+			last = number
+		}
+	}
+	return last
+}
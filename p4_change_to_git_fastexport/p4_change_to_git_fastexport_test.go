@@ -0,0 +1,226 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/perforce-utils/perforceutils/wildcard"
+)
+
+const examplePath = "../perforceutils/testdata/example_journal.txt"
+
+// The two revisions of //depot/path1/README.txt
+const readmeRCS = `head	1.2;
+access;
+symbols;
+locks; strict;
+comment	@# @;
+
+
+1.2
+date	2021.01.18.22.14.00;	author p4;	state Exp;
+branches;
+next	1.1;
+
+1.1
+date	2021.01.18.22.13.58;	author p4;	state Exp;
+branches;
+next	;
+
+
+desc
+@@
+
+
+1.2
+log
+@@
+text
+@Read me
+Twice
+@
+
+
+1.1
+log
+@@
+text
+@d2 1
+@
+`
+
+func TestRelativePath(t *testing.T) {
+	tests := []struct {
+		depotFile string
+		want      string
+		wantOk    bool
+	}{
+		{"//depot/project/src/main.c", "src/main.c", true},
+		{"//depot/project/%40home%23%2A%25.txt", "@home#*%.txt", true},
+		{"//depot/project2/main.c", "", false},
+		{"//depot/project", "", false},
+	}
+	for _, test := range tests {
+		got, ok := relativePath(test.depotFile, "//depot/project")
+		if got != test.want || ok != test.wantOk {
+			t.Errorf("relativePath(%q) = %q, %v, want %q, %v", test.depotFile, got, ok, test.want, test.wantOk)
+		}
+	}
+}
+
+func TestQuotePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"src/main c", "src/main c"},
+		{`say "hi"`, `"say \"hi\""`},
+		{"back\\slash\nnew line", `"back\\slash\nnew line"`},
+	}
+	for _, test := range tests {
+		if got := quotePath(test.path); got != test.want {
+			t.Errorf("quotePath(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	changes, err := readRevisions(examplePath, "//depot", nil, 0)
+	if err != nil {
+		t.Fatalf("readRevisions() returned %v", err)
+	}
+	users, err := readChanges(examplePath, changes)
+	if err != nil {
+		t.Fatalf("readChanges() returned %v", err)
+	}
+	e := &exporter{users: users, emailDomain: "example.com"}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"the_user", "the_user <the_user@the_user_client>"},
+		{"unknown", "unknown <unknown@example.com>"},
+		{"<bad>", "bad <bad@example.com>"},
+	}
+	for _, test := range tests {
+		if got := e.identity(test.name); got != test.want {
+			t.Errorf("identity(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func writeArchive(t *testing.T, path string, content []byte, compressed bool) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("MkdirAll() returned %v", err)
+	}
+	if compressed {
+		var buffer bytes.Buffer
+		w := gzip.NewWriter(&buffer)
+		w.Write(content)
+		w.Close()
+		content = buffer.Bytes()
+	}
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+}
+
+func TestWriteChanges(t *testing.T) {
+	depotRoot := t.TempDir()
+	writeArchive(t, filepath.Join(depotRoot, "depot/path1/data1.dat,d/1.1.gz"), []byte("data 1"), true)
+	// Restored uncompressed
+	writeArchive(t, filepath.Join(depotRoot, "depot/path1/data1.dat,d/1.2"), []byte("data 2"), false)
+	writeArchive(t, filepath.Join(depotRoot, "depot/path1/README.txt,v"), []byte(readmeRCS), false)
+
+	filter, err := wildcard.NewFilter([]string{"//depot/...", "-//depot/path2/..."}, true)
+	if err != nil {
+		t.Fatalf("NewFilter() returned %v", err)
+	}
+	changes, err := readRevisions(examplePath, "//depot", filter, 0)
+	if err != nil {
+		t.Fatalf("readRevisions() returned %v", err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("readRevisions() returned %v changes, want 2", len(changes))
+	}
+	users, err := readChanges(examplePath, changes)
+	if err != nil {
+		t.Fatalf("readChanges() returned %v", err)
+	}
+
+	var stream bytes.Buffer
+	e := &exporter{w: &stream, depotRoot: depotRoot, branch: "refs/heads/main", from: "refs/heads/main^0", trailer: true, users: users}
+	if err := e.writeChanges(changes); err != nil {
+		t.Fatalf("writeChanges() returned %v", err)
+	}
+	// The archive of //depot/path1/data2.dat is missing
+	want := `feature done
+commit refs/heads/main
+author the_user <the_user@the_user_client> 1611008038 +0000
+committer the_user <the_user@the_user_client> 1611008038 +0000
+data 34
+Initial files
+
+Perforce-Change: 1
+
+from refs/heads/main^0
+M 100644 inline path1/README.txt
+data 8
+Read me
+
+M 100644 inline path1/data1.dat
+data 6
+data 1
+
+commit refs/heads/main
+author the_user <the_user@the_user_client> 1611008040 +0000
+committer the_user <the_user@the_user_client> 1611008040 +0000
+data 34
+Second change
+
+Perforce-Change: 2
+
+M 100644 inline path1/README.txt
+data 14
+Read me
+Twice
+
+M 100644 inline path1/data1.dat
+data 6
+data 2
+
+done
+`
+	if stream.String() != want {
+		t.Errorf("writeChanges() wrote\n%v\nwant\n%v", stream.String(), want)
+	}
+	if e.commits != 2 || e.files != 4 || e.skipped != 1 {
+		t.Errorf("writeChanges() exported %v commits, %v files and skipped %v, want 2, 4 and 1", e.commits, e.files, e.skipped)
+	}
+}
+
+func TestLastChange(t *testing.T) {
+	if got := lastChange(map[int]*change{3: nil, 12: nil, 7: nil}); got != 12 {
+		t.Errorf("lastChange() = %v, want 12", got)
+	}
+}
@@ -0,0 +1,394 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_checkpoint_anonymize rewrites a checkpoint or journal with the user, group, client,
+// label, branch and depot names, the file paths and the descriptions replaced by pseudonyms, so that
+// its metadata can be shared with support or vendors. The names keep their pseudonym across tables
+// and, with the same mapping file, across runs.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/schema"
+)
+
+// How a field is anonymized
+type fieldRule int
+
+const (
+	userField fieldRule = iota
+	groupField
+	// Client, label or branch names
+	domainField
+	depotField
+	depotPathField
+	clientPathField
+	localPathField
+	hostField
+	// Free text (descriptions, emails, full names, trigger commands) is replaced by as many x,
+	// keeping the line breaks, so that the records keep their size
+	textField
+	// Passwords and tickets are emptied
+	secretField
+	// Configurable values are kept when they're numbers, and replaced as text otherwise
+	configValueField
+	// Fields whose kind depends on another field of the record
+	domainNameField
+	groupMemberField
+	protectUserField
+	viewFileField
+	depotMapField
+)
+
+var changeRules = map[string]fieldRule{
+	"client":      domainField,
+	"user":        userField,
+	"description": textField,
+	"root":        depotPathField,
+	"importer":    textField,
+	"identity":    textField,
+	"stream":      depotPathField,
+}
+
+var revRules = map[string]fieldRule{
+	"depotFile": depotPathField,
+	"lbrFile":   depotPathField,
+}
+
+// The fields anonymized per table, by schema field name. Other fields are kept, and the records of
+// tables missing here are dropped unless -keep-tables lists them.
+var tableRules = map[string]map[string]fieldRule{
+	"db.change":   changeRules,
+	"db.changex":  changeRules,
+	"db.config":   {"value": configValueField},
+	"db.counters": {},
+	"db.depot":    {"name": depotField, "extra": textField, "map": depotMapField},
+	"db.desc":     {"description": textField},
+	"db.domain": {"name": domainNameField, "extra": hostField, "mount": localPathField, "mount2": localPathField,
+		"mount3": localPathField, "owner": userField, "description": textField, "stream": depotPathField},
+	"db.group":    {"user": groupMemberField, "group": groupField},
+	"db.have":     {"clientFile": clientPathField, "depotFile": depotPathField},
+	"db.integed":  {"toFile": depotPathField, "fromFile": depotPathField},
+	"db.label":    {"name": domainField, "depotFile": depotPathField},
+	"db.protect":  {"user": protectUserField, "host": hostField, "depotFile": depotPathField, "subPath": depotPathField},
+	"db.rev":      revRules,
+	"db.revdx":    revRules,
+	"db.revhx":    revRules,
+	"db.revsh":    revRules,
+	"db.storage":  {"lbrFile": depotPathField},
+	"db.stream":   {"stream": depotPathField, "parent": depotPathField, "title": textField},
+	"db.trigger":  {"name": textField, "depotFile": depotPathField, "trigger": textField},
+	"db.typemapx": {"depotFile": depotPathField},
+	"db.user": {"user": userField, "email": textField, "jobView": textField, "fullName": textField,
+		"password": secretField, "ticket": secretField},
+	"db.view": {"name": domainField, "viewFile": viewFileField, "depotFile": depotPathField},
+	"db.working": {"clientFile": clientPathField, "depotFile": depotPathField, "client": domainField,
+		"user": userField, "movedFile": depotPathField},
+}
+
+// The db.domain types whose names aren't client, label or branch names
+const (
+	depotDomainType  = 'd'
+	streamDomainType = 's'
+)
+
+// The db.group types of subgroup entries, whose user field holds a group name
+const subgroupGroupType = "1"
+
+// The note record heading checkpoints has this type, with the server root at this index
+const (
+	headerNoteType      = "0"
+	headerNoteRootField = 8
+)
+
+// Returns as many x as a text has bytes, keeping its line breaks
+func placeholderText(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' {
+			return r
+		}
+		return 'x'
+	}, strings.ToValidUTF8(text, "x"))
+}
+
+// Rewrites the records of a checkpoint
+type anonymizer struct {
+	names *pseudonymizer
+	// Tables copied as they are
+	keepTables map[string]bool
+
+	anonymized int
+	// The records dropped, by table
+	dropped map[string]int
+	// The records of a version whose layout isn't known dropped, by table and version
+	unknownVersions map[string]map[int]int
+}
+
+// Returns a field of the record by schema name, or an empty string
+func namedField(record journal.Record, table schema.Table, name string) string {
+	return record.Field(table.Index(name))
+}
+
+func (a *anonymizer) field(rule fieldRule, value string, record journal.Record, table schema.Table) string {
+	names := a.names
+	switch rule {
+	case userField:
+		return names.pseudonym(userKind, value)
+	case groupField:
+		return names.pseudonym(groupKind, value)
+	case domainField:
+		return names.pseudonym(domainKind, value)
+	case depotField:
+		return names.pseudonym(depotKind, value)
+	case depotPathField:
+		return names.path(depotKind, value)
+	case clientPathField:
+		return names.path(domainKind, value)
+	case localPathField:
+		return names.localPath(value)
+	case hostField:
+		return names.pseudonym(hostKind, value)
+	case textField:
+		return placeholderText(value)
+	case secretField:
+		return ""
+	case configValueField:
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return value
+		}
+		return placeholderText(value)
+	case domainNameField:
+		switch domainType, _ := strconv.Atoi(namedField(record, table, "type")); domainType {
+		case depotDomainType:
+			return names.pseudonym(depotKind, value)
+		case streamDomainType:
+			return names.path(depotKind, value)
+		}
+		return names.pseudonym(domainKind, value)
+	case groupMemberField:
+		if namedField(record, table, "type") == subgroupGroupType {
+			return names.pseudonym(groupKind, value)
+		}
+		return names.pseudonym(userKind, value)
+	case protectUserField:
+		if isGroup, _ := strconv.ParseBool(namedField(record, table, "isGroup")); isGroup {
+			return names.pseudonym(groupKind, value)
+		}
+		return names.pseudonym(userKind, value)
+	case viewFileField:
+		// Client views map to paths starting with the client name, branch views to depot paths
+		name := namedField(record, table, "name")
+		if strings.HasPrefix(strings.TrimLeft(value, "-+"), "//"+name+"/") {
+			return names.path(domainKind, value)
+		}
+		return names.path(depotKind, value)
+	case depotMapField:
+		// Maps are usually the depot name followed by /...
+		depot := namedField(record, table, "name")
+		if strings.HasPrefix(value, depot+"/") {
+			return names.pseudonym(depotKind, depot) + names.localPath(strings.TrimPrefix(value, depot))
+		}
+		return names.localPath(value)
+	}
+	return value
+}
+
+// Returns the anonymized record, or false when the record must be dropped
+func (a *anonymizer) anonymize(record journal.Record) (string, bool) {
+	if record.Operation == journal.NoteTransaction && record.Field(0) == headerNoteType {
+		// The server root, such as C:\Users\name\p4root
+		tokens := journal.Tokens(record.Raw)
+		if 1+headerNoteRootField < len(tokens) {
+			tokens[1+headerNoteRootField] = journal.Quote(a.names.localPath(record.Field(headerNoteRootField)))
+			return joinTokens(tokens, record.Raw), true
+		}
+	}
+	if !record.IsTableOperation() || a.keepTables[record.Table] {
+		return record.Raw, true
+	}
+	rules, ok := tableRules[record.Table]
+	if !ok {
+		a.dropped[record.Table]++
+		return "", false
+	}
+	// The rules name fields, whose position depends on the version of the record
+	table, known := schema.Layout(record.Table, record.Version)
+	if !known {
+		if a.unknownVersions[record.Table] == nil {
+			a.unknownVersions[record.Table] = make(map[int]int)
+		}
+		a.unknownVersions[record.Table][record.Version]++
+		return "", false
+	}
+	// Fields missing from the registry could hold anything
+	if len(record.Fields) > len(table.Fields) {
+		a.dropped[record.Table]++
+		return "", false
+	}
+	a.anonymized++
+	if len(rules) == 0 {
+		return record.Raw, true
+	}
+
+	tokens := journal.Tokens(record.Raw)
+	for name, rule := range rules {
+		i := table.Index(name)
+		if i < 0 || i >= len(record.Fields) || journal.HeaderFieldCount+i >= len(tokens) {
+			continue
+		}
+		tokens[journal.HeaderFieldCount+i] = journal.Quote(a.field(rule, record.Fields[i], record, table))
+	}
+	return joinTokens(tokens, record.Raw), true
+}
+
+// Joins the tokens of a record, keeping the trailing space of the original record
+func joinTokens(tokens []string, raw string) string {
+	joined := strings.Join(tokens, " ")
+	if strings.HasSuffix(raw, " ") {
+		joined += " "
+	}
+	return joined
+}
+
+// Copies a checkpoint or journal to w, anonymized. Returns the number of records read and written.
+func anonymizeJournal(journalPath string, w io.Writer, a *anonymizer) (int, int, error) {
+	file, err := journal.Open(journalPath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	read := 0
+	written := 0
+	err = journal.Scan(file, func(record journal.Record) error {
+		read++
+		raw, ok := a.anonymize(record)
+		if !ok {
+			return nil
+		}
+		written++
+		if _, err := io.WriteString(w, raw); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\n")
+		return err
+	})
+	return read, written, err
+}
+
+func main() {
+	flags := struct {
+		mapping         string
+		output          string
+		keepTables      string
+		caseInsensitive bool
+		keepExtensions  bool
+	}{}
+
+	flag.StringVar(&flags.mapping, "mapping", "", "CSV file mapping names to their pseudonym, loaded when it exists and updated (required).")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File to write the anonymized checkpoint to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.keepTables, "keep-tables", "", "Comma-separated tables without anonymization rules to copy as they are, instead of dropping them.")
+	flag.BoolVar(&flags.caseInsensitive, "case-insensitive", false, "Give names differing only by case the same pseudonym, for case-insensitive servers.")
+	flag.BoolVar(&flags.keepExtensions, "keep-extensions", true, "Keep file extensions, which decide file types.")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(false); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 || len(flags.mapping) == 0 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+
+	names := newPseudonymizer(flags.caseInsensitive, flags.keepExtensions)
+	if err := names.load(flags.mapping); err != nil {
+		logging.Fatal("Error loading mapping", logging.PathKey, flags.mapping, logging.Err(err))
+	}
+	a := &anonymizer{names: names, keepTables: make(map[string]bool), dropped: make(map[string]int),
+		unknownVersions: make(map[string]map[int]int)}
+	if len(flags.keepTables) > 0 {
+		for _, table := range strings.Split(flags.keepTables, ",") {
+			a.keepTables[table] = true
+		}
+	}
+
+	start := time.Now()
+	var read, written int
+	err := output.WriteFile(flags.output, func(w io.Writer) error {
+		var err error
+		read, written, err = anonymizeJournal(flag.Arg(0), w, a)
+		return err
+	})
+	if err != nil {
+		logging.Fatal("Error anonymizing journal", logging.Err(err))
+	}
+	// The checkpoint is only useful along with the mapping, to translate the answers back
+	if err := output.WriteFile(flags.mapping, names.write); err != nil {
+		logging.Fatal("Error writing mapping", logging.PathKey, flags.mapping, logging.Err(err))
+	}
+
+	tables := make([]string, 0, len(a.dropped))
+	for table := range a.dropped {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		slog.Warn("Dropped records of a table without anonymization rules", logging.TableKey, table, logging.CountKey, a.dropped[table])
+	}
+	tables = tables[:0]
+	for table := range a.unknownVersions {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		versions := make([]int, 0, len(a.unknownVersions[table]))
+		for version := range a.unknownVersions[table] {
+			versions = append(versions, version)
+		}
+		sort.Ints(versions)
+		for _, version := range versions {
+			slog.Warn("Dropped records of a version whose layout isn't known", logging.TableKey, table,
+				"version", version, logging.CountKey, a.unknownVersions[table][version])
+		}
+	}
+	slog.Info("Processed records", logging.CountKey, read, "written", written, "anonymized", a.anonymized)
+	slog.Info("Pseudonyms", logging.CountKey, len(names.mappings), "added", names.added)
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+)
+
+func TestAnonymizeJournal(t *testing.T) {
+	a := &anonymizer{names: newPseudonymizer(false, true), keepTables: make(map[string]bool), dropped: make(map[string]int),
+		unknownVersions: make(map[string]map[int]int)}
+	var anonymized bytes.Buffer
+	read, written, err := anonymizeJournal("../perforceutils/testdata/example_journal.txt", &anonymized, a)
+	if err != nil {
+		t.Fatalf("anonymizeJournal() returned %v", err)
+	}
+	if written == 0 || written >= read || a.dropped["db.configh"] != 1 {
+		t.Errorf("anonymizeJournal() read %v records and wrote %v, dropping %v, want db.configh dropped", read, written, a.dropped)
+	}
+	for _, name := range []string{"the_user", "path1", "data1", "README", "Default depot", "AppData"} {
+		if strings.Contains(anonymized.String(), name) {
+			t.Errorf("anonymizeJournal() kept %q", name)
+		}
+	}
+	// The same names get the same pseudonyms in all tables, and the sizes and digests are kept
+	data1 := a.names.path(depotKind, "//depot/path1/data1.dat")
+	for _, want := range []string{
+		"@nx@ 0 1611008050 @50@ 10 0 0 0 0 @C:\\name1\\name2\\name3\\name4\\name5\\name6@ @journal@ ",
+		"@pv@ 9 @db.rev@ @" + data1 + "@ 2 65539 1 2 1611008040 1611008039 F1C9645DBC14EFDDC7D8A322685F26EB 10485760 0 0 @" + data1 + "@ @1.2@ 65539 \n",
+		"@pv@ 1 @db.storage@ @" + data1 + "@ @1.2@ 65539 1 F1C9645DBC14EFDDC7D8A322685F26EB 10485760 10221 ",
+		"@pv@ 1 @db.counters@ @change@ @3@ \n",
+	} {
+		if !strings.Contains(anonymized.String(), want) {
+			t.Errorf("anonymizeJournal() wrote %q, want it to contain %q", anonymized.String(), want)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	p := newPseudonymizer(true, true)
+	tests := []struct {
+		kind string
+		path string
+		want string
+	}{
+		{depotKind, "//depot/path1/data1.dat", "//depot1/name1/name2.dat"},
+		{depotKind, "//Depot/Path1/README.txt", "//depot1/name1/name3.txt"},
+		{depotKind, "-//depot/....c", "-//depot1/....c"},
+		{depotKind, "//depot/path1/*/%%1.dat", "//depot1/name1/*/%%1.dat"},
+		{domainKind, "//the_user_client/path1/...", "//domain1/name1/..."},
+		{depotKind, `c:\Users\the_user`, `c:\name4\name5`},
+	}
+	for _, test := range tests {
+		if got := p.path(test.kind, test.path); got != test.want {
+			t.Errorf("path(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestPseudonymsRoundTrip(t *testing.T) {
+	p := newPseudonymizer(false, false)
+	p.pseudonym(userKind, "the_user")
+	p.pseudonym(userKind, "other_user")
+	var saved bytes.Buffer
+	if err := p.write(&saved); err != nil {
+		t.Fatalf("write() returned %v", err)
+	}
+
+	path := t.TempDir() + "/mapping.csv"
+	if err := os.WriteFile(path, saved.Bytes(), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+	loaded := newPseudonymizer(false, false)
+	if err := loaded.load(path); err != nil {
+		t.Fatalf("load() returned %v", err)
+	}
+	if got := loaded.pseudonym(userKind, "other_user"); got != "user2" {
+		t.Errorf("pseudonym(other_user) = %q after load, want user2", got)
+	}
+	if got := loaded.pseudonym(userKind, "new_user"); got != "user3" {
+		t.Errorf("pseudonym(new_user) = %q after load, want user3", got)
+	}
+	if err := loaded.load(t.TempDir() + "/missing.csv"); err != nil {
+		t.Errorf("load(missing) returned %v", err)
+	}
+}
+
+func TestPlaceholderText(t *testing.T) {
+	if got := placeholderText("Created by\r\nthe_user.\xff"); got != "xxxxxxxxxx\r\nxxxxxxxxxx" {
+		t.Errorf("placeholderText() = %q", got)
+	}
+}
+
+func TestAnonymizeHeader(t *testing.T) {
+	a := &anonymizer{names: newPseudonymizer(false, true), keepTables: make(map[string]bool), dropped: make(map[string]int),
+		unknownVersions: make(map[string]map[int]int)}
+	tests := []struct {
+		record string
+		want   string
+	}{
+		{`@nx@ 0 1611008050 @50@ 10 0 0 0 0 @C:\Users\the_user\p4root@ @journal@ @@ @@ @@ `,
+			`@nx@ 0 1611008050 @50@ 10 0 0 0 0 @C:\name1\name2\name3@ @journal@ @@ @@ @@ `},
+		{"@nx@ 0 1611008050 @50@ 10 0 0 0 0 @/home/the_user/p4root@ @journal@ @@ @@ @@ ",
+			"@nx@ 0 1611008050 @50@ 10 0 0 0 0 @/name4/name2/name3@ @journal@ @@ @@ @@ "},
+		// The table notes hold nothing else
+		{"@nx@ 4 1611008050 @50@ 1 0 -286465841 0 0 @db.counters@ @@ @@ @@ @@ ",
+			"@nx@ 4 1611008050 @50@ 1 0 -286465841 0 0 @db.counters@ @@ @@ @@ @@ "},
+	}
+	for _, test := range tests {
+		got, ok := a.anonymize(journal.Parse(test.record))
+		if !ok || got != test.want {
+			t.Errorf("anonymize(%q) = %q, %v, want %q", test.record, got, ok, test.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The kinds of names replaced by pseudonyms, numbered per kind (user1, user2, ...)
+const (
+	userKind  = "user"
+	groupKind = "group"
+	// Clients, labels and branches, which share a namespace
+	domainKind = "domain"
+	depotKind  = "depot"
+	// The directory and file names of paths
+	nameKind = "name"
+	hostKind = "host"
+)
+
+// A name and its pseudonym, as listed in the mapping file
+type mapping struct {
+	kind      string
+	name      string
+	pseudonym string
+}
+
+// Replaces names by pseudonyms, the same in all tables. The mappings can be saved and loaded again,
+// so that checkpoints anonymized at different times use the same pseudonyms.
+type pseudonymizer struct {
+	// Names differing only by case get the same pseudonym, for case-insensitive servers
+	caseInsensitive bool
+	// File extensions are kept, as they decide file types
+	keepExtensions bool
+
+	pseudonyms map[string]map[string]string
+	last       map[string]int
+	mappings   []mapping
+	added      int
+}
+
+func newPseudonymizer(caseInsensitive bool, keepExtensions bool) *pseudonymizer {
+	return &pseudonymizer{
+		caseInsensitive: caseInsensitive,
+		keepExtensions:  keepExtensions,
+		pseudonyms:      make(map[string]map[string]string),
+		last:            make(map[string]int),
+	}
+}
+
+func (p *pseudonymizer) key(name string) string {
+	if p.caseInsensitive {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+func (p *pseudonymizer) add(m mapping) {
+	names, ok := p.pseudonyms[m.kind]
+	if !ok {
+		names = make(map[string]string)
+		p.pseudonyms[m.kind] = names
+	}
+	names[p.key(m.name)] = m.pseudonym
+	p.mappings = append(p.mappings, m)
+	if number, err := strconv.Atoi(strings.TrimPrefix(m.pseudonym, m.kind)); err == nil && number > p.last[m.kind] {
+		p.last[m.kind] = number
+	}
+}
+
+// Returns the pseudonym of a name. Empty names and the "*" wildcard are kept.
+func (p *pseudonymizer) pseudonym(kind string, name string) string {
+	if len(name) == 0 || name == "*" {
+		return name
+	}
+	if pseudonym, ok := p.pseudonyms[kind][p.key(name)]; ok {
+		return pseudonym
+	}
+	pseudonym := fmt.Sprintf("%v%d", kind, p.last[kind]+1)
+	p.add(mapping{kind: kind, name: name, pseudonym: pseudonym})
+	p.added++
+	return pseudonym
+}
+
+// Returns a file name with its stem replaced, keeping its extension when keepExtensions is set
+func (p *pseudonymizer) fileName(kind string, name string) string {
+	if i := strings.LastIndexByte(name, '.'); p.keepExtensions && i >= 0 {
+		return p.pseudonym(kind, name[:i]) + name[i:]
+	}
+	return p.pseudonym(kind, name)
+}
+
+// Returns a path component with the names between its wildcards (..., * and %%1) replaced
+func (p *pseudonymizer) component(kind string, component string, last bool) string {
+	var result strings.Builder
+	literalStart := 0
+	for i := 0; i < len(component); {
+		length := 0
+		switch {
+		case strings.HasPrefix(component[i:], "..."):
+			length = 3
+		case component[i] == '*':
+			length = 1
+		case strings.HasPrefix(component[i:], "%%") && i+2 < len(component) && component[i+2] >= '0' && component[i+2] <= '9':
+			length = 3
+		default:
+			i++
+			continue
+		}
+		result.WriteString(p.pseudonym(kind, component[literalStart:i]))
+		result.WriteString(component[i : i+length])
+		i += length
+		literalStart = i
+	}
+	if last {
+		result.WriteString(p.fileName(kind, component[literalStart:]))
+	} else {
+		result.WriteString(p.pseudonym(kind, component[literalStart:]))
+	}
+	return result.String()
+}
+
+// Returns a depot path such as //depot/src/main.c, or a view line such as -//ws/....c, with its
+// components replaced. The first component is a depot name, or a client name for client paths.
+// Other values are handled as local paths.
+func (p *pseudonymizer) path(rootKind string, path string) string {
+	mapFlag := ""
+	if strings.HasPrefix(path, "-") || strings.HasPrefix(path, "+") {
+		mapFlag, path = path[:1], path[1:]
+	}
+	if !strings.HasPrefix(path, "//") {
+		return mapFlag + p.localPath(path)
+	}
+	components := strings.Split(path[2:], "/")
+	for i, component := range components {
+		kind := nameKind
+		if i == 0 {
+			kind = rootKind
+		}
+		components[i] = p.component(kind, component, i == len(components)-1)
+	}
+	return mapFlag + "//" + strings.Join(components, "/")
+}
+
+// Returns a path on a workstation or server, such as a client root, with its components replaced.
+// Windows drives are kept.
+func (p *pseudonymizer) localPath(path string) string {
+	var result strings.Builder
+	start := 0
+	for i := 0; i <= len(path); i++ {
+		if i < len(path) && path[i] != '/' && path[i] != '\\' {
+			continue
+		}
+		component := path[start:i]
+		if len(component) == 2 && component[1] == ':' && start == 0 {
+			result.WriteString(component)
+		} else {
+			result.WriteString(p.component(nameKind, component, i == len(path)))
+		}
+		if i < len(path) {
+			result.WriteByte(path[i])
+		}
+		start = i + 1
+	}
+	return result.String()
+}
+
+// Loads the mappings saved by an earlier run. A missing file is an empty mapping.
+func (p *pseudonymizer) load(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 3
+	if _, err := reader.Read(); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p.add(mapping{kind: record[0], name: record[1], pseudonym: record[2]})
+	}
+}
+
+// Writes the mappings as CSV, those loaded first
+func (p *pseudonymizer) write(w io.Writer) error {
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write([]string{"Kind", "Name", "Pseudonym"})
+	for _, m := range p.mappings {
+		csvWriter.Write([]string{m.kind, m.name, m.pseudonym})
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_checkpoint_diff compares two Perforce checkpoints table by table and reports
+// added, removed and changed records. It's meant to validate upgrades, recoveries and migrations.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/schema"
+)
+
+// Returns the fields identifying a record: the key fields of its table in the schema registry,
+// so that records with the same key in both checkpoints are reported as changed rather than removed
+// and added. Records of tables or versions missing from the registry are identified by all their
+// fields.
+func recordKey(record journal.Record) string {
+	indexes, ok := schema.KeyIndexes(record.Table, record.Version)
+	if !ok {
+		return strings.Join(record.Fields, "\x00")
+	}
+	key := make([]string, len(indexes))
+	for i, index := range indexes {
+		key[i] = record.Field(index)
+	}
+	return strings.Join(key, "\x00")
+}
+
+// Calls fn for every @pv@ record of a checkpoint with the table name, record key and raw record
+func scanCheckpoint(path string, tables map[string]bool, fn func(table string, key string, record string)) error {
+	return journal.ScanFile(path, tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue || len(record.Fields) == 0 {
+			return nil
+		}
+		fn(record.Table, recordKey(record), strings.TrimRight(record.Raw, " \r\n"))
+		return nil
+	})
+}
+
+// Returns the record without its entry type, version and table name, so that records
+// rewritten with a newer table version but identical values compare equal
+func recordBody(record string) string {
+	parts := strings.SplitN(record, " ", journal.HeaderFieldCount+1)
+	if len(parts) <= journal.HeaderFieldCount {
+		return ""
+	}
+	return parts[journal.HeaderFieldCount]
+}
+
+type tableDiff struct {
+	added     int
+	removed   int
+	changed   int
+	unchanged int
+}
+
+// Compares two checkpoints, optionally writing the differing records to dump
+func diffCheckpoints(oldPath string, newPath string, tables map[string]bool, dump io.Writer) (map[string]*tableDiff, error) {
+	diffs := make(map[string]*tableDiff)
+	getDiff := func(table string) *tableDiff {
+		diff, ok := diffs[table]
+		if !ok {
+			diff = &tableDiff{}
+			diffs[table] = diff
+		}
+		return diff
+	}
+
+	// The old checkpoint is loaded in memory, the new one is streamed against it
+	oldRecords := make(map[string]map[string]string)
+	err := scanCheckpoint(oldPath, tables, func(table string, key string, record string) {
+		tableRecords, ok := oldRecords[table]
+		if !ok {
+			tableRecords = make(map[string]string)
+			oldRecords[table] = tableRecords
+		}
+		if _, duplicate := tableRecords[key]; duplicate {
+			slog.Warn("Duplicate key", logging.TableKey, table, "key", strings.ReplaceAll(key, "\x00", " "))
+		}
+		tableRecords[key] = record
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading %v: %v", oldPath, err)
+	}
+
+	err = scanCheckpoint(newPath, tables, func(table string, key string, record string) {
+		diff := getDiff(table)
+		oldRecord, ok := oldRecords[table][key]
+		switch {
+		case !ok:
+			diff.added++
+			if dump != nil {
+				fmt.Fprintf(dump, "+ %v\n", record)
+			}
+		case recordBody(oldRecord) != recordBody(record):
+			diff.changed++
+			if dump != nil {
+				fmt.Fprintf(dump, "< %v\n> %v\n", oldRecord, record)
+			}
+		default:
+			diff.unchanged++
+		}
+		if ok {
+			delete(oldRecords[table], key)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading %v: %v", newPath, err)
+	}
+
+	for table, tableRecords := range oldRecords {
+		diff := getDiff(table)
+		diff.removed += len(tableRecords)
+		if dump != nil {
+			for _, record := range tableRecords {
+				fmt.Fprintf(dump, "- %v\n", record)
+			}
+		}
+	}
+
+	return diffs, nil
+}
+
+func main() {
+	flags := struct {
+		tables string
+		dump   string
+		output string
+		format string
+	}{}
+
+	flag.StringVar(&flags.tables, "tables", "", "Comma-separated tables to compare (all tables by default).")
+	flag.StringVar(&flags.dump, "dump", "", "File to write the added (+), removed (-) and changed (<, >) records to.")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File, or table for the database formats, to write the differences of each table to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage())
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(false); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 2 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(flags.format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+	if flag.Arg(0) == journal.Stdin && flag.Arg(1) == journal.Stdin {
+		logging.Fatal("Only one of the checkpoints can be read from the standard input")
+	}
+
+	tables := make(map[string]bool)
+	if len(flags.tables) > 0 {
+		for _, table := range strings.Split(flags.tables, ",") {
+			tables[table] = true
+		}
+	}
+
+	start := time.Now()
+	var diffs map[string]*tableDiff
+	var err error
+	if len(flags.dump) > 0 {
+		err = output.WriteFile(flags.dump, func(dump io.Writer) error {
+			var err error
+			diffs, err = diffCheckpoints(flag.Arg(0), flag.Arg(1), tables, dump)
+			return err
+		})
+	} else {
+		diffs, err = diffCheckpoints(flag.Arg(0), flag.Arg(1), tables, nil)
+	}
+	if err != nil {
+		logging.Fatal("Error comparing checkpoints", logging.Err(err))
+	}
+
+	names := make([]string, 0, len(diffs))
+	for name := range diffs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	differingCount := 0
+	err = output.WriteTable(flags.format, flags.output, output.Table{Name: "checkpoint_diff"}, func(out output.Writer) error {
+		out.Write([]string{"Table", "Added", "Removed", "Changed", "Unchanged"})
+		for _, name := range names {
+			diff := diffs[name]
+			if diff.added+diff.removed+diff.changed > 0 {
+				differingCount++
+			}
+			out.Write([]string{
+				name,
+				strconv.Itoa(diff.added),
+				strconv.Itoa(diff.removed),
+				strconv.Itoa(diff.changed),
+				strconv.Itoa(diff.unchanged)})
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Fatal("Error writing differences", logging.Err(err))
+	}
+
+	slog.Info("Compared tables", logging.CountKey, len(diffs))
+	slog.Info("Tables with differences", logging.CountKey, differingCount)
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const exampleJournal = "../perforceutils/testdata/example_journal.txt"
+
+func TestDiffCheckpoints(t *testing.T) {
+	example, err := os.ReadFile(exampleJournal)
+	if err != nil {
+		t.Fatalf("ReadFile() returned %v", err)
+	}
+	// One counter changed, one removed and one added
+	modified := strings.Replace(string(example), "@pv@ 1 @db.counters@ @change@ @3@ \n", "@pv@ 1 @db.counters@ @change@ @4@ \n", 1)
+	modified = strings.Replace(modified, "@pv@ 1 @db.counters@ @journal@ @1@ \n", "@pv@ 1 @db.counters@ @lastCheckpointAction@ @0@ \n", 1)
+	newPath := filepath.Join(t.TempDir(), "checkpoint.2")
+	if err := os.WriteFile(newPath, []byte(modified), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+
+	var dump bytes.Buffer
+	diffs, err := diffCheckpoints(exampleJournal, newPath, nil, &dump)
+	if err != nil {
+		t.Fatalf("diffCheckpoints() returned %v", err)
+	}
+	counters := diffs["db.counters"]
+	if counters == nil || *counters != (tableDiff{added: 1, removed: 1, changed: 1, unchanged: 2}) {
+		t.Errorf("diffCheckpoints() db.counters = %+v, want 1 added, 1 removed, 1 changed and 2 unchanged", counters)
+	}
+	if rev := diffs["db.rev"]; rev == nil || *rev != (tableDiff{unchanged: 6}) {
+		t.Errorf("diffCheckpoints() db.rev = %+v, want 6 unchanged", rev)
+	}
+	for _, line := range []string{
+		"< @pv@ 1 @db.counters@ @change@ @3@\n> @pv@ 1 @db.counters@ @change@ @4@\n",
+		"- @pv@ 1 @db.counters@ @journal@ @1@\n",
+		"+ @pv@ 1 @db.counters@ @lastCheckpointAction@ @0@\n",
+	} {
+		if !strings.Contains(dump.String(), line) {
+			t.Errorf("diffCheckpoints() dump = %q, want it to contain %q", dump.String(), line)
+		}
+	}
+
+	diffs, err = diffCheckpoints(exampleJournal, newPath, map[string]bool{"db.rev": true}, nil)
+	if err != nil {
+		t.Fatalf("diffCheckpoints() returned %v", err)
+	}
+	if len(diffs) != 1 || diffs["db.rev"] == nil {
+		t.Errorf("diffCheckpoints(db.rev) = %v, want only db.rev", diffs)
+	}
+}
+
+func TestRecordBody(t *testing.T) {
+	tests := []struct {
+		record string
+		want   string
+	}{
+		{"@pv@ 1 @db.counters@ @change@ @3@", "@change@ @3@"},
+		{"@pv@ 2 @db.counters@ @change@ @3@", "@change@ @3@"},
+		{"@pv@ 1 @db.counters@", ""},
+	}
+	for _, test := range tests {
+		if got := recordBody(test.record); got != test.want {
+			t.Errorf("recordBody(%q) = %q, want %q", test.record, got, test.want)
+		}
+	}
+}
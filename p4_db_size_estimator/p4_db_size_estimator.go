@@ -0,0 +1,312 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_db_size_estimator estimates the size of the db.* files that replaying a checkpoint
+// produces, to size the disks of new server hosts and to check that a restore produced db files of
+// plausible sizes.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// Heuristics of the btree encoding of the records
+const (
+	// Slot, key and value headers of each record in its page
+	recordOverheadBytes = 12
+	// Child page number of each key in the internal pages
+	childPointerBytes = 4
+	// The header and root pages of an empty db file
+	minimumPages = 2
+)
+
+// The records of a table, as read from the checkpoint
+type tableSize struct {
+	name    string
+	records int64
+	// The encoded size of the records stored in the leaf pages, and of their keys
+	leafBytes int64
+	keyBytes  int64
+	// Records larger than half a page are stored in overflow pages of their own
+	overflowPages int64
+	// The size of the db file, -1 when unknown
+	actualBytes int64
+}
+
+// Returns the encoded size of a field: integers are stored in binary, strings with a terminator
+func fieldBytes(value string) int64 {
+	if number, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if number >= math.MinInt32 && number <= math.MaxInt32 {
+			return 4
+		}
+		return 8
+	}
+	return int64(len(value)) + 1
+}
+
+func (t *tableSize) add(fields []string, pageSize int64) {
+	t.records++
+	size := int64(recordOverheadBytes)
+	for _, field := range fields {
+		size += fieldBytes(field)
+	}
+	if size > pageSize/2 {
+		t.overflowPages += (size + pageSize - 1) / pageSize
+		size = recordOverheadBytes
+	}
+	t.leafBytes += size
+	// The tables are keyed by their first fields, the first one is taken as an estimate
+	if len(fields) > 0 {
+		t.keyBytes += fieldBytes(fields[0])
+	}
+}
+
+// Returns the estimated size of the db file: the leaf pages filled to the fill factor, the
+// overflow pages, and the levels of internal pages above the leaves
+func (t *tableSize) estimate(pageSize int64, fill float64) int64 {
+	usable := float64(pageSize) * fill
+	leafPages := math.Ceil(float64(t.leafBytes) / usable)
+	pages := leafPages + float64(t.overflowPages)
+	if t.records > 0 {
+		averageKey := float64(t.keyBytes)/float64(t.records) + childPointerBytes + recordOverheadBytes
+		fanout := math.Max(2, usable/averageKey)
+		for level := leafPages; level > 1; {
+			level = math.Ceil(level / fanout)
+			pages += level
+		}
+	}
+	return int64(math.Max(pages, minimumPages)) * pageSize
+}
+
+func (t *tableSize) averageRecordBytes(pageSize int64) int64 {
+	if t.records == 0 {
+		return 0
+	}
+	return (t.leafBytes + t.overflowPages*pageSize) / t.records
+}
+
+// Returns whether the db file is within the tolerance factor of the estimate
+func plausible(actual, estimate int64, tolerance float64) bool {
+	ratio := float64(actual) / float64(estimate)
+	return ratio >= 1/tolerance && ratio <= tolerance
+}
+
+// Reads the records of all tables of the checkpoint
+func readTables(checkpointPath string, pageSize int64) (map[string]*tableSize, error) {
+	tables := make(map[string]*tableSize)
+	otherOperations := 0
+	err := journal.ScanFile(checkpointPath, nil, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			// Checkpoints only put values, journals also replace and delete them
+			otherOperations++
+			return nil
+		}
+		table, ok := tables[record.Table]
+		if !ok {
+			table = &tableSize{name: record.Table, actualBytes: -1}
+			tables[record.Table] = table
+		}
+		table.add(record.Fields, pageSize)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if otherOperations > 0 {
+		slog.Warn("Ignored records other than put values, estimates are for checkpoints", logging.CountKey, otherOperations)
+	}
+	return tables, nil
+}
+
+// Sets the actual size of the db files of the tables, adding the db files without records
+func readActualSizes(dbDir string, tables map[string]*tableSize) error {
+	entries, err := os.ReadDir(dbDir)
+	if err != nil {
+		return fmt.Errorf("error listing db files: %v", err)
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasPrefix(entry.Name(), "db.") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("error reading db files: %v", err)
+		}
+		table, ok := tables[entry.Name()]
+		if !ok {
+			table = &tableSize{name: entry.Name()}
+			tables[entry.Name()] = table
+		}
+		table.actualBytes = info.Size()
+	}
+	for _, table := range tables {
+		if table.actualBytes < 0 {
+			slog.Warn("No db file for table", logging.TableKey, table.name, logging.PathKey, filepath.Join(dbDir, table.name))
+		}
+	}
+	return nil
+}
+
+func writeEstimates(out output.Writer, tables []*tableSize, pageSize int64, fill float64, tolerance float64) error {
+	out.Write([]string{
+		"Table",
+		"Records",
+		"AverageRecordBytes",
+		"EstimatedBytes",
+		"ActualBytes",
+		"Ratio",
+		"Plausible"})
+	for _, table := range tables {
+		estimate := table.estimate(pageSize, fill)
+		actual, ratio, isPlausible := "", "", ""
+		if table.actualBytes >= 0 {
+			actual = strconv.FormatInt(table.actualBytes, 10)
+			ratio = strconv.FormatFloat(float64(table.actualBytes)/float64(estimate), 'f', 2, 64)
+			isPlausible = strconv.FormatBool(plausible(table.actualBytes, estimate, tolerance))
+		}
+		out.Write([]string{
+			table.name,
+			strconv.FormatInt(table.records, 10),
+			strconv.FormatInt(table.averageRecordBytes(pageSize), 10),
+			strconv.FormatInt(estimate, 10),
+			actual,
+			ratio,
+			isPlausible})
+	}
+	return nil
+}
+
+func main() {
+	flags := struct {
+		pageSize  int64
+		fill      float64
+		dbDir     string
+		tolerance float64
+		output    string
+		format    string
+	}{}
+
+	flag.Int64Var(&flags.pageSize, "page-size", 8192, "Size of the pages of the db files in bytes.")
+	flag.Float64Var(&flags.fill, "fill", 0.7, "Average fill of the btree pages after a replay, between 0 and 1.")
+	flag.StringVar(&flags.dbDir, "db-dir", "", "Directory of the db files (P4ROOT) to compare the estimates with, such as after a restore.")
+	flag.Float64Var(&flags.tolerance, "tolerance", 3, "Factor by which a db file may be larger or smaller than its estimate and still be plausible, with -db-dir.")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File, or table for the database formats, to write the estimates to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage())
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(false); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(flags.format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+	if flags.pageSize < 512 {
+		logging.Fatal("-page-size must be at least 512")
+	}
+	if flags.fill <= 0 || flags.fill > 1 {
+		logging.Fatal("-fill must be between 0 and 1")
+	}
+	if flags.tolerance < 1 {
+		logging.Fatal("-tolerance must be at least 1")
+	}
+
+	start := time.Now()
+	checkpointPath := flag.Arg(0)
+	tables, err := readTables(checkpointPath, flags.pageSize)
+	if err != nil {
+		logging.Fatal("Error processing checkpoint", logging.PathKey, checkpointPath, logging.Err(err))
+	}
+	if len(flags.dbDir) > 0 {
+		if err := readActualSizes(flags.dbDir, tables); err != nil {
+			logging.Fatal("Error comparing with the db files", logging.PathKey, flags.dbDir, logging.Err(err))
+		}
+	}
+
+	sorted := make([]*tableSize, 0, len(tables))
+	for _, table := range tables {
+		sorted = append(sorted, table)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+	err = output.WriteTable(flags.format, flags.output, output.Table{Name: "db_size"}, func(out output.Writer) error {
+		return writeEstimates(out, sorted, flags.pageSize, flags.fill, flags.tolerance)
+	})
+	if err != nil {
+		logging.Fatal("Error writing estimates", logging.Err(err))
+	}
+
+	var totalEstimate, totalActual int64
+	implausible := 0
+	for _, table := range sorted {
+		estimate := table.estimate(flags.pageSize, flags.fill)
+		totalEstimate += estimate
+		if table.actualBytes < 0 {
+			continue
+		}
+		totalActual += table.actualBytes
+		if !plausible(table.actualBytes, estimate, flags.tolerance) {
+			implausible++
+			slog.Warn("Implausible db file size", logging.TableKey, table.name, logging.BytesKey, table.actualBytes,
+				"estimated_bytes", estimate, "records", table.records)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].estimate(flags.pageSize, flags.fill) > sorted[j].estimate(flags.pageSize, flags.fill)
+	})
+	for i, table := range sorted {
+		if i >= 5 {
+			break
+		}
+		slog.Info("Largest table", logging.TableKey, table.name, "records", table.records,
+			"estimated_bytes", table.estimate(flags.pageSize, flags.fill))
+	}
+	slog.Info("Estimated db size", "tables", len(tables), logging.BytesKey, totalEstimate)
+	if len(flags.dbDir) > 0 {
+		slog.Info("Actual db size", logging.BytesKey, totalActual, "implausible", implausible)
+	}
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+	if implausible > 0 {
+		os.Exit(1)
+	}
+}
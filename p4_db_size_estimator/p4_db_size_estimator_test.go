@@ -0,0 +1,93 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestFieldBytes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"3", 4},
+		{"-2147483648", 4},
+		{"1611008050000", 8},
+		{"", 1},
+		{"//depot/path1/data1.dat", 24},
+	}
+	for _, test := range tests {
+		if got := fieldBytes(test.value); got != test.want {
+			t.Errorf("fieldBytes(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestReadTables(t *testing.T) {
+	tables, err := readTables("../perforceutils/testdata/example_journal.txt", 8192)
+	if err != nil {
+		t.Fatalf("readTables() returned %v", err)
+	}
+	for name, want := range map[string]int64{"db.counters": 4, "db.rev": 6, "db.storage": 6, "db.user": 1} {
+		if table := tables[name]; table == nil || table.records != want {
+			t.Errorf("readTables() %v = %+v, want %v records", name, table, want)
+		}
+	}
+	// A few records fit in a single leaf page, under the root and header pages
+	if got := tables["db.rev"].estimate(8192, 0.7); got != 2*8192 {
+		t.Errorf("estimate(db.rev) = %v, want %v", got, 2*8192)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	table := &tableSize{name: "db.have"}
+	for i := 0; i < 10000; i++ {
+		table.add([]string{"//the_user_client/path/file.txt", "//depot/path/file.txt", "1", "0", "1611008038"}, 8192)
+	}
+	if got := table.averageRecordBytes(8192); got != 12+32+22+4+4+4 {
+		t.Errorf("averageRecordBytes() = %v, want %v", got, 12+32+22+4+4+4)
+	}
+	// 780 KB of records in 137 leaf pages filled to 70%, under 2 internal pages and the root
+	if got := table.estimate(8192, 0.7); got != 140*8192 {
+		t.Errorf("estimate() = %v, want %v", got, 140*8192)
+	}
+
+	// Records over half a page go to overflow pages
+	large := &tableSize{name: "db.desc"}
+	large.add([]string{"1", string(make([]byte, 10000))}, 8192)
+	if large.overflowPages != 2 {
+		t.Errorf("add() overflow pages = %v, want 2", large.overflowPages)
+	}
+}
+
+func TestPlausible(t *testing.T) {
+	tests := []struct {
+		actual   int64
+		estimate int64
+		want     bool
+	}{
+		{100, 100, true},
+		{300, 100, true},
+		{301, 100, false},
+		{34, 100, true},
+		{33, 100, false},
+	}
+	for _, test := range tests {
+		if got := plausible(test.actual, test.estimate, 3); got != test.want {
+			t.Errorf("plausible(%v, %v, 3) = %v, want %v", test.actual, test.estimate, got, test.want)
+		}
+	}
+}
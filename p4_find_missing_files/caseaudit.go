@@ -0,0 +1,71 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// An archive found on disk under another spelling than the path from the checkpoint
+type spellingMismatch struct {
+	path     string
+	diskPath string
+}
+
+// Returns how the paths differ: "case" when only the case of some letters differs, "encoding" when
+// the names only match once converted (Unicode normalization form or non-UTF-8 names)
+func (m spellingMismatch) kind() string {
+	if strings.EqualFold(m.path, m.diskPath) {
+		return "case"
+	}
+	return "encoding"
+}
+
+// Returns the first path component that differs, as spelled in the checkpoint and on disk
+func (m spellingMismatch) firstDifference() (string, string) {
+	components := strings.Split(m.path, "/")
+	diskComponents := strings.Split(m.diskPath, "/")
+	for i := 0; i < len(components) && i < len(diskComponents); i++ {
+		if components[i] != diskComponents[i] {
+			return components[i], diskComponents[i]
+		}
+	}
+	return m.path, m.diskPath
+}
+
+// Writes the archives found under another spelling as CSV
+func writeCaseAudit(filePath string, mismatches []spellingMismatch) error {
+	return output.WriteFile(filePath, func(w io.Writer) error {
+		csvWriter := output.NewCSVWriter(w)
+		csvWriter.Write([]string{"Depot", "Kind", "CheckpointName", "DiskName", "Path", "DiskPath"})
+		for _, mismatch := range mismatches {
+			name, diskName := mismatch.firstDifference()
+			csvWriter.Write([]string{archive.DepotName(mismatch.path), mismatch.kind(), name, diskName,
+				mismatch.path, mismatch.diskPath})
+		}
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return fmt.Errorf("error writing csv: %v", err)
+		}
+		return nil
+	})
+}
@@ -1,8 +1,29 @@
-module github.com/google/perforce-utils/p4-find-missing-files
+module github.com/google/perforce-utils/p4_find_missing_files
 
-go 1.15
+go 1.21
 
 require (
-	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
+	github.com/charmbracelet/bubbletea v0.26.6
+	github.com/google/perforce-utils/perforceutils v0.0.0
+	github.com/minio/md5-simd v1.1.2
+)
+
+require (
+	github.com/charmbracelet/x/ansi v0.1.2 // indirect
+	github.com/charmbracelet/x/input v0.1.0 // indirect
+	github.com/charmbracelet/x/term v0.1.1 // indirect
+	github.com/charmbracelet/x/windows v0.1.0 // indirect
+	github.com/erikgeiser/coninput v0.0.0-20211004153227-1c3628e74d0f // indirect
 	github.com/karrick/godirwalk v1.16.1 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.5 // indirect
+	github.com/mattn/go-localereader v0.0.1 // indirect
+	github.com/mattn/go-runewidth v0.0.15 // indirect
+	github.com/muesli/ansi v0.0.0-20230316100256-276c6243b2f6 // indirect
+	github.com/muesli/cancelreader v0.2.2 // indirect
+	github.com/rivo/uniseg v0.4.7 // indirect
+	github.com/xo/terminfo v0.0.0-20220910002029-abceb7e1c41e // indirect
+	golang.org/x/sync v0.7.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+	golang.org/x/text v0.3.8 // indirect
 )
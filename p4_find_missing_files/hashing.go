@@ -0,0 +1,93 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"hash"
+	"sync"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	md5simd "github.com/minio/md5-simd"
+)
+
+// The MD5 implementations of -digest-hash
+const (
+	// crypto/md5, in assembly on amd64 and arm64: each worker hashes its archive on its own core
+	goHash = "go"
+	// minio/md5-simd: the archives of up to 16 workers are hashed together on one core, in the lanes
+	// of the AVX2 or AVX-512 registers (it falls back to crypto/md5 without AVX2)
+	simdHash = "simd"
+)
+
+// The workers sharing an md5-simd server, which hashes 16 streams at once with AVX-512
+const simdLanes = 16
+
+// Starts the workers hashing archives for -verify-digests, pinned to the CPUs of cpuList or of a
+// NUMA node when given. The servers of md5-simd are closed along with the pool.
+func newHashPool(workers int, cpuList string, numaNode int, implementation string) (*archive.HashPool, func(), error) {
+	options := archive.HashPoolOptions{Workers: workers}
+	var err error
+	switch {
+	case len(cpuList) > 0 && numaNode >= 0:
+		return nil, nil, fmt.Errorf("-digest-cpus and -digest-numa-node can't be combined")
+	case len(cpuList) > 0:
+		options.CPUs, err = archive.ParseCPUList(cpuList)
+	case numaNode >= 0:
+		options.CPUs, err = archive.NodeCPUs(numaNode)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var servers []md5simd.Server
+	switch implementation {
+	case goHash:
+	case simdHash:
+		servers = make([]md5simd.Server, (workers+simdLanes-1)/simdLanes)
+		var mu sync.Mutex
+		options.NewHash = func(worker int) hash.Hash {
+			mu.Lock()
+			defer mu.Unlock()
+			server := servers[worker/simdLanes]
+			if server == nil {
+				server = md5simd.NewServer()
+				servers[worker/simdLanes] = server
+			}
+			return server.NewHash()
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown hash implementation %v, expected %v or %v", implementation, goHash, simdHash)
+	}
+
+	pool, err := archive.NewHashPool(options)
+	closeServers := func() {
+		for _, server := range servers {
+			if server != nil {
+				server.Close()
+			}
+		}
+	}
+	if err != nil {
+		closeServers()
+		return nil, nil, err
+	}
+	return pool, func() {
+		pool.Close()
+		closeServers()
+	}, nil
+}
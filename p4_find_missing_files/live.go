@@ -0,0 +1,318 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/lbr"
+	"github.com/google/perforce-utils/perforceutils/logging"
+)
+
+// The commands listing the expected archives of a live server, for -p4-live-command
+const (
+	// p4 storage lists db.storage, on servers from 2019.1
+	storageCommand = "storage"
+	// p4 fstat -Of -Oc -Ol lists every revision with its librarian file, for older servers
+	fstatCommand = "fstat"
+)
+
+// The depot types of p4 depots, as numbered in db.depot. Remote, archive and unload depots have no
+// archives of their own to list.
+var liveDepotTypes = map[string]lbr.DepotType{
+	"local":   lbr.LocalDepotType,
+	"remote":  lbr.RemoteDepotType,
+	"spec":    lbr.SpecDepotType,
+	"stream":  lbr.StreamDepotType,
+	"archive": lbr.ArchiveDepotType,
+	"unload":  lbr.UnloadDepotType,
+	"tangent": lbr.TangentDepotType,
+	"graph":   lbr.GraphDepotType,
+}
+
+// The actions of p4 fstat, as numbered in db.rev
+var liveActions = map[string]archive.FileAction{
+	"add":         archive.AddFileAction,
+	"edit":        archive.EditFileAction,
+	"delete":      archive.DeleteFileAction,
+	"branch":      archive.BranchFileAction,
+	"integrate":   archive.IntegrateFileAction,
+	"import":      archive.ImportFileAction,
+	"purge":       archive.PurgeFileAction,
+	"move/delete": archive.MoveFromFileAction,
+	"move/add":    archive.MoveToFileAction,
+	"archive":     archive.ArchiveFileAction,
+}
+
+// Runs the p4 command-line client against a live server or replica, with the connection settings
+// of the environment (P4PORT, P4USER, P4CONFIG)
+type liveServer struct {
+	p4 string
+	// Canceled when the run is interrupted, killing the running command
+	ctx context.Context
+}
+
+// Runs a p4 command with tagged output, calling fn with the tags of each record. Paths that match no
+// file aren't errors.
+func (s liveServer) scan(fn func(tags map[string]string) error, args ...string) error {
+	args = append([]string{"-ztag"}, args...)
+	slog.Debug("Running command", "command", s.p4, "args", strings.Join(args, " "))
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(s.ctx, s.p4, args...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%v failed: %v", s.p4, err)
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	tags := make(map[string]string)
+	flush := func() error {
+		if len(tags) == 0 {
+			return nil
+		}
+		err := fn(tags)
+		tags = make(map[string]string)
+		return err
+	}
+	var fnErr error
+	for scanner.Scan() && fnErr == nil {
+		line := scanner.Text()
+		if len(line) == 0 {
+			fnErr = flush()
+			continue
+		}
+		tag, value, _ := strings.Cut(strings.TrimPrefix(line, "... "), " ")
+		tags[tag] = value
+	}
+	if fnErr == nil {
+		fnErr = flush()
+	}
+	if fnErr == nil {
+		fnErr = scanner.Err()
+	}
+	if fnErr != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fnErr
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if s.ctx.Err() != nil {
+			return s.ctx.Err()
+		}
+		message := strings.TrimSpace(stderr.String())
+		for _, line := range strings.Split(message, "\n") {
+			if !strings.HasSuffix(line, "no such file(s).") {
+				return fmt.Errorf("%v %v failed: %v: %v", s.p4, strings.Join(args, " "), err, message)
+			}
+		}
+	}
+	return nil
+}
+
+// The numbers of records written to a live extract
+type liveCounts struct {
+	depots  int
+	records int
+	// Records whose type or numbers couldn't be read
+	skipped int
+}
+
+// Lists the expected archives of a live server into a checkpoint extract, to verify it in place of
+// a checkpoint: the case handling of the server as a counter, the depots, and the db.storage records
+// listed by p4 storage or the db.rev records of p4 fstat, table by table as in a checkpoint.
+// Shelved files aren't listed.
+func (s liveServer) writeExtract(w io.Writer, command string) (liveCounts, error) {
+	var counts liveCounts
+	writeRecord := func(version int, table string, fields ...string) error {
+		_, err := fmt.Fprintf(w, "@pv@ %d @%v@ %v \n", version, table, strings.Join(fields, " "))
+		return err
+	}
+	number := func(tags map[string]string, names ...string) (string, bool) {
+		for _, name := range names {
+			if value, ok := tags[name]; ok {
+				_, err := strconv.ParseInt(value, 10, 64)
+				return value, err == nil
+			}
+		}
+		return "0", true
+	}
+	// Digests are written as zeros when unknown, as p4d does
+	digest := func(tags map[string]string, name string) string {
+		if value := tags[name]; len(value) > 0 {
+			return value
+		}
+		return strings.Repeat("0", 32)
+	}
+	lbrType := func(text string) (string, bool) {
+		if _, err := strconv.Atoi(text); err == nil {
+			return text, true
+		}
+		bits, err := lbr.LibrarianType(text)
+		if err != nil {
+			return "", false
+		}
+		return strconv.Itoa(bits), true
+	}
+
+	err := s.scan(func(tags map[string]string) error {
+		if caseHandling, ok := tags[archive.CaseHandlingKey]; ok {
+			return writeRecord(1, "db.counters", journal.Quote(archive.CaseHandlingKey), journal.Quote(caseHandling))
+		}
+		return nil
+	}, "info")
+	if err != nil {
+		return counts, err
+	}
+
+	var depots []string
+	err = s.scan(func(tags map[string]string) error {
+		depotType, ok := liveDepotTypes[tags["type"]]
+		if !ok {
+			slog.Warn("Skipping depot of unknown type", logging.DepotKey, tags["name"], "type", tags["type"])
+			return nil
+		}
+		switch depotType {
+		case lbr.LocalDepotType, lbr.SpecDepotType, lbr.StreamDepotType, lbr.TangentDepotType:
+			depots = append(depots, tags["name"])
+		}
+		counts.depots++
+		return writeRecord(1, "db.depot", journal.Quote(tags["name"]), strconv.Itoa(int(depotType)),
+			journal.Quote(tags["extra"]), journal.Quote(tags["map"]))
+	}, "depots")
+	if err != nil {
+		return counts, err
+	}
+	sort.Strings(depots)
+
+	for _, depot := range depots {
+		slog.Info("Listing the archives of depot", logging.DepotKey, depot, "command", command)
+		fileSpec := "//" + depot + "/..."
+		switch command {
+		case storageCommand:
+			err = s.scan(func(tags map[string]string) error {
+				// Older releases name the librarian file depotFile
+				lbrFile, ok := tags["lbrFile"]
+				if !ok {
+					lbrFile = tags["depotFile"]
+				}
+				lbrRev, ok := tags["lbrRev"]
+				if !ok {
+					lbrRev = tags["rev"]
+				}
+				typeText, ok := tags["lbrType"]
+				if !ok {
+					typeText = tags["type"]
+				}
+				bits, typeOK := lbrType(typeText)
+				refCount, refCountOK := number(tags, "refCount")
+				size, sizeOK := number(tags, "size")
+				serverSize, serverSizeOK := number(tags, "serverSize")
+				date, dateOK := number(tags, "date")
+				if len(lbrFile) == 0 || len(lbrRev) == 0 || !typeOK || !refCountOK || !sizeOK || !serverSizeOK || !dateOK {
+					slog.Warn("Skipping unexpected storage record", logging.PathKey, lbrFile, logging.RevisionKey, lbrRev, "type", typeText)
+					counts.skipped++
+					return nil
+				}
+				counts.records++
+				return writeRecord(1, "db.storage", journal.Quote(lbrFile), journal.Quote(lbrRev), bits, refCount,
+					digest(tags, "digest"), size, serverSize, digest(tags, "compCksum"), date)
+			}, "storage", fileSpec)
+		case fstatCommand:
+			err = s.scan(func(tags map[string]string) error {
+				// Deleted revisions have no archive
+				if len(tags["lbrFile"]) == 0 {
+					return nil
+				}
+				action, actionOK := liveActions[tags["headAction"]]
+				bits, typeOK := lbrType(tags["lbrType"])
+				depotRev, revOK := number(tags, "headRev")
+				change, changeOK := number(tags, "headChange")
+				date, dateOK := number(tags, "headTime")
+				modTime, modTimeOK := number(tags, "headModTime")
+				size, sizeOK := number(tags, "fileSize")
+				if !actionOK || !typeOK || !revOK || !changeOK || !dateOK || !modTimeOK || !sizeOK {
+					slog.Warn("Skipping unexpected revision", logging.PathKey, tags["depotFile"], logging.RevisionKey, tags["headRev"],
+						"action", tags["headAction"], "type", tags["lbrType"])
+					counts.skipped++
+					return nil
+				}
+				lazy := "0"
+				if tags["lbrIsLazy"] == "1" {
+					lazy = "1"
+				}
+				counts.records++
+				return writeRecord(9, "db.rev", journal.Quote(tags["depotFile"]), depotRev, bits, strconv.Itoa(int(action)),
+					change, date, modTime, digest(tags, "digest"), size, "0", lazy, journal.Quote(tags["lbrFile"]),
+					journal.Quote(tags["lbrRev"]), bits)
+			}, "fstat", "-Of", "-Oc", "-Ol", fileSpec)
+		default:
+			return counts, fmt.Errorf("unknown command %v, expected %v or %v", command, storageCommand, fstatCommand)
+		}
+		if err != nil {
+			return counts, err
+		}
+	}
+	return counts, nil
+}
+
+// Lists the expected archives of a live server into path, or a temporary file when empty. The file
+// is removed when the listing fails or ctx is canceled.
+func writeLiveExtract(ctx context.Context, p4 string, command string, path string) (string, error) {
+	var file *os.File
+	var err error
+	if len(path) > 0 {
+		file, err = os.Create(path)
+	} else {
+		file, err = os.CreateTemp("", "p4_find_missing_files.*.ckp")
+	}
+	if err != nil {
+		return "", fmt.Errorf("error creating the extract: %v", err)
+	}
+	writer := bufio.NewWriter(file)
+	counts, err := liveServer{p4: p4, ctx: ctx}.writeExtract(writer, command)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	slog.Info("Listed the archives of the live server", "depots", counts.depots, "records", counts.records,
+		"skipped", counts.skipped, logging.PathKey, file.Name())
+	return file.Name(), nil
+}
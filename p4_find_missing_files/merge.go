@@ -0,0 +1,247 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/scope"
+)
+
+// Writes the outcome of a run as JSON, to be merged with the other shards
+func writePartialReport(filePath string, report *runReport) error {
+	return output.WriteFile(filePath, func(w io.Writer) error {
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			return fmt.Errorf("error writing partial report: %v", err)
+		}
+		return nil
+	})
+}
+
+func readPartialReport(filePath string) (*runReport, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	report := &runReport{}
+	if err := json.NewDecoder(file).Decode(report); err != nil {
+		return nil, fmt.Errorf("error reading partial report %v: %v", filePath, err)
+	}
+	return report, nil
+}
+
+// Combines the partial reports of the shards of a verification into a single report. All the
+// shards must be present exactly once, so that a shard that failed to run isn't mistaken for a
+// clean one.
+func mergePartialReports(reports []*runReport, paths []string) (*runReport, error) {
+	merged := &runReport{
+		JournalPath: reports[0].JournalPath,
+		DepotRoot:   reports[0].DepotRoot,
+		Table:       reports[0].Table,
+		Result:      archive.Result{ByDepot: make(map[string]*archive.Counts), Records: reports[0].Result.Records},
+	}
+	seen := make(map[int]string)
+	count := 0
+	for i, report := range reports {
+		shard, err := archive.ParseShard(report.Shard)
+		if err != nil || shard.Count <= 1 {
+			return nil, fmt.Errorf("%v is not the report of a shard (run with -shard)", paths[i])
+		}
+		if count == 0 {
+			count = shard.Count
+		} else if shard.Count != count {
+			return nil, fmt.Errorf("%v is shard %v, expected one of %v shards", paths[i], report.Shard, count)
+		}
+		if previous, ok := seen[shard.Index]; ok {
+			return nil, fmt.Errorf("shard %v is in both %v and %v", report.Shard, previous, paths[i])
+		}
+		seen[shard.Index] = paths[i]
+		if report.Interrupted || report.ResumeAfterLine > 0 {
+			return nil, fmt.Errorf("%v is the report of an interrupted or resumed run, which only verified part of the shard", paths[i])
+		}
+		if report.Table != merged.Table {
+			return nil, fmt.Errorf("%v verified db.%v, expected db.%v", paths[i], report.Table, merged.Table)
+		}
+
+		if merged.Started.IsZero() || report.Started.Before(merged.Started) {
+			merged.Started = report.Started
+		}
+		// Every shard reads the whole checkpoint, so they all skip the same malformed records, the
+		// same records of unterminated transactions, and the same records outside of -since/-until
+		if report.Malformed > merged.Malformed {
+			merged.Malformed = report.Malformed
+		}
+		if report.Result.PartialTransactionRecords > merged.Result.PartialTransactionRecords {
+			merged.Result.PartialTransactionRecords = report.Result.PartialTransactionRecords
+		}
+		if report.Result.OutOfWindow > merged.Result.OutOfWindow {
+			merged.Result.OutOfWindow = report.Result.OutOfWindow
+		}
+		// The filter is applied before the records are split between the shards
+		if report.Result.InFilter > merged.Result.InFilter {
+			merged.Result.InFilter = report.Result.InFilter
+		}
+		if report.Result.OutOfFilter > merged.Result.OutOfFilter {
+			merged.Result.OutOfFilter = report.Result.OutOfFilter
+		}
+		if report.Result.OutOfIndexFilter > merged.Result.OutOfIndexFilter {
+			merged.Result.OutOfIndexFilter = report.Result.OutOfIndexFilter
+		}
+		merged.Result.Processed += report.Result.Processed
+		merged.Result.Missing += report.Result.Missing
+		merged.Result.Unverifiable += report.Result.Unverifiable
+		merged.Result.TimedOut += report.Result.TimedOut
+		merged.Result.DigestsComputed += report.Result.DigestsComputed
+		merged.Result.DigestsCached += report.Result.DigestsCached
+		merged.Result.BadDigests += report.Result.BadDigests
+		merged.Result.CorruptArchives += report.Result.CorruptArchives
+		merged.Result.DigestsSkipped += report.Result.DigestsSkipped
+		merged.Result.DigestsTimedOut += report.Result.DigestsTimedOut
+		merged.Result.ExternalSkipped += report.Result.ExternalSkipped
+		merged.Result.ExternalChecked += report.Result.ExternalChecked
+		merged.Result.ExternalErrors += report.Result.ExternalErrors
+		merged.Result.GraphSkipped += report.Result.GraphSkipped
+		merged.Result.Shelved += report.Result.Shelved
+		merged.Result.SpellingMismatches += report.Result.SpellingMismatches
+		merged.Result.TruncatedArchives += report.Result.TruncatedArchives
+		for depot, counts := range report.Result.ByDepot {
+			total, ok := merged.Result.ByDepot[depot]
+			if !ok {
+				total = &archive.Counts{}
+				merged.Result.ByDepot[depot] = total
+			}
+			total.Processed += counts.Processed
+			total.Missing += counts.Missing
+			total.Unverifiable += counts.Unverifiable
+			total.TimedOut += counts.TimedOut
+		}
+		merged.Missing = append(merged.Missing, report.Missing...)
+		merged.Unverifiable = append(merged.Unverifiable, report.Unverifiable...)
+		merged.Unreadable = append(merged.Unreadable, report.Unreadable...)
+		merged.LayoutAnomalies = append(merged.LayoutAnomalies, report.LayoutAnomalies...)
+		merged.TruncatedArchives = append(merged.TruncatedArchives, report.TruncatedArchives...)
+	}
+	var absent []string
+	for i := 0; i < count; i++ {
+		if _, ok := seen[i]; !ok {
+			absent = append(absent, fmt.Sprintf("%d/%d", i, count))
+		}
+	}
+	if len(absent) > 0 {
+		return nil, fmt.Errorf("missing the reports of shards %v", strings.Join(absent, ", "))
+	}
+
+	// The shards run in parallel, so the merged run lasts until the last one finished
+	for _, report := range reports {
+		if end := report.Started.Add(report.Duration).Sub(merged.Started); end > merged.Duration {
+			merged.Duration = end
+		}
+	}
+	sort.Strings(merged.Missing)
+	sort.Strings(merged.Unverifiable)
+	sort.Slice(merged.Unreadable, func(i, j int) bool { return merged.Unreadable[i].Path < merged.Unreadable[j].Path })
+	sort.Slice(merged.LayoutAnomalies, func(i, j int) bool { return merged.LayoutAnomalies[i].Path < merged.LayoutAnomalies[j].Path })
+	sort.Slice(merged.TruncatedArchives, func(i, j int) bool {
+		return merged.TruncatedArchives[i].Path < merged.TruncatedArchives[j].Path
+	})
+	merged.Shards = count
+	return merged, nil
+}
+
+func runMerge(args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	htmlReport := flags.String("html-report", "", "File to write the HTML report of the whole verification to.")
+	missingCSV := flags.String("missing-csv", "", "File to write the missing files of all shards to, as CSV.")
+	truncatedCSV := flags.String("truncated-csv", "", "File to write the truncated archives of all shards to, as CSV (for shards run with -check-sizes).")
+	unreadableCSV := flags.String("unreadable-csv", "", "File to write the directories and files that the shards couldn't read to, as CSV.")
+	scopeMap := flags.String("scope-map", "", scopeMapUsage)
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if len(*htmlReport) == 0 && len(*missingCSV) == 0 && len(*truncatedCSV) == 0 && len(*unreadableCSV) == 0 {
+		return fmt.Errorf("specify -missing-csv, -truncated-csv, -unreadable-csv and/or -html-report")
+	}
+
+	var scopes *scope.Map
+	if len(*scopeMap) > 0 {
+		if len(*missingCSV) == 0 && len(*truncatedCSV) == 0 {
+			return fmt.Errorf("-scope-map requires -missing-csv and/or -truncated-csv")
+		}
+		var err error
+		if scopes, err = scope.ReadMap(*scopeMap); err != nil {
+			return fmt.Errorf("error reading scope map: %v", err)
+		}
+	}
+
+	var reports []*runReport
+	for _, path := range flags.Args() {
+		report, err := readPartialReport(path)
+		if err != nil {
+			return err
+		}
+		reports = append(reports, report)
+	}
+	merged, err := mergePartialReports(reports, flags.Args())
+	if err != nil {
+		return err
+	}
+	slog.Info("Merged partial reports", "shards", merged.Shards, "processed", merged.Result.Processed,
+		"missing", merged.Result.Missing, "unverifiable", merged.Result.Unverifiable)
+
+	if len(*missingCSV) > 0 {
+		if err := writeMissingCSV(*missingCSV, merged.Missing); err != nil {
+			return err
+		}
+		merged.CSVName = relativeLink(*htmlReport, *missingCSV)
+	}
+	if len(*truncatedCSV) > 0 {
+		if err := writeTruncatedCSV(*truncatedCSV, merged.TruncatedArchives); err != nil {
+			return err
+		}
+	}
+	if scopes != nil {
+		if err := writeTeamReports(scopes, *missingCSV, merged.Missing, *truncatedCSV, merged.TruncatedArchives); err != nil {
+			return err
+		}
+	}
+	if len(*unreadableCSV) > 0 {
+		if err := writeUnreadableCSV(*unreadableCSV, merged.Unreadable); err != nil {
+			return err
+		}
+	}
+	if len(*htmlReport) > 0 {
+		if err := writeHTMLReport(*htmlReport, merged); err != nil {
+			return err
+		}
+	}
+	slog.Info("Wrote merged report", logging.CountKey, len(merged.Missing))
+	return nil
+}
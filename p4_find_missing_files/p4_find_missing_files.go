@@ -16,246 +16,950 @@ limitations under the License.
 
 // The binary p4_find_missing_files scans Perforce checkpoints/journals and verifies
 // that all files are present in the depot.
-// It is meant as a quick alternative to the very slow "p4 verify" and,
-// unlike "p4 verify", it doesn't check md5 hashes.
+// It is meant as a quick alternative to the very slow "p4 verify": by default it doesn't check
+// md5 hashes, and with -verify-digests it keeps a cache of them so that repeated runs only hash
+// the archives that changed.
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
+	"math"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/golang/glog"
-	"github.com/karrick/godirwalk"
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/metrics"
+	"github.com/google/perforce-utils/perforceutils/notify"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/scope"
+	"github.com/google/perforce-utils/perforceutils/wildcard"
 )
 
-// https://www.perforce.com/perforce/doc.current/schema/#FileType
-type ServerStorageType int
-
-const (
-	RCSStorageType          ServerStorageType = 0
-	BinaryStorageType                         = 1
-	TinyStorageType                           = 2
-	CompressedStorageType                     = 3
-	TempObjStorageType                        = 4
-	DetectTypeStorageType                     = 5
-	CompressedTempObj                         = 6
-	BinaryAccessStorageType                   = 7
-	ExternalStorageType                       = 8
-)
+// Decides what happens to records that can't be parsed.
+// In strict mode, the first malformed record aborts processing.
+// Otherwise malformed records are counted and optionally copied to a quarantine file for inspection.
+type malformedRecordHandler struct {
+	strict     bool
+	count      int
+	quarantine *output.File
+}
 
-const (
-	// Each journal entry has an entry type, version and table name, totaling 3 fields.
-	// The db.storage entry has 9 fields per https://www.perforce.com/perforce/doc.current/schema/#db.storage.
-	DbStorageJournalFieldCount = 12
-)
+func (h *malformedRecordHandler) handle(record journal.Record, err error) error {
+	h.count++
+	if h.strict {
+		return fmt.Errorf("malformed record at line %v (byte offset %v): %v", record.LineNumber, record.Offset, err)
+	}
+	slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+		logging.OffsetKey, record.Offset, logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+	if h.quarantine != nil {
+		h.quarantine.WriteString(record.Raw)
+		h.quarantine.WriteString("\n")
+	}
+	return nil
+}
 
-func registerExistingPath(filemap map[string]int, value string, caseSensitive bool) {
-	valueToAdd := value
-	if !caseSensitive {
-		valueToAdd = strings.ToLower(value)
+// Returned by processEntries when verifying db.storage in a checkpoint that only has db.rev records
+var errNoStorageRecords = errors.New("no db.storage records")
+
+// Returned by processEntries, and by the walk, when the run is interrupted by SIGINT or SIGTERM
+var errInterrupted = errors.New("interrupted")
+
+// Returns errInterrupted for the errors of a context canceled by an interruption
+func interruption(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return errInterrupted
 	}
-	filemap[valueToAdd] = 1
-	glog.V(2).Infof("%v added to filemap\n", valueToAdd)
+	return err
 }
 
-func pathExistsOnDisk(filemap map[string]int, value string, caseSensitive bool) bool {
-	var exists bool
-	if caseSensitive {
-		_, exists = filemap[value]
-	} else {
-		_, exists = filemap[strings.ToLower(value)]
+// Reads the case handling of the server from the checkpoint, defaulting to case-insensitive
+func detectCaseSensitivity(journalPath string) bool {
+	// The standard input can't be read twice
+	if journalPath == journal.Stdin {
+		slog.Info("Case handling not detected when reading the standard input, assuming case-insensitive")
+		return false
 	}
+	file, err := journal.Open(journalPath)
+	if err != nil {
+		slog.Warn("Could not detect case handling", logging.Err(err))
+		return false
+	}
+	defer file.Close()
 
-	return exists
+	caseHandling, source, err := archive.DetectCaseHandling(file)
+	if err != nil {
+		slog.Warn("Could not detect case handling", logging.Err(err))
+		return false
+	}
+	if caseHandling == archive.UnknownCaseHandling {
+		slog.Info("Case handling not recorded in the checkpoint, assuming case-insensitive")
+		return false
+	}
+	slog.Info("Detected case handling", "case_handling", caseHandling.String(), "source", source)
+	return caseHandling == archive.SensitiveCaseHandling
 }
 
-// Scans an RCS file for revisions and adds file+revision pairs to the filemap
-func readVersionsFromRCS(filePath string, normalizedPath string, filemap map[string]int, caseSensitive bool) error {
-
-	file, err := os.OpenFile(filePath, os.O_RDONLY, os.ModePerm)
+// Reads the depots stored elsewhere than in a directory named after them from the checkpoint
+func readDepotMaps(journalPath string) archive.DepotMaps {
+	// The standard input can't be read twice
+	if journalPath == journal.Stdin {
+		slog.Info("Depot maps not read from the standard input, assuming depots are stored under their name")
+		return nil
+	}
+	file, err := journal.Open(journalPath)
 	if err != nil {
-		return fmt.Errorf("error opening RCS file %v: %v", filePath, err)
+		slog.Warn("Could not read depot maps", logging.Err(err))
+		return nil
 	}
 	defer file.Close()
 
-	var sentinelBuffer = [...]string{"text", "@@", "log"}
+	depots, err := archive.ReadDepotMaps(file)
+	if err != nil {
+		slog.Warn("Could not read depot maps", logging.Err(err))
+		return nil
+	}
+	for depot, dir := range depots {
+		slog.Info("Remapped depot", "depot", depot, logging.PathKey, dir)
+	}
+	return depots
+}
+
+// Reads the graph depots of the checkpoint, whose files are git objects rather than librarian files
+func readGraphDepots(journalPath string) map[string]bool {
+	if journalPath == journal.Stdin {
+		slog.Info("Depot types not read from the standard input, graph depots are checked as other depots")
+		return nil
+	}
+	file, err := journal.Open(journalPath)
+	if err != nil {
+		slog.Warn("Could not read depot types", logging.Err(err))
+		return nil
+	}
+	defer file.Close()
 
-	var circularBuffer [4]string
-	bufferPosition := 0
+	depotTypes, err := archive.ReadDepotTypes(file)
+	if err != nil {
+		slog.Warn("Could not read depot types", logging.Err(err))
+		return nil
+	}
+	depots := archive.GraphDepots(depotTypes)
+	for depot := range depots {
+		slog.Info("Skipping graph depot, whose git objects aren't librarian files", logging.DepotKey, depot)
+	}
+	return depots
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		circularBuffer[bufferPosition] = line
-		bufferPosition = (bufferPosition + 1) % len(circularBuffer)
-		if line == "text" {
-			testIndex := bufferPosition - 1
-			if testIndex < 0 {
-				testIndex = len(circularBuffer) - 1
-			}
-			scanIndex := 0
-			for scanIndex < len(sentinelBuffer) && circularBuffer[testIndex] == sentinelBuffer[scanIndex] {
-				scanIndex++
-				testIndex--
-				if testIndex < 0 {
-					testIndex = len(circularBuffer) - 1
-				}
-			}
-			if scanIndex == len(sentinelBuffer) {
-				registerExistingPath(filemap, normalizedPath+"/"+circularBuffer[testIndex], caseSensitive)
-			}
+// How long an external check command may run before it's counted as a failure
+const externalCheckTimeout = time.Minute
+
+// Returns an archive.Options.CheckExternal function running a command with the librarian file and
+// revision as its last two arguments. The command exits with 0 when the content exists, 1 when it
+// doesn't, and any other code when it can't tell.
+func externalCheckCommand(command string) func(lbrFile string, lbrRev string, record journal.Record) (bool, error) {
+	arguments := strings.Fields(command)
+	return func(lbrFile string, lbrRev string, record journal.Record) (bool, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), externalCheckTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, arguments[0], append(arguments[1:], lbrFile, lbrRev)...)
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return false, nil
+		}
+		if err != nil {
+			slog.Warn("External check failed", logging.PathKey, lbrFile, logging.RevisionKey, lbrRev,
+				logging.TableKey, record.Table, logging.Err(err))
+			return false, err
 		}
+		return true, nil
 	}
+}
 
-	return nil
+// Returns the librarian revision of a db.storage or db.rev record
+func recordRevision(record journal.Record) string {
+	if record.Table == "db.rev" {
+		return record.Field(archive.DbRevFieldLbrRev)
+	}
+	return record.Field(archive.DbStorageFieldLbrRev)
 }
 
-// Lists all versioned files under a depot path, optionally scoping the scan to the subdirectory specified by filter
-func listVersionedFiles(depotPath string, filter string, caseSensitive bool) (map[string]int, error) {
-	filemap := make(map[string]int)
-	rootPath := depotPath
-	if len(filter) > 0 {
-		rootPath = filepath.Join(depotPath,
-			strings.ReplaceAll(strings.Trim(filter, "/"), "/", string(filepath.Separator)))
-	}
-	err := godirwalk.Walk(rootPath, &godirwalk.Options{
-		Callback: func(osPathname string, de *godirwalk.Dirent) error {
-			if de.IsDir() {
-				return nil
-			}
-			// Normalized the path:
-			// 1. Strip depot path from osPathname
-			// 2. Ensure backslashes are converted to forward slashes - Perforce depot paths always use forward slashes
-			// 3. Trim any leading or trailing slashes
-			// 4. Prefix with // to make the path depot-absolute
-			normalizedPath := "//" + strings.Trim(strings.ReplaceAll(strings.Replace(osPathname, depotPath, "", 1), "\\", "/"), "/")
-			if strings.HasSuffix(normalizedPath, ",v") {
-				if err := readVersionsFromRCS(osPathname, normalizedPath, filemap, caseSensitive); err != nil {
-					return fmt.Errorf("Error reading versions from RCS file: %v", err)
-				}
-			} else {
-				registerExistingPath(filemap, normalizedPath, caseSensitive)
+// Processes a Helix Core checkpoint or journal and verifies all files listed in the table of the options.
+// Returns archive.ErrMaxMissing when options.MaxMissing files are missing, and errInterrupted when ctx is
+// canceled, after reporting the counts so far.
+func processEntries(ctx context.Context, journalPath string, index *archive.Index, options archive.Options,
+	malformed *malformedRecordHandler, emitter *metrics.Emitter, report *runReport, ui *tui) (archive.Result, error) {
+	file, err := journal.Open(journalPath)
+	if err != nil {
+		return archive.Result{}, fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	options.OnMissing = func(path string, record journal.Record) {
+		slog.Warn("Missing file", logging.DepotKey, archive.DepotName(path), logging.PathKey, path,
+			logging.RevisionKey, recordRevision(record), logging.TableKey, record.Table)
+		if report != nil {
+			report.Missing = append(report.Missing, path)
+			// Shelved archives aren't listed, as they can't be named by a revision
+			switch record.Table {
+			case "db.storage":
+				report.MissingArchives[archiveKey(record.Field(archive.DbStorageFieldLbrFile), record.Field(archive.DbStorageFieldLbrRev))] = true
+			case "db.rev":
+				report.MissingArchives[archiveKey(record.Field(archive.DbRevFieldLbrFile), record.Field(archive.DbRevFieldLbrRev))] = true
 			}
-			return nil
-		},
-		Unsorted: true, // we don't need sorting and this is faster
-	})
-	return filemap, err
+		}
+		ui.addMissing(path)
+	}
+	options.OnUnverifiable = func(path string, unreadable archive.UnreadablePath, record journal.Record) {
+		slog.Warn("Unverifiable file", logging.DepotKey, archive.DepotName(path), logging.PathKey, path,
+			logging.RevisionKey, recordRevision(record), logging.TableKey, record.Table,
+			"unreadable", unreadable.Path, logging.ErrorClassKey, unreadable.Class)
+		if report != nil {
+			report.Unverifiable = append(report.Unverifiable, path)
+		}
+		ui.addUnverifiable(path)
+	}
+	if ui != nil {
+		options.OnChecked = ui.checked
+	}
+	options.OnBadDigest = func(path string, digest string, expected string, record journal.Record) {
+		slog.Warn("Bad digest", logging.DepotKey, archive.DepotName(path), logging.PathKey, path,
+			logging.RevisionKey, recordRevision(record), logging.TableKey, record.Table,
+			"digest", digest, "expected", expected)
+	}
+	options.OnCorruptArchive = func(path string, err error, record journal.Record) {
+		slog.Warn("Corrupt archive", logging.DepotKey, archive.DepotName(path), logging.PathKey, path,
+			logging.RevisionKey, recordRevision(record), logging.TableKey, record.Table,
+			logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+	}
+	options.OnMalformed = malformed.handle
+	result, err := archive.Verify(ctx, file, index, options)
+	err = interruption(err)
+	if err != nil && err != archive.ErrMaxMissing && err != errInterrupted {
+		return result, err
+	}
+	if err == nil && options.Table == archive.StorageTable && result.Records["db.storage"] == 0 && result.Records["db.rev"] > 0 {
+		slog.Warn("No db.storage records found", "rev_records", result.Records["db.rev"])
+		return result, errNoStorageRecords
+	}
+
+	if result.PartialTransactionRecords > 0 {
+		slog.Warn("Skipped the records of unterminated transactions", logging.CountKey, result.PartialTransactionRecords)
+	}
+	slog.Info("Processed files", logging.CountKey, result.Processed)
+	slog.Info("Missing files", logging.CountKey, result.Missing)
+	if result.Unverifiable > 0 {
+		slog.Warn("Unverifiable files, under directories that couldn't be read", logging.CountKey, result.Unverifiable)
+	}
+	if result.TimedOut > 0 {
+		slog.Warn("Unverifiable files, under directories or in files that timed out", logging.CountKey, result.TimedOut)
+	}
+	slog.Info("Shelved files checked", logging.CountKey, result.Shelved)
+	if !options.Window.IsZero() {
+		slog.Info("Records dated outside of -since/-until", logging.CountKey, result.OutOfWindow)
+	}
+	if options.Filter != nil {
+		slog.Info("Records selected by -filter", logging.CountKey, result.InFilter, "left_out", result.OutOfFilter)
+	}
+	if result.OutOfIndexFilter > 0 {
+		slog.Warn("Records selected by -filter whose archives the walk left out, not verified", logging.CountKey, result.OutOfIndexFilter)
+	}
+	if options.Shard.Count > 1 {
+		slog.Info("Files left to other shards", logging.CountKey, result.OutOfShard)
+	}
+	if result.ExternalSkipped > 0 {
+		slog.Info("Skipped external (+X) files, which have no archive under the depot root", logging.CountKey, result.ExternalSkipped)
+	}
+	if options.CheckExternal != nil {
+		slog.Info("Checked external (+X) files", logging.CountKey, result.ExternalChecked, "errors", result.ExternalErrors)
+	}
+	if result.GraphSkipped > 0 {
+		slog.Info("Skipped graph depot files", logging.CountKey, result.GraphSkipped)
+	}
+	if options.OnTruncatedArchive != nil {
+		slog.Info("Truncated archives, empty or smaller than recorded", logging.CountKey, result.TruncatedArchives)
+		emitter.Gauge("truncated_archives", int64(result.TruncatedArchives))
+	}
+	emitter.Gauge("external_skipped", int64(result.ExternalSkipped))
+	emitter.Gauge("graph_skipped", int64(result.GraphSkipped))
+	emitter.Gauge("external_errors", int64(result.ExternalErrors))
+	if options.VerifyDigests {
+		slog.Info("Verified digests", "computed", result.DigestsComputed, "cached", result.DigestsCached,
+			"bad", result.BadDigests, "corrupt", result.CorruptArchives, "skipped", result.DigestsSkipped,
+			"timed_out", result.DigestsTimedOut)
+		emitter.Gauge("bad_digests", int64(result.BadDigests))
+		emitter.Gauge("corrupt_archives", int64(result.CorruptArchives))
+		emitter.Gauge("digests_computed", int64(result.DigestsComputed))
+		emitter.Gauge("digests_cached", int64(result.DigestsCached))
+	}
+	if report != nil {
+		report.Result = result
+	}
+
+	emitter.Gauge("processed", int64(result.Processed))
+	emitter.Gauge("missing", int64(result.Missing))
+	emitter.Gauge("unverifiable", int64(result.Unverifiable))
+	emitter.Gauge("timed_out", int64(result.TimedOut))
+	for depot, counts := range result.ByDepot {
+		emitter.Gauge("depot."+metrics.Sanitize(depot)+".processed", int64(counts.Processed))
+		emitter.Gauge("depot."+metrics.Sanitize(depot)+".missing", int64(counts.Missing))
+		emitter.Gauge("depot."+metrics.Sanitize(depot)+".unverifiable", int64(counts.Unverifiable))
+	}
+
+	return result, err
 }
 
-// Processes a Helix Core checkpoint or journal and verifies all files listed in the db.storage table
-func processDbStorageEntries(journalPath string, filemap map[string]int, filter string, caseSensitive bool) error {
-	file, err := os.OpenFile(journalPath, os.O_RDONLY, os.ModePerm)
+// Adds the files listed in a manifest, compressed or not, to the index
+func readManifest(ctx context.Context, manifestPath string, index *archive.Index, filter *wildcard.Filter, options archive.ManifestOptions) error {
+	file, err := journal.Open(manifestPath)
 	if err != nil {
-		return fmt.Errorf("open file error: %v", err)
+		return err
 	}
 	defer file.Close()
+	return index.ReadManifest(ctx, file, filter, options)
+}
+
+type filterList []string
+
+func (f *filterList) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *filterList) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
 
-	fileCount := 0
-	missingCount := 0
+func main() {
+	flags := struct {
+		caseSensitive  bool
+		encoding       string
+		verbose        bool
+		filters        filterList
+		table          string
+		strict         bool
+		quarantine     string
+		bloomFiles     int
+		bloomFPRate    float64
+		statsd         string
+		graphite       string
+		metricsPrefix  string
+		followLinks    bool
+		oneFS          bool
+		htmlReport     string
+		missingCSV     string
+		scopeMap       string
+		resumeLine     int
+		since          string
+		until          string
+		filespecs      string
+		maxMissing     int
+		verifyDigests  bool
+		digestCache    string
+		digestWorkers  int
+		digestCPUs     string
+		digestNUMANode int
+		digestHash     string
+		shard          string
+		partialReport  string
+		externalCheck  string
+		notifySlack    string
+		notifyEmail    string
+		notifySMTP     string
+		notifyFrom     string
+		notifyURL      string
+		ioNice         bool
+		ioNiceEntries  float64
+		ioNiceReadMB   float64
+		ioNicePrio     bool
+		ioTimeout      time.Duration
+		ioRetries      int
+		ioBackoff      time.Duration
+		netFS          bool
+		tui            bool
+		skipPartial    bool
+		depotMaps      bool
+		caseAudit      string
+		checkSizes     bool
+		truncatedCSV   string
+		walkRetries    int
+		walkRetryDelay time.Duration
+		unreadableCSV  string
+		manifest       string
+		manifestFormat string
+		manifestPrefix string
+		p4Live         bool
+		p4             string
+		p4LiveCommand  string
+		p4LiveExtract  string
+	}{}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, " ")
-		if len(parts) < 4 {
-			continue
+	flag.BoolVar(&flags.caseSensitive, "case-sensitive", false, "Case-sensitive processing (detected from the checkpoint by default).")
+	flag.StringVar(&flags.encoding, "encoding", "auto", "Encoding of non-UTF-8 file names: auto, utf8, latin1 or shiftjis.")
+	flag.BoolVar(&flags.verbose, "verbose", false, "Verbose output.")
+	flag.Var(&flags.filters, "filter", "Depot path pattern narrowing the scan, such as //depot/.../*.uasset, or excluding paths when starting with -, such as -//depot/builds/... (repeatable, last match wins).")
+	flag.StringVar(&flags.since, "since", "", "Only verify the records dated from this date (2006-01-02), time (RFC 3339) or duration before now (7d, 36h): when the archive was stored for db.storage, the submit date for db.rev.")
+	flag.StringVar(&flags.until, "until", "", "Only verify the records dated before this date, time or duration before now, as -since.")
+	flag.StringVar(&flags.table, "table", "storage", "Table listing the expected files: storage or rev.")
+	flag.BoolVar(&flags.strict, "strict", false, "Abort on the first malformed record instead of skipping it.")
+	flag.BoolVar(&flags.skipPartial, "skip-partial-transactions", false, "Leave out the records of the transactions a journal ends with unterminated (@bx@ without @ex@), such as after a crash.")
+	flag.StringVar(&flags.quarantine, "quarantine", "", "File to copy skipped malformed records to.")
+	flag.IntVar(&flags.bloomFiles, "bloom-files", 0, "Expected number of files on disk; uses a Bloom filter instead of an exact map when set.")
+	flag.Float64Var(&flags.bloomFPRate, "bloom-false-positive-rate", 0.01, "False positive rate of the Bloom filter, rechecked on disk.")
+	flag.BoolVar(&flags.followLinks, "follow-symlinks", false, "Follow symbolic links to directories under the depot root.")
+	flag.BoolVar(&flags.depotMaps, "depot-maps", true, "Read the archive directories of the depots from the Map field of db.depot, instead of assuming they are named after the depots.")
+	flag.BoolVar(&flags.oneFS, "one-filesystem", false, "Don't scan directories mounted from another filesystem.")
+	flag.StringVar(&flags.htmlReport, "html-report", "", "File to write an HTML report of the run to.")
+	flag.StringVar(&flags.caseAudit, "case-audit", "", "File to write the archives whose name on disk differs from the checkpoint (case or encoding) to, as CSV; matches names case-insensitively.")
+	flag.BoolVar(&flags.checkSizes, "check-sizes", false, "Also record the size of the full file archives found, and report the ones that are empty or smaller than recorded in db.storage, as left by interrupted copies.")
+	flag.StringVar(&flags.truncatedCSV, "truncated-csv", "", "File to write the archives found empty or smaller than recorded to, as CSV (requires -check-sizes).")
+	flag.IntVar(&flags.walkRetries, "walk-retries", 2, "Times the directories that couldn't be read are walked again once the rest of the depot root is scanned.")
+	flag.DurationVar(&flags.walkRetryDelay, "walk-retry-delay", 10*time.Second, "Wait before each retry of the directories that couldn't be read.")
+	flag.StringVar(&flags.unreadableCSV, "unreadable-csv", "", "File to write the directories and files that couldn't be read to, as CSV, with their error and the number of attempts.")
+	flag.StringVar(&flags.manifest, "manifest", "", "Listing of the archive files to verify against instead of walking DEPOT_ROOT, such as the output of find or an S3 inventory.")
+	flag.StringVar(&flags.manifestFormat, "manifest-format", archive.FindManifest, "Format of -manifest: find (one path per line) or s3 (S3 inventory CSV).")
+	flag.StringVar(&flags.manifestPrefix, "manifest-prefix", "", "Prefix stripped from the paths of -manifest to make them relative to the depot root.")
+	flag.BoolVar(&flags.p4Live, "p4-live", false, "List the expected archives from a live server or replica with the p4 command-line client instead of reading a checkpoint: DEPOT_ROOT is then the only argument (requires super access).")
+	flag.StringVar(&flags.p4, "p4", "p4", "Path to the p4 command-line client, for -p4-live.")
+	flag.StringVar(&flags.p4LiveCommand, "p4-live-command", storageCommand, "Command listing the archives with -p4-live: storage (p4 storage, servers from 2019.1) or fstat (p4 fstat -Of -Oc -Ol, older servers).")
+	flag.StringVar(&flags.p4LiveExtract, "p4-live-extract", "", "File to keep the records listed with -p4-live in, as a checkpoint extract to verify again or resume from (a temporary file by default).")
+	flag.StringVar(&flags.missingCSV, "missing-csv", "", "File to write the missing files to, as CSV.")
+	flag.StringVar(&flags.scopeMap, "scope-map", "", scopeMapUsage)
+	flag.StringVar(&flags.filespecs, "missing-filespecs", "", "File to write the submitted revisions whose archive is missing to, one //depot/path#rev per line, for p4 -x.")
+	flag.IntVar(&flags.resumeLine, "resume-after-line", 0, "Only verify the records after this line of the checkpoint, as logged by an interrupted run.")
+	flag.IntVar(&flags.maxMissing, "max-missing", 0, "Abort with a non-zero exit code once this many files are missing (0 for no limit).")
+	flag.BoolVar(&flags.verifyDigests, "verify-digests", false, "Also compare the MD5 digest of the full file archives found to the one recorded.")
+	flag.StringVar(&flags.digestCache, "digest-cache", "", "File caching the archive digests between runs, rehashing only the archives whose size or modification time changed.")
+	flag.IntVar(&flags.digestWorkers, "digest-workers", 0, "Full file archives hashed in parallel with -verify-digests, such as one per core (0 hashes them one after the other while reading the checkpoint).")
+	flag.StringVar(&flags.digestCPUs, "digest-cpus", "", "CPUs to pin the digest workers to, one CPU per worker in turn, as a list such as 0-19,40-59 (Linux only).")
+	flag.IntVar(&flags.digestNUMANode, "digest-numa-node", -1, "NUMA node whose CPUs the digest workers are pinned to, as -digest-cpus (Linux only).")
+	flag.StringVar(&flags.digestHash, "digest-hash", goHash, "MD5 implementation of the digest workers: go (assembly of the Go standard library, one archive per core) or simd (md5-simd, up to 16 archives per core with AVX2 or AVX-512).")
+	flag.StringVar(&flags.shard, "shard", "", "Only verify the part i/n of the depot path space (from 0/n to n-1/n), to spread a verification across n machines.")
+	flag.StringVar(&flags.partialReport, "partial-report", "", "File to write the results to, for the merge command to combine the reports of all shards.")
+	flag.StringVar(&flags.externalCheck, "external-check", "", "Command checking that the content of an external (+X) file exists, called with its librarian file and revision (they are skipped by default).")
+	flag.StringVar(&flags.notifySlack, "notify-slack-webhook", "", "Slack incoming webhook URL to post a summary of the run to when it finishes or fails.")
+	flag.StringVar(&flags.notifyEmail, "notify-email", "", "Comma-separated addresses to email a summary of the run to when it finishes or fails.")
+	flag.StringVar(&flags.notifySMTP, "notify-smtp", "localhost:25", "SMTP server host:port for -notify-email.")
+	flag.StringVar(&flags.notifyFrom, "notify-from", "", "Sender address for -notify-email (perforce-utils@<hostname> by default).")
+	flag.StringVar(&flags.notifyURL, "notify-report-url", "", "URL of the HTML report to link from notifications (the -html-report path by default).")
+	flag.BoolVar(&flags.ioNice, "io-nice", false, "Limit the disk accesses of the scan, to run against the live volume of a server.")
+	flag.Float64Var(&flags.ioNiceEntries, "io-nice-entries", 10000, "Directory entries walked per second with -io-nice (0 for no limit).")
+	flag.Float64Var(&flags.ioNiceReadMB, "io-nice-read-mb", 20, "MB of archives read per second with -io-nice (0 for no limit).")
+	flag.BoolVar(&flags.ioNicePrio, "io-nice-priority", true, "Also move the scan to the idle I/O scheduling class and the lowest CPU priority with -io-nice (Linux only).")
+	flag.DurationVar(&flags.ioTimeout, "io-timeout", 0, "Abandon the stat and read calls taking longer than this, such as 30s, leaving the directory or file unverifiable instead of hanging the scan on a flaky NFS mount (0 for no timeout).")
+	flag.IntVar(&flags.ioRetries, "io-retries", 2, "Retries of the stat and read calls that time out or fail transiently (stale NFS handles, I/O errors) with -io-timeout.")
+	flag.DurationVar(&flags.ioBackoff, "io-retry-backoff", time.Second, "Wait before the first retry with -io-timeout, doubled before each next one.")
+	flag.BoolVar(&flags.netFS, "net-fs", false, "The depot root is on a network filesystem (NFS, SMB): look the archives checked one by one (Bloom filter confirmations, sizes, digests) up in the listing of their directory, read once, instead of a stat call each.")
+	flag.BoolVar(&flags.tui, "tui", false, "Show the progress of the run in the terminal, then browse the missing files by directory once it's complete.")
+	flag.StringVar(&flags.statsd, "statsd", "", "StatsD host:port to send scan statistics to.")
+	flag.StringVar(&flags.graphite, "graphite", "", "Graphite plaintext host:port to send scan statistics to.")
+	flag.StringVar(&flags.metricsPrefix, "metrics-prefix", "perforce.find_missing_files", "Prefix of the metric names.")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(flags.verbose); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.Arg(0) == "merge" {
+		if err := runMerge(flag.Args()[1:]); err != nil {
+			logging.Fatal("Error merging partial reports", logging.Err(err))
+		}
+		return
+	}
+	// A manifest replaces the depot root, and -p4-live the checkpoint
+	journalPath, depotRoot := flag.Arg(0), flag.Arg(1)
+	arguments := 2
+	if flags.p4Live {
+		journalPath, depotRoot = "", flag.Arg(0)
+		arguments--
+	}
+	if len(flags.manifest) > 0 {
+		arguments--
+	}
+	if flag.NArg() < arguments {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if len(flags.manifest) > 0 {
+		if flags.verifyDigests {
+			logging.Fatal("-manifest lists the archives without their content and can't be combined with -verify-digests")
 		}
-		if parts[0] != "@pv@" {
-			continue
+		if flags.bloomFiles > 0 {
+			logging.Fatal("-manifest can't be combined with -bloom-files, which confirms files on disk")
 		}
-		if parts[2] != "@db.storage@" {
-			continue
+		if flags.checkSizes {
+			logging.Fatal("-manifest lists the archives without their size and can't be combined with -check-sizes")
 		}
+		depotRoot = flags.manifest
+	}
 
-		// The filename is the only part of the line that may contain spaces.
-		// That means that if a filename contained spaces, we'd have more fields than expected.
-		// We can find how many pieces the filename has been split into by computing the difference.
-		filenameExtraPartCount := len(parts) - DbStorageJournalFieldCount
+	if len(flags.truncatedCSV) > 0 && !flags.checkSizes {
+		logging.Fatal("-truncated-csv requires -check-sizes")
+	}
 
-		filename := strings.Join(parts[3:3+filenameExtraPartCount], " ")
-		filename = strings.Trim(filename, "@")
-		if len(filter) > 0 && !strings.HasPrefix(filename, filter) {
-			continue
+	var scopes *scope.Map
+	if len(flags.scopeMap) > 0 {
+		if len(flags.missingCSV) == 0 && len(flags.truncatedCSV) == 0 {
+			logging.Fatal("-scope-map requires -missing-csv and/or -truncated-csv")
 		}
-		revision := parts[3+filenameExtraPartCount]
-		fileType, err := strconv.Atoi(parts[4+filenameExtraPartCount])
-		if err != nil {
-			glog.Warningf("WARNING: Could not parse file type: %v", parts[4+filenameExtraPartCount])
-			continue
+		var err error
+		if scopes, err = scope.ReadMap(flags.scopeMap); err != nil {
+			logging.Fatal("Error reading scope map", logging.PathKey, flags.scopeMap, logging.Err(err))
 		}
+	}
 
-		serverFileType := ServerStorageType(fileType & 0xF)
-		var versionedFilePath string
+	if len(flags.filespecs) > 0 && journalPath == journal.Stdin {
+		logging.Fatal("-missing-filespecs reads the revisions of the missing files from the checkpoint again, which can't be done from the standard input")
+	}
 
-		glog.V(2).Infof("%v [%v] (%v - %v) scanned\n", filename, revision, fileType, serverFileType)
+	slog.Debug("Starting p4_find_missing_files in verbose mode")
 
-		if serverFileType == RCSStorageType {
-			versionedFilePath = filename + ",v/" + revision[1:len(revision)-1]
-		} else {
-			versionedFilePath = filename + ",d/" + revision[1:len(revision)-1]
+	if flags.table != archive.StorageTable && flags.table != archive.RevTable {
+		logging.Fatal("Unknown table, expected storage or rev", logging.TableKey, flags.table)
+	}
+	var shard archive.Shard
+	if len(flags.shard) > 0 {
+		var err error
+		if shard, err = archive.ParseShard(flags.shard); err != nil {
+			logging.Fatal("Invalid -shard", logging.Err(err))
 		}
+		slog.Info("Verifying shard", "shard", shard.String())
+	}
 
-		exists := pathExistsOnDisk(filemap, versionedFilePath, caseSensitive)
-		if !exists {
-			exists = pathExistsOnDisk(filemap, versionedFilePath+".gz", caseSensitive)
-			if !exists {
-				missingCount++
-				glog.Warningf("Missing %v", versionedFilePath)
+	// The flag overrides the case handling recorded in the checkpoint
+	caseSensitiveSet := false
+	tableSet := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "case-sensitive":
+			caseSensitiveSet = true
+		case "table":
+			tableSet = true
+		}
+	})
+	removeExtract := false
+	if flags.p4Live {
+		if flags.p4LiveCommand == fstatCommand {
+			// p4 fstat lists revisions, without db.storage
+			if tableSet && flags.table != archive.RevTable {
+				logging.Fatal("-p4-live-command=fstat lists the revisions of db.rev and can't be combined with -table=storage")
 			}
+			flags.table, tableSet = archive.RevTable, true
 		}
-
-		fileCount++
+		// Interrupting the listing removes the extract, as there's no verification to resume
+		listCtx, stopListSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		var err error
+		journalPath, err = writeLiveExtract(listCtx, flags.p4, flags.p4LiveCommand, flags.p4LiveExtract)
+		stopListSignals()
+		if errors.Is(err, context.Canceled) {
+			slog.Error("Interrupted while listing the archives of the live server, no file was verified")
+			os.Exit(130)
+		}
+		if err != nil {
+			logging.Fatal("Error listing the archives of the live server", logging.Err(err))
+		}
+		removeExtract = len(flags.p4LiveExtract) == 0
+	}
+	// The temporary extract of the live server is removed by every exit but the interruption of the
+	// verification, which can resume from it. The quarantine file is only replaced at the end.
+	malformed := &malformedRecordHandler{}
+	exit := func(code int) {
+		if malformed.quarantine != nil {
+			malformed.quarantine.Close()
+		}
+		if removeExtract {
+			os.Remove(journalPath)
+		}
+		os.Exit(code)
+	}
+	fatal := func(msg string, args ...interface{}) {
+		slog.Error(msg, args...)
+		exit(1)
+	}
+	if len(flags.caseAudit) > 0 {
+		// Archives spelled differently on disk must be matched to be reported
+		if caseSensitiveSet && flags.caseSensitive {
+			fatal("-case-audit matches names case-insensitively and can't be combined with -case-sensitive")
+		}
+		if flags.bloomFiles > 0 {
+			fatal("-case-audit keeps the names found on disk and can't be combined with -bloom-files")
+		}
+		flags.caseSensitive = false
+	} else if !caseSensitiveSet {
+		flags.caseSensitive = detectCaseSensitivity(journalPath)
 	}
 
-	glog.Infof("Processed %v files\n", fileCount)
-	glog.Infof("Missing %v files\n", missingCount)
-
-	return nil
-}
+	var filter *wildcard.Filter
+	if len(flags.filters) > 0 {
+		var err error
+		if filter, err = wildcard.NewFilter(flags.filters, !flags.caseSensitive); err != nil {
+			fatal("Invalid -filter", logging.Err(err))
+		}
+		slog.Info("Filtering librarian files", "filter", filter.String())
+	}
 
-func main() {
-	// glog to both stderr and to file
-	flag.Set("alsologtostderr", "true")
+	window, err := archive.ParseDateWindow(flags.since, flags.until, time.Now())
+	if err != nil {
+		fatal("Invalid date window", logging.Err(err))
+	}
+	if !window.IsZero() {
+		slog.Info("Verifying the records of a date window", "window", window.String())
+	}
 
-	flags := struct {
-		caseSensitive bool
-		verbose       bool
-		filter        string
-	}{}
+	var depots archive.DepotMaps
+	if flags.depotMaps {
+		depots = readDepotMaps(journalPath)
+	}
 
-	flag.BoolVar(&flags.caseSensitive, "case-sensitive", false, "Case-sensitive processing.")
-	flag.BoolVar(&flags.verbose, "verbose", false, "Verbose output.")
-	flag.StringVar(&flags.filter, "filter", "", "Prefix filter to narrow the scanning path.")
+	normalizer, err := archive.NewPathNormalizer(flags.caseSensitive, flags.encoding)
+	if err != nil {
+		fatal("Invalid -encoding", logging.Err(err))
+	}
 
-	flag.Parse()
-	if flag.NArg() < 2 {
-		glog.Errorf("Insufficient number or arguments specified")
-		os.Exit(1)
+	malformed.strict = flags.strict
+	if len(flags.quarantine) > 0 {
+		if malformed.quarantine, err = output.Create(flags.quarantine); err != nil {
+			fatal("Error creating quarantine file", logging.Err(err))
+		}
 	}
 
-	if flags.verbose {
-		flag.Set("v", "2")
+	emitter, err := metrics.Dial(flags.statsd, flags.graphite, flags.metricsPrefix)
+	if err != nil {
+		fatal("Could not connect to the metrics servers", logging.Err(err))
 	}
 
-	glog.V(2).Infoln("Starting p4_find_missing_files in verbose mode")
+	notifier := notify.New(flags.notifySlack, flags.notifyEmail, flags.notifySMTP, flags.notifyFrom)
+
+	options := archive.Options{
+		Table:         flags.table,
+		Filter:        filter,
+		Window:        window,
+		MaxMissing:    flags.maxMissing,
+		VerifyDigests: flags.verifyDigests,
+		DepotRoot:     depotRoot,
+		Depots:        depots,
+		GraphDepots:   readGraphDepots(journalPath),
+		Shard:         shard,
+
+		SkipPartialTransactions: flags.skipPartial,
+		ResumeAfterLine:         flags.resumeLine,
+	}
+	if flags.resumeLine > 0 {
+		slog.Info("Resuming the verification after a line of the checkpoint", logging.LineKey, flags.resumeLine)
+	}
+	if len(strings.TrimSpace(flags.externalCheck)) > 0 {
+		options.CheckExternal = externalCheckCommand(flags.externalCheck)
+	}
+	if len(flags.digestCache) > 0 {
+		if !flags.verifyDigests {
+			fatal("-digest-cache requires -verify-digests")
+		}
+		options.DigestCache, err = archive.OpenDigestCache(flags.digestCache)
+		if err != nil {
+			fatal("Error loading the digest cache", logging.PathKey, flags.digestCache, logging.Err(err))
+		}
+		slog.Debug("Loaded digest cache", logging.PathKey, flags.digestCache, logging.CountKey, options.DigestCache.Len())
+	}
+	closeHashPool := func() {}
+	if flags.digestWorkers > 0 {
+		if !flags.verifyDigests {
+			fatal("-digest-workers requires -verify-digests")
+		}
+		options.HashPool, closeHashPool, err = newHashPool(flags.digestWorkers, flags.digestCPUs, flags.digestNUMANode, flags.digestHash)
+		if err != nil {
+			fatal("Error starting the digest workers", logging.Err(err))
+		}
+		slog.Info("Hashing archives in parallel", "workers", flags.digestWorkers, "hash", flags.digestHash)
+	} else if len(flags.digestCPUs) > 0 || flags.digestNUMANode >= 0 {
+		fatal("-digest-cpus and -digest-numa-node require -digest-workers")
+	}
 
+	var throttle *archive.Throttle
+	if flags.ioNice {
+		throttle = archive.NewThrottle(flags.ioNiceEntries, flags.ioNiceReadMB*1024*1024)
+		options.Throttle = throttle
+		if flags.ioNicePrio {
+			if err := lowerPriority(); err != nil {
+				slog.Warn("Could not lower the priority of the scan", logging.Err(err))
+			}
+		}
+		slog.Info("Limiting disk accesses", "entries_per_second", flags.ioNiceEntries, "read_mb_per_second", flags.ioNiceReadMB)
+	}
+	var timeouts *archive.FileTimeouts
+	if flags.ioTimeout > 0 {
+		timeouts = archive.NewFileTimeouts(flags.ioTimeout, flags.ioRetries, flags.ioBackoff)
+		options.Timeouts = timeouts
+		slog.Info("Bounding disk accesses", "timeout", flags.ioTimeout.String(), "retries", flags.ioRetries)
+	}
+	options.NetworkFS = flags.netFS
+
+	// Interrupting the run stops it cleanly: the reports are written with the files verified so far
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		// A second interrupt exits immediately
+		stopSignals()
+		slog.Warn("Interrupted, writing the reports of the files verified so far (interrupt again to exit immediately)")
+	}()
+
+	var ui *tui
+	if flags.tui {
+		ui = startTUI(depotRoot)
+	}
 	start := time.Now()
-	filemap, _ := listVersionedFiles(flag.Arg(1), flags.filter, flags.caseSensitive)
-	err := processDbStorageEntries(flag.Arg(0), filemap, flags.filter, flags.caseSensitive)
-	if err != nil {
-		glog.Errorf("Error processing storage entries: %v\n", err)
+	index := archive.NewIndex(normalizer)
+	if flags.bloomFiles > 0 {
+		index = archive.NewBloomIndex(normalizer, flags.bloomFiles, flags.bloomFPRate)
+	}
+	var mismatches []spellingMismatch
+	if len(flags.caseAudit) > 0 {
+		if err := index.TrackDiskPaths(); err != nil {
+			fatal("Error setting up the case audit", logging.Err(err))
+		}
+		options.OnSpellingMismatch = func(path string, diskPath string, record journal.Record) {
+			slog.Debug("Name differs on disk", logging.PathKey, path, "disk_path", diskPath)
+			mismatches = append(mismatches, spellingMismatch{path: path, diskPath: diskPath})
+		}
+	}
+	var truncated []truncatedArchive
+	if flags.checkSizes {
+		if err := index.TrackSizes(); err != nil {
+			fatal("-check-sizes keeps the size of every archive found and can't be combined with -bloom-files")
+		}
+		options.OnTruncatedArchive = func(path string, size int64, expected int64, record journal.Record) {
+			slog.Warn("Truncated archive", logging.DepotKey, archive.DepotName(path), logging.PathKey, path,
+				logging.RevisionKey, recordRevision(record), logging.TableKey, record.Table,
+				"size", size, "expected", expected)
+			truncated = append(truncated, truncatedArchive{Path: path, Size: size, Expected: expected})
+		}
+	}
+	if len(flags.manifest) > 0 {
+		ui.setPhase(manifestPhase)
+		err = readManifest(ctx, flags.manifest, index, filter, archive.ManifestOptions{Format: flags.manifestFormat,
+			Prefix: flags.manifestPrefix, Shard: shard, Depots: depots, SkipDepots: options.GraphDepots})
+		if interruption(err) == errInterrupted {
+			ui.stop()
+			slog.Error("Interrupted while reading the manifest, no file was verified")
+			exit(130)
+		}
+		if err != nil {
+			ui.stop()
+			fatal("Error reading the manifest", logging.PathKey, flags.manifest, logging.Err(err))
+		}
+		slog.Info("Read manifest", logging.PathKey, flags.manifest, logging.CountKey, index.Len())
+	} else {
+		ui.setPhase(walkPhase)
+		walkOptions := archive.WalkOptions{FollowSymlinks: flags.followLinks, OneFilesystem: flags.oneFS, Shard: shard,
+			Throttle: throttle, Timeouts: timeouts, Depots: depots, SkipDepots: options.GraphDepots,
+			SubtreeRetries: flags.walkRetries, RetryDelay: flags.walkRetryDelay, NetworkFS: flags.netFS}
+		if ui != nil {
+			walkOptions.OnFile = ui.fileFound
+		}
+		err = index.Walk(ctx, depotRoot, filter, walkOptions)
+		if interruption(err) == errInterrupted {
+			ui.stop()
+			slog.Error("Interrupted while walking the depot root, no file was verified")
+			exit(130)
+		}
+		if err != nil {
+			ui.stop()
+			fatal("Error scanning the depot root", logging.PathKey, depotRoot, logging.Err(err))
+		}
+	}
+	if filter != nil {
+		slog.Info("Archives left out by -filter", logging.CountKey, index.FilteredOut())
+	}
+	if unreadable := index.Unreadable(); len(unreadable) > 0 {
+		slog.Warn("Directories and files that couldn't be read", logging.CountKey, len(unreadable), "timed_out", index.TimedOut())
+	}
+	for _, anomaly := range index.LayoutAnomalies() {
+		slog.Warn("Archive layout anomaly", logging.PathKey, anomaly.Path, "kind", anomaly.Kind,
+			"found", strings.Join(anomaly.Found, " "))
+	}
+	emitter.Gauge("timed_out_paths", int64(index.TimedOut()))
+	emitter.Gauge("layout_anomalies", int64(len(index.LayoutAnomalies())))
+	emitter.Timing("walk_duration", time.Since(start))
+	verifyStart := time.Now()
+	var report *runReport
+	if len(flags.htmlReport) > 0 || len(flags.missingCSV) > 0 || len(flags.partialReport) > 0 || len(flags.filespecs) > 0 {
+		report = &runReport{JournalPath: journalPath, DepotRoot: depotRoot, Table: flags.table, Started: start,
+			Shard: shard.String(), Unreadable: index.Unreadable(), LayoutAnomalies: index.LayoutAnomalies(),
+			MissingArchives: make(map[string]bool),
+			ResumeAfterLine: flags.resumeLine}
+	}
+	ui.setPhase(verifyPhase)
+	result, err := processEntries(ctx, journalPath, index, options, malformed, emitter, report, ui)
+	// Servers before 2019.1 have no db.storage table. The checkpoint is verified again against db.rev,
+	// unless the table was requested explicitly or the checkpoint can't be read twice.
+	if err == errNoStorageRecords && !tableSet && journalPath != journal.Stdin {
+		slog.Warn("The checkpoint has no db.storage table, as for servers before 2019.1: verifying db.rev instead")
+		options.Table = archive.RevTable
+		if report != nil {
+			report.Table = options.Table
+		}
+		result, err = processEntries(ctx, journalPath, index, options, malformed, emitter, report, ui)
+	}
+	closeHashPool()
+	if options.HashPool != nil {
+		stats := options.HashPool.Stats()
+		slog.Info("Hashed archives", logging.CountKey, stats.Files, "bytes", stats.Bytes,
+			logging.DurationKey, stats.Elapsed.String(), "mb_per_second", math.Round(stats.Throughput()/(1024*1024)*10)/10)
+		emitter.Gauge("digest_bytes_per_second", int64(stats.Throughput()))
+	}
+	if options.DigestCache != nil {
+		// Digests computed before an abort are still worth keeping
+		if saveErr := options.DigestCache.Save(); saveErr != nil {
+			slog.Error("Error saving the digest cache", logging.PathKey, flags.digestCache, logging.Err(saveErr))
+		}
+	}
+	emitter.Timing("verify_duration", time.Since(verifyStart))
+	if flags.bloomFiles > 0 {
+		rechecks, falsePositives := index.Rechecks()
+		slog.Info("Rechecked files on disk", logging.CountKey, rechecks, "false_positives", falsePositives)
+	}
+	if flags.netFS {
+		slog.Info("Listed directories to check their files", logging.CountKey, index.DirListings())
+	}
+	if err == archive.ErrMaxMissing {
+		slog.Error("Aborted after too many missing files", "max_missing", flags.maxMissing)
+	} else if err == errInterrupted {
+		slog.Error("Interrupted", logging.LineKey, result.LastLine)
+	} else if err == errNoStorageRecords {
+		slog.Error("The checkpoint has no db.storage table, as for servers before 2019.1: use -table=rev to verify db.rev")
+	} else if err != nil {
+		slog.Error("Error processing storage entries", logging.Err(err))
+	}
+
+	if malformed.count > 0 {
+		slog.Warn("Skipped malformed records", logging.CountKey, malformed.count)
+	}
+	if malformed.quarantine != nil {
+		if commitErr := malformed.quarantine.Commit(); commitErr != nil {
+			slog.Error("Error writing quarantine file", logging.Err(commitErr))
+			err = commitErr
+		}
 	}
 
 	elapsed := time.Since(start)
-	glog.Infof("Execution took %s\n", elapsed)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+
+	// An aborted or interrupted run still reports the files found so far
+	partial := err == archive.ErrMaxMissing || err == errInterrupted
+	if len(flags.caseAudit) > 0 && (err == nil || partial) {
+		slog.Info("Archives named differently on disk", logging.CountKey, len(mismatches))
+		if auditErr := writeCaseAudit(flags.caseAudit, mismatches); auditErr != nil {
+			slog.Error("Error writing case audit", logging.PathKey, flags.caseAudit, logging.Err(auditErr))
+			err = auditErr
+		}
+	}
 
+	if len(flags.unreadableCSV) > 0 && (err == nil || partial) {
+		if csvErr := writeUnreadableCSV(flags.unreadableCSV, index.Unreadable()); csvErr != nil {
+			slog.Error("Error writing unreadable paths", logging.PathKey, flags.unreadableCSV, logging.Err(csvErr))
+			err = csvErr
+		}
+	}
+
+	if len(flags.truncatedCSV) > 0 && (err == nil || partial) {
+		if csvErr := writeTruncatedCSV(flags.truncatedCSV, truncated); csvErr != nil {
+			slog.Error("Error writing truncated archives", logging.PathKey, flags.truncatedCSV, logging.Err(csvErr))
+			err = csvErr
+		}
+	}
+
+	if scopes != nil && (err == nil || partial) {
+		var missing []string
+		if report != nil {
+			missing = report.Missing
+		}
+		if scopeErr := writeTeamReports(scopes, flags.missingCSV, missing, flags.truncatedCSV, truncated); scopeErr != nil {
+			slog.Error("Error writing team reports", logging.Err(scopeErr))
+			err = scopeErr
+		}
+	}
+
+	if report != nil && (err == nil || partial) {
+		ui.setPhase(reportPhase)
+		report.Duration = elapsed
+		report.Malformed = malformed.count
+		report.TruncatedArchives = truncated
+		if err == errInterrupted {
+			report.Interrupted = true
+			report.LastLine = result.LastLine
+		}
+		var reportErr error
+		if len(flags.missingCSV) > 0 {
+			reportErr = writeMissingCSV(flags.missingCSV, report.Missing)
+			report.CSVName = relativeLink(flags.htmlReport, flags.missingCSV)
+		}
+		if err == errInterrupted && len(flags.filespecs) > 0 {
+			slog.Warn("Not writing -missing-filespecs, which reads the checkpoint again, for an interrupted run")
+		} else if reportErr == nil && len(flags.filespecs) > 0 {
+			var revisions int
+			revisions, reportErr = writeMissingFilespecs(flags.filespecs, journalPath, report)
+			slog.Info("Revisions whose archive is missing", logging.CountKey, revisions, logging.PathKey, flags.filespecs)
+		}
+		if reportErr == nil && len(flags.htmlReport) > 0 {
+			reportErr = writeHTMLReport(flags.htmlReport, report)
+		}
+		if reportErr == nil && len(flags.partialReport) > 0 {
+			reportErr = writePartialReport(flags.partialReport, report)
+		}
+		if reportErr != nil {
+			slog.Error("Error writing report", logging.Err(reportErr))
+			err = reportErr
+		}
+	}
+
+	summary := notify.Summary{Tool: "p4_find_missing_files", Err: err, Scanned: result.Processed,
+		Missing: result.Missing, Duration: elapsed, Report: flags.notifyURL}
+	if len(summary.Report) == 0 && len(flags.htmlReport) > 0 {
+		summary.Report, _ = filepath.Abs(flags.htmlReport)
+	}
+	if notifyErr := notifier.Send(summary); notifyErr != nil {
+		slog.Warn("Could not send notification", logging.Err(notifyErr))
+	}
+
+	emitter.Gauge("malformed", int64(malformed.count))
+	emitter.Timing("duration", elapsed)
+	if metricsErr := emitter.Close(); metricsErr != nil {
+		slog.Warn("Could not send metrics", logging.Err(metricsErr))
+	}
+
+	if err == errInterrupted {
+		ui.stop()
+		if removeExtract {
+			slog.Warn("Kept the extract of the live server, give it as the journal path to resume", logging.PathKey, journalPath)
+		}
+		// The last line verified, or the line the run resumed after when it didn't get further
+		slog.Warn("Verification interrupted, resume it with -resume-after-line", "resume_after_line",
+			max(result.LastLine, flags.resumeLine), logging.PathKey, journalPath)
+		os.Exit(130)
+	}
+	ui.finish(err)
+	if removeExtract {
+		os.Remove(journalPath)
+	}
 	if err != nil {
 		os.Exit(1)
 	}
@@ -0,0 +1,31 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadGraphDepots(t *testing.T) {
+	// The depot "repo" of the example checkpoint is a graph depot, listed after db.upgrades and db.user
+	got := readGraphDepots("../perforceutils/testdata/example_journal.txt")
+	want := map[string]bool{"repo": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readGraphDepots() = %v, want %v", got, want)
+	}
+}
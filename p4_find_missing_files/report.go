@@ -0,0 +1,416 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/scope"
+)
+
+const (
+	// Directories listed in the top missing directories table
+	reportTopDirectories = 50
+	// Missing files listed per depot; the CSV has all of them
+	reportFilesPerDepot = 1000
+)
+
+// The usage of the -scope-map flag of the verification and of merge
+const scopeMapUsage = "File mapping depot path prefixes to teams, one \"prefix team\" per line, to also write a copy of -missing-csv and -truncated-csv per team with the files under its paths."
+
+// The outcome of a verification run, as needed by the reports
+type runReport struct {
+	JournalPath string
+	DepotRoot   string
+	Table       string
+	Started     time.Time
+	Duration    time.Duration
+	Malformed   int
+	Result      archive.Result
+	// The paths of the missing librarian files, relative to the depot root
+	Missing []string
+	// The paths of the librarian files under unreadable directories, and these directories
+	Unverifiable []string                 `json:",omitempty"`
+	Unreadable   []archive.UnreadablePath `json:",omitempty"`
+	// The librarian files stored both as ,v and ,d, or with an uppercase suffix
+	LayoutAnomalies []archive.LayoutAnomaly `json:",omitempty"`
+	// The full file archives found smaller than recorded, with -check-sizes
+	TruncatedArchives []truncatedArchive `json:",omitempty"`
+	// The librarian files and revisions missing, keyed as archiveKey, to find the depot revisions
+	// using them
+	MissingArchives map[string]bool `json:"-"`
+	// Set when the run was interrupted, with the line of the last record it verified, and the line
+	// of the checkpoint the run resumed after
+	Interrupted     bool `json:",omitempty"`
+	LastLine        int  `json:",omitempty"`
+	ResumeAfterLine int  `json:",omitempty"`
+	// The name of the missing files CSV, linked from the HTML report
+	CSVName string
+	// The shard verified (i/n), or the number of shards of a merged report
+	Shard  string `json:",omitempty"`
+	Shards int    `json:",omitempty"`
+}
+
+// A full file archive found smaller than recorded, with its path relative to the depot root
+type truncatedArchive struct {
+	Path     string
+	Size     int64
+	Expected int64
+}
+
+type depotReport struct {
+	Name           string
+	Processed      int
+	Missing        int
+	Unverifiable   int
+	MissingPercent string
+	Files          []string
+	Truncated      int
+}
+
+type directoryCount struct {
+	Directory string
+	Missing   int
+}
+
+// Writes the missing files as CSV
+func writeMissingCSV(filePath string, missing []string) error {
+	return output.WriteFile(filePath, func(w io.Writer) error {
+		csvWriter := output.NewCSVWriter(w)
+		csvWriter.Write([]string{"Depot", "Directory", "Path"})
+		for _, missing := range missing {
+			csvWriter.Write([]string{archive.DepotName(missing), missingDirectory(missing), missing})
+		}
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return fmt.Errorf("error writing csv: %v", err)
+		}
+		return nil
+	})
+}
+
+// Writes the full file archives found smaller than recorded as CSV
+func writeTruncatedCSV(filePath string, truncated []truncatedArchive) error {
+	return output.WriteFile(filePath, func(w io.Writer) error {
+		csvWriter := output.NewCSVWriter(w)
+		csvWriter.Write([]string{"Depot", "Path", "Size", "ExpectedSize"})
+		for _, entry := range truncated {
+			csvWriter.Write([]string{archive.DepotName(entry.Path), entry.Path,
+				strconv.FormatInt(entry.Size, 10), strconv.FormatInt(entry.Expected, 10)})
+		}
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return fmt.Errorf("error writing csv: %v", err)
+		}
+		return nil
+	})
+}
+
+// Writes a CSV report per team of the scope map next to filePath, with the findings under the
+// paths the team owns
+func writeScopedCSV[T any](scopes *scope.Map, filePath string, items []T, path func(T) string,
+	write func(string, []T) error) error {
+	split := scope.Split(scopes, items, path)
+	teams := make([]string, 0, len(split))
+	for team := range split {
+		teams = append(teams, team)
+	}
+	sort.Strings(teams)
+	for _, team := range teams {
+		teamPath := scope.Destination(filePath, team)
+		if err := write(teamPath, split[team]); err != nil {
+			return err
+		}
+		slog.Info("Wrote team report", "team", team, logging.CountKey, len(split[team]), logging.PathKey, teamPath)
+	}
+	return nil
+}
+
+// Writes the copies of -missing-csv and -truncated-csv of each team of the scope map, skipping the
+// reports that aren't requested
+func writeTeamReports(scopes *scope.Map, missingCSV string, missing []string, truncatedCSV string,
+	truncated []truncatedArchive) error {
+	if len(missingCSV) > 0 {
+		err := writeScopedCSV(scopes, missingCSV, missing, func(path string) string { return path }, writeMissingCSV)
+		if err != nil {
+			return err
+		}
+	}
+	if len(truncatedCSV) > 0 {
+		return writeScopedCSV(scopes, truncatedCSV, truncated, func(entry truncatedArchive) string { return entry.Path },
+			writeTruncatedCSV)
+	}
+	return nil
+}
+
+// Writes the directories and files that couldn't be read, even after the retries of the walk
+func writeUnreadableCSV(filePath string, unreadable []archive.UnreadablePath) error {
+	return output.WriteFile(filePath, func(w io.Writer) error {
+		csvWriter := output.NewCSVWriter(w)
+		csvWriter.Write([]string{"Depot", "Path", "ErrorClass", "Error", "Attempts"})
+		for _, entry := range unreadable {
+			csvWriter.Write([]string{archive.DepotName(entry.Path), entry.Path, entry.Class, entry.Error,
+				strconv.Itoa(entry.Attempts)})
+		}
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return fmt.Errorf("error writing csv: %v", err)
+		}
+		return nil
+	})
+}
+
+// Returns the key of a librarian file revision in runReport.MissingArchives
+func archiveKey(lbrFile string, lbrRev string) string {
+	return lbrFile + "\x00" + lbrRev
+}
+
+// Writes the submitted revisions whose archive is missing as Perforce file specifications, one
+// //depot/path#rev per line, to be passed to p4 -x. The revisions are read from the db.rev records
+// of the checkpoint, so that the lazy copies sharing a missing archive are listed as well. Returns
+// the number of revisions written.
+func writeMissingFilespecs(filePath string, journalPath string, report *runReport) (int, error) {
+	var filespecs []string
+	err := journal.ScanFile(journalPath, map[string]bool{"db.rev": true}, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		rev, err := archive.ParseRevRecord(record.Fields)
+		if err != nil || !rev.Action.HasArchive() || !report.MissingArchives[archiveKey(rev.LbrFile, rev.LbrRev)] {
+			return nil
+		}
+		// Depot paths are recorded with their special characters (@#%*) already escaped
+		filespecs = append(filespecs, fmt.Sprintf("%v#%v", rev.DepotFile, rev.DepotRev))
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error reading the revisions of the missing files: %v", err)
+	}
+	sort.Strings(filespecs)
+	err = output.WriteFile(filePath, func(w io.Writer) error {
+		for _, filespec := range filespecs {
+			if _, err := fmt.Fprintln(w, filespec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return len(filespecs), err
+}
+
+// Returns the depot directory of a librarian file revision, for example //depot/dir for
+// //depot/dir/file.txt,d/1.2.gz
+func missingDirectory(versionedFilePath string) string {
+	directory := versionedFilePath
+	for i := 0; i < 2; i++ {
+		if slash := strings.LastIndex(directory, "/"); slash > 1 {
+			directory = directory[:slash]
+		}
+	}
+	return directory
+}
+
+func percent(part int, total int) string {
+	if total == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.2f%%", 100*float64(part)/float64(total))
+}
+
+// Writes a self-contained HTML report: summary, per-depot table with the missing files of each depot,
+// and the directories with the most missing files
+func writeHTMLReport(filePath string, report *runReport) error {
+	depots := make(map[string]*depotReport)
+	for name, counts := range report.Result.ByDepot {
+		depots[name] = &depotReport{
+			Name:           name,
+			Processed:      counts.Processed,
+			Missing:        counts.Missing,
+			Unverifiable:   counts.Unverifiable,
+			MissingPercent: percent(counts.Missing, counts.Processed),
+		}
+	}
+	directories := make(map[string]int)
+	for _, missing := range report.Missing {
+		directories[missingDirectory(missing)]++
+		depot, ok := depots[archive.DepotName(missing)]
+		if !ok {
+			continue
+		}
+		if len(depot.Files) < reportFilesPerDepot {
+			depot.Files = append(depot.Files, missing)
+		} else {
+			depot.Truncated++
+		}
+	}
+
+	var depotList []*depotReport
+	for _, depot := range depots {
+		sort.Strings(depot.Files)
+		depotList = append(depotList, depot)
+	}
+	sort.Slice(depotList, func(i, j int) bool {
+		if depotList[i].Missing != depotList[j].Missing {
+			return depotList[i].Missing > depotList[j].Missing
+		}
+		return depotList[i].Name < depotList[j].Name
+	})
+
+	var directoryList []directoryCount
+	for directory, count := range directories {
+		directoryList = append(directoryList, directoryCount{Directory: directory, Missing: count})
+	}
+	sort.Slice(directoryList, func(i, j int) bool {
+		if directoryList[i].Missing != directoryList[j].Missing {
+			return directoryList[i].Missing > directoryList[j].Missing
+		}
+		return directoryList[i].Directory < directoryList[j].Directory
+	})
+	if len(directoryList) > reportTopDirectories {
+		directoryList = directoryList[:reportTopDirectories]
+	}
+
+	truncated := report.TruncatedArchives
+	if len(truncated) > reportFilesPerDepot {
+		truncated = truncated[:reportFilesPerDepot]
+	}
+
+	return output.WriteFile(filePath, func(w io.Writer) error {
+		err := reportTemplate.Execute(w, struct {
+			*runReport
+			MissingPercent  string
+			Depots          []*depotReport
+			Directories     []directoryCount
+			Truncated       []truncatedArchive
+			TruncatedOthers int
+		}{report, percent(report.Result.Missing, report.Result.Processed), depotList, directoryList,
+			truncated, len(report.TruncatedArchives) - len(truncated)})
+		if err != nil {
+			return fmt.Errorf("error writing html report: %v", err)
+		}
+		return nil
+	})
+}
+
+// Returns the path of the CSV relative to the HTML report, so that the link survives copying both files
+func relativeLink(htmlPath string, csvPath string) string {
+	if link, err := filepath.Rel(filepath.Dir(htmlPath), csvPath); err == nil {
+		return filepath.ToSlash(link)
+	}
+	return csvPath
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Missing files report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #202124; }
+h1 { font-size: 1.6em; }
+.cards { display: flex; flex-wrap: wrap; gap: 1em; margin-bottom: 2em; }
+.card { border: 1px solid #dadce0; border-radius: 8px; padding: 1em 1.5em; min-width: 10em; }
+.card .value { font-size: 1.8em; font-weight: bold; }
+.card .label { color: #5f6368; }
+.card.alert .value { color: #d93025; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border-bottom: 1px solid #dadce0; padding: 0.3em 1em; text-align: left; }
+td.number { text-align: right; }
+details { margin-bottom: 0.5em; }
+summary { cursor: pointer; }
+ul { font-family: monospace; }
+.meta { color: #5f6368; }
+</style>
+</head>
+<body>
+<h1>Missing files report</h1>
+<p class="meta">{{.JournalPath}} against {{.DepotRoot}} (db.{{.Table}}{{if .Shard}}, shard {{.Shard}}{{end}}{{if .Shards}}, merged from {{.Shards}} shards{{end}}), {{.Started.Format "2006-01-02 15:04:05 MST"}}, took {{.Duration}}</p>
+{{if .ResumeAfterLine}}<p class="meta">Resumed after line {{.ResumeAfterLine}} of the checkpoint: the records before it were verified by an earlier run.</p>{{end}}
+{{if .Interrupted}}<p class="meta">Interrupted: only the records up to line {{.LastLine}} of the checkpoint were verified. Resume with -resume-after-line={{.LastLine}}.</p>{{end}}
+
+<div class="cards">
+<div class="card"><div class="value">{{.Result.Processed}}</div><div class="label">files checked</div></div>
+<div class="card{{if .Result.Missing}} alert{{end}}"><div class="value">{{.Result.Missing}}</div><div class="label">missing ({{.MissingPercent}})</div></div>
+<div class="card"><div class="value">{{len .Depots}}</div><div class="label">depots</div></div>
+{{if .Result.Unverifiable}}<div class="card alert"><div class="value">{{.Result.Unverifiable}}</div><div class="label">unverifiable (unreadable directories)</div></div>{{end}}
+{{if .Result.TimedOut}}<div class="card alert"><div class="value">{{.Result.TimedOut}}</div><div class="label">of which timed out</div></div>{{end}}
+<div class="card{{if .Malformed}} alert{{end}}"><div class="value">{{.Malformed}}</div><div class="label">malformed records</div></div>
+{{if .Result.ExternalSkipped}}<div class="card"><div class="value">{{.Result.ExternalSkipped}}</div><div class="label">external (+X) files skipped</div></div>{{end}}
+{{if .Result.GraphSkipped}}<div class="card"><div class="value">{{.Result.GraphSkipped}}</div><div class="label">graph depot files skipped</div></div>{{end}}
+{{if .Result.ExternalErrors}}<div class="card alert"><div class="value">{{.Result.ExternalErrors}}</div><div class="label">external checks failed</div></div>{{end}}
+{{if .Result.TruncatedArchives}}<div class="card alert"><div class="value">{{.Result.TruncatedArchives}}</div><div class="label">truncated archives</div></div>{{end}}
+</div>
+{{if .CSVName}}<p><a href="{{.CSVName}}">Download all missing files (CSV)</a></p>{{end}}
+
+<h2>Depots</h2>
+<table>
+<tr><th>Depot</th><th>Checked</th><th>Missing</th><th>Missing %</th>{{if .Result.Unverifiable}}<th>Unverifiable</th>{{end}}</tr>
+{{range .Depots}}<tr><td><a href="#depot-{{.Name}}">{{.Name}}</a></td><td class="number">{{.Processed}}</td><td class="number">{{.Missing}}</td><td class="number">{{.MissingPercent}}</td>{{if $.Result.Unverifiable}}<td class="number">{{.Unverifiable}}</td>{{end}}</tr>
+{{end}}</table>
+
+{{if .Unreadable}}<h2>Unreadable directories</h2>
+<p class="meta">The archives below these paths couldn't be checked, and are counted as unverifiable rather than missing.</p>
+<table>
+<tr><th>Path</th><th>Error class</th><th>Error</th><th>Attempts</th></tr>
+{{range .Unreadable}}<tr><td>{{.Path}}</td><td>{{.Class}}</td><td>{{.Error}}</td><td class="number">{{.Attempts}}</td></tr>
+{{end}}</table>{{end}}
+
+{{if .LayoutAnomalies}}<h2>Layout anomalies</h2>
+<p class="meta">These librarian files are stored both as an RCS file (,v) and as a directory of full files (,d), as left by some conversions (rcs_and_full), or with an uppercase ,V or ,D suffix that p4d doesn't find on case-sensitive servers (uppercase_suffix). p4d only reads one of them, so revisions may be missing or read from the wrong archive.</p>
+<table>
+<tr><th>Librarian file</th><th>Kind</th><th>Found</th></tr>
+{{range .LayoutAnomalies}}<tr><td>{{.Path}}</td><td>{{.Kind}}</td><td>{{range $i, $path := .Found}}{{if $i}}<br>{{end}}{{$path}}{{end}}</td></tr>
+{{end}}</table>{{end}}
+
+{{if .Truncated}}<h2>Truncated archives</h2>
+<p class="meta">These archives exist but are empty, or smaller than recorded in db.storage, as left by interrupted copies.</p>
+<table>
+<tr><th>Path</th><th>Size</th><th>Expected size</th></tr>
+{{range .Truncated}}<tr><td>{{.Path}}</td><td class="number">{{.Size}}</td><td class="number">{{.Expected}}</td></tr>
+{{end}}</table>
+{{if .TruncatedOthers}}<p class="meta">{{.TruncatedOthers}} more, see -truncated-csv</p>{{end}}{{end}}
+
+{{if .Directories}}<h2>Top missing directories</h2>
+<table>
+<tr><th>Directory</th><th>Missing</th></tr>
+{{range .Directories}}<tr><td>{{.Directory}}</td><td class="number">{{.Missing}}</td></tr>
+{{end}}</table>{{end}}
+
+<h2>Missing files by depot</h2>
+{{range .Depots}}{{if .Missing}}<details id="depot-{{.Name}}">
+<summary>{{.Name}}: {{.Missing}} missing</summary>
+<ul>
+{{range .Files}}<li>{{.}}</li>
+{{end}}</ul>
+{{if .Truncated}}<p class="meta">{{.Truncated}} more, see the CSV</p>{{end}}
+</details>
+{{end}}{{end}}
+</body>
+</html>
+`))
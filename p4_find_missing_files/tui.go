@@ -0,0 +1,401 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+)
+
+// The number of log lines kept for the events pane, and printed once the interface closes
+const tuiLogLines = 20
+
+// Phases of a run, as shown by the interface
+const (
+	manifestPhase = "reading the manifest"
+	walkPhase     = "walking the depot root"
+	verifyPhase   = "verifying the checkpoint"
+	reportPhase   = "writing reports"
+	completePhase = "complete"
+)
+
+// The progress of a run, updated by the scan and read by the interface
+type tuiState struct {
+	// Archives found by the walk, updated without the lock as it's the hottest counter
+	found atomic.Int64
+
+	mu        sync.Mutex
+	depotRoot string
+	started   time.Time
+	phase     string
+	counts    archive.Counts
+	byDepot   map[string]*archive.Counts
+	missing   []string
+	logs      []string
+	finished  bool
+	err       error
+}
+
+// Keeps the last log lines, as the log output while the interface is shown
+func (s *tuiState) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		s.logs = append(s.logs, line)
+	}
+	if len(s.logs) > tuiLogLines {
+		s.logs = s.logs[len(s.logs)-tuiLogLines:]
+	}
+	return len(p), nil
+}
+
+// Returns the counts of a depot, adding them when needed. The lock must be held.
+func (s *tuiState) depot(path string) *archive.Counts {
+	name := archive.DepotName(path)
+	counts, ok := s.byDepot[name]
+	if !ok {
+		counts = &archive.Counts{}
+		s.byDepot[name] = counts
+	}
+	return counts
+}
+
+// A full screen interface showing the progress of the run, then a browser of the missing files
+// grouped by directory once it's complete. Its methods do nothing on a nil *tui, so that the scan
+// calls them unconditionally.
+type tui struct {
+	state   *tuiState
+	program *tea.Program
+	// Closed once the interface is closed
+	closed chan struct{}
+	// Set when the interface is closed by stop rather than by the user
+	stopped atomic.Bool
+}
+
+// Takes over the terminal and redirects the logs to the events pane. Quitting before the run is
+// complete interrupts it.
+func startTUI(depotRoot string) *tui {
+	state := &tuiState{depotRoot: depotRoot, started: time.Now(), byDepot: make(map[string]*archive.Counts)}
+	ui := &tui{state: state, closed: make(chan struct{})}
+	ui.program = tea.NewProgram(&tuiModel{state: state}, tea.WithAltScreen())
+	logging.SetOutput(state)
+	go func() {
+		_, err := ui.program.Run()
+		logging.SetOutput(os.Stderr)
+		// The last events would otherwise vanish with the screen
+		state.mu.Lock()
+		for _, line := range state.logs {
+			fmt.Fprintln(os.Stderr, line)
+		}
+		finished := state.finished
+		state.mu.Unlock()
+		close(ui.closed)
+		switch {
+		case ui.stopped.Load():
+		case err != nil:
+			slog.Warn("Could not show the interface, going on without it", logging.Err(err))
+		case !finished:
+			slog.Error("Interrupted")
+			os.Exit(130)
+		}
+	}()
+	return ui
+}
+
+func (ui *tui) setPhase(phase string) {
+	if ui == nil {
+		return
+	}
+	ui.state.mu.Lock()
+	ui.state.phase = phase
+	ui.state.mu.Unlock()
+}
+
+// For WalkOptions.OnFile
+func (ui *tui) fileFound(path string) {
+	ui.state.found.Add(1)
+}
+
+// For Options.OnChecked
+func (ui *tui) checked(path string, record journal.Record) {
+	ui.state.mu.Lock()
+	ui.state.counts.Processed++
+	ui.state.depot(path).Processed++
+	ui.state.mu.Unlock()
+}
+
+func (ui *tui) addMissing(path string) {
+	if ui == nil {
+		return
+	}
+	ui.state.mu.Lock()
+	ui.state.counts.Missing++
+	ui.state.depot(path).Missing++
+	ui.state.missing = append(ui.state.missing, path)
+	ui.state.mu.Unlock()
+}
+
+func (ui *tui) addUnverifiable(path string) {
+	if ui == nil {
+		return
+	}
+	ui.state.mu.Lock()
+	ui.state.counts.Unverifiable++
+	ui.state.depot(path).Unverifiable++
+	ui.state.mu.Unlock()
+}
+
+// Marks the run complete, switches to the browser and waits for the user to quit
+func (ui *tui) finish(err error) {
+	if ui == nil {
+		return
+	}
+	ui.state.mu.Lock()
+	ui.state.phase = completePhase
+	ui.state.finished = true
+	ui.state.err = err
+	ui.state.mu.Unlock()
+	ui.program.Send(finishedMsg{})
+	<-ui.closed
+}
+
+// Closes the interface and gives the terminal back, such as before a fatal error
+func (ui *tui) stop() {
+	if ui == nil {
+		return
+	}
+	ui.stopped.Store(true)
+	ui.program.Kill()
+	<-ui.closed
+}
+
+type tickMsg time.Time
+type finishedMsg struct{}
+
+func tick() tea.Cmd {
+	return tea.Tick(250*time.Millisecond, func(t time.Time) tea.Msg { return tickMsg(t) })
+}
+
+type tuiModel struct {
+	state  *tuiState
+	width  int
+	height int
+
+	// The browser, once the run is complete: the directories with missing files, most first, and
+	// the files of the directory opened, if any
+	directories []directoryCount
+	files       map[string][]string
+	opened      string
+	// The selected line and the first line shown, of the directories and of the opened directory
+	cursor, offset         int
+	fileCursor, fileOffset int
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	return tick()
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+	case tickMsg:
+		if m.directories == nil {
+			return m, tick()
+		}
+	case finishedMsg:
+		m.buildBrowser()
+	case tea.KeyMsg:
+		return m, m.handleKey(msg.String())
+	}
+	return m, nil
+}
+
+// Groups the missing files by directory
+func (m *tuiModel) buildBrowser() {
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	m.files = make(map[string][]string)
+	for _, path := range m.state.missing {
+		directory := missingDirectory(path)
+		m.files[directory] = append(m.files[directory], path)
+	}
+	m.directories = make([]directoryCount, 0, len(m.files))
+	for directory, files := range m.files {
+		sort.Strings(files)
+		m.directories = append(m.directories, directoryCount{Directory: directory, Missing: len(files)})
+	}
+	sort.Slice(m.directories, func(i, j int) bool {
+		if m.directories[i].Missing != m.directories[j].Missing {
+			return m.directories[i].Missing > m.directories[j].Missing
+		}
+		return m.directories[i].Directory < m.directories[j].Directory
+	})
+}
+
+// The number of lines of the browser list
+func (m *tuiModel) listHeight() int {
+	// The header, summary and help lines
+	return max(m.height-6, 1)
+}
+
+func (m *tuiModel) handleKey(key string) tea.Cmd {
+	switch key {
+	case "q", "ctrl+c":
+		return tea.Quit
+	}
+	if m.directories == nil {
+		return nil
+	}
+	cursor, offset, count := &m.cursor, &m.offset, len(m.directories)
+	if len(m.opened) > 0 {
+		cursor, offset, count = &m.fileCursor, &m.fileOffset, len(m.files[m.opened])
+	}
+	switch key {
+	case "up", "k":
+		*cursor--
+	case "down", "j":
+		*cursor++
+	case "pgup":
+		*cursor -= m.listHeight()
+	case "pgdown", " ":
+		*cursor += m.listHeight()
+	case "home", "g":
+		*cursor = 0
+	case "end", "G":
+		*cursor = count - 1
+	case "enter", "right", "l":
+		if len(m.opened) == 0 && count > 0 {
+			m.opened = m.directories[m.cursor].Directory
+			m.fileCursor, m.fileOffset = 0, 0
+		}
+		return nil
+	case "esc", "left", "h", "backspace":
+		m.opened = ""
+		return nil
+	}
+	*cursor = min(max(*cursor, 0), max(count-1, 0))
+	if *cursor < *offset {
+		*offset = *cursor
+	} else if *cursor >= *offset+m.listHeight() {
+		*offset = *cursor - m.listHeight() + 1
+	}
+	return nil
+}
+
+// Cuts a line to the width of the terminal
+func (m *tuiModel) fit(line string) string {
+	if m.width <= 0 {
+		return line
+	}
+	runes := []rune(line)
+	if len(runes) > m.width {
+		return string(runes[:m.width])
+	}
+	return line
+}
+
+func (m *tuiModel) View() string {
+	m.state.mu.Lock()
+	defer m.state.mu.Unlock()
+	s := m.state
+	var view bytes.Buffer
+	line := func(format string, args ...interface{}) {
+		view.WriteString(m.fit(fmt.Sprintf(format, args...)))
+		view.WriteString("\n")
+	}
+
+	status := s.phase
+	if s.finished && s.err != nil {
+		status = fmt.Sprintf("failed: %v", s.err)
+	}
+	line("p4_find_missing_files %v: %v (%v)", s.depotRoot, status, time.Since(s.started).Truncate(time.Second))
+	line("Archives found %d   checked %d   missing %d   unverifiable %d",
+		s.found.Load(), s.counts.Processed, s.counts.Missing, s.counts.Unverifiable)
+	line("")
+	if m.directories != nil {
+		m.viewBrowser(line)
+		return view.String()
+	}
+
+	depots := make([]string, 0, len(s.byDepot))
+	for depot := range s.byDepot {
+		depots = append(depots, depot)
+	}
+	sort.Strings(depots)
+	line("%-30v %12v %12v %12v", "Depot", "Checked", "Missing", "Unverifiable")
+	// The depots, then the events pane
+	rows := max(m.height-len(s.logs)-7, 1)
+	for i, depot := range depots {
+		if i == rows-1 && len(depots) > rows {
+			line("... %d more depots", len(depots)-i)
+			break
+		}
+		counts := s.byDepot[depot]
+		line("%-30v %12d %12d %12d", depot, counts.Processed, counts.Missing, counts.Unverifiable)
+	}
+	line("")
+	for _, event := range s.logs {
+		line("%v", event)
+	}
+	line("q: quit (interrupts the run)")
+	return view.String()
+}
+
+// Shows the directories with missing files, or the missing files of the directory opened
+func (m *tuiModel) viewBrowser(line func(format string, args ...interface{})) {
+	if len(m.directories) == 0 {
+		line("No missing files.")
+		line("q: quit")
+		return
+	}
+	if len(m.opened) > 0 {
+		files := m.files[m.opened]
+		line("Missing files in %v (%d)", m.opened, len(files))
+		for i := m.fileOffset; i < len(files) && i < m.fileOffset+m.listHeight(); i++ {
+			line("%v %v", selectionMark(i == m.fileCursor), files[i])
+		}
+		line("esc: back   up/down, pgup/pgdown: move   q: quit")
+		return
+	}
+	line("Directories with missing files (%d)", len(m.directories))
+	for i := m.offset; i < len(m.directories) && i < m.offset+m.listHeight(); i++ {
+		directory := m.directories[i]
+		line("%v %8d  %v", selectionMark(i == m.cursor), directory.Missing, directory.Directory)
+	}
+	line("enter: open   up/down, pgup/pgdown: move   q: quit")
+}
+
+func selectionMark(selected bool) string {
+	if selected {
+		return ">"
+	}
+	return " "
+}
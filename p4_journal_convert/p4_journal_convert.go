@@ -0,0 +1,374 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_journal_convert rewrites the records of a Perforce checkpoint or journal into other
+// record versions of their tables, adding the fields missing from older versions and dropping the
+// ones the target version doesn't have, so that checkpoints of older servers can be read by the
+// newest parsers, and the other way around.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/schema"
+)
+
+// The note records marking the start of each table in checkpoints have this type, with the record
+// version and the table name at these indexes
+const (
+	tableNoteType         = "4"
+	tableNoteVersionField = 3
+	tableNoteTableField   = 8
+)
+
+// The rewriting of the records of a table from one record version to another
+type conversion struct {
+	table string
+	from  int
+	to    int
+	// The index in the source fields of each target field, or -1 for the fields the source version
+	// doesn't have, which are left empty
+	sources []int
+	// The value written for each target field missing from the record: @@ for strings, 0 for numbers
+	missing []string
+	// The source fields the target version doesn't have, by index
+	dropped map[int]string
+	// The source version is unknown: fields are matched by position, and the ones past the fields
+	// of the target version are dropped
+	byPosition bool
+
+	records int
+	// The records that had a value, other than empty or 0, in a dropped field
+	lostValues int
+}
+
+// Returns the names of the dropped fields, in their order in the source version
+func (c *conversion) droppedFields() []string {
+	indexes := make([]int, 0, len(c.dropped))
+	for i := range c.dropped {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	names := make([]string, len(indexes))
+	for i, index := range indexes {
+		names[i] = c.dropped[index]
+	}
+	return names
+}
+
+func newConversion(table string, from int, target schema.Table) *conversion {
+	c := &conversion{table: table, from: from, to: target.Version, dropped: make(map[int]string)}
+	for _, field := range target.Fields {
+		missing := journal.Quote("")
+		if schema.FieldKind(table, field) == schema.NumberKind {
+			missing = "0"
+		}
+		c.missing = append(c.missing, missing)
+	}
+	source, ok := schema.Layout(table, from)
+	if !ok {
+		c.byPosition = true
+		c.sources = make([]int, len(target.Fields))
+		for i := range c.sources {
+			c.sources[i] = i
+		}
+		slog.Warn("Unknown record version, matching fields by position", logging.TableKey, table, "from", from, "to", c.to)
+		return c
+	}
+	var padded []string
+	for _, field := range target.Fields {
+		index := source.Index(field)
+		c.sources = append(c.sources, index)
+		if index < 0 {
+			padded = append(padded, field)
+		}
+	}
+	for i, field := range source.Fields {
+		if target.Index(field) < 0 {
+			c.dropped[i] = field
+		}
+	}
+	if len(c.dropped) > 0 {
+		slog.Warn("Dropping fields unsupported by the target version", logging.TableKey, table, "from", from, "to", c.to,
+			"fields", strings.Join(c.droppedFields(), ","))
+	}
+	if len(padded) > 0 {
+		slog.Info("Adding fields missing from the source version, left empty or 0", logging.TableKey, table, "from", from,
+			"to", c.to, "fields", strings.Join(padded, ","))
+	}
+	return c
+}
+
+// Returns the fields of a record in the target version, @-quoting included
+func (c *conversion) convert(record journal.Record, tokens []string) []string {
+	c.records++
+	fields := tokens[journal.HeaderFieldCount:]
+	converted := make([]string, len(c.sources))
+	for i, source := range c.sources {
+		if source >= 0 && source < len(fields) {
+			converted[i] = fields[source]
+		} else {
+			converted[i] = c.missing[i]
+		}
+	}
+	lost := false
+	for i, value := range record.Fields {
+		if c.byPosition && i >= len(c.sources) {
+			c.dropped[i] = fmt.Sprintf("field%d", i)
+		}
+		// Numeric fields are 0 when unset
+		if _, dropped := c.dropped[i]; dropped && len(value) > 0 && value != "0" {
+			lost = true
+		}
+	}
+	if lost {
+		c.lostValues++
+	}
+	return converted
+}
+
+// Rewrites records into the target version of their table
+type converter struct {
+	// The target version of each table, the current one of the schema registry unless set by -to
+	targets map[string]int
+	// The tables given to -to, whose records of unknown versions are converted by position
+	explicit    map[string]bool
+	conversions map[string]map[int]*conversion
+	// The unknown record versions of each table, copied as is
+	unknownVersions map[string]map[int]int
+	// The records of tables missing from the schema registry, copied as is
+	unknownTables map[string]int
+}
+
+// Parses -to, a comma-separated list of table=version
+func newConverter(to string) (*converter, error) {
+	c := &converter{
+		targets:         make(map[string]int),
+		explicit:        make(map[string]bool),
+		conversions:     make(map[string]map[int]*conversion),
+		unknownVersions: make(map[string]map[int]int),
+		unknownTables:   make(map[string]int),
+	}
+	for table, layout := range schema.Tables {
+		c.targets[table] = layout.Version
+	}
+	if len(to) == 0 {
+		return c, nil
+	}
+	for _, entry := range strings.Split(to, ",") {
+		table, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		version, err := strconv.Atoi(value)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("invalid -to entry %q, expected table=version", entry)
+		}
+		if _, ok := schema.Layout(table, version); !ok {
+			return nil, fmt.Errorf("unknown layout of version %v of %v", version, table)
+		}
+		c.targets[table] = version
+		c.explicit[table] = true
+	}
+	return c, nil
+}
+
+// Returns the conversion of the records of a table version, or nil when they are kept as is
+func (c *converter) conversion(table string, version int) *conversion {
+	to, ok := c.targets[table]
+	if !ok || to == version {
+		return nil
+	}
+	if _, known := schema.Layout(table, version); !known && !c.explicit[table] {
+		// Matching the fields by position would misplace them when the version moved or removed
+		// some, which only the user can rule out
+		return nil
+	}
+	byVersion, ok := c.conversions[table]
+	if !ok {
+		byVersion = make(map[int]*conversion)
+		c.conversions[table] = byVersion
+	}
+	conv, ok := byVersion[version]
+	if !ok {
+		target, _ := schema.Layout(table, to)
+		conv = newConversion(table, version, target)
+		byVersion[version] = conv
+	}
+	return conv
+}
+
+// Returns the record converted to the target version of its table
+func (c *converter) convert(record journal.Record) string {
+	if record.Operation == journal.NoteTransaction && record.Field(0) == tableNoteType {
+		// The table markers of checkpoints give the version of the records that follow
+		version, err := strconv.Atoi(record.Field(tableNoteVersionField))
+		table := record.Field(tableNoteTableField)
+		if err != nil || c.conversion(table, version) == nil {
+			return record.Raw
+		}
+		tokens := journal.Tokens(record.Raw)
+		tokens[1+tableNoteVersionField] = strconv.Itoa(c.targets[table])
+		return joinTokens(tokens, record.Raw)
+	}
+	if !record.IsTableOperation() {
+		return record.Raw
+	}
+	if _, ok := c.targets[record.Table]; !ok {
+		if c.unknownTables[record.Table] == 0 {
+			slog.Warn("Copying the records of a table missing from the schema registry as is", logging.TableKey, record.Table,
+				"version", record.Version)
+		}
+		c.unknownTables[record.Table]++
+		return record.Raw
+	}
+	conv := c.conversion(record.Table, record.Version)
+	if conv == nil {
+		if _, known := schema.Layout(record.Table, record.Version); !known {
+			c.countUnknownVersion(record)
+		}
+		return record.Raw
+	}
+	tokens := journal.Tokens(record.Raw)
+	converted := append(tokens[:journal.HeaderFieldCount:journal.HeaderFieldCount], conv.convert(record, tokens)...)
+	converted[1] = strconv.Itoa(conv.to)
+	return joinTokens(converted, record.Raw)
+}
+
+// Counts a record of a version missing from the schema registry, copied as is
+func (c *converter) countUnknownVersion(record journal.Record) {
+	byVersion, ok := c.unknownVersions[record.Table]
+	if !ok {
+		byVersion = make(map[int]int)
+		c.unknownVersions[record.Table] = byVersion
+	}
+	if byVersion[record.Version] == 0 {
+		slog.Warn("Copying the records of an unknown record version as is, -to converts them by position",
+			logging.TableKey, record.Table, "version", record.Version, "to", c.targets[record.Table])
+	}
+	byVersion[record.Version]++
+}
+
+// Joins the tokens of a record, keeping the trailing space of the original record
+func joinTokens(tokens []string, raw string) string {
+	joined := strings.Join(tokens, " ")
+	if strings.HasSuffix(raw, " ") {
+		joined += " "
+	}
+	return joined
+}
+
+// Copies the records of a journal to w, converted. Returns the number of records read.
+func convertJournal(journalPath string, w io.Writer, c *converter) (int, error) {
+	file, err := journal.Open(journalPath)
+	if err != nil {
+		return 0, fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	read := 0
+	err = journal.Scan(file, func(record journal.Record) error {
+		read++
+		if _, err := io.WriteString(w, c.convert(record)); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\n")
+		return err
+	})
+	return read, err
+}
+
+func main() {
+	flags := struct {
+		to     string
+		output string
+	}{}
+
+	flag.StringVar(&flags.to, "to", "", "Comma-separated table=version record versions to convert tables to, such as db.rev=8 (the versions of the schema registry by default).")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File to write the converted journal to, replaced only once complete (the standard output by default).")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(false); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	c, err := newConverter(flags.to)
+	if err != nil {
+		logging.Fatal("Invalid -to", logging.Err(err))
+	}
+
+	start := time.Now()
+
+	var read int
+	err = output.WriteFile(flags.output, func(w io.Writer) error {
+		var err error
+		read, err = convertJournal(flag.Arg(0), w, c)
+		return err
+	})
+	if err != nil {
+		logging.Fatal("Error converting journal", logging.Err(err))
+	}
+
+	lostValues := 0
+	for _, byVersion := range c.conversions {
+		for _, conv := range byVersion {
+			slog.Info("Converted records", logging.TableKey, conv.table, "from", conv.from, "to", conv.to,
+				logging.CountKey, conv.records)
+			if conv.lostValues > 0 {
+				slog.Warn("Dropped values of fields unsupported by the target version", logging.TableKey, conv.table,
+					"from", conv.from, "to", conv.to, "fields", strings.Join(conv.droppedFields(), ","),
+					logging.CountKey, conv.lostValues)
+				lostValues += conv.lostValues
+			}
+		}
+	}
+	for table, byVersion := range c.unknownVersions {
+		for version, count := range byVersion {
+			slog.Info("Copied records of an unknown record version", logging.TableKey, table, "version", version,
+				logging.CountKey, count)
+		}
+	}
+	for table, count := range c.unknownTables {
+		slog.Info("Copied records of an unknown table", logging.TableKey, table, logging.CountKey, count)
+	}
+	slog.Info("Processed records", logging.CountKey, read)
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+	if lostValues > 0 {
+		os.Exit(2)
+	}
+}
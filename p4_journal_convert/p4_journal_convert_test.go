@@ -0,0 +1,88 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+)
+
+func TestConvert(t *testing.T) {
+	c, err := newConverter("")
+	if err != nil {
+		t.Fatalf("newConverter() returned %v", err)
+	}
+	tests := []struct {
+		record string
+		want   string
+	}{
+		// Version 8 of db.rev has no size, which is added as 0
+		{"@pv@ 8 @db.rev@ @//depot/a.txt@ 1 0 0 1 1611008038 1611008037 271E0A48226C79CCA6C1FCDE43CDAC31 0 0 @//depot/a.txt@ @1.1@ 0 ",
+			"@pv@ 9 @db.rev@ @//depot/a.txt@ 1 0 0 1 1611008038 1611008037 271E0A48226C79CCA6C1FCDE43CDAC31 0 0 0 @//depot/a.txt@ @1.1@ 0 "},
+		{"@nx@ 4 1611008050 @50@ 8 0 1327843568 0 0 @db.rev@ @@ @@ @@ @@ ",
+			"@nx@ 4 1611008050 @50@ 9 0 1327843568 0 0 @db.rev@ @@ @@ @@ @@ "},
+		// Current versions, unknown versions and unknown tables are kept as is
+		{"@pv@ 1 @db.counters@ @change@ @3@ ", "@pv@ 1 @db.counters@ @change@ @3@ "},
+		{"@pv@ 3 @db.counters@ @change@ @3@ ", "@pv@ 3 @db.counters@ @change@ @3@ "},
+		{"@pv@ 1 @db.other@ @a@ ", "@pv@ 1 @db.other@ @a@ "},
+		{"@ex@ 1 1611008050 ", "@ex@ 1 1611008050 "},
+	}
+	for _, test := range tests {
+		if got := c.convert(journal.Parse(test.record)); got != test.want {
+			t.Errorf("convert(%q) = %q, want %q", test.record, got, test.want)
+		}
+	}
+	if c.unknownVersions["db.counters"][3] != 1 || c.unknownTables["db.other"] != 1 {
+		t.Errorf("convert() counted %v unknown versions and %v unknown tables, want one of each", c.unknownVersions, c.unknownTables)
+	}
+}
+
+func TestConvertJournal(t *testing.T) {
+	c, err := newConverter("db.rev=8")
+	if err != nil {
+		t.Fatalf("newConverter() returned %v", err)
+	}
+	var converted bytes.Buffer
+	read, err := convertJournal("../perforceutils/testdata/example_journal.txt", &converted, c)
+	if err != nil {
+		t.Fatalf("convertJournal() returned %v", err)
+	}
+	if read == 0 || strings.Count(converted.String(), "\n") < read {
+		t.Errorf("convertJournal() read %v records and wrote %q", read, converted.String())
+	}
+	want := "@pv@ 8 @db.rev@ @//depot/path1/data1.dat@ 2 65539 1 2 1611008040 1611008039 F1C9645DBC14EFDDC7D8A322685F26EB 0 0 @//depot/path1/data1.dat@ @1.2@ 65539 \n"
+	if !strings.Contains(converted.String(), want) {
+		t.Errorf("convertJournal() wrote %q, want it to contain %q", converted.String(), want)
+	}
+	// All the revisions of the example have a size, lost in version 8
+	conv := c.conversions["db.rev"][9]
+	if conv == nil || conv.records != 6 || conv.lostValues != 6 || !reflect.DeepEqual(conv.droppedFields(), []string{"size"}) {
+		t.Errorf("convertJournal() conversion of db.rev = %+v, want 6 records losing their size", conv)
+	}
+}
+
+func TestNewConverterErrors(t *testing.T) {
+	for _, to := range []string{"db.rev", "db.rev=x", "db.rev=1", "db.other=1"} {
+		if _, err := newConverter(to); err == nil {
+			t.Errorf("newConverter(%q) succeeded, want an error", to)
+		}
+	}
+}
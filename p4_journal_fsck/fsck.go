@@ -0,0 +1,267 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/schema"
+)
+
+// The structural problems found in journals
+const (
+	// A quoted value isn't closed before the next record starts, or before the end of the file
+	unterminatedQuote = "unterminated-quote"
+	unknownOperation  = "unknown-operation"
+	// A table operation without a numeric version or a table name
+	badHeader = "bad-header"
+	// A table record with an older version than an earlier record of the same table
+	versionDecrease = "version-decrease"
+	// A table record with another number of fields than the registry has for its version
+	fieldCount = "field-count"
+	// A table record with another number of fields than the first record of its table and version
+	inconsistentFieldCount = "inconsistent-field-count"
+	// An unquoted value that isn't a number or a digest, such as garbage written over a record
+	badToken = "bad-token"
+	// NUL bytes, as left by zeroed disk blocks
+	nulBytes = "nul-bytes"
+	// The last line has no line ending
+	truncatedLine = "truncated-line"
+	// The file doesn't end with an @ex@ record
+	missingEndMarker = "missing-end-marker"
+)
+
+// The order problems are summarized in
+var problemKinds = []string{unterminatedQuote, unknownOperation, badHeader, versionDecrease, fieldCount,
+	inconsistentFieldCount, badToken, nulBytes, truncatedLine, missingEndMarker}
+
+// A suspect region of a journal
+type problem struct {
+	kind string
+	// The byte offset (in the uncompressed journal), line and length of the record
+	offset int64
+	line   int
+	length int
+	table  string
+	detail string
+}
+
+var knownOperations = map[string]bool{
+	journal.PutValue:          true,
+	journal.ReplaceValue:      true,
+	journal.DeleteValue:       true,
+	journal.VerifyValue:       true,
+	journal.EndTransaction:    true,
+	journal.BeginTransaction:  true,
+	journal.MarkTransaction:   true,
+	journal.NoteTransaction:   true,
+	journal.CheckpointComment: true,
+}
+
+// Lines looking like the start of a record. Inside a quoted value, the @ of such a line would be
+// escaped, so finding one while a value is still open means the quote is unbalanced.
+var recordStartPattern = regexp.MustCompile(`^@(pv|rv|dv|vv|ex|bx|mx|nx|rc)@( |\r?$)`)
+
+// Unquoted values are numbers, or hexadecimal digests
+var unquotedPattern = regexp.MustCompile(`^-?[0-9A-Fa-f]+$`)
+
+// The layout seen for a table
+type tableLayout struct {
+	version int
+	// The number of fields of the first record of each version
+	fieldCounts map[int]int
+}
+
+// Checks the structure of a journal, record by record
+type checker struct {
+	tables   map[string]*tableLayout
+	problems map[string]int
+	records  int
+	// Called for each problem found
+	onProblem func(problem)
+	// Called when the version of a table goes up, which happens in journals spanning an upgrade
+	onUpgrade  func(table string, from int, to int, offset int64)
+	lastRecord journal.Record
+}
+
+func newChecker(onProblem func(problem), onUpgrade func(table string, from int, to int, offset int64)) *checker {
+	return &checker{
+		tables:    make(map[string]*tableLayout),
+		problems:  make(map[string]int),
+		onProblem: onProblem,
+		onUpgrade: onUpgrade,
+	}
+}
+
+func (c *checker) report(p problem) {
+	c.problems[p.kind]++
+	c.onProblem(p)
+}
+
+// Returns whether a line leaves a quoted value open, given whether it started inside one
+func endsInQuote(line string, inQuote bool) bool {
+	for i := 0; i < len(line); i++ {
+		if line[i] != '@' {
+			continue
+		}
+		if inQuote && i+1 < len(line) && line[i+1] == '@' {
+			i++
+			continue
+		}
+		inQuote = !inQuote
+	}
+	return inQuote
+}
+
+// Reads a journal and checks its records
+func (c *checker) check(r io.Reader) error {
+	reader := bufio.NewReaderSize(r, 1024*1024)
+	var raw strings.Builder
+	inQuote := false
+	lineNumber := 0
+	startLine := 1
+	offset := int64(0)
+	startOffset := int64(0)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("read error at offset %v: %v", offset, err)
+		}
+		if len(line) > 0 {
+			lineNumber++
+			if inQuote && recordStartPattern.MatchString(line) {
+				c.report(problem{kind: unterminatedQuote, offset: startOffset, line: startLine, length: raw.Len(),
+					table: journal.Parse(raw.String()).Table, detail: fmt.Sprintf("record at line %v starts inside a quoted value", lineNumber)})
+				c.checkRecord(raw.String(), startOffset, startLine, false)
+				raw.Reset()
+				inQuote = false
+				startLine = lineNumber
+				startOffset = offset
+			}
+			if strings.IndexByte(line, 0) >= 0 {
+				c.report(problem{kind: nulBytes, offset: offset + int64(strings.IndexByte(line, 0)), line: lineNumber,
+					length: strings.Count(line, "\x00")})
+			}
+			offset += int64(len(line))
+			raw.WriteString(line)
+			inQuote = endsInQuote(line, inQuote)
+		}
+		if err == io.EOF {
+			if len(line) > 0 {
+				c.report(problem{kind: truncatedLine, offset: offset - int64(len(line)), line: lineNumber, length: len(line)})
+			}
+			if inQuote {
+				c.report(problem{kind: unterminatedQuote, offset: startOffset, line: startLine, length: raw.Len(),
+					table: journal.Parse(raw.String()).Table, detail: "quoted value still open at the end of the file"})
+			}
+			if raw.Len() > 0 {
+				c.checkRecord(raw.String(), startOffset, startLine, !inQuote)
+			}
+			if c.records == 0 {
+				c.report(problem{kind: missingEndMarker, detail: "no records"})
+			} else if c.lastRecord.Operation != journal.EndTransaction {
+				c.report(problem{kind: missingEndMarker, offset: offset, line: lineNumber,
+					detail: fmt.Sprintf("last record is @%v@", c.lastRecord.Operation)})
+			}
+			return nil
+		}
+		if inQuote {
+			continue
+		}
+		c.checkRecord(raw.String(), startOffset, startLine, true)
+		raw.Reset()
+		startLine = lineNumber + 1
+		startOffset = offset
+	}
+}
+
+// Checks a record. The fields of incomplete records aren't checked, as they can't be told apart.
+func (c *checker) checkRecord(raw string, offset int64, line int, complete bool) {
+	text := strings.TrimRight(raw, "\r\n")
+	if len(strings.TrimSpace(text)) == 0 {
+		return
+	}
+	c.records++
+	record := journal.Parse(text)
+	c.lastRecord = record
+	at := problem{offset: offset, line: line, length: len(raw), table: record.Table}
+
+	tokens := journal.Tokens(text)
+	if !strings.HasPrefix(tokens[0], "@") || !knownOperations[record.Operation] {
+		at.kind, at.detail = unknownOperation, fmt.Sprintf("%.40q", tokens[0])
+		c.report(at)
+		return
+	}
+	if !complete {
+		return
+	}
+	for i, token := range tokens[1:] {
+		if !strings.HasPrefix(token, "@") && !unquotedPattern.MatchString(token) {
+			at.kind, at.detail = badToken, fmt.Sprintf("field %v is %.40q", i+1, token)
+			c.report(at)
+			return
+		}
+	}
+	switch record.Operation {
+	case journal.PutValue, journal.ReplaceValue, journal.DeleteValue, journal.VerifyValue:
+	default:
+		return
+	}
+	if !record.IsTableOperation() {
+		at.kind, at.detail = badHeader, "no numeric version and table name"
+		c.report(at)
+		return
+	}
+	if _, err := strconv.Atoi(tokens[1]); err != nil || !strings.HasPrefix(tokens[2], "@") {
+		at.kind, at.detail = badHeader, fmt.Sprintf("%.40q", strings.Join(tokens[1:3], " "))
+		c.report(at)
+		return
+	}
+
+	layout, ok := c.tables[record.Table]
+	if !ok {
+		layout = &tableLayout{version: record.Version, fieldCounts: make(map[int]int)}
+		c.tables[record.Table] = layout
+	}
+	if record.Version < layout.version {
+		at.kind, at.detail = versionDecrease, fmt.Sprintf("version %v after version %v", record.Version, layout.version)
+		c.report(at)
+	} else if record.Version > layout.version {
+		c.onUpgrade(record.Table, layout.version, record.Version, offset)
+		layout.version = record.Version
+	}
+
+	if known, ok := schema.Tables[record.Table]; ok && known.Version == record.Version && len(record.Fields) != len(known.Fields) {
+		at.kind, at.detail = fieldCount, fmt.Sprintf("%v fields, %v expected for version %v", len(record.Fields),
+			len(known.Fields), record.Version)
+		c.report(at)
+		return
+	}
+	if count, ok := layout.fieldCounts[record.Version]; !ok {
+		layout.fieldCounts[record.Version] = len(record.Fields)
+	} else if count != len(record.Fields) {
+		at.kind, at.detail = inconsistentFieldCount, fmt.Sprintf("%v fields, %v in the first record of version %v",
+			len(record.Fields), count, record.Version)
+		c.report(at)
+	}
+}
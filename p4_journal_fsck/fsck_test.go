@@ -0,0 +1,85 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		journal string
+		// The kind and line of each problem
+		want []string
+	}{
+		{"valid", "@pv@ 1 @db.counters@ @change@ @3@ \n@pv@ 0 @db.desc@ @1@ @a\n@@multi-line description@ \n@ex@ 1 1611008050 \n", nil},
+		{"unterminated quote", "@pv@ 0 @db.desc@ @1@ @open \n@pv@ 1 @db.counters@ @change@ @3@ \n@ex@ 1 1611008050 \n",
+			[]string{"unterminated-quote 1"}},
+		{"quote open at the end", "@ex@ 1 1611008050 \n@pv@ 0 @db.desc@ @1@ @open \n",
+			[]string{"unterminated-quote 2", "missing-end-marker 2"}},
+		{"unknown operation", "@xx@ 1 @db.counters@ @change@ @3@ \n@ex@ 1 1611008050 \n", []string{"unknown-operation 1"}},
+		{"bad header", "@pv@ A @db.counters@ @change@ @3@ \n@ex@ 1 1611008050 \n", []string{"bad-header 1"}},
+		{"version decrease", "@pv@ 1 @db.counters@ @change@ @3@ \n@pv@ 0 @db.counters@ @change@ @3@ \n@ex@ 1 1611008050 \n",
+			[]string{"version-decrease 2"}},
+		{"field count", "@pv@ 1 @db.counters@ @change@ @3@ @extra@ \n@ex@ 1 1611008050 \n", []string{"field-count 1"}},
+		{"inconsistent field count", "@pv@ 1 @db.unknown@ @a@ \n@pv@ 1 @db.unknown@ @a@ @b@ \n@ex@ 1 1611008050 \n",
+			[]string{"inconsistent-field-count 2"}},
+		{"bad token", "@pv@ 1 @db.counters@ @change@ 3z \n@ex@ 1 1611008050 \n", []string{"bad-token 1"}},
+		{"nul bytes", "@pv@ 1 @db.counters@ @change@ @3@ \n\x00\x00\x00\n@ex@ 1 1611008050 \n",
+			[]string{"nul-bytes 2", "unknown-operation 2"}},
+		{"truncated line", "@pv@ 1 @db.counters@ @change@ @3@ \n@ex@ 1 1611008050", []string{"truncated-line 2"}},
+		{"missing end marker", "@pv@ 1 @db.counters@ @change@ @3@ \n", []string{"missing-end-marker 1"}},
+		{"empty", "", []string{"missing-end-marker 0"}},
+	}
+	for _, test := range tests {
+		var got []string
+		checker := newChecker(func(p problem) {
+			got = append(got, p.kind+" "+strconv.Itoa(p.line))
+		}, func(string, int, int, int64) {})
+		if err := checker.check(strings.NewReader(test.journal)); err != nil {
+			t.Fatalf("check(%v) returned %v", test.name, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("check(%v) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckExampleJournal(t *testing.T) {
+	file, err := os.Open("../perforceutils/testdata/example_journal.txt")
+	if err != nil {
+		t.Fatalf("Open() returned %v", err)
+	}
+	defer file.Close()
+	upgrades := 0
+	checker := newChecker(func(p problem) {
+		t.Errorf("check() found %+v", p)
+	}, func(string, int, int, int64) {
+		upgrades++
+	})
+	if err := checker.check(file); err != nil {
+		t.Fatalf("check() returned %v", err)
+	}
+	if checker.records == 0 || upgrades != 0 {
+		t.Errorf("check() read %v records with %v upgrades, want records without upgrades", checker.records, upgrades)
+	}
+}
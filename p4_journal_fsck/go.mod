@@ -0,0 +1,7 @@
+module github.com/google/perforce-utils/p4_journal_fsck
+
+go 1.21
+
+require github.com/google/perforce-utils/perforceutils v0.0.0
+
+require github.com/klauspost/compress v1.17.9 // indirect
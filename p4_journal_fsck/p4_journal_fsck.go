@@ -0,0 +1,127 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_journal_fsck checks the structure of a checkpoint or journal before it is replayed
+// or restored: balanced @-quoting, record versions, field counts and the final @ex@ marker. It
+// reports the byte offsets of the suspect records, so that they can be inspected or cut out.
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+func main() {
+	flags := struct {
+		output      string
+		format      string
+		maxProblems int
+	}{}
+
+	flag.StringVar(&flags.output, "output", output.Stdout, "File, or table for the database formats, to write the problems to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage())
+	flag.IntVar(&flags.maxProblems, "max-problems", 1000, "Maximum number of problems to list, the others are only counted (0 for no limit).")
+	logging.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(false); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(flags.format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+
+	start := time.Now()
+	var problems []problem
+	total := 0
+	c := newChecker(func(p problem) {
+		total++
+		if flags.maxProblems > 0 && len(problems) >= flags.maxProblems {
+			return
+		}
+		problems = append(problems, p)
+		slog.Warn("Suspect record", "problem", p.kind, logging.OffsetKey, p.offset, logging.LineKey, p.line,
+			logging.TableKey, p.table, "detail", p.detail)
+	}, func(table string, from int, to int, offset int64) {
+		slog.Info("Table version changed", logging.TableKey, table, "from", from, "to", to, logging.OffsetKey, offset)
+	})
+
+	file, err := journal.Open(flag.Arg(0))
+	if err != nil {
+		logging.Fatal("Error opening journal", logging.PathKey, flag.Arg(0), logging.Err(err))
+	}
+	defer file.Close()
+	checkErr := c.check(file)
+	if checkErr != nil {
+		slog.Error("Error reading journal", logging.PathKey, flag.Arg(0), logging.Err(checkErr))
+	}
+
+	err = output.WriteTable(flags.format, flags.output, output.Table{Name: "journal_problems"}, func(out output.Writer) error {
+		out.Write([]string{"Offset", "Line", "Length", "Problem", "Table", "Detail"})
+		for _, p := range problems {
+			out.Write([]string{
+				strconv.FormatInt(p.offset, 10),
+				strconv.Itoa(p.line),
+				strconv.Itoa(p.length),
+				p.kind,
+				p.table,
+				p.detail})
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Fatal("Error writing problems", logging.Err(err))
+	}
+
+	slog.Info("Checked records", logging.CountKey, c.records, "tables", len(c.tables))
+	for _, kind := range problemKinds {
+		if c.problems[kind] > 0 {
+			slog.Warn("Problems", "problem", kind, logging.CountKey, c.problems[kind])
+		}
+	}
+	if total > len(problems) {
+		slog.Warn("Only listed the first problems", logging.CountKey, len(problems), "total", total)
+	}
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+
+	if checkErr != nil {
+		os.Exit(1)
+	}
+	if total > 0 {
+		os.Exit(2)
+	}
+}
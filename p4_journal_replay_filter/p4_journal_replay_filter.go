@@ -0,0 +1,422 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_journal_replay_filter reads a Perforce checkpoint or journal and writes a copy
+// containing only the selected tables and depot paths, optionally with user names and descriptions
+// redacted. The copy can be replayed with p4d -jr to create shareable repro cases or partial restores.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/schema"
+)
+
+// The field holding the depot path of the records of each table, used by -paths.
+// Records of tables not listed here are kept regardless of -paths.
+// See https://www.perforce.com/perforce/doc.current/schema/.
+var tablePathField = map[string]int{
+	"db.archmap":   1,
+	"db.excl":      0,
+	"db.have":      1,
+	"db.integed":   0,
+	"db.label":     1,
+	"db.locks":     0,
+	"db.resolve":   0,
+	"db.rev":       0,
+	"db.revcx":     1,
+	"db.revdx":     0,
+	"db.revhx":     0,
+	"db.revpx":     0,
+	"db.revsh":     0,
+	"db.revsx":     0,
+	"db.revux":     0,
+	"db.storage":   0,
+	"db.storagesh": 0,
+	"db.working":   1,
+}
+
+// How a field is redacted
+type redaction int
+
+const (
+	// User names are replaced by a pseudonym, the same in all tables
+	redactUser redaction = iota
+	// Client names, often made of a user and host name, are replaced by a pseudonym too
+	redactClient
+	// Client syntax paths (//client/...) get the pseudonym of their client
+	redactClientPath
+	// Free text (descriptions, emails, full names, client roots) is replaced by a placeholder
+	redactText
+	// Secrets (passwords and tickets) are emptied
+	redactSecret
+	// Fields whose kind depends on another field of the record
+	redactDomainName
+	redactDomainHost
+	redactGroupMember
+	redactProtectUser
+	redactViewName
+	redactViewFile
+)
+
+var changeRedactions = map[string]redaction{
+	"client":      redactClient,
+	"user":        redactUser,
+	"description": redactText,
+}
+
+// The fields redacted by -redact per table, by schema field name: the fields holding user or client
+// names, free text and secrets
+var tableRedactions = map[string]map[string]redaction{
+	"db.bodytext": {"text": redactText},
+	"db.change":   changeRedactions,
+	"db.changex":  changeRedactions,
+	"db.desc":     {"description": redactText},
+	"db.domain": {"name": redactDomainName, "extra": redactDomainHost, "mount": redactText, "mount2": redactText,
+		"mount3": redactText, "owner": redactUser, "description": redactText},
+	"db.excl":    {"client": redactClient, "user": redactUser},
+	"db.group":   {"user": redactGroupMember},
+	"db.have":    {"clientFile": redactClientPath},
+	"db.locks":   {"client": redactClient, "user": redactUser},
+	"db.protect": {"user": redactProtectUser},
+	"db.user": {"user": redactUser, "email": redactText, "fullName": redactText, "password": redactSecret,
+		"ticket": redactSecret},
+	"db.view":    {"name": redactViewName, "viewFile": redactViewFile},
+	"db.working": {"clientFile": redactClientPath, "client": redactClient, "user": redactUser},
+}
+
+const redactedText = "redacted"
+
+// The db.domain type of clients, whose names and hosts are redacted. Labels, branches, depots and
+// streams keep their names, which appear in depot paths.
+const clientDomainType = "99"
+
+// The db.group types of subgroup entries, whose user field holds a group name
+const subgroupGroupType = "1"
+
+// The note records marking the start of each table in checkpoints have this type,
+// with the table name at this index
+const (
+	tableNoteType       = "4"
+	tableNoteTableField = 8
+)
+
+// The note record heading checkpoints has this type, with the server root at this index
+const (
+	headerNoteType      = "0"
+	headerNoteRootField = 8
+)
+
+// Replaces user and client names by consistent pseudonyms (user1, user2, ..., client1, ...)
+type recordRedactor struct {
+	users   map[string]string
+	clients map[string]string
+	// The records of a version whose layout isn't known dropped, by table and version
+	unknownVersions map[string]map[int]int
+	// The records with more fields than their layout dropped, by table
+	dropped map[string]int
+}
+
+func newRecordRedactor() *recordRedactor {
+	return &recordRedactor{users: make(map[string]string), clients: make(map[string]string),
+		unknownVersions: make(map[string]map[int]int), dropped: make(map[string]int)}
+}
+
+// Returns the pseudonym of a name, numbered in the order the names are found
+func pseudonym(pseudonyms map[string]string, prefix string, name string) string {
+	if len(name) == 0 {
+		return name
+	}
+	pseudonym, ok := pseudonyms[name]
+	if !ok {
+		pseudonym = fmt.Sprintf("%s%d", prefix, len(pseudonyms)+1)
+		pseudonyms[name] = pseudonym
+	}
+	return pseudonym
+}
+
+// Replaces the client name of a client syntax path, after the +/- of view mappings
+func (r *recordRedactor) clientPath(path string) string {
+	rest := strings.TrimLeft(path, "-+")
+	if !strings.HasPrefix(rest, "//") {
+		return path
+	}
+	client, file, _ := strings.Cut(rest[2:], "/")
+	return path[:len(path)-len(rest)] + "//" + pseudonym(r.clients, "client", client) + "/" + file
+}
+
+// Reports whether a db.view record maps a client view, whose files start with the client name,
+// rather than a branch view
+func isClientView(record journal.Record, table schema.Table) bool {
+	name := record.Field(table.Index("name"))
+	return strings.HasPrefix(strings.TrimLeft(record.Field(table.Index("viewFile")), "-+"), "//"+name+"/")
+}
+
+func (r *recordRedactor) field(how redaction, value string, record journal.Record, table schema.Table) string {
+	switch how {
+	case redactUser:
+		return pseudonym(r.users, "user", value)
+	case redactClient:
+		return pseudonym(r.clients, "client", value)
+	case redactClientPath:
+		return r.clientPath(value)
+	case redactText:
+		if len(value) > 0 {
+			return redactedText
+		}
+		return ""
+	case redactSecret:
+		return ""
+	case redactDomainName:
+		if record.Field(table.Index("type")) == clientDomainType {
+			return pseudonym(r.clients, "client", value)
+		}
+	case redactDomainHost:
+		if record.Field(table.Index("type")) == clientDomainType {
+			return ""
+		}
+	case redactGroupMember:
+		if record.Field(table.Index("type")) != subgroupGroupType {
+			return pseudonym(r.users, "user", value)
+		}
+	case redactProtectUser:
+		// Protections granted to groups name the group, and wildcards match several users
+		isGroup := record.Field(table.Index("isGroup")) == "1"
+		if !isGroup && !strings.Contains(value, "*") && !strings.Contains(value, "...") {
+			return pseudonym(r.users, "user", value)
+		}
+	case redactViewName:
+		if isClientView(record, table) {
+			return pseudonym(r.clients, "client", value)
+		}
+	case redactViewFile:
+		if isClientView(record, table) {
+			return r.clientPath(value)
+		}
+	}
+	return value
+}
+
+// Returns the record with the sensitive fields of its table redacted, or false when the record must
+// be dropped because the fields to redact can't be found
+func (r *recordRedactor) redact(record journal.Record) (string, bool) {
+	if record.Operation == journal.NoteTransaction && record.Field(0) == headerNoteType {
+		// The server root, which like client roots often holds a user name
+		tokens := journal.Tokens(record.Raw)
+		if 1+headerNoteRootField < len(tokens) && len(record.Field(headerNoteRootField)) > 0 {
+			tokens[1+headerNoteRootField] = journal.Quote(redactedText)
+			return joinTokens(tokens, record.Raw), true
+		}
+	}
+	fields, ok := tableRedactions[record.Table]
+	if !ok {
+		return record.Raw, true
+	}
+	// The fields are redacted by name, whose position depends on the version of the record
+	table, known := schema.Layout(record.Table, record.Version)
+	if !known {
+		if r.unknownVersions[record.Table] == nil {
+			r.unknownVersions[record.Table] = make(map[int]int)
+		}
+		r.unknownVersions[record.Table][record.Version]++
+		return "", false
+	}
+	// Fields missing from the registry could hold anything
+	if len(record.Fields) > len(table.Fields) {
+		r.dropped[record.Table]++
+		return "", false
+	}
+	tokens := journal.Tokens(record.Raw)
+	for name, how := range fields {
+		i := table.Index(name)
+		if i < 0 || i >= len(record.Fields) || journal.HeaderFieldCount+i >= len(tokens) {
+			continue
+		}
+		tokens[journal.HeaderFieldCount+i] = journal.Quote(r.field(how, record.Fields[i], record, table))
+	}
+	return joinTokens(tokens, record.Raw), true
+}
+
+// Joins the tokens of a record, keeping the trailing space of the original record
+func joinTokens(tokens []string, raw string) string {
+	joined := strings.Join(tokens, " ")
+	if strings.HasSuffix(raw, " ") {
+		joined += " "
+	}
+	return joined
+}
+
+// Selects the records to keep
+type recordFilter struct {
+	tables   map[string]bool
+	prefixes []string
+}
+
+func (f *recordFilter) keep(record journal.Record) bool {
+	if !record.IsTableOperation() {
+		// Drop the table markers of checkpoints along with the tables
+		if record.Operation == journal.NoteTransaction && record.Field(0) == tableNoteType && len(f.tables) > 0 {
+			return f.tables[record.Field(tableNoteTableField)]
+		}
+		return true
+	}
+	if len(f.tables) > 0 && !f.tables[record.Table] {
+		return false
+	}
+	field, ok := tablePathField[record.Table]
+	if !ok || len(f.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range f.prefixes {
+		if strings.HasPrefix(record.Field(field), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Copies the selected records of a journal to w. Returns the number of records read and written.
+func filterJournal(journalPath string, w io.Writer, filter *recordFilter, redactor *recordRedactor) (int, int, error) {
+	file, err := journal.Open(journalPath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	read := 0
+	written := 0
+	err = journal.Scan(file, func(record journal.Record) error {
+		read++
+		if !filter.keep(record) {
+			return nil
+		}
+		raw := record.Raw
+		if redactor != nil {
+			var ok bool
+			if raw, ok = redactor.redact(record); !ok {
+				return nil
+			}
+		}
+		written++
+		if _, err := io.WriteString(w, raw); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\n")
+		return err
+	})
+	return read, written, err
+}
+
+func main() {
+	flags := struct {
+		tables string
+		paths  string
+		redact bool
+		output string
+	}{}
+
+	flag.StringVar(&flags.tables, "tables", "", "Comma-separated tables to keep (all tables by default).")
+	flag.StringVar(&flags.paths, "paths", "", "Comma-separated depot path prefixes to keep, for tables with depot paths (all paths by default).")
+	flag.BoolVar(&flags.redact, "redact", false, "Replace user and client names by pseudonyms and remove descriptions, emails, client roots and passwords.")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File to write the filtered journal to, replaced only once complete (the standard output by default).")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(false); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+
+	filter := &recordFilter{tables: make(map[string]bool)}
+	if len(flags.tables) > 0 {
+		for _, table := range strings.Split(flags.tables, ",") {
+			filter.tables[table] = true
+		}
+	}
+	if len(flags.paths) > 0 {
+		filter.prefixes = strings.Split(flags.paths, ",")
+	}
+	var redactor *recordRedactor
+	if flags.redact {
+		redactor = newRecordRedactor()
+	}
+
+	start := time.Now()
+
+	var read, written int
+	err := output.WriteFile(flags.output, func(w io.Writer) error {
+		var err error
+		read, written, err = filterJournal(flag.Arg(0), w, filter, redactor)
+		return err
+	})
+	if err != nil {
+		logging.Fatal("Error filtering journal", logging.Err(err))
+	}
+
+	slog.Info("Processed records", logging.CountKey, read, "kept", written)
+	if redactor != nil {
+		slog.Info("Redacted names", "users", len(redactor.users), "clients", len(redactor.clients))
+		tables := make([]string, 0, len(redactor.dropped))
+		for table := range redactor.dropped {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		for _, table := range tables {
+			slog.Warn("Dropped records with more fields than known, which can't be redacted", logging.TableKey, table,
+				logging.CountKey, redactor.dropped[table])
+		}
+		tables = tables[:0]
+		for table := range redactor.unknownVersions {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		for _, table := range tables {
+			versions := make([]int, 0, len(redactor.unknownVersions[table]))
+			for version := range redactor.unknownVersions[table] {
+				versions = append(versions, version)
+			}
+			sort.Ints(versions)
+			for _, version := range versions {
+				slog.Warn("Dropped records of a version whose layout isn't known, which can't be redacted", logging.TableKey, table,
+					"version", version, logging.CountKey, redactor.unknownVersions[table][version])
+			}
+		}
+	}
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+}
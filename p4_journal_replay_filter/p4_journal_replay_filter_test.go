@@ -0,0 +1,116 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+)
+
+func TestFilterJournal(t *testing.T) {
+	filter := &recordFilter{tables: map[string]bool{"db.rev": true, "db.user": true}, prefixes: []string{"//depot/path1/"}}
+	var filtered bytes.Buffer
+	read, written, err := filterJournal("../perforceutils/testdata/example_journal.txt", &filtered, filter, newRecordRedactor())
+	if err != nil {
+		t.Fatalf("filterJournal() returned %v", err)
+	}
+	if written == 0 || written >= read {
+		t.Errorf("filterJournal() read %v records and wrote %v", read, written)
+	}
+	lines := strings.Split(filtered.String(), "\n")
+	counts := make(map[string]int)
+	for _, line := range lines {
+		record := journal.Parse(line)
+		if record.IsTableOperation() {
+			counts[record.Table]++
+		} else if record.Operation == journal.NoteTransaction && record.Field(0) == tableNoteType {
+			counts["note "+record.Field(tableNoteTableField)]++
+		}
+	}
+	// The revisions of //depot/path2 are left out, and the users kept and redacted
+	want := map[string]int{"db.rev": 5, "db.user": 1, "note db.rev": 1, "note db.user": 1}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("filterJournal() wrote %v, want %v", counts, want)
+	}
+	if strings.Contains(filtered.String(), "the_user") {
+		t.Errorf("filterJournal() kept the user name: %q", filtered.String())
+	}
+}
+
+func TestRedact(t *testing.T) {
+	r := newRecordRedactor()
+	tests := []struct {
+		record string
+		want   string
+	}{
+		{"@pv@ 7 @db.user@ @the_user@ @the_user@@the_user_client@ @@ 1611008019 1611008019 @The User@ @secret@ 0 @ticket@ 0 0 0 0 0 0 ",
+			"@pv@ 7 @db.user@ @user1@ @redacted@ @@ 1611008019 1611008019 @redacted@ @@ 0 @@ 0 0 0 0 0 0 "},
+		{"@pv@ 7 @db.domain@ @the_user_client@ 99 @the_user1-W@ @c:\\client@ @@ @@ @the_user@ 1611008024 1611008024 0 @Created by the_user.@ @@ @@ 1 ",
+			"@pv@ 7 @db.domain@ @client1@ 99 @@ @redacted@ @@ @@ @user1@ 1611008024 1611008024 0 @redacted@ @@ @@ 1 "},
+		// Depots keep their names
+		{"@pv@ 7 @db.domain@ @depot@ 100 @@ @@ @@ @@ @@ 1611008019 1611008019 0 @Default depot@ @@ @@ 0 ",
+			"@pv@ 7 @db.domain@ @depot@ 100 @@ @@ @@ @@ @@ 1611008019 1611008019 0 @redacted@ @@ @@ 0 "},
+		{"@pv@ 1 @db.view@ @the_user_client@ 0 0 @//the_user_client/...@ @//depot/...@ ",
+			"@pv@ 1 @db.view@ @client1@ 0 0 @//client1/...@ @//depot/...@ "},
+		{"@pv@ 3 @db.have@ @//the_user_client/path1/data1.dat@ @//depot/path1/data1.dat@ 2 65539 1611008039 ",
+			"@pv@ 3 @db.have@ @//client1/path1/data1.dat@ @//depot/path1/data1.dat@ 2 65539 1611008039 "},
+		{"@pv@ 7 @db.group@ @the_user@ @developers@ 0 0 0 0 0 0 0 ",
+			"@pv@ 7 @db.group@ @user1@ @developers@ 0 0 0 0 0 0 0 "},
+		{"@pv@ 7 @db.group@ @admins@ @developers@ 1 0 0 0 0 0 0 ",
+			"@pv@ 7 @db.group@ @admins@ @developers@ 1 0 0 0 0 0 0 "},
+	}
+	for _, test := range tests {
+		got, ok := r.redact(journal.Parse(test.record))
+		if !ok || got != test.want {
+			t.Errorf("redact(%q) = %q, %v, want %q", test.record, got, ok, test.want)
+		}
+	}
+
+	// Records of unknown versions or with unknown fields can't be redacted
+	for _, record := range []string{
+		"@pv@ 99 @db.user@ @the_user@ ",
+		"@pv@ 1 @db.view@ @the_user_client@ 0 0 @//the_user_client/...@ @//depot/...@ @extra@ ",
+	} {
+		if got, ok := r.redact(journal.Parse(record)); ok {
+			t.Errorf("redact(%q) = %q, want the record dropped", record, got)
+		}
+	}
+}
+
+func TestRedactHeader(t *testing.T) {
+	r := newRecordRedactor()
+	tests := []struct {
+		record string
+		want   string
+	}{
+		{`@nx@ 0 1611008050 @50@ 10 0 0 0 0 @C:\Users\the_user\p4root@ @journal@ @@ @@ @@ `,
+			"@nx@ 0 1611008050 @50@ 10 0 0 0 0 @redacted@ @journal@ @@ @@ @@ "},
+		{"@nx@ 4 1611008050 @50@ 1 0 -286465841 0 0 @db.counters@ @@ @@ @@ @@ ",
+			"@nx@ 4 1611008050 @50@ 1 0 -286465841 0 0 @db.counters@ @@ @@ @@ @@ "},
+		{"@ex@ 24632 1611008050", "@ex@ 24632 1611008050"},
+	}
+	for _, test := range tests {
+		got, ok := r.redact(journal.Parse(test.record))
+		if !ok || got != test.want {
+			t.Errorf("redact(%q) = %q, %v, want %q", test.record, got, ok, test.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/schema"
+)
+
+// The rates tracked per minute
+const (
+	SubmitsMetric     = "submits"
+	BytesMetric       = "bytes"
+	DeletesMetric     = "deletes"
+	ObliteratesMetric = "obliterates"
+)
+
+var metricNames = []string{SubmitsMetric, BytesMetric, DeletesMetric, ObliteratesMetric}
+
+// What each metric counts, for alerts
+var metricDescriptions = map[string]string{
+	SubmitsMetric:     "submitted changes",
+	BytesMetric:       "bytes of new revisions",
+	DeletesMetric:     "deleted files",
+	ObliteratesMetric: "obliterated revisions",
+}
+
+// A minute whose rate is far above the baseline
+type anomaly struct {
+	metric   string
+	minute   time.Time
+	value    float64
+	baseline float64
+	stddev   float64
+}
+
+func (a anomaly) String() string {
+	return fmt.Sprintf("%.0f %v in the minute of %v, baseline %.0f per minute (stddev %.0f)",
+		a.value, metricDescriptions[a.metric], a.minute.UTC().Format(time.RFC3339), a.baseline, a.stddev)
+}
+
+// The rolling baseline of a metric: an exponentially weighted moving average and variance of its
+// per-minute values
+type baseline struct {
+	mean     float64
+	variance float64
+	minutes  int
+	// Whether the previous minute was anomalous, so that an episode is only reported once
+	alerting bool
+}
+
+func (b *baseline) update(value float64, alpha float64) {
+	if b.minutes == 0 {
+		b.mean = value
+	} else {
+		diff := value - b.mean
+		increment := alpha * diff
+		b.mean += increment
+		b.variance = (1 - alpha) * (b.variance + diff*increment)
+	}
+	b.minutes++
+}
+
+// Tracks the per-minute rates of submits, bytes added, deletes and obliterates of a journal, and
+// reports the minutes well above their rolling baseline.
+//
+// Minutes are delimited by the timestamps of the transaction markers of the journal, so that past
+// journals can be replayed to tune the thresholds. A minute is closed when the first transaction of
+// a later minute is read.
+type anomalyDetector struct {
+	// The weight of each new minute in the baselines
+	alpha float64
+	// How many standard deviations above the baseline a minute must be to be anomalous
+	sigma float64
+	// The number of minutes the baselines are built from before minutes are checked
+	warmup int
+	// The minimum value of an anomalous minute for each metric, to ignore spikes on idle servers
+	floors    map[string]float64
+	onAnomaly func(anomaly)
+
+	baselines map[string]*baseline
+	// The unix time of the start of the current minute, 0 before the first transaction
+	minute  int64
+	current map[string]float64
+}
+
+func newAnomalyDetector(baselineMinutes int, sigma float64, warmup int, floors map[string]float64,
+	onAnomaly func(anomaly)) *anomalyDetector {
+	d := &anomalyDetector{
+		alpha:     2 / (float64(baselineMinutes) + 1),
+		sigma:     sigma,
+		warmup:    warmup,
+		floors:    floors,
+		onAnomaly: onAnomaly,
+		baselines: make(map[string]*baseline),
+		current:   make(map[string]float64),
+	}
+	for _, name := range metricNames {
+		d.baselines[name] = &baseline{}
+	}
+	return d
+}
+
+// Parses the minimum values of anomalies, such as "submits=100,obliterates=1000"
+func parseFloors(value string) (map[string]float64, error) {
+	floors := make(map[string]float64)
+	for _, floor := range strings.Split(value, ",") {
+		if len(strings.TrimSpace(floor)) == 0 {
+			continue
+		}
+		name, number, ok := strings.Cut(floor, "=")
+		name = strings.TrimSpace(name)
+		if _, known := metricDescriptions[name]; !ok || !known {
+			return nil, fmt.Errorf("invalid minimum %q, expected one of %v followed by =value", floor,
+				strings.Join(metricNames, ", "))
+		}
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid minimum %q: %v", floor, err)
+		}
+		floors[name] = parsed
+	}
+	return floors, nil
+}
+
+// The record fields the detector needs
+type changeStatus struct {
+	Status int `p4:"status"`
+}
+
+const submittedChange = 1
+
+type revSize struct {
+	Action    int   `p4:"action"`
+	Size      int64 `p4:"size"`
+	LbrIsLazy bool  `p4:"lbrIsLazy"`
+}
+
+func (d *anomalyDetector) add(record journal.Record) {
+	switch record.Operation {
+	case journal.BeginTransaction, journal.EndTransaction:
+		// @ex@ <pid> <time>
+		if timestamp, err := strconv.ParseInt(record.Field(1), 10, 64); err == nil {
+			d.advance(timestamp - timestamp%60)
+		}
+		return
+	}
+	if d.minute == 0 {
+		return
+	}
+	switch {
+	case record.Table == "db.change" && (record.Operation == journal.PutValue || record.Operation == journal.ReplaceValue):
+		var change changeStatus
+		if schema.Unmarshal(record, &change) == nil && change.Status == submittedChange {
+			d.current[SubmitsMetric]++
+		}
+	case record.Table == "db.rev" && record.Operation == journal.PutValue:
+		var rev revSize
+		if schema.Unmarshal(record, &rev) != nil {
+			return
+		}
+		action := archive.FileAction(rev.Action)
+		if action == archive.DeleteFileAction {
+			d.current[DeletesMetric]++
+		} else if action.HasArchive() && !rev.LbrIsLazy && rev.Size > 0 {
+			d.current[BytesMetric] += float64(rev.Size)
+		}
+	case record.Table == "db.rev" && record.Operation == journal.DeleteValue:
+		d.current[ObliteratesMetric]++
+	}
+}
+
+// Closes the minutes up to the one starting at minute. Idle minutes count as zeros, up to the
+// length of the warmup.
+func (d *anomalyDetector) advance(minute int64) {
+	if d.minute == 0 {
+		d.minute = minute
+		return
+	}
+	if minute <= d.minute {
+		return
+	}
+	d.close()
+	idle := (minute-d.minute)/60 - 1
+	if idle > int64(d.warmup) {
+		idle = int64(d.warmup)
+	}
+	for i := int64(0); i < idle; i++ {
+		d.close()
+	}
+	d.minute = minute
+}
+
+// Checks the current minute against the baselines and adds it to them
+func (d *anomalyDetector) close() {
+	for _, name := range metricNames {
+		b := d.baselines[name]
+		value := d.current[name]
+		stddev := math.Sqrt(b.variance)
+		anomalous := b.minutes >= d.warmup && value >= d.floors[name] && value > b.mean+d.sigma*stddev
+		if anomalous && !b.alerting && d.onAnomaly != nil {
+			d.onAnomaly(anomaly{metric: name, minute: time.Unix(d.minute, 0), value: value, baseline: b.mean, stddev: stddev})
+		}
+		b.alerting = anomalous
+		b.update(value, d.alpha)
+		d.current[name] = 0
+	}
+}
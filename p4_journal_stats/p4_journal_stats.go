@@ -0,0 +1,360 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_journal_stats reads a Perforce checkpoint or journal and reports the number of
+// records and bytes of each table and operation, and the largest records, to find what makes a
+// journal grow. It can also follow the live journal and alert on abnormal rates of submits,
+// bytes added, deletes and obliterates.
+package main
+
+import (
+	"container/heap"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/notify"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// Keys of the largest records are truncated to this many bytes
+const maxKeyLength = 200
+
+// The records of a table with the same operation
+type recordStats struct {
+	table     string
+	operation string
+	records   int
+	bytes     int64
+	maxBytes  int
+}
+
+// A record among the largest ones, without its content
+type largeRecord struct {
+	table      string
+	operation  string
+	lineNumber int
+	offset     int64
+	bytes      int
+	// The first field of the record, for example the depot file of db.rev
+	key string
+}
+
+// A min-heap of the largest records, so that the smallest one is replaced first
+type largeRecords []largeRecord
+
+func (h largeRecords) Len() int            { return len(h) }
+func (h largeRecords) Less(i, j int) bool  { return h[i].bytes < h[j].bytes }
+func (h largeRecords) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *largeRecords) Push(x interface{}) { *h = append(*h, x.(largeRecord)) }
+func (h *largeRecords) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// Accumulates the statistics of the records of a journal
+type journalStats struct {
+	byTable      map[string]*recordStats
+	byOperation  map[string]*recordStats
+	largest      largeRecords
+	largestCount int
+	records      int
+	bytes        int64
+}
+
+func newJournalStats(largestCount int) *journalStats {
+	return &journalStats{
+		byTable:      make(map[string]*recordStats),
+		byOperation:  make(map[string]*recordStats),
+		largestCount: largestCount,
+	}
+}
+
+func (s *journalStats) add(record journal.Record) {
+	// The size in the journal, including the trailing newline
+	size := len(record.Raw) + 1
+	s.records++
+	s.bytes += int64(size)
+
+	for _, stats := range []*recordStats{
+		s.stats(s.byTable, record.Table+"\x00"+record.Operation, record.Table, record.Operation),
+		s.stats(s.byOperation, record.Operation, "", record.Operation),
+	} {
+		stats.records++
+		stats.bytes += int64(size)
+		if size > stats.maxBytes {
+			stats.maxBytes = size
+		}
+	}
+
+	if s.largestCount <= 0 || (len(s.largest) == s.largestCount && size <= s.largest[0].bytes) {
+		return
+	}
+	key := ""
+	if record.IsTableOperation() {
+		key = record.Field(0)
+		if len(key) > maxKeyLength {
+			key = key[:maxKeyLength]
+		}
+	}
+	large := largeRecord{table: record.Table, operation: record.Operation, lineNumber: record.LineNumber,
+		offset: record.Offset, bytes: size, key: key}
+	if len(s.largest) == s.largestCount {
+		s.largest[0] = large
+		heap.Fix(&s.largest, 0)
+	} else {
+		heap.Push(&s.largest, large)
+	}
+}
+
+func (s *journalStats) stats(statsMap map[string]*recordStats, key string, table string, operation string) *recordStats {
+	stats, ok := statsMap[key]
+	if !ok {
+		stats = &recordStats{table: table, operation: operation}
+		statsMap[key] = stats
+	}
+	return stats
+}
+
+// Returns the statistics sorted by decreasing bytes
+func sortedStats(statsMap map[string]*recordStats) []*recordStats {
+	sorted := make([]*recordStats, 0, len(statsMap))
+	for _, stats := range statsMap {
+		sorted = append(sorted, stats)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].bytes != sorted[j].bytes {
+			return sorted[i].bytes > sorted[j].bytes
+		}
+		if sorted[i].table != sorted[j].table {
+			return sorted[i].table < sorted[j].table
+		}
+		return sorted[i].operation < sorted[j].operation
+	})
+	return sorted
+}
+
+// Returns the largest records, largest first
+func (s *journalStats) largestRecords() []largeRecord {
+	sorted := append([]largeRecord(nil), s.largest...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].bytes != sorted[j].bytes {
+			return sorted[i].bytes > sorted[j].bytes
+		}
+		return sorted[i].offset < sorted[j].offset
+	})
+	return sorted
+}
+
+func (s *journalStats) share(bytes int64) string {
+	if s.bytes == 0 {
+		return "0.00"
+	}
+	return strconv.FormatFloat(100*float64(bytes)/float64(s.bytes), 'f', 2, 64)
+}
+
+// Writes the records and bytes of each table and operation. Non-table records, such as
+// transaction markers, have an empty table.
+func (s *journalStats) writeTable(out output.Writer) error {
+	out.Write([]string{"Table", "Operation", "Records", "Bytes", "AverageBytes", "MaxBytes", "SharePercent"})
+	for _, stats := range sortedStats(s.byTable) {
+		out.Write([]string{
+			stats.table,
+			stats.operation,
+			strconv.Itoa(stats.records),
+			strconv.FormatInt(stats.bytes, 10),
+			strconv.FormatInt(stats.bytes/int64(stats.records), 10),
+			strconv.Itoa(stats.maxBytes),
+			s.share(stats.bytes)})
+	}
+	return nil
+}
+
+func writeLargestCSV(w io.Writer, records []largeRecord) error {
+	csvWriter := output.NewCSVWriter(w)
+	csvWriter.Write([]string{"Table", "Operation", "Line", "Offset", "Bytes", "Key"})
+	for _, record := range records {
+		csvWriter.Write([]string{
+			record.table,
+			record.operation,
+			strconv.Itoa(record.lineNumber),
+			strconv.FormatInt(record.offset, 10),
+			strconv.Itoa(record.bytes),
+			record.key})
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return fmt.Errorf("error writing csv: %v", err)
+	}
+	return nil
+}
+
+func main() {
+	flags := struct {
+		largest         int
+		largestCSV      string
+		output          string
+		format          string
+		follow          bool
+		followInterval  time.Duration
+		anomalies       bool
+		baselineMinutes int
+		warmupMinutes   int
+		anomalySigma    float64
+		anomalyMin      string
+		notifySlack     string
+		notifyEmail     string
+		notifySMTP      string
+		notifyFrom      string
+		verbose         bool
+	}{}
+
+	flag.IntVar(&flags.largest, "largest", 10, "Number of largest records to report.")
+	flag.StringVar(&flags.largestCSV, "largest-csv", "", "File to write the largest records to, as CSV (they are logged otherwise).")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File, or table for the database formats, to write the statistics to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage())
+	flag.BoolVar(&flags.follow, "follow", false, "Follow the live journal as it grows, across rotations, and detect rate anomalies until interrupted.")
+	flag.DurationVar(&flags.followInterval, "follow-interval", time.Second, "How often to check the followed journal for new records.")
+	flag.BoolVar(&flags.anomalies, "anomalies", false, "Detect rate anomalies in a journal read once, to tune the thresholds (always on with -follow).")
+	flag.IntVar(&flags.baselineMinutes, "baseline-minutes", 60, "Number of minutes the rolling baselines average over.")
+	flag.IntVar(&flags.warmupMinutes, "warmup-minutes", 30, "Number of minutes the baselines are built from before anomalies are reported.")
+	flag.Float64Var(&flags.anomalySigma, "anomaly-sigma", 4, "How many standard deviations above its baseline a minute must be to be anomalous.")
+	flag.StringVar(&flags.anomalyMin, "anomaly-min", "submits=100,bytes=1073741824,deletes=1000,obliterates=1000", "Comma-separated minimum per-minute values of anomalies, for submits, bytes, deletes and obliterates.")
+	flag.StringVar(&flags.notifySlack, "notify-slack-webhook", "", "Slack incoming webhook URL to post anomalies to.")
+	flag.StringVar(&flags.notifyEmail, "notify-email", "", "Comma-separated addresses to email anomalies to.")
+	flag.StringVar(&flags.notifySMTP, "notify-smtp", "localhost:25", "SMTP server host:port for -notify-email.")
+	flag.StringVar(&flags.notifyFrom, "notify-from", "", "Sender address for -notify-email (perforce-utils@<hostname> by default).")
+	flag.BoolVar(&flags.verbose, "verbose", false, "Verbose output.")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(flags.verbose); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(flags.format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+
+	var detector *anomalyDetector
+	anomalies := 0
+	if flags.follow || flags.anomalies {
+		floors, err := parseFloors(flags.anomalyMin)
+		if err != nil {
+			logging.Fatal("Invalid -anomaly-min", logging.Err(err))
+		}
+		if flags.baselineMinutes < 1 {
+			logging.Fatal("-baseline-minutes must be at least 1")
+		}
+		notifier := notify.New(flags.notifySlack, flags.notifyEmail, flags.notifySMTP, flags.notifyFrom)
+		host, _ := os.Hostname()
+		detector = newAnomalyDetector(flags.baselineMinutes, flags.anomalySigma, flags.warmupMinutes, floors, func(a anomaly) {
+			anomalies++
+			slog.Warn("Rate anomaly", "metric", a.metric, "minute", a.minute.UTC().Format(time.RFC3339),
+				"value", a.value, "baseline", a.baseline, "stddev", a.stddev)
+			title := fmt.Sprintf("p4_journal_stats on %v: %.0f %v in a minute", host, a.value, metricDescriptions[a.metric])
+			if err := notifier.SendAlert(title, fmt.Sprintf("%v\n\nJournal: %v\n", a, flag.Arg(0))); err != nil {
+				slog.Warn("Could not send notification", logging.Err(err))
+			}
+		})
+	}
+
+	start := time.Now()
+	var file io.ReadCloser
+	var err error
+	if flags.follow {
+		stop := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			slog.Info("Stopping to follow the journal")
+			close(stop)
+		}()
+		file, err = journal.Follow(flag.Arg(0), flags.followInterval, stop)
+	} else {
+		file, err = journal.Open(flag.Arg(0))
+	}
+	if err != nil {
+		logging.Fatal("Error opening journal", logging.PathKey, flag.Arg(0), logging.Err(err))
+	}
+	defer file.Close()
+
+	stats := newJournalStats(flags.largest)
+	if err := journal.Scan(file, func(record journal.Record) error {
+		stats.add(record)
+		if detector != nil {
+			detector.add(record)
+		}
+		return nil
+	}); err != nil {
+		logging.Fatal("Error reading journal", logging.PathKey, flag.Arg(0), logging.Err(err))
+	}
+
+	if err := output.WriteTable(flags.format, flags.output, output.Table{Name: "journal_stats"}, stats.writeTable); err != nil {
+		logging.Fatal("Error writing statistics", logging.Err(err))
+	}
+
+	for _, operation := range sortedStats(stats.byOperation) {
+		slog.Info("Operation totals", "operation", operation.operation, logging.CountKey, operation.records,
+			logging.BytesKey, operation.bytes)
+	}
+	largest := stats.largestRecords()
+	if len(flags.largestCSV) > 0 {
+		err := output.WriteFile(flags.largestCSV, func(w io.Writer) error {
+			return writeLargestCSV(w, largest)
+		})
+		if err != nil {
+			logging.Fatal("Error writing largest records", logging.PathKey, flags.largestCSV, logging.Err(err))
+		}
+	} else {
+		for _, record := range largest {
+			slog.Info("Large record", logging.TableKey, record.table, "operation", record.operation,
+				logging.LineKey, record.lineNumber, logging.OffsetKey, record.offset, logging.BytesKey, record.bytes,
+				"key", record.key)
+		}
+	}
+	slog.Info("Processed records", logging.CountKey, stats.records, logging.BytesKey, stats.bytes)
+	if detector != nil {
+		slog.Info("Rate anomalies", logging.CountKey, anomalies)
+	}
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+}
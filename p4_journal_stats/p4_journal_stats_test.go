@@ -0,0 +1,137 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+)
+
+// Keeps the rows written, in place of a file
+type rowsWriter struct {
+	rows [][]string
+}
+
+func (w *rowsWriter) Write(row []string) error {
+	w.rows = append(w.rows, row)
+	return nil
+}
+
+func (w *rowsWriter) Commit() error { return nil }
+func (w *rowsWriter) Close() error  { return nil }
+
+func TestJournalStats(t *testing.T) {
+	stats := newJournalStats(2)
+	err := journal.ScanFile("../perforceutils/testdata/example_journal.txt", nil, func(record journal.Record) error {
+		stats.add(record)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ScanFile() returned %v", err)
+	}
+
+	rev := stats.byTable["db.rev\x00"+journal.PutValue]
+	if rev == nil || rev.records != 6 {
+		t.Errorf("add() db.rev = %+v, want 6 records", rev)
+	}
+	total := 0
+	for _, operation := range stats.byOperation {
+		total += operation.records
+	}
+	if total != stats.records {
+		t.Errorf("add() counted %v records by operation, want %v", total, stats.records)
+	}
+
+	largest := stats.largestRecords()
+	if len(largest) != 2 || largest[0].bytes < largest[1].bytes {
+		t.Fatalf("largestRecords() = %+v, want the 2 largest records, largest first", largest)
+	}
+	for _, table := range stats.byTable {
+		if table.maxBytes > largest[0].bytes {
+			t.Errorf("largestRecords() = %+v, smaller than a record of %v bytes in %v", largest, table.maxBytes, table.table)
+		}
+	}
+
+	out := &rowsWriter{}
+	if err := stats.writeTable(out); err != nil {
+		t.Fatalf("writeTable() returned %v", err)
+	}
+	if len(out.rows) != 1+len(stats.byTable) {
+		t.Errorf("writeTable() wrote %v rows, want %v", len(out.rows), 1+len(stats.byTable))
+	}
+}
+
+func TestSortedStats(t *testing.T) {
+	stats := map[string]*recordStats{
+		"a": {table: "db.rev", operation: "pv", bytes: 10},
+		"b": {table: "db.have", operation: "pv", bytes: 20},
+		"c": {table: "db.rev", operation: "dv", bytes: 10},
+	}
+	var got []string
+	for _, s := range sortedStats(stats) {
+		got = append(got, s.table+" "+s.operation)
+	}
+	want := []string{"db.have pv", "db.rev dv", "db.rev pv"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sortedStats() = %q, want %q", got, want)
+	}
+}
+
+func TestAnomalyDetector(t *testing.T) {
+	var anomalies []anomaly
+	detector := newAnomalyDetector(10, 3, 3, map[string]float64{ObliteratesMetric: 10}, func(a anomaly) {
+		anomalies = append(anomalies, a)
+	})
+	// An obliterated revision a minute, then 50 in the seventh minute
+	start := int64(1611008040)
+	for minute := int64(0); minute < 8; minute++ {
+		detector.add(journal.Record{Operation: journal.EndTransaction,
+			Fields: []string{"1", strconv.FormatInt(start+60*minute, 10)}})
+		count := 1
+		if minute == 6 {
+			count = 50
+		}
+		for i := 0; i < count; i++ {
+			detector.add(journal.Record{Operation: journal.DeleteValue, Table: "db.rev"})
+		}
+	}
+	if len(anomalies) != 1 {
+		t.Fatalf("add() reported %v, want one anomaly", anomalies)
+	}
+	if got := anomalies[0]; got.metric != ObliteratesMetric || got.value != 50 || got.minute.Unix() != start+6*60 {
+		t.Errorf("add() reported %v, want 50 obliterated revisions in the seventh minute", got)
+	}
+}
+
+func TestParseFloors(t *testing.T) {
+	floors, err := parseFloors("submits=100, obliterates=1000")
+	if err != nil {
+		t.Fatalf("parseFloors() returned %v", err)
+	}
+	want := map[string]float64{SubmitsMetric: 100, ObliteratesMetric: 1000}
+	if !reflect.DeepEqual(floors, want) {
+		t.Errorf("parseFloors() = %v, want %v", floors, want)
+	}
+	for _, value := range []string{"changes=1", "submits", "submits=many"} {
+		if _, err := parseFloors(value); err == nil {
+			t.Errorf("parseFloors(%q) succeeded, want an error", value)
+		}
+	}
+}
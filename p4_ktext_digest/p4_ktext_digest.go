@@ -0,0 +1,308 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_ktext_digest computes the digests "p4 verify" expects for the archives of +k
+// (ktext) files, with their RCS keywords collapsed. Archives restored from backups or copied from
+// workspaces may have expanded keywords, such as "$Change: 1234 $", that make their content differ
+// from the digests of the checkpoint.
+package main
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/lbr"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/rcs"
+	"github.com/google/perforce-utils/perforceutils/schema"
+)
+
+// Revision statuses
+const (
+	OKRevision       = "ok"
+	MismatchRevision = "mismatch"
+	MissingRevision  = "missing"
+	// The archive exists but couldn't be read, for example a corrupted ,v file
+	ErrorRevision = "error"
+)
+
+// Returns the MD5 digest of a content, as recorded in db.storage and db.rev
+func digest(content []byte) string {
+	sum := md5.Sum(content)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// Reads a full file archive, uncompressing it when its name ends with .gz
+func readArchive(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var content io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("error uncompressing %v: %v", path, err)
+		}
+		defer gzipReader.Close()
+		content = gzipReader
+	}
+	return io.ReadAll(content)
+}
+
+// Prints the keyword-collapsed digest of files, md5sum style. Each revision of RCS ,v files is
+// printed as file,v/revision.
+func printDigests(w io.Writer, paths []string) error {
+	for _, path := range paths {
+		if strings.HasSuffix(path, ",v") {
+			file, err := rcs.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			for _, revision := range file.Revisions() {
+				content, err := file.Content(revision.Number)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(w, "%v  %v\n", digest(archive.CollapseKeywords(content)), path+"/"+revision.Number)
+			}
+			continue
+		}
+		content, err := readArchive(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%v  %v\n", digest(archive.CollapseKeywords(content)), path)
+	}
+	return nil
+}
+
+// Counts of checked revisions, by status
+type counts map[string]int
+
+// Checks the archives of the +k revisions of a checkpoint against their db.rev digests, writing
+// them as a table. Revisions sharing an archive (lazy copies) are checked once.
+func checkRevisions(out output.Writer, checkpointPath string, depotRoot string, depots lbr.DepotMaps, all bool) (counts, error) {
+	out.Write([]string{
+		"DepotFile",
+		"DepotRev",
+		"LbrFile",
+		"LbrRev",
+		"Digest",
+		"ArchiveDigest",
+		"KeywordsExpanded",
+		"Status",
+		"Archive"})
+
+	results := make(counts)
+	checked := make(map[string]bool)
+	// The last RCS file read, since the revisions of a file are listed one after the other
+	var rcsFile *rcs.File
+	var rcsPath string
+	var rcsErr error
+
+	err := journal.ScanFile(checkpointPath, map[string]bool{"db.rev": true}, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		var rev schema.Rev
+		if err := schema.Unmarshal(record, &rev); err != nil || len(rev.LbrFile) == 0 {
+			slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		if !archive.HasKeywords(rev.Type) || !archive.FileAction(rev.Action).HasArchive() ||
+			len(strings.Trim(rev.Digest, "0")) == 0 {
+			return nil
+		}
+		key := rev.LbrFile + "#" + rev.LbrRev
+		if checked[key] {
+			return nil
+		}
+		checked[key] = true
+
+		path := depots.Path(depotRoot, lbr.VersionedFilePath(rev.LbrFile, rev.LbrRev, rev.LbrType))
+		var content []byte
+		var err error
+		if lbr.StorageType(rev.LbrType) == lbr.RCSStorageType {
+			// All the revisions are in the ,v file
+			path = filepath.Dir(path)
+			if path != rcsPath {
+				rcsFile, rcsErr = rcs.ReadFile(path)
+				rcsPath = path
+			}
+			err = rcsErr
+			if err == nil {
+				content, err = rcsFile.Content(rev.LbrRev)
+			}
+		} else {
+			// Compressed types may have been restored uncompressed, and the other way around
+			content, err = readArchive(path + ".gz")
+			if errors.Is(err, fs.ErrNotExist) {
+				content, err = readArchive(path)
+			} else {
+				path += ".gz"
+			}
+		}
+
+		status, archiveDigest, expanded := OKRevision, "", false
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			status = MissingRevision
+		case err != nil:
+			status = ErrorRevision
+			slog.Warn("Could not read archive", logging.PathKey, path, logging.RevisionKey, rev.LbrRev, logging.Err(err))
+		default:
+			archiveDigest = digest(archive.CollapseKeywords(content))
+			expanded = archiveDigest != digest(content)
+			if archiveDigest != rev.Digest {
+				status = MismatchRevision
+			}
+		}
+		results[status]++
+		if status == OKRevision && !all {
+			return nil
+		}
+		out.Write([]string{
+			rev.DepotFile,
+			strconv.Itoa(rev.DepotRev),
+			rev.LbrFile,
+			rev.LbrRev,
+			rev.Digest,
+			archiveDigest,
+			strconv.FormatBool(expanded),
+			status,
+			path})
+		return nil
+	})
+	return results, err
+}
+
+// Reads the depots stored outside of a directory named after them, from the start of a checkpoint
+func readDepotMaps(checkpointPath string) lbr.DepotMaps {
+	// The standard input can't be read twice
+	if checkpointPath == journal.Stdin {
+		slog.Info("Depot maps not read from the standard input, assuming depots are stored under their name")
+		return nil
+	}
+	file, err := journal.Open(checkpointPath)
+	if err != nil {
+		slog.Warn("Could not read depot maps", logging.Err(err))
+		return nil
+	}
+	defer file.Close()
+
+	depots, err := lbr.ReadDepotMaps(file)
+	if err != nil {
+		slog.Warn("Could not read depot maps", logging.Err(err))
+		return nil
+	}
+	for depot, dir := range depots {
+		slog.Info("Remapped depot", "depot", depot, logging.PathKey, dir)
+	}
+	return depots
+}
+
+func main() {
+	flags := struct {
+		depotRoot string
+		depotMaps bool
+		all       bool
+		output    string
+		format    string
+		verbose   bool
+	}{}
+
+	flag.StringVar(&flags.depotRoot, "depot-root", "", "Depot root to check the +k revisions of the checkpoint given as argument against.")
+	flag.BoolVar(&flags.depotMaps, "depot-maps", true, "Locate the archives of depots from their Map field in db.depot.")
+	flag.BoolVar(&flags.all, "all", false, "Report the revisions whose digest matches as well.")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File to write the digests to, or file or table for the database formats to write the report to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage()+" For the report of -depot-root.")
+	flag.BoolVar(&flags.verbose, "verbose", false, "Verbose output.")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(flags.verbose); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(flags.format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+
+	if len(flags.depotRoot) == 0 {
+		err := output.WriteFile(flags.output, func(w io.Writer) error {
+			return printDigests(w, flag.Args())
+		})
+		if err != nil {
+			logging.Fatal("Error computing digests", logging.Err(err))
+		}
+		return
+	}
+
+	start := time.Now()
+	var depots lbr.DepotMaps
+	if flags.depotMaps {
+		depots = readDepotMaps(flag.Arg(0))
+	}
+	var results counts
+	err := output.WriteTable(flags.format, flags.output, output.Table{Name: "ktext_digests"}, func(out output.Writer) error {
+		var err error
+		results, err = checkRevisions(out, flag.Arg(0), flags.depotRoot, depots, flags.all)
+		return err
+	})
+	if err != nil {
+		logging.Fatal("Error checking revisions", logging.PathKey, flag.Arg(0), logging.Err(err))
+	}
+
+	for _, status := range []string{OKRevision, MismatchRevision, MissingRevision, ErrorRevision} {
+		slog.Info("Checked +k revisions", "status", status, logging.CountKey, results[status])
+	}
+	slog.Info("Execution took", logging.DurationKey, time.Since(start).String())
+
+	if results[MismatchRevision]+results[MissingRevision]+results[ErrorRevision] > 0 {
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Keeps the rows written, in place of a file
+type rowsWriter struct{ rows [][]string }
+
+func (w *rowsWriter) Write(row []string) error { w.rows = append(w.rows, row); return nil }
+func (w *rowsWriter) Commit() error            { return nil }
+func (w *rowsWriter) Close() error             { return nil }
+
+const (
+	collapsedContent = "// $Id$\nint x;\n"
+	expandedContent  = "// $Id: //depot/k/a.c#1 $\nint x;\n"
+)
+
+// A ktext revision stored in full, in db.rev version 9
+func ktextRev(depotFile string, lbrFile string, digest string) string {
+	return fmt.Sprintf("@pv@ 9 @db.rev@ @%v@ 1 32 0 4 1611008048 1611008047 %v 16 0 0 @%v@ @1.4@ 1 \n",
+		depotFile, digest, lbrFile)
+}
+
+func TestCheckRevisions(t *testing.T) {
+	depotRoot := t.TempDir()
+	archives := map[string]string{
+		"depot/k/a.c,d/1.4": expandedContent,
+		"depot/k/b.c,d/1.4": "int y;\n",
+	}
+	for name, content := range archives {
+		path := filepath.Join(depotRoot, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("MkdirAll() returned %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile() returned %v", err)
+		}
+	}
+
+	expected := digest([]byte(collapsedContent))
+	example, err := os.ReadFile("../perforceutils/testdata/example_journal.txt")
+	if err != nil {
+		t.Fatalf("ReadFile() returned %v", err)
+	}
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	records := ktextRev("//depot/k/a.c", "//depot/k/a.c", expected) +
+		// A lazy copy of a.c, checked once
+		ktextRev("//depot/k2/a.c", "//depot/k/a.c", expected) +
+		ktextRev("//depot/k/b.c", "//depot/k/b.c", expected) +
+		ktextRev("//depot/k/c.c", "//depot/k/c.c", expected)
+	if err := os.WriteFile(checkpoint, append(example, records...), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+
+	out := &rowsWriter{}
+	results, err := checkRevisions(out, checkpoint, depotRoot, nil, true)
+	if err != nil {
+		t.Fatalf("checkRevisions() returned %v", err)
+	}
+	wantCounts := counts{OKRevision: 1, MismatchRevision: 1, MissingRevision: 1}
+	if !reflect.DeepEqual(results, wantCounts) {
+		t.Errorf("checkRevisions() = %v, want %v", results, wantCounts)
+	}
+	want := [][]string{
+		{"//depot/k/a.c", "1", "//depot/k/a.c", "1.4", expected, expected, "true", OKRevision,
+			filepath.Join(depotRoot, "depot/k/a.c,d/1.4")},
+		{"//depot/k/b.c", "1", "//depot/k/b.c", "1.4", expected, digest([]byte("int y;\n")), "false", MismatchRevision,
+			filepath.Join(depotRoot, "depot/k/b.c,d/1.4")},
+		{"//depot/k/c.c", "1", "//depot/k/c.c", "1.4", expected, "", "false", MissingRevision,
+			filepath.Join(depotRoot, "depot/k/c.c,d/1.4")},
+	}
+	if !reflect.DeepEqual(out.rows[1:], want) {
+		t.Errorf("checkRevisions() wrote %q, want %q", out.rows[1:], want)
+	}
+
+	// Only the revisions failing verification are written by default
+	out = &rowsWriter{}
+	if _, err := checkRevisions(out, checkpoint, depotRoot, nil, false); err != nil {
+		t.Fatalf("checkRevisions() returned %v", err)
+	}
+	if !reflect.DeepEqual(out.rows[1:], want[1:]) {
+		t.Errorf("checkRevisions() wrote %q, want %q", out.rows[1:], want[1:])
+	}
+}
+
+func TestPrintDigests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.c")
+	if err := os.WriteFile(path, []byte(expandedContent), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+	var printed bytes.Buffer
+	if err := printDigests(&printed, []string{path}); err != nil {
+		t.Fatalf("printDigests() returned %v", err)
+	}
+	if got, want := printed.String(), digest([]byte(collapsedContent))+"  "+path+"\n"; got != want {
+		t.Errorf("printDigests() wrote %q, want %q", got, want)
+	}
+	if err := printDigests(&printed, []string{path + ".missing"}); err == nil {
+		t.Errorf("printDigests() of a missing file succeeded, want an error")
+	}
+}
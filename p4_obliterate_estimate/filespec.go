@@ -0,0 +1,101 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/wildcard"
+)
+
+// A file argument of p4 obliterate: a depot path with the ..., * and %%1 wildcards, optionally
+// followed by a revision range (#3,5) or a changelist range (@100,200)
+type fileSpec struct {
+	text string
+	path *wildcard.Pattern
+	// Inclusive range of revisions, or of changelists when byChange is set. Bounds left at 0 are open.
+	first    int
+	last     int
+	byChange bool
+}
+
+// Parses file arguments like "//depot/old/...", "//depot/*.iso#1,3" or "//depot/tmp/...@1,5000".
+// Depot paths are matched as stored in the checkpoint, with @, #, % and * escaped as %40, %23, %25
+// and %2A.
+func parseFileSpec(text string, caseInsensitive bool) (*fileSpec, error) {
+	if !strings.HasPrefix(text, "//") {
+		return nil, fmt.Errorf("expected a depot path, got %q", text)
+	}
+	spec := &fileSpec{text: text}
+	path := text
+	if i := strings.IndexAny(text, "#@"); i >= 0 {
+		path = text[:i]
+		spec.byChange = text[i] == '@'
+		if err := spec.parseRange(text[i+1:]); err != nil {
+			return nil, fmt.Errorf("invalid range in %q: %v", text, err)
+		}
+	}
+
+	pattern, err := wildcard.Compile(path, caseInsensitive)
+	if err != nil {
+		return nil, fmt.Errorf("invalid depot path %q: %v", text, err)
+	}
+	spec.path = pattern
+	return spec, nil
+}
+
+// Parses the bounds of a range such as "3,5", "#3,#5" or "1,head". As for other p4 commands
+// taking a range, a single revision is the end of a range starting at the first one.
+func (s *fileSpec) parseRange(value string) error {
+	bounds := strings.Split(value, ",")
+	if len(bounds) > 2 {
+		return fmt.Errorf("expected at most two bounds, got %q", value)
+	}
+	if len(bounds) == 1 {
+		bounds = []string{"", bounds[0]}
+	}
+	for i, bound := range bounds {
+		bound = strings.TrimLeft(bound, "#@")
+		if (i == 0 && len(bound) == 0) || (i == 1 && bound == "head") {
+			continue
+		}
+		number, err := strconv.Atoi(bound)
+		if err != nil || number < 1 {
+			return fmt.Errorf("expected a revision or changelist number, got %q", bound)
+		}
+		if i == 0 {
+			s.first = number
+		} else {
+			s.last = number
+		}
+	}
+	return nil
+}
+
+// Reports whether a revision of a depot file, submitted in a change, is within the spec
+func (s *fileSpec) matches(depotFile string, revision int, change int) bool {
+	if !s.path.Match(depotFile) {
+		return false
+	}
+	number := revision
+	if s.byChange {
+		number = change
+	}
+	return (s.first == 0 || number >= s.first) && (s.last == 0 || number <= s.last)
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestFileSpec(t *testing.T) {
+	tests := []struct {
+		spec     string
+		file     string
+		revision int
+		change   int
+		want     bool
+	}{
+		{"//depot/path1/...", "//depot/path1/data1.dat", 2, 2, true},
+		{"//depot/path1/...", "//depot/path2/More.txt", 1, 3, false},
+		{"//depot/*/*.dat", "//depot/path1/data1.dat", 1, 1, true},
+		{"//depot/path1/data1.dat#1", "//depot/path1/data1.dat", 1, 1, true},
+		{"//depot/path1/data1.dat#1", "//depot/path1/data1.dat", 2, 2, false},
+		{"//depot/path1/data1.dat#2,head", "//depot/path1/data1.dat", 2, 2, true},
+		{"//depot/path1/data1.dat#2,head", "//depot/path1/data1.dat", 1, 1, false},
+		{"//depot/...@2,3", "//depot/path1/data1.dat", 1, 1, false},
+		{"//depot/...@2,3", "//depot/path2/More.txt", 1, 3, true},
+		{"//depot/...@@1", "//depot/path2/More.txt", 1, 3, false},
+	}
+	for _, test := range tests {
+		spec, err := parseFileSpec(test.spec, false)
+		if err != nil {
+			t.Fatalf("parseFileSpec(%q) returned %v", test.spec, err)
+		}
+		if got := spec.matches(test.file, test.revision, test.change); got != test.want {
+			t.Errorf("parseFileSpec(%q).matches(%v#%v@%v) = %v, want %v", test.spec, test.file, test.revision, test.change, got, test.want)
+		}
+	}
+}
+
+func TestParseFileSpecErrors(t *testing.T) {
+	for _, spec := range []string{"depot/...", "//depot/...#1,2,3", "//depot/...#x", "//depot/...#0"} {
+		if _, err := parseFileSpec(spec, false); err == nil {
+			t.Errorf("parseFileSpec(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_obliterate_estimate reports what "p4 obliterate" would remove for a set of file
+// arguments, from a checkpoint: the revisions, and the archive files that would actually be deleted
+// once the archives shared with other files (lazy copies) or with shelves are accounted for.
+// It never connects to the server.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/lbr"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/schema"
+)
+
+// A librarian file revision referenced by at least one obliterated revision
+type archiveFile struct {
+	lbrFile string
+	lbrRev  string
+	lbrType int
+	// The server size from db.storage, or the size of the file from db.rev when there's no db.storage
+	// record (servers before 2019.1)
+	size int64
+	// The reference count of db.storage, -1 without a record
+	refCount int
+	// The db.rev and db.revsh records referencing the archive, and how many of them are obliterated
+	references  int
+	obliterated int
+	// A revision outside the file arguments, or a shelved revision, that keeps the archive
+	keptBy string
+}
+
+// Reports whether obliterating removes the archive, as no other revision references it
+func (a *archiveFile) deleted() bool {
+	return a.references <= a.obliterated
+}
+
+// What obliterating the file arguments would remove
+type estimate struct {
+	revisions  int
+	files      map[string]bool
+	lazyCopies int
+	// Keyed by librarian file and revision
+	archives map[string]*archiveFile
+	// The RCS files holding an obliterated revision, true when one of their revisions is kept
+	rcsFiles       map[string]bool
+	storageRecords int
+}
+
+func archiveKey(lbrFile string, lbrRev string) string {
+	return lbrFile + "\x00" + lbrRev
+}
+
+func matchesAny(specs []*fileSpec, rev *schema.Rev) bool {
+	for _, spec := range specs {
+		if spec.matches(rev.DepotFile, rev.DepotRev, rev.Change) {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the revisions matching the file arguments, and the archives they reference
+func findRevisions(checkpointPath string, specs []*fileSpec) (*estimate, error) {
+	e := &estimate{
+		files:    make(map[string]bool),
+		archives: make(map[string]*archiveFile),
+		rcsFiles: make(map[string]bool),
+	}
+	err := journal.ScanFile(checkpointPath, map[string]bool{"db.rev": true}, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		var rev schema.Rev
+		if err := schema.Unmarshal(record, &rev); err != nil {
+			slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		if !matchesAny(specs, &rev) {
+			return nil
+		}
+		e.revisions++
+		e.files[rev.DepotFile] = true
+		if !archive.FileAction(rev.Action).HasArchive() {
+			return nil
+		}
+		if rev.LbrIsLazy {
+			e.lazyCopies++
+		}
+		key := archiveKey(rev.LbrFile, rev.LbrRev)
+		a, ok := e.archives[key]
+		if !ok {
+			a = &archiveFile{lbrFile: rev.LbrFile, lbrRev: rev.LbrRev, lbrType: rev.LbrType, size: rev.Size, refCount: -1}
+			e.archives[key] = a
+		}
+		a.obliterated++
+		if _, ok := e.rcsFiles[rev.LbrFile]; !ok && lbr.StorageType(rev.LbrType) == lbr.RCSStorageType {
+			e.rcsFiles[rev.LbrFile] = false
+		}
+		return nil
+	})
+	return e, err
+}
+
+// Counts all the references to the archives of the obliterated revisions, including from the files
+// outside the file arguments and from shelves, and reads their size from db.storage
+func (e *estimate) countReferences(checkpointPath string, specs []*fileSpec) error {
+	tables := map[string]bool{"db.rev": true, "db.revsh": true, "db.storage": true}
+	return journal.ScanFile(checkpointPath, tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		if record.Table == "db.storage" {
+			e.storageRecords++
+			var storage schema.Storage
+			if schema.Unmarshal(record, &storage) != nil {
+				return nil
+			}
+			if a, ok := e.archives[archiveKey(storage.LbrFile, storage.LbrRev)]; ok {
+				a.refCount = storage.RefCount
+				if storage.ServerSize >= 0 {
+					a.size = storage.ServerSize
+				}
+			}
+			return nil
+		}
+
+		// Malformed db.rev records were reported by findRevisions
+		var rev schema.Rev
+		if schema.Unmarshal(record, &rev) != nil || !archive.FileAction(rev.Action).HasArchive() {
+			return nil
+		}
+		// Obliterate doesn't remove shelved revisions
+		shelved := record.Table == "db.revsh"
+		kept := shelved || !matchesAny(specs, &rev)
+		if _, ok := e.rcsFiles[rev.LbrFile]; ok && kept && !shelved && lbr.StorageType(rev.LbrType) == lbr.RCSStorageType {
+			e.rcsFiles[rev.LbrFile] = true
+		}
+		a, ok := e.archives[archiveKey(rev.LbrFile, rev.LbrRev)]
+		if !ok {
+			return nil
+		}
+		a.references++
+		if kept && len(a.keptBy) == 0 {
+			if shelved {
+				a.keptBy = fmt.Sprintf("%v@=%v", rev.DepotFile, rev.Change)
+			} else {
+				a.keptBy = fmt.Sprintf("%v#%v", rev.DepotFile, rev.DepotRev)
+			}
+		}
+		return nil
+	})
+}
+
+// Writes the archives referenced by the obliterated revisions, sorted by librarian file
+func (e *estimate) writeArchives(out output.Writer) error {
+	archives := make([]*archiveFile, 0, len(e.archives))
+	for _, a := range e.archives {
+		archives = append(archives, a)
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		if archives[i].lbrFile != archives[j].lbrFile {
+			return archives[i].lbrFile < archives[j].lbrFile
+		}
+		return archives[i].lbrRev < archives[j].lbrRev
+	})
+
+	out.Write([]string{
+		"LbrFile",
+		"LbrRev",
+		"Archive",
+		"Size",
+		"References",
+		"Obliterated",
+		"RefCount",
+		"Deleted",
+		"KeptBy"})
+	for _, a := range archives {
+		// Tiny files are stored in db.revtx rather than under the depot root
+		archivePath := ""
+		if lbr.StorageType(a.lbrType) != lbr.TinyStorageType {
+			archivePath = lbr.VersionedFilePath(a.lbrFile, a.lbrRev, a.lbrType)
+		}
+		refCount := ""
+		if a.refCount >= 0 {
+			refCount = strconv.Itoa(a.refCount)
+		}
+		out.Write([]string{
+			a.lbrFile,
+			a.lbrRev,
+			archivePath,
+			strconv.FormatInt(a.size, 10),
+			strconv.Itoa(a.references),
+			strconv.Itoa(a.obliterated),
+			refCount,
+			strconv.FormatBool(a.deleted()),
+			a.keptBy})
+	}
+	return nil
+}
+
+func main() {
+	flags := struct {
+		caseInsensitive bool
+		output          string
+		format          string
+	}{}
+
+	flag.BoolVar(&flags.caseInsensitive, "case-insensitive", false, "Match depot paths ignoring case, as case-insensitive servers do.")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File, or table for the database formats, to write the archives to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage())
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(false); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 2 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(flags.format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+	checkpointPath := flag.Arg(flag.NArg() - 1)
+
+	var specs []*fileSpec
+	for _, text := range flag.Args()[:flag.NArg()-1] {
+		spec, err := parseFileSpec(text, flags.caseInsensitive)
+		if err != nil {
+			logging.Fatal("Invalid file argument", logging.Err(err))
+		}
+		specs = append(specs, spec)
+	}
+
+	start := time.Now()
+	e, err := findRevisions(checkpointPath, specs)
+	if err != nil {
+		logging.Fatal("Error processing checkpoint", logging.PathKey, checkpointPath, logging.Err(err))
+	}
+	// The archives are only known once the revisions are, so the checkpoint is read twice
+	if len(e.archives) > 0 {
+		if err := e.countReferences(checkpointPath, specs); err != nil {
+			logging.Fatal("Error processing checkpoint", logging.PathKey, checkpointPath, logging.Err(err))
+		}
+		if e.storageRecords == 0 {
+			slog.Warn("No db.storage records, archive sizes are the file sizes of db.rev")
+		}
+	}
+	if err := output.WriteTable(flags.format, flags.output, output.Table{Name: "obliterated_archives"}, e.writeArchives); err != nil {
+		logging.Fatal("Error writing archives", logging.Err(err))
+	}
+
+	var deletedCount, keptCount int
+	var deletedBytes, keptBytes int64
+	for _, a := range e.archives {
+		if a.deleted() {
+			deletedCount++
+			deletedBytes += a.size
+		} else {
+			keptCount++
+			keptBytes += a.size
+		}
+	}
+	rcsDeleted := 0
+	for _, kept := range e.rcsFiles {
+		if !kept {
+			rcsDeleted++
+		}
+	}
+	slog.Info("Obliterated revisions", logging.CountKey, e.revisions, "files", len(e.files), "lazy_copies", e.lazyCopies)
+	slog.Info("Deleted archives", logging.CountKey, deletedCount, logging.BytesKey, deletedBytes, "rcs_files", rcsDeleted)
+	slog.Info("Kept archives", logging.CountKey, keptCount, logging.BytesKey, keptBytes)
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+}
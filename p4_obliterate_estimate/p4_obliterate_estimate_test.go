@@ -0,0 +1,74 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEstimate(t *testing.T) {
+	const checkpoint = "../perforceutils/testdata/example_journal.txt"
+	var specs []*fileSpec
+	for _, text := range []string{"//depot/path1/data1.dat#1", "//depot/path1/README.txt#1"} {
+		spec, err := parseFileSpec(text, false)
+		if err != nil {
+			t.Fatalf("parseFileSpec(%q) returned %v", text, err)
+		}
+		specs = append(specs, spec)
+	}
+	e, err := findRevisions(checkpoint, specs)
+	if err != nil {
+		t.Fatalf("findRevisions() returned %v", err)
+	}
+	if err := e.countReferences(checkpoint, specs); err != nil {
+		t.Fatalf("countReferences() returned %v", err)
+	}
+	if e.revisions != 2 || len(e.files) != 2 || e.storageRecords != 6 {
+		t.Errorf("estimate = %v revisions of %v files with %v db.storage records, want 2 of 2 with 6", e.revisions, len(e.files), e.storageRecords)
+	}
+	// The RCS file of README.txt holds revision 2 as well
+	if want := map[string]bool{"//depot/path1/README.txt": true}; !reflect.DeepEqual(e.rcsFiles, want) {
+		t.Errorf("estimate RCS files = %v, want %v", e.rcsFiles, want)
+	}
+
+	out := &rowsWriter{}
+	if err := e.writeArchives(out); err != nil {
+		t.Fatalf("writeArchives() returned %v", err)
+	}
+	want := [][]string{
+		{"LbrFile", "LbrRev", "Archive", "Size", "References", "Obliterated", "RefCount", "Deleted", "KeptBy"},
+		{"//depot/path1/README.txt", "1.1", "//depot/path1/README.txt,v/1.1", "203", "1", "1", "1", "true", ""},
+		{"//depot/path1/data1.dat", "1.1", "//depot/path1/data1.dat,d/1.1", "10221", "1", "1", "1", "true", ""},
+	}
+	if !reflect.DeepEqual(out.rows, want) {
+		t.Errorf("writeArchives() = %q, want %q", out.rows, want)
+	}
+}
+
+// Keeps the rows written, in place of a file
+type rowsWriter struct {
+	rows [][]string
+}
+
+func (w *rowsWriter) Write(row []string) error {
+	w.rows = append(w.rows, row)
+	return nil
+}
+
+func (w *rowsWriter) Commit() error { return nil }
+func (w *rowsWriter) Close() error  { return nil }
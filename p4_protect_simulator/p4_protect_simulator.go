@@ -0,0 +1,243 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_protect_simulator checks a batch of accesses, each a user connecting from a host to
+// a depot file with an access level, against the protections table and groups of a checkpoint, or
+// against a protections spec not applied yet, to test changes of the protections before they reach
+// the server. It never connects to the server.
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// An access to check, from the CSV given with -checks
+type accessCheck struct {
+	lineNumber int
+	user       string
+	host       string
+	depotFile  string
+	access     string
+	level      accessLevel
+	// pass or fail, empty when the CSV has no Expected column
+	expected string
+
+	granted bool
+	line    *protectionsLine
+}
+
+func (c *accessCheck) result() string {
+	if c.granted {
+		return "pass"
+	}
+	return "fail"
+}
+
+// Reads the accesses to check from a CSV file whose header names the User, Host, Path and Access
+// columns, and optionally Expected
+func readChecks(r io.Reader) ([]*accessCheck, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"user", "host", "path", "access"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %v, expected User, Host, Path, Access and optionally Expected", name)
+		}
+	}
+	expectedColumn, hasExpected := columns["expected"]
+
+	var checks []*accessCheck
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return checks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		lineNumber, _ := reader.FieldPos(0)
+		field := func(column int) string {
+			if column < len(row) {
+				return strings.TrimSpace(row[column])
+			}
+			return ""
+		}
+		check := &accessCheck{
+			lineNumber: lineNumber,
+			user:       field(columns["user"]),
+			host:       field(columns["host"]),
+			depotFile:  field(columns["path"]),
+			access:     field(columns["access"]),
+		}
+		if check.level, err = parseAccessLevel(check.access); err != nil {
+			return nil, fmt.Errorf("line %v: %v", lineNumber, err)
+		}
+		if hasExpected {
+			check.expected = strings.ToLower(field(expectedColumn))
+			if check.expected != "pass" && check.expected != "fail" {
+				return nil, fmt.Errorf("line %v: expected pass or fail, got %q", lineNumber, field(expectedColumn))
+			}
+		}
+		checks = append(checks, check)
+	}
+}
+
+func writeResults(out output.Writer, checks []*accessCheck, withExpected bool) error {
+	header := []string{
+		"User",
+		"Host",
+		"Path",
+		"Access",
+		"Result",
+		"ProtectionsLine"}
+	if withExpected {
+		header = append(header, "Expected", "Matches")
+	}
+	out.Write(header)
+	for _, c := range checks {
+		line := ""
+		if c.line != nil {
+			line = c.line.text
+		}
+		row := []string{c.user, c.host, c.depotFile, c.access, c.result(), line}
+		if withExpected {
+			row = append(row, c.expected, strconv.FormatBool(c.expected == c.result()))
+		}
+		out.Write(row)
+	}
+	return nil
+}
+
+func main() {
+	flags := struct {
+		checks          string
+		protections     string
+		output          string
+		format          string
+		caseInsensitive bool
+	}{}
+
+	flag.StringVar(&flags.checks, "checks", "", "CSV file of the accesses to check, with User, Host, Path, Access and optionally Expected (pass or fail) columns.")
+	flag.StringVar(&flags.protections, "protections", "", "Protections spec, as written by \"p4 protect -o\", instead of db.protect.")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File, or table for the database formats, to write the results to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage())
+	flag.BoolVar(&flags.caseInsensitive, "case-insensitive", false, "Match depot paths, users and groups ignoring case, as case-insensitive servers do.")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(false); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 || len(flags.checks) == 0 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(flags.format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+	checkpointPath := flag.Arg(0)
+
+	start := time.Now()
+	file, err := os.Open(flags.checks)
+	if err != nil {
+		logging.Fatal("Error opening checks", logging.PathKey, flags.checks, logging.Err(err))
+	}
+	checks, err := readChecks(file)
+	file.Close()
+	if err != nil {
+		logging.Fatal("Error reading checks", logging.PathKey, flags.checks, logging.Err(err))
+	}
+
+	p := &protections{caseInsensitive: flags.caseInsensitive}
+	if len(flags.protections) > 0 {
+		var file *os.File
+		if file, err = os.Open(flags.protections); err == nil {
+			p.lines, err = readProtectionsSpec(file, flags.caseInsensitive)
+			file.Close()
+		}
+	} else {
+		p.lines, err = readProtectionsTable(checkpointPath, flags.caseInsensitive)
+	}
+	if err != nil {
+		logging.Fatal("Error reading protections", logging.Err(err))
+	}
+	if len(p.lines) == 0 {
+		logging.Fatal("Empty protections table, -protections can give the output of \"p4 protect -o\"")
+	}
+	if p.groups, err = readGroups(checkpointPath, flags.caseInsensitive); err != nil {
+		logging.Fatal("Error processing checkpoint", logging.PathKey, checkpointPath, logging.Err(err))
+	}
+
+	withExpected := false
+	passed, unexpected := 0, 0
+	for _, c := range checks {
+		c.granted, c.line = p.check(c.user, c.host, c.depotFile, c.level)
+		if c.granted {
+			passed++
+		}
+		if len(c.expected) > 0 {
+			withExpected = true
+			if c.expected != c.result() {
+				unexpected++
+				slog.Warn("Unexpected result", logging.LineKey, c.lineNumber, "user", c.user, "host", c.host,
+					logging.PathKey, c.depotFile, "access", c.access, "result", c.result())
+			}
+		}
+	}
+	err = output.WriteTable(flags.format, flags.output, output.Table{Name: "access_checks"}, func(out output.Writer) error {
+		return writeResults(out, checks, withExpected)
+	})
+	if err != nil {
+		logging.Fatal("Error writing results", logging.Err(err))
+	}
+
+	slog.Info("Checked accesses", logging.CountKey, len(checks), "passed", passed, "failed", len(checks)-passed,
+		"unexpected", unexpected, "protections_lines", len(p.lines))
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+	if unexpected > 0 {
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Keeps the rows written, in place of a file
+type rowsWriter struct{ rows [][]string }
+
+func (w *rowsWriter) Write(row []string) error { w.rows = append(w.rows, row); return nil }
+func (w *rowsWriter) Commit() error            { return nil }
+func (w *rowsWriter) Close() error             { return nil }
+
+func TestReadChecksAndWriteResults(t *testing.T) {
+	lines, err := readProtectionsSpec(strings.NewReader(specProtections), false)
+	if err != nil {
+		t.Fatalf("readProtectionsSpec() returned %v", err)
+	}
+	p := &protections{lines: lines}
+	if p.groups, err = readGroups(writeCheckpoint(t, checkpointProtections), false); err != nil {
+		t.Fatalf("readGroups() returned %v", err)
+	}
+	checks, err := readChecks(strings.NewReader(`User,Host,Path,Access,Expected
+admin,10.1.2.3,//depot/path1/data1.dat,super,pass
+the_user,10.1.2.3, //depot/path1/data1.dat ,read,Pass
+other,10.1.2.3,//depot/path1/data1.dat,read,pass
+`))
+	if err != nil {
+		t.Fatalf("readChecks() returned %v", err)
+	}
+	for _, c := range checks {
+		c.granted, c.line = p.check(c.user, c.host, c.depotFile, c.level)
+	}
+	out := &rowsWriter{}
+	if err := writeResults(out, checks, true); err != nil {
+		t.Fatalf("writeResults() returned %v", err)
+	}
+	want := [][]string{
+		{"User", "Host", "Path", "Access", "Result", "ProtectionsLine", "Expected", "Matches"},
+		{"admin", "10.1.2.3", "//depot/path1/data1.dat", "super", "pass", "super user admin 10.1.0.0/16 //...", "pass", "true"},
+		{"the_user", "10.1.2.3", "//depot/path1/data1.dat", "read", "pass", "write group devs * //depot/...", "pass", "true"},
+		{"other", "10.1.2.3", "//depot/path1/data1.dat", "read", "fail", "", "pass", "false"},
+	}
+	if !reflect.DeepEqual(out.rows, want) {
+		t.Errorf("writeResults() wrote %q, want %q", out.rows, want)
+	}
+}
+
+func TestReadChecksErrors(t *testing.T) {
+	for _, checks := range []string{
+		"User,Host,Path\nthe_user,*,//depot/...\n",
+		"User,Host,Path,Access\nthe_user,*,//depot/...,delete\n",
+		"User,Host,Path,Access,Expected\nthe_user,*,//depot/...,read,maybe\n",
+	} {
+		if _, err := readChecks(strings.NewReader(checks)); err == nil {
+			t.Errorf("readChecks(%q) succeeded, want an error", checks)
+		}
+	}
+}
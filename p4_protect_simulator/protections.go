@@ -0,0 +1,369 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/schema"
+	"github.com/google/perforce-utils/perforceutils/wildcard"
+)
+
+// The rights granted by the access levels, as the bits of the perm field of db.protect, see
+// https://www.perforce.com/perforce/doc.current/schema/#Perm
+const (
+	rightList   = 0x001
+	rightRead   = 0x002
+	rightOpen   = 0x004
+	rightWrite  = 0x008
+	rightBranch = 0x010
+	rightReview = 0x020
+	rightAdmin  = 0x040
+	rightSuper  = 0x080
+	rightOwner  = 0x100
+)
+
+// The mapFlag of protections lines starting with "-"
+const excludeMapFlag = 1
+
+// An access level of the protections table, such as write, or a single right, such as =branch
+type accessLevel struct {
+	name string
+	// The rights granted by a line of this level
+	grants int
+	// The rights removed by an exclusion line of this level: the level and the ones above it
+	removes int
+	// The right needed to have this level of access
+	requires int
+}
+
+var accessLevels = []accessLevel{
+	{"list", rightList, 0x1ff, rightList},
+	{"read", rightList | rightRead, 0x1ff &^ rightList, rightRead},
+	{"open", rightList | rightRead | rightOpen, rightOpen | rightWrite | rightBranch | rightAdmin | rightSuper | rightOwner, rightOpen},
+	{"write", rightList | rightRead | rightOpen | rightWrite | rightBranch, rightWrite | rightBranch | rightAdmin | rightSuper | rightOwner, rightWrite},
+	{"review", rightList | rightRead | rightReview, rightReview | rightAdmin | rightSuper, rightReview},
+	{"admin", rightList | rightRead | rightOpen | rightWrite | rightBranch | rightReview | rightAdmin, rightAdmin | rightSuper, rightAdmin},
+	{"super", 0xff, rightSuper, rightSuper},
+	{"owner", rightOwner, rightOwner, rightOwner},
+	{"=read", rightRead, rightRead, rightRead},
+	{"=open", rightOpen, rightOpen, rightOpen},
+	{"=write", rightWrite, rightWrite, rightWrite},
+	{"=branch", rightBranch, rightBranch, rightBranch},
+}
+
+// Returns the access level of a name, such as write or =branch
+func parseAccessLevel(name string) (accessLevel, error) {
+	for _, level := range accessLevels {
+		if level.name == strings.ToLower(name) {
+			return level, nil
+		}
+	}
+	return accessLevel{}, fmt.Errorf("unknown access level %q", name)
+}
+
+// Returns the access level of the perm field of db.protect
+func decodeAccessLevel(perm int) (accessLevel, error) {
+	for _, level := range accessLevels {
+		if level.grants == perm {
+			return level, nil
+		}
+	}
+	return accessLevel{}, fmt.Errorf("unknown access level %#x", perm)
+}
+
+// Matches a name against a pattern where * matches anything, as the users, groups and hosts of
+// protections lines
+func matchName(pattern string, name string, caseInsensitive bool) bool {
+	if caseInsensitive {
+		pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+	}
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(name, part)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(part):]
+	}
+	return strings.HasSuffix(name, parts[len(parts)-1])
+}
+
+// Matches a client address against the host of a protections line: *, a wildcard such as
+// 10.1.* or proxy-10.1.*, or a CIDR block such as 10.1.0.0/16
+func matchHost(pattern string, host string) bool {
+	if _, block, err := net.ParseCIDR(strings.TrimPrefix(pattern, "proxy-")); err == nil {
+		if strings.HasPrefix(pattern, "proxy-") != strings.HasPrefix(host, "proxy-") {
+			return false
+		}
+		ip := net.ParseIP(strings.TrimPrefix(host, "proxy-"))
+		return ip != nil && block.Contains(ip)
+	}
+	return matchName(pattern, host, false)
+}
+
+// A line of the protections table, such as "write group dev * //depot/dev/..."
+type protectionsLine struct {
+	text    string
+	level   accessLevel
+	isGroup bool
+	name    string
+	host    string
+	exclude bool
+	path    *wildcard.Pattern
+}
+
+func newProtectionsLine(level string, lineType string, name string, host string, path string, caseInsensitive bool) (*protectionsLine, error) {
+	line := &protectionsLine{text: strings.Join([]string{level, lineType, name, host, path}, " "), name: name, host: host}
+	var err error
+	if line.level, err = parseAccessLevel(level); err != nil {
+		return nil, err
+	}
+	switch lineType {
+	case "user":
+	case "group":
+		line.isGroup = true
+	default:
+		return nil, fmt.Errorf("expected user or group, got %q", lineType)
+	}
+	if strings.HasPrefix(path, "-") {
+		line.exclude = true
+		path = path[1:]
+	}
+	if line.path, err = wildcard.Compile(path, caseInsensitive); err != nil {
+		return nil, fmt.Errorf("invalid depot path %q: %v", path, err)
+	}
+	return line, nil
+}
+
+// The lines of a protections table, in order, and the groups of the users they apply to
+type protections struct {
+	lines           []*protectionsLine
+	groups          *groupMemberships
+	caseInsensitive bool
+}
+
+// Reports whether a line applies to a user connecting from a host, directly or through a group
+func (p *protections) applies(line *protectionsLine, user string, host string) bool {
+	if !matchHost(line.host, host) {
+		return false
+	}
+	if !line.isGroup {
+		return matchName(line.name, user, p.caseInsensitive)
+	}
+	if p.caseInsensitive {
+		user = strings.ToLower(user)
+	}
+	for _, group := range p.groups.of(user) {
+		if matchName(line.name, group, p.caseInsensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether a user connecting from a host has an access level on a depot file, and the line
+// deciding it, nil when no line grants the access. As on the server, the last line granting or
+// removing the right needed decides.
+func (p *protections) check(user string, host string, depotFile string, level accessLevel) (bool, *protectionsLine) {
+	for i := len(p.lines) - 1; i >= 0; i-- {
+		line := p.lines[i]
+		rights := line.level.grants
+		if line.exclude {
+			rights = line.level.removes
+		}
+		if rights&level.requires == 0 || !line.path.Match(depotFile) || !p.applies(line, user, host) {
+			continue
+		}
+		return !line.exclude, line
+	}
+	return false, nil
+}
+
+// Splits a line of a spec into its words, which are quoted when they contain spaces
+func splitSpecLine(line string) []string {
+	var words []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if len(line) == 0 {
+			return words
+		}
+		end := strings.IndexAny(line, " \t")
+		if line[0] == '"' {
+			line = line[1:]
+			end = strings.IndexByte(line, '"')
+		}
+		if end < 0 {
+			return append(words, line)
+		}
+		words = append(words, line[:end])
+		line = line[end+1:]
+	}
+}
+
+// Reads the Protections field of a protections spec, as written by "p4 protect -o"
+func readProtectionsSpec(r io.Reader, caseInsensitive bool) ([]*protectionsLine, error) {
+	var lines []*protectionsLine
+	inProtections := false
+	lineNumber := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNumber++
+		text := scanner.Text()
+		if strings.HasPrefix(text, "#") {
+			continue
+		}
+		if !strings.HasPrefix(text, "\t") && !strings.HasPrefix(text, " ") {
+			inProtections = strings.HasPrefix(text, "Protections:")
+			continue
+		}
+		// Lines can end with a comment
+		if i := strings.Index(text, "##"); i >= 0 {
+			text = text[:i]
+		}
+		words := splitSpecLine(text)
+		if !inProtections || len(words) == 0 {
+			continue
+		}
+		if len(words) != 5 {
+			return nil, fmt.Errorf("line %v: expected an access level, user or group, a name, a host and a depot path, got %q", lineNumber, strings.TrimSpace(text))
+		}
+		line, err := newProtectionsLine(words[0], words[1], words[2], words[3], words[4], caseInsensitive)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", lineNumber, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// Reads the protections table of a checkpoint, from db.protect
+func readProtectionsTable(checkpointPath string, caseInsensitive bool) ([]*protectionsLine, error) {
+	var records []schema.Protect
+	err := journal.ScanFile(checkpointPath, map[string]bool{"db.protect": true}, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		var entry schema.Protect
+		if err := schema.Unmarshal(record, &entry); err != nil {
+			return fmt.Errorf("line %v: %v", record.LineNumber, err)
+		}
+		records = append(records, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+
+	var lines []*protectionsLine
+	for _, record := range records {
+		level, err := decodeAccessLevel(record.Perm)
+		if err != nil {
+			return nil, fmt.Errorf("protections line %v: %v", record.Seq, err)
+		}
+		lineType := "user"
+		if record.IsGroup {
+			lineType = "group"
+		}
+		path := record.DepotFile
+		if record.MapFlag == excludeMapFlag {
+			path = "-" + path
+		}
+		line, err := newProtectionsLine(level.name, lineType, record.User, record.Host, path, caseInsensitive)
+		if err != nil {
+			return nil, fmt.Errorf("protections line %v: %v", record.Seq, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// The groups of db.group, with their subgroups
+type groupMemberships struct {
+	members map[string][]string
+	// The groups a group is a subgroup of
+	parents map[string][]string
+	cache   map[string][]string
+}
+
+// Returns the groups of a user: the groups it's a member of, and the groups these are subgroups of
+func (g *groupMemberships) of(user string) []string {
+	if groups, ok := g.cache[user]; ok {
+		return groups
+	}
+	seen := make(map[string]bool)
+	pending := append([]string{}, g.members[user]...)
+	var groups []string
+	for len(pending) > 0 {
+		group := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seen[group] {
+			continue
+		}
+		seen[group] = true
+		groups = append(groups, group)
+		pending = append(pending, g.parents[group]...)
+	}
+	g.cache[user] = groups
+	return groups
+}
+
+// The types of the records of db.group, see https://www.perforce.com/perforce/doc.current/schema/#GroupType
+const (
+	groupMember   = 0
+	groupSubgroup = 1
+)
+
+// Reads the group memberships of a checkpoint, from db.group
+func readGroups(checkpointPath string, caseInsensitive bool) (*groupMemberships, error) {
+	g := &groupMemberships{members: make(map[string][]string), parents: make(map[string][]string), cache: make(map[string][]string)}
+	err := journal.ScanFile(checkpointPath, map[string]bool{"db.group": true}, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		var membership schema.Group
+		if err := schema.Unmarshal(record, &membership); err != nil {
+			return fmt.Errorf("line %v: %v", record.LineNumber, err)
+		}
+		user := membership.User
+		if caseInsensitive {
+			user = strings.ToLower(user)
+		}
+		switch membership.Type {
+		case groupMember:
+			g.members[user] = append(g.members[user], membership.Group)
+		case groupSubgroup:
+			g.parents[membership.User] = append(g.parents[membership.User], membership.Group)
+		}
+		return nil
+	})
+	return g, err
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The example checkpoint with groups and protections: the_user is in devs-core, a subgroup of devs
+const checkpointProtections = `@pv@ 7 @db.group@ @the_user@ @devs-core@ 0 0 0 0 0 43200 0 
+@pv@ 7 @db.group@ @devs-core@ @devs@ 1 0 0 0 0 43200 0 
+@pv@ 4 @db.protect@ 1 1 @devs@ @*@ 31 0 @//depot/...@ @@ 0 
+@pv@ 4 @db.protect@ 2 0 @*@ @*@ 1 1 @//depot/path2/...@ @@ 0 
+@pv@ 4 @db.protect@ 3 0 @admin@ @10.1.0.0/16@ 255 0 @//...@ @@ 0 
+`
+
+const specProtections = `# A comment
+Protections:
+	write group devs * //depot/... ## Developers
+	list user * * -//depot/path2/...
+	super user admin 10.1.0.0/16 //...
+`
+
+func writeCheckpoint(t *testing.T, lines string) string {
+	t.Helper()
+	example, err := os.ReadFile("../perforceutils/testdata/example_journal.txt")
+	if err != nil {
+		t.Fatalf("ReadFile() returned %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	if err := os.WriteFile(path, append(example, lines...), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+	return path
+}
+
+func TestCheck(t *testing.T) {
+	checkpoint := writeCheckpoint(t, checkpointProtections)
+	lines, err := readProtectionsTable(checkpoint, false)
+	if err != nil {
+		t.Fatalf("readProtectionsTable() returned %v", err)
+	}
+	specLines, err := readProtectionsSpec(strings.NewReader(specProtections), false)
+	if err != nil {
+		t.Fatalf("readProtectionsSpec() returned %v", err)
+	}
+	var texts, specTexts []string
+	for i := range lines {
+		texts = append(texts, lines[i].text)
+	}
+	for i := range specLines {
+		specTexts = append(specTexts, specLines[i].text)
+	}
+	if !reflect.DeepEqual(texts, specTexts) {
+		t.Errorf("readProtectionsTable() = %q, readProtectionsSpec() = %q, want the same lines", texts, specTexts)
+	}
+
+	p := &protections{lines: lines}
+	if p.groups, err = readGroups(checkpoint, false); err != nil {
+		t.Fatalf("readGroups() returned %v", err)
+	}
+	tests := []struct {
+		user      string
+		host      string
+		depotFile string
+		access    string
+		want      bool
+		wantLine  string
+	}{
+		{"the_user", "10.2.0.1", "//depot/path1/data1.dat", "write", true, "write group devs * //depot/..."},
+		{"the_user", "10.2.0.1", "//depot/path2/More.txt", "list", false, "list user * * -//depot/path2/..."},
+		{"the_user", "10.2.0.1", "//depot/path1/data1.dat", "admin", false, ""},
+		{"admin", "10.1.2.3", "//depot/path2/More.txt", "super", true, "super user admin 10.1.0.0/16 //..."},
+		{"admin", "10.2.0.1", "//depot/path2/More.txt", "read", false, "list user * * -//depot/path2/..."},
+		{"other", "10.2.0.1", "//depot/path1/data1.dat", "=read", false, ""},
+	}
+	for _, test := range tests {
+		level, err := parseAccessLevel(test.access)
+		if err != nil {
+			t.Fatalf("parseAccessLevel(%v) returned %v", test.access, err)
+		}
+		got, line := p.check(test.user, test.host, test.depotFile, level)
+		gotLine := ""
+		if line != nil {
+			gotLine = line.text
+		}
+		if got != test.want || gotLine != test.wantLine {
+			t.Errorf("check(%v, %v, %v, %v) = %v, %q, want %v, %q", test.user, test.host, test.depotFile, test.access,
+				got, gotLine, test.want, test.wantLine)
+		}
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"*", "10.1.2.3", true},
+		{"10.1.*", "10.1.2.3", true},
+		{"10.1.*", "10.2.2.3", false},
+		{"10.1.0.0/16", "10.1.2.3", true},
+		{"10.1.0.0/16", "proxy-10.1.2.3", false},
+		{"proxy-10.1.0.0/16", "proxy-10.1.2.3", true},
+		{"proxy-*", "10.1.2.3", false},
+	}
+	for _, test := range tests {
+		if got := matchHost(test.pattern, test.host); got != test.want {
+			t.Errorf("matchHost(%q, %q) = %v, want %v", test.pattern, test.host, got, test.want)
+		}
+	}
+}
+
+func TestReadProtectionsSpecErrors(t *testing.T) {
+	for _, spec := range []string{
+		"Protections:\n\twrite group devs //depot/...\n",
+		"Protections:\n\tdelete group devs * //depot/...\n",
+		"Protections:\n\twrite team devs * //depot/...\n",
+	} {
+		if _, err := readProtectionsSpec(strings.NewReader(spec), false); err == nil {
+			t.Errorf("readProtectionsSpec(%q) succeeded, want an error", spec)
+		}
+	}
+}
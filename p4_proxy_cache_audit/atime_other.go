@@ -0,0 +1,29 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Access times aren't available on this platform, the modification time is used instead
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
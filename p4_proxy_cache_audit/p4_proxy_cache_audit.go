@@ -0,0 +1,345 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_proxy_cache_audit scans the cache directory of a Helix Proxy (P4P), matches the
+// cached archive files against the db.storage table of the server, and reports orphaned and stale
+// cache entries. It can also write a cleanup script removing them.
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/karrick/godirwalk"
+)
+
+// Cache entry statuses
+const (
+	CurrentEntry = "current"
+	// The server has no db.storage record for the entry (obliterated or purged revision)
+	OrphanedEntry = "orphaned"
+	// The entry hasn't been accessed for longer than -max-age days
+	StaleEntry = "stale"
+	// An uncompressed entry whose size differs from db.storage, for example a partial transfer
+	SizeMismatchEntry = "size-mismatch"
+)
+
+// A file in the proxy cache. RCS files hold several revisions.
+type cacheEntry struct {
+	path       string
+	lbrFile    string
+	lbrRevs    []string
+	size       int64
+	compressed bool
+	lastAccess time.Time
+	status     string
+}
+
+// The size of each archive known to the server, keyed by librarian file and revision
+type storageIndex map[string]int64
+
+func storageKey(lbrFile string, lbrRev string) string {
+	return lbrFile + "\x00" + lbrRev
+}
+
+// Loads db.storage from a checkpoint or journal, or from the CSV produced by p4_storage_to_csv
+func loadStorage(path string) (storageIndex, error) {
+	if strings.HasSuffix(path, ".csv") {
+		return loadStorageCSV(path)
+	}
+	storage := make(storageIndex)
+	err := journal.ScanFile(path, map[string]bool{"db.storage": true}, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		storageRecord, err := archive.ParseStorageRecord(record.Fields)
+		if err != nil {
+			slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		storage[storageKey(storageRecord.LbrFile, storageRecord.LbrRev)] = storageRecord.Size
+		return nil
+	})
+	return storage, err
+}
+
+func loadStorageCSV(path string) (storageIndex, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(bufio.NewReader(file))
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading csv header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"LibrarianFile", "LibrarianRevision", "FileSize"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %v, expected the output of p4_storage_to_csv", name)
+		}
+	}
+
+	storage := make(storageIndex)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading csv: %v", err)
+		}
+		size, _ := strconv.ParseInt(row[columns["FileSize"]], 10, 64)
+		storage[storageKey(row[columns["LibrarianFile"]], strings.Trim(row[columns["LibrarianRevision"]], "@"))] = size
+	}
+	return storage, nil
+}
+
+// Maps a cache file to the librarian file and revisions it holds.
+// The cache mirrors the depot layout: <lbrFile>,d/<lbrRev>[.gz] and <lbrFile>,v RCS files.
+func parseCachePath(cacheRoot string, osPathname string) (*cacheEntry, error) {
+	relativePath, err := filepath.Rel(cacheRoot, osPathname)
+	if err != nil {
+		return nil, err
+	}
+	depotPath := "//" + filepath.ToSlash(relativePath)
+	entry := &cacheEntry{path: osPathname}
+
+	if strings.HasSuffix(depotPath, ",v") {
+		entry.lbrFile = strings.TrimSuffix(depotPath, ",v")
+		err := archive.ReadRCSRevisions(osPathname, func(revision string) {
+			entry.lbrRevs = append(entry.lbrRevs, revision)
+		})
+		return entry, err
+	}
+
+	i := strings.LastIndex(depotPath, ",d/")
+	if i < 0 {
+		return nil, fmt.Errorf("not an archive file")
+	}
+	entry.lbrFile = depotPath[:i]
+	lbrRev := depotPath[i+3:]
+	if strings.HasSuffix(lbrRev, ".gz") {
+		entry.compressed = true
+		lbrRev = strings.TrimSuffix(lbrRev, ".gz")
+	}
+	entry.lbrRevs = []string{lbrRev}
+	return entry, nil
+}
+
+// Lists the cache files and decides the status of each of them
+func auditCache(cacheRoot string, storage storageIndex, now time.Time, maxAge time.Duration) ([]*cacheEntry, error) {
+	var entries []*cacheEntry
+	err := godirwalk.Walk(cacheRoot, &godirwalk.Options{
+		Callback: func(osPathname string, de *godirwalk.Dirent) error {
+			if de.IsDir() {
+				return nil
+			}
+			entry, err := parseCachePath(cacheRoot, osPathname)
+			if err != nil {
+				slog.Debug("Ignoring file", logging.PathKey, osPathname, logging.Err(err))
+				return nil
+			}
+			info, err := os.Stat(osPathname)
+			if err != nil {
+				slog.Warn("Could not stat", logging.PathKey, osPathname, logging.Err(err))
+				return nil
+			}
+			entry.size = info.Size()
+			entry.lastAccess = accessTime(info)
+
+			entry.status = CurrentEntry
+			known := false
+			for _, lbrRev := range entry.lbrRevs {
+				expectedSize, ok := storage[storageKey(entry.lbrFile, lbrRev)]
+				if !ok {
+					continue
+				}
+				known = true
+				// Compressed and RCS entries don't have the size of the revision
+				if !entry.compressed && len(entry.lbrRevs) == 1 && !strings.HasSuffix(osPathname, ",v") &&
+					expectedSize >= 0 && expectedSize != entry.size {
+					entry.status = SizeMismatchEntry
+				}
+			}
+			if !known {
+				entry.status = OrphanedEntry
+			} else if entry.status == CurrentEntry && maxAge > 0 && now.Sub(entry.lastAccess) > maxAge {
+				entry.status = StaleEntry
+			}
+			entries = append(entries, entry)
+			return nil
+		},
+		Unsorted: true, // we don't need sorting and this is faster
+	})
+	return entries, err
+}
+
+// Quotes a path for a POSIX shell
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// Writes a script removing the entries with the given statuses, least recently used first
+func writeCleanupScript(path string, entries []*cacheEntry, statuses map[string]bool) (int, int64, error) {
+	var selected []*cacheEntry
+	for _, entry := range entries {
+		if statuses[entry.status] {
+			selected = append(selected, entry)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].lastAccess.Before(selected[j].lastAccess) })
+
+	// A partial script would remove only some of the entries, so it's only written once complete
+	bytes := int64(0)
+	err := output.WriteFile(path, func(w io.Writer) error {
+		fmt.Fprintf(w, "#!/bin/sh\n# Generated by p4_proxy_cache_audit on %v\n", time.Now().Format(time.RFC3339))
+		for _, entry := range selected {
+			fmt.Fprintf(w, "rm -f %v # %v, last access %v\n",
+				shellQuote(entry.path), entry.status, entry.lastAccess.Format("2006-01-02"))
+			bytes += entry.size
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("error writing cleanup script: %v", err)
+	}
+	return len(selected), bytes, nil
+}
+
+func main() {
+	flags := struct {
+		maxAge        int
+		cleanupScript string
+		cleanOrphans  bool
+		cleanMismatch bool
+		all           bool
+		output        string
+		format        string
+		verbose       bool
+	}{}
+
+	flag.IntVar(&flags.maxAge, "max-age", 90, "Days since the last access after which an entry is stale (0 to disable).")
+	flag.StringVar(&flags.cleanupScript, "cleanup-script", "", "Shell script to write, removing stale entries.")
+	flag.BoolVar(&flags.cleanOrphans, "clean-orphans", true, "Include orphaned entries in the cleanup script.")
+	flag.BoolVar(&flags.cleanMismatch, "clean-size-mismatch", true, "Include entries whose size differs from db.storage in the cleanup script.")
+	flag.BoolVar(&flags.all, "all", false, "Report current entries as well.")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File, or table for the database formats, to write the cache entries to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage())
+	flag.BoolVar(&flags.verbose, "verbose", false, "Verbose output.")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(flags.verbose); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 2 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(flags.format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+
+	start := time.Now()
+
+	storage, err := loadStorage(flag.Arg(1))
+	if err != nil {
+		logging.Fatal("Error reading db.storage", logging.Err(err))
+	}
+	slog.Info("Loaded db.storage records", logging.CountKey, len(storage))
+
+	entries, err := auditCache(flag.Arg(0), storage, start, time.Duration(flags.maxAge)*24*time.Hour)
+	if err != nil {
+		logging.Fatal("Error scanning cache", logging.Err(err))
+	}
+
+	counts := make(map[string]int)
+	bytes := make(map[string]int64)
+	err = output.WriteTable(flags.format, flags.output, output.Table{Name: "proxy_cache"}, func(out output.Writer) error {
+		out.Write([]string{
+			"Path",
+			"LibrarianFile",
+			"LibrarianRevisions",
+			"Size",
+			"LastAccess",
+			"Status"})
+		for _, entry := range entries {
+			counts[entry.status]++
+			bytes[entry.status] += entry.size
+			if entry.status == CurrentEntry && !flags.all {
+				continue
+			}
+			out.Write([]string{
+				entry.path,
+				entry.lbrFile,
+				strings.Join(entry.lbrRevs, " "),
+				strconv.FormatInt(entry.size, 10),
+				entry.lastAccess.Format(time.RFC3339),
+				entry.status})
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Fatal("Error writing entries", logging.Err(err))
+	}
+
+	slog.Info("Processed files", logging.CountKey, len(entries))
+	for _, status := range []string{CurrentEntry, StaleEntry, OrphanedEntry, SizeMismatchEntry} {
+		slog.Info("Cache entries", "status", status, logging.CountKey, counts[status], logging.BytesKey, bytes[status])
+	}
+
+	if len(flags.cleanupScript) > 0 {
+		statuses := map[string]bool{StaleEntry: true, OrphanedEntry: flags.cleanOrphans, SizeMismatchEntry: flags.cleanMismatch}
+		count, total, err := writeCleanupScript(flags.cleanupScript, entries, statuses)
+		if err != nil {
+			logging.Fatal("Error writing cleanup script", logging.Err(err))
+		}
+		slog.Info("Cleanup script removes files", logging.CountKey, count, logging.BytesKey, total)
+	}
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The head of an RCS file with the two revisions of //depot/path1/README.txt
+const readmeRCS = `head	1.2;
+access;
+symbols;
+locks; strict;
+comment	@# @;
+
+
+1.2
+date	2021.01.18.22.14.00;	author p4;	state Exp;
+branches;
+next	1.1;
+
+1.1
+date	2021.01.18.22.13.58;	author p4;	state Exp;
+branches;
+next	;
+
+
+desc
+@@
+
+
+1.2
+log
+@@
+text
+@Read me
+Twice
+@
+
+
+1.1
+log
+@@
+text
+@d2 1
+@
+`
+
+func TestParseCachePath(t *testing.T) {
+	tests := []struct {
+		path       string
+		lbrFile    string
+		lbrRev     string
+		compressed bool
+	}{
+		{"/cache/depot/path1/data1.dat,d/1.1.gz", "//depot/path1/data1.dat", "1.1", true},
+		{"/cache/depot/path1/data1.dat,d/1.2", "//depot/path1/data1.dat", "1.2", false},
+		{"/cache/depot/dir,d/file,d/1.3", "//depot/dir,d/file", "1.3", false},
+	}
+	for _, test := range tests {
+		entry, err := parseCachePath("/cache", test.path)
+		if err != nil {
+			t.Fatalf("parseCachePath(%q) returned %v", test.path, err)
+		}
+		if entry.lbrFile != test.lbrFile || !reflect.DeepEqual(entry.lbrRevs, []string{test.lbrRev}) || entry.compressed != test.compressed {
+			t.Errorf("parseCachePath(%q) = %v, %v, %v, want %v, %v, %v", test.path, entry.lbrFile, entry.lbrRevs, entry.compressed,
+				test.lbrFile, test.lbrRev, test.compressed)
+		}
+	}
+	if _, err := parseCachePath("/cache", "/cache/depot/notes.txt"); err == nil {
+		t.Errorf("parseCachePath() of a file outside of the archives succeeded, want an error")
+	}
+}
+
+func TestLoadStorageCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.csv")
+	extraction := "LibrarianFile,LibrarianRevision,FileSize\n//depot/path1/data1.dat,@1.1@,10485760\n"
+	if err := os.WriteFile(path, []byte(extraction), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+	storage, err := loadStorage(path)
+	if err != nil {
+		t.Fatalf("loadStorage() returned %v", err)
+	}
+	want := storageIndex{storageKey("//depot/path1/data1.dat", "1.1"): 10485760}
+	if !reflect.DeepEqual(storage, want) {
+		t.Errorf("loadStorage() = %q, want %q", storage, want)
+	}
+}
+
+func TestAuditCache(t *testing.T) {
+	storage, err := loadStorage("../perforceutils/testdata/example_journal.txt")
+	if err != nil {
+		t.Fatalf("loadStorage() returned %v", err)
+	}
+	if len(storage) != 6 {
+		t.Errorf("loadStorage() returned %v archives, want 6", len(storage))
+	}
+
+	now := time.Now()
+	cacheRoot := t.TempDir()
+	files := []struct {
+		name       string
+		content    string
+		lastAccess time.Time
+	}{
+		{"depot/path1/data1.dat,d/1.1.gz", "compressed", now.Add(-60 * 24 * time.Hour)},
+		{"depot/path1/data1.dat,d/1.2", "partial", now},
+		{"depot/path1/data2.dat,d/1.1.gz", "compressed", now},
+		{"depot/path1/README.txt,v", readmeRCS, now},
+		{"depot/path3/gone.dat,d/1.1", "gone", now.Add(-24 * time.Hour)},
+		{"depot/notes.txt", "notes", now},
+	}
+	for _, file := range files {
+		path := filepath.Join(cacheRoot, filepath.FromSlash(file.name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("MkdirAll() returned %v", err)
+		}
+		if err := os.WriteFile(path, []byte(file.content), 0o644); err != nil {
+			t.Fatalf("WriteFile() returned %v", err)
+		}
+		if err := os.Chtimes(path, file.lastAccess, file.lastAccess); err != nil {
+			t.Fatalf("Chtimes() returned %v", err)
+		}
+	}
+
+	entries, err := auditCache(cacheRoot, storage, now, 30*24*time.Hour)
+	if err != nil {
+		t.Fatalf("auditCache() returned %v", err)
+	}
+	got := make(map[string]string)
+	for _, entry := range entries {
+		relativePath, _ := filepath.Rel(cacheRoot, entry.path)
+		got[filepath.ToSlash(relativePath)] = entry.status
+	}
+	want := map[string]string{
+		"depot/path1/data1.dat,d/1.1.gz": StaleEntry,
+		"depot/path1/data1.dat,d/1.2":    SizeMismatchEntry,
+		"depot/path1/data2.dat,d/1.1.gz": CurrentEntry,
+		"depot/path1/README.txt,v":       CurrentEntry,
+		"depot/path3/gone.dat,d/1.1":     OrphanedEntry,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("auditCache() = %v, want %v", got, want)
+	}
+
+	script := filepath.Join(t.TempDir(), "cleanup.sh")
+	count, bytes, err := writeCleanupScript(script, entries, map[string]bool{StaleEntry: true, OrphanedEntry: true})
+	if err != nil {
+		t.Fatalf("writeCleanupScript() returned %v", err)
+	}
+	if count != 2 || bytes != int64(len("compressed")+len("gone")) {
+		t.Errorf("writeCleanupScript() = %v, %v, want 2, %v", count, bytes, len("compressed")+len("gone"))
+	}
+	content, err := os.ReadFile(script)
+	if err != nil {
+		t.Fatalf("ReadFile() returned %v", err)
+	}
+	// Least recently used first
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	wantLines := []string{
+		"rm -f " + shellQuote(filepath.Join(cacheRoot, "depot/path1/data1.dat,d/1.1.gz")) + " # stale, last access " +
+			now.Add(-60*24*time.Hour).Format("2006-01-02"),
+		"rm -f " + shellQuote(filepath.Join(cacheRoot, "depot/path3/gone.dat,d/1.1")) + " # orphaned, last access " +
+			now.Add(-24*time.Hour).Format("2006-01-02"),
+	}
+	if len(lines) != 4 || !reflect.DeepEqual(lines[2:], wantLines) {
+		t.Errorf("writeCleanupScript() wrote %q, want the header and %q", lines, wantLines)
+	}
+}
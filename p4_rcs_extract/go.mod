@@ -0,0 +1,5 @@
+module github.com/google/perforce-utils/p4_rcs_extract
+
+go 1.21
+
+require github.com/google/perforce-utils/perforceutils v0.0.0
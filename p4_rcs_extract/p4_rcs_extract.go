@@ -0,0 +1,143 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_rcs_extract extracts the content of revisions from the RCS ,v archives Helix Core
+// stores text files in, without p4d. It's meant for emergency recovery and to check digests.
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/rcs"
+)
+
+// Lists the revisions of an RCS file, with their size and digest
+func listRevisions(out output.Writer, file *rcs.File) error {
+	out.Write([]string{"Revision", "Date", "Author", "State", "Size", "Digest"})
+	for _, revision := range file.Revisions() {
+		content, err := file.Content(revision.Number)
+		if err != nil {
+			return err
+		}
+		date := revision.Date
+		if parsed, err := revision.Time(); err == nil {
+			date = parsed.Format(time.RFC3339)
+		}
+		out.Write([]string{
+			revision.Number,
+			date,
+			revision.Author,
+			revision.State,
+			strconv.Itoa(len(content)),
+			digest(content)})
+	}
+	return nil
+}
+
+// Returns the MD5 digest of a content, as recorded in db.storage and db.rev
+func digest(content []byte) string {
+	sum := md5.Sum(content)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func main() {
+	flags := struct {
+		list    bool
+		digest  bool
+		output  string
+		format  string
+		verbose bool
+	}{}
+
+	flag.BoolVar(&flags.list, "list", false, "List the revisions of the file as a table instead of extracting one.")
+	flag.BoolVar(&flags.digest, "digest", false, "Print the MD5 digest of the revision instead of its content.")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File to write the content of the revision or the list to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.output, "o", output.Stdout, "Same as -output.")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage()+" For -list, whose -output can be a table for the database formats.")
+	flag.BoolVar(&flags.verbose, "verbose", false, "Verbose output.")
+	logging.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(flags.verbose); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(flags.format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+
+	file, err := rcs.ReadFile(flag.Arg(0))
+	if err != nil {
+		logging.Fatal("Error reading RCS file", logging.PathKey, flag.Arg(0), logging.Err(err))
+	}
+	slog.Debug("Read RCS file", logging.PathKey, flag.Arg(0), "head", file.Head, logging.CountKey, len(file.Revisions()))
+
+	if flags.list {
+		err := output.WriteTable(flags.format, flags.output, output.Table{Name: "rcs_revisions"}, func(out output.Writer) error {
+			return listRevisions(out, file)
+		})
+		if err != nil {
+			logging.Fatal("Error listing revisions", logging.PathKey, flag.Arg(0), logging.Err(err))
+		}
+		return
+	}
+
+	revision := file.Head
+	if flag.NArg() > 1 {
+		revision = flag.Arg(1)
+	}
+	content, err := file.Content(revision)
+	if err != nil {
+		logging.Fatal("Error extracting revision", logging.PathKey, flag.Arg(0), logging.RevisionKey, revision, logging.Err(err))
+	}
+
+	if flags.digest {
+		fmt.Println(digest(content))
+		return
+	}
+	err = output.WriteFile(flags.output, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+	if err != nil {
+		logging.Fatal("Error writing revision", logging.PathKey, flags.output, logging.Err(err))
+	}
+	if flags.output != output.Stdout {
+		slog.Info("Extracted revision", logging.RevisionKey, revision, logging.PathKey, flags.output, logging.BytesKey, len(content))
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/perforce-utils/perforceutils/rcs"
+)
+
+// Keeps the rows written, in place of a file
+type rowsWriter struct{ rows [][]string }
+
+func (w *rowsWriter) Write(row []string) error { w.rows = append(w.rows, row); return nil }
+func (w *rowsWriter) Commit() error            { return nil }
+func (w *rowsWriter) Close() error             { return nil }
+
+// The two revisions of //depot/path1/README.txt, 1.1 by another author
+const readmeRCS = `head	1.2;
+access;
+symbols;
+locks; strict;
+comment	@# @;
+
+
+1.2
+date	2021.01.18.22.14.00;	author p4;	state Exp;
+branches;
+next	1.1;
+
+1.1
+date	2021.01.18.22.13.58;	author joe;	state Exp;
+branches;
+next	;
+
+
+desc
+@@
+
+
+1.2
+log
+@@
+text
+@Read me
+Twice
+@
+
+
+1.1
+log
+@@
+text
+@d2 1
+@
+`
+
+func TestListRevisions(t *testing.T) {
+	file, err := rcs.Parse([]byte(readmeRCS))
+	if err != nil {
+		t.Fatalf("Parse() returned %v", err)
+	}
+	out := &rowsWriter{}
+	if err := listRevisions(out, file); err != nil {
+		t.Fatalf("listRevisions() returned %v", err)
+	}
+	want := [][]string{
+		{"Revision", "Date", "Author", "State", "Size", "Digest"},
+		{"1.2", "2021-01-18T22:14:00Z", "p4", "Exp", "14", digest([]byte("Read me\nTwice\n"))},
+		{"1.1", "2021-01-18T22:13:58Z", "joe", "Exp", "8", digest([]byte("Read me\n"))},
+	}
+	if !reflect.DeepEqual(out.rows, want) {
+		t.Errorf("listRevisions() wrote %q, want %q", out.rows, want)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	if got, want := digest([]byte("hello")), "5D41402ABC4B2A76B9719D911017C592"; got != want {
+		t.Errorf("digest() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_refcount_check cross-checks the reference counts of db.storage and db.storagesh
+// against the revisions of db.rev and db.revsh sharing each archive, and reports the archives whose
+// count is too low or too high.
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/problems"
+)
+
+const (
+	// Fewer revisions reference the archive than db.storage counts: it may be deleted while
+	// revisions still use it
+	underCounted = "under-counted"
+	// More revisions reference the archive than db.storage counts: it won't be deleted once no
+	// revision uses it anymore
+	overCounted = "over-counted"
+)
+
+// The reference count of an archive in a storage table
+type storageCount struct {
+	lbrType  int
+	refCount int
+}
+
+// An archive, with its storage records and the revisions referencing it
+type archiveRefs struct {
+	// The db.storage and db.storagesh records, nil when the table has none
+	storage, shelvedStorage *storageCount
+	// The revisions of db.rev and db.revsh referencing the archive
+	references, shelvedReferences int
+}
+
+// The tables whose revisions hold references to the archives. db.revdx and db.revhx duplicate
+// records of db.rev, so they aren't counted.
+var referencingTables = map[string]bool{"db.rev": true, "db.revsh": true}
+
+// Reads the storage records of a checkpoint, and counts the revisions referencing each archive.
+// Returns the archives keyed by librarian file and revision, and the number of records of each table.
+func readArchives(checkpointPath string) (map[string]*archiveRefs, map[string]int, error) {
+	// All the tables go into the same map, so that they can come in any order
+	archives := make(map[string]*archiveRefs)
+	lookup := func(lbrFile string, lbrRev string) *archiveRefs {
+		key := lbrFile + "\x00" + lbrRev
+		refs, ok := archives[key]
+		if !ok {
+			refs = &archiveRefs{}
+			archives[key] = refs
+		}
+		return refs
+	}
+	records := make(map[string]int)
+	tables := map[string]bool{"db.storage": true, "db.storagesh": true}
+	for table := range referencingTables {
+		tables[table] = true
+	}
+	err := journal.ScanFile(checkpointPath, tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		records[record.Table]++
+		if record.Table == "db.storage" || record.Table == "db.storagesh" {
+			storage, err := archive.ParseStorageRecord(record.Fields)
+			if err != nil {
+				slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			refs := lookup(storage.LbrFile, storage.LbrRev)
+			count := &storageCount{lbrType: storage.LbrType, refCount: storage.RefCount}
+			if record.Table == "db.storage" {
+				refs.storage = count
+			} else {
+				refs.shelvedStorage = count
+			}
+			return nil
+		}
+		rev, err := archive.ParseRevRecord(record.Fields)
+		if err != nil {
+			slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		// Deleted, purged and archived revisions have no archive to reference
+		if !rev.Action.HasArchive() {
+			return nil
+		}
+		refs := lookup(rev.LbrFile, rev.LbrRev)
+		if record.Table == "db.revsh" {
+			refs.shelvedReferences++
+		} else {
+			refs.references++
+		}
+		return nil
+	})
+	return archives, records, err
+}
+
+// Adds the archives whose reference count differs from the revisions referencing them to the
+// report. Servers with db.storagesh count the shelved revisions there, older ones in db.storage.
+// Returns the number of storage records checked, of archives referenced without one, and of
+// problems by kind.
+func checkArchives(archives map[string]*archiveRefs, shelvedSeparately bool, report *problems.Report) (int, int, map[string]int) {
+	counts := make(map[string]int)
+	checked, unstored := 0, 0
+	for key, refs := range archives {
+		lbrFile, lbrRev, _ := strings.Cut(key, "\x00")
+		check := func(table string, storage *storageCount, references int) {
+			if storage == nil {
+				// The revisions reference an archive the storage table doesn't count at all
+				if references > 0 {
+					unstored++
+				}
+				return
+			}
+			checked++
+			kind := ""
+			switch {
+			case storage.refCount < references:
+				kind = underCounted
+			case storage.refCount > references:
+				kind = overCounted
+			default:
+				return
+			}
+			counts[kind]++
+			report.Add(lbrFile, lbrRev, table, strconv.Itoa(storage.lbrType), strconv.Itoa(storage.refCount), strconv.Itoa(references), kind)
+		}
+		if shelvedSeparately {
+			check("db.storage", refs.storage, refs.references)
+			check("db.storagesh", refs.shelvedStorage, refs.shelvedReferences)
+		} else {
+			check("db.storage", refs.storage, refs.references+refs.shelvedReferences)
+		}
+	}
+	return checked, unstored, counts
+}
+
+func main() {
+	var options problems.Options
+	options.RegisterFlags(flag.CommandLine)
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(options.Verbose); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(options.Format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+
+	start := time.Now()
+	archives, records, err := readArchives(flag.Arg(0))
+	if err != nil {
+		logging.Fatal("Error reading checkpoint", logging.PathKey, flag.Arg(0), logging.Err(err))
+	}
+	if records["db.storage"] == 0 {
+		logging.Fatal("The checkpoint has no db.storage records, as for servers before 2019.1")
+	}
+
+	shelvedSeparately := records["db.storagesh"] > 0
+	report := problems.NewReport(options, output.Table{Name: "refcount"}, []string{"LibrarianFile", "LibrarianRevision", "Table", "LibrarianType", "RefCount", "References", "Problem"})
+	checked, unstored, counts := checkArchives(archives, shelvedSeparately, report)
+	if err := report.Write("Inconsistent reference count"); err != nil {
+		logging.Fatal("Error writing problems", logging.Err(err))
+	}
+
+	slog.Info("Checked storage records", logging.CountKey, checked, "storage_records", records["db.storage"],
+		"storagesh_records", records["db.storagesh"], "rev_records", records["db.rev"], "revsh_records", records["db.revsh"])
+	if unstored > 0 {
+		slog.Warn("Referenced archives without a storage record", logging.CountKey, unstored)
+	}
+	for _, kind := range []string{underCounted, overCounted} {
+		if counts[kind] > 0 {
+			slog.Warn("Inconsistent reference counts", "problem", kind, logging.CountKey, counts[kind])
+		}
+	}
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+
+	if report.Total() > 0 {
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/problems"
+)
+
+// A lazy copy of data1.dat#1 that db.storage doesn't count, a shelved revision of README.txt#2
+// counted in db.storage as by servers without db.storagesh, an archive no revision references
+// and a revision without storage record
+const refcountRecords = `@pv@ 9 @db.rev@ @//depot/path3/copy.dat@ 1 65539 3 4 1611008048 1611008037 F1C9645DBC14EFDDC7D8A322685F26EB 10485760 0 1 @//depot/path1/data1.dat@ @1.1@ 65539 
+@pv@ 9 @db.revsh@ @//depot/path1/README.txt@ 3 0 1 5 1611008048 1611008038 E58A41657AB37F063690AD6A2FB1B3B6 15 0 1 @//depot/path1/README.txt@ @1.2@ 0 
+@pv@ 1 @db.storage@ @//depot/path1/README.txt@ @1.2@ 0 2 E58A41657AB37F063690AD6A2FB1B3B6 15 348 00000000000000000000000000000000 1611008040 
+@pv@ 1 @db.storage@ @//depot/path4/gone.dat@ @1.1@ 65539 1 F1C9645DBC14EFDDC7D8A322685F26EB 10485760 10221 00000000000000000000000000000000 1611008038 
+@pv@ 9 @db.rev@ @//depot/path5/new.txt@ 1 0 0 6 1611008048 1611008047 E58A41657AB37F063690AD6A2FB1B3B6 15 0 0 @//depot/path5/new.txt@ @1.1@ 0 
+`
+
+func TestCheckArchives(t *testing.T) {
+	example, err := os.ReadFile("../perforceutils/testdata/example_journal.txt")
+	if err != nil {
+		t.Fatalf("ReadFile() returned %v", err)
+	}
+	dir := t.TempDir()
+	checkpoint := filepath.Join(dir, "checkpoint")
+	if err := os.WriteFile(checkpoint, append(example, refcountRecords...), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+
+	archives, records, err := readArchives(checkpoint)
+	if err != nil {
+		t.Fatalf("readArchives() returned %v", err)
+	}
+	wantRecords := map[string]int{"db.rev": 8, "db.revsh": 1, "db.storage": 8}
+	if !reflect.DeepEqual(records, wantRecords) {
+		t.Errorf("readArchives() records = %v, want %v", records, wantRecords)
+	}
+
+	path := filepath.Join(dir, "problems.csv")
+	header := []string{"LibrarianFile", "LibrarianRevision", "Table", "LibrarianType", "RefCount", "References", "Problem"}
+	report := problems.NewReport(problems.Options{Output: path, Format: "csv"}, output.Table{Name: "refcount"}, header)
+	checked, unstored, counts := checkArchives(archives, false, report)
+	if checked != 7 || unstored != 1 {
+		t.Errorf("checkArchives() = %v, %v, want 7, 1", checked, unstored)
+	}
+	wantCounts := map[string]int{underCounted: 1, overCounted: 1}
+	if !reflect.DeepEqual(counts, wantCounts) {
+		t.Errorf("checkArchives() counts = %v, want %v", counts, wantCounts)
+	}
+	if err := report.Write("Inconsistent reference count"); err != nil {
+		t.Fatalf("Write() returned %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() returned %v", err)
+	}
+	want := "LibrarianFile,LibrarianRevision,Table,LibrarianType,RefCount,References,Problem\n" +
+		"//depot/path1/data1.dat,1.1,db.storage,65539,1,2,under-counted\n" +
+		"//depot/path4/gone.dat,1.1,db.storage,65539,1,0,over-counted\n"
+	if string(got) != want {
+		t.Errorf("Write() wrote %q, want %q", got, want)
+	}
+
+	// Servers with db.storagesh count the shelved revision there instead
+	report = problems.NewReport(problems.Options{Output: path, Format: "csv"}, output.Table{Name: "refcount"}, header)
+	if _, _, counts := checkArchives(archives, true, report); counts[overCounted] != 2 {
+		t.Errorf("checkArchives() with db.storagesh counts = %v, want 2 over-counted archives", counts)
+	}
+}
@@ -0,0 +1,365 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_retention_sim simulates retention rules against a checkpoint: it computes how much
+// archive space would be reclaimed and prints the p4 commands that would apply the rules.
+// It never connects to the server.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// A retention rule. Revisions matching the path are candidates when they are not among the
+// keepLast most recent revisions of their file and are older than maxAge. Unset limits don't apply.
+type retentionRule struct {
+	text     string
+	path     string
+	keepLast int
+	maxAge   time.Duration
+
+	candidateCount int
+	reclaimedCount int
+	reclaimedBytes int64
+}
+
+// Parses rules like "//builds/... keep=5" or "//depot/tmp/... max-age=90"
+func parseRetentionRule(text string) (*retentionRule, error) {
+	parts := strings.Fields(text)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "//") {
+		return nil, fmt.Errorf("expected a depot path followed by keep=N and/or max-age=DAYS, got %q", text)
+	}
+	rule := &retentionRule{text: text, path: parts[0]}
+	for _, part := range parts[1:] {
+		keyValue := strings.SplitN(part, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("invalid limit %q in rule %q", part, text)
+		}
+		value, err := strconv.Atoi(keyValue[1])
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid value %q in rule %q", keyValue[1], text)
+		}
+		switch keyValue[0] {
+		case "keep":
+			rule.keepLast = value
+		case "max-age":
+			rule.maxAge = time.Duration(value) * 24 * time.Hour
+		default:
+			return nil, fmt.Errorf("unknown limit %q in rule %q", keyValue[0], text)
+		}
+	}
+	return rule, nil
+}
+
+// Supports exact paths and paths ending with the "..." wildcard
+func (r *retentionRule) matches(depotFile string) bool {
+	if strings.HasSuffix(r.path, "...") {
+		return strings.HasPrefix(depotFile, strings.TrimSuffix(r.path, "..."))
+	}
+	return depotFile == r.path
+}
+
+type revision struct {
+	number int
+	date   int64
+	lbrKey string
+}
+
+// The revisions of a depot file that still have an archive
+type depotFile struct {
+	name      string
+	revisions []revision
+}
+
+type archiveFile struct {
+	size       int64
+	references int
+	candidates int
+}
+
+// Loads the revisions of the files matching any rule, and the archives they reference
+func loadRevisions(journalPath string, rules []*retentionRule) (map[string]*depotFile, map[string]*archiveFile, error) {
+	files := make(map[string]*depotFile)
+	archives := make(map[string]*archiveFile)
+	getArchive := func(key string) *archiveFile {
+		a, ok := archives[key]
+		if !ok {
+			a = &archiveFile{size: -1}
+			archives[key] = a
+		}
+		return a
+	}
+
+	tables := map[string]bool{"db.rev": true, "db.storage": true}
+	err := journal.ScanFile(journalPath, tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		fields := record.Fields
+		if record.Table == "db.storage" {
+			if len(fields) < archive.DbStorageFieldCount {
+				return nil
+			}
+			size, err := strconv.ParseInt(fields[archive.DbStorageFieldServerSize], 10, 64)
+			if err != nil {
+				slog.Warn("Could not parse server size", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					"server_size", fields[archive.DbStorageFieldServerSize], logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			getArchive(fields[archive.DbStorageFieldLbrFile] + "\x00" + fields[archive.DbStorageFieldLbrRev]).size = size
+			return nil
+		}
+
+		if len(fields) < archive.DbRevFieldCount {
+			return nil
+		}
+		action, _ := strconv.Atoi(fields[archive.DbRevFieldAction])
+		if !archive.FileAction(action).HasArchive() {
+			return nil
+		}
+
+		lbrKey := fields[archive.DbRevFieldLbrFile] + "\x00" + fields[archive.DbRevFieldLbrRev]
+		// Archives are shared by lazy copies, so all references count, including from files no rule matches
+		getArchive(lbrKey).references++
+
+		name := fields[archive.DbRevFieldDepotFile]
+		matched := false
+		for _, rule := range rules {
+			if rule.matches(name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil
+		}
+
+		number, err := strconv.Atoi(fields[archive.DbRevFieldDepotRev])
+		if err != nil {
+			slog.Warn("Could not parse revision", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.RevisionKey, fields[archive.DbRevFieldDepotRev], logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		date, err := strconv.ParseInt(fields[archive.DbRevFieldDate], 10, 64)
+		if err != nil {
+			slog.Warn("Could not parse date", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				"date", fields[archive.DbRevFieldDate], logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		file, ok := files[name]
+		if !ok {
+			file = &depotFile{name: name}
+			files[name] = file
+		}
+		file.revisions = append(file.revisions, revision{number: number, date: date, lbrKey: lbrKey})
+		return nil
+	})
+	return files, archives, err
+}
+
+// Returns the revisions of the file that the first matching rule would remove.
+// The head revision is always kept.
+func selectCandidates(file *depotFile, rules []*retentionRule, now time.Time) (*retentionRule, []revision) {
+	var rule *retentionRule
+	for _, r := range rules {
+		if r.matches(file.name) {
+			rule = r
+			break
+		}
+	}
+	if rule == nil {
+		return nil, nil
+	}
+
+	// Most recent revisions first
+	sort.Slice(file.revisions, func(i, j int) bool { return file.revisions[i].number > file.revisions[j].number })
+
+	var candidates []revision
+	for i, rev := range file.revisions {
+		if i == 0 || (rule.keepLast > 0 && i < rule.keepLast) {
+			continue
+		}
+		if rule.maxAge > 0 && now.Sub(time.Unix(rev.date, 0)) <= rule.maxAge {
+			continue
+		}
+		candidates = append(candidates, rev)
+	}
+	return rule, candidates
+}
+
+// Formats revisions as Perforce revision ranges, for example //depot/file#1,3 and //depot/file#5,5
+func revisionRanges(name string, candidates []revision) []string {
+	numbers := make([]int, len(candidates))
+	for i, rev := range candidates {
+		numbers[i] = rev.number
+	}
+	sort.Ints(numbers)
+
+	var ranges []string
+	for i := 0; i < len(numbers); {
+		j := i
+		for j+1 < len(numbers) && numbers[j+1] == numbers[j]+1 {
+			j++
+		}
+		ranges = append(ranges, fmt.Sprintf("%v#%v,%v", name, numbers[i], numbers[j]))
+		i = j + 1
+	}
+	return ranges
+}
+
+// Quotes a file revision specification for a POSIX shell
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+type ruleList []string
+
+func (r *ruleList) String() string {
+	return strings.Join(*r, "; ")
+}
+
+func (r *ruleList) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
+
+func main() {
+	flags := struct {
+		rules        ruleList
+		mode         string
+		archiveDepot string
+		asOf         string
+		output       string
+	}{}
+
+	flag.Var(&flags.rules, "rule", "Retention rule such as \"//builds/... keep=5\" or \"//tmp/... max-age=90\" (repeatable, first match wins).")
+	flag.StringVar(&flags.mode, "mode", "obliterate", "Commands to emit: obliterate or archive.")
+	flag.StringVar(&flags.archiveDepot, "archive-depot", "archive", "Archive depot used by -mode=archive.")
+	flag.StringVar(&flags.asOf, "as-of", "", "Date (YYYY-MM-DD) the rules are evaluated at, today by default.")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File to write the commands to, replaced only once complete (the standard output by default).")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(false); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 || len(flags.rules) == 0 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if flags.mode != "obliterate" && flags.mode != "archive" {
+		logging.Fatal("Unknown mode, expected obliterate or archive", "mode", flags.mode)
+	}
+
+	var rules []*retentionRule
+	for _, text := range flags.rules {
+		rule, err := parseRetentionRule(text)
+		if err != nil {
+			logging.Fatal("Invalid -rule", logging.Err(err))
+		}
+		rules = append(rules, rule)
+	}
+
+	start := time.Now()
+	now := start
+	if len(flags.asOf) > 0 {
+		var err error
+		if now, err = time.Parse("2006-01-02", flags.asOf); err != nil {
+			logging.Fatal("Invalid -as-of date", logging.Err(err))
+		}
+	}
+
+	files, archives, err := loadRevisions(flag.Arg(0), rules)
+	if err != nil {
+		logging.Fatal("Error processing journal", logging.Err(err))
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Running part of the commands would leave the retention half applied, so they're only written
+	// once complete
+	candidatesByRule := make(map[*retentionRule][]revision)
+	err = output.WriteFile(flags.output, func(w io.Writer) error {
+		for _, name := range names {
+			rule, candidates := selectCandidates(files[name], rules, now)
+			if len(candidates) == 0 {
+				continue
+			}
+			for _, rev := range candidates {
+				archives[rev.lbrKey].candidates++
+			}
+			candidatesByRule[rule] = append(candidatesByRule[rule], candidates...)
+			for _, fileRange := range revisionRanges(name, candidates) {
+				if flags.mode == "archive" {
+					fmt.Fprintf(w, "p4 archive -D %v %v\n", flags.archiveDepot, shellQuote(fileRange))
+				} else {
+					fmt.Fprintf(w, "p4 obliterate -y %v\n", shellQuote(fileRange))
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Fatal("Error writing commands", logging.Err(err))
+	}
+
+	// An archive is only reclaimed when every revision referencing it is removed
+	reclaimed := make(map[string]bool)
+	for _, rule := range rules {
+		for _, rev := range candidatesByRule[rule] {
+			rule.candidateCount++
+			a := archives[rev.lbrKey]
+			if a.candidates < a.references || reclaimed[rev.lbrKey] {
+				continue
+			}
+			reclaimed[rev.lbrKey] = true
+			rule.reclaimedCount++
+			if a.size > 0 {
+				rule.reclaimedBytes += a.size
+			}
+		}
+		slog.Info("Rule", "rule", rule.text, "revisions", rule.candidateCount, "archives", rule.reclaimedCount,
+			logging.BytesKey, rule.reclaimedBytes)
+	}
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionRule(t *testing.T) {
+	tests := []struct {
+		text     string
+		path     string
+		keepLast int
+		maxAge   time.Duration
+	}{
+		{"//builds/... keep=5", "//builds/...", 5, 0},
+		{"//depot/tmp/... max-age=90", "//depot/tmp/...", 0, 90 * 24 * time.Hour},
+		{"//depot/file keep=2 max-age=1", "//depot/file", 2, 24 * time.Hour},
+	}
+	for _, test := range tests {
+		rule, err := parseRetentionRule(test.text)
+		if err != nil {
+			t.Fatalf("parseRetentionRule(%q) returned %v", test.text, err)
+		}
+		if rule.path != test.path || rule.keepLast != test.keepLast || rule.maxAge != test.maxAge {
+			t.Errorf("parseRetentionRule(%q) = %v, %v, %v, want %v, %v, %v", test.text, rule.path, rule.keepLast, rule.maxAge,
+				test.path, test.keepLast, test.maxAge)
+		}
+	}
+
+	for _, text := range []string{"//builds/...", "builds/... keep=5", "//builds/... keep", "//builds/... keep=-1", "//builds/... size=5"} {
+		if _, err := parseRetentionRule(text); err == nil {
+			t.Errorf("parseRetentionRule(%q) succeeded, want an error", text)
+		}
+	}
+}
+
+func TestLoadRevisions(t *testing.T) {
+	rule, err := parseRetentionRule("//depot/path1/... keep=1")
+	if err != nil {
+		t.Fatalf("parseRetentionRule() returned %v", err)
+	}
+	files, archives, err := loadRevisions("../perforceutils/testdata/example_journal.txt", []*retentionRule{rule})
+	if err != nil {
+		t.Fatalf("loadRevisions() returned %v", err)
+	}
+	got := make(map[string]int)
+	for name, file := range files {
+		got[name] = len(file.revisions)
+	}
+	want := map[string]int{
+		"//depot/path1/data1.dat":  2,
+		"//depot/path1/data2.dat":  1,
+		"//depot/path1/README.txt": 2,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadRevisions() files = %v, want %v", got, want)
+	}
+	// Files no rule matches still reference their archives
+	if a := archives["//depot/path2/More.txt\x001.3"]; a == nil || a.references != 1 {
+		t.Errorf("loadRevisions() archive of //depot/path2/More.txt = %+v, want 1 reference", a)
+	}
+}
+
+func TestSelectCandidates(t *testing.T) {
+	now := time.Date(2021, 1, 31, 0, 0, 0, 0, time.UTC)
+	day := int64(24 * 60 * 60)
+	file := func() *depotFile {
+		f := &depotFile{name: "//depot/file"}
+		for number := 1; number <= 5; number++ {
+			// One revision a day, the head revision submitted the day before now
+			f.revisions = append(f.revisions, revision{number: number, date: now.Unix() - int64(6-number)*day})
+		}
+		return f
+	}
+	tests := []struct {
+		rule string
+		want []int
+	}{
+		{"//depot/... keep=2", []int{3, 2, 1}},
+		{"//depot/... max-age=3", []int{2, 1}},
+		{"//depot/... keep=4 max-age=3", []int{1}},
+		{"//depot/... keep=0", []int{4, 3, 2, 1}},
+		{"//depot/file keep=10", nil},
+		{"//other/... keep=1", nil},
+	}
+	for _, test := range tests {
+		rule, err := parseRetentionRule(test.rule)
+		if err != nil {
+			t.Fatalf("parseRetentionRule(%q) returned %v", test.rule, err)
+		}
+		_, candidates := selectCandidates(file(), []*retentionRule{rule}, now)
+		var got []int
+		for _, rev := range candidates {
+			got = append(got, rev.number)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("selectCandidates(%q) = %v, want %v", test.rule, got, test.want)
+		}
+	}
+}
+
+func TestRevisionRanges(t *testing.T) {
+	var candidates []revision
+	for _, number := range []int{7, 1, 2, 3, 5} {
+		candidates = append(candidates, revision{number: number})
+	}
+	want := []string{"//depot/file#1,3", "//depot/file#5,5", "//depot/file#7,7"}
+	if got := revisionRanges("//depot/file", candidates); !reflect.DeepEqual(got, want) {
+		t.Errorf("revisionRanges() = %q, want %q", got, want)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if got, want := shellQuote("//depot/it's#1,2"), `'//depot/it'\''s#1,2'`; got != want {
+		t.Errorf("shellQuote() = %v, want %v", got, want)
+	}
+}
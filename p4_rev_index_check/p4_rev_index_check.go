@@ -0,0 +1,234 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_rev_index_check checks that the index tables of db.rev agree with it: db.revhx
+// must hold the head revision of each file not deleted at head, and db.revdx the head revision of
+// each file deleted at head.
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/problems"
+)
+
+// The index tables of db.rev
+const (
+	// The head revisions of the files that aren't deleted at head
+	headIndexTable = "db.revhx"
+	// The head revisions of the files deleted at head
+	deletedIndexTable = "db.revdx"
+)
+
+const (
+	// The head revision isn't in the index table it belongs to
+	missingFromIndex = "missing"
+	// The index table has the file although its head revision belongs to the other table, or the
+	// file has no revisions in db.rev at all
+	staleIndex = "stale"
+	// The index table has another revision of the file than its head revision
+	notHead = "not-head"
+	// The index table has the head revision, with fields that differ from db.rev
+	fieldMismatch = "mismatch"
+	// The index table has several records for the file
+	duplicateIndex = "duplicate"
+)
+
+var problemKinds = []string{missingFromIndex, staleIndex, notHead, fieldMismatch, duplicateIndex}
+
+// A depot file, with its head revision and the records of the index tables
+type fileRevisions struct {
+	head    *archive.RevRecord
+	indexes map[string][]*archive.RevRecord
+}
+
+// A file whose index records don't agree with db.rev
+type problem struct {
+	depotFile string
+	// The head revision from db.rev, 0 when db.rev has no revision of the file
+	headRev    int
+	headAction archive.FileAction
+	table      string
+	// The revision of the index record, 0 when the index record is missing
+	indexRev int
+	kind     string
+}
+
+// Reports whether the head revision of a file is a deletion, which db.revdx indexes rather than
+// db.revhx. Purged and archived revisions keep the file at head.
+func deletedAtHead(action archive.FileAction) bool {
+	return action == archive.DeleteFileAction || action == archive.MoveFromFileAction
+}
+
+// Returns the problems of the index records of a file
+func (f *fileRevisions) check(depotFile string) []problem {
+	var problems []problem
+	add := func(table string, indexRev int, kind string) {
+		p := problem{depotFile: depotFile, table: table, indexRev: indexRev, kind: kind}
+		if f.head != nil {
+			p.headRev, p.headAction = f.head.DepotRev, f.head.Action
+		}
+		problems = append(problems, p)
+	}
+	expected := ""
+	if f.head != nil {
+		expected = headIndexTable
+		if deletedAtHead(f.head.Action) {
+			expected = deletedIndexTable
+		}
+	}
+	for _, table := range []string{headIndexTable, deletedIndexTable} {
+		records := f.indexes[table]
+		if table != expected {
+			for _, record := range records {
+				add(table, record.DepotRev, staleIndex)
+			}
+			continue
+		}
+		if len(records) == 0 {
+			add(table, 0, missingFromIndex)
+			continue
+		}
+		if len(records) > 1 {
+			add(table, records[1].DepotRev, duplicateIndex)
+		}
+		switch record := records[0]; {
+		case record.DepotRev != f.head.DepotRev:
+			add(table, record.DepotRev, notHead)
+		case *record != *f.head:
+			add(table, record.DepotRev, fieldMismatch)
+		}
+	}
+	return problems
+}
+
+// Reads the head revision of each file from db.rev, and its records of the index tables. Returns the
+// files keyed by depot file, and the number of records of each table.
+func readFiles(checkpointPath string) (map[string]*fileRevisions, map[string]int, error) {
+	// The tables go into the same map, so that they can come in any order
+	files := make(map[string]*fileRevisions)
+	lookup := func(depotFile string) *fileRevisions {
+		file, ok := files[depotFile]
+		if !ok {
+			file = &fileRevisions{indexes: make(map[string][]*archive.RevRecord)}
+			files[depotFile] = file
+		}
+		return file
+	}
+	records := make(map[string]int)
+	tables := map[string]bool{"db.rev": true, headIndexTable: true, deletedIndexTable: true}
+	err := journal.ScanFile(checkpointPath, tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		rev, err := archive.ParseRevRecord(record.Fields)
+		if err != nil {
+			slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		records[record.Table]++
+		file := lookup(rev.DepotFile)
+		if record.Table != "db.rev" {
+			file.indexes[record.Table] = append(file.indexes[record.Table], rev)
+		} else if file.head == nil || rev.DepotRev > file.head.DepotRev {
+			file.head = rev
+		}
+		return nil
+	})
+	return files, records, err
+}
+
+func main() {
+	var options problems.Options
+	options.RegisterFlags(flag.CommandLine)
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(options.Verbose); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(options.Format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+
+	start := time.Now()
+	files, records, err := readFiles(flag.Arg(0))
+	if err != nil {
+		logging.Fatal("Error reading checkpoint", logging.PathKey, flag.Arg(0), logging.Err(err))
+	}
+	if records["db.rev"] > 0 && records[headIndexTable] == 0 && records[deletedIndexTable] == 0 {
+		logging.Fatal("The checkpoint has no db.revhx nor db.revdx records, as for servers without these index tables")
+	}
+
+	report := problems.NewReport(options, output.Table{Name: "rev_index"}, []string{"DepotFile", "HeadRev", "HeadAction", "Table", "IndexRev", "Problem"})
+	counts := make(map[string]int)
+	for depotFile, file := range files {
+		for _, p := range file.check(depotFile) {
+			counts[p.kind]++
+			headRev, headAction, indexRev := "", "", ""
+			if p.headRev > 0 {
+				headRev, headAction = strconv.Itoa(p.headRev), strconv.Itoa(int(p.headAction))
+			}
+			if p.indexRev > 0 {
+				indexRev = strconv.Itoa(p.indexRev)
+			}
+			report.Add(p.depotFile, headRev, headAction, p.table, indexRev, p.kind)
+		}
+	}
+	if err := report.Write("Inconsistent rev index"); err != nil {
+		logging.Fatal("Error writing problems", logging.Err(err))
+	}
+
+	slog.Info("Checked files", logging.CountKey, len(files), "rev_records", records["db.rev"],
+		"revhx_records", records[headIndexTable], "revdx_records", records[deletedIndexTable])
+	for _, kind := range problemKinds {
+		if counts[kind] > 0 {
+			slog.Warn("Inconsistent rev index records", "problem", kind, logging.CountKey, counts[kind])
+		}
+	}
+	if report.Total() > 0 {
+		slog.Warn("The rev index tables disagree with db.rev, p4d -xx reports and repairs such inconsistencies")
+	}
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+
+	if report.Total() > 0 {
+		os.Exit(2)
+	}
+}
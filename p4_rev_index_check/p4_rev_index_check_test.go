@@ -0,0 +1,86 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// A revision of db.rev version 9, or of its index tables
+func revRecord(table string, depotFile string, depotRev int, action int, size int) string {
+	return fmt.Sprintf("@pv@ 9 @%v@ @%v@ %v 0 %v 4 1611008048 1611008047 E58A41657AB37F063690AD6A2FB1B3B6 %v 0 0 @%v@ @1.%v@ 0 \n",
+		table, depotFile, depotRev, action, size, depotFile, depotRev)
+}
+
+func TestCheck(t *testing.T) {
+	records := revRecord("db.rev", "//depot/path3/deleted.txt", 1, 0, 15) +
+		revRecord("db.rev", "//depot/path3/deleted.txt", 2, 2, 0) +
+		revRecord("db.revhx", "//depot/path3/deleted.txt", 1, 0, 15) +
+		revRecord("db.revhx", "//depot/path4/ghost.txt", 1, 0, 15) +
+		revRecord("db.rev", "//depot/path5/old.txt", 2, 1, 15) +
+		revRecord("db.revhx", "//depot/path5/old.txt", 1, 0, 15) +
+		revRecord("db.rev", "//depot/path6/changed.txt", 1, 0, 15) +
+		revRecord("db.revhx", "//depot/path6/changed.txt", 1, 0, 16) +
+		revRecord("db.rev", "//depot/path7/twice.txt", 1, 0, 15) +
+		revRecord("db.revhx", "//depot/path7/twice.txt", 1, 0, 15) +
+		revRecord("db.revhx", "//depot/path7/twice.txt", 1, 0, 15)
+	example, err := os.ReadFile("../perforceutils/testdata/example_journal.txt")
+	if err != nil {
+		t.Fatalf("ReadFile() returned %v", err)
+	}
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	if err := os.WriteFile(checkpoint, append(example, records...), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+
+	files, counts, err := readFiles(checkpoint)
+	if err != nil {
+		t.Fatalf("readFiles() returned %v", err)
+	}
+	wantCounts := map[string]int{"db.rev": 11, headIndexTable: 10}
+	if !reflect.DeepEqual(counts, wantCounts) {
+		t.Errorf("readFiles() records = %v, want %v", counts, wantCounts)
+	}
+
+	var got []problem
+	for depotFile, file := range files {
+		got = append(got, file.check(depotFile)...)
+	}
+	sort.Slice(got, func(i, j int) bool {
+		if got[i].depotFile != got[j].depotFile {
+			return got[i].depotFile < got[j].depotFile
+		}
+		return got[i].table < got[j].table
+	})
+	// The files of the example agree with their index records
+	want := []problem{
+		{"//depot/path3/deleted.txt", 2, 2, deletedIndexTable, 0, missingFromIndex},
+		{"//depot/path3/deleted.txt", 2, 2, headIndexTable, 1, staleIndex},
+		{"//depot/path4/ghost.txt", 0, 0, headIndexTable, 1, staleIndex},
+		{"//depot/path5/old.txt", 2, 1, headIndexTable, 1, notHead},
+		{"//depot/path6/changed.txt", 1, 0, headIndexTable, 1, fieldMismatch},
+		{"//depot/path7/twice.txt", 1, 0, headIndexTable, 1, duplicateIndex},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("check() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,366 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_s3_verify checks that the archives of a checkpoint are in the S3 bucket where
+// Helix Core servers configured with S3 storage keep them: each archive expected by db.storage is
+// looked up under the key of its librarian path, by listing the bucket or by a HEAD request per
+// archive, and the missing objects and the ones whose size differs from db.storage are reported.
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// How the objects are looked up
+const (
+	// Lists the objects under the prefix: a request per thousand objects, best for whole depots
+	listMode = "list"
+	// Sends a HEAD request per archive: best for a few archives in a large bucket
+	headMode = "head"
+)
+
+const (
+	// The bucket has no object for the archive
+	missingObject = "missing"
+	// The object has another size than the archive as recorded by db.storage
+	sizeMismatch = "size-mismatch"
+)
+
+// An archive expected in the bucket
+type expectedObject struct {
+	key string
+	// The path of the archive relative to the depot root
+	path string
+	// The size of the file as stored, or -1 when it isn't recorded, as for RCS files
+	size int64
+
+	found      bool
+	actualSize int64
+}
+
+// Returns the size of an archive as stored, or -1 when not recorded
+func storedSize(storage *archive.StorageRecord, lbrType int) int64 {
+	switch archive.StorageType(lbrType) {
+	case archive.BinaryStorageType, archive.TempObjStorageType:
+		// Stored as is, so the size of the content is the one of the file
+		if storage.ServerSize > 0 {
+			return storage.ServerSize
+		}
+		return storage.Size
+	case archive.CompressedStorageType, archive.CompressedTempObj:
+		if storage.ServerSize > 0 {
+			return storage.ServerSize
+		}
+	}
+	return -1
+}
+
+// Lists the archives of a checkpoint from db.storage and db.storagesh, each RCS file once, with
+// their key under prefix. Archives of depots mapped outside the depot root have no key and are
+// counted as skipped.
+func listExpectedObjects(checkpointPath string, depots archive.DepotMaps, prefix string) (map[string]*expectedObject, int, int, error) {
+	objects := make(map[string]*expectedObject)
+	records, skipped := 0, 0
+	// The archives of db.storage that belong to shelved files, which db.revsh lists first
+	shelved := make(map[string]bool)
+	tables := map[string]bool{"db.revsh": true, "db.storage": true, "db.storagesh": true}
+	err := journal.ScanFile(checkpointPath, tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		if record.Table == "db.revsh" {
+			rev, err := archive.ParseRevRecord(record.Fields)
+			if err != nil {
+				slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			shelved[rev.LbrFile+"\x00"+rev.LbrRev] = true
+			return nil
+		}
+		storage, err := archive.ParseStorageRecord(record.Fields)
+		if err != nil {
+			slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		records++
+		lbrType := storage.LbrType
+		if record.Table == "db.storagesh" || shelved[storage.LbrFile+"\x00"+storage.LbrRev] {
+			lbrType = archive.ShelvedStorageType(lbrType)
+		}
+		path := archive.ArchiveFilePath("", depots, storage.LbrFile, storage.LbrRev, lbrType)
+		size := storedSize(storage, lbrType)
+		switch archive.StorageType(lbrType) {
+		case archive.RCSStorageType:
+			// RCS files hold several revisions, listed one after the other
+			path = filepath.Dir(path)
+		case archive.BinaryStorageType, archive.TempObjStorageType, archive.CompressedStorageType, archive.CompressedTempObj:
+		default:
+			// Not stored in a file of its own, such as tiny files stored in db.revtx
+			return nil
+		}
+		if filepath.IsAbs(path) {
+			skipped++
+			return nil
+		}
+		key := prefix + filepath.ToSlash(path)
+		// Shelved archives may be listed in both db.storage and db.storagesh
+		if _, ok := objects[key]; !ok {
+			objects[key] = &expectedObject{key: key, path: filepath.ToSlash(path), size: size}
+		}
+		return nil
+	})
+	return objects, records, skipped, err
+}
+
+// Looks up the expected objects by listing the bucket. Returns the number of objects that aren't
+// archives of the checkpoint.
+func listObjects(ctx context.Context, b *bucket, prefix string, objects map[string]*expectedObject) (int, error) {
+	unexpected := 0
+	err := b.list(ctx, prefix, func(key string, size int64) error {
+		object, ok := objects[key]
+		if !ok {
+			unexpected++
+			return nil
+		}
+		object.found, object.actualSize = true, size
+		return nil
+	})
+	return unexpected, err
+}
+
+// Looks up the expected objects with HEAD requests. Returns the number of requests that failed,
+// whose objects are left out of the problems.
+func headObjects(ctx context.Context, b *bucket, objects map[string]*expectedObject, workers int) int {
+	var mu sync.Mutex
+	failed := 0
+	queue := make(chan *expectedObject, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for object := range queue {
+				size, found, err := b.head(ctx, object.key)
+				mu.Lock()
+				if err != nil {
+					failed++
+					// Not reported as missing, its state is unknown
+					object.found, object.actualSize = true, object.size
+					if ctx.Err() == nil {
+						slog.Error("Error looking up object", "key", object.key, logging.Err(err))
+					}
+				} else {
+					object.found, object.actualSize = found, size
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, object := range objects {
+		select {
+		case queue <- object:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return failed
+}
+
+// Returns the objects missing from the bucket or stored with another size, sorted by key, and their
+// number by problem
+func findProblems(objects map[string]*expectedObject) ([]*expectedObject, map[string]int) {
+	var problems []*expectedObject
+	counts := make(map[string]int)
+	for _, object := range objects {
+		switch {
+		case !object.found:
+			counts[missingObject]++
+		case object.size >= 0 && object.actualSize != object.size:
+			counts[sizeMismatch]++
+		default:
+			continue
+		}
+		problems = append(problems, object)
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].key < problems[j].key })
+	return problems, counts
+}
+
+func writeProblems(out output.Writer, problems []*expectedObject) error {
+	out.Write([]string{"Key", "Path", "Problem", "Size", "ExpectedSize"})
+	for _, object := range problems {
+		problem, size, expected := missingObject, "", ""
+		if object.found {
+			problem, size = sizeMismatch, strconv.FormatInt(object.actualSize, 10)
+		}
+		if object.size >= 0 {
+			expected = strconv.FormatInt(object.size, 10)
+		}
+		out.Write([]string{object.key, object.path, problem, size, expected})
+	}
+	return nil
+}
+
+func main() {
+	flags := struct {
+		bucket    string
+		prefix    string
+		region    string
+		endpoint  string
+		pathStyle bool
+		mode      string
+		workers   int
+		output    string
+		format    string
+	}{}
+
+	flag.StringVar(&flags.bucket, "bucket", "", "S3 bucket holding the archives.")
+	flag.StringVar(&flags.prefix, "prefix", "", "Prefix of the keys of the archives, prepended as is to their path relative to the depot root (such as depots/).")
+	flag.StringVar(&flags.region, "region", "", "Region of the bucket (the one of the AWS configuration by default).")
+	flag.StringVar(&flags.endpoint, "endpoint", "", "URL of an S3-compatible service to use instead of AWS.")
+	flag.BoolVar(&flags.pathStyle, "path-style", false, "Send path-style requests (endpoint/bucket/key), as most S3-compatible services need.")
+	flag.StringVar(&flags.mode, "mode", listMode, "How the objects are looked up: list (listing the keys under -prefix) or head (a HEAD request per archive).")
+	flag.IntVar(&flags.workers, "workers", 16, "Number of HEAD requests sent at once with -mode=head.")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File, or table for the database formats, to write the missing and size-mismatched objects to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage())
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(false); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 || len(flags.bucket) == 0 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(flags.format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+	if flags.mode != listMode && flags.mode != headMode {
+		logging.Fatal("Unknown -mode, expected list or head", "mode", flags.mode)
+	}
+	if flags.workers < 1 {
+		logging.Fatal("Invalid number of workers", "workers", flags.workers)
+	}
+	checkpointPath := flag.Arg(0)
+	if checkpointPath == journal.Stdin {
+		logging.Fatal("The checkpoint is read twice, so it can't be the standard input")
+	}
+
+	start := time.Now()
+	file, err := journal.Open(checkpointPath)
+	if err != nil {
+		logging.Fatal("Error opening checkpoint", logging.PathKey, checkpointPath, logging.Err(err))
+	}
+	depots, err := archive.ReadDepotMaps(file)
+	file.Close()
+	if err != nil {
+		logging.Fatal("Error reading depot maps", logging.PathKey, checkpointPath, logging.Err(err))
+	}
+	objects, records, skipped, err := listExpectedObjects(checkpointPath, depots, flags.prefix)
+	if err != nil {
+		logging.Fatal("Error processing checkpoint", logging.PathKey, checkpointPath, logging.Err(err))
+	}
+	if records == 0 {
+		logging.Fatal("No db.storage records, servers before 2019.1 are not supported")
+	}
+	if skipped > 0 {
+		slog.Warn("Skipped the archives of depots mapped outside the depot root, which have no key under -prefix",
+			logging.CountKey, skipped)
+	}
+
+	// Interrupting the run stops it: the objects not looked up yet would all be reported missing,
+	// so no report is written
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	b, err := newBucket(ctx, flags.bucket, flags.region, flags.endpoint, flags.pathStyle)
+	if err != nil {
+		logging.Fatal("Error configuring S3 access", logging.Err(err))
+	}
+	failed := 0
+	if flags.mode == listMode {
+		unexpected, err := listObjects(ctx, b, flags.prefix, objects)
+		if err != nil {
+			logging.Fatal("Error listing bucket", "bucket", flags.bucket, "prefix", flags.prefix, logging.Err(err))
+		}
+		if unexpected > 0 {
+			slog.Info("Objects that aren't archives of the checkpoint", logging.CountKey, unexpected)
+		}
+	} else {
+		failed = headObjects(ctx, b, objects, flags.workers)
+	}
+	if ctx.Err() != nil {
+		logging.Fatal("Interrupted")
+	}
+
+	problems, counts := findProblems(objects)
+	err = output.WriteTable(flags.format, flags.output, output.Table{Name: "s3_problems"}, func(out output.Writer) error {
+		return writeProblems(out, problems)
+	})
+	if err != nil {
+		logging.Fatal("Error writing problems", logging.Err(err))
+	}
+
+	slog.Info("Checked archives", logging.CountKey, len(objects), "mode", flags.mode)
+	for _, kind := range []string{missingObject, sizeMismatch} {
+		if counts[kind] > 0 {
+			slog.Warn("Archives not stored as recorded", "problem", kind, logging.CountKey, counts[kind])
+		}
+	}
+	if failed > 0 {
+		slog.Error("Archives that couldn't be looked up", logging.CountKey, failed)
+	}
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+	if failed > 0 {
+		os.Exit(1)
+	}
+	if len(problems) > 0 {
+		os.Exit(2)
+	}
+}
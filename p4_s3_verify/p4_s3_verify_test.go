@@ -0,0 +1,156 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+)
+
+// Keeps the rows written, in place of a file
+type rowsWriter struct{ rows [][]string }
+
+func (w *rowsWriter) Write(row []string) error { w.rows = append(w.rows, row); return nil }
+func (w *rowsWriter) Commit() error            { return nil }
+func (w *rowsWriter) Close() error             { return nil }
+
+// Serves the objects of a bucket as S3 does, to ListObjectsV2 and HeadObject requests in path style
+func newFakeBucket(t *testing.T, name string, objects map[string]int64) *bucket {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := strings.CutPrefix(r.URL.Path, "/"+name+"/")
+		switch {
+		case r.Method == http.MethodGet && (r.URL.Path == "/"+name || r.URL.Path == "/"+name+"/"):
+			prefix := r.URL.Query().Get("prefix")
+			var keys []string
+			for key := range objects {
+				if strings.HasPrefix(key, prefix) {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprintf(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>%v</Name><Prefix>%v</Prefix><KeyCount>%v</KeyCount><MaxKeys>1000</MaxKeys><IsTruncated>false</IsTruncated>`,
+				name, prefix, len(keys))
+			for _, key := range keys {
+				fmt.Fprintf(w, "<Contents><Key>%v</Key><Size>%v</Size></Contents>", key, objects[key])
+			}
+			fmt.Fprint(w, "</ListBucketResult>")
+		case r.Method == http.MethodHead && ok:
+			size, found := objects[key]
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", fmt.Sprint(size))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	b, err := newBucket(context.Background(), name, "us-east-1", server.URL, true)
+	if err != nil {
+		t.Fatalf("newBucket() returned %v", err)
+	}
+	return b
+}
+
+func TestStoredSize(t *testing.T) {
+	storage := &archive.StorageRecord{Size: 10485760, ServerSize: 10221}
+	tests := []struct {
+		lbrType    int
+		serverSize int64
+		want       int64
+	}{
+		{0x10001, 10221, 10221},
+		{0x10001, 0, 10485760},
+		{0x10003, 10221, 10221},
+		{0x10003, 0, -1},
+		{0, 203, -1},
+	}
+	for _, test := range tests {
+		storage.ServerSize = test.serverSize
+		if got := storedSize(storage, test.lbrType); got != test.want {
+			t.Errorf("storedSize(%v, %#x) = %v, want %v", test.serverSize, test.lbrType, got, test.want)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	b := newFakeBucket(t, "archives", map[string]int64{
+		"depots/depot/path1/data1.dat,d/1.1.gz": 10221,
+		"depots/depot/path1/data1.dat,d/1.2.gz": 100,
+		"depots/depot/path1/README.txt,v":       203,
+		"depots/unexpected.txt":                 5,
+	})
+	want := [][]string{
+		{"Key", "Path", "Problem", "Size", "ExpectedSize"},
+		{"depots/depot/path1/data1.dat,d/1.2.gz", "depot/path1/data1.dat,d/1.2.gz", sizeMismatch, "100", "10221"},
+		{"depots/depot/path1/data2.dat,d/1.1.gz", "depot/path1/data2.dat,d/1.1.gz", missingObject, "", "10221"},
+		{"depots/depot/path2/More.txt,v", "depot/path2/More.txt,v", missingObject, "", ""},
+	}
+	for _, mode := range []string{listMode, headMode} {
+		objects, records, skipped, err := listExpectedObjects("../perforceutils/testdata/example_journal.txt", nil, "depots/")
+		if err != nil {
+			t.Fatalf("listExpectedObjects() returned %v", err)
+		}
+		if len(objects) != 5 || records != 6 || skipped != 0 {
+			t.Errorf("listExpectedObjects() = %v objects, %v, %v, want 5, 6, 0", len(objects), records, skipped)
+		}
+
+		if mode == listMode {
+			unexpected, err := listObjects(context.Background(), b, "depots/", objects)
+			if err != nil {
+				t.Fatalf("listObjects() returned %v", err)
+			}
+			if unexpected != 1 {
+				t.Errorf("listObjects() = %v, want 1", unexpected)
+			}
+		} else if failed := headObjects(context.Background(), b, objects, 2); failed != 0 {
+			t.Errorf("headObjects() = %v, want 0", failed)
+		}
+
+		problems, counts := findProblems(objects)
+		wantCounts := map[string]int{missingObject: 2, sizeMismatch: 1}
+		if !reflect.DeepEqual(counts, wantCounts) {
+			t.Errorf("findProblems() with -mode=%v counts = %v, want %v", mode, counts, wantCounts)
+		}
+		out := &rowsWriter{}
+		if err := writeProblems(out, problems); err != nil {
+			t.Fatalf("writeProblems() returned %v", err)
+		}
+		if !reflect.DeepEqual(out.rows, want) {
+			t.Errorf("writeProblems() with -mode=%v wrote %q, want %q", mode, out.rows, want)
+		}
+	}
+}
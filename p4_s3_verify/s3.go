@@ -0,0 +1,92 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// The objects of an S3 bucket
+type bucket struct {
+	client *s3.Client
+	name   string
+}
+
+// Connects to a bucket with the default credentials of the AWS SDK (environment, shared
+// configuration files, instance roles, ...). endpoint selects an S3-compatible service instead of
+// AWS, such as MinIO, which usually needs path-style requests.
+func newBucket(ctx context.Context, name string, region string, endpoint string, pathStyle bool) (*bucket, error) {
+	var options []func(*config.LoadOptions) error
+	if len(region) > 0 {
+		options = append(options, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if len(endpoint) > 0 {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = pathStyle
+	})
+	return &bucket{client: client, name: name}, nil
+}
+
+// Lists the objects whose key starts with prefix, with their size
+func (b *bucket) list(ctx context.Context, prefix string, fn func(key string, size int64) error) error {
+	paginator := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.name),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			if err := fn(aws.ToString(object.Key), aws.ToInt64(object.Size)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the size of an object, or false when the bucket doesn't have it
+func (b *bucket) head(ctx context.Context, key string) (int64, bool, error) {
+	object, err := b.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.name),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		// HEAD responses have no body, so a missing object is only told by its status
+		var responseErr *awshttp.ResponseError
+		if errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusNotFound {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return aws.ToInt64(object.ContentLength), true, nil
+}
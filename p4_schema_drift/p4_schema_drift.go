@@ -0,0 +1,257 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_schema_drift compares the table layouts used by a Helix Core server against
+// the schema registry embedded in perforce-utils and reports unknown tables and fields.
+// Running it at upgrade time shows parser gaps before reports silently start missing data.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/schema"
+)
+
+// The layout of a table as reported by the server
+type observedTable struct {
+	name    string
+	version int
+	// Field names are only known when the layout comes from "p4 dbschema"
+	fields     []string
+	fieldCount int
+}
+
+// Derives table layouts from the records of a checkpoint or journal
+func readJournalSchemas(r io.Reader) (map[string]*observedTable, error) {
+	tables := make(map[string]*observedTable)
+	err := journal.ScanTables(r, nil, func(record journal.Record) error {
+		switch record.Operation {
+		case journal.PutValue, journal.ReplaceValue, journal.DeleteValue:
+		default:
+			return nil
+		}
+		table, ok := tables[record.Table]
+		if !ok {
+			table = &observedTable{name: record.Table}
+			tables[record.Table] = table
+		}
+		if record.Version >= table.version {
+			table.version = record.Version
+			table.fieldCount = len(record.Fields)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+// Parses the tagged output of "p4 -ztag dbschema"
+func readDbSchema(r io.Reader) (map[string]*observedTable, error) {
+	tables := make(map[string]*observedTable)
+	var current *observedTable
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimPrefix(scanner.Text(), "... "), " ", 2)
+		if len(parts) < 2 {
+			continue
+		}
+		tag, value := parts[0], parts[1]
+		switch {
+		case tag == "table":
+			current = &observedTable{name: value}
+			tables[value] = current
+		case current == nil:
+			continue
+		case tag == "version":
+			version, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("unexpected version %v for table %v", value, current.name)
+			}
+			current.version = version
+		case strings.HasPrefix(tag, "name"):
+			current.fields = append(current.fields, value)
+			current.fieldCount = len(current.fields)
+		}
+	}
+	return tables, scanner.Err()
+}
+
+func runCommand(name string, args ...string) ([]byte, error) {
+	slog.Debug("Running command", "command", name, "args", strings.Join(args, " "))
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v failed: %v: %v", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// Dumps the given tables from a server root with "p4d -jd" and derives their layouts
+func readServerDump(p4d string, root string, tables []string) (map[string]*observedTable, error) {
+	dump, err := ioutil.TempFile("", "p4_schema_drift")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temp file: %v", err)
+	}
+	dump.Close()
+	defer os.Remove(dump.Name())
+
+	args := append([]string{"-r", root, "-jd", dump.Name()}, tables...)
+	if _, err := runCommand(p4d, args...); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(dump.Name())
+	if err != nil {
+		return nil, fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+	return readJournalSchemas(file)
+}
+
+// Compares observed layouts with the registry, logging every difference.
+// Returns the number of known tables whose layout differs and the number of unknown tables.
+func reportDrift(tables map[string]*observedTable) (int, int) {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	driftCount := 0
+	unknownCount := 0
+	for _, name := range names {
+		observed := tables[name]
+		known, ok := schema.Tables[name]
+		if !ok {
+			unknownCount++
+			slog.Warn("Unknown table", logging.TableKey, name, "version", observed.version, "fields", observed.fieldCount)
+			continue
+		}
+
+		drifted := false
+		if observed.version != known.Version {
+			drifted = true
+			slog.Warn("Table version differs from the registry", logging.TableKey, name, "version", observed.version,
+				"registry_version", known.Version)
+		}
+		if observed.fieldCount > len(known.Fields) {
+			drifted = true
+			unknownFields := fmt.Sprintf("%v", observed.fieldCount-len(known.Fields))
+			if len(observed.fields) > 0 {
+				unknownFields = strings.Join(observed.fields[len(known.Fields):], ", ")
+			}
+			slog.Warn("Unknown fields", logging.TableKey, name, "after", known.Fields[len(known.Fields)-1], "fields", unknownFields)
+		} else if observed.fieldCount < len(known.Fields) {
+			drifted = true
+			slog.Warn("Missing fields", logging.TableKey, name, "fields", observed.fieldCount, "registry_fields", len(known.Fields),
+				"missing", strings.Join(known.Fields[observed.fieldCount:], ", "))
+		}
+		if drifted {
+			driftCount++
+		} else {
+			slog.Debug("Table matches the registry", logging.TableKey, name)
+		}
+	}
+	return driftCount, unknownCount
+}
+
+func main() {
+	flags := struct {
+		dbschema bool
+		p4       string
+		p4d      string
+		p4dRoot  string
+		tables   string
+		verbose  bool
+	}{}
+
+	flag.BoolVar(&flags.dbschema, "dbschema", false, "Query the server schema with \"p4 dbschema\" (requires super access).")
+	flag.StringVar(&flags.p4, "p4", "p4", "Path to the p4 command-line client.")
+	flag.StringVar(&flags.p4d, "p4d", "p4d", "Path to the p4d server binary.")
+	flag.StringVar(&flags.p4dRoot, "p4d-root", "", "Server root to dump tables from with \"p4d -jd\".")
+	flag.StringVar(&flags.tables, "tables", "db.counters,db.config,db.depot", "Comma-separated tables to dump with -p4d-root.")
+	flag.BoolVar(&flags.verbose, "verbose", false, "Verbose output.")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(flags.verbose); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+
+	start := time.Now()
+	var tables map[string]*observedTable
+	var err error
+	switch {
+	case flags.dbschema:
+		var output []byte
+		if output, err = runCommand(flags.p4, "-ztag", "dbschema"); err == nil {
+			tables, err = readDbSchema(bytes.NewReader(output))
+		}
+	case len(flags.p4dRoot) > 0:
+		tables, err = readServerDump(flags.p4d, flags.p4dRoot, strings.Split(flags.tables, ","))
+	case flag.NArg() > 0:
+		var file io.ReadCloser
+		if file, err = journal.Open(flag.Arg(0)); err == nil {
+			tables, err = readJournalSchemas(file)
+			file.Close()
+		}
+	default:
+		logging.Fatal("Specify -dbschema, -p4d-root or a checkpoint/journal path")
+	}
+
+	if err != nil {
+		logging.Fatal("Error reading server schema", logging.Err(err))
+	}
+
+	driftCount, unknownCount := reportDrift(tables)
+	slog.Info("Compared tables", logging.CountKey, len(tables))
+	slog.Info("Tables differing from the registry", logging.CountKey, driftCount)
+	slog.Info("Unknown tables", logging.CountKey, unknownCount)
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+
+	if driftCount > 0 {
+		os.Exit(2)
+	}
+}
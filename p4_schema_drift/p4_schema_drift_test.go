@@ -0,0 +1,91 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadJournalSchemas(t *testing.T) {
+	file, err := os.Open("../perforceutils/testdata/example_journal.txt")
+	if err != nil {
+		t.Fatalf("Open() returned %v", err)
+	}
+	defer file.Close()
+	tables, err := readJournalSchemas(file)
+	if err != nil {
+		t.Fatalf("readJournalSchemas() returned %v", err)
+	}
+	for _, want := range []observedTable{
+		{name: "db.counters", version: 1, fieldCount: 2},
+		{name: "db.rev", version: 9, fieldCount: 14},
+		{name: "db.storage", version: 1, fieldCount: 9},
+	} {
+		if got := tables[want.name]; got == nil || !reflect.DeepEqual(*got, want) {
+			t.Errorf("readJournalSchemas() %v = %+v, want %+v", want.name, got, want)
+		}
+	}
+	// db.configh, db.revcx and db.upgrades aren't in the registry
+	if drifted, unknown := reportDrift(tables); drifted != 0 || unknown != 3 {
+		t.Errorf("reportDrift() = %v, %v, want 0, 3", drifted, unknown)
+	}
+}
+
+func TestReadDbSchema(t *testing.T) {
+	tables, err := readDbSchema(strings.NewReader(`... table db.counters
+... version 1
+... name0 name
+... type0 key
+... name1 value
+... type1 text
+
+... table db.upgrades.rp
+... version 1
+... name0 seq
+`))
+	if err != nil {
+		t.Fatalf("readDbSchema() returned %v", err)
+	}
+	want := map[string]*observedTable{
+		"db.counters":    {name: "db.counters", version: 1, fields: []string{"name", "value"}, fieldCount: 2},
+		"db.upgrades.rp": {name: "db.upgrades.rp", version: 1, fields: []string{"seq"}, fieldCount: 1},
+	}
+	if !reflect.DeepEqual(tables, want) {
+		t.Errorf("readDbSchema() = %+v, want %+v", tables, want)
+	}
+
+	if _, err := readDbSchema(strings.NewReader("... table db.counters\n... version one\n")); err == nil {
+		t.Errorf("readDbSchema(version one) succeeded, want an error")
+	}
+}
+
+func TestReportDrift(t *testing.T) {
+	tables := map[string]*observedTable{
+		"db.counters": {name: "db.counters", version: 1, fieldCount: 2},
+		// A newer server with a field added
+		"db.rev": {name: "db.rev", version: 10, fieldCount: 15},
+		// An older one without some fields
+		"db.user":  {name: "db.user", version: 7, fieldCount: 11},
+		"db.other": {name: "db.other", version: 1, fieldCount: 3},
+	}
+	if drifted, unknown := reportDrift(tables); drifted != 2 || unknown != 1 {
+		t.Errorf("reportDrift() = %v, %v, want 2, 1", drifted, unknown)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+)
+
+// Whether an archive is expected on disk, reported in the ArchiveState column. The states are
+// ordered so that the most significant reference to an archive wins: an archive still used by one
+// revision is expected even if another revision sharing it was purged.
+type archiveState int
+
+const (
+	// No db.rev or db.revsh record refers to the archive, or they weren't read
+	UnknownArchiveState archiveState = iota
+	// Purged by obliterate -p (p4 archive -p for archive depots)
+	PurgedArchiveState
+	// Older revisions of +S file types, purged automatically when newer ones are submitted
+	TrimmedArchiveState
+	// Moved to an archive depot by p4 archive
+	ArchivedArchiveState
+	// Used by a revision or a shelved file
+	ExpectedArchiveState
+)
+
+func (s archiveState) String() string {
+	switch s {
+	case PurgedArchiveState:
+		return "purged"
+	case TrimmedArchiveState:
+		return "trimmed"
+	case ArchivedArchiveState:
+		return "archived"
+	case ExpectedArchiveState:
+		return "expected"
+	}
+	return "unknown"
+}
+
+// The ArchiveExpected column: empty when the state is unknown
+func (s archiveState) expected() string {
+	if s == UnknownArchiveState {
+		return ""
+	}
+	return strconv.FormatBool(s == ExpectedArchiveState)
+}
+
+// The states of the archives referenced by db.rev and db.revsh, keyed by librarian file and
+// revision. Checkpoints list db.storage before db.rev, so they are read in a first pass.
+type archiveStates struct {
+	states map[string]archiveState
+}
+
+// Reads the db.rev and db.revsh records of a checkpoint or journal
+func readArchiveStates(journalPath string) (*archiveStates, error) {
+	a := &archiveStates{states: make(map[string]archiveState)}
+	tables := map[string]bool{"db.rev": true, "db.revsh": true}
+	err := journal.ScanFile(journalPath, tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		fields := record.Fields
+		if record.Table == "db.revsh" {
+			if len(fields) > DbRevShFieldLbrRev {
+				a.add(fields[DbRevShFieldLbrFile]+"\x00"+fields[DbRevShFieldLbrRev], ExpectedArchiveState)
+			}
+			return nil
+		}
+		if len(fields) < archive.DbRevFieldCount {
+			slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		action, _ := strconv.Atoi(fields[archive.DbRevFieldAction])
+		fileType, _ := strconv.ParseUint(fields[archive.DbRevFieldType], 10, 64)
+		a.add(fields[archive.DbRevFieldLbrFile]+"\x00"+fields[archive.DbRevFieldLbrRev], revisionArchiveState(archive.FileAction(action), fileType))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Deleted revisions have no archive of their own, so they don't tell anything about the archive
+// they refer to
+func revisionArchiveState(action archive.FileAction, fileType uint64) archiveState {
+	switch action {
+	case archive.DeleteFileAction:
+		return UnknownArchiveState
+	case archive.ArchiveFileAction:
+		return ArchivedArchiveState
+	case archive.PurgeFileAction:
+		serverFileType := ServerStorageType(fileType & uint64(FileTypeBitMaskServerStorageType))
+		if serverFileType == TempObjServerStorageType || serverFileType == CompressedTempObjServerStorageType ||
+			fileType&FileTypeBitMaskRevisionsNumber != 0 {
+			return TrimmedArchiveState
+		}
+		return PurgedArchiveState
+	}
+	return ExpectedArchiveState
+}
+
+func (a *archiveStates) add(key string, state archiveState) {
+	if state > a.states[key] {
+		a.states[key] = state
+	}
+}
+
+// Returns the state of the archive of a db.storage record
+func (a *archiveStates) state(record *DbStorageRecord) archiveState {
+	file := strings.ReplaceAll(record.LibrarianFile, "@@", "@")
+	return a.states[file+"\x00"+strings.Trim(record.LibrarianRevision, "@")]
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// Where rows are written: an output.Writer, or rotating CSV files in a directory
+type rowWriter interface {
+	Write(row []string) error
+}
+
+// Counts the bytes written to the underlying file
+type countingWriter struct {
+	file  *output.File
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+// Writes CSV rows to gzip compressed files <prefix>-000001.csv.gz, <prefix>-000002.csv.gz, ... in a
+// directory, starting a new file when the current one reaches maxRows rows or maxBytes compressed
+// bytes (0 for no limit). The first row written is the header, repeated at the top of each file.
+type rotatingWriter struct {
+	directory string
+	prefix    string
+	maxRows   int64
+	maxBytes  int64
+
+	header   []string
+	sequence int
+	rows     int64
+	file     *countingWriter
+	gzip     *gzip.Writer
+	buffer   *bufio.Writer
+	csv      *output.CSVWriter
+	err      error
+}
+
+func newRotatingWriter(directory string, prefix string, maxRows int64, maxBytes int64) (*rotatingWriter, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating output directory: %v", err)
+	}
+	return &rotatingWriter{directory: directory, prefix: prefix, maxRows: maxRows, maxBytes: maxBytes}, nil
+}
+
+// Finishes the current file, if any. Files only appear in the directory once finished.
+func (w *rotatingWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	w.csv.Flush()
+	err := w.csv.Error()
+	if flushErr := w.buffer.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := w.gzip.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = w.file.file.Commit()
+	} else {
+		w.file.file.Close()
+	}
+	slog.Debug("Wrote output file", logging.PathKey, w.file.file.Name(), "rows", w.rows)
+	w.file = nil
+	return err
+}
+
+func (w *rotatingWriter) openFile() error {
+	w.sequence++
+	name := filepath.Join(w.directory, fmt.Sprintf("%v-%06d.csv.gz", w.prefix, w.sequence))
+	file, err := output.Create(name)
+	if err != nil {
+		return fmt.Errorf("error creating output file: %v", err)
+	}
+	w.file = &countingWriter{file: file}
+	w.gzip = gzip.NewWriter(w.file)
+	w.buffer = bufio.NewWriter(w.gzip)
+	w.csv = output.NewCSVWriter(w.buffer)
+	w.rows = 0
+	return w.csv.Write(w.header)
+}
+
+func (w *rotatingWriter) Write(row []string) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.header == nil {
+		w.header = row
+		return nil
+	}
+	// The compressed size lags behind the rows written since gzip buffers its output,
+	// so files end up slightly larger than maxBytes
+	if w.file != nil && ((w.maxRows > 0 && w.rows >= w.maxRows) || (w.maxBytes > 0 && w.file.count >= w.maxBytes)) {
+		w.err = w.closeFile()
+	}
+	if w.err == nil && w.file == nil {
+		w.err = w.openFile()
+	}
+	if w.err == nil {
+		w.err = w.csv.Write(row)
+		w.rows++
+	}
+	return w.err
+}
+
+// Finishes the last file. Returns the number of files written.
+func (w *rotatingWriter) Close() (int, error) {
+	if err := w.closeFile(); w.err == nil {
+		w.err = err
+	}
+	return w.sequence, w.err
+}
+
+// Discards the last file, for runs that failed: the files written before it are complete.
+// Returns the number of files kept.
+func (w *rotatingWriter) Abort() int {
+	if w.file == nil {
+		return w.sequence
+	}
+	w.file.file.Close()
+	w.file = nil
+	return w.sequence - 1
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func readChunk(t *testing.T, path string) [][]string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open() returned %v", err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("NewReader() returned %v", err)
+	}
+	rows, err := csv.NewReader(reader).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll() returned %v", err)
+	}
+	return rows
+}
+
+func TestRotatingWriter(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "chunks")
+	w, err := newRotatingWriter(dir, "storage", 2, 0)
+	if err != nil {
+		t.Fatalf("newRotatingWriter() returned %v", err)
+	}
+	rows := [][]string{{"Name", "Size"}, {"a", "1"}, {"b", "2"}, {"c", "3"}}
+	for _, row := range rows {
+		if err := w.Write(row); err != nil {
+			t.Fatalf("Write() returned %v", err)
+		}
+	}
+	count, err := w.Close()
+	if err != nil || count != 2 {
+		t.Fatalf("Close() = %v, %v, want 2", count, err)
+	}
+	// Each file starts with the header
+	if got, want := readChunk(t, filepath.Join(dir, "storage-000001.csv.gz")), rows[:3]; !reflect.DeepEqual(got, want) {
+		t.Errorf("storage-000001.csv.gz = %q, want %q", got, want)
+	}
+	if got, want := readChunk(t, filepath.Join(dir, "storage-000002.csv.gz")), [][]string{rows[0], rows[3]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("storage-000002.csv.gz = %q, want %q", got, want)
+	}
+}
+
+func TestRotatingWriterAbort(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newRotatingWriter(dir, "storage", 1, 0)
+	if err != nil {
+		t.Fatalf("newRotatingWriter() returned %v", err)
+	}
+	for _, row := range [][]string{{"Name"}, {"a"}, {"b"}} {
+		if err := w.Write(row); err != nil {
+			t.Fatalf("Write() returned %v", err)
+		}
+	}
+	// The second file isn't complete, so it's discarded
+	if count := w.Abort(); count != 1 {
+		t.Errorf("Abort() = %v, want 1", count)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.csv.gz"))
+	if want := []string{filepath.Join(dir, "storage-000001.csv.gz")}; !reflect.DeepEqual(files, want) {
+		t.Errorf("Abort() left %q, want %q", files, want)
+	}
+}
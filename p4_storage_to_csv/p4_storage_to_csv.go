@@ -15,20 +15,33 @@ limitations under the License.
 */
 
 // The binary p4_storage_to_csv converts the journal representation of the db.storage table
-// to CSV format.
+// (and of db.storagesh, the storage of shelved files) to CSV format.
 package main
 
 import (
 	"bufio"
-	"encoding/csv"
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/metrics"
+	"github.com/google/perforce-utils/perforceutils/output"
+	_ "github.com/google/perforce-utils/perforceutils/output/bigquery"
+	_ "github.com/google/perforce-utils/perforceutils/output/parquet"
+	_ "github.com/google/perforce-utils/perforceutils/output/sqlite"
 )
 
 // The fields of the db.storage table are documented here:
@@ -132,143 +145,612 @@ const (
 	FileTypeBitMaskClientStorageTypeModifier                 = 0x720000
 )
 
-// Processes a Helix Core checkpoint or journal and verifies all files listed in the db.storage table
-func processDbStorageEntries(journalPath string) error {
-	file, err := os.OpenFile(journalPath, os.O_RDONLY, os.ModePerm)
+// A db.storage record, decoded from its journal representation
+type DbStorageRecord struct {
+	LibrarianFile     string
+	LibrarianRevision string
+	FileType          uint64
+	ReferenceCount    int
+	Digest            string
+	Size              int64
+	ServerSize        int64
+	CompressedDigest  string
+	Date              int
+	// Whether the record comes from db.storagesh rather than db.storage
+	ShelvedStorage bool
+}
+
+// Identifies the record to dump with -debug-record: a line number or a librarian file
+type debugRecordSelector struct {
+	table         string
+	lineNumber    int
+	librarianFile string
+}
+
+func parseDebugRecordSelector(value string) (*debugRecordSelector, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return nil, fmt.Errorf("expected <table>:<line-number-or-key>, got %v", value)
+	}
+	if parts[0] != "db.storage" && parts[0] != "db.storagesh" {
+		return nil, fmt.Errorf("unsupported table %v, only db.storage and db.storagesh records can be debugged", parts[0])
+	}
+	selector := &debugRecordSelector{table: parts[0]}
+	if lineNumber, err := strconv.Atoi(parts[1]); err == nil {
+		selector.lineNumber = lineNumber
+	} else {
+		selector.librarianFile = parts[1]
+	}
+	return selector, nil
+}
+
+// Splits the filename back out of the space-separated journal fields.
+// Returns the number of extra parts the filename has been split into.
+func filenameExtraPartCount(parts []string) int {
+	// The filename is the only part of the line that may contain spaces.
+	// That means that if a filename contained spaces, we'd have more fields than expected.
+	// We can find how many pieces the filename has been split into by computing the difference.
+	return len(parts) - DbStorageJournalFieldCount
+}
+
+func parseDbStorageRecord(parts []string) (*DbStorageRecord, error) {
+	filenameExtraPartCount := filenameExtraPartCount(parts)
+	if filenameExtraPartCount < 1 {
+		return nil, fmt.Errorf("expected at least %v fields, got %v", DbStorageJournalFieldCount+1, len(parts))
+	}
+
+	record := &DbStorageRecord{}
+	record.LibrarianFile = strings.Join(parts[DbStorageFieldFileMarker:DbStorageFieldFileMarker+filenameExtraPartCount], " ")
+	record.LibrarianFile = strings.Trim(record.LibrarianFile, "@")
+
+	record.LibrarianRevision = parts[DbStorageFieldRev+filenameExtraPartCount]
+
+	var err error
+	record.FileType, err = strconv.ParseUint(parts[DbStorageFieldType+filenameExtraPartCount], 10, 64)
 	if err != nil {
-		return fmt.Errorf("open file error: %v", err)
+		return nil, fmt.Errorf("could not parse file type: %v", parts[DbStorageFieldType+filenameExtraPartCount])
 	}
-	defer file.Close()
 
-	fileCount := 0
+	record.ReferenceCount, err = strconv.Atoi(parts[DbStorageFieldRefCount+filenameExtraPartCount])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse reference count: %v", parts[DbStorageFieldRefCount+filenameExtraPartCount])
+	}
 
-	csvWriter := csv.NewWriter(os.Stdout)
-	csvWriter.Write([]string{
-		"LibrarianFile",
-		"LibrarianRevision",
-		"FileType",
-		"ServerFileType",
-		"ServerFileTypeModifier",
-		"RevisionsNumber",
-		"ClientFileType",
-		"ServerFileModifier",
-		"ReferenceCount",
-		"MD5OfLibrarianFile",
-		"FileSize",
-		"FileSizeOnServer",
-		"DigestOfCompressedFile",
-		"LastUpdateDate"})
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, " ")
-		if len(parts) < 4 {
-			continue
-		}
-		if parts[0] != "@pv@" {
-			continue
-		}
-		if parts[2] != "@db.storage@" {
-			continue
-		}
+	record.Digest = parts[DbStorageFieldDigest+filenameExtraPartCount]
+
+	record.Size, err = strconv.ParseInt(parts[DbStorageFieldSize+filenameExtraPartCount], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse size: %v", parts[DbStorageFieldSize+filenameExtraPartCount])
+	}
 
-		// The filename is the only part of the line that may contain spaces.
-		// That means that if a filename contained spaces, we'd have more fields than expected.
-		// We can find how many pieces the filename has been split into by computing the difference.
-		filenameExtraPartCount := len(parts) - DbStorageJournalFieldCount
+	record.ServerSize, err = strconv.ParseInt(parts[DbStorageFieldServerSize+filenameExtraPartCount], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse server size: %v", parts[DbStorageFieldServerSize+filenameExtraPartCount])
+	}
 
-		filename := strings.Join(parts[DbStorageFieldFileMarker:DbStorageFieldFileMarker+filenameExtraPartCount], " ")
-		filename = strings.Trim(filename, "@")
+	record.CompressedDigest = parts[DbStorageFieldCompCksum+filenameExtraPartCount]
 
-		revision := parts[DbStorageFieldRev+filenameExtraPartCount]
-		fileType, err := strconv.ParseUint(parts[DbStorageFieldType+filenameExtraPartCount], 10, 64)
-		if err != nil {
-			glog.Warningf("WARNING: Could not parse file type: %v", parts[DbStorageFieldType+filenameExtraPartCount])
-			continue
-		}
+	record.Date, err = strconv.Atoi(parts[DbStorageFieldDate+filenameExtraPartCount])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse date: %v", parts[DbStorageFieldDate+filenameExtraPartCount])
+	}
 
-		refCount, err := strconv.Atoi(parts[DbStorageFieldRefCount+filenameExtraPartCount])
-		if err != nil {
-			glog.Warningf("WARNING: Could not parse reference count: %v", parts[DbStorageFieldRefCount+filenameExtraPartCount])
-			continue
+	return record, nil
+}
+
+// Writes everything we know about how a record was parsed, to diagnose field misalignment
+func dumpRecord(w io.Writer, lineNumber int, line string, parts []string, record *DbStorageRecord, parseErr error) {
+	fmt.Fprintf(w, "Line %v\n", lineNumber)
+	fmt.Fprintf(w, "Raw: %q\n", line)
+	fmt.Fprintf(w, "Fields (%v):\n", len(parts))
+	for i, part := range parts {
+		fmt.Fprintf(w, "  [%v] %q\n", i, part)
+	}
+	fmt.Fprintf(w, "Schema version: %v (%v fields expected, filename split into %v parts)\n",
+		parts[1], DbStorageJournalFieldCount+1, filenameExtraPartCount(parts))
+	if parseErr != nil {
+		fmt.Fprintf(w, "Decode error: %v\n", parseErr)
+	} else {
+		fmt.Fprintf(w, "Decoded: %+v\n", *record)
+	}
+	fmt.Fprintln(w)
+}
+
+// A line scanner that keeps track of line numbers and byte offsets, for error reporting
+type journalScanner struct {
+	*bufio.Scanner
+	lineNumber int
+	lineOffset int64
+	nextOffset int64
+}
+
+func newJournalScanner(file io.Reader) *journalScanner {
+	js := &journalScanner{Scanner: bufio.NewScanner(file)}
+	js.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			js.lineOffset = js.nextOffset
+			// ScanLines only drops one \r, journals converted twice by Windows tools have more
+			token = bytes.TrimRight(token, "\r")
 		}
+		js.nextOffset += int64(advance)
+		return advance, token, err
+	})
+	return js
+}
+
+func (js *journalScanner) Scan() bool {
+	if !js.Scanner.Scan() {
+		return false
+	}
+	js.lineNumber++
+	return true
+}
 
-		digest := parts[DbStorageFieldDigest+filenameExtraPartCount]
+// Decides what happens to records that can't be parsed.
+// In strict mode, the first malformed record aborts processing.
+// Otherwise malformed records are counted and optionally copied to a quarantine file for inspection.
+type malformedRecordHandler struct {
+	strict     bool
+	count      int
+	quarantine *output.File
+}
 
-		size, err := strconv.ParseInt(parts[DbStorageFieldSize+filenameExtraPartCount], 10, 64)
-		if err != nil {
-			glog.Warningf("WARNING: Could not parse size: %v", parts[DbStorageFieldSize+filenameExtraPartCount])
+func (h *malformedRecordHandler) handle(line journalLine, err error) error {
+	h.count++
+	if h.strict {
+		return fmt.Errorf("malformed record at line %v (byte offset %v): %v", line.number, line.offset, err)
+	}
+	slog.Warn("Skipping malformed record", logging.LineKey, line.number, logging.OffsetKey, line.offset,
+		logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+	if h.quarantine != nil {
+		h.quarantine.WriteString(line.text)
+		h.quarantine.WriteString("\n")
+	}
+	return nil
+}
+
+// Archive classes reported in the ArchiveClass column
+const (
+	SubmittedArchiveClass = "submitted"
+	TempObjArchiveClass   = "tempobj"
+	ShelvedArchiveClass   = "shelved"
+)
+
+// The journal fields of the db.revsh table holding the librarian file and revision of shelved files.
+// See https://www.perforce.com/perforce/doc.current/schema/#db.revsh.
+const (
+	DbRevShFieldLbrFile = 14
+	DbRevShFieldLbrRev  = 15
+)
+
+// Upper bounds (in days) of the age buckets in the archive accounting summary
+var ageBucketDays = []int{30, 90, 365, 2 * 365, 5 * 365}
+
+type archiveClassTotals struct {
+	count      int
+	bytes      int64
+	ageBuckets []int64
+}
+
+// Classifies archives as submitted, temporary objects or shelved, and accumulates per-class totals.
+// Shelved archives are identified from db.revsh, which precedes db.storage in checkpoints.
+type archiveAccounting struct {
+	now             time.Time
+	shelfMaxAge     time.Duration
+	shelvedArchives map[string]bool
+	totals          map[string]*archiveClassTotals
+	cleanupCount    int
+	cleanupBytes    int64
+	// Archive bytes per depot
+	depotBytes map[string]int64
+}
+
+func newArchiveAccounting(now time.Time, shelfMaxAge time.Duration) *archiveAccounting {
+	return &archiveAccounting{
+		now:             now,
+		shelfMaxAge:     shelfMaxAge,
+		shelvedArchives: make(map[string]bool),
+		totals:          make(map[string]*archiveClassTotals),
+		depotBytes:      make(map[string]int64),
+	}
+}
+
+func (a *archiveAccounting) addShelvedRevision(fields []string) {
+	if len(fields) <= DbRevShFieldLbrRev {
+		return
+	}
+	a.shelvedArchives[fields[DbRevShFieldLbrFile]+"\x00"+fields[DbRevShFieldLbrRev]] = true
+}
+
+// Returns the class of the archive, and whether it's a shelf old enough to be a cleanup candidate
+func (a *archiveAccounting) classify(record *DbStorageRecord) (string, bool) {
+	class := SubmittedArchiveClass
+	serverFileType := ServerStorageType(record.FileType & uint64(FileTypeBitMaskServerStorageType))
+	if record.ShelvedStorage || a.shelvedArchives[record.LibrarianFile+"\x00"+strings.Trim(record.LibrarianRevision, "@")] {
+		class = ShelvedArchiveClass
+	} else if serverFileType == TempObjServerStorageType || serverFileType == CompressedTempObjServerStorageType {
+		class = TempObjArchiveClass
+	}
+
+	age := a.now.Sub(time.Unix(int64(record.Date), 0))
+
+	totals, ok := a.totals[class]
+	if !ok {
+		totals = &archiveClassTotals{ageBuckets: make([]int64, len(ageBucketDays)+1)}
+		a.totals[class] = totals
+	}
+	totals.count++
+	totals.bytes += record.ServerSize
+	a.depotBytes[archive.DepotName(record.LibrarianFile)] += record.ServerSize
+	bucket := 0
+	for bucket < len(ageBucketDays) && age > time.Duration(ageBucketDays[bucket])*24*time.Hour {
+		bucket++
+	}
+	totals.ageBuckets[bucket] += record.ServerSize
+
+	cleanupCandidate := class == ShelvedArchiveClass && a.shelfMaxAge > 0 && age > a.shelfMaxAge
+	if cleanupCandidate {
+		a.cleanupCount++
+		a.cleanupBytes += record.ServerSize
+	}
+	return class, cleanupCandidate
+}
+
+func (a *archiveAccounting) logSummary() {
+	for _, class := range []string{SubmittedArchiveClass, TempObjArchiveClass, ShelvedArchiveClass} {
+		totals, ok := a.totals[class]
+		if !ok {
 			continue
 		}
+		slog.Info("Archives", "class", class, logging.CountKey, totals.count, logging.BytesKey, totals.bytes)
+		lower := 0
+		for bucket, bytes := range totals.ageBuckets {
+			if bucket < len(ageBucketDays) {
+				slog.Info("Archive age", "class", class, "min_days", lower, "max_days", ageBucketDays[bucket], logging.BytesKey, bytes)
+				lower = ageBucketDays[bucket]
+			} else {
+				slog.Info("Archive age", "class", class, "min_days", lower, logging.BytesKey, bytes)
+			}
+		}
+	}
+	if a.shelfMaxAge > 0 {
+		slog.Info("Shelf cleanup candidates", logging.CountKey, a.cleanupCount, logging.BytesKey, a.cleanupBytes)
+	}
+}
 
-		serverSize, err := strconv.ParseInt(parts[DbStorageFieldServerSize+filenameExtraPartCount], 10, 64)
-		if err != nil {
-			glog.Warningf("WARNING: Could not parse server size: %v", parts[DbStorageFieldServerSize+filenameExtraPartCount])
-			continue
+// Sends the per-class and per-depot archive totals
+func (a *archiveAccounting) emitMetrics(emitter *metrics.Emitter) {
+	for class, totals := range a.totals {
+		emitter.Gauge("archives."+class+".files", int64(totals.count))
+		emitter.Gauge("archives."+class+".bytes", totals.bytes)
+	}
+	for depot, bytes := range a.depotBytes {
+		emitter.Gauge("depot."+metrics.Sanitize(depot)+".bytes", bytes)
+	}
+	if a.shelfMaxAge > 0 {
+		emitter.Gauge("shelf_cleanup.files", int64(a.cleanupCount))
+		emitter.Gauge("shelf_cleanup.bytes", a.cleanupBytes)
+	}
+}
+
+// The columns of the CSV. Version 2 added the archive classes, version 3 the archive states,
+// version 4 the origin of the records and version 5 the RFC 3339 dates;
+// -schema-version writes the layout of an older version for loaders that haven't been updated.
+var storageSchema = output.Schema{Tool: "p4_storage_to_csv", Columns: []output.Column{
+	{Name: "LibrarianFile", Type: "string", Description: "Path of the archive (lbrFile), relative to the depot root", Since: 1},
+	{Name: "LibrarianRevision", Type: "string", Description: "Revision of the archive (lbrRev)", Since: 1},
+	{Name: "FileType", Type: "hex", Description: "Librarian file type (lbrType)", Since: 1},
+	{Name: "ServerFileType", Type: "hex", Description: "Server storage type bits of FileType", Since: 1},
+	{Name: "ServerFileTypeModifier", Type: "hex", Description: "Server storage type modifier bits of FileType", Since: 1},
+	{Name: "RevisionsNumber", Type: "hex", Description: "Number of revisions kept (+S) bits of FileType", Since: 1},
+	{Name: "ClientFileType", Type: "hex", Description: "Client file type bits of FileType", Since: 1},
+	{Name: "ServerFileModifier", Type: "hex", Description: "Client file type modifier bits of FileType", Since: 1},
+	{Name: "ReferenceCount", Type: "hex", Description: "Number of revisions referring to the archive", Since: 1},
+	{Name: "MD5OfLibrarianFile", Type: "string", Description: "MD5 digest of the revision content", Since: 1},
+	{Name: "FileSize", Type: "integer", Description: "Size of the revision content in bytes", Since: 1},
+	{Name: "FileSizeOnServer", Type: "integer", Description: "Size of the archive as stored in bytes", Since: 1},
+	{Name: "DigestOfCompressedFile", Type: "string", Description: "MD5 digest of the compressed archive", Since: 1},
+	{Name: "LastUpdateDate", Type: "timestamp", Description: "Date of the last update of the record, in seconds since the epoch", Since: 1},
+	{Name: "ArchiveClass", Type: "string", Description: "submitted, tempobj or shelved", Since: 2},
+	{Name: "CleanupCandidate", Type: "boolean", Description: "Whether the archive is a shelf older than -shelf-max-age", Since: 2},
+	{Name: "ArchiveExpected", Type: "boolean", Description: "Whether the archive should exist, empty when the state is unknown", Since: 3},
+	{Name: "ArchiveState", Type: "string", Description: "expected, purged, trimmed, archived or unknown", Since: 3},
+	{Name: "ShelvedStorage", Type: "boolean", Description: "Whether the record comes from db.storagesh, the storage of shelved files", Since: 4},
+	{Name: "LastUpdateTime", Type: "string", Description: "LastUpdateDate as an RFC 3339 timestamp in the time zone of -tz (UTC by default)", Since: 5},
+}}
+
+// Processes a Helix Core checkpoint or journal and verifies all files listed in the db.storage table
+func processDbStorageEntries(journalPath string, rows rowWriter, schema output.Schema, debugRecord *debugRecordSelector,
+	malformed *malformedRecordHandler, accounting *archiveAccounting, states *archiveStates, window archive.DateWindow,
+	workers int, maxLineBytes int) error {
+	file, err := journal.Open(journalPath)
+	if err != nil {
+		return fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	fileCount := 0
+	outOfWindow := 0
+	stateCounts := make(map[archiveState]int)
+
+	if debugRecord == nil {
+		if err := rows.Write(schema.Header()); err != nil {
+			return err
 		}
+	}
 
-		compCksum := parts[DbStorageFieldCompCksum+filenameExtraPartCount]
+	// Checkpoints of servers before 2019.1 only have db.rev
+	revCount, err := scanStorageLines(file, workers, maxLineBytes, debugRecord != nil, func(line *parsedLine) error {
+		if line.shelvedFields != nil {
+			accounting.addShelvedRevision(line.shelvedFields)
+			return nil
+		}
+		record, err := line.record, line.err
+
+		if debugRecord != nil {
+			if line.number == debugRecord.lineNumber || (len(debugRecord.librarianFile) > 0 &&
+				strings.Contains(line.text, "@"+debugRecord.table+"@") &&
+				strings.Contains(line.text, "@"+debugRecord.librarianFile+"@")) {
+				dumpRecord(os.Stdout, line.number, line.text, line.parts, record, err)
+				fileCount++
+			}
+			return nil
+		}
 
-		date, err := strconv.Atoi(parts[DbStorageFieldDate+filenameExtraPartCount])
 		if err != nil {
-			glog.Warningf("WARNING: Could not parse date size: %v", parts[DbStorageFieldDate+filenameExtraPartCount])
-			continue
+			return malformed.handle(line.journalLine, err)
+		}
+		if !window.Contains(int64(record.Date)) {
+			outOfWindow++
+			return nil
 		}
 
-		serverFileType := ServerStorageType(fileType & uint64(FileTypeBitMaskServerStorageType))
-		serverFileTypeModifier := ServerStorageTypeModifier(fileType & FileTypeBitMaskServerStorageTypeModifier)
-		revisionsNumber := RevisionsNumber(fileType & FileTypeBitMaskRevisionsNumber)
-		clientFileType := ClientStorageType(fileType & FileTypeBitMaskClientStorageType)
-		clientFileTypeModifier := ClientStorageTypeModifier(fileType & FileTypeBitMaskClientStorageTypeModifier)
-
-		csvWriter.Write([]string{
-			filename,
-			revision,
-			strconv.FormatUint(fileType, 16),
-			strconv.FormatInt(int64(serverFileType), 16),
-			strconv.FormatInt(int64(serverFileTypeModifier), 16),
-			strconv.FormatInt(int64(revisionsNumber), 16),
-			strconv.FormatInt(int64(clientFileType), 16),
-			strconv.FormatInt(int64(clientFileTypeModifier), 16),
-			strconv.FormatInt(int64(refCount), 16),
-			digest,
-			strconv.FormatInt(size, 10),
-			strconv.FormatInt(serverSize, 10),
-			compCksum,
-			strconv.FormatInt(int64(date), 10)})
-
-		if err := csvWriter.Error(); err != nil {
-			glog.Errorf("error writing csv:", err)
+		archiveClass, cleanupCandidate := accounting.classify(record)
+		state := UnknownArchiveState
+		if states != nil {
+			state = states.state(record)
+		}
+		stateCounts[state]++
+
+		err = rows.Write(schema.Row(append(line.columns,
+			archiveClass,
+			strconv.FormatBool(cleanupCandidate),
+			state.expected(),
+			state.String(),
+			strconv.FormatBool(record.ShelvedStorage),
+			output.FormatTimestamp(int64(record.Date)))))
+		if err != nil {
+			return err
 		}
 
 		fileCount++
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	csvWriter.Flush()
-	glog.Infof("Processed %v files\n", fileCount)
+	if debugRecord != nil {
+		slog.Info("Dumped records", logging.CountKey, fileCount)
+	} else {
+		slog.Info("Processed files", logging.CountKey, fileCount)
+		if !window.IsZero() {
+			slog.Info("Records dated outside of -since/-until", logging.CountKey, outOfWindow)
+		}
+		accounting.logSummary()
+		for state := UnknownArchiveState; state <= ExpectedArchiveState; state++ {
+			if stateCounts[state] > 0 {
+				slog.Info("Archive states", "state", state.String(), logging.CountKey, stateCounts[state])
+			}
+		}
+	}
 
+	if fileCount+outOfWindow == 0 && revCount > 0 && debugRecord == nil {
+		return fmt.Errorf("no db.storage records, but %v db.rev records: servers before 2019.1 have no db.storage table", revCount)
+	}
 	return nil
 }
 
 func main() {
-	// glog to both stderr and to file
-	flag.Set("alsologtostderr", "true")
+	flags := struct {
+		debugRecord   string
+		strict        bool
+		quarantine    string
+		shelfMaxAge   int
+		outputDir     string
+		rotateRows    float64
+		rotateSize    float64
+		statsd        string
+		graphite      string
+		metricsPrefix string
+		output        string
+		format        string
+		archiveState  bool
+		schemaVersion int
+		printSchema   bool
+		workers       int
+		since         string
+		until         string
+	}{}
+
+	flag.StringVar(&flags.debugRecord, "debug-record", "",
+		"Dump how the record <table>:<line-number-or-key> is parsed instead of writing CSV.")
+	flag.BoolVar(&flags.strict, "strict", false, "Abort on the first malformed record instead of skipping it.")
+	flag.StringVar(&flags.quarantine, "quarantine", "", "File to copy skipped malformed records to.")
+	flag.IntVar(&flags.shelfMaxAge, "shelf-max-age", 365, "Age in days after which shelved archives are cleanup candidates (0 to disable).")
+	flag.StringVar(&flags.output, "output", output.Stdout,
+		"File or table to write the rows to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage())
+	flag.StringVar(&flags.outputDir, "output-dir", "", "Directory to write gzip compressed CSV files to, instead of the standard output.")
+	flag.Float64Var(&flags.rotateRows, "rotate-rows", 10, "Millions of rows after which -output-dir starts a new file (0 for no limit).")
+	flag.Float64Var(&flags.rotateSize, "rotate-size", 1, "Compressed GB after which -output-dir starts a new file (0 for no limit).")
+	flag.StringVar(&flags.statsd, "statsd", "", "StatsD host:port to send archive totals to.")
+	flag.StringVar(&flags.graphite, "graphite", "", "Graphite plaintext host:port to send archive totals to.")
+	flag.StringVar(&flags.metricsPrefix, "metrics-prefix", "perforce.storage", "Prefix of the metric names.")
+	flag.BoolVar(&flags.archiveState, "archive-state", true,
+		"Read db.rev first to report whether each archive is expected to exist (reads the input twice).")
+	flag.StringVar(&flags.since, "since", "", "Only extract the records dated from this date (2006-01-02), time (RFC 3339) or duration before now (7d, 36h).")
+	flag.StringVar(&flags.until, "until", "", "Only extract the records dated before this date, time or duration before now, as -since.")
+	flag.IntVar(&flags.workers, "workers", runtime.NumCPU(), "Number of goroutines parsing records.")
+
+	flag.IntVar(&flags.schemaVersion, "schema-version", storageSchema.Latest(), "Version of the CSV layout to write, for loaders expecting an older one.")
+	flag.BoolVar(&flags.printSchema, "print-schema", false, "Print the schema of the CSV as JSON and exit.")
+	output.RegisterTimeZoneFlag(flag.CommandLine)
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
 
 	flag.Parse()
+	if err := logging.Setup(false); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	schema, err := storageSchema.Select(flags.schemaVersion)
+	if err != nil {
+		logging.Fatal("Invalid -schema-version", logging.Err(err))
+	}
+	// The line scanner of db.storage reads lines up to the limit of the journal package
+	maxLineBytes := journal.MaxLineBytes()
+	if maxLineBytes < 0 {
+		logging.Fatal("Invalid -max-line-bytes", slog.Int("value", maxLineBytes))
+	}
+	if maxLineBytes == 0 {
+		maxLineBytes = math.MaxInt
+	}
+	if err := output.CheckTimeZone(); err != nil {
+		logging.Fatal("Invalid -tz", logging.Err(err))
+	}
+	if flags.printSchema {
+		if err := schema.Write(os.Stdout); err != nil {
+			logging.Fatal("Error writing schema", logging.Err(err))
+		}
+		return
+	}
 	if flag.NArg() < 1 {
-		glog.Errorf("Insufficient number or arguments specified")
-		os.Exit(1)
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if len(flags.outputDir) > 0 && flags.format != "csv" {
+		logging.Fatal("-output-dir only writes csv files", "format", flags.format)
+	}
+
+	window, err := archive.ParseDateWindow(flags.since, flags.until, time.Now())
+	if err != nil {
+		logging.Fatal("Invalid date window", logging.Err(err))
+	}
+
+	var debugRecord *debugRecordSelector
+	if len(flags.debugRecord) > 0 {
+		var err error
+		if debugRecord, err = parseDebugRecordSelector(flags.debugRecord); err != nil {
+			logging.Fatal("Invalid -debug-record", logging.Err(err))
+		}
+	}
+
+	emitter, err := metrics.Dial(flags.statsd, flags.graphite, flags.metricsPrefix)
+	if err != nil {
+		logging.Fatal("Could not connect to the metrics servers", logging.Err(err))
 	}
 
 	start := time.Now()
-	err := processDbStorageEntries(flag.Arg(0))
+	var states *archiveStates
+	if flags.archiveState && debugRecord == nil {
+		if flag.Arg(0) == journal.Stdin {
+			slog.Warn("Archive states can't be determined from the standard input, which can only be read once")
+		} else if states, err = readArchiveStates(flag.Arg(0)); err != nil {
+			logging.Fatal("Error reading db.rev", logging.Err(err))
+		}
+	}
+
+	var rows rowWriter
+	var outputWriter output.Writer
+	var chunks *rotatingWriter
+	if len(flags.outputDir) > 0 && debugRecord == nil {
+		chunks, err = newRotatingWriter(flags.outputDir, "storage", int64(flags.rotateRows*1e6), int64(flags.rotateSize*(1<<30)))
+		if err != nil {
+			logging.Fatal("Error creating output directory", logging.PathKey, flags.outputDir, logging.Err(err))
+		}
+		// The files are completed one after the other, so the schema is written first
+		if err := output.WriteSchema(filepath.Join(flags.outputDir, "storage"), schema); err != nil {
+			logging.Fatal("Error writing schema", logging.Err(err))
+		}
+		rows = chunks
+	} else {
+		if debugRecord != nil {
+			flags.output, flags.format = output.Stdout, "csv"
+		}
+		table := output.Table{Name: "storage", Schema: schema}
+		if outputWriter, err = output.NewWriter(flags.format, flags.output, table); err != nil {
+			logging.Fatal("Error creating output", logging.Err(err))
+		}
+		rows = outputWriter
+	}
+
+	// Created last, as the fatal errors before the processing would leave its temporary file
+	malformed := &malformedRecordHandler{strict: flags.strict}
+	if len(flags.quarantine) > 0 {
+		if malformed.quarantine, err = output.Create(flags.quarantine); err != nil {
+			logging.Fatal("Error creating quarantine file", logging.Err(err))
+		}
+	}
+
+	accounting := newArchiveAccounting(start, time.Duration(flags.shelfMaxAge)*24*time.Hour)
+	err = processDbStorageEntries(flag.Arg(0), rows, schema, debugRecord, malformed, accounting, states, window, flags.workers, maxLineBytes)
+	// os.Exit at the end of failed runs skips deferred calls
+	if outputWriter != nil && err != nil {
+		outputWriter.Close()
+	} else if outputWriter != nil {
+		if err = outputWriter.Commit(); err != nil {
+			slog.Error("Error writing output", logging.Err(err))
+		} else if flags.format == "csv" && flags.output != output.Stdout && len(flags.output) > 0 {
+			// The schema describes the new file, so it's only replaced once the file is
+			if err = output.WriteSchema(flags.output, schema); err != nil {
+				slog.Error("Error writing schema", logging.Err(err))
+			}
+		}
+	}
+	if chunks != nil && err != nil {
+		count := chunks.Abort()
+		slog.Warn("Discarded the last, incomplete output file", logging.PathKey, flags.outputDir, "kept", count)
+	} else if chunks != nil {
+		count, closeErr := chunks.Close()
+		if closeErr != nil {
+			slog.Error("Error writing output files", logging.PathKey, flags.outputDir, logging.Err(closeErr))
+			err = closeErr
+		} else {
+			slog.Info("Wrote output files", logging.PathKey, flags.outputDir, logging.CountKey, count)
+		}
+	}
 	if err != nil {
-		glog.Errorf("Error processing storage entries: %v\n", err)
+		slog.Error("Error processing storage entries", logging.Err(err))
+	} else if debugRecord == nil {
+		accounting.emitMetrics(emitter)
+	}
+
+	if malformed.count > 0 {
+		slog.Warn("Skipped malformed records", logging.CountKey, malformed.count)
+	}
+	// The records quarantined before a failure are still worth inspecting
+	if malformed.quarantine != nil {
+		if commitErr := malformed.quarantine.Commit(); commitErr != nil {
+			slog.Error("Error writing quarantine file", logging.Err(commitErr))
+			err = commitErr
+		}
 	}
 
 	elapsed := time.Since(start)
-	glog.Infof("Execution took %s\n", elapsed)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+
+	emitter.Timing("duration", elapsed)
+	if metricsErr := emitter.Close(); metricsErr != nil {
+		slog.Warn("Could not send metrics", logging.Err(metricsErr))
+	}
 
 	if err != nil {
 		os.Exit(1)
@@ -0,0 +1,149 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+)
+
+// Keeps the rows written, in place of a file
+type rowsWriter struct{ rows [][]string }
+
+func (w *rowsWriter) Write(row []string) error { w.rows = append(w.rows, row); return nil }
+
+func process(t *testing.T, journalPath string, malformed *malformedRecordHandler, version int) ([][]string, error) {
+	t.Helper()
+	states, err := readArchiveStates(journalPath)
+	if err != nil {
+		t.Fatalf("readArchiveStates() returned %v", err)
+	}
+	schema, err := storageSchema.Select(version)
+	if err != nil {
+		t.Fatalf("Select(%v) returned %v", version, err)
+	}
+	rows := &rowsWriter{}
+	accounting := newArchiveAccounting(time.Unix(1611008050, 0), 0)
+	err = processDbStorageEntries(journalPath, rows, schema, nil, malformed, accounting, states, archive.DateWindow{}, 2, 1<<20)
+	return rows.rows, err
+}
+
+func TestProcessDbStorageEntries(t *testing.T) {
+	rows, err := process(t, "example_journal.txt", &malformedRecordHandler{}, storageSchema.Latest())
+	if err != nil {
+		t.Fatalf("processDbStorageEntries() returned %v", err)
+	}
+	if len(rows) != 7 {
+		t.Fatalf("processDbStorageEntries() wrote %v rows, want the header and 6 records", len(rows))
+	}
+	if !reflect.DeepEqual(rows[0], storageSchema.Header()) {
+		t.Errorf("processDbStorageEntries() wrote the header %q, want %q", rows[0], storageSchema.Header())
+	}
+	want := [][]string{
+		{"//depot/path1/data1.dat", "@1.1@", "10003", "3", "0", "0", "10000", "0", "1", "F1C9645DBC14EFDDC7D8A322685F26EB",
+			"10485760", "10221", "00000000000000000000000000000000", "1611008038", "submitted", "false", "true", "expected",
+			"false", "2021-01-18T22:13:58Z"},
+		{"//depot/path1/README.txt", "@1.2@", "0", "0", "0", "0", "0", "0", "1", "E58A41657AB37F063690AD6A2FB1B3B6",
+			"15", "348", "00000000000000000000000000000000", "1611008040", "submitted", "false", "true", "expected",
+			"false", "2021-01-18T22:14:00Z"},
+	}
+	if got := [][]string{rows[1], rows[5]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("processDbStorageEntries() wrote %q, want %q", got, want)
+	}
+
+	// The layout of the first version has no archive classes, states nor timestamps
+	rows, err = process(t, "example_journal.txt", &malformedRecordHandler{}, 1)
+	if err != nil {
+		t.Fatalf("processDbStorageEntries() returned %v", err)
+	}
+	if got := rows[1]; !reflect.DeepEqual(got, want[0][:14]) {
+		t.Errorf("processDbStorageEntries() with version 1 wrote %q, want %q", got, want[0][:14])
+	}
+}
+
+func TestProcessMalformedRecords(t *testing.T) {
+	example, err := os.ReadFile("example_journal.txt")
+	if err != nil {
+		t.Fatalf("ReadFile() returned %v", err)
+	}
+	malformedLine := "@pv@ 1 @db.storage@ @//depot/path1/bad.dat@ @1.1@ binary 1 F1C9645DBC14EFDDC7D8A322685F26EB 10 10 0 1611008038 "
+	journalPath := filepath.Join(t.TempDir(), "journal")
+	if err := os.WriteFile(journalPath, append(example, malformedLine+"\n"...), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+
+	malformed := &malformedRecordHandler{}
+	rows, err := process(t, journalPath, malformed, storageSchema.Latest())
+	if err != nil {
+		t.Fatalf("processDbStorageEntries() returned %v", err)
+	}
+	if len(rows) != 7 || malformed.count != 1 {
+		t.Errorf("processDbStorageEntries() wrote %v rows and skipped %v records, want 7 and 1", len(rows), malformed.count)
+	}
+
+	if _, err := process(t, journalPath, &malformedRecordHandler{strict: true}, storageSchema.Latest()); err == nil ||
+		!strings.Contains(err.Error(), "malformed record") {
+		t.Errorf("processDbStorageEntries() in strict mode returned %v, want a malformed record error", err)
+	}
+}
+
+func TestParseDbStorageRecord(t *testing.T) {
+	line := "@pv@ 1 @db.storage@ @//depot/with two spaces.txt@ @1.1@ 0 2 271E0A48226C79CCA6C1FCDE43CDAC31 9 203 00000000000000000000000000000000 1611008038 "
+	record, err := parseDbStorageRecord(strings.Split(line, " "))
+	if err != nil {
+		t.Fatalf("parseDbStorageRecord() returned %v", err)
+	}
+	if record.LibrarianFile != "//depot/with two spaces.txt" || record.LibrarianRevision != "@1.1@" ||
+		record.ReferenceCount != 2 || record.Size != 9 || record.ServerSize != 203 || record.Date != 1611008038 {
+		t.Errorf("parseDbStorageRecord() = %+v", record)
+	}
+
+	if _, err := parseDbStorageRecord(strings.Split("@pv@ 1 @db.storage@ @//depot/a@ @1.1@", " ")); err == nil {
+		t.Errorf("parseDbStorageRecord() of a truncated record succeeded, want an error")
+	}
+}
+
+func TestParseDebugRecordSelector(t *testing.T) {
+	tests := []struct {
+		value string
+		want  *debugRecordSelector
+	}{
+		{"db.storage:160", &debugRecordSelector{table: "db.storage", lineNumber: 160}},
+		{"db.storagesh://depot/path1/data1.dat", &debugRecordSelector{table: "db.storagesh", librarianFile: "//depot/path1/data1.dat"}},
+		{"db.rev:160", nil},
+		{"db.storage:", nil},
+		{"160", nil},
+	}
+	for _, test := range tests {
+		got, err := parseDebugRecordSelector(test.value)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("parseDebugRecordSelector(%q) succeeded, want an error", test.value)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseDebugRecordSelector(%q) = %+v, %v, want %+v", test.value, got, err, test.want)
+		}
+	}
+}
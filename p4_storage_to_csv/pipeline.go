@@ -0,0 +1,248 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+)
+
+const (
+	// Lines handed to a parser worker at once
+	batchSize = 4096
+	// The initial buffer of the line scanner, which grows up to -max-line-bytes for long records
+	// such as change descriptions
+	scannerBufferSize = 4 * 1024 * 1024
+)
+
+// A line of the journal, with its position for error reporting
+type journalLine struct {
+	text   string
+	number int
+	offset int64
+}
+
+// A db.storage, db.storagesh or db.revsh line, as parsed by a worker
+type parsedLine struct {
+	journalLine
+	// The fields of a db.revsh record
+	shelvedFields []string
+	// The decoded db.storage or db.storagesh record, or the error decoding it
+	record *DbStorageRecord
+	err    error
+	// The columns of the record that don't depend on the records before it
+	columns []string
+	// The space-separated parts of the line, kept for -debug-record only
+	parts []string
+}
+
+// Lines are parsed by batches, and the batches handed back in journal order
+type lineBatch struct {
+	lines  []journalLine
+	parsed []parsedLine
+	// Signaled by the worker once the batch is parsed
+	done chan struct{}
+}
+
+var batchPool = sync.Pool{New: func() interface{} {
+	return &lineBatch{
+		lines:  make([]journalLine, 0, batchSize),
+		parsed: make([]parsedLine, 0, batchSize),
+		done:   make(chan struct{}, 1),
+	}
+}}
+
+// Returns the quoted table name of a put value record, such as @db.storage@, without allocating
+func recordTable(line []byte) []byte {
+	if !bytes.HasPrefix(line, []byte("@pv@ ")) {
+		return nil
+	}
+	rest := line[len("@pv@ "):]
+	version := bytes.IndexByte(rest, ' ')
+	if version < 0 {
+		return nil
+	}
+	rest = rest[version+1:]
+	end := bytes.IndexByte(rest, ' ')
+	if end < 0 {
+		return nil
+	}
+	return rest[:end]
+}
+
+// Appends the space-separated parts of a line to parts, like strings.Split but reusing its array
+func splitParts(parts []string, line string) []string {
+	for {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return append(parts, line)
+		}
+		parts = append(parts, line[:i])
+		line = line[i+1:]
+	}
+}
+
+// Returns the columns of a db.storage record that only depend on the record itself
+func recordColumns(record *DbStorageRecord) []string {
+	fileType := record.FileType
+	serverFileType := ServerStorageType(fileType & uint64(FileTypeBitMaskServerStorageType))
+	serverFileTypeModifier := ServerStorageTypeModifier(fileType & FileTypeBitMaskServerStorageTypeModifier)
+	revisionsNumber := RevisionsNumber(fileType & FileTypeBitMaskRevisionsNumber)
+	clientFileType := ClientStorageType(fileType & FileTypeBitMaskClientStorageType)
+	clientFileTypeModifier := ClientStorageTypeModifier(fileType & FileTypeBitMaskClientStorageTypeModifier)
+	return append(make([]string, 0, len(storageSchema.Columns)),
+		record.LibrarianFile,
+		record.LibrarianRevision,
+		strconv.FormatUint(fileType, 16),
+		strconv.FormatInt(int64(serverFileType), 16),
+		strconv.FormatInt(int64(serverFileTypeModifier), 16),
+		strconv.FormatInt(int64(revisionsNumber), 16),
+		strconv.FormatInt(int64(clientFileType), 16),
+		strconv.FormatInt(int64(clientFileTypeModifier), 16),
+		strconv.FormatInt(int64(record.ReferenceCount), 16),
+		record.Digest,
+		strconv.FormatInt(record.Size, 10),
+		strconv.FormatInt(record.ServerSize, 10),
+		record.CompressedDigest,
+		strconv.FormatInt(int64(record.Date), 10))
+}
+
+// Parses a db.storage, db.storagesh or db.revsh line, splitting it into parts (returned for reuse)
+func parseLine(line journalLine, parts []string, keepParts bool) (parsedLine, []string) {
+	if !strings.HasSuffix(line.text, " ") {
+		// Records end with a space, which tools converting line endings may have stripped
+		line.text += " "
+	}
+	parsed := parsedLine{journalLine: line}
+	parts = splitParts(parts[:0], line.text)
+	if parts[2] == "@db.revsh@" {
+		parsed.shelvedFields = journal.Split(line.text)
+		return parsed, parts
+	}
+	parsed.record, parsed.err = parseDbStorageRecord(parts)
+	if parsed.err == nil {
+		parsed.record.ShelvedStorage = parts[2] == "@db.storagesh@"
+		parsed.columns = recordColumns(parsed.record)
+	}
+	if keepParts {
+		parsed.parts = append([]string(nil), parts...)
+	}
+	return parsed, parts
+}
+
+// Reads the db.storage, db.storagesh and db.revsh lines of a journal and parses them with a number of workers,
+// calling fn for each of them in journal order. Returns the number of db.rev records, to tell the
+// checkpoints of servers without db.storage apart.
+//
+// A reader goroutine picks the lines of these tables without allocating the others, the workers
+// split and decode batches of lines, and the calling goroutine handles them in order, as the
+// accounting and the CSV depend on it.
+//
+// Lines longer than maxLineBytes stop the scan with an error rather than ending it early.
+func scanStorageLines(r io.Reader, workers int, maxLineBytes int, keepParts bool, fn func(*parsedLine) error) (int, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	scanner := newJournalScanner(r)
+	scanner.Buffer(make([]byte, 0, min(scannerBufferSize, maxLineBytes)), maxLineBytes)
+
+	jobs := make(chan *lineBatch, workers*2)
+	ordered := make(chan *lineBatch, workers*4)
+	// Closed when fn fails, to stop the reader
+	stop := make(chan struct{})
+	revCount := 0
+	var scanErr error
+
+	go func() {
+		defer close(ordered)
+		defer close(jobs)
+		batch := batchPool.Get().(*lineBatch)
+		send := func() bool {
+			select {
+			case ordered <- batch:
+			case <-stop:
+				return false
+			}
+			select {
+			case jobs <- batch:
+			case <-stop:
+				return false
+			}
+			batch = batchPool.Get().(*lineBatch)
+			return true
+		}
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			switch string(recordTable(line)) {
+			case "@db.rev@":
+				revCount++
+				continue
+			case "@db.revsh@", "@db.storage@", "@db.storagesh@":
+			default:
+				continue
+			}
+			batch.lines = append(batch.lines, journalLine{text: string(line), number: scanner.lineNumber, offset: scanner.lineOffset})
+			if len(batch.lines) == batchSize && !send() {
+				return
+			}
+		}
+		scanErr = scanner.Err()
+		if errors.Is(scanErr, bufio.ErrTooLong) {
+			scanErr = fmt.Errorf("line %d at offset %d is longer than %d bytes, raise -max-line-bytes: %w",
+				scanner.lineNumber+1, scanner.nextOffset, maxLineBytes, scanErr)
+		}
+		if len(batch.lines) > 0 {
+			send()
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			var parts []string
+			for batch := range jobs {
+				for _, line := range batch.lines {
+					var parsed parsedLine
+					parsed, parts = parseLine(line, parts, keepParts)
+					batch.parsed = append(batch.parsed, parsed)
+				}
+				batch.done <- struct{}{}
+			}
+		}()
+	}
+
+	for batch := range ordered {
+		<-batch.done
+		for i := range batch.parsed {
+			if err := fn(&batch.parsed[i]); err != nil {
+				close(stop)
+				return 0, err
+			}
+		}
+		batch.lines = batch.lines[:0]
+		batch.parsed = batch.parsed[:0]
+		batchPool.Put(batch)
+	}
+	return revCount, scanErr
+}
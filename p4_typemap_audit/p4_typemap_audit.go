@@ -0,0 +1,242 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_typemap_audit compares the file types of the head revisions of a checkpoint with
+// the typemap, reporting the files whose type the typemap would set differently today, such as
+// images stored as text, and printing the p4 retype commands that would fix them.
+// It never connects to the server.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/lbr"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/schema"
+)
+
+// A file whose head revision has another type than the typemap gives it
+type violation struct {
+	depotFile string
+	headRev   int
+	actual    lbr.FileType
+	expected  lbr.FileType
+	entry     *typemapEntry
+}
+
+type auditOptions struct {
+	// Text files are stored as unicode by servers in unicode mode
+	unicodeServer bool
+}
+
+// Checks the head revision of each file of a checkpoint against the typemap. Deleted files are
+// skipped, as are the types that can't be decoded.
+func auditRevisions(checkpointPath string, m typemap, options auditOptions) ([]violation, int, error) {
+	var violations []violation
+	fileCount := 0
+	unsupportedTypes := make(map[int]bool)
+
+	// Checkpoints list the revisions of a file one after the other
+	var head *schema.Rev
+	checkHead := func() {
+		if head == nil || !archive.FileAction(head.Action).HasArchive() {
+			return
+		}
+		entry := m.lookup(head.DepotFile)
+		if entry == nil {
+			return
+		}
+		actual, err := lbr.DecodeFileType(head.Type)
+		if err != nil {
+			if !unsupportedTypes[head.Type] {
+				unsupportedTypes[head.Type] = true
+				slog.Warn("Skipping files of an unsupported type", logging.PathKey, head.DepotFile, logging.Err(err))
+			}
+			return
+		}
+		fileCount++
+		entry.fileCount++
+		expected := actual.With(entry.fileType)
+		if options.unicodeServer && actual.Base == "unicode" && expected.Base == "text" {
+			expected.Base = "unicode"
+		}
+		if expected != actual {
+			entry.violationCount++
+			violations = append(violations, violation{
+				depotFile: head.DepotFile,
+				headRev:   head.DepotRev,
+				actual:    actual,
+				expected:  expected,
+				entry:     entry,
+			})
+		}
+	}
+
+	err := journal.ScanFile(checkpointPath, map[string]bool{"db.rev": true}, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		var rev schema.Rev
+		if err := schema.Unmarshal(record, &rev); err != nil {
+			slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		if head != nil && head.DepotFile == rev.DepotFile {
+			if rev.DepotRev > head.DepotRev {
+				head = &rev
+			}
+			return nil
+		}
+		checkHead()
+		head = &rev
+		return nil
+	})
+	checkHead()
+	return violations, fileCount, err
+}
+
+// Quotes a file type or a depot path for a POSIX shell
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+func writeRetypeCommands(w io.Writer, violations []violation) error {
+	for _, v := range violations {
+		fmt.Fprintf(w, "p4 retype -t %v %v\n", shellQuote(v.expected.String()), shellQuote(v.depotFile))
+	}
+	return nil
+}
+
+func writeReport(out output.Writer, violations []violation) error {
+	out.Write([]string{
+		"DepotFile",
+		"HeadRev",
+		"Type",
+		"ExpectedType",
+		"TypemapEntry"})
+	for _, v := range violations {
+		out.Write([]string{
+			v.depotFile,
+			strconv.Itoa(v.headRev),
+			v.actual.String(),
+			v.expected.String(),
+			v.entry.text})
+	}
+	return nil
+}
+
+func main() {
+	flags := struct {
+		typemap         string
+		output          string
+		report          string
+		format          string
+		caseInsensitive bool
+		unicode         bool
+	}{}
+
+	flag.StringVar(&flags.typemap, "typemap", "", "Typemap spec, as written by \"p4 typemap -o\", instead of db.typemapx.")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File to write the p4 retype commands to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.report, "report", "", "File, or table for the database formats, to write the files whose type differs from the typemap to.")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage()+" For -report.")
+	flag.BoolVar(&flags.caseInsensitive, "case-insensitive", false, "Match typemap paths ignoring case, as case-insensitive servers do.")
+	flag.BoolVar(&flags.unicode, "unicode", false, "The server runs in unicode mode, storing text files as unicode.")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(false); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(flags.format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+	checkpointPath := flag.Arg(0)
+
+	start := time.Now()
+	var m typemap
+	var err error
+	if len(flags.typemap) > 0 {
+		var file *os.File
+		if file, err = os.Open(flags.typemap); err == nil {
+			m, err = readTypemapSpec(file, flags.caseInsensitive)
+			file.Close()
+		}
+	} else {
+		m, err = readTypemapTable(checkpointPath, flags.caseInsensitive)
+	}
+	if err != nil {
+		logging.Fatal("Error reading typemap", logging.Err(err))
+	}
+	if len(m) == 0 {
+		logging.Fatal("Empty typemap, -typemap can give the output of \"p4 typemap -o\"")
+	}
+
+	violations, fileCount, err := auditRevisions(checkpointPath, m, auditOptions{unicodeServer: flags.unicode})
+	if err != nil {
+		logging.Fatal("Error processing checkpoint", logging.PathKey, checkpointPath, logging.Err(err))
+	}
+	err = output.WriteFile(flags.output, func(w io.Writer) error {
+		return writeRetypeCommands(w, violations)
+	})
+	if err != nil {
+		logging.Fatal("Error writing commands", logging.Err(err))
+	}
+	if len(flags.report) > 0 {
+		err := output.WriteTable(flags.format, flags.report, output.Table{Name: "typemap_violations"}, func(out output.Writer) error {
+			return writeReport(out, violations)
+		})
+		if err != nil {
+			logging.Fatal("Error writing report", logging.PathKey, flags.report, logging.Err(err))
+		}
+	}
+
+	for _, entry := range m {
+		if !entry.exclude {
+			slog.Info("Typemap entry", "entry", entry.text, "files", entry.fileCount, "violations", entry.violationCount)
+		}
+	}
+	slog.Info("Checked files", logging.CountKey, fileCount, "violations", len(violations))
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+	if len(violations) > 0 {
+		os.Exit(2)
+	}
+}
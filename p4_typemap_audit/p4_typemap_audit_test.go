@@ -0,0 +1,108 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Keeps the rows written, in place of a file
+type rowsWriter struct{ rows [][]string }
+
+func (w *rowsWriter) Write(row []string) error { w.rows = append(w.rows, row); return nil }
+func (w *rowsWriter) Commit() error            { return nil }
+func (w *rowsWriter) Close() error             { return nil }
+
+const specTypemap = `# A comment
+TypeMap:
+	binary+l //....dat
+	text //....txt
+	text "//depot/path2/..."
+	text -//depot/path2/...
+
+Description:
+	binary //....txt
+`
+
+func TestAuditRevisions(t *testing.T) {
+	m, err := readTypemapSpec(strings.NewReader(specTypemap), false)
+	if err != nil {
+		t.Fatalf("readTypemapSpec() returned %v", err)
+	}
+	if len(m) != 4 {
+		t.Fatalf("readTypemapSpec() returned %v entries, want 4", len(m))
+	}
+	violations, fileCount, err := auditRevisions("../perforceutils/testdata/example_journal.txt", m, auditOptions{})
+	if err != nil {
+		t.Fatalf("auditRevisions() returned %v", err)
+	}
+	if fileCount != 3 {
+		t.Errorf("auditRevisions() checked %v files, want 3", fileCount)
+	}
+
+	out := &rowsWriter{}
+	if err := writeReport(out, violations); err != nil {
+		t.Fatalf("writeReport() returned %v", err)
+	}
+	want := [][]string{
+		{"DepotFile", "HeadRev", "Type", "ExpectedType", "TypemapEntry"},
+		{"//depot/path1/data1.dat", "2", "binary", "binary+l", "binary+l //....dat"},
+		{"//depot/path1/data2.dat", "1", "binary", "binary+l", "binary+l //....dat"},
+	}
+	if !reflect.DeepEqual(out.rows, want) {
+		t.Errorf("writeReport() wrote %q, want %q", out.rows, want)
+	}
+
+	var commands bytes.Buffer
+	if err := writeRetypeCommands(&commands, violations); err != nil {
+		t.Fatalf("writeRetypeCommands() returned %v", err)
+	}
+	if got, want := commands.String(), "p4 retype -t 'binary+l' '//depot/path1/data1.dat'\n"+
+		"p4 retype -t 'binary+l' '//depot/path1/data2.dat'\n"; got != want {
+		t.Errorf("writeRetypeCommands() wrote %q, want %q", got, want)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	m, err := readTypemapSpec(strings.NewReader(specTypemap), true)
+	if err != nil {
+		t.Fatalf("readTypemapSpec() returned %v", err)
+	}
+	tests := []struct {
+		depotFile string
+		want      string
+	}{
+		{"//depot/path1/data1.dat", "binary+l //....dat"},
+		{"//depot/path1/DATA1.DAT", "binary+l //....dat"},
+		{"//depot/path1/README.txt", "text //....txt"},
+		{"//Depot/Path2/More.txt", ""},
+		{"//depot/path2/data.dat", ""},
+		{"//depot/path1/Makefile", ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if entry := m.lookup(test.depotFile); entry != nil {
+			got = entry.text
+		}
+		if got != test.want {
+			t.Errorf("lookup(%q) = %q, want %q", test.depotFile, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/lbr"
+	"github.com/google/perforce-utils/perforceutils/schema"
+	"github.com/google/perforce-utils/perforceutils/wildcard"
+)
+
+// The mapFlag of map entries starting with "-"
+const excludeMapFlag = 1
+
+// A line of the typemap, such as "binary+l //....png"
+type typemapEntry struct {
+	text     string
+	fileType lbr.FileType
+	exclude  bool
+	path     *wildcard.Pattern
+
+	fileCount      int
+	violationCount int
+}
+
+func newTypemapEntry(fileType string, path string, caseInsensitive bool) (*typemapEntry, error) {
+	entry := &typemapEntry{text: fileType + " " + path}
+	if strings.HasPrefix(path, "-") {
+		entry.exclude = true
+		path = path[1:]
+	}
+	var err error
+	if entry.fileType, err = lbr.ParseFileType(fileType); err != nil {
+		return nil, err
+	}
+	if entry.path, err = wildcard.Compile(path, caseInsensitive); err != nil {
+		return nil, fmt.Errorf("invalid depot path %q: %v", path, err)
+	}
+	return entry, nil
+}
+
+// The entries of a typemap, in order
+type typemap []*typemapEntry
+
+// Returns the entry that applies to a depot file, the last one matching it as later lines override
+// earlier ones, or nil when none does or the file is excluded
+func (m typemap) lookup(depotFile string) *typemapEntry {
+	for i := len(m) - 1; i >= 0; i-- {
+		if m[i].path.Match(depotFile) {
+			if m[i].exclude {
+				return nil
+			}
+			return m[i]
+		}
+	}
+	return nil
+}
+
+// Splits a line of a spec into its words, which are quoted when they contain spaces
+func splitSpecLine(line string) []string {
+	var words []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if len(line) == 0 {
+			return words
+		}
+		end := strings.IndexAny(line, " \t")
+		if line[0] == '"' {
+			line = line[1:]
+			end = strings.IndexByte(line, '"')
+		}
+		if end < 0 {
+			return append(words, line)
+		}
+		words = append(words, line[:end])
+		line = line[end+1:]
+	}
+}
+
+// Reads the TypeMap field of a typemap spec, as written by "p4 typemap -o"
+func readTypemapSpec(r io.Reader, caseInsensitive bool) (typemap, error) {
+	var m typemap
+	inTypeMap := false
+	lineNumber := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, " ") {
+			inTypeMap = strings.HasPrefix(line, "TypeMap:")
+			continue
+		}
+		words := splitSpecLine(line)
+		if !inTypeMap || len(words) == 0 {
+			continue
+		}
+		if len(words) != 2 {
+			return nil, fmt.Errorf("line %v: expected a file type and a depot path, got %q", lineNumber, strings.TrimSpace(line))
+		}
+		entry, err := newTypemapEntry(words[0], words[1], caseInsensitive)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", lineNumber, err)
+		}
+		m = append(m, entry)
+	}
+	return m, scanner.Err()
+}
+
+// Reads the typemap of a checkpoint, from db.typemapx. File types are stored as the bits of db.rev.
+func readTypemapTable(checkpointPath string, caseInsensitive bool) (typemap, error) {
+	var records []schema.TypeMap
+	err := journal.ScanFile(checkpointPath, map[string]bool{"db.typemapx": true}, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		var entry schema.TypeMap
+		if err := schema.Unmarshal(record, &entry); err != nil {
+			return fmt.Errorf("line %v: %v", record.LineNumber, err)
+		}
+		records = append(records, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+
+	var m typemap
+	for _, record := range records {
+		fileType := record.Type
+		if bits, err := strconv.Atoi(record.Type); err == nil {
+			decoded, err := lbr.DecodeFileType(bits)
+			if err != nil {
+				return nil, fmt.Errorf("typemap entry %v: %v", record.Seq, err)
+			}
+			fileType = decoded.String()
+		}
+		path := record.DepotFile
+		if record.MapFlag == excludeMapFlag {
+			path = "-" + path
+		}
+		entry, err := newTypemapEntry(fileType, path, caseInsensitive)
+		if err != nil {
+			return nil, fmt.Errorf("typemap entry %v: %v", record.Seq, err)
+		}
+		m = append(m, entry)
+	}
+	return m, nil
+}
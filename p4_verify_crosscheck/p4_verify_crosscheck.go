@@ -0,0 +1,294 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_verify_crosscheck cross-references saved "p4 verify -q" output with the db.storage
+// CSV produced by p4_storage_to_csv and the db.rev records of a checkpoint, and reports whether
+// each BAD! or MISSING! revision points to a damaged archive or to inconsistent metadata.
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/schema"
+)
+
+const (
+	ArchiveProblem  = "archive"
+	MetadataProblem = "metadata"
+	// The checkpoint has no db.rev record for the revision, so the archive it uses is unknown
+	UnresolvedProblem = "unresolved"
+)
+
+// Matches the error lines of "p4 verify -q", for example:
+// //depot/path/file.txt#2 - edit change 12 (text) 9E107D9D372BB6826BD81D3542A419D6 BAD!
+var verifyLinePattern = regexp.MustCompile(
+	`^(//.+?)#(\d+) - (\S+) change (\d+) \(([^)]*)\)(?: ([0-9A-Fa-f]{32}))? (MISSING|BAD)!`)
+
+// A revision reported by p4 verify
+type verifyError struct {
+	depotFile string
+	revision  string
+	action    string
+	change    string
+	digest    string
+	status    string
+}
+
+func revisionKey(depotFile string, revision string) string {
+	return depotFile + "#" + revision
+}
+
+// The archive a revision reads its content from, from db.rev. It differs from the depot file
+// for lazy copies, which share the archive of the revision they were branched from.
+type librarianRevision struct {
+	file     string
+	revision string
+}
+
+// The db.storage values needed to classify verify errors
+type storageRecord struct {
+	librarianFile     string
+	librarianRevision string
+	digest            string
+	referenceCount    int64
+}
+
+// Loads the output of p4_storage_to_csv, keyed by librarian file and revision
+func loadStorageCSV(path string) (map[string]*storageRecord, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(bufio.NewReader(file))
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading csv header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[name] = i
+	}
+	for _, name := range []string{"LibrarianFile", "LibrarianRevision", "MD5OfLibrarianFile", "ReferenceCount"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %v, expected the output of p4_storage_to_csv", name)
+		}
+	}
+
+	records := make(map[string]*storageRecord)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading csv: %v", err)
+		}
+		// Reference counts are written in hexadecimal
+		referenceCount, err := strconv.ParseInt(row[columns["ReferenceCount"]], 16, 64)
+		if err != nil {
+			slog.Warn("Could not parse reference count", "reference_count", row[columns["ReferenceCount"]],
+				logging.ErrorClassKey, logging.MalformedError)
+			continue
+		}
+		record := &storageRecord{
+			librarianFile:     row[columns["LibrarianFile"]],
+			librarianRevision: strings.Trim(row[columns["LibrarianRevision"]], "@"),
+			digest:            strings.ToUpper(row[columns["MD5OfLibrarianFile"]]),
+			referenceCount:    referenceCount,
+		}
+		records[record.librarianFile+"\x00"+record.librarianRevision] = record
+	}
+	return records, nil
+}
+
+// Parses saved "p4 verify -q" output, ignoring lines that are not BAD! or MISSING! errors
+func loadVerifyErrors(path string) ([]verifyError, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	var errors []verifyError
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		match := verifyLinePattern.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if match == nil {
+			slog.Debug("Ignoring line", "text", scanner.Text())
+			continue
+		}
+		errors = append(errors, verifyError{
+			depotFile: match[1],
+			revision:  match[2],
+			action:    match[3],
+			change:    match[4],
+			digest:    strings.ToUpper(match[6]),
+			status:    match[7],
+		})
+	}
+	return errors, scanner.Err()
+}
+
+// Loads the librarian file and revision of the revisions reported by verify from the db.rev
+// records of a checkpoint or journal, keyed by depot file and revision
+func loadRevisions(path string, verifyErrors []verifyError) (map[string]librarianRevision, error) {
+	wanted := make(map[string]bool, len(verifyErrors))
+	for _, verifyErr := range verifyErrors {
+		wanted[revisionKey(verifyErr.depotFile, verifyErr.revision)] = true
+	}
+
+	revisions := make(map[string]librarianRevision)
+	err := journal.ScanFile(path, map[string]bool{"db.rev": true}, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		var rev schema.Rev
+		if err := schema.Unmarshal(record, &rev); err != nil || len(rev.DepotFile) == 0 {
+			slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		key := revisionKey(rev.DepotFile, strconv.Itoa(rev.DepotRev))
+		if wanted[key] {
+			revisions[key] = librarianRevision{file: rev.LbrFile, revision: rev.LbrRev}
+		}
+		return nil
+	})
+	return revisions, err
+}
+
+// Decides whether a verify error is caused by the archive or by the metadata, from the db.storage
+// record of the archive db.rev says the revision uses
+func classify(verifyErr verifyError, revisions map[string]librarianRevision, storage map[string]*storageRecord) (string, librarianRevision, string) {
+	librarian, ok := revisions[revisionKey(verifyErr.depotFile, verifyErr.revision)]
+	if !ok {
+		return UnresolvedProblem, librarianRevision{}, "no db.rev record for the revision in the checkpoint"
+	}
+	record, ok := storage[librarian.file+"\x00"+librarian.revision]
+	if !ok {
+		return MetadataProblem, librarian, "no db.storage record for " + librarian.file + " " + librarian.revision + " used by db.rev"
+	}
+	if record.referenceCount <= 0 {
+		return MetadataProblem, librarian, "db.storage record is not referenced"
+	}
+	if len(verifyErr.digest) > 0 && verifyErr.digest != record.digest {
+		return MetadataProblem, librarian, "db.rev digest differs from db.storage digest " + record.digest
+	}
+	if verifyErr.status == "MISSING" {
+		return ArchiveProblem, librarian, "archive file is missing"
+	}
+	return ArchiveProblem, librarian, "archive content doesn't match the recorded digest"
+}
+
+func main() {
+	flags := struct {
+		output string
+		format string
+	}{}
+
+	flag.StringVar(&flags.output, "output", output.Stdout, "File, or table for the database formats, to write the classified verify errors to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage())
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(false); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 3 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(flags.format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+
+	start := time.Now()
+
+	verifyErrors, err := loadVerifyErrors(flag.Arg(0))
+	if err != nil {
+		logging.Fatal("Error reading verify output", logging.Err(err))
+	}
+	storage, err := loadStorageCSV(flag.Arg(1))
+	if err != nil {
+		logging.Fatal("Error reading storage csv", logging.Err(err))
+	}
+	revisions, err := loadRevisions(flag.Arg(2), verifyErrors)
+	if err != nil {
+		logging.Fatal("Error reading checkpoint", logging.Err(err))
+	}
+
+	counts := make(map[string]int)
+	err = output.WriteTable(flags.format, flags.output, output.Table{Name: "verify_problems"}, func(out output.Writer) error {
+		out.Write([]string{
+			"DepotFile",
+			"Revision",
+			"Change",
+			"VerifyStatus",
+			"Problem",
+			"LibrarianFile",
+			"LibrarianRevision",
+			"Reason"})
+		for _, verifyErr := range verifyErrors {
+			problem, librarian, reason := classify(verifyErr, revisions, storage)
+			counts[problem]++
+			out.Write([]string{
+				verifyErr.depotFile,
+				verifyErr.revision,
+				verifyErr.change,
+				verifyErr.status,
+				problem,
+				librarian.file,
+				librarian.revision,
+				reason})
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Fatal("Error writing problems", logging.Err(err))
+	}
+
+	slog.Info("Processed verify errors", logging.CountKey, len(verifyErrors))
+	slog.Info("Archive problems", logging.CountKey, counts[ArchiveProblem])
+	slog.Info("Metadata problems", logging.CountKey, counts[MetadataProblem])
+	slog.Info("Unresolved", logging.CountKey, counts[UnresolvedProblem])
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const verifyOutput = `//depot/path1/data1.dat#2 - edit change 2 (binary+F) F1C9645DBC14EFDDC7D8A322685F26EB BAD!
+//depot/path1/README.txt#1 - add change 1 (text) 271E0A48226C79CCA6C1FCDE43CDAC31 MISSING!
+//depot/path1/README.txt#2 - edit change 2 (text) 00000000000000000000000000000001 BAD!
+//depot/path2/More.txt#1 - add change 3 (text) MISSING!
+  //depot/path1/data2.dat#1 - add change 1 (binary+F) f1c9645dbc14efddc7d8a322685f26eb BAD!
+//depot/path9/gone.txt#1 - add change 9 (text) MISSING!
+//depot/path1/data1.dat#1 - add change 1 (binary+F) F1C9645DBC14EFDDC7D8A322685F26EB
+`
+
+// Storage records as written by p4_storage_to_csv, without //depot/path2/More.txt
+const storageCSV = `LibrarianFile,LibrarianRevision,ReferenceCount,MD5OfLibrarianFile
+//depot/path1/data1.dat,@1.2@,1,F1C9645DBC14EFDDC7D8A322685F26EB
+//depot/path1/data2.dat,@1.1@,0,F1C9645DBC14EFDDC7D8A322685F26EB
+//depot/path1/README.txt,@1.1@,1,271e0a48226c79cca6c1fcde43cdac31
+//depot/path1/README.txt,@1.2@,a,E58A41657AB37F063690AD6A2FB1B3B6
+`
+
+func TestClassify(t *testing.T) {
+	dir := t.TempDir()
+	verifyPath := filepath.Join(dir, "verify.txt")
+	storagePath := filepath.Join(dir, "storage.csv")
+	if err := os.WriteFile(verifyPath, []byte(verifyOutput), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+	if err := os.WriteFile(storagePath, []byte(storageCSV), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+
+	verifyErrors, err := loadVerifyErrors(verifyPath)
+	if err != nil {
+		t.Fatalf("loadVerifyErrors() returned %v", err)
+	}
+	if len(verifyErrors) != 6 {
+		t.Fatalf("loadVerifyErrors() returned %v errors, want 6", len(verifyErrors))
+	}
+	if want := (verifyError{"//depot/path1/data2.dat", "1", "add", "1", "F1C9645DBC14EFDDC7D8A322685F26EB", "BAD"}); verifyErrors[4] != want {
+		t.Errorf("loadVerifyErrors()[4] = %+v, want %+v", verifyErrors[4], want)
+	}
+	storage, err := loadStorageCSV(storagePath)
+	if err != nil {
+		t.Fatalf("loadStorageCSV() returned %v", err)
+	}
+	revisions, err := loadRevisions("../perforceutils/testdata/example_journal.txt", verifyErrors)
+	if err != nil {
+		t.Fatalf("loadRevisions() returned %v", err)
+	}
+
+	var got [][]string
+	for _, verifyErr := range verifyErrors {
+		problem, librarian, reason := classify(verifyErr, revisions, storage)
+		got = append(got, []string{problem, librarian.file, librarian.revision, reason})
+	}
+	want := [][]string{
+		{ArchiveProblem, "//depot/path1/data1.dat", "1.2", "archive content doesn't match the recorded digest"},
+		{ArchiveProblem, "//depot/path1/README.txt", "1.1", "archive file is missing"},
+		{MetadataProblem, "//depot/path1/README.txt", "1.2", "db.rev digest differs from db.storage digest E58A41657AB37F063690AD6A2FB1B3B6"},
+		{MetadataProblem, "//depot/path2/More.txt", "1.3", "no db.storage record for //depot/path2/More.txt 1.3 used by db.rev"},
+		{MetadataProblem, "//depot/path1/data2.dat", "1.1", "db.storage record is not referenced"},
+		{UnresolvedProblem, "", "", "no db.rev record for the revision in the checkpoint"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("classify() = %q, want %q", got, want)
+	}
+}
+
+func TestLoadStorageCSVErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.csv")
+	if err := os.WriteFile(path, []byte("LibrarianFile,LibrarianRevision,FileSize\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+	if _, err := loadStorageCSV(path); err == nil {
+		t.Errorf("loadStorageCSV() of a CSV without ReferenceCount succeeded, want an error")
+	}
+}
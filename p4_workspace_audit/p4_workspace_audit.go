@@ -0,0 +1,392 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4_workspace_audit compares the files of a client workspace with its have list, as
+// recorded in db.have, and reports the files modified without being opened and the files missing
+// locally. It's an offline "p4 reconcile -n" that doesn't need a connection to the server.
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// The fields of the db.have table, as indexes in journal.Record.Fields.
+// They are documented here: https://www.perforce.com/perforce/doc.current/schema/#db.have.
+const (
+	DbHaveFieldClientFile = 0
+	DbHaveFieldDepotFile  = 1
+	DbHaveFieldHaveRev    = 2
+	DbHaveFieldType       = 3
+	DbHaveFieldTime       = 4
+
+	DbHaveFieldCount = 5
+)
+
+// The fields of the db.working table used to skip opened files.
+// See https://www.perforce.com/perforce/doc.current/schema/#db.working.
+const (
+	DbWorkingFieldClientFile = 0
+	DbWorkingFieldClient     = 2
+)
+
+// Bits of the file types of db.rev, see https://www.perforce.com/perforce/doc.current/schema/#FileType
+const (
+	fileTypeKeywordMask = 0x30
+	fileTypeClientMask  = 0x10D0000
+	fileTypeText        = 0x0
+	fileTypeSymlink     = 0x40000
+	fileTypeUnicode     = 0x80000
+	fileTypeUTF16       = 0x1080000
+)
+
+// Comparison modes
+const (
+	SizeMode  = "size"
+	MtimeMode = "mtime"
+	HashMode  = "hash"
+)
+
+// File statuses
+const (
+	OKFile       = "ok"
+	MissingFile  = "missing"
+	ModifiedFile = "modified"
+	// Files opened in the workspace are expected to differ
+	OpenedFile = "opened"
+	// Files whose content can't be compared, such as files with RCS keywords
+	UncheckedFile = "unchecked"
+)
+
+// A file of the have list and what the workspace file should look like
+type haveFile struct {
+	clientFile string
+	depotFile  string
+	haveRev    int
+	haveTime   int64
+	// From db.rev
+	fileType int
+	size     int64
+	digest   string
+	hasRev   bool
+	opened   bool
+
+	localPath string
+	status    string
+	detail    string
+}
+
+func revKey(depotFile string, rev int) string {
+	return depotFile + "#" + strconv.Itoa(rev)
+}
+
+// Loads the have list of a client, with the sizes and digests of the revisions from db.rev
+func loadHaveList(journalPath string, client string) ([]*haveFile, error) {
+	clientPrefix := "//" + client + "/"
+	var files []*haveFile
+	byRev := make(map[string][]*haveFile)
+	byClientFile := make(map[string]*haveFile)
+
+	tables := map[string]bool{"db.have": true, "db.rev": true, "db.working": true}
+	err := journal.ScanFile(journalPath, tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		switch record.Table {
+		case "db.have":
+			if !strings.HasPrefix(record.Field(DbHaveFieldClientFile), clientPrefix) {
+				return nil
+			}
+			if len(record.Fields) < DbHaveFieldCount {
+				slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			haveRev, err := strconv.Atoi(record.Fields[DbHaveFieldHaveRev])
+			if err != nil {
+				slog.Warn("Skipping record with invalid revision", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.RevisionKey, record.Fields[DbHaveFieldHaveRev], logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			haveTime, _ := strconv.ParseInt(record.Fields[DbHaveFieldTime], 10, 64)
+			file := &haveFile{
+				clientFile: record.Fields[DbHaveFieldClientFile],
+				depotFile:  record.Fields[DbHaveFieldDepotFile],
+				haveRev:    haveRev,
+				haveTime:   haveTime,
+			}
+			files = append(files, file)
+			key := revKey(file.depotFile, file.haveRev)
+			byRev[key] = append(byRev[key], file)
+			byClientFile[file.clientFile] = file
+		case "db.rev":
+			rev, err := archive.ParseRevRecord(record.Fields)
+			if err != nil {
+				return nil
+			}
+			for _, file := range byRev[revKey(rev.DepotFile, rev.DepotRev)] {
+				file.fileType = rev.Type
+				file.size = rev.Size
+				file.digest = strings.ToUpper(rev.Digest)
+				file.hasRev = true
+			}
+		case "db.working":
+			if record.Field(DbWorkingFieldClient) != client {
+				return nil
+			}
+			if file, ok := byClientFile[record.Field(DbWorkingFieldClientFile)]; ok {
+				file.opened = true
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// Drops the carriage returns of CRLF line endings
+type crlfWriter struct {
+	w         io.Writer
+	pendingCR bool
+	written   int64
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+1)
+	for _, b := range p {
+		if c.pendingCR && b != '\n' {
+			out = append(out, '\r')
+		}
+		c.pendingCR = b == '\r'
+		if !c.pendingCR {
+			out = append(out, b)
+		}
+	}
+	c.written += int64(len(out))
+	_, err := c.w.Write(out)
+	return len(p), err
+}
+
+func (c *crlfWriter) Close() error {
+	if c.pendingCR {
+		c.written++
+		_, err := c.w.Write([]byte{'\r'})
+		return err
+	}
+	return nil
+}
+
+// Returns the size and MD5 digest of a workspace file, as the server computes them:
+// text files with CRLF line endings are converted to LF when crlf is set
+func fileDigest(path string, crlf bool) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	if !crlf {
+		size, err := io.Copy(hash, file)
+		return size, strings.ToUpper(hex.EncodeToString(hash.Sum(nil))), err
+	}
+	writer := &crlfWriter{w: hash}
+	if _, err := io.Copy(writer, file); err != nil {
+		return 0, "", err
+	}
+	if err := writer.Close(); err != nil {
+		return 0, "", err
+	}
+	return writer.written, strings.ToUpper(hex.EncodeToString(hash.Sum(nil))), nil
+}
+
+// Compares a workspace file with its have list entry and sets its status
+func auditFile(file *haveFile, root string, client string, mode string, crlf bool) {
+	file.localPath = filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(file.clientFile, "//"+client+"/")))
+	file.status = OKFile
+
+	info, err := os.Lstat(file.localPath)
+	if os.IsNotExist(err) {
+		file.status = MissingFile
+		return
+	}
+	if err != nil {
+		file.status, file.detail = UncheckedFile, err.Error()
+		return
+	}
+
+	clientType := file.fileType & fileTypeClientMask
+	switch {
+	case file.opened:
+		file.status = OpenedFile
+		return
+	case !file.hasRev:
+		file.status, file.detail = UncheckedFile, "no db.rev record"
+		return
+	case clientType == fileTypeSymlink:
+		if info.Mode()&os.ModeSymlink == 0 {
+			file.status, file.detail = ModifiedFile, "not a symbolic link"
+		}
+		return
+	case file.fileType&fileTypeKeywordMask != 0:
+		file.status, file.detail = UncheckedFile, "RCS keywords are expanded in the workspace"
+		return
+	case clientType == fileTypeUTF16 || (clientType == fileTypeUnicode && mode != MtimeMode):
+		// The server stores these files in UTF-8, the workspace in the client character set
+		file.status, file.detail = UncheckedFile, "converted to the client character set"
+		return
+	}
+	isText := clientType == fileTypeText
+
+	if mode == MtimeMode {
+		if file.haveTime > 0 && info.ModTime().Unix() != file.haveTime {
+			file.status = ModifiedFile
+			file.detail = fmt.Sprintf("modified %v, synced %v", info.ModTime().Format(time.RFC3339),
+				time.Unix(file.haveTime, 0).Format(time.RFC3339))
+		}
+		return
+	}
+
+	if mode == SizeMode && !(isText && crlf) {
+		if file.size >= 0 && info.Size() != file.size {
+			file.status = ModifiedFile
+			file.detail = fmt.Sprintf("size %v, expected %v", info.Size(), file.size)
+		}
+		return
+	}
+
+	size, digest, err := fileDigest(file.localPath, isText && crlf)
+	if err != nil {
+		file.status, file.detail = UncheckedFile, err.Error()
+		return
+	}
+	switch {
+	case file.size >= 0 && size != file.size:
+		file.status = ModifiedFile
+		file.detail = fmt.Sprintf("size %v, expected %v", size, file.size)
+	case mode == HashMode && len(file.digest) > 0 && digest != file.digest:
+		file.status = ModifiedFile
+		file.detail = fmt.Sprintf("digest %v, expected %v", digest, file.digest)
+	}
+}
+
+func main() {
+	flags := struct {
+		client  string
+		mode    string
+		crlf    bool
+		all     bool
+		output  string
+		format  string
+		verbose bool
+	}{}
+
+	flag.StringVar(&flags.client, "client", "", "Name of the client workspace.")
+	flag.StringVar(&flags.mode, "mode", SizeMode, "How files are compared: size, mtime or hash.")
+	flag.BoolVar(&flags.crlf, "crlf", false, "Text files have CRLF line endings in the workspace (LineEnd local or win on Windows).")
+	flag.BoolVar(&flags.all, "all", false, "Report all files, not only modified and missing ones.")
+	flag.StringVar(&flags.output, "output", output.Stdout, "File, or table for the database formats, to write the audited files to, replaced only once complete (the standard output by default).")
+	flag.StringVar(&flags.format, "format", "csv", output.FormatUsage())
+	flag.BoolVar(&flags.verbose, "verbose", false, "Verbose output.")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+
+	flag.Parse()
+	if err := logging.Setup(flags.verbose); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 2 || len(flags.client) == 0 {
+		logging.Fatal("Insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(flags.format); err != nil {
+		logging.Fatal("Invalid output options", logging.Err(err))
+	}
+	if flags.mode != SizeMode && flags.mode != MtimeMode && flags.mode != HashMode {
+		logging.Fatal("Unknown mode, expected size, mtime or hash", "mode", flags.mode)
+	}
+
+	start := time.Now()
+
+	files, err := loadHaveList(flag.Arg(0), flags.client)
+	if err != nil {
+		logging.Fatal("Error reading have list", logging.Err(err))
+	}
+	if len(files) == 0 {
+		slog.Warn("No db.have records found", "client", flags.client)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].clientFile < files[j].clientFile })
+
+	counts := make(map[string]int)
+	err = output.WriteTable(flags.format, flags.output, output.Table{Name: "workspace_files"}, func(out output.Writer) error {
+		out.Write([]string{
+			"ClientFile",
+			"LocalPath",
+			"DepotFile",
+			"HaveRev",
+			"Status",
+			"Detail"})
+		for _, file := range files {
+			auditFile(file, flag.Arg(1), flags.client, flags.mode, flags.crlf)
+			slog.Debug("Audited file", logging.PathKey, file.localPath, "status", file.status, "detail", file.detail)
+			counts[file.status]++
+			if !flags.all && file.status != ModifiedFile && file.status != MissingFile {
+				continue
+			}
+			out.Write([]string{
+				file.clientFile,
+				file.localPath,
+				file.depotFile,
+				strconv.Itoa(file.haveRev),
+				file.status,
+				file.detail})
+		}
+		return nil
+	})
+	if err != nil {
+		logging.Fatal("Error writing files", logging.Err(err))
+	}
+
+	slog.Info("Processed files", logging.CountKey, len(files))
+	for _, status := range []string{OKFile, ModifiedFile, MissingFile, OpenedFile, UncheckedFile} {
+		slog.Info("Files", "status", status, logging.CountKey, counts[status])
+	}
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+}
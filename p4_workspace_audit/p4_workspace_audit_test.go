@@ -0,0 +1,142 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// A synced text file whose content is "hello\n", and data2.dat opened for edit
+const workspaceRecords = `@pv@ 3 @db.have@ @//the_user_client/path3/hello.txt@ @//depot/path3/hello.txt@ 1 0 1611008047 
+@pv@ 9 @db.rev@ @//depot/path3/hello.txt@ 1 0 0 4 1611008048 1611008047 B1946AC92492D2347C6235B4D2611184 6 0 0 @//depot/path3/hello.txt@ @1.1@ 0 
+@pv@ 3 @db.have@ @//other_client/path3/hello.txt@ @//depot/path3/hello.txt@ 1 0 1611008047 
+@pv@ 10 @db.working@ @//the_user_client/path1/data2.dat@ @//depot/path1/data2.dat@ @the_user_client@ @the_user@ 1 1 0 1 0 0 65539 1 0 0 @@ 0 00000000000000000000000000000000 -1 0 0 0 0 @@ 0 
+`
+
+func TestAuditFile(t *testing.T) {
+	example, err := os.ReadFile("../perforceutils/testdata/example_journal.txt")
+	if err != nil {
+		t.Fatalf("ReadFile() returned %v", err)
+	}
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	if err := os.WriteFile(checkpoint, append(example, workspaceRecords...), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+
+	// data1.dat is missing, README.txt has the size of its revision but not its content, and More.txt
+	// neither
+	root := t.TempDir()
+	workspace := map[string]string{
+		"path1/data2.dat":  "edited",
+		"path1/README.txt": "Not read me!!\n\n",
+		"path2/More.txt":   "More text\n",
+		"path3/hello.txt":  "hello\r\n",
+	}
+	for name, content := range workspace {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("MkdirAll() returned %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile() returned %v", err)
+		}
+	}
+
+	tests := []struct {
+		mode string
+		crlf bool
+		want map[string]string
+	}{
+		{SizeMode, false, map[string]string{
+			"//the_user_client/path1/data1.dat":  MissingFile,
+			"//the_user_client/path1/data2.dat":  OpenedFile,
+			"//the_user_client/path1/README.txt": OKFile,
+			"//the_user_client/path2/More.txt":   ModifiedFile,
+			"//the_user_client/path3/hello.txt":  ModifiedFile,
+		}},
+		{HashMode, true, map[string]string{
+			"//the_user_client/path1/data1.dat":  MissingFile,
+			"//the_user_client/path1/data2.dat":  OpenedFile,
+			"//the_user_client/path1/README.txt": ModifiedFile,
+			"//the_user_client/path2/More.txt":   ModifiedFile,
+			"//the_user_client/path3/hello.txt":  OKFile,
+		}},
+	}
+	for _, test := range tests {
+		files, err := loadHaveList(checkpoint, "the_user_client")
+		if err != nil {
+			t.Fatalf("loadHaveList() returned %v", err)
+		}
+		got := make(map[string]string)
+		for _, file := range files {
+			auditFile(file, root, "the_user_client", test.mode, test.crlf)
+			got[file.clientFile] = file.status
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("auditFile() with -mode=%v -crlf=%v = %v, want %v", test.mode, test.crlf, got, test.want)
+		}
+	}
+}
+
+func TestAuditFileMtime(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "file.txt")
+	if err := os.WriteFile(path, []byte("text\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() returned %v", err)
+	}
+	var statuses []string
+	for _, haveTime := range []int64{info.ModTime().Unix(), info.ModTime().Unix() - 60} {
+		file := &haveFile{clientFile: "//client/file.txt", haveTime: haveTime, size: 1, hasRev: true}
+		auditFile(file, root, "client", MtimeMode, false)
+		statuses = append(statuses, file.status)
+	}
+	sort.Strings(statuses)
+	if want := []string{ModifiedFile, OKFile}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("auditFile() with -mode=mtime = %q, want %q", statuses, want)
+	}
+}
+
+func TestCRLFWriter(t *testing.T) {
+	tests := []struct {
+		chunks []string
+		want   string
+	}{
+		{[]string{"a\r\nb\r\n"}, "a\nb\n"},
+		{[]string{"a\r", "\nb"}, "a\nb"},
+		{[]string{"a\rb\r"}, "a\rb\r"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		w := &crlfWriter{w: &out}
+		for _, chunk := range test.chunks {
+			w.Write([]byte(chunk))
+		}
+		w.Close()
+		if out.String() != test.want || w.written != int64(len(test.want)) {
+			t.Errorf("crlfWriter(%q) wrote %q, %v bytes, want %q", test.chunks, out.String(), w.written, test.want)
+		}
+	}
+}
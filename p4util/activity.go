@@ -0,0 +1,380 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/schema"
+)
+
+// The status of submitted changes in db.change (0 is pending and 2 shelved)
+const submittedChangeStatus = 1
+
+// Activity periods: the hours of the day, or of the week starting on Monday
+const (
+	dayPeriod  = "day"
+	weekPeriod = "week"
+)
+
+// The submitted changes and revisions of a path prefix, by hour of the period
+type activityCells struct {
+	path      string
+	changes   []int
+	revisions []int
+}
+
+func newActivityCells(path string, slots int) *activityCells {
+	return &activityCells{path: path, changes: make([]int, slots), revisions: make([]int, slots)}
+}
+
+func (a *activityCells) total() int {
+	total := 0
+	for _, revisions := range a.revisions {
+		total += revisions
+	}
+	return total
+}
+
+// Returns the prefix of a directory, depth directories below its depot (the depot for 0)
+func activityPrefix(directory string, depth int) string {
+	if !strings.HasPrefix(directory, "//") {
+		return directory
+	}
+	parts := strings.SplitN(directory[2:], "/", depth+2)
+	if len(parts) > depth+1 {
+		parts = parts[:depth+1]
+	}
+	return "//" + strings.Join(parts, "/")
+}
+
+// Returns the directory of the root of a change, the common path of its files such as
+// //depot/main/..., or // for changes spanning several depots
+func changeRootDirectory(root string) string {
+	if wildcard := strings.IndexAny(root, "*%"); wildcard >= 0 {
+		root = root[:wildcard]
+	}
+	if ellipsis := strings.Index(root, "..."); ellipsis >= 0 {
+		root = root[:ellipsis]
+	}
+	root = strings.TrimRight(root, "/")
+	if len(root) < 2 {
+		return "//"
+	}
+	return root
+}
+
+// Returns the hour of the period of a date: the hour of the day, or of the week from Monday 00:00
+func activitySlot(date int64, location *time.Location, period string) int {
+	t := time.Unix(date, 0).In(location)
+	if period == weekPeriod {
+		return (int(t.Weekday())+6)%7*24 + t.Hour()
+	}
+	return t.Hour()
+}
+
+// Returns the label of an hour of the period, such as 14:00 or Tuesday 14:00
+func activitySlotLabel(slot int, period string) string {
+	hour := fmt.Sprintf("%02d:00", slot%24)
+	if period == weekPeriod {
+		return time.Weekday((slot/24+1)%7).String() + " " + hour
+	}
+	return hour
+}
+
+// Returns the first hour of the window of consecutive hours with the fewest revisions, wrapping
+// around the end of the period, and their revisions
+func quietestWindow(revisions []int, hours int) (int, int) {
+	if hours > len(revisions) {
+		hours = len(revisions)
+	}
+	best, bestRevisions := 0, -1
+	for start := range revisions {
+		sum := 0
+		for i := 0; i < hours; i++ {
+			sum += revisions[(start+i)%len(revisions)]
+		}
+		if bestRevisions < 0 || sum < bestRevisions {
+			best, bestRevisions = start, sum
+		}
+	}
+	return best, bestRevisions
+}
+
+func runActivity(args []string) error {
+	flags := flag.NewFlagSet("activity", flag.ExitOnError)
+	depth := flags.Int("depth", 1, "Directory levels below the depot at which activity is aggregated (0 for depots).")
+	period := flags.String("period", dayPeriod, "Hours of the heatmap: day (24 hours) or week (168 hours, from Monday).")
+	timezone := flags.String("timezone", "UTC", "Time zone of the hours, such as America/Los_Angeles (Local for the time zone of this machine).")
+	since := flags.String("since", "", "Only count the submits from this date (2006-01-02), time (RFC 3339) or duration before now (7d, 36h).")
+	until := flags.String("until", "", "Only count the submits before this date, time or duration before now, as -since.")
+	windowHours := flags.Int("window-hours", 4, "Length of the quietest maintenance window to report, in hours.")
+	htmlHeatmap := flags.String("html", "", "File to write an HTML heatmap of the busiest paths to.")
+	limit := flags.Int("limit", 50, "Number of busiest paths in the HTML heatmap (0 for all).")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+	slots := 24
+	switch *period {
+	case dayPeriod:
+	case weekPeriod:
+		slots = 7 * 24
+	default:
+		return fmt.Errorf("unknown period %v, expected day or week", *period)
+	}
+	location, err := time.LoadLocation(*timezone)
+	if err != nil {
+		return fmt.Errorf("invalid -timezone: %v", err)
+	}
+	window, err := archive.ParseDateWindow(*since, *until, time.Now())
+	if err != nil {
+		return err
+	}
+	if *depth < 0 {
+		return fmt.Errorf("-depth can't be negative")
+	}
+	if *windowHours <= 0 {
+		return fmt.Errorf("-window-hours must be positive")
+	}
+
+	paths := make(map[string]*activityCells)
+	cells := func(path string) *activityCells {
+		prefix, ok := paths[path]
+		if !ok {
+			prefix = newActivityCells(path, slots)
+			paths[path] = prefix
+		}
+		return prefix
+	}
+	totals := newActivityCells("All paths", slots)
+	outOfWindow := 0
+
+	tables := map[string]bool{"db.change": true, "db.rev": true}
+	err = journal.ScanFile(flags.Arg(0), tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		if record.Table == "db.change" {
+			var change schema.Change
+			if err := schema.Unmarshal(record, &change); err != nil {
+				slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError, logging.Err(err))
+				return nil
+			}
+			if change.Status != submittedChangeStatus {
+				return nil
+			}
+			if !window.Contains(change.Date) {
+				outOfWindow++
+				return nil
+			}
+			slot := activitySlot(change.Date, location, *period)
+			cells(activityPrefix(changeRootDirectory(change.Root), *depth)).changes[slot]++
+			totals.changes[slot]++
+			return nil
+		}
+
+		rev, err := archive.ParseRevRecord(record.Fields)
+		if err != nil {
+			slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		if !window.Contains(rev.Date) {
+			return nil
+		}
+		directory := rev.DepotFile
+		if slash := strings.LastIndex(directory, "/"); slash > 1 {
+			directory = directory[:slash]
+		}
+		slot := activitySlot(rev.Date, location, *period)
+		cells(activityPrefix(directory, *depth)).revisions[slot]++
+		totals.revisions[slot]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !window.IsZero() {
+		slog.Info("Changes dated outside of -since/-until", logging.CountKey, outOfWindow)
+	}
+
+	sorted := make([]*activityCells, 0, len(paths))
+	for _, prefix := range paths {
+		sorted = append(sorted, prefix)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].path < sorted[j].path })
+
+	out, err := output.NewWriter(*format, *outputPath, output.Table{Name: "activity"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.Write([]string{"Path", "Day", "Hour", "Changes", "Revisions"})
+	for _, prefix := range sorted {
+		for slot := 0; slot < slots; slot++ {
+			day := ""
+			if *period == weekPeriod {
+				day = time.Weekday((slot/24 + 1) % 7).String()
+			}
+			out.Write([]string{
+				prefix.path,
+				day,
+				strconv.Itoa(slot % 24),
+				strconv.Itoa(prefix.changes[slot]),
+				strconv.Itoa(prefix.revisions[slot])})
+		}
+	}
+	if err := out.Commit(); err != nil {
+		return err
+	}
+
+	busiest := 0
+	for slot, revisions := range totals.revisions {
+		if revisions > totals.revisions[busiest] {
+			busiest = slot
+		}
+	}
+	quietStart, quietRevisions := quietestWindow(totals.revisions, *windowHours)
+	slog.Info("Submit activity", "paths", len(paths), "revisions", totals.total(), "timezone", location.String())
+	slog.Info("Busiest hour", "hour", activitySlotLabel(busiest, *period), "revisions", totals.revisions[busiest])
+	slog.Info("Quietest maintenance window", "from", activitySlotLabel(quietStart, *period),
+		"hours", *windowHours, "revisions", quietRevisions)
+
+	if len(*htmlHeatmap) > 0 {
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].total() > sorted[j].total() })
+		if *limit > 0 && len(sorted) > *limit {
+			sorted = sorted[:*limit]
+		}
+		quietest := fmt.Sprintf("%v hours from %v", *windowHours, activitySlotLabel(quietStart, *period))
+		if err := writeActivityHeatmap(*htmlHeatmap, totals, sorted, *period, location, quietest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type heatmapCell struct {
+	Title string
+	Color template.CSS
+}
+
+type heatmapRow struct {
+	Path      string
+	Revisions int
+	Cells     []heatmapCell
+}
+
+// Returns the row of a path, shaded relative to the busiest hour of the path
+func newHeatmapRow(prefix *activityCells, period string) heatmapRow {
+	busiest := 1
+	for _, revisions := range prefix.revisions {
+		if revisions > busiest {
+			busiest = revisions
+		}
+	}
+	row := heatmapRow{Path: prefix.path, Revisions: prefix.total()}
+	for slot, revisions := range prefix.revisions {
+		row.Cells = append(row.Cells, heatmapCell{
+			Title: fmt.Sprintf("%v: %v changes, %v revisions", activitySlotLabel(slot, period), prefix.changes[slot], revisions),
+			Color: template.CSS(fmt.Sprintf("rgba(26, 115, 232, %.2f)", float64(revisions)/float64(busiest))),
+		})
+	}
+	return row
+}
+
+// Writes a self-contained HTML page with the heatmap of all paths and of the busiest ones
+func writeActivityHeatmap(filePath string, totals *activityCells, paths []*activityCells, period string,
+	location *time.Location, quietest string) error {
+	var headers []string
+	for slot := range totals.revisions {
+		if period == weekPeriod && slot%24 != 0 {
+			headers = append(headers, "")
+		} else {
+			headers = append(headers, activitySlotLabel(slot, period))
+		}
+	}
+	rows := []heatmapRow{newHeatmapRow(totals, period)}
+	for _, prefix := range paths {
+		rows = append(rows, newHeatmapRow(prefix, period))
+	}
+
+	file, err := output.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("error creating html heatmap: %v", err)
+	}
+	defer file.Close()
+
+	err = activityTemplate.Execute(file, struct {
+		Period   string
+		Timezone string
+		Quietest string
+		Headers  []string
+		Rows     []heatmapRow
+	}{period, location.String(), quietest, headers, rows})
+	if err != nil {
+		return fmt.Errorf("error writing html heatmap: %v", err)
+	}
+	return file.Commit()
+}
+
+var activityTemplate = template.Must(template.New("activity").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Submit activity</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #202124; }
+h1 { font-size: 1.6em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 0.3em; text-align: left; white-space: nowrap; }
+th.hour { font-weight: normal; font-size: 0.7em; color: #5f6368; }
+td.cell { min-width: {{if eq .Period "week"}}0.3em{{else}}1.5em{{end}}; border: 1px solid #f1f3f4; }
+td.number { text-align: right; }
+.meta { color: #5f6368; }
+</style>
+</head>
+<body>
+<h1>Submit activity</h1>
+<p class="meta">Revisions by hour of the {{.Period}} ({{.Timezone}}), each row shaded relative to its busiest hour.
+Quietest maintenance window: {{.Quietest}}.</p>
+
+<table>
+<tr><th>Path</th><th>Revisions</th>{{range .Headers}}<th class="hour">{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr><td>{{.Path}}</td><td class="number">{{.Revisions}}</td>{{range .Cells}}<td class="cell" style="background: {{.Color}}" title="{{.Title}}"></td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
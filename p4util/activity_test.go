@@ -0,0 +1,37 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestActivity(t *testing.T) {
+	rows := runReport(t, runActivity, exampleJournal)
+	// Only the hours with submits, out of the 24 rows of each path
+	var active [][]string
+	for _, row := range rows[1:] {
+		if row[3] != "0" {
+			active = append(active, row)
+		}
+	}
+	checkReport(t, active, []int{0, 2, 3, 4}, [][]string{
+		{"//depot/path1", "22", "2", "5"},
+		{"//depot/path2", "22", "1", "1"},
+	})
+	if len(rows) != 1+2*24 {
+		t.Errorf("runActivity() wrote %d rows, want %d", len(rows), 1+2*24)
+	}
+}
@@ -0,0 +1,270 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// Upper bounds (in days) of the age buckets of the histogram
+var archiveAgeBucketDays = []int{30, 90, 365, 2 * 365, 3 * 365, 5 * 365, 10 * 365}
+
+const secondsPerDay = 24 * 60 * 60
+
+// An archive and when it was last written
+type archiveAge struct {
+	lbrFile string
+	bytes   int64
+	date    int64
+	// Whether the size and date come from db.storage rather than db.rev
+	fromStorage bool
+	// Whether the date comes from the revision that created the archive
+	fromRev bool
+}
+
+// Archive totals of a directory
+type directoryAge struct {
+	directory string
+	archives  int
+	bytes     int64
+	coldBytes int64
+	newest    int64
+}
+
+// Returns the directory of a librarian file, truncated to depth directories below the depot when depth > 0
+func archiveDirectory(lbrFile string, depth int) string {
+	directory := lbrFile
+	if slash := strings.LastIndex(directory, "/"); slash > 1 {
+		directory = directory[:slash]
+	}
+	if depth <= 0 || !strings.HasPrefix(directory, "//") {
+		return directory
+	}
+	// The depot name is followed by depth directories
+	parts := strings.SplitN(directory[2:], "/", depth+2)
+	if len(parts) > depth+1 {
+		parts = parts[:depth+1]
+	}
+	return "//" + strings.Join(parts, "/")
+}
+
+func runAge(args []string) error {
+	flags := flag.NewFlagSet("age", flag.ExitOnError)
+	coldYears := flags.Float64("cold-years", 3, "Years without updates after which archive bytes are cold.")
+	coldPercent := flags.Float64("cold-percent", 90, "Percentage of cold bytes above which a directory is reported.")
+	minBytes := flags.Int64("min-bytes", 0, "Only report directories with at least this many archive bytes.")
+	depth := flags.Int("depth", 0, "Aggregate directories this many levels below the depot (0 for the directories of the archives).")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	output.RegisterTimeZoneFlag(flags)
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+	if err := output.CheckTimeZone(); err != nil {
+		return err
+	}
+	if *coldYears <= 0 {
+		return fmt.Errorf("-cold-years must be positive")
+	}
+
+	archives := make(map[string]*archiveAge)
+	newestDate := int64(0)
+	getArchive := func(lbrFile string, lbrRev string) *archiveAge {
+		key := lbrFile + "\x00" + lbrRev
+		age, ok := archives[key]
+		if !ok {
+			age = &archiveAge{lbrFile: lbrFile}
+			archives[key] = age
+		}
+		return age
+	}
+
+	tables := map[string]bool{"db.rev": true, "db.storage": true}
+	err := scanCheckpointOrExtraction(flags.Arg(0), tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		fields := record.Fields
+		if record.Table == "db.storage" {
+			if len(fields) < archive.DbStorageFieldCount {
+				slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			age := getArchive(fields[archive.DbStorageFieldLbrFile], fields[archive.DbStorageFieldLbrRev])
+			size, err := strconv.ParseInt(fields[archive.DbStorageFieldServerSize], 10, 64)
+			if err != nil || size <= 0 {
+				// Not all servers record the size of the archive as stored
+				size, _ = strconv.ParseInt(fields[archive.DbStorageFieldSize], 10, 64)
+			}
+			age.bytes = size
+			age.fromStorage = true
+			// The date of the revision that created the archive is more accurate, since db.storage
+			// records are also updated when their reference count changes
+			if !age.fromRev {
+				age.date, _ = strconv.ParseInt(fields[archive.DbStorageFieldDate], 10, 64)
+			}
+		} else {
+			if len(fields) < archive.DbRevFieldCount {
+				slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			action, _ := strconv.Atoi(fields[archive.DbRevFieldAction])
+			// Lazy copies don't write archives
+			if !archive.FileAction(action).HasArchive() || fields[archive.DbRevFieldLbrIsLazy] != "0" {
+				return nil
+			}
+			date, err := strconv.ParseInt(fields[archive.DbRevFieldDate], 10, 64)
+			if err != nil {
+				slog.Warn("Could not parse date", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					"date", fields[archive.DbRevFieldDate], logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			age := getArchive(fields[archive.DbRevFieldLbrFile], fields[archive.DbRevFieldLbrRev])
+			if !age.fromStorage {
+				age.bytes, _ = strconv.ParseInt(fields[archive.DbRevFieldSize], 10, 64)
+			}
+			if !age.fromRev || date > age.date {
+				age.date = date
+			}
+			age.fromRev = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	storageCount := 0
+	for _, age := range archives {
+		if age.fromStorage {
+			storageCount++
+		}
+		if age.date > newestDate {
+			newestDate = age.date
+		}
+	}
+	if storageCount == 0 {
+		slog.Warn("No db.storage records found, using the file sizes from db.rev")
+	}
+
+	coldStart := newestDate - int64(*coldYears*365*secondsPerDay)
+	buckets := make([]int64, len(archiveAgeBucketDays)+1)
+	bucketCounts := make([]int, len(archiveAgeBucketDays)+1)
+	directories := make(map[string]*directoryAge)
+	totalBytes := int64(0)
+	for _, age := range archives {
+		days := (newestDate - age.date) / secondsPerDay
+		bucket := 0
+		for bucket < len(archiveAgeBucketDays) && days > int64(archiveAgeBucketDays[bucket]) {
+			bucket++
+		}
+		buckets[bucket] += age.bytes
+		bucketCounts[bucket]++
+		totalBytes += age.bytes
+
+		name := archiveDirectory(age.lbrFile, *depth)
+		directory, ok := directories[name]
+		if !ok {
+			directory = &directoryAge{directory: name}
+			directories[name] = directory
+		}
+		directory.archives++
+		directory.bytes += age.bytes
+		if age.date < coldStart {
+			directory.coldBytes += age.bytes
+		}
+		if age.date > directory.newest {
+			directory.newest = age.date
+		}
+	}
+
+	var cold []*directoryAge
+	coldBytes := int64(0)
+	for _, directory := range directories {
+		if directory.bytes == 0 || directory.bytes < *minBytes {
+			continue
+		}
+		if 100*float64(directory.coldBytes)/float64(directory.bytes) > *coldPercent {
+			cold = append(cold, directory)
+			coldBytes += directory.bytes
+		}
+	}
+	sort.Slice(cold, func(i, j int) bool {
+		if cold[i].bytes != cold[j].bytes {
+			return cold[i].bytes > cold[j].bytes
+		}
+		return cold[i].directory < cold[j].directory
+	})
+
+	out, err := output.NewWriter(*format, *outputPath, output.Table{Name: "age"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.Write([]string{
+		"Directory",
+		"Archives",
+		"ArchiveBytes",
+		"ColdBytes",
+		"ColdPercent",
+		"NewestUpdate",
+		"NewestUpdateTime"})
+	for _, directory := range cold {
+		out.Write([]string{
+			directory.directory,
+			strconv.Itoa(directory.archives),
+			strconv.FormatInt(directory.bytes, 10),
+			strconv.FormatInt(directory.coldBytes, 10),
+			fmt.Sprintf("%.1f", 100*float64(directory.coldBytes)/float64(directory.bytes)),
+			formatDate(directory.newest),
+			output.FormatTimestamp(directory.newest)})
+	}
+	if err := out.Commit(); err != nil {
+		return err
+	}
+
+	slog.Info("Processed archives", logging.CountKey, len(archives), logging.BytesKey, totalBytes, "as_of", formatDate(newestDate))
+	lower := 0
+	for bucket, bytes := range buckets {
+		if bucket < len(archiveAgeBucketDays) {
+			slog.Info("Archive age", "min_days", lower, "max_days", archiveAgeBucketDays[bucket],
+				logging.CountKey, bucketCounts[bucket], logging.BytesKey, bytes)
+			lower = archiveAgeBucketDays[bucket]
+		} else {
+			slog.Info("Archive age", "min_days", lower, logging.CountKey, bucketCounts[bucket], logging.BytesKey, bytes)
+		}
+	}
+	slog.Info("Reported cold directories", logging.CountKey, len(cold), logging.BytesKey, coldBytes)
+	return nil
+}
@@ -0,0 +1,34 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestAge(t *testing.T) {
+	// An archive last updated three and a half years before the example's
+	checkpoint := writeCheckpoint(t, `@pv@ 9 @db.rev@ @//depot/old/a.txt@ 1 0 0 4 1500000000 1500000000 271E0A48226C79CCA6C1FCDE43CDAC31 10 0 0 @//depot/old/a.txt@ @1.4@ 0 
+@pv@ 1 @db.storage@ @//depot/old/a.txt@ @1.4@ 0 1 271E0A48226C79CCA6C1FCDE43CDAC31 10 100 00000000000000000000000000000000 1500000000 
+`)
+	rows := runReport(t, runAge, checkpoint)
+	checkReport(t, rows, []int{0, 1, 2, 3, 4, 5}, [][]string{
+		{"Directory", "Archives", "ArchiveBytes", "ColdBytes", "ColdPercent", "NewestUpdate"},
+		{"//depot/old", "1", "100", "100", "100.0", "2017-07-14"},
+	})
+
+	rows = runReport(t, runAge, "-cold-years=4", checkpoint)
+	checkReport(t, rows, []int{0}, [][]string{{"Directory"}})
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// The extension reported for librarian files without one
+const noExtension = "(none)"
+
+// Archive bytes of a depot and file extension, by how they are stored
+type compressionStats struct {
+	depot               string
+	extension           string
+	archives            int
+	rcsBytes            int64
+	uncompressedBytes   int64
+	compressedBytes     int64
+	otherBytes          int64
+	ratio               float64
+	retypeSavings       int64
+	autocompressSavings int64
+}
+
+// Compressed and uncompressed sizes of the compressed archives of an extension, to estimate the
+// compression ratio of the archives stored uncompressed
+type compressionSample struct {
+	size       int64
+	serverSize int64
+}
+
+func (s compressionSample) ratio() (float64, bool) {
+	if s.size <= 0 {
+		return 0, false
+	}
+	ratio := float64(s.serverSize) / float64(s.size)
+	if ratio > 1 {
+		ratio = 1
+	}
+	return ratio, true
+}
+
+// Returns the extension of a librarian file, or noExtension
+func archiveExtension(lbrFile string) string {
+	extension := path.Ext(lbrFile)
+	if len(extension) <= 1 {
+		return noExtension
+	}
+	return extension
+}
+
+func runCompression(args []string) error {
+	flags := flag.NewFlagSet("compression", flag.ExitOnError)
+	defaultRatio := flags.Float64("default-ratio", 0.5, "Compression ratio assumed for extensions without compressed archives to learn from.")
+	minSavings := flags.Int64("min-savings", 0, "Only report depots and extensions with at least this many bytes of estimated savings.")
+	commands := flags.String("commands", "", "File to write candidate \"p4 retype\" commands to.")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+	if *defaultRatio <= 0 || *defaultRatio > 1 {
+		return fmt.Errorf("-default-ratio must be between 0 and 1")
+	}
+
+	stats := make(map[string]*compressionStats)
+	samples := make(map[string]*compressionSample)
+	var overall compressionSample
+
+	err := scanCheckpointOrExtraction(flags.Arg(0), map[string]bool{"db.storage": true}, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		storage, err := archive.ParseStorageRecord(record.Fields)
+		if err != nil {
+			slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+
+		depot := archive.DepotName(storage.LbrFile)
+		extension := archiveExtension(storage.LbrFile)
+		key := depot + "\x00" + extension
+		stat, ok := stats[key]
+		if !ok {
+			stat = &compressionStats{depot: depot, extension: extension}
+			stats[key] = stat
+		}
+		stat.archives++
+
+		stored := storage.ServerSize
+		if stored <= 0 {
+			// Not all servers record the size of the archive as stored
+			stored = storage.Size
+		}
+		switch archive.StorageType(storage.LbrType) {
+		case archive.RCSStorageType:
+			// The ,v files hold deltas, so the revision sizes overstate what they take on disk
+			stat.rcsBytes += storage.Size
+		case archive.BinaryStorageType, archive.TempObjStorageType:
+			stat.uncompressedBytes += stored
+		case archive.CompressedStorageType, archive.CompressedTempObj:
+			stat.compressedBytes += stored
+			if storage.Size > 0 && storage.ServerSize > 0 {
+				sample, ok := samples[extension]
+				if !ok {
+					sample = &compressionSample{}
+					samples[extension] = sample
+				}
+				sample.size += storage.Size
+				sample.serverSize += storage.ServerSize
+				overall.size += storage.Size
+				overall.serverSize += storage.ServerSize
+			}
+		default:
+			stat.otherBytes += stored
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fallbackRatio, ok := overall.ratio()
+	if !ok {
+		fallbackRatio = *defaultRatio
+	}
+
+	var reported []*compressionStats
+	var totals compressionStats
+	for _, stat := range stats {
+		stat.ratio = fallbackRatio
+		if sample, ok := samples[stat.extension]; ok {
+			if ratio, ok := sample.ratio(); ok {
+				stat.ratio = ratio
+			}
+		}
+		stat.retypeSavings = int64(float64(stat.uncompressedBytes) * (1 - stat.ratio))
+		stat.autocompressSavings = int64(float64(stat.rcsBytes) * (1 - stat.ratio))
+
+		totals.rcsBytes += stat.rcsBytes
+		totals.uncompressedBytes += stat.uncompressedBytes
+		totals.compressedBytes += stat.compressedBytes
+		totals.otherBytes += stat.otherBytes
+		totals.retypeSavings += stat.retypeSavings
+		totals.autocompressSavings += stat.autocompressSavings
+
+		if stat.retypeSavings+stat.autocompressSavings >= *minSavings {
+			reported = append(reported, stat)
+		}
+	}
+	sort.Slice(reported, func(i, j int) bool {
+		a, b := reported[i], reported[j]
+		if a.retypeSavings+a.autocompressSavings != b.retypeSavings+b.autocompressSavings {
+			return a.retypeSavings+a.autocompressSavings > b.retypeSavings+b.autocompressSavings
+		}
+		if a.depot != b.depot {
+			return a.depot < b.depot
+		}
+		return a.extension < b.extension
+	})
+
+	out, err := output.NewWriter(*format, *outputPath, output.Table{Name: "compression"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.Write([]string{
+		"Depot",
+		"Extension",
+		"Archives",
+		"RCSBytes",
+		"UncompressedBytes",
+		"CompressedBytes",
+		"OtherBytes",
+		"CompressionRatio",
+		"RetypeSavings",
+		"AutocompressSavings"})
+	for _, stat := range reported {
+		out.Write([]string{
+			stat.depot,
+			stat.extension,
+			strconv.Itoa(stat.archives),
+			strconv.FormatInt(stat.rcsBytes, 10),
+			strconv.FormatInt(stat.uncompressedBytes, 10),
+			strconv.FormatInt(stat.compressedBytes, 10),
+			strconv.FormatInt(stat.otherBytes, 10),
+			strconv.FormatFloat(stat.ratio, 'f', 3, 64),
+			strconv.FormatInt(stat.retypeSavings, 10),
+			strconv.FormatInt(stat.autocompressSavings, 10)})
+	}
+	if err := out.Commit(); err != nil {
+		return err
+	}
+
+	if len(*commands) > 0 {
+		if err := writeRetypeCommands(*commands, reported); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Archive bytes", "rcs", totals.rcsBytes, "uncompressed", totals.uncompressedBytes,
+		"compressed", totals.compressedBytes, "other", totals.otherBytes)
+	slog.Info("Estimated savings", "retype", totals.retypeSavings, "autocompress", totals.autocompressSavings,
+		"ratio", strconv.FormatFloat(fallbackRatio, 'f', 3, 64))
+	return nil
+}
+
+// Writes a "p4 retype" command adding +C to the files of each depot and extension stored uncompressed
+func writeRetypeCommands(commandsPath string, reported []*compressionStats) error {
+	file, err := output.Create(commandsPath)
+	if err != nil {
+		return fmt.Errorf("error creating commands file: %v", err)
+	}
+	defer file.Close()
+
+	count := 0
+	for _, stat := range reported {
+		if stat.retypeSavings <= 0 || stat.extension == noExtension {
+			continue
+		}
+		fmt.Fprintf(file, "# %v: %v bytes uncompressed, about %v bytes saved\n",
+			stat.extension, stat.uncompressedBytes, stat.retypeSavings)
+		fmt.Fprintf(file, "p4 retype -t +C \"//%v/...%v\"\n", stat.depot, stat.extension)
+		count++
+	}
+	if err := file.Commit(); err != nil {
+		return fmt.Errorf("error writing commands file: %v", err)
+	}
+	slog.Info("Wrote retype commands", logging.PathKey, commandsPath, logging.CountKey, count)
+	return nil
+}
@@ -0,0 +1,436 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// The fields of the db.config table, as indexes in journal.Record.Fields.
+// They are documented here: https://www.perforce.com/perforce/doc.current/schema/#db.config.
+const (
+	DbConfigFieldServerName = 0
+	DbConfigFieldName       = 1
+	DbConfigFieldValue      = 2
+
+	DbConfigFieldCount = 3
+)
+
+// The fields of the db.trigger table, as indexes in journal.Record.Fields.
+// They are documented here: https://www.perforce.com/perforce/doc.current/schema/#db.trigger.
+const (
+	DbTriggerFieldSeq       = 0
+	DbTriggerFieldName      = 1
+	DbTriggerFieldMapFlag   = 2
+	DbTriggerFieldDepotFile = 3
+	DbTriggerFieldTrigger   = 4
+	DbTriggerFieldAction    = 5
+
+	DbTriggerFieldCount = 6
+)
+
+// The path prefixes of the map flags, see https://www.perforce.com/perforce/doc.current/schema/#MapFlag
+var mapFlagPrefixes = map[string]string{
+	"0": "",
+	"1": "-",
+	"2": "+",
+}
+
+// Kinds of configuration entries
+const (
+	configurableKind = "configurable"
+	triggerKind      = "trigger"
+)
+
+// Drift between a baseline and a checkpoint
+const (
+	driftChanged    = "changed"
+	driftMissing    = "missing"
+	driftUnexpected = "unexpected"
+)
+
+// The configuration of a topology, as recorded in a checkpoint or a baseline
+type serverConfig struct {
+	// The configurables of each server name ("any" for all servers)
+	configurables map[string]map[string]string
+	// The lines of each trigger, in table order, as "type path command"
+	triggers map[string][]string
+}
+
+func newServerConfig() *serverConfig {
+	return &serverConfig{configurables: make(map[string]map[string]string), triggers: make(map[string][]string)}
+}
+
+func (c *serverConfig) setConfigurable(server string, name string, value string) {
+	configurables, ok := c.configurables[server]
+	if !ok {
+		configurables = make(map[string]string)
+		c.configurables[server] = configurables
+	}
+	configurables[name] = value
+}
+
+// A configurable or trigger that differs from the baseline
+type configDrift struct {
+	kind     string
+	server   string
+	name     string
+	drift    string
+	expected string
+	actual   string
+}
+
+// Formats a trigger line as in the triggers table ("p4 triggers -o"), without the name
+func triggerLine(fields []string) string {
+	prefix, ok := mapFlagPrefixes[fields[DbTriggerFieldMapFlag]]
+	if !ok {
+		prefix = fields[DbTriggerFieldMapFlag] + ":"
+	}
+	return fmt.Sprintf("%v %v%v \"%v\"", fields[DbTriggerFieldTrigger], prefix, fields[DbTriggerFieldDepotFile],
+		fields[DbTriggerFieldAction])
+}
+
+// Reads the configurables from db.config and the triggers from db.trigger
+func readCheckpointConfig(path string, ignored map[string]bool) (*serverConfig, error) {
+	config := newServerConfig()
+	type triggerEntry struct {
+		seq  int
+		name string
+		line string
+	}
+	var triggers []triggerEntry
+	err := journal.ScanFile(path, map[string]bool{"db.config": true, "db.trigger": true}, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		fields := record.Fields
+		switch record.Table {
+		case "db.config":
+			if len(fields) < DbConfigFieldCount {
+				slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			if !ignored[fields[DbConfigFieldName]] {
+				config.setConfigurable(fields[DbConfigFieldServerName], fields[DbConfigFieldName], fields[DbConfigFieldValue])
+			}
+		case "db.trigger":
+			if len(fields) < DbTriggerFieldCount {
+				slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			if !ignored[fields[DbTriggerFieldName]] {
+				seq, _ := strconv.Atoi(fields[DbTriggerFieldSeq])
+				triggers = append(triggers, triggerEntry{seq: seq, name: fields[DbTriggerFieldName], line: triggerLine(fields)})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(triggers, func(i, j int) bool { return triggers[i].seq < triggers[j].seq })
+	for _, trigger := range triggers {
+		config.triggers[trigger.name] = append(config.triggers[trigger.name], trigger.line)
+	}
+	return config, nil
+}
+
+// Reads a baseline written by -write-baseline, or by hand:
+//
+//	configurables:
+//	  any:
+//	    security: "3"
+//	  edge-1:
+//	    rpl.checksum.change: "1"
+//	triggers:
+//	  check-description:
+//	    - change-submit //depot/... "python3 /p4/triggers/check.py %change%"
+func readBaseline(path string, ignored map[string]bool) (*serverConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading baseline: %v", err)
+	}
+	document, err := parseYAML(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing baseline %v: %v", path, err)
+	}
+	root, ok := document.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("error parsing baseline %v: expected a mapping", path)
+	}
+
+	config := newServerConfig()
+	for section, value := range root {
+		switch section {
+		case "configurables":
+			servers, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("error parsing baseline %v: configurables must map server names to configurables", path)
+			}
+			for server, value := range servers {
+				configurables, ok := value.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("error parsing baseline %v: configurables of %v must be a mapping", path, server)
+				}
+				for name, value := range configurables {
+					text, ok := value.(string)
+					if !ok {
+						return nil, fmt.Errorf("error parsing baseline %v: configurable %v of %v must be a string", path, name, server)
+					}
+					if !ignored[name] {
+						config.setConfigurable(server, name, text)
+					}
+				}
+			}
+		case "triggers":
+			triggers, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("error parsing baseline %v: triggers must map trigger names to their lines", path)
+			}
+			for name, value := range triggers {
+				if ignored[name] {
+					continue
+				}
+				switch lines := value.(type) {
+				case string:
+					config.triggers[name] = []string{lines}
+				case []interface{}:
+					for _, line := range lines {
+						text, ok := line.(string)
+						if !ok {
+							return nil, fmt.Errorf("error parsing baseline %v: the lines of trigger %v must be strings", path, name)
+						}
+						config.triggers[name] = append(config.triggers[name], text)
+					}
+				default:
+					return nil, fmt.Errorf("error parsing baseline %v: trigger %v must be a list of lines", path, name)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("error parsing baseline %v: unknown section %v", path, section)
+		}
+	}
+	return config, nil
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Writes a configuration as a baseline that readBaseline reads back
+func writeBaseline(path string, config *serverConfig, source string) error {
+	file, err := output.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating baseline: %v", err)
+	}
+	defer file.Close()
+
+	fmt.Fprintf(file, "# Configuration baseline extracted by p4util config from %v\n", source)
+	fmt.Fprintf(file, "configurables:")
+	if len(config.configurables) == 0 {
+		fmt.Fprintf(file, " {}")
+	}
+	fmt.Fprintf(file, "\n")
+	for _, server := range sortedKeys(config.configurables) {
+		fmt.Fprintf(file, "  %v:\n", yamlKey(server))
+		for _, name := range sortedKeys(config.configurables[server]) {
+			fmt.Fprintf(file, "    %v: %v\n", yamlKey(name), strconv.Quote(config.configurables[server][name]))
+		}
+	}
+	fmt.Fprintf(file, "triggers:")
+	if len(config.triggers) == 0 {
+		fmt.Fprintf(file, " {}")
+	}
+	fmt.Fprintf(file, "\n")
+	for _, name := range sortedKeys(config.triggers) {
+		fmt.Fprintf(file, "  %v:\n", yamlKey(name))
+		for _, line := range config.triggers[name] {
+			fmt.Fprintf(file, "    - %v\n", strconv.Quote(line))
+		}
+	}
+	if err := file.Commit(); err != nil {
+		return fmt.Errorf("error writing baseline: %v", err)
+	}
+	return nil
+}
+
+// Lists the configurables and triggers that differ between the baseline and a checkpoint
+func diffConfig(expected *serverConfig, actual *serverConfig) []configDrift {
+	var drifts []configDrift
+	compare := func(kind string, server string, name string, expectedValue string, expectedOK bool, actualValue string, actualOK bool) {
+		switch {
+		case expectedOK && !actualOK:
+			drifts = append(drifts, configDrift{kind, server, name, driftMissing, expectedValue, ""})
+		case !expectedOK && actualOK:
+			drifts = append(drifts, configDrift{kind, server, name, driftUnexpected, "", actualValue})
+		case expectedValue != actualValue:
+			drifts = append(drifts, configDrift{kind, server, name, driftChanged, expectedValue, actualValue})
+		}
+	}
+
+	servers := make(map[string]bool)
+	for server := range expected.configurables {
+		servers[server] = true
+	}
+	for server := range actual.configurables {
+		servers[server] = true
+	}
+	for _, server := range sortedKeys(servers) {
+		names := make(map[string]bool)
+		for name := range expected.configurables[server] {
+			names[name] = true
+		}
+		for name := range actual.configurables[server] {
+			names[name] = true
+		}
+		for _, name := range sortedKeys(names) {
+			expectedValue, expectedOK := expected.configurables[server][name]
+			actualValue, actualOK := actual.configurables[server][name]
+			compare(configurableKind, server, name, expectedValue, expectedOK, actualValue, actualOK)
+		}
+	}
+
+	names := make(map[string]bool)
+	for name := range expected.triggers {
+		names[name] = true
+	}
+	for name := range actual.triggers {
+		names[name] = true
+	}
+	for _, name := range sortedKeys(names) {
+		expectedLines, expectedOK := expected.triggers[name]
+		actualLines, actualOK := actual.triggers[name]
+		compare(triggerKind, "", name, strings.Join(expectedLines, "\n"), expectedOK, strings.Join(actualLines, "\n"), actualOK)
+	}
+	return drifts
+}
+
+func runConfig(args []string) error {
+	flags := flag.NewFlagSet("config", flag.ExitOnError)
+	baseline := flags.String("baseline", "", "YAML baseline to compare the checkpoints with, reporting the drift instead of the configuration.")
+	writeBaselinePath := flags.String("write-baseline", "", "File to write the configuration of the checkpoint to, as a YAML baseline.")
+	ignore := flags.String("ignore", "", "Comma-separated configurables and triggers to leave out, such as the ones that differ on every server.")
+	failOnDrift := flags.Bool("fail-on-drift", false, "Exit with a non-zero code when a checkpoint drifted from the baseline.")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+	if len(*writeBaselinePath) > 0 && flags.NArg() > 1 {
+		return fmt.Errorf("-write-baseline takes a single checkpoint")
+	}
+	ignored := make(map[string]bool)
+	for _, name := range strings.Split(*ignore, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			ignored[name] = true
+		}
+	}
+
+	var expected *serverConfig
+	if len(*baseline) > 0 {
+		var err error
+		if expected, err = readBaseline(*baseline, ignored); err != nil {
+			return err
+		}
+	}
+
+	out, err := output.NewWriter(*format, *outputPath, output.Table{Name: "config"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if expected != nil {
+		out.Write([]string{"Checkpoint", "Kind", "Server", "Name", "Drift", "Expected", "Actual"})
+	} else {
+		out.Write([]string{"Checkpoint", "Kind", "Server", "Name", "Value"})
+	}
+	drifted := 0
+	for _, path := range flags.Args() {
+		actual, err := readCheckpointConfig(path, ignored)
+		if err != nil {
+			return err
+		}
+		configurables := 0
+		for _, server := range actual.configurables {
+			configurables += len(server)
+		}
+		slog.Info("Read configuration", logging.PathKey, path, "configurables", configurables, "triggers", len(actual.triggers))
+
+		if len(*writeBaselinePath) > 0 {
+			if err := writeBaseline(*writeBaselinePath, actual, path); err != nil {
+				return err
+			}
+			slog.Info("Wrote baseline", logging.PathKey, *writeBaselinePath)
+		}
+
+		if expected == nil {
+			for _, server := range sortedKeys(actual.configurables) {
+				for _, name := range sortedKeys(actual.configurables[server]) {
+					out.Write([]string{path, configurableKind, server, name, actual.configurables[server][name]})
+				}
+			}
+			for _, name := range sortedKeys(actual.triggers) {
+				for _, line := range actual.triggers[name] {
+					out.Write([]string{path, triggerKind, "", name, line})
+				}
+			}
+			continue
+		}
+
+		drifts := diffConfig(expected, actual)
+		for _, drift := range drifts {
+			out.Write([]string{path, drift.kind, drift.server, drift.name, drift.drift, drift.expected, drift.actual})
+		}
+		if len(drifts) > 0 {
+			drifted++
+			slog.Warn("Configuration drift", logging.PathKey, path, logging.CountKey, len(drifts))
+		}
+	}
+	if err := out.Commit(); err != nil {
+		return err
+	}
+
+	if expected != nil {
+		slog.Info("Compared with the baseline", logging.CountKey, flags.NArg(), "drifted", drifted)
+		if drifted > 0 && *failOnDrift {
+			return fmt.Errorf("%v of %v checkpoints drifted from the baseline", drifted, flags.NArg())
+		}
+	}
+	return nil
+}
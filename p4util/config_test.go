@@ -0,0 +1,28 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestConfig(t *testing.T) {
+	rows := runReport(t, runConfig, exampleJournal)
+	checkReport(t, rows, []int{1, 2, 3, 4}, [][]string{
+		{"Kind", "Server", "Name", "Value"},
+		{"configurable", "any", "configurationVersion", "1"},
+		{"configurable", "any", "unicode", "1"},
+	})
+}
@@ -0,0 +1,279 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/schema"
+)
+
+// The counter holding the last change number assigned by the server
+const changeCounter = "change"
+
+// A set of change numbers
+type changeSet []uint64
+
+func (s *changeSet) add(change int) {
+	if change <= 0 {
+		return
+	}
+	for len(*s) <= change/64 {
+		*s = append(*s, 0)
+	}
+	(*s)[change/64] |= 1 << (change % 64)
+}
+
+func (s changeSet) contains(change int) bool {
+	return change/64 < len(s) && s[change/64]&(1<<(change%64)) != 0
+}
+
+// A range of change numbers without a change, nor a known reason for it
+type changeGap struct {
+	from int
+	to   int
+}
+
+// The changes of a checkpoint, and the change numbers known to have been used by changes since gone
+type changeNumbers struct {
+	present changeSet
+	// Submitted changes are renumbered from their pending number, kept as their descKey, and
+	// deleted changes leave their number unused
+	explained changeSet
+	maxChange int
+	// The table holding the highest change
+	maxTable string
+	deleted  int
+}
+
+func (c *changeNumbers) see(change int, table string) {
+	if change > c.maxChange {
+		c.maxChange = change
+		c.maxTable = table
+	}
+}
+
+// Returns the ranges of change numbers, up to last, that are neither used nor explained
+func (c *changeNumbers) gaps(last int) []changeGap {
+	var gaps []changeGap
+	for change := 1; change <= last; change++ {
+		if c.present.contains(change) || c.explained.contains(change) {
+			continue
+		}
+		if len(gaps) > 0 && gaps[len(gaps)-1].to == change-1 {
+			gaps[len(gaps)-1].to = change
+		} else {
+			gaps = append(gaps, changeGap{from: change, to: change})
+		}
+	}
+	return gaps
+}
+
+// Reads change numbers or ranges (100-200) known to have been deleted, one per line, from a file
+func readKnownDeletes(filePath string, changes *changeNumbers) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		from, to, isRange := strings.Cut(text, "-")
+		first, err := strconv.Atoi(strings.TrimSpace(from))
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(strings.TrimSpace(to))
+		}
+		if err != nil || first <= 0 || last < first {
+			return fmt.Errorf("%v:%v: expected a change number or a range such as 100-200, got %v", filePath, line, text)
+		}
+		for change := first; change <= last; change++ {
+			changes.explained.add(change)
+		}
+	}
+	return scanner.Err()
+}
+
+func runCounters(args []string) error {
+	flags := flag.NewFlagSet("counters", flag.ExitOnError)
+	knownDeletes := flags.String("known-deletes", "", "File listing deleted change numbers or ranges (100-200), one per line, which don't count as gaps.")
+	gapsCSV := flags.String("gaps-csv", "", "File to write the unexplained gaps in change numbers to, as CSV.")
+	failOnGaps := flags.Bool("fail-on-gaps", false, "Exit with an error when change numbers have unexplained gaps, not only when the change counter is behind.")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+
+	changes := &changeNumbers{}
+	if len(*knownDeletes) > 0 {
+		if err := readKnownDeletes(*knownDeletes, changes); err != nil {
+			return err
+		}
+	}
+
+	counters := make(map[string]string)
+	tables := map[string]bool{"db.counters": true, "db.change": true, "db.rev": true, "db.revsh": true}
+	err := journal.ScanFile(flags.Arg(0), tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		switch record.Table {
+		case "db.counters":
+			var counter schema.Counter
+			if err := schema.Unmarshal(record, &counter); err != nil {
+				slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError, logging.Err(err))
+				return nil
+			}
+			counters[counter.Name] = counter.Value
+		case "db.change":
+			var change schema.Change
+			if err := schema.Unmarshal(record, &change); err != nil {
+				slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError, logging.Err(err))
+				return nil
+			}
+			changes.present.add(change.Change)
+			changes.see(change.Change, record.Table)
+			if change.DescKey != change.Change {
+				changes.explained.add(change.DescKey)
+			}
+		default:
+			var rev schema.Rev
+			if err := schema.Unmarshal(record, &rev); err != nil {
+				slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError, logging.Err(err))
+				return nil
+			}
+			changes.see(rev.Change, record.Table)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The changes deleted by the journals replayed after the checkpoint
+	for _, journalPath := range flags.Args()[1:] {
+		err := journal.ScanFile(journalPath, map[string]bool{"db.change": true}, func(record journal.Record) error {
+			if record.Operation != journal.DeleteValue {
+				return nil
+			}
+			var change schema.Change
+			if schema.Unmarshal(record, &change) == nil {
+				changes.explained.add(change.Change)
+				changes.deleted++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out, err := output.NewWriter(*format, *outputPath, output.Table{Name: "counters"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.Write([]string{"Name", "Value"})
+	for _, name := range names {
+		out.Write([]string{name, counters[name]})
+	}
+	if err := out.Commit(); err != nil {
+		return err
+	}
+
+	counterValue, ok := counters[changeCounter]
+	counter, err := strconv.Atoi(counterValue)
+	if !ok || err != nil {
+		if changes.maxChange > 0 {
+			return fmt.Errorf("no valid change counter (%q), but changes up to %v in %v", counterValue, changes.maxChange, changes.maxTable)
+		}
+		counter = 0
+	}
+	slog.Info("Change counter", "counter", counter, "max_change", changes.maxChange, logging.TableKey, changes.maxTable,
+		"known_deletes", changes.deleted)
+
+	gaps := changes.gaps(min(counter, changes.maxChange))
+	missing := 0
+	for i, gap := range gaps {
+		missing += gap.to - gap.from + 1
+		if i < 10 {
+			slog.Warn("Unexplained gap in change numbers", "from", gap.from, "to", gap.to)
+		}
+	}
+	slog.Info("Unexplained gaps in change numbers", "gaps", len(gaps), "changes", missing)
+	if len(*gapsCSV) > 0 {
+		if err := writeChangeGaps(*gapsCSV, gaps); err != nil {
+			return err
+		}
+	}
+
+	if counter < changes.maxChange {
+		// The next change would reuse the number of an existing one
+		return fmt.Errorf("the change counter (%v) is behind the highest change (%v in %v)", counter, changes.maxChange, changes.maxTable)
+	}
+	if *failOnGaps && len(gaps) > 0 {
+		return fmt.Errorf("%v unexplained gaps in change numbers", len(gaps))
+	}
+	return nil
+}
+
+func writeChangeGaps(filePath string, gaps []changeGap) error {
+	return output.WriteFile(filePath, func(w io.Writer) error {
+		csvWriter := output.NewCSVWriter(w)
+		csvWriter.Write([]string{"From", "To", "Changes"})
+		for _, gap := range gaps {
+			csvWriter.Write([]string{strconv.Itoa(gap.from), strconv.Itoa(gap.to), strconv.Itoa(gap.to - gap.from + 1)})
+		}
+		csvWriter.Flush()
+		if err := csvWriter.Error(); err != nil {
+			return fmt.Errorf("error writing csv: %v", err)
+		}
+		return nil
+	})
+}
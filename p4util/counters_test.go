@@ -0,0 +1,30 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestCounters(t *testing.T) {
+	rows := runReport(t, runCounters, exampleJournal)
+	checkReport(t, rows, []int{0, 1}, [][]string{
+		{"Name", "Value"},
+		{"change", "3"},
+		{"journal", "1"},
+		{"maxCommitChange", "3"},
+		{"upgrade", "36"},
+	})
+}
@@ -0,0 +1,400 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// The fields of the db.domain table, as indexes in journal.Record.Fields.
+// They are documented here: https://www.perforce.com/perforce/doc.current/schema/#db.domain.
+const (
+	DbDomainFieldName        = 0
+	DbDomainFieldType        = 1
+	DbDomainFieldExtra       = 2
+	DbDomainFieldMount       = 3
+	DbDomainFieldMount2      = 4
+	DbDomainFieldMount3      = 5
+	DbDomainFieldOwner       = 6
+	DbDomainFieldUpdateDate  = 7
+	DbDomainFieldAccessDate  = 8
+	DbDomainFieldOptions     = 9
+	DbDomainFieldDescription = 10
+	// Only recorded by newer servers
+	DbDomainFieldStream = 11
+
+	DbDomainFieldCount = 11
+)
+
+// The fields of the db.have table, as indexes in journal.Record.Fields.
+// They are documented here: https://www.perforce.com/perforce/doc.current/schema/#db.have.
+const (
+	DbHaveFieldClientFile = 0
+	DbHaveFieldDepotFile  = 1
+	DbHaveFieldHaveRev    = 2
+
+	DbHaveFieldCount = 3
+)
+
+// The domain types, see https://www.perforce.com/perforce/doc.current/schema/#DomainType
+const (
+	domainTypeBranch = "98"  // 'b'
+	domainTypeClient = "99"  // 'c'
+	domainTypeDepot  = "100" // 'd'
+	domainTypeLabel  = "108" // 'l'
+	domainTypeStream = "115" // 's'
+)
+
+var domainTypes = map[string]string{
+	domainTypeBranch: "branch",
+	domainTypeClient: "client",
+	domainTypeDepot:  "depot",
+	domainTypeLabel:  "label",
+	domainTypeStream: "stream",
+}
+
+// Bits of the options of db.domain, see https://www.perforce.com/perforce/doc.current/schema/#DomainOpts
+var clientOptions = []struct {
+	bit    int64
+	set    string
+	notSet string
+}{
+	{0x01, "allwrite", "noallwrite"},
+	{0x02, "clobber", "noclobber"},
+	{0x04, "compress", "nocompress"},
+	{0x08, "locked", "unlocked"},
+	{0x10, "modtime", "nomodtime"},
+	{0x20, "rmdir", "normdir"},
+}
+
+const domainOptionLocked = 0x08
+
+// A client, label, branch, stream or depot of db.domain
+type domainRecord struct {
+	name        string
+	domainType  string
+	host        string
+	root        string
+	stream      string
+	owner       string
+	options     string
+	description string
+	updateDate  int64
+	accessDate  int64
+}
+
+// Parses a db.domain record, logging and skipping the short ones
+func parseDomain(record journal.Record) (*domainRecord, bool) {
+	fields := record.Fields
+	if len(fields) < DbDomainFieldCount {
+		slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+			logging.ErrorClassKey, logging.MalformedError)
+		return nil, false
+	}
+	updateDate, _ := strconv.ParseInt(fields[DbDomainFieldUpdateDate], 10, 64)
+	accessDate, _ := strconv.ParseInt(fields[DbDomainFieldAccessDate], 10, 64)
+	return &domainRecord{
+		name:        fields[DbDomainFieldName],
+		domainType:  fields[DbDomainFieldType],
+		host:        fields[DbDomainFieldExtra],
+		root:        fields[DbDomainFieldMount],
+		stream:      record.Field(DbDomainFieldStream),
+		owner:       fields[DbDomainFieldOwner],
+		options:     fields[DbDomainFieldOptions],
+		description: fields[DbDomainFieldDescription],
+		updateDate:  updateDate,
+		accessDate:  accessDate,
+	}, true
+}
+
+// Returns the options as "p4 client" or "p4 label" shows them, or the raw value for other types
+func (d *domainRecord) optionNames() string {
+	options, err := strconv.ParseInt(d.options, 10, 64)
+	if err != nil {
+		return d.options
+	}
+	switch d.domainType {
+	case domainTypeClient:
+		names := make([]string, 0, len(clientOptions))
+		for _, option := range clientOptions {
+			if options&option.bit != 0 {
+				names = append(names, option.set)
+			} else {
+				names = append(names, option.notSet)
+			}
+		}
+		return strings.Join(names, " ")
+	case domainTypeLabel, domainTypeBranch:
+		if options&domainOptionLocked != 0 {
+			return "locked"
+		}
+		return "unlocked"
+	}
+	return d.options
+}
+
+// Parses a comma-separated list of domain type names
+func parseDomainTypes(names string) (map[string]bool, error) {
+	types := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for domainType, typeName := range domainTypes {
+			if name == typeName {
+				types[domainType] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown domain type %q", name)
+		}
+	}
+	return types, nil
+}
+
+func runDomains(args []string) error {
+	flags := flag.NewFlagSet("domains", flag.ExitOnError)
+	typeNames := flags.String("types", "client,label,branch,stream", "Comma-separated domain types to list (client, label, branch, stream, depot).")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+	types, err := parseDomainTypes(*typeNames)
+	if err != nil {
+		return err
+	}
+
+	out, err := output.NewWriter(*format, *outputPath, output.Table{Name: "domains"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.Write([]string{
+		"Name",
+		"Type",
+		"Owner",
+		"Host",
+		"Root",
+		"Stream",
+		"UpdateDate",
+		"AccessDate",
+		"Options",
+		"Description"})
+	counts := make(map[string]int)
+	err = journal.ScanFile(flags.Arg(0), map[string]bool{"db.domain": true}, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		domain, ok := parseDomain(record)
+		if !ok || !types[domain.domainType] {
+			return nil
+		}
+		out.Write([]string{
+			domain.name,
+			typeName(domainTypes, domain.domainType),
+			domain.owner,
+			domain.host,
+			domain.root,
+			domain.stream,
+			formatDate(domain.updateDate),
+			formatDate(domain.accessDate),
+			domain.optionNames(),
+			domain.description})
+		counts[domain.domainType]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := out.Commit(); err != nil {
+		return err
+	}
+
+	for _, domainType := range []string{domainTypeClient, domainTypeLabel, domainTypeBranch, domainTypeStream, domainTypeDepot} {
+		if types[domainType] {
+			slog.Info("Processed domains", "type", domainTypes[domainType], logging.CountKey, counts[domainType])
+		}
+	}
+	return nil
+}
+
+// A client workspace and the size of its have list
+type clientStats struct {
+	*domainRecord
+	haveFiles int
+}
+
+// Returns the client of a db.have clientFile, such as my_client for //my_client/dir/file.c
+func clientName(clientFile string) string {
+	name, _, _ := strings.Cut(strings.TrimPrefix(clientFile, "//"), "/")
+	return name
+}
+
+func runClients(args []string) error {
+	flags := flag.NewFlagSet("clients", flag.ExitOnError)
+	unusedDays := flags.Int("unused-days", 0, "Only report clients that haven't been accessed for this many days (0 for all clients).")
+	asOf := flags.String("as-of", "", "Date (YYYY-MM-DD) unused days are computed at, the checkpoint date by default.")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+
+	clients := make(map[string]*clientStats)
+	// Have lists are counted separately, as db.have may come before db.domain in journals
+	haveFiles := make(map[string]int)
+	checkpointDate := int64(0)
+
+	file, err := journal.Open(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	err = journal.Scan(file, func(record journal.Record) error {
+		if record.Operation == journal.NoteTransaction && record.Field(0) == "0" {
+			checkpointDate, _ = strconv.ParseInt(record.Field(1), 10, 64)
+			return nil
+		}
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		switch record.Table {
+		case "db.domain":
+			domain, ok := parseDomain(record)
+			if ok && domain.domainType == domainTypeClient {
+				clients[domain.name] = &clientStats{domainRecord: domain}
+			}
+		case "db.have":
+			if len(record.Fields) < DbHaveFieldCount {
+				slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			haveFiles[clientName(record.Fields[DbHaveFieldClientFile])]++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	orphaned := 0
+	for name, count := range haveFiles {
+		client, ok := clients[name]
+		if !ok {
+			orphaned += count
+			continue
+		}
+		client.haveFiles = count
+	}
+	if orphaned > 0 {
+		slog.Warn("Have list entries of clients not found in db.domain", logging.CountKey, orphaned)
+	}
+
+	now := time.Now()
+	if len(*asOf) > 0 {
+		if now, err = time.Parse("2006-01-02", *asOf); err != nil {
+			return fmt.Errorf("invalid -as-of date: %v", err)
+		}
+	} else if checkpointDate > 0 {
+		now = time.Unix(checkpointDate, 0)
+	}
+
+	// The largest have lists first, as deleting those clients shrinks db.have the most
+	ranked := make([]*clientStats, 0, len(clients))
+	for _, client := range clients {
+		ranked = append(ranked, client)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].haveFiles != ranked[j].haveFiles {
+			return ranked[i].haveFiles > ranked[j].haveFiles
+		}
+		return ranked[i].name < ranked[j].name
+	})
+
+	out, err := output.NewWriter(*format, *outputPath, output.Table{Name: "clients"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.Write([]string{
+		"Client",
+		"Owner",
+		"Host",
+		"Root",
+		"Stream",
+		"UpdateDate",
+		"AccessDate",
+		"UnusedDays",
+		"HaveFiles",
+		"Options",
+		"Description"})
+	reported := 0
+	reportedFiles := 0
+	for _, client := range ranked {
+		unused := int(now.Sub(time.Unix(client.accessDate, 0)).Hours() / 24)
+		if *unusedDays > 0 && unused < *unusedDays {
+			continue
+		}
+		out.Write([]string{
+			client.name,
+			client.owner,
+			client.host,
+			client.root,
+			client.stream,
+			formatDate(client.updateDate),
+			formatDate(client.accessDate),
+			strconv.Itoa(unused),
+			strconv.Itoa(client.haveFiles),
+			client.optionNames(),
+			client.description})
+		reported++
+		reportedFiles += client.haveFiles
+	}
+	if err := out.Commit(); err != nil {
+		return err
+	}
+
+	slog.Info("Processed clients", logging.CountKey, len(clients))
+	if *unusedDays > 0 {
+		slog.Info("Reported unused clients", logging.CountKey, reported, "have_files", reportedFiles,
+			"as_of", now.UTC().Format("2006-01-02"))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestClients(t *testing.T) {
+	rows := runReport(t, runClients, exampleJournal)
+	checkReport(t, rows, []int{0, 1, 2, 8, 9}, [][]string{
+		{"Client", "Owner", "Host", "HaveFiles", "Options"},
+		{"the_user_client", "the_user", "the_user1-W", "4", "noallwrite noclobber nocompress unlocked nomodtime normdir"},
+	})
+}
+
+func TestDomains(t *testing.T) {
+	rows := runReport(t, runDomains, "-types=depot", exampleJournal)
+	checkReport(t, rows, []int{0, 1, 9}, [][]string{
+		{"Name", "Type", "Description"},
+		{".p4-extensions", "depot", "Helix Core Extensions depot."},
+		{"depot", "depot", "Default depot"},
+		{"repo", "depot", "Default graph depot"},
+	})
+
+	rows = runReport(t, runDomains, exampleJournal)
+	checkReport(t, rows, []int{0, 1}, [][]string{
+		{"Name", "Type"},
+		{"the_user_client", "client"},
+	})
+}
+
+func TestParseDomainTypes(t *testing.T) {
+	types, err := parseDomainTypes("client, stream")
+	if err != nil {
+		t.Fatalf("parseDomainTypes() returned %v", err)
+	}
+	if len(types) != 2 || !types[domainTypeClient] || !types[domainTypeStream] {
+		t.Errorf("parseDomainTypes() = %v, want client and stream", types)
+	}
+	if _, err := parseDomainTypes("client,workspace"); err == nil {
+		t.Errorf("parseDomainTypes(workspace) succeeded, want an error")
+	}
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log/slog"
+	"sort"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+)
+
+// Calls fn for the records of the given tables of a checkpoint or journal, or of a
+// p4_storage_to_csv extraction, so that the reports computed from db.storage can be run again on
+// the extraction of a checkpoint instead of parsing it again. Extractions only have db.storage and
+// db.storagesh records.
+func scanCheckpointOrExtraction(path string, tables map[string]bool, fn func(journal.Record) error) error {
+	if !archive.IsExtraction(path) {
+		return journal.ScanFile(path, tables, fn)
+	}
+	var missing []string
+	for table := range tables {
+		if table != "db.storage" && table != "db.storagesh" {
+			missing = append(missing, table)
+		}
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		slog.Info("Reading a p4_storage_to_csv extraction, which has no records of the other tables",
+			logging.PathKey, path, "tables", missing)
+	} else {
+		slog.Info("Reading a p4_storage_to_csv extraction", logging.PathKey, path)
+	}
+	return archive.ScanExtraction(path, tables, fn)
+}
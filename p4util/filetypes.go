@@ -0,0 +1,201 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/lbr"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// The base type reported for librarian types that can't be decoded
+const unknownBaseType = "(unknown)"
+
+// Archive bytes and counts of a file extension and base type, by how they are stored
+type fileTypeStats struct {
+	extension string
+	baseType  string
+	archives  int
+	bytes     int64
+	// RCS deltas, full files stored as is (+F, and tempobj) and compressed full files (+C)
+	rcsArchives          int
+	rcsBytes             int64
+	uncompressedArchives int
+	uncompressedBytes    int64
+	compressedArchives   int
+	compressedBytes      int64
+	largeArchives        int
+	largeBytes           int64
+	largestBytes         int64
+}
+
+func runFileTypes(args []string) error {
+	flags := flag.NewFlagSet("filetypes", flag.ExitOnError)
+	largeSize := flags.Int64("large-size", 100<<20, "Size in bytes from which archives count as large files.")
+	minBytes := flags.Int64("min-bytes", 0, "Only report extensions and base types with at least this many archive bytes.")
+	limit := flags.Int("limit", 0, "Number of extensions and base types to report, largest first (0 for all).")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+
+	stats := make(map[string]*fileTypeStats)
+	// Bytes by base type and storage, for the summary
+	baseBytes := make(map[string]int64)
+	var rcsBytes, uncompressedBytes, compressedBytes int64
+	err := scanCheckpointOrExtraction(flags.Arg(0), map[string]bool{"db.storage": true}, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		storage, err := archive.ParseStorageRecord(record.Fields)
+		if err != nil {
+			slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+
+		baseType, ok := lbr.BaseType(storage.LbrType)
+		if !ok {
+			baseType = unknownBaseType
+		}
+		extension := archiveExtension(storage.LbrFile)
+		key := extension + "\x00" + baseType
+		stat, ok := stats[key]
+		if !ok {
+			stat = &fileTypeStats{extension: extension, baseType: baseType}
+			stats[key] = stat
+		}
+
+		stored := storage.ServerSize
+		if stored <= 0 {
+			// Not all servers record the size of the archive as stored
+			stored = storage.Size
+		}
+		switch archive.StorageType(storage.LbrType) {
+		case archive.RCSStorageType:
+			// As in the compression report, the revision sizes overstate the deltas of the ,v files
+			stored = storage.Size
+			stat.rcsArchives++
+			stat.rcsBytes += stored
+			rcsBytes += stored
+		case archive.BinaryStorageType, archive.TempObjStorageType:
+			stat.uncompressedArchives++
+			stat.uncompressedBytes += stored
+			uncompressedBytes += stored
+		case archive.CompressedStorageType, archive.CompressedTempObj:
+			stat.compressedArchives++
+			stat.compressedBytes += stored
+			compressedBytes += stored
+		case archive.TinyStorageType:
+			// Stored in db.revtx rather than under the depot root
+			return nil
+		}
+		stat.archives++
+		stat.bytes += stored
+		baseBytes[baseType] += stored
+		// Large files are the ones transferred large, whatever their storage
+		if storage.Size >= *largeSize {
+			stat.largeArchives++
+			stat.largeBytes += stored
+		}
+		if stored > stat.largestBytes {
+			stat.largestBytes = stored
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var reported []*fileTypeStats
+	for _, stat := range stats {
+		if stat.archives > 0 && stat.bytes >= *minBytes {
+			reported = append(reported, stat)
+		}
+	}
+	sort.Slice(reported, func(i, j int) bool {
+		a, b := reported[i], reported[j]
+		if a.bytes != b.bytes {
+			return a.bytes > b.bytes
+		}
+		if a.extension != b.extension {
+			return a.extension < b.extension
+		}
+		return a.baseType < b.baseType
+	})
+	if *limit > 0 && len(reported) > *limit {
+		reported = reported[:*limit]
+	}
+
+	out, err := output.NewWriter(*format, *outputPath, output.Table{Name: "filetypes"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.Write([]string{
+		"Extension",
+		"BaseType",
+		"Archives",
+		"Bytes",
+		"RCSArchives",
+		"RCSBytes",
+		"UncompressedArchives",
+		"UncompressedBytes",
+		"CompressedArchives",
+		"CompressedBytes",
+		"LargeArchives",
+		"LargeBytes",
+		"LargestBytes"})
+	for _, stat := range reported {
+		out.Write([]string{
+			stat.extension,
+			stat.baseType,
+			strconv.Itoa(stat.archives),
+			strconv.FormatInt(stat.bytes, 10),
+			strconv.Itoa(stat.rcsArchives),
+			strconv.FormatInt(stat.rcsBytes, 10),
+			strconv.Itoa(stat.uncompressedArchives),
+			strconv.FormatInt(stat.uncompressedBytes, 10),
+			strconv.Itoa(stat.compressedArchives),
+			strconv.FormatInt(stat.compressedBytes, 10),
+			strconv.Itoa(stat.largeArchives),
+			strconv.FormatInt(stat.largeBytes, 10),
+			strconv.FormatInt(stat.largestBytes, 10)})
+	}
+	if err := out.Commit(); err != nil {
+		return err
+	}
+
+	slog.Info("Archive bytes by base type", "text", baseBytes["text"], "unicode", baseBytes["unicode"],
+		"binary", baseBytes["binary"], "symlink", baseBytes["symlink"], "unknown", baseBytes[unknownBaseType])
+	slog.Info("Archive bytes by storage", "rcs", rcsBytes, "uncompressed", uncompressedBytes, "compressed", compressedBytes)
+	return nil
+}
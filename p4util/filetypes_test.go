@@ -0,0 +1,28 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestFileTypes(t *testing.T) {
+	rows := runReport(t, runFileTypes, exampleJournal)
+	checkReport(t, rows, []int{0, 1, 2, 3, 4, 8, 12}, [][]string{
+		{"Extension", "BaseType", "Archives", "Bytes", "RCSArchives", "CompressedArchives", "LargestBytes"},
+		{".dat", "binary", "3", "30663", "0", "3", "10221"},
+		{".txt", "text", "3", "37", "3", "0", "15"},
+	})
+}
@@ -0,0 +1,306 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// Archive bytes added and removed on a day (UTC), from db.storage records
+type dailyGrowth struct {
+	day     string
+	added   int64
+	removed int64
+}
+
+// Adds up the db.storage records of a journal by day. New archives are dated with their db.storage
+// date, which is when they were created. Removed archives keep the date they were created in
+// their @dv@ record, so they are dated with the transaction that removed them instead.
+func readStorageGrowth(path string, growth map[string]*dailyGrowth) (undated int, err error) {
+	day := func(timestamp int64) *dailyGrowth {
+		name := time.Unix(timestamp, 0).UTC().Format("2006-01-02")
+		daily, ok := growth[name]
+		if !ok {
+			daily = &dailyGrowth{day: name}
+			growth[name] = daily
+		}
+		return daily
+	}
+
+	file, err := journal.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	transactionTime := int64(0)
+	err = journal.Scan(file, func(record journal.Record) error {
+		switch record.Operation {
+		case journal.BeginTransaction, journal.EndTransaction:
+			// @ex@ <pid> <time>
+			if timestamp, err := strconv.ParseInt(record.Field(1), 10, 64); err == nil {
+				transactionTime = timestamp
+			}
+			return nil
+		case journal.PutValue, journal.DeleteValue:
+		default:
+			return nil
+		}
+		if record.Table != "db.storage" {
+			return nil
+		}
+		storage, err := archive.ParseStorageRecord(record.Fields)
+		if err != nil {
+			slog.Warn("Skipping malformed record", logging.PathKey, path, logging.TableKey, record.Table,
+				logging.LineKey, record.LineNumber, logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		size := storage.ServerSize
+		if size <= 0 {
+			// Not all servers record the size of the archive as stored
+			size = storage.Size
+		}
+		if record.Operation == journal.PutValue {
+			if storage.Date <= 0 {
+				undated++
+				return nil
+			}
+			day(storage.Date).added += size
+			return nil
+		}
+		if transactionTime == 0 {
+			undated++
+			return nil
+		}
+		day(transactionTime).removed += size
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error reading %v: %v", path, err)
+	}
+	return undated, nil
+}
+
+// When the free space of the volume runs out at the growth rate of the last days
+type volumeForecast struct {
+	from        string
+	to          string
+	days        int
+	bytesPerDay float64
+	// Negative when the volume isn't growing
+	daysToFull float64
+	fullDate   time.Time
+}
+
+// Forecasts from the net growth of the last days of the journals, up to the most recent day with
+// db.storage records. The window is shorter when the journals cover fewer days.
+func forecastVolume(growth []*dailyGrowth, days int, usable int64, now time.Time) volumeForecast {
+	last, _ := time.Parse("2006-01-02", growth[len(growth)-1].day)
+	first, _ := time.Parse("2006-01-02", growth[0].day)
+	start := last.AddDate(0, 0, 1-days)
+	if first.After(start) {
+		start = first
+	}
+	f := volumeForecast{
+		from:       start.Format("2006-01-02"),
+		to:         last.Format("2006-01-02"),
+		days:       int(last.Sub(start).Hours()/24) + 1,
+		daysToFull: -1,
+	}
+	net := int64(0)
+	for _, daily := range growth {
+		if daily.day >= f.from {
+			net += daily.added - daily.removed
+		}
+	}
+	f.bytesPerDay = float64(net) / float64(f.days)
+
+	switch {
+	case usable <= 0:
+		f.daysToFull = 0
+	case f.bytesPerDay > 0:
+		f.daysToFull = float64(usable) / f.bytesPerDay
+	default:
+		return f
+	}
+	f.fullDate = daysAfter(now, f.daysToFull)
+	return f
+}
+
+// The forecasts further away than this many days (about 2,700 years) are left without a date
+const maxForecastDays = 1e6
+
+// Returns the time a number of days after now, or the zero time beyond maxForecastDays. A
+// time.Duration only spans 292 years, which slow growth on a large volume exceeds, so the whole
+// days are added as a date.
+func daysAfter(now time.Time, days float64) time.Time {
+	if days > maxForecastDays {
+		return time.Time{}
+	}
+	whole := math.Floor(days)
+	return now.AddDate(0, 0, int(whole)).Add(time.Duration((days - whole) * 24 * float64(time.Hour)))
+}
+
+func writeDailyGrowth(filePath string, growth []*dailyGrowth) error {
+	file, err := output.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("error creating csv: %v", err)
+	}
+	defer file.Close()
+
+	csvWriter := output.NewCSVWriter(file)
+	csvWriter.Write([]string{"Date", "BytesAdded", "BytesRemoved", "NetBytes"})
+	for _, daily := range growth {
+		csvWriter.Write([]string{
+			daily.day,
+			strconv.FormatInt(daily.added, 10),
+			strconv.FormatInt(daily.removed, 10),
+			strconv.FormatInt(daily.added-daily.removed, 10)})
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return fmt.Errorf("error writing csv: %v", err)
+	}
+	return file.Commit()
+}
+
+func runForecast(args []string) error {
+	flags := flag.NewFlagSet("forecast", flag.ExitOnError)
+	volume := flags.String("volume", "", "Path on the archive volume whose free space is forecast, such as the depot root.")
+	days := flags.Int("days", 30, "Number of most recent days of the journals the growth rate is computed over.")
+	reservePercent := flags.Float64("reserve-percent", 0, "Percentage of the volume that counts as full when it's the only space left.")
+	alertDays := flags.Int("alert-days", 0, "Exit with a non-zero code when the volume is forecast to fill within this many days (0 to never).")
+	dailyCSV := flags.String("daily-csv", "", "File to write the archive bytes added and removed each day to, as CSV.")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || len(*volume) == 0 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+	if *days <= 0 {
+		return fmt.Errorf("-days must be positive")
+	}
+	if *reservePercent < 0 || *reservePercent >= 100 {
+		return fmt.Errorf("-reserve-percent must be between 0 and 100")
+	}
+
+	total, available, err := volumeSpace(*volume)
+	if err != nil {
+		return err
+	}
+
+	paths := flags.Args()
+	if len(paths) > 1 || paths[0] != journal.Stdin {
+		if paths, err = snapshotPaths(paths); err != nil {
+			return fmt.Errorf("error listing journals: %v", err)
+		}
+	}
+	growthByDay := make(map[string]*dailyGrowth)
+	for _, path := range paths {
+		undated, err := readStorageGrowth(path, growthByDay)
+		if err != nil {
+			return err
+		}
+		if undated > 0 {
+			slog.Warn("Skipped undated db.storage records", logging.PathKey, path, logging.CountKey, undated)
+		}
+		slog.Info("Read journal", logging.PathKey, path)
+	}
+	if len(growthByDay) == 0 {
+		return fmt.Errorf("no db.storage records found")
+	}
+	growth := make([]*dailyGrowth, 0, len(growthByDay))
+	for _, daily := range growthByDay {
+		growth = append(growth, daily)
+	}
+	sort.Slice(growth, func(i, j int) bool { return growth[i].day < growth[j].day })
+
+	reserve := int64(float64(total) * *reservePercent / 100)
+	f := forecastVolume(growth, *days, available-reserve, time.Now())
+	if f.days < *days {
+		slog.Warn("The journals cover fewer days than requested", "days", f.days, "requested", *days)
+	}
+
+	daysToFull, fullDate := "", ""
+	if f.daysToFull >= 0 {
+		daysToFull = strconv.FormatFloat(math.Floor(f.daysToFull), 'f', 0, 64)
+		if !f.fullDate.IsZero() {
+			fullDate = f.fullDate.UTC().Format("2006-01-02")
+		}
+	}
+	out, err := output.NewWriter(*format, *outputPath, output.Table{Name: "forecast"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.Write([]string{
+		"Volume",
+		"TotalBytes",
+		"AvailableBytes",
+		"ReserveBytes",
+		"From",
+		"To",
+		"Days",
+		"BytesPerDay",
+		"DaysToFull",
+		"FullDate"})
+	out.Write([]string{
+		*volume,
+		strconv.FormatInt(total, 10),
+		strconv.FormatInt(available, 10),
+		strconv.FormatInt(reserve, 10),
+		f.from,
+		f.to,
+		strconv.Itoa(f.days),
+		strconv.FormatInt(int64(f.bytesPerDay), 10),
+		daysToFull,
+		fullDate})
+	if err := out.Commit(); err != nil {
+		return err
+	}
+	if len(*dailyCSV) > 0 {
+		if err := writeDailyGrowth(*dailyCSV, growth); err != nil {
+			return err
+		}
+	}
+
+	if f.daysToFull < 0 {
+		slog.Info("The archive volume isn't growing", "volume", *volume, "bytes_per_day", int64(f.bytesPerDay))
+		return nil
+	}
+	slog.Info("Forecast", "volume", *volume, "bytes_per_day", int64(f.bytesPerDay), "days_to_full", daysToFull,
+		"full_date", fullDate)
+	if *alertDays > 0 && f.daysToFull < float64(*alertDays) {
+		return fmt.Errorf("volume %v is forecast to fill in %v days, on %v", *volume, daysToFull, fullDate)
+	}
+	return nil
+}
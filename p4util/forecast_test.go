@@ -0,0 +1,50 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestForecast(t *testing.T) {
+	volume := t.TempDir()
+	rows := runReport(t, runForecast, "-volume", volume, exampleJournal)
+	checkReport(t, rows, []int{0, 4, 5, 6, 7}, [][]string{
+		{"Volume", "From", "To", "Days", "BytesPerDay"},
+		{volume, "2021-01-18", "2021-01-18", "1", "31421"},
+	})
+}
+
+func TestDaysAfter(t *testing.T) {
+	now := time.Date(2021, 1, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		days float64
+		want time.Time
+	}{
+		{0, now},
+		{1.5, time.Date(2021, 1, 20, 0, 0, 0, 0, time.UTC)},
+		// Beyond the 292 years of a time.Duration
+		{365 * 400, time.Date(2420, 10, 13, 12, 0, 0, 0, time.UTC)},
+		{2564004, time.Time{}},
+	}
+	for _, test := range tests {
+		if got := daysAfter(now, test.days); !got.Equal(test.want) {
+			t.Errorf("daysAfter(%v) = %v, want %v", test.days, got, test.want)
+		}
+	}
+}
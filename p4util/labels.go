@@ -0,0 +1,257 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// The fields of the db.label table, as indexes in journal.Record.Fields.
+// They are documented here: https://www.perforce.com/perforce/doc.current/schema/#db.label.
+const (
+	DbLabelFieldName      = 0
+	DbLabelFieldDepotFile = 1
+	DbLabelFieldHaveRev   = 2
+
+	DbLabelFieldCount = 3
+)
+
+type labelStats struct {
+	name        string
+	owner       string
+	description string
+	updateDate  int64
+	accessDate  int64
+	revisions   int
+	bytes       int64
+}
+
+// Labels have no tagged revisions in db.label when they are automatic labels (or empty static labels)
+func (l *labelStats) labelType() string {
+	if l.revisions > 0 {
+		return "static"
+	}
+	return "automatic"
+}
+
+// The archive of a revision, waiting for the db.storage size of that archive
+type revisionArchive struct {
+	lbrKey     string
+	recordSize int64
+}
+
+func runLabels(args []string) error {
+	flags := flag.NewFlagSet("labels", flag.ExitOnError)
+	unusedYears := flags.Float64("unused-years", 0, "Only report labels that haven't been used for this many years (0 for all labels).")
+	asOf := flags.String("as-of", "", "Date (YYYY-MM-DD) unused days are computed at, the checkpoint date by default.")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+
+	labels := make(map[string]*labelStats)
+	// The labels tagging each depotFile@rev, resolved to archives once all the tables are read
+	tagged := make(map[string][]*labelStats)
+	revisions := make(map[string]revisionArchive)
+	archiveSizes := make(map[string]int64)
+	checkpointDate := int64(0)
+
+	file, err := journal.Open(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	err = journal.Scan(file, func(record journal.Record) error {
+		if record.Operation == journal.NoteTransaction && record.Field(0) == "0" {
+			checkpointDate, _ = strconv.ParseInt(record.Field(1), 10, 64)
+			return nil
+		}
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		fields := record.Fields
+		switch record.Table {
+		case "db.domain":
+			domain, ok := parseDomain(record)
+			if !ok || domain.domainType != domainTypeLabel {
+				return nil
+			}
+			labels[domain.name] = &labelStats{
+				name:        domain.name,
+				owner:       domain.owner,
+				description: domain.description,
+				updateDate:  domain.updateDate,
+				accessDate:  domain.accessDate,
+			}
+		case "db.label":
+			if len(fields) < DbLabelFieldCount {
+				slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			label, ok := labels[fields[DbLabelFieldName]]
+			if !ok {
+				// Tags of a label whose spec was deleted
+				label = &labelStats{name: fields[DbLabelFieldName]}
+				labels[label.name] = label
+			}
+			label.revisions++
+			key := fields[DbLabelFieldDepotFile] + "\x00" + fields[DbLabelFieldHaveRev]
+			tagged[key] = append(tagged[key], label)
+		case "db.rev":
+			if len(fields) < archive.DbRevFieldCount {
+				slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			revision := revisionArchive{}
+			action, _ := strconv.Atoi(fields[archive.DbRevFieldAction])
+			if archive.FileAction(action).HasArchive() {
+				// Lazy copies reference the archive of another revision, which a label keeps alive all the same
+				revision.lbrKey = fields[archive.DbRevFieldLbrFile] + "\x00" + fields[archive.DbRevFieldLbrRev]
+				revision.recordSize, _ = strconv.ParseInt(fields[archive.DbRevFieldSize], 10, 64)
+			}
+			revisions[fields[archive.DbRevFieldDepotFile]+"\x00"+fields[archive.DbRevFieldDepotRev]] = revision
+		case "db.storage":
+			if len(fields) < archive.DbStorageFieldCount {
+				slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			size, err := strconv.ParseInt(fields[archive.DbStorageFieldServerSize], 10, 64)
+			if err != nil || size <= 0 {
+				// Not all servers record the size of the archive as stored
+				size, _ = strconv.ParseInt(fields[archive.DbStorageFieldSize], 10, 64)
+			}
+			archiveSizes[fields[archive.DbStorageFieldLbrFile]+"\x00"+fields[archive.DbStorageFieldLbrRev]] = size
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	unresolved := 0
+	for key, taggedLabels := range tagged {
+		revision, ok := revisions[key]
+		if !ok {
+			unresolved++
+			continue
+		}
+		if len(revision.lbrKey) == 0 {
+			continue
+		}
+		size, ok := archiveSizes[revision.lbrKey]
+		if !ok {
+			size = revision.recordSize
+		}
+		for _, label := range taggedLabels {
+			label.bytes += size
+		}
+	}
+	if unresolved > 0 {
+		slog.Warn("Tagged revisions not found in db.rev", logging.CountKey, unresolved)
+	}
+
+	now := time.Now()
+	if len(*asOf) > 0 {
+		if now, err = time.Parse("2006-01-02", *asOf); err != nil {
+			return fmt.Errorf("invalid -as-of date: %v", err)
+		}
+	} else if checkpointDate > 0 {
+		now = time.Unix(checkpointDate, 0)
+	}
+
+	// The heaviest static labels first
+	ranked := make([]*labelStats, 0, len(labels))
+	for _, label := range labels {
+		ranked = append(ranked, label)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].revisions != ranked[j].revisions {
+			return ranked[i].revisions > ranked[j].revisions
+		}
+		return ranked[i].name < ranked[j].name
+	})
+
+	out, err := output.NewWriter(*format, *outputPath, output.Table{Name: "labels"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.Write([]string{
+		"Label",
+		"Owner",
+		"Type",
+		"UpdateDate",
+		"AccessDate",
+		"UnusedDays",
+		"TaggedRevisions",
+		"TaggedBytes",
+		"Description"})
+	reported := 0
+	staticCount := 0
+	unusedRevisions := 0
+	for _, label := range ranked {
+		if label.revisions > 0 {
+			staticCount++
+		}
+		unused := int(now.Sub(time.Unix(label.accessDate, 0)).Hours() / 24)
+		if *unusedYears > 0 && float64(unused) < *unusedYears*365 {
+			continue
+		}
+		unusedRevisions += label.revisions
+		out.Write([]string{
+			label.name,
+			label.owner,
+			label.labelType(),
+			formatDate(label.updateDate),
+			formatDate(label.accessDate),
+			strconv.Itoa(unused),
+			strconv.Itoa(label.revisions),
+			strconv.FormatInt(label.bytes, 10),
+			label.description})
+		reported++
+	}
+	if err := out.Commit(); err != nil {
+		return err
+	}
+
+	slog.Info("Processed labels", logging.CountKey, len(labels), "static", staticCount)
+	if *unusedYears > 0 {
+		slog.Info("Reported unused labels", logging.CountKey, reported, "tagged_revisions", unusedRevisions,
+			"as_of", now.UTC().Format("2006-01-02"))
+	}
+	return nil
+}
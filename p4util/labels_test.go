@@ -0,0 +1,31 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestLabels(t *testing.T) {
+	checkpoint := writeCheckpoint(t, `@pv@ 7 @db.domain@ @release1@ 108 @@ @@ @@ @@ @the_user@ 1611008040 1611008045 0 @Release 1@ @@ @@ 0 
+@pv@ 7 @db.label@ @release1@ @//depot/path1/data1.dat@ 2 
+@pv@ 7 @db.label@ @release1@ @//depot/path1/README.txt@ 1 
+`)
+	rows := runReport(t, runLabels, checkpoint)
+	checkReport(t, rows, []int{0, 1, 2, 6, 7, 8}, [][]string{
+		{"Label", "Owner", "Type", "TaggedRevisions", "TaggedBytes", "Description"},
+		{"release1", "the_user", "static", "2", "10424", "Release 1"},
+	})
+}
@@ -0,0 +1,346 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// The users of a checkpoint, dated from its header, or from the modification time of the file for
+// journals without one
+type userSnapshot struct {
+	path  string
+	date  time.Time
+	users map[string]*userRecord
+}
+
+// Only standard users consume a license
+func (s *userSnapshot) licensed() map[string]*userRecord {
+	licensed := make(map[string]*userRecord)
+	for name, user := range s.users {
+		if user.userType == "standard" {
+			licensed[name] = user
+		}
+	}
+	return licensed
+}
+
+func readUserSnapshot(path string) (*userSnapshot, error) {
+	file, err := journal.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	s := &userSnapshot{path: path, users: make(map[string]*userRecord)}
+	err = journal.Scan(file, func(record journal.Record) error {
+		if record.Operation == journal.NoteTransaction && record.Field(0) == "0" {
+			if date, err := strconv.ParseInt(record.Field(1), 10, 64); err == nil {
+				s.date = time.Unix(date, 0)
+			}
+			return nil
+		}
+		if record.Operation != journal.PutValue || record.Table != "db.user" {
+			return nil
+		}
+		if len(record.Fields) < DbUserFieldCount {
+			slog.Warn("Skipping short record", logging.PathKey, path, logging.TableKey, record.Table,
+				logging.LineKey, record.LineNumber, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		accessDate, _ := strconv.ParseInt(record.Fields[DbUserFieldAccessDate], 10, 64)
+		s.users[record.Fields[DbUserFieldUser]] = &userRecord{
+			fields:     record.Fields,
+			userType:   typeName(userTypes, record.Fields[DbUserFieldType]),
+			accessDate: accessDate,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading %v: %v", path, err)
+	}
+	if s.date.IsZero() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %v: %v", path, err)
+		}
+		s.date = info.ModTime()
+	}
+	return s, nil
+}
+
+// Reads the number of users a Helix Core license file allows, from its Users: line
+func readLicenseSeats(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("error reading license: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "Users") {
+			continue
+		}
+		seats, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return 0, fmt.Errorf("license %v doesn't limit users to a number: %q", path, strings.TrimSpace(value))
+		}
+		return seats, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("error reading license: %v", err)
+	}
+	return 0, fmt.Errorf("license %v has no Users: line", path)
+}
+
+// The licensed users added and removed between the first and last snapshots of the window
+type seatGrowth struct {
+	from    time.Time
+	to      time.Time
+	days    float64
+	added   int
+	removed int
+}
+
+func (g seatGrowth) perDay(users int) float64 {
+	if g.days <= 0 {
+		return 0
+	}
+	return float64(users) / g.days
+}
+
+// Counts the users added and removed between consecutive snapshots, over the snapshots taken in the
+// last days before the most recent one. Snapshots must be sorted by date.
+func measureSeatGrowth(snapshots []*userSnapshot, days int) seatGrowth {
+	last := snapshots[len(snapshots)-1]
+	start := last.date.AddDate(0, 0, -days)
+	first := len(snapshots) - 1
+	for first > 0 && !snapshots[first-1].date.Before(start) {
+		first--
+	}
+	g := seatGrowth{from: snapshots[first].date, to: last.date, days: last.date.Sub(snapshots[first].date).Hours() / 24}
+	previous := snapshots[first].licensed()
+	for _, s := range snapshots[first+1:] {
+		current := s.licensed()
+		for name := range current {
+			if _, ok := previous[name]; !ok {
+				g.added++
+			}
+		}
+		for name := range previous {
+			if _, ok := current[name]; !ok {
+				g.removed++
+			}
+		}
+		previous = current
+	}
+	return g
+}
+
+// The days until the free seats are used at the net rate of users added, or -1 when the number of
+// users isn't growing
+func daysToFull(free int, netPerDay float64) float64 {
+	switch {
+	case free <= 0:
+		return 0
+	case netPerDay > 0:
+		return float64(free) / netPerDay
+	}
+	return -1
+}
+
+func formatDaysToFull(days float64, now time.Time) (string, string) {
+	if days < 0 {
+		return "", ""
+	}
+	date := daysAfter(now, days)
+	if date.IsZero() {
+		return strconv.FormatFloat(math.Floor(days), 'f', 0, 64), ""
+	}
+	return strconv.FormatFloat(math.Floor(days), 'f', 0, 64), date.UTC().Format("2006-01-02")
+}
+
+func writeReclaimableUsers(filePath string, names []string, users map[string]*userRecord, now time.Time) error {
+	file, err := output.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("error creating csv: %v", err)
+	}
+	defer file.Close()
+
+	csvWriter := output.NewCSVWriter(file)
+	csvWriter.Write([]string{"User", "Email", "FullName", "AccessDate", "IdleDays"})
+	for _, name := range names {
+		user := users[name]
+		csvWriter.Write([]string{
+			name,
+			user.fields[DbUserFieldEmail],
+			user.fields[DbUserFieldFullName],
+			formatDate(user.accessDate),
+			strconv.Itoa(int(now.Sub(time.Unix(user.accessDate, 0)).Hours() / 24))})
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return fmt.Errorf("error writing csv: %v", err)
+	}
+	return file.Commit()
+}
+
+func runLicenses(args []string) error {
+	flags := flag.NewFlagSet("licenses", flag.ExitOnError)
+	license := flags.String("license", "", "Helix Core license file the number of seats is read from.")
+	seats := flags.Int("seats", 0, "Number of licensed users, instead of reading them from -license.")
+	idleDays := flags.Int("idle-days", 90, "Number of days without accessing the server after which a standard user can be reclaimed.")
+	days := flags.Int("days", 365, "Number of days before the most recent checkpoint the rate of users added is computed over.")
+	alertDays := flags.Int("alert-days", 0, "Exit with a non-zero code when the seats are forecast to run out within this many days (0 to never).")
+	usersCSV := flags.String("users-csv", "", "File to write the reclaimable users to, as CSV.")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	flags.Parse(args)
+
+	if flags.NArg() < 1 || (len(*license) == 0) == (*seats <= 0) {
+		return fmt.Errorf("insufficient number or arguments specified, one of -license or -seats is required")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+	if *days <= 0 {
+		return fmt.Errorf("-days must be positive")
+	}
+	if len(*license) > 0 {
+		var err error
+		if *seats, err = readLicenseSeats(*license); err != nil {
+			return err
+		}
+		slog.Info("Read license", logging.PathKey, *license, "seats", *seats)
+	}
+
+	paths := flags.Args()
+	if len(paths) > 1 || paths[0] != journal.Stdin {
+		var err error
+		if paths, err = snapshotPaths(paths); err != nil {
+			return fmt.Errorf("error listing checkpoints: %v", err)
+		}
+	}
+	var snapshots []*userSnapshot
+	for _, path := range paths {
+		s, err := readUserSnapshot(path)
+		if err != nil {
+			return err
+		}
+		slog.Info("Read checkpoint", logging.PathKey, path, "date", s.date.UTC().Format("2006-01-02"), "users", len(s.users))
+		snapshots = append(snapshots, s)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].date.Before(snapshots[j].date) })
+
+	current := snapshots[len(snapshots)-1]
+	now := current.date
+	users := current.licensed()
+	var reclaimable []string
+	for name, user := range users {
+		if int(now.Sub(time.Unix(user.accessDate, 0)).Hours()/24) >= *idleDays {
+			reclaimable = append(reclaimable, name)
+		}
+	}
+	sort.Strings(reclaimable)
+
+	g := measureSeatGrowth(snapshots, *days)
+	if g.days < 1 {
+		slog.Warn("The checkpoints don't span a day, the seats can't be forecast", logging.CountKey, len(snapshots))
+	} else if g.days < float64(*days) {
+		slog.Warn("The checkpoints cover fewer days than requested", "days", int(g.days), "requested", *days)
+	}
+	netPerDay := g.perDay(g.added - g.removed)
+	free := *seats - len(users)
+	untilFull, fullDate := formatDaysToFull(daysToFull(free, netPerDay), now)
+	untilFullReclaimed, fullDateReclaimed := formatDaysToFull(daysToFull(free+len(reclaimable), netPerDay), now)
+
+	out, err := output.NewWriter(*format, *outputPath, output.Table{Name: "licenses"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.Write([]string{
+		"Date",
+		"Seats",
+		"Users",
+		"UtilizationPercent",
+		"FreeSeats",
+		"Reclaimable",
+		"From",
+		"To",
+		"UsersAdded",
+		"UsersRemoved",
+		"AddedPerDay",
+		"NetPerDay",
+		"DaysToFull",
+		"FullDate",
+		"DaysToFullAfterReclaim",
+		"FullDateAfterReclaim"})
+	out.Write([]string{
+		now.UTC().Format("2006-01-02"),
+		strconv.Itoa(*seats),
+		strconv.Itoa(len(users)),
+		strconv.FormatFloat(100*float64(len(users))/float64(*seats), 'f', 1, 64),
+		strconv.Itoa(free),
+		strconv.Itoa(len(reclaimable)),
+		g.from.UTC().Format("2006-01-02"),
+		g.to.UTC().Format("2006-01-02"),
+		strconv.Itoa(g.added),
+		strconv.Itoa(g.removed),
+		strconv.FormatFloat(g.perDay(g.added), 'f', 2, 64),
+		strconv.FormatFloat(netPerDay, 'f', 2, 64),
+		untilFull,
+		fullDate,
+		untilFullReclaimed,
+		fullDateReclaimed})
+	if err := out.Commit(); err != nil {
+		return err
+	}
+	if len(*usersCSV) > 0 {
+		if err := writeReclaimableUsers(*usersCSV, reclaimable, users, now); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("License usage", "seats", *seats, "users", len(users), "free", free, "reclaimable", len(reclaimable),
+		"idle_days", *idleDays)
+	if len(untilFull) == 0 {
+		slog.Info("The number of licensed users isn't growing", "net_per_day", netPerDay)
+		return nil
+	}
+	slog.Info("Forecast", "net_per_day", netPerDay, "days_to_full", untilFull, "full_date", fullDate,
+		"full_date_after_reclaim", fullDateReclaimed)
+	if *alertDays > 0 && daysToFull(free, netPerDay) < float64(*alertDays) {
+		return fmt.Errorf("the seats are forecast to run out in %v days, on %v", untilFull, fullDate)
+	}
+	return nil
+}
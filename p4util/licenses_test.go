@@ -0,0 +1,52 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLicenses(t *testing.T) {
+	rows := runReport(t, runLicenses, "-seats=5", exampleJournal)
+	checkReport(t, rows, []int{0, 1, 2, 3, 4}, [][]string{
+		{"Date", "Seats", "Users", "UtilizationPercent", "FreeSeats"},
+		{"2021-01-18", "5", "1", "20.0", "4"},
+	})
+}
+
+func TestFormatDaysToFull(t *testing.T) {
+	now := time.Date(2021, 1, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		days     float64
+		wantDays string
+		wantDate string
+	}{
+		{-1, "", ""},
+		{0, "0", "2021-01-18"},
+		{10.5, "10", "2021-01-29"},
+		// A user added every few decades, beyond the 292 years of a time.Duration
+		{400 * 365, "146000", "2420-10-13"},
+		{5e6, "5000000", ""},
+	}
+	for _, test := range tests {
+		days, date := formatDaysToFull(test.days, now)
+		if days != test.wantDays || date != test.wantDate {
+			t.Errorf("formatDaysToFull(%v) = %v, %v, want %v, %v", test.days, days, date, test.wantDays, test.wantDate)
+		}
+	}
+}
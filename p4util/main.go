@@ -0,0 +1,123 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The binary p4util groups reports computed from Perforce checkpoints and journals.
+// Each report is a subcommand with its own flags:
+//
+//	p4util [global flags] <command> [command flags] <arguments>
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/jsonrpc"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	_ "github.com/google/perforce-utils/perforceutils/output/bigquery"
+	_ "github.com/google/perforce-utils/perforceutils/output/parquet"
+	_ "github.com/google/perforce-utils/perforceutils/output/sqlite"
+)
+
+// The usage of the -output flag of the commands writing CSV
+const outputUsage = "File, or table for the database formats, to write the report to, replaced only once complete (the standard output by default)."
+
+type command struct {
+	description string
+	run         func(args []string) error
+}
+
+var commands = map[string]command{
+	"activity":    {"Reports submit activity by path and hour of the day or week, to plan maintenance windows.", runActivity},
+	"age":         {"Reports archive bytes by age and the directories holding cold data.", runAge},
+	"compression": {"Reports archive bytes stored uncompressed and the savings of compressing them.", runCompression},
+	"clients":     {"Reports client workspaces with their have list sizes, and the ones unused for a number of days.", runClients},
+	"counters":    {"Extracts counters, and checks the change counter and the continuity of change numbers.", runCounters},
+	"config":      {"Extracts configurables and triggers, and compares them with a YAML baseline to detect drift.", runConfig},
+	"domains":     {"Extracts clients, labels, branches and streams from db.domain.", runDomains},
+	"filetypes":   {"Reports archive bytes and large files by file extension and base type, and how they are stored.", runFileTypes},
+	"groups":      {"Extracts group memberships from db.group.", runGroups},
+	"licenses":    {"Reports license utilization, reclaimable users and when the seats run out.", runLicenses},
+	"labels":      {"Extracts labels from db.domain and the revisions they tag from db.label.", runLabels},
+	"manifest":    {"Lists the expected archive files with their size and digest, to validate backups.", runManifest},
+	"streams":     {"Extracts streams with their parents and specs, and reports broken stream hierarchies.", runStreams},
+	"owners":      {"Attributes archive bytes to the users who submitted them and to their groups.", runOwners},
+	"top":         {"Ranks depot files by archive size, revision count and recent growth.", runTop},
+	"trends":      {"Reports depot growth over time from a series of checkpoints or extractions.", runTrends},
+	"forecast":    {"Forecasts when the archive volume fills, from the archive growth recorded in journals.", runForecast},
+	"users":       {"Extracts users from db.user and reports idle users.", runUsers},
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: p4util [global flags] <command> [command flags] <arguments>\n\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %-12v %v\n", name, commands[name].description)
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "\nGlobal flags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	verbose := flag.Bool("verbose", false, "Verbose output.")
+	logging.RegisterFlags(flag.CommandLine)
+	journal.RegisterFlags(flag.CommandLine)
+	jsonrpc.RegisterFlags(flag.CommandLine)
+	output.RegisterCSVFlags(flag.CommandLine)
+	flag.Usage = usage
+
+	flag.Parse()
+	if err := logging.Setup(*verbose); err != nil {
+		logging.Fatal("Invalid logging options", logging.Err(err))
+	}
+	if jsonrpc.Enabled() {
+		if err := jsonrpc.Serve(os.Stdin, os.Stdout); err != nil {
+			logging.Fatal("Error serving JSON-RPC requests", logging.Err(err))
+		}
+		return
+	}
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		logging.Fatal("Unknown command", "command", flag.Arg(0))
+	}
+
+	start := time.Now()
+	err := cmd.run(flag.Args()[1:])
+	if err != nil {
+		slog.Error("Error running command", "command", flag.Arg(0), logging.Err(err))
+	}
+
+	elapsed := time.Since(start)
+	slog.Info("Execution took", logging.DurationKey, elapsed.String())
+
+	if err != nil {
+		os.Exit(1)
+	}
+}
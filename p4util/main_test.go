@@ -0,0 +1,74 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const exampleJournal = "../perforceutils/testdata/example_journal.txt"
+
+// Runs a command writing its CSV report to a temporary file, and returns the rows of the report
+func runReport(t *testing.T, run func([]string) error, args ...string) [][]string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "report.csv")
+	if err := run(append([]string{"-output", path}, args...)); err != nil {
+		t.Fatalf("run(%v) returned %v", args, err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open() returned %v", err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll() returned %v", err)
+	}
+	return rows
+}
+
+// Writes the example journal followed by the given lines to a temporary checkpoint
+func writeCheckpoint(t *testing.T, lines string) string {
+	t.Helper()
+	example, err := os.ReadFile(exampleJournal)
+	if err != nil {
+		t.Fatalf("ReadFile() returned %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	if err := os.WriteFile(path, append(example, lines...), 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+	return path
+}
+
+// Checks the rows of a report, leaving out the columns not in columns
+func checkReport(t *testing.T, rows [][]string, columns []int, want [][]string) {
+	t.Helper()
+	got := make([][]string, len(rows))
+	for i, row := range rows {
+		for _, column := range columns {
+			got[i] = append(got[i], row[column])
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("report = %q, want %q", got, want)
+	}
+}
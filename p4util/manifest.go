@@ -0,0 +1,204 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// The formats of the manifests written by the manifest command
+const (
+	// A "digest  path" line per archive, as written and checked by md5sum
+	md5sumManifest = "md5sum"
+	// A JSON object per archive and line, with its path, size and digest when known
+	jsonManifest = "json"
+)
+
+// An archive file expected under the depot root
+type manifestEntry struct {
+	Path string `json:"path"`
+	// The size and MD5 digest of the file as stored, when recorded: RCS files hold several
+	// revisions, so neither is known for them
+	Size int64  `json:"size,omitempty"`
+	MD5  string `json:"md5,omitempty"`
+}
+
+// Returns the entry of the archive of a db.storage record, or false when it isn't stored in a file
+// of its own under the depot root, such as tiny files stored in db.revtx
+func storageManifestEntry(storage *archive.StorageRecord, lbrType int, depots archive.DepotMaps) (manifestEntry, bool) {
+	path := archive.ArchiveFilePath("", depots, storage.LbrFile, storage.LbrRev, lbrType)
+	entry := manifestEntry{}
+	switch archive.StorageType(lbrType) {
+	case archive.RCSStorageType:
+		entry.Path = filepath.Dir(path)
+		return entry, true
+	case archive.BinaryStorageType, archive.TempObjStorageType:
+		// Stored as is, so the digest of the content is the one of the file
+		entry.Path, entry.Size, entry.MD5 = path, storage.ServerSize, storage.Digest
+		if entry.Size <= 0 {
+			entry.Size = storage.Size
+		}
+	case archive.CompressedStorageType, archive.CompressedTempObj:
+		entry.Path, entry.Size, entry.MD5 = path, storage.ServerSize, storage.CompCksum
+	default:
+		return entry, false
+	}
+	// Servers leave the digests empty or zeroed when unknown
+	if len(strings.Trim(entry.MD5, "0")) == 0 {
+		entry.MD5 = ""
+	}
+	entry.MD5 = strings.ToLower(entry.MD5)
+	return entry, true
+}
+
+// Reads the depot maps of a checkpoint, or none from the standard input which can't be read twice
+func readManifestDepotMaps(path string) (archive.DepotMaps, error) {
+	if path == journal.Stdin {
+		slog.Info("Depot maps not read from the standard input, assuming depots are stored under their name")
+		return nil, nil
+	}
+	file, err := journal.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+	depots, err := archive.ReadDepotMaps(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading depot maps: %v", err)
+	}
+	return depots, nil
+}
+
+func runManifest(args []string) error {
+	flags := flag.NewFlagSet("manifest", flag.ExitOnError)
+	manifestFormat := flags.String("manifest-format", md5sumManifest, "Format of the manifest: md5sum (checked with md5sum -c) or json (a JSON object per line, with the sizes).")
+	prefix := flags.String("prefix", "", "Prefix of the archive paths, such as the depot root or the path of the backup in its bucket (relative to the depot root by default).")
+	outputPath := flags.String("output", output.Stdout, "File to write the manifest to, replaced only once complete (the standard output by default).")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if *manifestFormat != md5sumManifest && *manifestFormat != jsonManifest {
+		return fmt.Errorf("unknown -manifest-format %v, expected %v or %v", *manifestFormat, md5sumManifest, jsonManifest)
+	}
+
+	depots, err := readManifestDepotMaps(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	for depot, dir := range depots {
+		slog.Info("Remapped depot", logging.DepotKey, depot, logging.PathKey, dir)
+	}
+
+	var listed, rcsFiles, withoutDigest, withoutFile int
+	err = output.WriteFile(*outputPath, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		// The archives of db.storage that belong to shelved files, which db.revsh lists first
+		shelved := make(map[string]bool)
+		// The shelved archives listed so far, as servers listing them in db.storagesh may also keep
+		// them in db.storage
+		listedShelves := make(map[string]bool)
+		// db.storage lists the revisions of an RCS file one after the other
+		lastRCSFile := ""
+		tables := map[string]bool{"db.revsh": true, "db.storage": true, "db.storagesh": true}
+		return journal.ScanFile(flags.Arg(0), tables, func(record journal.Record) error {
+			if record.Operation != journal.PutValue {
+				return nil
+			}
+			if record.Table == "db.revsh" {
+				rev, err := archive.ParseRevRecord(record.Fields)
+				if err != nil {
+					slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+						logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+					return nil
+				}
+				shelved[rev.LbrFile+"\x00"+rev.LbrRev] = true
+				return nil
+			}
+			storage, err := archive.ParseStorageRecord(record.Fields)
+			if err != nil {
+				slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			lbrType := storage.LbrType
+			if record.Table == "db.storagesh" || shelved[storage.LbrFile+"\x00"+storage.LbrRev] {
+				lbrType = archive.ShelvedStorageType(lbrType)
+				key := archive.VersionedFilePath(storage.LbrFile, storage.LbrRev, lbrType)
+				if listedShelves[key] {
+					return nil
+				}
+				listedShelves[key] = true
+			}
+			entry, ok := storageManifestEntry(storage, lbrType, depots)
+			if !ok {
+				withoutFile++
+				return nil
+			}
+			if archive.StorageType(lbrType) == archive.RCSStorageType {
+				if entry.Path == lastRCSFile {
+					return nil
+				}
+				lastRCSFile = entry.Path
+				rcsFiles++
+			}
+			if !filepath.IsAbs(entry.Path) {
+				entry.Path = *prefix + filepath.ToSlash(entry.Path)
+			}
+			if len(entry.MD5) == 0 {
+				withoutDigest++
+				// md5sum can only check the files it has a digest of
+				if *manifestFormat == md5sumManifest {
+					return nil
+				}
+			}
+			listed++
+			if *manifestFormat == jsonManifest {
+				return encoder.Encode(entry)
+			}
+			_, err = fmt.Fprintf(w, "%v  %v\n", entry.MD5, entry.Path)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Wrote manifest", logging.CountKey, listed, "rcs_files", rcsFiles, "format", *manifestFormat)
+	if withoutDigest > 0 && *manifestFormat == md5sumManifest {
+		slog.Warn("Left out the archives without a recorded digest, such as RCS files, use -manifest-format=json to list them",
+			logging.CountKey, withoutDigest)
+	} else if withoutDigest > 0 {
+		slog.Info("Listed archives without a recorded digest, such as RCS files", logging.CountKey, withoutDigest)
+	}
+	if withoutFile > 0 {
+		slog.Info("Skipped revisions not stored in archive files, such as tiny files", logging.CountKey, withoutFile)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	if err := runManifest([]string{"-manifest-format=json", "-output", path, exampleJournal}); err != nil {
+		t.Fatalf("runManifest() returned %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() returned %v", err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry struct {
+			Path string `json:"path"`
+			Size int64  `json:"size"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Unmarshal(%q) returned %v", line, err)
+		}
+		got = append(got, entry.Path)
+	}
+	want := []string{
+		"depot/path1/data1.dat,d/1.1.gz",
+		"depot/path1/data1.dat,d/1.2.gz",
+		"depot/path1/data2.dat,d/1.1.gz",
+		"depot/path1/README.txt,v",
+		"depot/path2/More.txt,v",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("runManifest() listed %q, want %q", got, want)
+	}
+}
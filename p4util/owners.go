@@ -0,0 +1,279 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// The fields of the db.change table, as indexes in journal.Record.Fields.
+// They are documented here: https://www.perforce.com/perforce/doc.current/schema/#db.change.
+const (
+	DbChangeFieldChange      = 0
+	DbChangeFieldDescKey     = 1
+	DbChangeFieldClient      = 2
+	DbChangeFieldUser        = 3
+	DbChangeFieldDate        = 4
+	DbChangeFieldStatus      = 5
+	DbChangeFieldDescription = 6
+
+	DbChangeFieldCount = 7
+)
+
+// Reported for revisions whose change isn't in db.change, and for users who aren't in any group
+const (
+	unknownOwner = "(unknown)"
+	noGroup      = "(none)"
+)
+
+// Archive bytes attributed to a user or a group
+type ownerStats struct {
+	name      string
+	members   int
+	revisions int
+	bytes     int64
+	groups    []string
+}
+
+// A revision that owns its archive, waiting for the user of its change and the db.storage size
+// of the archive
+type ownedRevision struct {
+	change     string
+	lbrKey     string
+	recordSize int64
+}
+
+func runOwners(args []string) error {
+	flags := flag.NewFlagSet("owners", flag.ExitOnError)
+	by := flags.String("by", "user", "Attribute the archive bytes to each user or group.")
+	teams := flags.String("groups", "", "Comma-separated groups that are teams; by default, all the groups users are direct members of.")
+	limit := flags.Int("limit", 0, "Number of users or groups to report (0 for all).")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+	if *by != "user" && *by != "group" {
+		return fmt.Errorf("unknown -by %v, expected user or group", *by)
+	}
+	teamSet := make(map[string]bool)
+	for _, group := range strings.Split(*teams, ",") {
+		if group = strings.TrimSpace(group); len(group) > 0 {
+			teamSet[group] = true
+		}
+	}
+
+	changeUsers := make(map[string]string)
+	userGroups := make(map[string][]string)
+	archiveSizes := make(map[string]int64)
+	var revisions []ownedRevision
+
+	tables := map[string]bool{"db.rev": true, "db.storage": true, "db.change": true, "db.group": true}
+	err := journal.ScanFile(flags.Arg(0), tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		fields := record.Fields
+		switch record.Table {
+		case "db.change":
+			if len(fields) < DbChangeFieldCount {
+				slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			changeUsers[fields[DbChangeFieldChange]] = fields[DbChangeFieldUser]
+		case "db.group":
+			if len(fields) < DbGroupFieldCount {
+				slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			// Subgroups and owners don't make a user part of the team
+			if fields[DbGroupFieldType] != "0" {
+				return nil
+			}
+			if len(teamSet) > 0 && !teamSet[fields[DbGroupFieldGroup]] {
+				return nil
+			}
+			userGroups[fields[DbGroupFieldUser]] = append(userGroups[fields[DbGroupFieldUser]], fields[DbGroupFieldGroup])
+		case "db.storage":
+			if len(fields) < archive.DbStorageFieldCount {
+				slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			size, err := strconv.ParseInt(fields[archive.DbStorageFieldServerSize], 10, 64)
+			if err != nil || size <= 0 {
+				// Not all servers record the size of the archive as stored
+				size, _ = strconv.ParseInt(fields[archive.DbStorageFieldSize], 10, 64)
+			}
+			archiveSizes[fields[archive.DbStorageFieldLbrFile]+"\x00"+fields[archive.DbStorageFieldLbrRev]] = size
+		case "db.rev":
+			if len(fields) < archive.DbRevFieldCount {
+				slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			action, _ := strconv.Atoi(fields[archive.DbRevFieldAction])
+			if !archive.FileAction(action).HasArchive() {
+				return nil
+			}
+			// Lazy copies share the archive of another revision, which is attributed to its own submitter
+			if fields[archive.DbRevFieldLbrIsLazy] != "0" {
+				return nil
+			}
+			recordSize, _ := strconv.ParseInt(fields[archive.DbRevFieldSize], 10, 64)
+			revisions = append(revisions, ownedRevision{
+				change:     fields[archive.DbRevFieldChange],
+				lbrKey:     fields[archive.DbRevFieldLbrFile] + "\x00" + fields[archive.DbRevFieldLbrRev],
+				recordSize: recordSize,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(archiveSizes) == 0 {
+		slog.Warn("No db.storage records found, using the file sizes from db.rev")
+	}
+
+	users := make(map[string]*ownerStats)
+	unknownChanges := make(map[string]bool)
+	var totalBytes int64
+	for _, revision := range revisions {
+		size, ok := archiveSizes[revision.lbrKey]
+		if !ok {
+			size = revision.recordSize
+		}
+		user, ok := changeUsers[revision.change]
+		if !ok {
+			// Changes can be deleted from db.change by obliterate or by hand
+			user = unknownOwner
+			unknownChanges[revision.change] = true
+		}
+		stats, ok := users[user]
+		if !ok {
+			stats = &ownerStats{name: user, groups: userGroups[user]}
+			sort.Strings(stats.groups)
+			users[user] = stats
+		}
+		stats.revisions++
+		stats.bytes += size
+		totalBytes += size
+	}
+	if len(unknownChanges) > 0 {
+		slog.Warn("Changes of revisions not found in db.change", logging.CountKey, len(unknownChanges))
+	}
+
+	owners := users
+	if *by == "group" {
+		// The bytes of users in several groups are split evenly between them, so that the groups
+		// add up to the total
+		owners = make(map[string]*ownerStats)
+		for _, user := range users {
+			groups := user.groups
+			if len(groups) == 0 {
+				groups = []string{noGroup}
+			}
+			for i, group := range groups {
+				stats, ok := owners[group]
+				if !ok {
+					stats = &ownerStats{name: group}
+					owners[group] = stats
+				}
+				share := user.bytes / int64(len(groups))
+				if i == 0 {
+					share += user.bytes % int64(len(groups))
+				}
+				stats.members++
+				stats.revisions += user.revisions
+				stats.bytes += share
+			}
+		}
+	}
+
+	ranked := make([]*ownerStats, 0, len(owners))
+	for _, stats := range owners {
+		ranked = append(ranked, stats)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].bytes != ranked[j].bytes {
+			return ranked[i].bytes > ranked[j].bytes
+		}
+		return ranked[i].name < ranked[j].name
+	})
+	if *limit > 0 && len(ranked) > *limit {
+		ranked = ranked[:*limit]
+	}
+
+	share := func(bytes int64) string {
+		if totalBytes == 0 {
+			return "0.00"
+		}
+		return strconv.FormatFloat(100*float64(bytes)/float64(totalBytes), 'f', 2, 64)
+	}
+	out, err := output.NewWriter(*format, *outputPath, output.Table{Name: "owners"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if *by == "group" {
+		out.Write([]string{"Group", "Members", "Revisions", "ArchiveBytes", "SharePercent"})
+	} else {
+		out.Write([]string{"User", "Revisions", "ArchiveBytes", "SharePercent", "Groups"})
+	}
+	for _, stats := range ranked {
+		if *by == "group" {
+			out.Write([]string{
+				stats.name,
+				strconv.Itoa(stats.members),
+				strconv.Itoa(stats.revisions),
+				strconv.FormatInt(stats.bytes, 10),
+				share(stats.bytes)})
+		} else {
+			out.Write([]string{
+				stats.name,
+				strconv.Itoa(stats.revisions),
+				strconv.FormatInt(stats.bytes, 10),
+				share(stats.bytes),
+				strings.Join(stats.groups, " ")})
+		}
+	}
+	if err := out.Commit(); err != nil {
+		return err
+	}
+
+	slog.Info("Attributed archive bytes", logging.BytesKey, totalBytes, "revisions", len(revisions), "users", len(users))
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/scope"
+)
+
+// The usage of the -scope-map flag of the reports that can be split between teams
+const scopeMapUsage = "File mapping depot path prefixes to teams, one \"prefix team\" per line, to also write a copy of the report per team with the paths it owns, named after the report file."
+
+// Reads the scope map of -scope-map, or returns nil when not set. The reports of the teams are
+// files named after the report, so the report must be written to a file.
+func readScopeMap(path string, reportPath string, format string) (*scope.Map, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	if len(reportPath) == 0 || reportPath == output.Stdout {
+		return nil, fmt.Errorf("-scope-map requires the report to be written to a file")
+	}
+	if format == "bigquery" {
+		return nil, fmt.Errorf("-scope-map writes a file per team and can't be used with -format=bigquery")
+	}
+	scopes, err := scope.ReadMap(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading scope map: %v", err)
+	}
+	return scopes, nil
+}
+
+// Writes the report of each team of the scope map, with the rows of the paths it owns
+func writeTeamReports[T any](scopes *scope.Map, reportPath string, rows []T, path func(T) string,
+	write func(destination string, rows []T) error) error {
+	split := scope.Split(scopes, rows, path)
+	teams := make([]string, 0, len(split))
+	for team := range split {
+		teams = append(teams, team)
+	}
+	sort.Strings(teams)
+	for _, team := range teams {
+		destination := scope.Destination(reportPath, team)
+		if err := write(destination, split[team]); err != nil {
+			return err
+		}
+		slog.Info("Wrote team report", "team", team, logging.CountKey, len(split[team]), logging.PathKey, destination)
+	}
+	return nil
+}
@@ -0,0 +1,642 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/logging"
+)
+
+// Scan states
+const (
+	ScanQueued    = "queued"
+	ScanRunning   = "running"
+	ScanSucceeded = "succeeded"
+	ScanFailed    = "failed"
+	ScanCanceled  = "canceled"
+)
+
+// The prefix of the -listen addresses naming a unix socket
+const unixListenPrefix = "unix:"
+
+// serve runs the other commands, so it's registered once the commands map is initialized
+func init() {
+	commands["serve"] = command{"Serves an HTTP API to run the other commands and fetch their reports.", runServe}
+}
+
+// A format the server writes reports in: the ones written to a file it can serve back
+type reportFormat struct {
+	extension   string
+	contentType string
+}
+
+var reportFormats = map[string]reportFormat{
+	"csv":     {".csv", "text/csv"},
+	"json":    {".jsonl", "application/x-ndjson"},
+	"parquet": {".parquet", "application/vnd.apache.parquet"},
+}
+
+// The flags of the commands choosing where and how their reports are written, which the server
+// sets itself: a scan only writes to its own directory
+var reservedFlags = map[string]bool{
+	"output":          true,
+	"format":          true,
+	"manifest-format": true,
+	"html":            true,
+	"commands":        true,
+	"write-baseline":  true,
+	"gaps-csv":        true,
+	"daily-csv":       true,
+	"users-csv":       true,
+	"paths-csv":       true,
+}
+
+// A report run by the server, as returned by the API
+type scan struct {
+	ID       string     `json:"id"`
+	Command  string     `json:"command"`
+	Args     []string   `json:"args"`
+	Format   string     `json:"format"`
+	State    string     `json:"state"`
+	Queued   time.Time  `json:"queued"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+
+	directory   string
+	reportPath  string
+	logPath     string
+	contentType string
+	cancel      context.CancelFunc
+}
+
+// The body of a StartScan request
+type scanRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Format  string   `json:"format"`
+}
+
+// Runs the reports of p4util on request. Each scan runs the p4util binary itself in a child process,
+// so that a failing report doesn't take the server down, with the report and the logs written
+// to files in a directory of its own, removed with the scan.
+type scanServer struct {
+	executable string
+	directory  string
+	slots      chan struct{}
+	token      string
+	// The directories of -root, the only ones the scans may read files from
+	roots []string
+
+	mu     sync.Mutex
+	scans  map[string]*scan
+	nextID int
+}
+
+func (s *scanServer) get(id string) (scan, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.scans[id]
+	if !ok {
+		return scan{}, false
+	}
+	return *current, true
+}
+
+func (s *scanServer) update(current *scan, fn func(*scan)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(current)
+}
+
+// The directories given with -root
+type rootList []string
+
+func (l *rootList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *rootList) Set(value string) error {
+	root, err := filepath.Abs(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, root)
+	return nil
+}
+
+// Returns whether a cleaned absolute path is one of the roots or inside one of them
+func underRoot(path string, roots []string) bool {
+	for _, root := range roots {
+		if relative, err := filepath.Rel(root, path); err == nil && filepath.IsLocal(relative) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an error for an argument value naming a file outside of the roots. The flags of the
+// commands can't be told apart from their values, so every value is checked, and each element of
+// the comma-separated ones. Relative paths are read in the directory of the scan, so only those
+// leaving it are rejected. Depot paths such as //depot/... are absolute too, so those starting with
+// // are only rejected when they name an existing file.
+func checkScanPath(value string, roots []string) error {
+	for _, element := range strings.Split(value, ",") {
+		switch {
+		case len(element) == 0 || element == "-":
+		case !filepath.IsAbs(element):
+			if !filepath.IsLocal(element) {
+				return fmt.Errorf("path %v leaves the scan directory, use an absolute path under a -root of the server", element)
+			}
+		case underRoot(filepath.Clean(element), roots):
+		case strings.HasPrefix(element, "//"):
+			if _, err := os.Lstat(filepath.Clean(element)); err == nil {
+				return fmt.Errorf("path %v is outside of the -root directories of the server", element)
+			}
+		default:
+			return fmt.Errorf("path %v is outside of the -root directories of the server", element)
+		}
+	}
+	return nil
+}
+
+// Returns an error for the arguments setting a reserved flag, as -name, --name or -name=value, and
+// for the ones naming files outside of the roots
+func checkScanArgs(args []string, roots []string) error {
+	flagsEnded := false
+	for _, arg := range args {
+		if flagsEnded || !strings.HasPrefix(arg, "-") || arg == "-" {
+			if err := checkScanPath(arg, roots); err != nil {
+				return err
+			}
+			continue
+		}
+		if arg == "--" {
+			flagsEnded = true
+			continue
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if reservedFlags[name] {
+			return fmt.Errorf("flag -%v is set by the server, use the format of the request instead", name)
+		}
+		if hasValue {
+			if err := checkScanPath(value, roots); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *scanServer) start(request scanRequest) (scan, error) {
+	if _, ok := commands[request.Command]; !ok || request.Command == "serve" {
+		return scan{}, fmt.Errorf("unknown command %v", request.Command)
+	}
+	if err := checkScanArgs(request.Args, s.roots); err != nil {
+		return scan{}, err
+	}
+	if len(request.Format) == 0 {
+		request.Format = "csv"
+	}
+	format, ok := reportFormats[request.Format]
+	if !ok {
+		return scan{}, fmt.Errorf("unknown format %v, expected csv, json or parquet", request.Format)
+	}
+	contentType := format.contentType
+	switch {
+	case request.Command == "manifest" && request.Format != "csv":
+		return scan{}, fmt.Errorf("manifest only writes the md5sum format, leave the format out")
+	case request.Command == "manifest":
+		format.extension, contentType = ".md5", "text/plain; charset=utf-8"
+	case request.Command == "streams" && request.Format == "json":
+		// streams writes a single document rather than JSON lines
+		contentType = "application/json"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	// The directory is unique even when -dir holds the scans of a previous server
+	directory, err := os.MkdirTemp(s.directory, "scan-"+id+"-")
+	if err != nil {
+		return scan{}, fmt.Errorf("error creating scan directory: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	current := &scan{
+		ID:          id,
+		Command:     request.Command,
+		Args:        request.Args,
+		Format:      request.Format,
+		State:       ScanQueued,
+		Queued:      time.Now(),
+		directory:   directory,
+		reportPath:  filepath.Join(directory, "report"+format.extension),
+		logPath:     filepath.Join(directory, "log.jsonl"),
+		contentType: contentType,
+		cancel:      cancel,
+	}
+	s.scans[id] = current
+	go s.run(ctx, current)
+	return *current, nil
+}
+
+func (s *scanServer) run(ctx context.Context, current *scan) {
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		s.finish(ctx, current, nil)
+		return
+	}
+	defer func() { <-s.slots }()
+
+	s.update(current, func(c *scan) {
+		started := time.Now()
+		c.State = ScanRunning
+		c.Started = &started
+	})
+	slog.Info("Starting scan", "id", current.ID, "command", current.Command)
+	s.finish(ctx, current, s.execute(ctx, current))
+}
+
+func (s *scanServer) finish(ctx context.Context, current *scan, err error) {
+	s.update(current, func(c *scan) {
+		finished := time.Now()
+		c.Finished = &finished
+		switch {
+		case ctx.Err() != nil:
+			c.State = ScanCanceled
+		case err != nil:
+			c.State = ScanFailed
+			c.Error = err.Error()
+		default:
+			c.State = ScanSucceeded
+		}
+	})
+	switch {
+	case ctx.Err() != nil:
+		slog.Info("Scan canceled", "id", current.ID, "command", current.Command)
+	case err != nil:
+		slog.Warn("Scan failed", "id", current.ID, "command", current.Command, logging.Err(err))
+	default:
+		slog.Info("Scan succeeded", "id", current.ID, "command", current.Command)
+	}
+}
+
+func (s *scanServer) execute(ctx context.Context, current *scan) error {
+	logFile, err := os.Create(current.logPath)
+	if err != nil {
+		return fmt.Errorf("error creating log: %v", err)
+	}
+	defer logFile.Close()
+
+	// The report only appears once the command succeeded, as -output is replaced on completion
+	args := []string{"-log-format", logging.JSONFormat, current.Command, "-output", current.reportPath}
+	if current.Command != "manifest" {
+		args = append(args, "-format", current.Format)
+	}
+	args = append(args, current.Args...)
+	cmd := exec.CommandContext(ctx, s.executable, args...)
+	// Relative paths are read in the directory of the scan, see checkScanPath
+	cmd.Dir = current.directory
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v failed: %v, see the log", current.Command, err)
+	}
+	return nil
+}
+
+// Cancels a scan, and removes it with its files once it has stopped
+func (s *scanServer) remove(current *scan) {
+	current.cancel()
+	go func() {
+		for {
+			s.mu.Lock()
+			finished := current.Finished != nil
+			s.mu.Unlock()
+			if finished {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err := os.RemoveAll(current.directory); err != nil {
+			slog.Warn("Error removing scan", "id", current.ID, logging.PathKey, current.directory, logging.Err(err))
+		}
+	}()
+}
+
+// Removes the scans finished for longer than keep, checked every minute
+func (s *scanServer) expire(ctx context.Context, keep time.Duration) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for id, current := range s.scans {
+				if current.Finished != nil && now.Sub(*current.Finished) > keep {
+					delete(s.scans, id)
+					s.remove(current)
+					slog.Info("Expired scan", "id", id, "command", current.Command)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Cancels the scans on shutdown, and waits for them to stop
+func (s *scanServer) cancelAll() {
+	s.mu.Lock()
+	for _, current := range s.scans {
+		current.cancel()
+	}
+	s.mu.Unlock()
+	for {
+		s.mu.Lock()
+		running := 0
+		for _, current := range s.scans {
+			if current.Finished == nil {
+				running++
+			}
+		}
+		s.mu.Unlock()
+		if running == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Requires the bearer token of -token-file, when set
+func (s *scanServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.token) > 0 {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid bearer token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// POST /v1/scans starts a scan
+func (s *scanServer) handleStartScan(w http.ResponseWriter, r *http.Request) {
+	// Browsers only send JSON cross-origin after a preflight, which the server doesn't answer,
+	// so a page can't start scans on behalf of a user with access to the server
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, fmt.Errorf("the request must be sent as application/json"))
+		return
+	}
+	var request scanRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return
+	}
+	started, err := s.start(request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, started)
+}
+
+// GET /v1/scans lists the scans
+func (s *scanServer) handleListScans(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	list := make([]scan, 0, len(s.scans))
+	for _, current := range s.scans {
+		list = append(list, *current)
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Queued.Before(list[j].Queued) })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// GET /v1/scans/{id} returns the status of a scan
+func (s *scanServer) handleGetScanStatus(w http.ResponseWriter, r *http.Request) {
+	current, ok := s.get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown scan %v", r.PathValue("id")))
+		return
+	}
+	writeJSON(w, http.StatusOK, current)
+}
+
+// POST /v1/scans/{id}/cancel stops a queued or running scan, which keeps its logs
+func (s *scanServer) handleCancelScan(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	current, ok := s.scans[r.PathValue("id")]
+	if ok {
+		current.cancel()
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown scan %v", r.PathValue("id")))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// DELETE /v1/scans/{id} cancels a scan if it hasn't finished, and removes it with its report and logs
+func (s *scanServer) handleDeleteScan(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	current, ok := s.scans[r.PathValue("id")]
+	if ok {
+		delete(s.scans, current.ID)
+		s.remove(current)
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown scan %v", r.PathValue("id")))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /v1/scans/{id}/report returns the report of a succeeded scan,
+// and GET /v1/scans/{id}/log its logs, as JSON lines
+func (s *scanServer) handleGetFile(report bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		current, ok := s.get(r.PathValue("id"))
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown scan %v", r.PathValue("id")))
+			return
+		}
+		if current.Started == nil {
+			writeError(w, http.StatusConflict, fmt.Errorf("scan %v hasn't started", current.ID))
+			return
+		}
+		if !report {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			http.ServeFile(w, r, current.logPath)
+			return
+		}
+		if current.State != ScanSucceeded {
+			writeError(w, http.StatusConflict, fmt.Errorf("scan %v has no report (state %v)", current.ID, current.State))
+			return
+		}
+		w.Header().Set("Content-Type", current.contentType)
+		http.ServeFile(w, r, current.reportPath)
+	}
+}
+
+// Listens on a TCP address, or on a unix socket only accessible to the user running the server
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixListenPrefix)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	address := flags.String("listen", "localhost:8080", "Address to listen on, or unix:<path> for a unix socket only accessible to the user running the server.")
+	directory := flags.String("dir", "", "Directory to write the reports and logs of the scans to (a temporary directory removed on exit by default).")
+	maxScans := flags.Int("max-scans", 2, "Number of scans running at the same time; others are queued.")
+	keep := flags.Duration("keep", 24*time.Hour, "How long the finished scans and their files are kept before being removed, 0 to keep them until deleted.")
+	tokenFile := flags.String("token-file", "", "File holding a token the requests must send as \"Authorization: Bearer <token>\", required to listen on TCP.")
+	var roots rootList
+	flags.Var(&roots, "root", "Directory the scans may read checkpoints and other files from, such as /p4/1/checkpoints; repeat for several.")
+	flags.Parse(args)
+
+	if *maxScans <= 0 {
+		return fmt.Errorf("-max-scans must be positive")
+	}
+	if *keep < 0 {
+		return fmt.Errorf("-keep must not be negative")
+	}
+	if len(roots) == 0 {
+		return fmt.Errorf("-root is required, the scans only read files under it")
+	}
+	if len(*tokenFile) == 0 && !strings.HasPrefix(*address, unixListenPrefix) {
+		return fmt.Errorf("-token-file is required to listen on %v, or listen on a unix socket with -listen=%v<path>", *address, unixListenPrefix)
+	}
+	var token string
+	if len(*tokenFile) > 0 {
+		contents, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			return fmt.Errorf("error reading token: %v", err)
+		}
+		token = strings.TrimSpace(string(contents))
+		if len(token) == 0 {
+			return fmt.Errorf("%v holds no token", *tokenFile)
+		}
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error locating p4util: %v", err)
+	}
+	if len(*directory) == 0 {
+		temporary, err := os.MkdirTemp("", "p4util-serve-")
+		if err != nil {
+			return fmt.Errorf("error creating scan directory: %v", err)
+		}
+		defer os.RemoveAll(temporary)
+		*directory = temporary
+	} else if err := os.MkdirAll(*directory, 0755); err != nil {
+		return fmt.Errorf("error creating scan directory: %v", err)
+	}
+
+	server := &scanServer{
+		executable: executable,
+		directory:  *directory,
+		slots:      make(chan struct{}, *maxScans),
+		token:      token,
+		roots:      roots,
+		scans:      make(map[string]*scan),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/scans", server.handleStartScan)
+	mux.HandleFunc("GET /v1/scans", server.handleListScans)
+	mux.HandleFunc("GET /v1/scans/{id}", server.handleGetScanStatus)
+	mux.HandleFunc("DELETE /v1/scans/{id}", server.handleDeleteScan)
+	mux.HandleFunc("POST /v1/scans/{id}/cancel", server.handleCancelScan)
+	mux.HandleFunc("GET /v1/scans/{id}/report", server.handleGetFile(true))
+	mux.HandleFunc("GET /v1/scans/{id}/log", server.handleGetFile(false))
+
+	listener, err := listen(*address)
+	if err != nil {
+		return fmt.Errorf("error listening on %v: %v", *address, err)
+	}
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	if *keep > 0 {
+		go server.expire(ctx, *keep)
+	}
+	httpServer := &http.Server{Handler: server.authenticate(mux)}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdown)
+	}()
+
+	slog.Info("Serving", "address", *address, logging.PathKey, *directory, "roots", roots.String())
+	err = httpServer.Serve(listener)
+	server.cancelAll()
+	if errors.Is(err, http.ErrServerClosed) {
+		slog.Info("Stopped serving")
+		return nil
+	}
+	return err
+}
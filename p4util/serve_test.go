@@ -0,0 +1,59 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckScanArgs(t *testing.T) {
+	root := t.TempDir()
+	checkpoint := filepath.Join(root, "p4_1.ckp.123.gz")
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "checkpoint under root", args: []string{"-limit", "50", checkpoint}},
+		{name: "flag value under root", args: []string{"-baseline=" + filepath.Join(root, "golden.yaml"), checkpoint}},
+		{name: "depot path", args: []string{"-path=//depot/main/...", checkpoint}},
+		{name: "values", args: []string{"-tables=db.rev,db.have", "-since", "7d", "-"}},
+		{name: "checkpoint outside root", args: []string{outside}, wantErr: true},
+		{name: "flag value outside root", args: []string{"-license=" + outside, checkpoint}, wantErr: true},
+		{name: "list element outside root", args: []string{"-journals=" + checkpoint + "," + outside}, wantErr: true},
+		{name: "root escaped", args: []string{filepath.Join(root, "..", filepath.Base(filepath.Dir(outside)), "secret")}, wantErr: true},
+		{name: "relative path leaving the scan", args: []string{"../../etc/passwd"}, wantErr: true},
+		{name: "existing file as depot path", args: []string{"/" + outside}, wantErr: true},
+		{name: "after --", args: []string{"--", outside}, wantErr: true},
+		{name: "reserved flag", args: []string{"-output", filepath.Join(root, "report.csv")}, wantErr: true},
+		{name: "reserved flag with value", args: []string{"--format=parquet"}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkScanArgs(test.args, []string{root})
+			if (err != nil) != test.wantErr {
+				t.Errorf("checkScanArgs(%q) returned %v, want error %v", test.args, err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/lbr"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/google/perforce-utils/perforceutils/schema"
+)
+
+// The parent of mainline and other top-level streams
+const noParent = "none"
+
+// The problems reported by the streams command
+const (
+	// The parent stream isn't in db.stream
+	orphanedStream = "orphaned"
+	// Following the parents leads back to the stream
+	cyclicStream = "cyclic-parent"
+	// The stream depot isn't in db.depot
+	missingDepotStream = "missing-depot"
+	// The depot of the stream isn't a stream depot
+	notStreamDepotStream = "not-stream-depot"
+	// The stream path doesn't have as many components as the StreamDepth of its depot
+	depthStream = "wrong-depth"
+)
+
+// A stream, with its spec from db.domain
+type streamRecord struct {
+	schema.Stream
+	Owner       string
+	Options     string
+	Description string
+	Level       int
+	Children    int
+	Problems    []string
+}
+
+// The fields written as JSON, named as in the CSV
+func (s *streamRecord) MarshalJSON() ([]byte, error) {
+	problems := s.Problems
+	if problems == nil {
+		problems = []string{}
+	}
+	return json.Marshal(struct {
+		Stream      string   `json:"stream"`
+		Parent      string   `json:"parent"`
+		Title       string   `json:"title"`
+		Type        int      `json:"type"`
+		Owner       string   `json:"owner"`
+		Options     string   `json:"options"`
+		ParentView  int      `json:"parentView"`
+		Change      int      `json:"change"`
+		Level       int      `json:"level"`
+		Children    int      `json:"children"`
+		Description string   `json:"description"`
+		Problems    []string `json:"problems"`
+	}{s.Stream.Stream, s.Parent, s.Title, s.Type, s.Owner, s.Options, s.ParentView, s.Change, s.Level, s.Children,
+		s.Description, problems})
+}
+
+// A depot of db.depot, with the number of path components of its streams
+type streamDepot struct {
+	depotType lbr.DepotType
+	depth     int
+}
+
+// Returns the StreamDepth of a stream depot, recorded in the extra field of db.depot either as a
+// number or as a path such as //streams/2. Depots created before StreamDepth have streams one
+// level below the depot.
+func streamDepth(extra string) int {
+	extra = extra[strings.LastIndex(extra, "/")+1:]
+	if depth, err := strconv.Atoi(extra); err == nil && depth > 0 {
+		return depth
+	}
+	return 1
+}
+
+// Returns the depot of a stream, such as streams for //streams/main, and the number of components
+// below it
+func streamDepotName(stream string) (string, int) {
+	depot, rest, _ := strings.Cut(strings.TrimPrefix(stream, "//"), "/")
+	if len(rest) == 0 {
+		return depot, 0
+	}
+	return depot, strings.Count(rest, "/") + 1
+}
+
+// Checks the streams against each other and their depots, and sets their level in the hierarchy,
+// their number of children and their problems
+func validateStreams(streams map[string]*streamRecord, depots map[string]streamDepot) {
+	for _, stream := range streams {
+		if parent, ok := streams[stream.Parent]; ok {
+			parent.Children++
+		}
+	}
+	for name, stream := range streams {
+		depotName, depth := streamDepotName(name)
+		if depot, ok := depots[depotName]; !ok {
+			stream.Problems = append(stream.Problems, missingDepotStream)
+		} else if depot.depotType != lbr.StreamDepotType {
+			stream.Problems = append(stream.Problems, notStreamDepotStream)
+		} else if depth != depot.depth {
+			stream.Problems = append(stream.Problems, depthStream)
+		}
+
+		// Levels are left at -1 for streams whose ancestry is broken
+		stream.Level = -1
+		visited := map[string]bool{name: true}
+		for level, parent := 0, stream.Parent; ; level, parent = level+1, streams[parent].Parent {
+			if parent == noParent {
+				stream.Level = level
+				break
+			}
+			if _, ok := streams[parent]; !ok {
+				// Only the stream whose parent is missing is orphaned, not its descendants
+				if level == 0 {
+					stream.Problems = append(stream.Problems, orphanedStream)
+				}
+				break
+			}
+			if visited[parent] {
+				if parent == name {
+					stream.Problems = append(stream.Problems, cyclicStream)
+				}
+				break
+			}
+			visited[parent] = true
+		}
+	}
+}
+
+// The columns of the CSV
+var streamColumns = []string{
+	"Stream",
+	"Parent",
+	"Title",
+	"Type",
+	"Owner",
+	"Options",
+	"ParentView",
+	"Change",
+	"Level",
+	"Children",
+	"Description",
+	"Problems"}
+
+func writeStreamRows(w output.Writer, streams []*streamRecord) {
+	w.Write(streamColumns)
+	for _, stream := range streams {
+		w.Write([]string{
+			stream.Stream.Stream,
+			stream.Parent,
+			stream.Title,
+			strconv.Itoa(stream.Type),
+			stream.Owner,
+			stream.Options,
+			strconv.Itoa(stream.ParentView),
+			strconv.Itoa(stream.Change),
+			strconv.Itoa(stream.Level),
+			strconv.Itoa(stream.Children),
+			stream.Description,
+			strings.Join(stream.Problems, " ")})
+	}
+}
+
+func writeStreams(format string, outputPath string, streams []*streamRecord) error {
+	out, err := output.NewWriter(format, outputPath, output.Table{Name: "streams"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	writeStreamRows(out, streams)
+	return out.Commit()
+}
+
+func writeStreamsJSON(w io.Writer, streams []*streamRecord) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(streams)
+}
+
+func runStreams(args []string) error {
+	flags := flag.NewFlagSet("streams", flag.ExitOnError)
+	format := flags.String("format", "csv", output.FormatUsage()+" json writes a document with the problems as arrays.")
+	problemsOnly := flags.Bool("problems-only", false, "Only report the streams with problems.")
+	failOnProblems := flags.Bool("fail-on-problems", false, "Exit with a non-zero code when streams have problems.")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+
+	streams := make(map[string]*streamRecord)
+	// Stream specs are in db.domain, which comes before db.stream in checkpoints
+	specs := make(map[string]*domainRecord)
+	depots := make(map[string]streamDepot)
+	tables := map[string]bool{"db.depot": true, "db.domain": true, "db.stream": true}
+	err := journal.ScanFile(flags.Arg(0), tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		switch record.Table {
+		case "db.depot":
+			var depot schema.Depot
+			if err := schema.Unmarshal(record, &depot); err != nil {
+				slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError, logging.Err(err))
+				return nil
+			}
+			depots[depot.Name] = streamDepot{depotType: lbr.DepotType(depot.Type), depth: streamDepth(depot.Extra)}
+		case "db.domain":
+			domain, ok := parseDomain(record)
+			if ok && domain.domainType == domainTypeStream {
+				specs[domain.name] = domain
+			}
+		case "db.stream":
+			stream := &streamRecord{}
+			if err := schema.Unmarshal(record, &stream.Stream); err != nil {
+				slog.Warn("Skipping malformed record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError, logging.Err(err))
+				return nil
+			}
+			streams[stream.Stream.Stream] = stream
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, stream := range streams {
+		if spec, ok := specs[name]; ok {
+			stream.Owner = spec.owner
+			stream.Options = spec.optionNames()
+			stream.Description = spec.description
+		}
+	}
+	validateStreams(streams, depots)
+
+	sorted := make([]*streamRecord, 0, len(streams))
+	for _, stream := range streams {
+		sorted = append(sorted, stream)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Stream.Stream < sorted[j].Stream.Stream
+	})
+
+	problems := make(map[string]int)
+	withProblems := 0
+	reported := make([]*streamRecord, 0, len(sorted))
+	for _, stream := range sorted {
+		for _, problem := range stream.Problems {
+			problems[problem]++
+		}
+		if len(stream.Problems) > 0 {
+			withProblems++
+			slog.Warn("Stream with problems", "stream", stream.Stream.Stream, "parent", stream.Parent,
+				"problems", strings.Join(stream.Problems, " "))
+		} else if *problemsOnly {
+			continue
+		}
+		reported = append(reported, stream)
+	}
+
+	if *format == "json" {
+		err = output.WriteFile(*outputPath, func(w io.Writer) error { return writeStreamsJSON(w, reported) })
+	} else {
+		err = writeStreams(*format, *outputPath, reported)
+	}
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Processed streams", logging.CountKey, len(streams), "with_problems", withProblems)
+	for _, problem := range []string{orphanedStream, cyclicStream, missingDepotStream, notStreamDepotStream, depthStream} {
+		if problems[problem] > 0 {
+			slog.Info("Stream problems", "problem", problem, logging.CountKey, problems[problem])
+		}
+	}
+	if withProblems > 0 && *failOnProblems {
+		return fmt.Errorf("%v of %v streams have problems", withProblems, len(streams))
+	}
+	return nil
+}
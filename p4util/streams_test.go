@@ -0,0 +1,44 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestStreams(t *testing.T) {
+	checkpoint := writeCheckpoint(t, `@pv@ 1 @db.depot@ @streams@ 3 @1@ @streams/...@ 
+@pv@ 7 @db.domain@ @//streams/main@ 115 @@ @@ @@ @@ @the_user@ 1611008040 1611008045 0 @Main line@ @@ @@ 0 
+@pv@ 2 @db.stream@ @//streams/main@ @none@ @main@ 0 @@ 0 0 0 0 0 0 0 
+@pv@ 2 @db.stream@ @//streams/dev@ @//streams/main@ @dev@ 1 @@ 0 0 0 0 0 0 0 
+@pv@ 2 @db.stream@ @//streams/lost@ @//streams/gone@ @lost@ 1 @@ 0 0 0 0 0 0 0 
+@pv@ 2 @db.stream@ @//depot/odd@ @none@ @odd@ 0 @@ 0 0 0 0 0 0 0 
+`)
+	rows := runReport(t, runStreams, checkpoint)
+	checkReport(t, rows, []int{0, 1, 4, 8, 9, 11}, [][]string{
+		{"Stream", "Parent", "Owner", "Level", "Children", "Problems"},
+		{"//depot/odd", "none", "", "0", "0", "not-stream-depot"},
+		{"//streams/dev", "//streams/main", "", "1", "0", ""},
+		{"//streams/lost", "//streams/gone", "", "-1", "0", "orphaned"},
+		{"//streams/main", "none", "the_user", "0", "1", ""},
+	})
+
+	rows = runReport(t, runStreams, "-problems-only", checkpoint)
+	checkReport(t, rows, []int{0, 11}, [][]string{
+		{"Stream", "Problems"},
+		{"//depot/odd", "not-stream-depot"},
+		{"//streams/lost", "orphaned"},
+	})
+}
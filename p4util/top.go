@@ -0,0 +1,230 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// Per depot file totals used by the top report
+type fileStats struct {
+	depotFile       string
+	archiveBytes    int64
+	revisions       int
+	recentBytes     int64
+	recentRevisions int
+}
+
+// A revision that owns its archive, waiting for the db.storage size of that archive
+type archivedRevision struct {
+	stats      *fileStats
+	lbrKey     string
+	date       int64
+	recordSize int64
+}
+
+func runTop(args []string) error {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	sortBy := flags.String("sort", "size", "Ranking criteria: size, revisions or growth.")
+	limit := flags.Int("limit", 100, "Number of files to report (0 for all).")
+	growthDays := flags.Int("growth-days", 30, "Number of days before the most recent revision used to compute growth.")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	scopeMap := flags.String("scope-map", "", scopeMapUsage)
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+	if *growthDays <= 0 {
+		return fmt.Errorf("-growth-days must be positive")
+	}
+	scopes, err := readScopeMap(*scopeMap, *outputPath, *format)
+	if err != nil {
+		return err
+	}
+
+	var less func(a, b *fileStats) bool
+	switch *sortBy {
+	case "size":
+		less = func(a, b *fileStats) bool { return a.archiveBytes > b.archiveBytes }
+	case "revisions":
+		less = func(a, b *fileStats) bool { return a.revisions > b.revisions }
+	case "growth":
+		less = func(a, b *fileStats) bool { return a.recentBytes > b.recentBytes }
+	default:
+		return fmt.Errorf("unknown sort criteria %v", *sortBy)
+	}
+
+	stats := make(map[string]*fileStats)
+	var revisions []archivedRevision
+	archiveSizes := make(map[string]int64)
+	newestDate := int64(0)
+
+	tables := map[string]bool{"db.rev": true, "db.storage": true}
+	err = journal.ScanFile(flags.Arg(0), tables, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		fields := record.Fields
+		if record.Table == "db.storage" {
+			if len(fields) < archive.DbStorageFieldCount {
+				slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			size, err := strconv.ParseInt(fields[archive.DbStorageFieldServerSize], 10, 64)
+			if err != nil || size <= 0 {
+				// Not all servers record the size of the archive as stored
+				size, _ = strconv.ParseInt(fields[archive.DbStorageFieldSize], 10, 64)
+			}
+			archiveSizes[fields[archive.DbStorageFieldLbrFile]+"\x00"+fields[archive.DbStorageFieldLbrRev]] = size
+			return nil
+		}
+
+		if len(fields) < archive.DbRevFieldCount {
+			slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		depotFile := fields[archive.DbRevFieldDepotFile]
+		fileStat, ok := stats[depotFile]
+		if !ok {
+			fileStat = &fileStats{depotFile: depotFile}
+			stats[depotFile] = fileStat
+		}
+		fileStat.revisions++
+
+		date, err := strconv.ParseInt(fields[archive.DbRevFieldDate], 10, 64)
+		if err != nil {
+			slog.Warn("Could not parse date", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				"date", fields[archive.DbRevFieldDate], logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		if date > newestDate {
+			newestDate = date
+		}
+
+		action, _ := strconv.Atoi(fields[archive.DbRevFieldAction])
+		if !archive.FileAction(action).HasArchive() {
+			return nil
+		}
+		// Lazy copies share the archive of another revision, which is accounted for there
+		if fields[archive.DbRevFieldLbrIsLazy] != "0" {
+			return nil
+		}
+
+		recordSize, _ := strconv.ParseInt(fields[archive.DbRevFieldSize], 10, 64)
+		revisions = append(revisions, archivedRevision{
+			stats:      fileStat,
+			lbrKey:     fields[archive.DbRevFieldLbrFile] + "\x00" + fields[archive.DbRevFieldLbrRev],
+			date:       date,
+			recordSize: recordSize,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(archiveSizes) == 0 {
+		slog.Warn("No db.storage records found, using the file sizes from db.rev")
+	}
+
+	growthStart := newestDate - int64(*growthDays)*24*60*60
+	for _, revision := range revisions {
+		size, ok := archiveSizes[revision.lbrKey]
+		if !ok {
+			size = revision.recordSize
+		}
+		revision.stats.archiveBytes += size
+		if revision.date > growthStart {
+			revision.stats.recentBytes += size
+			revision.stats.recentRevisions++
+		}
+	}
+
+	ranked := make([]*fileStats, 0, len(stats))
+	for _, fileStat := range stats {
+		ranked = append(ranked, fileStat)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if less(ranked[i], ranked[j]) {
+			return true
+		}
+		if less(ranked[j], ranked[i]) {
+			return false
+		}
+		return ranked[i].depotFile < ranked[j].depotFile
+	})
+	write := func(destination string, ranked []*fileStats) error {
+		if *limit > 0 && len(ranked) > *limit {
+			ranked = ranked[:*limit]
+		}
+		return writeTop(*format, destination, ranked, *growthDays)
+	}
+	if err := write(*outputPath, ranked); err != nil {
+		return err
+	}
+	if scopes != nil {
+		// Each team gets its own top files, ranked among the files it owns
+		err := writeTeamReports(scopes, *outputPath, ranked, func(fileStat *fileStats) string { return fileStat.depotFile }, write)
+		if err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Ranked files", logging.CountKey, len(stats))
+	return nil
+}
+
+func writeTop(format string, destination string, ranked []*fileStats, growthDays int) error {
+	out, err := output.NewWriter(format, destination, output.Table{Name: "top"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.Write([]string{
+		"DepotFile",
+		"ArchiveBytes",
+		"Revisions",
+		"RecentBytes",
+		"RecentRevisions",
+		"RecentBytesPerDay"})
+	for _, fileStat := range ranked {
+		out.Write([]string{
+			fileStat.depotFile,
+			strconv.FormatInt(fileStat.archiveBytes, 10),
+			strconv.Itoa(fileStat.revisions),
+			strconv.FormatInt(fileStat.recentBytes, 10),
+			strconv.Itoa(fileStat.recentRevisions),
+			strconv.FormatInt(fileStat.recentBytes/int64(growthDays), 10)})
+	}
+	return out.Commit()
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestTop(t *testing.T) {
+	rows := runReport(t, runTop, exampleJournal)
+	checkReport(t, rows, []int{0, 1, 2}, [][]string{
+		{"DepotFile", "ArchiveBytes", "Revisions"},
+		{"//depot/path1/data1.dat", "20442", "2"},
+		{"//depot/path1/data2.dat", "10221", "1"},
+		{"//depot/path1/README.txt", "551", "2"},
+		{"//depot/path2/More.txt", "207", "1"},
+	})
+}
+
+func TestTopByRevisions(t *testing.T) {
+	rows := runReport(t, runTop, "-sort=revisions", "-limit=2", exampleJournal)
+	checkReport(t, rows, []int{0, 2}, [][]string{
+		{"DepotFile", "Revisions"},
+		{"//depot/path1/README.txt", "2"},
+		{"//depot/path1/data1.dat", "2"},
+	})
+}
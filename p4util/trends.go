@@ -0,0 +1,514 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/archive"
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// Totals of a depot in a snapshot
+type depotTotals struct {
+	revisions int
+	archives  int
+	bytes     int64
+}
+
+// The depot and directory totals of a checkpoint, or of a p4_storage_to_csv extraction
+type snapshot struct {
+	path   string
+	date   time.Time
+	depots map[string]*depotTotals
+	// Archive bytes by directory, at the requested depth
+	directories map[string]int64
+	// Whether the revisions were counted; extractions only have db.storage
+	hasRevisions bool
+}
+
+func newSnapshot(path string) *snapshot {
+	return &snapshot{path: path, depots: make(map[string]*depotTotals), directories: make(map[string]int64)}
+}
+
+func (s *snapshot) depot(name string) *depotTotals {
+	totals, ok := s.depots[name]
+	if !ok {
+		totals = &depotTotals{}
+		s.depots[name] = totals
+	}
+	return totals
+}
+
+func (s *snapshot) addArchive(lbrFile string, bytes int64, depth int) {
+	totals := s.depot(archive.DepotName(lbrFile))
+	totals.archives++
+	totals.bytes += bytes
+	s.directories[archiveDirectory(lbrFile, depth)] += bytes
+}
+
+// Reads the revisions and archives of a checkpoint. It's dated from its header, or from the
+// modification time of the file for journals without one.
+func readCheckpointSnapshot(path string, depth int) (*snapshot, error) {
+	file, err := journal.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	s := newSnapshot(path)
+	s.hasRevisions = true
+	err = journal.Scan(file, func(record journal.Record) error {
+		if record.Operation == journal.NoteTransaction && record.Field(0) == "0" {
+			if date, err := strconv.ParseInt(record.Field(1), 10, 64); err == nil {
+				s.date = time.Unix(date, 0)
+			}
+			return nil
+		}
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		switch record.Table {
+		case "db.rev":
+			if len(record.Fields) < archive.DbRevFieldCount {
+				slog.Warn("Skipping short record", logging.PathKey, path, logging.TableKey, record.Table,
+					logging.LineKey, record.LineNumber, logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			s.depot(archive.DepotName(record.Fields[archive.DbRevFieldDepotFile])).revisions++
+		case "db.storage":
+			storage, err := archive.ParseStorageRecord(record.Fields)
+			if err != nil {
+				slog.Warn("Skipping malformed record", logging.PathKey, path, logging.TableKey, record.Table,
+					logging.LineKey, record.LineNumber, logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			size := storage.ServerSize
+			if size <= 0 {
+				// Not all servers record the size of the archive as stored
+				size = storage.Size
+			}
+			s.addArchive(storage.LbrFile, size, depth)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading %v: %v", path, err)
+	}
+	if s.date.IsZero() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %v: %v", path, err)
+		}
+		s.date = info.ModTime()
+	}
+	return s, nil
+}
+
+// Reads the archives of a p4_storage_to_csv extraction, dated from its most recently updated archive
+func readExtractionSnapshot(path string, depth int) (*snapshot, error) {
+	s := newSnapshot(path)
+	newest := int64(0)
+	err := archive.ScanExtraction(path, nil, func(record journal.Record) error {
+		storage, err := archive.ParseStorageRecord(record.Fields)
+		if err != nil {
+			slog.Warn("Skipping malformed record", logging.PathKey, path, logging.TableKey, record.Table,
+				logging.LineKey, record.LineNumber, logging.ErrorKey, err, logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		size := storage.ServerSize
+		if size <= 0 {
+			size = storage.Size
+		}
+		s.addArchive(storage.LbrFile, size, depth)
+		if storage.Date > newest {
+			newest = storage.Date
+		}
+		return nil
+	})
+	if err != nil {
+		// The errors of extractions name their file
+		return nil, err
+	}
+	s.date = time.Unix(newest, 0)
+	return s, nil
+}
+
+// Lists the files of the directory arguments, and the file arguments themselves
+func snapshotPaths(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				paths = append(paths, filepath.Join(arg, entry.Name()))
+			}
+		}
+	}
+	return paths, nil
+}
+
+// Growth of a directory between the first and last snapshots
+type directoryGrowth struct {
+	Directory   string
+	FirstBytes  int64
+	LastBytes   int64
+	BytesAdded  int64
+	BytesPerDay int64
+}
+
+func perWeek(added int64, days float64) int64 {
+	return int64(float64(added) * 7 / days)
+}
+
+func runTrends(args []string) error {
+	flags := flag.NewFlagSet("trends", flag.ExitOnError)
+	depth := flags.Int("depth", 2, "Directory levels below the depot at which growing paths are reported.")
+	limit := flags.Int("limit", 50, "Number of growing paths to report.")
+	pathsCSV := flags.String("paths-csv", "", "File to write the top growing paths to, as CSV.")
+	htmlChart := flags.String("html", "", "File to write an HTML chart of the depot sizes to.")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	scopeMap := flags.String("scope-map", "", scopeMapUsage+" Splits -paths-csv.")
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+	if len(*scopeMap) > 0 && len(*pathsCSV) == 0 {
+		return fmt.Errorf("-scope-map requires -paths-csv")
+	}
+	scopes, err := readScopeMap(*scopeMap, *pathsCSV, "csv")
+	if err != nil {
+		return err
+	}
+
+	paths, err := snapshotPaths(flags.Args())
+	if err != nil {
+		return fmt.Errorf("error listing snapshots: %v", err)
+	}
+	var snapshots []*snapshot
+	for _, path := range paths {
+		var s *snapshot
+		if archive.IsExtraction(path) {
+			s, err = readExtractionSnapshot(path, *depth)
+		} else {
+			s, err = readCheckpointSnapshot(path, *depth)
+		}
+		if err != nil {
+			return err
+		}
+		slog.Info("Read snapshot", logging.PathKey, path, "date", s.date.UTC().Format("2006-01-02"), "depots", len(s.depots))
+		snapshots = append(snapshots, s)
+	}
+	if len(snapshots) < 2 {
+		return fmt.Errorf("at least two checkpoints or extractions are needed, got %v", len(snapshots))
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].date.Before(snapshots[j].date) })
+
+	depotSet := make(map[string]bool)
+	for _, s := range snapshots {
+		for depot := range s.depots {
+			depotSet[depot] = true
+		}
+	}
+	depots := make([]string, 0, len(depotSet))
+	for depot := range depotSet {
+		depots = append(depots, depot)
+	}
+	sort.Strings(depots)
+
+	out, err := output.NewWriter(*format, *outputPath, output.Table{Name: "trends"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.Write([]string{
+		"Depot",
+		"From",
+		"To",
+		"Days",
+		"Revisions",
+		"Bytes",
+		"RevisionsAdded",
+		"BytesAdded",
+		"RevisionsPerWeek",
+		"BytesPerWeek"})
+	for _, depot := range depots {
+		for i := 1; i < len(snapshots); i++ {
+			previous, current := snapshots[i-1], snapshots[i]
+			days := current.date.Sub(previous.date).Hours() / 24
+			if days < 1 {
+				slog.Warn("Skipping snapshots taken less than a day apart", logging.PathKey, current.path, "previous", previous.path)
+				continue
+			}
+			before, after := &depotTotals{}, &depotTotals{}
+			if totals, ok := previous.depots[depot]; ok {
+				before = totals
+			}
+			if totals, ok := current.depots[depot]; ok {
+				after = totals
+			}
+			revisions, revisionsAdded, revisionsPerWeek := "", "", ""
+			if previous.hasRevisions && current.hasRevisions {
+				added := int64(after.revisions - before.revisions)
+				revisions = strconv.Itoa(after.revisions)
+				revisionsAdded = strconv.FormatInt(added, 10)
+				revisionsPerWeek = strconv.FormatInt(perWeek(added, days), 10)
+			}
+			out.Write([]string{
+				depot,
+				previous.date.UTC().Format("2006-01-02"),
+				current.date.UTC().Format("2006-01-02"),
+				strconv.FormatFloat(days, 'f', 1, 64),
+				revisions,
+				strconv.FormatInt(after.bytes, 10),
+				revisionsAdded,
+				strconv.FormatInt(after.bytes-before.bytes, 10),
+				revisionsPerWeek,
+				strconv.FormatInt(perWeek(after.bytes-before.bytes, days), 10)})
+		}
+	}
+	if err := out.Commit(); err != nil {
+		return err
+	}
+
+	first, last := snapshots[0], snapshots[len(snapshots)-1]
+	totalDays := last.date.Sub(first.date).Hours() / 24
+	if totalDays <= 0 {
+		return nil
+	}
+	var growing []directoryGrowth
+	for directory, lastBytes := range last.directories {
+		firstBytes := first.directories[directory]
+		if lastBytes <= firstBytes {
+			continue
+		}
+		growing = append(growing, directoryGrowth{
+			Directory:   directory,
+			FirstBytes:  firstBytes,
+			LastBytes:   lastBytes,
+			BytesAdded:  lastBytes - firstBytes,
+			BytesPerDay: int64(float64(lastBytes-firstBytes) / totalDays),
+		})
+	}
+	sort.Slice(growing, func(i, j int) bool {
+		if growing[i].BytesAdded != growing[j].BytesAdded {
+			return growing[i].BytesAdded > growing[j].BytesAdded
+		}
+		return growing[i].Directory < growing[j].Directory
+	})
+	// Each team gets the paths growing the most among the ones it owns
+	allGrowing := growing
+	if *limit > 0 && len(growing) > *limit {
+		growing = growing[:*limit]
+	}
+	for i, directory := range growing {
+		if i >= 10 {
+			break
+		}
+		slog.Info("Growing path", logging.PathKey, directory.Directory, "bytes_added", directory.BytesAdded,
+			"bytes_per_week", directory.BytesPerDay*7)
+	}
+
+	if len(*pathsCSV) > 0 {
+		if err := writeGrowingPaths(*pathsCSV, growing); err != nil {
+			return err
+		}
+	}
+	if scopes != nil {
+		err := writeTeamReports(scopes, *pathsCSV, allGrowing, func(directory directoryGrowth) string { return directory.Directory },
+			func(destination string, growing []directoryGrowth) error {
+				if *limit > 0 && len(growing) > *limit {
+					growing = growing[:*limit]
+				}
+				return writeGrowingPaths(destination, growing)
+			})
+		if err != nil {
+			return err
+		}
+	}
+	if len(*htmlChart) > 0 {
+		if err := writeTrendsChart(*htmlChart, snapshots, depots, growing); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeGrowingPaths(filePath string, growing []directoryGrowth) error {
+	file, err := output.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("error creating csv: %v", err)
+	}
+	defer file.Close()
+
+	csvWriter := output.NewCSVWriter(file)
+	csvWriter.Write([]string{"Path", "FirstBytes", "LastBytes", "BytesAdded", "BytesPerWeek"})
+	for _, directory := range growing {
+		csvWriter.Write([]string{
+			directory.Directory,
+			strconv.FormatInt(directory.FirstBytes, 10),
+			strconv.FormatInt(directory.LastBytes, 10),
+			strconv.FormatInt(directory.BytesAdded, 10),
+			strconv.FormatInt(directory.BytesPerDay*7, 10)})
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return fmt.Errorf("error writing csv: %v", err)
+	}
+	return file.Commit()
+}
+
+const (
+	chartWidth  = 800
+	chartHeight = 400
+)
+
+// Colors of the depot lines, reused when there are more depots
+var chartColors = []string{"#1a73e8", "#d93025", "#188038", "#f9ab00", "#9334e6", "#12b5cb", "#e8710a", "#5f6368"}
+
+type chartLine struct {
+	Depot  string
+	Color  string
+	Points string
+	Bytes  string
+}
+
+// Writes a self-contained HTML page with a line chart of the archive bytes of each depot over time,
+// and the top growing paths
+func writeTrendsChart(filePath string, snapshots []*snapshot, depots []string, growing []directoryGrowth) error {
+	maxBytes := int64(1)
+	for _, s := range snapshots {
+		for _, totals := range s.depots {
+			if totals.bytes > maxBytes {
+				maxBytes = totals.bytes
+			}
+		}
+	}
+	first, last := snapshots[0].date, snapshots[len(snapshots)-1].date
+	span := last.Sub(first).Seconds()
+
+	var lines []chartLine
+	for i, depot := range depots {
+		var points []string
+		for _, s := range snapshots {
+			bytes := int64(0)
+			if totals, ok := s.depots[depot]; ok {
+				bytes = totals.bytes
+			}
+			x := float64(chartWidth) * s.date.Sub(first).Seconds() / span
+			y := float64(chartHeight) * (1 - float64(bytes)/float64(maxBytes))
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+		}
+		bytes := int64(0)
+		if totals, ok := snapshots[len(snapshots)-1].depots[depot]; ok {
+			bytes = totals.bytes
+		}
+		lines = append(lines, chartLine{
+			Depot:  depot,
+			Color:  chartColors[i%len(chartColors)],
+			Points: strings.Join(points, " "),
+			Bytes:  strconv.FormatInt(bytes, 10),
+		})
+	}
+
+	file, err := output.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("error creating html chart: %v", err)
+	}
+	defer file.Close()
+
+	err = trendsTemplate.Execute(file, struct {
+		From     string
+		To       string
+		Count    int
+		MaxBytes int64
+		Width    int
+		Height   int
+		Lines    []chartLine
+		Growing  []directoryGrowth
+	}{first.UTC().Format("2006-01-02"), last.UTC().Format("2006-01-02"), len(snapshots), maxBytes,
+		chartWidth, chartHeight, lines, growing})
+	if err != nil {
+		return fmt.Errorf("error writing html chart: %v", err)
+	}
+	return file.Commit()
+}
+
+var trendsTemplate = template.Must(template.New("trends").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Depot growth</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #202124; }
+h1 { font-size: 1.6em; }
+svg { border: 1px solid #dadce0; margin-bottom: 1em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border-bottom: 1px solid #dadce0; padding: 0.3em 1em; text-align: left; }
+td.number { text-align: right; }
+.swatch { display: inline-block; width: 1em; height: 1em; margin-right: 0.5em; vertical-align: middle; }
+.meta { color: #5f6368; }
+</style>
+</head>
+<body>
+<h1>Depot growth</h1>
+<p class="meta">{{.Count}} snapshots from {{.From}} to {{.To}}, archive bytes from 0 to {{.MaxBytes}}</p>
+
+<svg width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}">
+{{range .Lines}}<polyline fill="none" stroke="{{.Color}}" stroke-width="2" points="{{.Points}}"><title>{{.Depot}}</title></polyline>
+{{end}}</svg>
+
+<table>
+<tr><th>Depot</th><th>Archive bytes</th></tr>
+{{range .Lines}}<tr><td><span class="swatch" style="background: {{.Color}}"></span>{{.Depot}}</td><td class="number">{{.Bytes}}</td></tr>
+{{end}}</table>
+
+{{if .Growing}}<h2>Top growing paths</h2>
+<table>
+<tr><th>Path</th><th>Bytes added</th><th>Bytes per day</th></tr>
+{{range .Growing}}<tr><td>{{.Directory}}</td><td class="number">{{.BytesAdded}}</td><td class="number">{{.BytesPerDay}}</td></tr>
+{{end}}</table>{{end}}
+</body>
+</html>
+`))
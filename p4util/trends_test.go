@@ -0,0 +1,44 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestTrends(t *testing.T) {
+	// The example checkpoint with one more archive, taken a week later
+	later := writeCheckpoint(t, `@pv@ 9 @db.rev@ @//depot/path3/a.txt@ 1 0 0 4 1611612000 1611612000 271E0A48226C79CCA6C1FCDE43CDAC31 10 0 0 @//depot/path3/a.txt@ @1.4@ 0 
+@pv@ 1 @db.storage@ @//depot/path3/a.txt@ @1.4@ 0 1 271E0A48226C79CCA6C1FCDE43CDAC31 10 700 00000000000000000000000000000000 1611612000 
+`)
+	data, err := os.ReadFile(later)
+	if err != nil {
+		t.Fatalf("ReadFile() returned %v", err)
+	}
+	data = bytes.Replace(data, []byte("1611008050"), []byte("1611612850"), 1)
+	if err := os.WriteFile(later, data, 0o644); err != nil {
+		t.Fatalf("WriteFile() returned %v", err)
+	}
+
+	rows := runReport(t, runTrends, exampleJournal, later)
+	checkReport(t, rows, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, [][]string{
+		{"Depot", "From", "To", "Days", "Revisions", "Bytes", "RevisionsAdded", "BytesAdded", "RevisionsPerWeek", "BytesPerWeek"},
+		{"depot", "2021-01-18", "2021-01-25", "7.0", "7", "32121", "1", "700", "1", "700"},
+	})
+}
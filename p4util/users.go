@@ -0,0 +1,291 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// The fields of the db.user table, as indexes in journal.Record.Fields.
+// They are documented here: https://www.perforce.com/perforce/doc.current/schema/#db.user.
+const (
+	DbUserFieldUser       = 0
+	DbUserFieldEmail      = 1
+	DbUserFieldJobView    = 2
+	DbUserFieldUpdateDate = 3
+	DbUserFieldAccessDate = 4
+	DbUserFieldFullName   = 5
+	DbUserFieldPassword   = 6
+	DbUserFieldStrength   = 7
+	DbUserFieldTicket     = 8
+	DbUserFieldEndDate    = 9
+	DbUserFieldType       = 10
+
+	DbUserFieldCount = 11
+)
+
+// https://www.perforce.com/perforce/doc.current/schema/#UserType
+var userTypes = map[string]string{
+	"0": "standard",
+	"1": "operator",
+	"2": "service",
+}
+
+// The fields of the db.group table, as indexes in journal.Record.Fields.
+// They are documented here: https://www.perforce.com/perforce/doc.current/schema/#db.group.
+const (
+	DbGroupFieldUser        = 0
+	DbGroupFieldGroup       = 1
+	DbGroupFieldType        = 2
+	DbGroupFieldMaxResults  = 3
+	DbGroupFieldMaxScanRows = 4
+	DbGroupFieldMaxLockTime = 5
+	DbGroupFieldMaxOpenFile = 6
+	DbGroupFieldTimeout     = 7
+
+	DbGroupFieldCount = 8
+)
+
+// https://www.perforce.com/perforce/doc.current/schema/#GroupType
+var groupMembershipTypes = map[string]string{
+	"0": "member",
+	"1": "subgroup",
+	"2": "owner",
+}
+
+// Returns the name of a type, or the raw value when it isn't known
+func typeName(names map[string]string, value string) string {
+	if name, ok := names[value]; ok {
+		return name
+	}
+	return value
+}
+
+func formatDate(date int64) string {
+	if date <= 0 {
+		return ""
+	}
+	return time.Unix(date, 0).UTC().Format("2006-01-02")
+}
+
+type userRecord struct {
+	fields     []string
+	userType   string
+	accessDate int64
+}
+
+func runUsers(args []string) error {
+	flags := flag.NewFlagSet("users", flag.ExitOnError)
+	idleDays := flags.Int("idle-days", 0, "Only report users who haven't accessed the server for this many days (0 for all users).")
+	includeService := flags.Bool("include-service", false, "Report idle service and operator users as well.")
+	asOf := flags.String("as-of", "", "Date (YYYY-MM-DD) idle days are computed at, the checkpoint date by default.")
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+
+	users := make(map[string]*userRecord)
+	groups := make(map[string][]string)
+	checkpointDate := int64(0)
+
+	file, err := journal.Open(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	// ScanFile skips the note records, so the header is read with Scan
+	err = journal.Scan(file, func(record journal.Record) error {
+		// The header of the checkpoint records when it was taken
+		if record.Operation == journal.NoteTransaction && record.Field(0) == "0" {
+			checkpointDate, _ = strconv.ParseInt(record.Field(1), 10, 64)
+			return nil
+		}
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		switch record.Table {
+		case "db.user":
+			if len(record.Fields) < DbUserFieldCount {
+				slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+					logging.ErrorClassKey, logging.MalformedError)
+				return nil
+			}
+			accessDate, _ := strconv.ParseInt(record.Fields[DbUserFieldAccessDate], 10, 64)
+			users[record.Fields[DbUserFieldUser]] = &userRecord{
+				fields:     record.Fields,
+				userType:   typeName(userTypes, record.Fields[DbUserFieldType]),
+				accessDate: accessDate,
+			}
+		case "db.group":
+			// Only direct members, subgroups and owners don't use a license through the group
+			if len(record.Fields) >= DbGroupFieldCount && record.Fields[DbGroupFieldType] == "0" {
+				groups[record.Fields[DbGroupFieldUser]] = append(groups[record.Fields[DbGroupFieldUser]], record.Fields[DbGroupFieldGroup])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if len(*asOf) > 0 {
+		if now, err = time.Parse("2006-01-02", *asOf); err != nil {
+			return fmt.Errorf("invalid -as-of date: %v", err)
+		}
+	} else if checkpointDate > 0 {
+		now = time.Unix(checkpointDate, 0)
+	}
+
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out, err := output.NewWriter(*format, *outputPath, output.Table{Name: "users"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.Write([]string{
+		"User",
+		"Email",
+		"FullName",
+		"Type",
+		"UpdateDate",
+		"AccessDate",
+		"IdleDays",
+		"Groups"})
+	reported := 0
+	idleByType := make(map[string]int)
+	for _, name := range names {
+		user := users[name]
+		idle := int(now.Sub(time.Unix(user.accessDate, 0)).Hours() / 24)
+		if *idleDays > 0 {
+			if idle < *idleDays {
+				continue
+			}
+			idleByType[user.userType]++
+			if user.userType != "standard" && !*includeService {
+				continue
+			}
+		}
+		updateDate, _ := strconv.ParseInt(user.fields[DbUserFieldUpdateDate], 10, 64)
+		userGroups := groups[name]
+		sort.Strings(userGroups)
+		out.Write([]string{
+			name,
+			user.fields[DbUserFieldEmail],
+			user.fields[DbUserFieldFullName],
+			user.userType,
+			formatDate(updateDate),
+			formatDate(user.accessDate),
+			strconv.Itoa(idle),
+			strings.Join(userGroups, " ")})
+		reported++
+	}
+	if err := out.Commit(); err != nil {
+		return err
+	}
+
+	slog.Info("Processed users", logging.CountKey, len(users))
+	if *idleDays > 0 {
+		for _, userType := range []string{"standard", "operator", "service"} {
+			slog.Info("Idle users", "type", userType, logging.CountKey, idleByType[userType])
+		}
+		slog.Info("Reported idle users", logging.CountKey, reported, "as_of", now.UTC().Format("2006-01-02"))
+	}
+	return nil
+}
+
+func runGroups(args []string) error {
+	flags := flag.NewFlagSet("groups", flag.ExitOnError)
+	outputPath := flags.String("output", output.Stdout, outputUsage)
+	format := flags.String("format", "csv", output.FormatUsage())
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		return fmt.Errorf("insufficient number or arguments specified")
+	}
+	if err := output.CheckFormat(*format); err != nil {
+		return err
+	}
+
+	out, err := output.NewWriter(*format, *outputPath, output.Table{Name: "groups"})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.Write([]string{
+		"Group",
+		"Member",
+		"Membership",
+		"MaxResults",
+		"MaxScanRows",
+		"MaxLockTime",
+		"MaxOpenFiles",
+		"Timeout"})
+	count := 0
+	err = journal.ScanFile(flags.Arg(0), map[string]bool{"db.group": true}, func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		if len(record.Fields) < DbGroupFieldCount {
+			slog.Warn("Skipping short record", logging.TableKey, record.Table, logging.LineKey, record.LineNumber,
+				logging.ErrorClassKey, logging.MalformedError)
+			return nil
+		}
+		out.Write([]string{
+			record.Fields[DbGroupFieldGroup],
+			record.Fields[DbGroupFieldUser],
+			typeName(groupMembershipTypes, record.Fields[DbGroupFieldType]),
+			record.Fields[DbGroupFieldMaxResults],
+			record.Fields[DbGroupFieldMaxScanRows],
+			record.Fields[DbGroupFieldMaxLockTime],
+			record.Fields[DbGroupFieldMaxOpenFile],
+			record.Fields[DbGroupFieldTimeout]})
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := out.Commit(); err != nil {
+		return err
+	}
+
+	slog.Info("Processed group entries", logging.CountKey, count)
+	return nil
+}
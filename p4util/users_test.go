@@ -0,0 +1,52 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestUsers(t *testing.T) {
+	rows := runReport(t, runUsers, exampleJournal)
+	checkReport(t, rows, []int{0, 1, 3, 4, 6}, [][]string{
+		{"User", "Email", "Type", "UpdateDate", "IdleDays"},
+		{"the_user", "the_user@the_user_client", "standard", "2021-01-18", "0"},
+	})
+}
+
+func TestUsersIdleDays(t *testing.T) {
+	rows := runReport(t, runUsers, "-idle-days=30", "-as-of=2021-03-01", exampleJournal)
+	checkReport(t, rows, []int{0, 6}, [][]string{
+		{"User", "IdleDays"},
+		{"the_user", "41"},
+	})
+
+	rows = runReport(t, runUsers, "-idle-days=30", exampleJournal)
+	checkReport(t, rows, []int{0, 6}, [][]string{
+		{"User", "IdleDays"},
+	})
+}
+
+func TestGroups(t *testing.T) {
+	checkpoint := writeCheckpoint(t, `@pv@ 7 @db.group@ @the_user@ @developers@ 0 1000 50000 30000 100 43200 0 
+@pv@ 7 @db.group@ @admins@ @developers@ 1 1000 50000 30000 100 43200 0 
+`)
+	rows := runReport(t, runGroups, checkpoint)
+	checkReport(t, rows, []int{0, 1, 2, 3, 7}, [][]string{
+		{"Group", "Member", "Membership", "MaxResults", "Timeout"},
+		{"developers", "the_user", "member", "1000", "43200"},
+		{"developers", "admins", "subgroup", "1000", "43200"},
+	})
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The baselines are a small subset of YAML, read and written here to keep p4util free of
+// dependencies: block mappings and sequences of scalars, plain or quoted scalars, comments,
+// and the {} and [] empty collections. Scalars are always strings.
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+// Removes a comment, which starts with a # at the beginning of the line or after a space,
+// outside quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' '):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseYAMLScalar(text string, number int) (string, error) {
+	switch {
+	case strings.HasPrefix(text, "\""):
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return "", fmt.Errorf("line %v: invalid double-quoted string %v", number, text)
+		}
+		return value, nil
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return "", fmt.Errorf("line %v: invalid single-quoted string %v", number, text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+	return text, nil
+}
+
+// Splits "key: value" at the first colon followed by a space or the end of the line, outside quotes
+func splitYAMLKey(text string, number int) (string, string, error) {
+	end := -1
+	if strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'") {
+		for i := 1; i < len(text); i++ {
+			if text[0] == '"' && text[i] == '\\' {
+				i++
+			} else if text[i] == text[0] {
+				end = i + 1
+				break
+			}
+		}
+	} else {
+		end = 0
+	}
+	if end < 0 {
+		return "", "", fmt.Errorf("line %v: unterminated key", number)
+	}
+	for i := end; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			key, err := parseYAMLScalar(strings.TrimSpace(text[:i]), number)
+			if err != nil {
+				return "", "", err
+			}
+			return key, strings.TrimSpace(text[i+1:]), nil
+		}
+	}
+	return "", "", fmt.Errorf("line %v: expected \"key: value\", got %v", number, text)
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	next  int
+}
+
+// Parses the block starting at the next line, whose lines are indented by indent
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	if strings.HasPrefix(p.lines[p.next].text, "- ") || p.lines[p.next].text == "-" {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+// Parses the value of a key or sequence item: inline, or the nested block that follows
+func (p *yamlParser) parseValue(inline string, indent int, number int) (interface{}, error) {
+	switch inline {
+	case "{}":
+		return map[string]interface{}{}, nil
+	case "[]":
+		return []interface{}{}, nil
+	case "":
+		if p.next < len(p.lines) && p.lines[p.next].indent > indent {
+			return p.parseBlock(p.lines[p.next].indent)
+		}
+		return "", nil
+	}
+	return parseYAMLScalar(inline, number)
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	mapping := make(map[string]interface{})
+	for p.next < len(p.lines) && p.lines[p.next].indent == indent {
+		line := p.lines[p.next]
+		if strings.HasPrefix(line.text, "- ") {
+			return nil, fmt.Errorf("line %v: unexpected sequence item in a mapping", line.number)
+		}
+		key, inline, err := splitYAMLKey(line.text, line.number)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := mapping[key]; ok {
+			return nil, fmt.Errorf("line %v: duplicate key %v", line.number, key)
+		}
+		p.next++
+		if len(inline) == 0 && p.next < len(p.lines) && p.lines[p.next].indent == indent &&
+			strings.HasPrefix(p.lines[p.next].text, "- ") {
+			// A sequence can be indented like its key
+			mapping[key], err = p.parseSequence(indent)
+		} else {
+			mapping[key], err = p.parseValue(inline, indent, line.number)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mapping, nil
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	sequence := []interface{}{}
+	for p.next < len(p.lines) && p.lines[p.next].indent == indent {
+		line := p.lines[p.next]
+		if !strings.HasPrefix(line.text, "- ") && line.text != "-" {
+			return nil, fmt.Errorf("line %v: expected a sequence item, got %v", line.number, line.text)
+		}
+		p.next++
+		item, err := p.parseValue(strings.TrimSpace(strings.TrimPrefix(line.text, "-")), indent, line.number)
+		if err != nil {
+			return nil, err
+		}
+		sequence = append(sequence, item)
+	}
+	return sequence, nil
+}
+
+// Parses a YAML document into nested map[string]interface{}, []interface{} and string values
+func parseYAML(content string) (interface{}, error) {
+	parser := &yamlParser{}
+	for i, raw := range strings.Split(content, "\n") {
+		if raw == "---" {
+			continue
+		}
+		text := strings.TrimRight(stripYAMLComment(strings.TrimRight(raw, "\r")), " ")
+		trimmed := strings.TrimLeft(text, " ")
+		if len(trimmed) == 0 {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %v: tabs are not allowed for indentation", i+1)
+		}
+		parser.lines = append(parser.lines, yamlLine{number: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(parser.lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	value, err := parser.parseBlock(parser.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if parser.next < len(parser.lines) {
+		line := parser.lines[parser.next]
+		return nil, fmt.Errorf("line %v: unexpected indentation", line.number)
+	}
+	return value, nil
+}
+
+var plainYAMLKey = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.\-/]*$`)
+
+// Quotes a mapping key when it isn't a plain word
+func yamlKey(key string) string {
+	if plainYAMLKey.MatchString(key) {
+		return key
+	}
+	return strconv.Quote(key)
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// A Bloom filter of strings. It never reports a string that was added as absent,
+// but may report a string that wasn't added as present.
+type bloomFilter struct {
+	bits      []uint64
+	bitCount  uint64
+	hashCount int
+}
+
+// Sizes the filter for the expected number of strings and false positive rate
+func newBloomFilter(expectedCount int, falsePositiveRate float64) *bloomFilter {
+	if expectedCount < 1 {
+		expectedCount = 1
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 0.01
+	}
+	bitCount := uint64(math.Ceil(-float64(expectedCount) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if bitCount < 64 {
+		bitCount = 64
+	}
+	hashCount := int(math.Round(float64(bitCount) / float64(expectedCount) * math.Ln2))
+	if hashCount < 1 {
+		hashCount = 1
+	}
+	return &bloomFilter{
+		bits:      make([]uint64, (bitCount+63)/64),
+		bitCount:  bitCount,
+		hashCount: hashCount,
+	}
+}
+
+// Derives the bit positions of a string from two halves of its 64-bit FNV hash (double hashing)
+func (f *bloomFilter) positions(value string, fn func(position uint64) bool) bool {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+	sum := hash.Sum64()
+	h1, h2 := sum&0xFFFFFFFF, sum>>32
+	for i := 0; i < f.hashCount; i++ {
+		if !fn((h1 + uint64(i)*h2) % f.bitCount) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) add(value string) {
+	f.positions(value, func(position uint64) bool {
+		f.bits[position/64] |= 1 << (position % 64)
+		return true
+	})
+}
+
+func (f *bloomFilter) mayContain(value string) bool {
+	return f.positions(value, func(position uint64) bool {
+		return f.bits[position/64]&(1<<(position%64)) != 0
+	})
+}
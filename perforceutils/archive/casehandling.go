@@ -0,0 +1,115 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+)
+
+// How a server compares file names
+type CaseHandling int
+
+const (
+	UnknownCaseHandling CaseHandling = iota
+	SensitiveCaseHandling
+	InsensitiveCaseHandling
+)
+
+func (c CaseHandling) String() string {
+	switch c {
+	case SensitiveCaseHandling:
+		return "sensitive"
+	case InsensitiveCaseHandling:
+		return "insensitive"
+	default:
+		return "unknown"
+	}
+}
+
+// The counter or configurable recording the case handling of the server (as set with p4d -C),
+// for example "p4 counter caseHandling insensitive"
+const CaseHandlingKey = "caseHandling"
+
+// The header of checkpoints and journals is a note record of type 0, followed by the date and the
+// journal sequence, and later the server root
+const headerNoteType = "0"
+
+var windowsRootPattern = regexp.MustCompile(`^[A-Za-z]:\\|^\\\\`)
+
+var errDetectionDone = errors.New("case handling detection done")
+
+func parseCaseHandling(value string) CaseHandling {
+	switch strings.ToLower(value) {
+	case "sensitive", "0":
+		return SensitiveCaseHandling
+	case "insensitive", "1":
+		return InsensitiveCaseHandling
+	}
+	return UnknownCaseHandling
+}
+
+// Reads the case handling of the server from the beginning of a checkpoint: the caseHandling counter
+// or configurable when set, otherwise the server root recorded in the header, since servers running
+// on Windows are always case-insensitive. The records are read until another table follows
+// db.counters: checkpoints write the records of a table together, usually db.config and db.counters
+// first, but journals and other inputs needn't order the tables by name.
+// Returns the detected setting and a description of where it comes from.
+func DetectCaseHandling(r io.Reader) (CaseHandling, string, error) {
+	detected := UnknownCaseHandling
+	source := ""
+	// An explicit setting takes precedence over the server root and ends the detection
+	setting := func(value CaseHandling, from string) error {
+		if value == UnknownCaseHandling {
+			return nil
+		}
+		detected, source = value, from
+		return errDetectionDone
+	}
+	countersSeen := false
+	err := journal.Scan(r, func(record journal.Record) error {
+		if record.IsTableOperation() && record.Table != "db.counters" && countersSeen {
+			return errDetectionDone
+		}
+		switch {
+		case record.Operation == journal.NoteTransaction && record.Field(0) == headerNoteType:
+			for _, field := range record.Fields {
+				if windowsRootPattern.MatchString(field) && detected == UnknownCaseHandling {
+					detected, source = InsensitiveCaseHandling, fmt.Sprintf("Windows server root %v", field)
+				}
+			}
+		case !record.IsTableOperation():
+		case record.Table == "db.config" && strings.EqualFold(record.Field(1), CaseHandlingKey):
+			return setting(parseCaseHandling(record.Field(2)), "db.config "+CaseHandlingKey)
+		case record.Table == "db.counters":
+			countersSeen = true
+			if strings.EqualFold(record.Field(0), CaseHandlingKey) {
+				return setting(parseCaseHandling(record.Field(1)), "db.counters "+CaseHandlingKey)
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errDetectionDone {
+		return UnknownCaseHandling, "", err
+	}
+	return detected, source, nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectCaseHandling(t *testing.T) {
+	tests := []struct {
+		name       string
+		checkpoint string
+		want       CaseHandling
+	}{
+		{
+			name: "counter",
+			checkpoint: `@pv@ 1 @db.config@ @any@ @unicode@ @1@ 
+@pv@ 1 @db.counters@ @caseHandling@ @insensitive@ 
+`,
+			want: InsensitiveCaseHandling,
+		},
+		{
+			name: "configurable",
+			checkpoint: `@pv@ 1 @db.config@ @any@ @caseHandling@ @sensitive@ 
+`,
+			want: SensitiveCaseHandling,
+		},
+		{
+			name: "counter after another table",
+			checkpoint: `@pv@ 1 @db.user@ @joe@ @joe@@example.com@ @@ 1611008019 1611008019 @joe@ @@ 0 @@ 0 0 0 0 0 0 
+@pv@ 1 @db.counters@ @change@ @3@ 
+@pv@ 1 @db.counters@ @caseHandling@ @insensitive@ 
+`,
+			want: InsensitiveCaseHandling,
+		},
+		{
+			name: "counter after db.counters",
+			checkpoint: `@pv@ 1 @db.counters@ @change@ @3@ 
+@pv@ 1 @db.depot@ @depot@ 0 @@ @depot/...@ 
+@pv@ 1 @db.counters@ @caseHandling@ @insensitive@ 
+`,
+			want: UnknownCaseHandling,
+		},
+		{
+			name: "Windows server root",
+			checkpoint: `@nx@ 0 1611008050 @50@ 10 0 0 0 0 @C:\Users\the_user\p4root@ @journal@ @@ @@ @@ 
+@pv@ 1 @db.counters@ @change@ @3@ 
+`,
+			want: InsensitiveCaseHandling,
+		},
+		{
+			name: "counter over Windows server root",
+			checkpoint: `@nx@ 0 1611008050 @50@ 10 0 0 0 0 @C:\Users\the_user\p4root@ @journal@ @@ @@ @@ 
+@pv@ 1 @db.counters@ @caseHandling@ @sensitive@ 
+`,
+			want: SensitiveCaseHandling,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, source, err := DetectCaseHandling(strings.NewReader(test.checkpoint))
+			if err != nil {
+				t.Fatalf("DetectCaseHandling() returned %v", err)
+			}
+			if got != test.want {
+				t.Errorf("DetectCaseHandling() = %v (from %q), want %v", got, source, test.want)
+			}
+		})
+	}
+}
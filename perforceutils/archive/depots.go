@@ -0,0 +1,66 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"io"
+
+	"github.com/google/perforce-utils/perforceutils/lbr"
+)
+
+// The fields of the db.depot table, as indexes in journal.Record.Fields.
+// They are documented here: https://www.perforce.com/perforce/doc.current/schema/#db.depot.
+const (
+	DbDepotFieldName  = 0
+	DbDepotFieldType  = 1
+	DbDepotFieldExtra = 2
+	DbDepotFieldMap   = 3
+
+	DbDepotFieldCount = 4
+)
+
+// The archive directories of the depots whose Map field doesn't match their name, keyed by depot name
+type DepotMaps = lbr.DepotMaps
+
+// Reads the depots whose archives aren't stored in a directory named after them, from a
+// checkpoint. The records after db.depot aren't read.
+func ReadDepotMaps(r io.Reader) (DepotMaps, error) {
+	return lbr.ReadDepotMaps(r)
+}
+
+// The type of a depot, from db.depot
+type DepotType = lbr.DepotType
+
+// Graph depots hold git repositories, whose files are git objects rather than librarian files
+const GraphDepotType = lbr.GraphDepotType
+
+// Reads the type of the depots of a checkpoint, keyed by depot name. The records after db.depot
+// aren't read.
+func ReadDepotTypes(r io.Reader) (map[string]DepotType, error) {
+	return lbr.ReadDepotTypes(r)
+}
+
+// Returns the names of the graph depots among depot types read by ReadDepotTypes
+func GraphDepots(depotTypes map[string]DepotType) map[string]bool {
+	depots := make(map[string]bool)
+	for depot, depotType := range depotTypes {
+		if depotType == GraphDepotType {
+			depots[depot] = true
+		}
+	}
+	return depots
+}
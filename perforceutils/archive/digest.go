@@ -0,0 +1,217 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// Returned by ArchiveDigest for archives whose content can't be hashed directly, such as RCS files
+// (whose revisions are rebuilt with the rcs package)
+var ErrDigestUnsupported = errors.New("digest not supported for this storage type")
+
+// Wrapped by the errors of ArchiveDigest for compressed archives that can't be uncompressed, such as
+// truncated files or files failing the gzip checksum, as opposed to archives that can't be read
+var ErrCorruptArchive = errors.New("corrupt archive")
+
+// Returns err wrapping ErrCorruptArchive, unless it's an error reading the file
+func corruptArchiveError(path string, err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return fmt.Errorf("error reading %v: %v", path, err)
+	}
+	return fmt.Errorf("%w %v: %v", ErrCorruptArchive, path, err)
+}
+
+// Reports whether a recorded digest can be compared: servers leave it empty or zeroed when unknown
+func hasDigest(digest string) bool {
+	return len(strings.Trim(digest, "0")) > 0
+}
+
+// Returns the path of a full file archive under the depot root, with its .gz suffix when compressed,
+// or of the revision under its ,v file for RCS archives
+func ArchiveFilePath(depotRoot string, depots DepotMaps, lbrFile string, lbrRev string, lbrType int) string {
+	path := depots.Path(depotRoot, VersionedFilePath(lbrFile, lbrRev, lbrType))
+	switch StorageType(lbrType) {
+	case CompressedStorageType, CompressedTempObj:
+		return path + ".gz"
+	}
+	return path
+}
+
+// Computes the MD5 digest of the content of a full file archive, uncompressing it when needed,
+// as recorded in db.storage and db.rev (uppercase hexadecimal)
+func ArchiveDigest(path string, lbrType int) (string, error) {
+	digest, _, err := archiveDigest(path, lbrType, nil, nil, md5.New())
+	return digest, err
+}
+
+// Hashes an archive with h, returning its digest and the number of bytes of content hashed
+func archiveDigest(path string, lbrType int, throttle *Throttle, timeouts *FileTimeouts, h hash.Hash) (string, int64, error) {
+	var compressed bool
+	switch StorageType(lbrType) {
+	case BinaryStorageType, TempObjStorageType:
+	case CompressedStorageType, CompressedTempObj:
+		compressed = true
+	default:
+		return "", 0, ErrDigestUnsupported
+	}
+
+	file, err := timeouts.open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	var content io.Reader = bufio.NewReaderSize(throttle.reader(timeouts.reader(path, file)), 1024*1024)
+	if compressed {
+		// Archives made of several gzip members, as written by some backup and transfer tools, are
+		// read as one stream
+		gzipReader, err := gzip.NewReader(content)
+		if err != nil {
+			return "", 0, corruptArchiveError(path, err)
+		}
+		defer gzipReader.Close()
+		content = gzipReader
+	}
+	n, err := io.Copy(h, content)
+	if err != nil {
+		if compressed {
+			return "", n, corruptArchiveError(path, err)
+		}
+		return "", n, fmt.Errorf("error reading %v: %v", path, err)
+	}
+	return strings.ToUpper(hex.EncodeToString(h.Sum(nil))), n, nil
+}
+
+// Returns the MD5 digest of a revision content, as recorded in db.storage and db.rev
+func contentDigest(content []byte) string {
+	sum := md5.Sum(content)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+type digestCacheEntry struct {
+	size    int64
+	modTime int64
+	digest  string
+}
+
+// A persistent cache of archive digests, keyed by path. Entries are only used while the size and
+// modification time of the archive are unchanged, so that repeated verifications only rehash the
+// archives that changed.
+//
+// The cache is a text file with one "<size> <mtime in ns> <digest> <path>" line per archive.
+type DigestCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]digestCacheEntry
+	changed bool
+}
+
+// Loads a digest cache, starting an empty one when the file doesn't exist yet
+func OpenDigestCache(path string) (*DigestCache, error) {
+	cache := &DigestCache{path: path, entries: make(map[string]digestCacheEntry)}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening digest cache: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		parts := strings.SplitN(scanner.Text(), " ", 4)
+		if len(parts) < 4 {
+			return nil, fmt.Errorf("malformed digest cache line %v", lineNumber)
+		}
+		size, sizeErr := strconv.ParseInt(parts[0], 10, 64)
+		modTime, modTimeErr := strconv.ParseInt(parts[1], 10, 64)
+		if sizeErr != nil || modTimeErr != nil {
+			return nil, fmt.Errorf("malformed digest cache line %v", lineNumber)
+		}
+		cache.entries[parts[3]] = digestCacheEntry{size: size, modTime: modTime, digest: parts[2]}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading digest cache: %v", err)
+	}
+	return cache, nil
+}
+
+// Returns the number of cached digests
+func (c *DigestCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Returns the cached digest of an archive, if it hasn't changed since it was computed
+func (c *DigestCache) Lookup(path string, info os.FileInfo) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[path]
+	if !ok || entry.size != info.Size() || entry.modTime != info.ModTime().UnixNano() {
+		return "", false
+	}
+	return entry.digest, true
+}
+
+// Records the digest of an archive along with its current size and modification time
+func (c *DigestCache) Store(path string, info os.FileInfo, digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[path] = digestCacheEntry{size: info.Size(), modTime: info.ModTime().UnixNano(), digest: digest}
+	c.changed = true
+}
+
+// Writes the cache back to its file, replacing it only once completely written
+func (c *DigestCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.changed {
+		return nil
+	}
+
+	err := output.WriteFile(c.path, func(w io.Writer) error {
+		for path, entry := range c.entries {
+			fmt.Fprintf(w, "%v %v %v %v\n", entry.size, entry.modTime, entry.digest, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error writing digest cache: %v", err)
+	}
+	c.changed = false
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Answers the stat calls of the files of a directory from a listing of the directory, read once,
+// instead of a call per file. On network filesystems (NFS, SMB), each stat call is a round trip to
+// the server, as is each lookup of a missing file, while the listing of a directory fetches the
+// attributes of all its files at once (NFS READDIRPLUS, SMB directory enumeration). Archives are
+// checked in the order of the checkpoint, which lists the revisions of a file one after the other,
+// so only the last directory listed is kept.
+type dirCache struct {
+	timeouts *FileTimeouts
+	dir      string
+	entries  map[string]os.FileInfo
+	err      error
+	// The number of directories listed
+	listings int
+}
+
+func newDirCache(timeouts *FileTimeouts) *dirCache {
+	return &dirCache{timeouts: timeouts}
+}
+
+// Returns the information of a file, as os.Stat
+func (c *dirCache) stat(path string) (os.FileInfo, error) {
+	dir := filepath.Dir(path)
+	if dir != c.dir {
+		c.dir, c.entries = dir, make(map[string]os.FileInfo)
+		c.listings++
+		var infos []os.FileInfo
+		infos, c.err = c.timeouts.readDir(dir)
+		for _, info := range infos {
+			c.entries[info.Name()] = info
+		}
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	info, ok := c.entries[filepath.Base(path)]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+	}
+	// The listing has the information of the links themselves
+	if info.Mode()&os.ModeSymlink != 0 {
+		return c.timeouts.stat(path)
+	}
+	return info, nil
+}
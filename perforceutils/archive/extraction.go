@@ -0,0 +1,166 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// The columns of a p4_storage_to_csv extraction holding the fields of db.storage, in field order
+var extractionColumns = [DbStorageFieldCount]string{
+	DbStorageFieldLbrFile:    "LibrarianFile",
+	DbStorageFieldLbrRev:     "LibrarianRevision",
+	DbStorageFieldLbrType:    "FileType",
+	DbStorageFieldRefCount:   "ReferenceCount",
+	DbStorageFieldDigest:     "MD5OfLibrarianFile",
+	DbStorageFieldSize:       "FileSize",
+	DbStorageFieldServerSize: "FileSizeOnServer",
+	DbStorageFieldCompCksum:  "DigestOfCompressedFile",
+	DbStorageFieldDate:       "LastUpdateDate",
+}
+
+// The file names of the extractions
+var extractionSuffixes = []string{".csv", ".csv.gz", ".parquet"}
+
+func hasExtractionSuffix(path string) bool {
+	for _, suffix := range extractionSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether a path is a p4_storage_to_csv extraction rather than a checkpoint or journal:
+// a CSV file (.csv or .csv.gz), a Parquet file (.parquet), or a directory written with -output-dir
+func IsExtraction(path string) bool {
+	if hasExtractionSuffix(path) {
+		return true
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// Lists the files of an extraction, in the order they were written
+func extractionFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		// Files still being written are hidden
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") && hasExtractionSuffix(entry.Name()) {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no extraction files in %v", path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Calls fn for the rows of a p4_storage_to_csv extraction, as the put value records of a checkpoint:
+// db.storagesh for the rows with true in the ShelvedStorage column, db.storage for the others, so
+// that the reports computed from db.storage can be computed again from an extraction without parsing
+// the checkpoint. Only the records of the given tables are passed on (all when tables is empty).
+// The line numbers of the records are those of the rows in their file, the header being line 1.
+func ScanExtraction(path string, tables map[string]bool, fn func(journal.Record) error) error {
+	files, err := extractionFiles(path)
+	if err != nil {
+		return fmt.Errorf("error listing extraction: %v", err)
+	}
+	for _, file := range files {
+		if err := scanExtractionFile(file, tables, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanExtractionFile(path string, tables map[string]bool, fn func(journal.Record) error) error {
+	var indexes [DbStorageFieldCount]int
+	shelvedIndex := -1
+	lineNumber := 0
+	return output.ReadRows(path, func(row []string) error {
+		lineNumber++
+		if lineNumber == 1 {
+			columns := make(map[string]int)
+			for i, name := range row {
+				columns[name] = i
+			}
+			for field, name := range extractionColumns {
+				index, ok := columns[name]
+				if !ok {
+					return fmt.Errorf("%v is not a p4_storage_to_csv extraction: no %v column", path, name)
+				}
+				indexes[field] = index
+			}
+			if index, ok := columns["ShelvedStorage"]; ok {
+				shelvedIndex = index
+			}
+			return nil
+		}
+
+		record := journal.Record{Operation: journal.PutValue, Version: 1, Table: "db.storage", LineNumber: lineNumber}
+		if shelvedIndex >= 0 && shelvedIndex < len(row) && row[shelvedIndex] == "true" {
+			record.Table = "db.storagesh"
+		}
+		if len(tables) > 0 && !tables[record.Table] {
+			return nil
+		}
+		record.Fields = make([]string, DbStorageFieldCount)
+		for field, index := range indexes {
+			if index < len(row) {
+				record.Fields[field] = row[index]
+			}
+		}
+		// The file type and reference count are written in hexadecimal
+		for _, field := range []int{DbStorageFieldLbrType, DbStorageFieldRefCount} {
+			if value, err := strconv.ParseInt(record.Fields[field], 16, 64); err == nil {
+				record.Fields[field] = strconv.FormatInt(value, 10)
+			}
+		}
+
+		raw := []string{journal.Quote(record.Operation), strconv.Itoa(record.Version), journal.Quote(record.Table)}
+		for field, value := range record.Fields {
+			switch field {
+			case DbStorageFieldLbrFile, DbStorageFieldLbrRev, DbStorageFieldDigest, DbStorageFieldCompCksum:
+				value = journal.Quote(value)
+			}
+			raw = append(raw, value)
+		}
+		record.Raw = strings.Join(raw, " ") + " "
+		return fn(record)
+	})
+}
@@ -0,0 +1,31 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"os"
+)
+
+type fileID struct {
+	device uint64
+	inode  uint64
+}
+
+// Directory identities aren't available on Windows, so cycles and mounts aren't detected there
+func getFileID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HashPoolOptions struct {
+	// The number of archives hashed in parallel
+	Workers int
+	// Pins each worker to one of these CPUs, in turn, so that the workers of a large host stay on
+	// the cores (and NUMA node) they were given. Linux only; the workers aren't pinned when empty.
+	CPUs []int
+	// Creates the hash of a worker, reset before each archive (crypto/md5 when nil). Hashes
+	// implementing io.Closer are closed along with the pool.
+	NewHash func(worker int) hash.Hash
+}
+
+// Computes the digests of full file archives on a fixed set of workers, for Verify to keep every
+// core of a large host busy (see Options.HashPool). RCS archives are still hashed one at a time.
+type HashPool struct {
+	jobs    chan func(hash.Hash)
+	workers sync.WaitGroup
+
+	mu       sync.Mutex
+	stats    HashStats
+	first    time.Time
+	lastDone time.Time
+}
+
+// The aggregate throughput of a hash pool
+type HashStats struct {
+	Files int64
+	// The bytes hashed, uncompressed
+	Bytes int64
+	// From the first archive submitted to the last one hashed
+	Elapsed time.Duration
+}
+
+// Returns the bytes hashed per second
+func (s HashStats) Throughput() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Elapsed.Seconds()
+}
+
+// Starts the workers of a hash pool, which run until Close is called. Fails when the workers can't
+// be pinned to the requested CPUs.
+func NewHashPool(options HashPoolOptions) (*HashPool, error) {
+	if options.Workers < 1 {
+		return nil, fmt.Errorf("invalid number of hash workers %v", options.Workers)
+	}
+	newHash := options.NewHash
+	if newHash == nil {
+		newHash = func(int) hash.Hash { return md5.New() }
+	}
+	pool := &HashPool{jobs: make(chan func(hash.Hash), options.Workers)}
+	started := make(chan error, options.Workers)
+	for i := 0; i < options.Workers; i++ {
+		pool.workers.Add(1)
+		go func(worker int) {
+			defer pool.workers.Done()
+			if len(options.CPUs) > 0 {
+				// The thread exits with the goroutine, rather than going back to the scheduler pinned
+				if err := pinThread(options.CPUs[worker%len(options.CPUs)]); err != nil {
+					started <- err
+					return
+				}
+			}
+			started <- nil
+			h := newHash(worker)
+			if closer, ok := h.(io.Closer); ok {
+				defer closer.Close()
+			}
+			for job := range pool.jobs {
+				h.Reset()
+				job(h)
+			}
+		}(i)
+	}
+	var err error
+	for i := 0; i < options.Workers; i++ {
+		if startErr := <-started; startErr != nil && err == nil {
+			err = startErr
+		}
+	}
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
+
+// Queues a job, waiting while all the workers are busy
+func (p *HashPool) submit(job func(hash.Hash)) {
+	p.mu.Lock()
+	if p.first.IsZero() {
+		p.first = time.Now()
+	}
+	p.mu.Unlock()
+	p.jobs <- job
+}
+
+// Records an archive hashed by a worker
+func (p *HashPool) done(bytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stats.Files++
+	p.stats.Bytes += bytes
+	p.lastDone = time.Now()
+}
+
+// Returns the archives and bytes hashed so far
+func (p *HashPool) Stats() HashStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	if !p.first.IsZero() && p.lastDone.After(p.first) {
+		stats.Elapsed = p.lastDone.Sub(p.first)
+	}
+	return stats
+}
+
+// Stops the workers once the queued archives are hashed
+func (p *HashPool) Close() {
+	close(p.jobs)
+	p.workers.Wait()
+}
+
+// Parses a Linux CPU list, as in /sys/devices/system/node/node0/cpulist or taskset -c: comma-separated
+// CPU numbers and ranges, such as "0-19,40-59"
+func ParseCPUList(list string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		if len(part) == 0 {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid CPU %q", part)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil, fmt.Errorf("invalid CPU range %q", part)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	if len(cpus) == 0 {
+		return nil, fmt.Errorf("empty CPU list")
+	}
+	return cpus, nil
+}
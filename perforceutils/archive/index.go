@@ -0,0 +1,810 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/perforce-utils/perforceutils/lbr"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/wildcard"
+	"github.com/karrick/godirwalk"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Brings journal and on-disk paths to a common form before they are compared:
+// legacy-encoded names are decoded to UTF-8, names are converted to Unicode normalization form C
+// (macOS filesystems store decomposed names), and case is folded unless matching is case-sensitive.
+type PathNormalizer struct {
+	caseSensitive bool
+	encoding      string
+	decoder       *encoding.Decoder
+}
+
+// Creates a normalizer for the given encoding of non-UTF-8 names: auto, utf8, latin1 or shiftjis.
+// In auto mode, names that are valid UTF-8 are assumed to be UTF-8 and others to be Latin-1.
+func NewPathNormalizer(caseSensitive bool, encodingName string) (*PathNormalizer, error) {
+	normalizer := &PathNormalizer{caseSensitive: caseSensitive, encoding: encodingName}
+	switch encodingName {
+	case "auto", "latin1":
+		normalizer.decoder = charmap.ISO8859_1.NewDecoder()
+	case "shiftjis":
+		normalizer.decoder = japanese.ShiftJIS.NewDecoder()
+	case "utf8":
+	default:
+		return nil, fmt.Errorf("unknown encoding %v, expected auto, utf8, latin1 or shiftjis", encodingName)
+	}
+	return normalizer, nil
+}
+
+func (n *PathNormalizer) Normalize(path string) string {
+	if n.decoder != nil && (n.encoding != "auto" || !utf8.ValidString(path)) {
+		if decoded, err := n.decoder.String(path); err == nil {
+			path = decoded
+		} else {
+			slog.Warn("Could not decode file name", logging.PathKey, path, "encoding", n.encoding, logging.Err(err))
+		}
+	}
+	if utf8.ValidString(path) {
+		path = norm.NFC.String(path)
+	}
+	if !n.caseSensitive {
+		path = strings.ToLower(path)
+	}
+	return path
+}
+
+// The set of librarian files present under a depot root, keyed by normalized depot-absolute path.
+// RCS files contribute one entry per revision, as <file>,v/<revision>.
+//
+// A Bloom index keeps a Bloom filter instead of the exact set, which uses far less memory.
+// Paths the filter may contain are confirmed on disk, so it must be built with Walk. The confirmation
+// uses the path as given, so it doesn't apply case folding or encoding conversions.
+type Index struct {
+	files      map[string]bool
+	normalizer *PathNormalizer
+
+	bloom     *bloomFilter
+	bloomSize int
+	depotRoot string
+	// Limits the confirmations on disk as well as the walk
+	throttle *Throttle
+	// Bounds the time of the confirmations on disk as well as of the walk
+	timeouts *FileTimeouts
+	// The depots stored elsewhere than in a directory named after them
+	depots DepotMaps
+	// The paths as found on disk, keyed by normalized path, when tracked
+	diskPaths map[string]string
+	// The sizes of the full file archives found by the walk, keyed by normalized path, when tracked
+	sizes map[string]int64
+	// Confirmations on disk, and how many of them were false positives of the filter
+	rechecks       int
+	falsePositives int
+	// Whether RCS files are added without their revisions, as when read from a manifest
+	wholeRCSFiles bool
+	// The revisions of the last RCS file read for a confirmation
+	rcsFile      string
+	rcsRevisions map[string]bool
+	// The directories and files that couldn't be read, and their position in the list keyed by
+	// normalized depot-absolute path
+	unreadable      []UnreadablePath
+	unreadableIndex map[string]int
+	// The directories that couldn't be read during the current pass of Walk, to walk again
+	failedDirs []walkTarget
+	// Answers the stat calls of files from the listing of their directory, on network filesystems
+	dirs *dirCache
+	// The filter the index was built with by Walk or ReadManifest, and the files it left out
+	filter      *wildcard.Filter
+	filteredOut int
+	// The librarian files stored both as ,v and ,d, or with an uppercase suffix, found by Walk
+	layoutAnomalies []LayoutAnomaly
+}
+
+// A directory to walk, with the depot path it's walked as and the directories to leave out
+type walkTarget struct {
+	dir     string
+	prefix  string
+	skipped map[string]bool
+}
+
+// A directory or file of the depot root that couldn't be read, so that the archives below it can't
+// be told present or missing
+type UnreadablePath struct {
+	// The depot-absolute path, such as //depot/dir
+	Path string
+	// The class of the error, such as permission or stale_handle (see logging.ErrorClass)
+	Class string
+	Error string
+	// How many times the walk tried to read it, more than once with WalkOptions.SubtreeRetries
+	Attempts int `json:",omitempty"`
+}
+
+func NewIndex(normalizer *PathNormalizer) *Index {
+	return &Index{files: make(map[string]bool), normalizer: normalizer}
+}
+
+// Creates an index backed by a Bloom filter sized for the expected number of files
+func NewBloomIndex(normalizer *PathNormalizer, expectedFiles int, falsePositiveRate float64) *Index {
+	return &Index{bloom: newBloomFilter(expectedFiles, falsePositiveRate), normalizer: normalizer}
+}
+
+// Registers a depot-absolute path such as //depot/file.txt,d/1.2.gz
+func (x *Index) Add(path string) {
+	normalized := x.normalizer.Normalize(path)
+	if x.diskPaths != nil {
+		x.diskPaths[normalized] = path
+	}
+	if x.bloom != nil {
+		x.bloom.add(normalized)
+		x.bloomSize++
+	} else {
+		x.files[normalized] = true
+	}
+	slog.Debug("Added to filemap", logging.PathKey, normalized)
+}
+
+func (x *Index) Contains(path string) bool {
+	if i := strings.LastIndex(path, ",v/"); i >= 0 && x.wholeRCSFiles {
+		path = path[:i+2]
+	}
+	normalized := x.normalizer.Normalize(path)
+	if x.bloom == nil {
+		return x.files[normalized]
+	}
+	if !x.bloom.mayContain(normalized) {
+		return false
+	}
+	x.rechecks++
+	if x.existsOnDisk(path) {
+		return true
+	}
+	x.falsePositives++
+	return false
+}
+
+// Keeps the path of the files added from now on as found on disk, for DiskPath. This takes as much
+// memory as an exact index again, so it isn't available with a Bloom index.
+func (x *Index) TrackDiskPaths() error {
+	if x.bloom != nil {
+		return fmt.Errorf("disk paths can't be tracked by a Bloom index")
+	}
+	x.diskPaths = make(map[string]string)
+	return nil
+}
+
+// Returns the path of a file as found on disk, which differs from the given path when the index
+// matches paths case-insensitively or converts their encoding
+func (x *Index) DiskPath(path string) (string, bool) {
+	diskPath, ok := x.diskPaths[x.normalizer.Normalize(path)]
+	return diskPath, ok
+}
+
+// Records the size of the full file archives found by Walk from now on, for Size and the size
+// checks of Verify. Each archive is stat'ed, and the sizes take memory, so this isn't available
+// with a Bloom index.
+func (x *Index) TrackSizes() error {
+	if x.bloom != nil {
+		return fmt.Errorf("sizes can't be tracked by a Bloom index")
+	}
+	x.sizes = make(map[string]int64)
+	return nil
+}
+
+// Returns the size of a full file archive as found by Walk, when sizes are tracked
+func (x *Index) Size(path string) (int64, bool) {
+	size, ok := x.sizes[x.normalizer.Normalize(path)]
+	return size, ok
+}
+
+// Returns the number of files in the index
+func (x *Index) Len() int {
+	if x.bloom != nil {
+		return x.bloomSize
+	}
+	return len(x.files)
+}
+
+// Records a path that couldn't be read. Paths that no longer exist, such as files deleted during the
+// walk, are simply absent.
+func (x *Index) markUnreadable(path string, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Debug("Vanished during the scan", logging.PathKey, path, logging.Err(err))
+		return
+	}
+	slog.Warn("Could not read, the archives below are unverifiable", logging.PathKey, path, logging.Err(err))
+	if x.unreadableIndex == nil {
+		x.unreadableIndex = make(map[string]int)
+	}
+	normalized := x.normalizer.Normalize(path)
+	if _, ok := x.unreadableIndex[normalized]; ok {
+		return
+	}
+	x.unreadableIndex[normalized] = len(x.unreadable)
+	x.unreadable = append(x.unreadable, UnreadablePath{Path: path, Class: logging.ErrorClass(err), Error: err.Error(), Attempts: 1})
+}
+
+// Records a directory that couldn't be read, to walk it again with WalkOptions.SubtreeRetries.
+// Walking again a file that couldn't be read adds it like any other.
+func (x *Index) markUnreadableDir(target walkTarget, err error) {
+	path := "//" + target.prefix
+	normalized := x.normalizer.Normalize(path)
+	if _, ok := x.unreadableIndex[normalized]; ok {
+		return
+	}
+	x.markUnreadable(path, err)
+	if _, ok := x.unreadableIndex[normalized]; ok {
+		x.failedDirs = append(x.failedDirs, target)
+	}
+}
+
+// Forgets a directory that couldn't be read, and the paths below it, before walking it again.
+// Returns how many times it was tried.
+func (x *Index) clearUnreadable(path string) int {
+	normalized := x.normalizer.Normalize(path)
+	attempts := 0
+	kept := x.unreadable[:0]
+	x.unreadableIndex = make(map[string]int)
+	for _, unreadable := range x.unreadable {
+		unreadableNormalized := x.normalizer.Normalize(unreadable.Path)
+		if unreadableNormalized == normalized {
+			attempts = unreadable.Attempts
+			continue
+		}
+		if strings.HasPrefix(unreadableNormalized, normalized+"/") {
+			continue
+		}
+		x.unreadableIndex[unreadableNormalized] = len(kept)
+		kept = append(kept, unreadable)
+	}
+	x.unreadable = kept
+	return attempts
+}
+
+// Returns the directories and files that couldn't be read
+func (x *Index) Unreadable() []UnreadablePath {
+	return x.unreadable
+}
+
+// Returns the number of directories and files that couldn't be read as reading them timed out
+func (x *Index) TimedOut() int {
+	count := 0
+	for _, unreadable := range x.unreadable {
+		if unreadable.Class == logging.TimeoutError {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns the unreadable directory or file a depot-absolute path is in, if any: its absence from the
+// index doesn't mean it's missing
+func (x *Index) Unverifiable(path string) (UnreadablePath, bool) {
+	if len(x.unreadable) == 0 {
+		return UnreadablePath{}, false
+	}
+	normalized := x.normalizer.Normalize(path)
+	for {
+		if i, ok := x.unreadableIndex[normalized]; ok {
+			return x.unreadable[i], true
+		}
+		slash := strings.LastIndex(normalized, "/")
+		if slash <= 1 {
+			return UnreadablePath{}, false
+		}
+		normalized = normalized[:slash]
+	}
+}
+
+// Returns the number of paths confirmed on disk by a Bloom index, and how many of them were absent
+func (x *Index) Rechecks() (int, int) {
+	return x.rechecks, x.falsePositives
+}
+
+// Returns the information of a file under the depot root, from the listing of its directory on
+// network filesystems
+func (x *Index) statFile(path string) (fs.FileInfo, error) {
+	if x.dirs != nil {
+		return x.dirs.stat(path)
+	}
+	return x.timeouts.stat(path)
+}
+
+// Returns the number of directories listed to answer the stat calls of their files, on network
+// filesystems
+func (x *Index) DirListings() int {
+	if x.dirs == nil {
+		return 0
+	}
+	return x.dirs.listings
+}
+
+// Checks a depot-absolute path under the depot root, reading the revisions of RCS files
+func (x *Index) existsOnDisk(path string) bool {
+	if i := strings.LastIndex(path, ",v/"); i >= 0 {
+		rcsFile := x.depots.Path(x.depotRoot, path[:i+2])
+		if rcsFile != x.rcsFile {
+			x.rcsFile = rcsFile
+			x.rcsRevisions = make(map[string]bool)
+			x.throttle.waitEntry()
+			err := readRCSRevisions(rcsFile, x.throttle, x.timeouts, func(revision string) { x.rcsRevisions[revision] = true })
+			if err != nil {
+				x.markUnreadable(path[:i+2], err)
+			}
+		}
+		return x.rcsRevisions[path[i+3:]]
+	}
+	x.throttle.waitEntry()
+	_, err := x.statFile(x.depots.Path(x.depotRoot, path))
+	if err != nil {
+		x.markUnreadable(path, err)
+	}
+	return err == nil
+}
+
+// Checks whether a librarian file revision is present, compressed or not.
+// Returns the path of the revision relative to the depot root.
+func (x *Index) HasRevision(lbrFile string, lbrRev string, lbrType int) (string, bool) {
+	versionedFilePath := VersionedFilePath(lbrFile, lbrRev, lbrType)
+	return versionedFilePath, x.Contains(versionedFilePath) || x.Contains(versionedFilePath+".gz")
+}
+
+// Scans an RCS file for revisions, on the trunk or on branches, and calls fn for each of them
+func ReadRCSRevisions(filePath string, fn func(revision string)) error {
+	return readRCSRevisions(filePath, nil, nil, fn)
+}
+
+func readRCSRevisions(filePath string, throttle *Throttle, timeouts *FileTimeouts, fn func(revision string)) error {
+	file, err := timeouts.open(filePath)
+	if err != nil {
+		return fmt.Errorf("error opening RCS file %v: %w", filePath, err)
+	}
+	defer file.Close()
+
+	// Each deltatext is the revision number, "log" and its string, newphrases, then "text" and its
+	// string. Only deltatexts that are complete are reported; a truncated file isn't an error.
+	scanner := &rcsScanner{reader: bufio.NewReader(throttle.reader(timeouts.reader(filePath, file)))}
+	var previous, pending string
+	for {
+		token, err := scanner.next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading RCS file %v: %w", filePath, err)
+		}
+		switch {
+		case token == "log" && isRCSNumber(previous):
+			pending = previous
+		case token == rcsString && previous == "text" && len(pending) > 0:
+			fn(pending)
+			pending = ""
+		}
+		previous = token
+	}
+
+	return nil
+}
+
+// Returned by rcsScanner.next for a string, whose content is skipped
+const rcsString = "@"
+
+// Splits an RCS file into words, separators and @strings@ like the rcs package, but streams the
+// file and skips the strings, as the log messages and revision texts can be arbitrarily long
+type rcsScanner struct {
+	reader *bufio.Reader
+	word   []byte
+}
+
+func isRCSSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isRCSSeparator(c byte) bool {
+	return c == ';' || c == ':' || c == '@'
+}
+
+// Revision numbers start with a digit, on the trunk (1.2) or on a branch (1.2.1.3)
+func isRCSNumber(word string) bool {
+	return len(word) > 0 && word[0] >= '0' && word[0] <= '9'
+}
+
+// Returns the next word or separator, or rcsString. Returns io.ErrUnexpectedEOF for a string
+// that isn't terminated.
+func (s *rcsScanner) next() (string, error) {
+	c, err := s.reader.ReadByte()
+	for err == nil && isRCSSpace(c) {
+		c, err = s.reader.ReadByte()
+	}
+	if err != nil {
+		return "", err
+	}
+	switch c {
+	case ';', ':':
+		return string(c), nil
+	case '@':
+		return rcsString, s.skipString()
+	}
+
+	s.word = append(s.word[:0], c)
+	for {
+		c, err := s.reader.ReadByte()
+		if err == io.EOF {
+			return string(s.word), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if isRCSSpace(c) || isRCSSeparator(c) {
+			s.reader.UnreadByte()
+			return string(s.word), nil
+		}
+		s.word = append(s.word, c)
+	}
+}
+
+// Skips the rest of a string, which ends at a single @; @@ stands for @
+func (s *rcsScanner) skipString() error {
+	for {
+		_, err := s.reader.ReadSlice('@')
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		c, err := s.reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if c != '@' {
+			s.reader.UnreadByte()
+			return nil
+		}
+	}
+}
+
+// Controls how Walk treats symbolic links and mount points
+type WalkOptions struct {
+	// Follow symbolic links to directories, for example ,d directories moved to another volume
+	FollowSymlinks bool
+	// Don't descend into directories on another filesystem than the depot root (mounts)
+	OneFilesystem bool
+	// Only scan the top-level directories of this shard
+	Shard Shard
+	// Limits the rate of directory entries and RCS file bytes read (no limit when nil)
+	Throttle *Throttle
+	// Bounds the time of the stat and read calls, so that a hung mount only leaves the directories
+	// and files it holds unreadable (no timeout when nil)
+	Timeouts *FileTimeouts
+	// The depots stored elsewhere than in a directory named after them, from db.depot
+	Depots DepotMaps
+	// Depots whose directories aren't scanned, such as graph depots holding git objects
+	SkipDepots map[string]bool
+	// Called for each archive file found, such as to report progress
+	OnFile func(path string)
+	// Directories that couldn't be read are walked again this many times once the rest of the walk
+	// is complete, such as after a transient NFS error, and the files found added to the index.
+	// The ones still unreadable are left in Unreadable, with the number of attempts.
+	SubtreeRetries int
+	// The wait before each retry of the unreadable directories
+	RetryDelay time.Duration
+	// The depot root is on a network filesystem (NFS, SMB): the files whose existence or size is
+	// checked one by one, such as the confirmations of a Bloom index, are looked up in the listing
+	// of their directory, read once, rather than with a stat call each
+	NetworkFS bool
+}
+
+// Converts a path under a walked directory to a depot-absolute path:
+// 1. Strip the walked directory from osPathname
+// 2. Ensure backslashes are converted to forward slashes - Perforce depot paths always use forward slashes
+// 3. Prefix with the depot path of the walked directory, empty for the depot root
+// 4. Trim any leading or trailing slashes, and prefix with // to make the path depot-absolute
+func depotAbsolutePath(walkRoot string, prefix string, osPathname string) string {
+	relativePath := strings.Trim(strings.ReplaceAll(strings.Replace(osPathname, walkRoot, "", 1), "\\", "/"), "/")
+	return "//" + strings.Trim(prefix+"/"+relativePath, "/")
+}
+
+// Returns the librarian file an archive belongs to, from its depot-absolute path:
+// //depot/file.txt for //depot/file.txt,v and //depot/file.txt,d/1.2.gz
+func librarianFile(path string) string {
+	if i := strings.LastIndex(path, ",d/"); i >= 0 {
+		return path[:i]
+	}
+	return strings.TrimSuffix(path, ",v")
+}
+
+// Adds all versioned files under a depot root to the index, optionally scoping the scan to the
+// librarian files selected by filter. Only the directories that may hold them are scanned.
+// Depots remapped by WalkOptions.Depots are scanned from their own directory, which may be outside
+// the depot root, and the directories named after them under the depot root are skipped.
+// The directories of WalkOptions.SkipDepots aren't scanned at all.
+// Directories reached twice (through symbolic links or bind mounts) are only scanned once,
+// which also breaks cycles. The walk stops with the error of ctx once it's done.
+func (x *Index) Walk(ctx context.Context, depotRoot string, filter *wildcard.Filter, options WalkOptions) error {
+	x.depotRoot = depotRoot
+	x.depots = options.Depots
+	x.throttle = options.Throttle
+	x.timeouts = options.Timeouts
+	x.failedDirs = nil
+	x.dirs = nil
+	x.filter = filter
+	if options.NetworkFS {
+		x.dirs = newDirCache(options.Timeouts)
+	}
+	visited := make(map[fileID]string)
+
+	if err := x.walkAll(ctx, depotRoot, visited, filter, options); err != nil {
+		return err
+	}
+	return x.retryFailedDirs(ctx, visited, filter, options)
+}
+
+// Walks the unreadable directories again, as many times as WalkOptions.SubtreeRetries allows
+func (x *Index) retryFailedDirs(ctx context.Context, visited map[fileID]string, filter *wildcard.Filter, options WalkOptions) error {
+	for attempt := 1; attempt <= options.SubtreeRetries && len(x.failedDirs) > 0; attempt++ {
+		targets := x.failedDirs
+		x.failedDirs = nil
+		slog.Info("Retrying unreadable directories", logging.CountKey, len(targets), "attempt", attempt)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(options.RetryDelay):
+		}
+		for _, target := range targets {
+			path := "//" + target.prefix
+			attempts := x.clearUnreadable(path)
+			// The directory was recorded as visited before it failed to be read
+			if info, err := x.timeouts.stat(target.dir); err == nil {
+				if id, ok := getFileID(info); ok {
+					delete(visited, id)
+				}
+			}
+			failed := len(x.failedDirs)
+			if err := x.walk(ctx, target.dir, target.prefix, target.skipped, visited, filter, options); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				x.markUnreadableDir(target, err)
+			}
+			if i, ok := x.unreadableIndex[x.normalizer.Normalize(path)]; ok {
+				x.unreadable[i].Attempts = attempts + 1
+			} else if len(x.failedDirs) == failed {
+				slog.Info("Read directory on retry", logging.PathKey, path, "attempt", attempt)
+			}
+		}
+	}
+	return nil
+}
+
+// Walks the depot root, or the roots of filter, and the directories of the remapped depots
+func (x *Index) walkAll(ctx context.Context, depotRoot string, visited map[fileID]string, filter *wildcard.Filter, options WalkOptions) error {
+	if roots := filter.Roots(); roots != nil {
+		for _, root := range roots {
+			if options.SkipDepots[lbr.DepotName(root)] {
+				continue
+			}
+			target := walkTarget{dir: options.Depots.Path(depotRoot, root), prefix: strings.Trim(root, "/")}
+			if _, err := x.timeouts.stat(target.dir); err != nil {
+				// A case-insensitive filter selects the root spelled in another case on disk as well,
+				// which the verification reads the records of
+				dir, found := "", false
+				if filter.CaseInsensitive() {
+					dir, found = x.findDirFold(target.dir)
+				}
+				if !found {
+					x.markUnreadableDir(target, err)
+					continue
+				}
+				slog.Debug("Found filter root in another case", "root", root, logging.PathKey, dir)
+				target.dir = dir
+			}
+			if err := x.walk(ctx, target.dir, target.prefix, nil, visited, filter, options); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	skipped := make(map[string]bool)
+	for depot := range options.SkipDepots {
+		skipped[filepath.Join(depotRoot, depot)] = true
+		skipped[options.Depots.Dir(depotRoot, depot)] = true
+	}
+	depots := make([]string, 0, len(options.Depots))
+	for depot := range options.Depots {
+		skipped[filepath.Join(depotRoot, depot)] = true
+		skipped[options.Depots.Dir(depotRoot, depot)] = true
+		if !options.SkipDepots[depot] {
+			depots = append(depots, depot)
+		}
+	}
+	if err := x.walk(ctx, depotRoot, "", skipped, visited, filter, options); err != nil {
+		return err
+	}
+	sort.Strings(depots)
+	for _, depot := range depots {
+		dir := options.Depots.Dir(depotRoot, depot)
+		if _, err := x.timeouts.stat(dir); err != nil {
+			slog.Warn("Could not read the archive directory of a remapped depot", "depot", depot, logging.PathKey, dir)
+			x.markUnreadableDir(walkTarget{dir: dir, prefix: depot}, err)
+			continue
+		}
+		slog.Debug("Scanning remapped depot", "depot", depot, logging.PathKey, dir)
+		if err := x.walk(ctx, dir, depot, nil, visited, filter, options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Looks a directory up regardless of the case of its name and of the names of its missing parents,
+// returning the first spelling found on disk
+func (x *Index) findDirFold(path string) (string, bool) {
+	parent, name := filepath.Dir(path), filepath.Base(path)
+	if parent == path {
+		return "", false
+	}
+	if _, err := x.timeouts.stat(parent); err != nil {
+		var found bool
+		if parent, found = x.findDirFold(parent); !found {
+			return "", false
+		}
+	}
+	entries, err := x.timeouts.readDir(parent)
+	if err != nil {
+		return "", false
+	}
+	for _, entry := range entries {
+		if strings.EqualFold(entry.Name(), name) {
+			return filepath.Join(parent, entry.Name()), true
+		}
+	}
+	return "", false
+}
+
+// Returns the number of files found by Walk or listed in the manifest that the filter left out.
+// The files of the directories the filter skips entirely aren't counted.
+func (x *Index) FilteredOut() int {
+	return x.filteredOut
+}
+
+// Adds the versioned files under rootPath, whose depot path is prefix, to the index.
+// Directories in skipped are left out, as well as the archives of librarian files filter doesn't select.
+func (x *Index) walk(ctx context.Context, rootPath string, prefix string, skipped map[string]bool, visited map[fileID]string,
+	filter *wildcard.Filter, options WalkOptions) error {
+	rootInfo, err := x.timeouts.stat(rootPath)
+	if err != nil {
+		return err
+	}
+	rootID, _ := getFileID(rootInfo)
+	layout := make(layoutTracker)
+
+	return godirwalk.Walk(rootPath, &godirwalk.Options{
+		Callback: func(osPathname string, de *godirwalk.Dirent) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			options.Throttle.waitEntry()
+			isDir, err := de.IsDirOrSymlinkToDir()
+			if err != nil {
+				// Such as a symbolic link to an unreadable directory, whose archives can't be verified
+				x.markUnreadable(depotAbsolutePath(rootPath, prefix, osPathname), err)
+				return nil
+			}
+			if isDir {
+				if skipped[osPathname] {
+					return godirwalk.SkipThis
+				}
+				depotPath := depotAbsolutePath(rootPath, prefix, osPathname)
+				// Depot directories are shared, their top-level directories are split between shards
+				if strings.Count(depotPath, "/") == 3 && !options.Shard.contains(x.normalizer, depotPath) {
+					return godirwalk.SkipThis
+				}
+				if filter.SkipsDir(depotPath) {
+					return godirwalk.SkipThis
+				}
+				if de.IsSymlink() && !options.FollowSymlinks {
+					slog.Warn("Not following symbolic link to directory", logging.PathKey, osPathname)
+					return nil
+				}
+				// Checked before the directory is read, so that a hung directory is skipped
+				info, err := x.timeouts.stat(osPathname)
+				if err != nil {
+					return err
+				}
+				id, ok := getFileID(info)
+				if !ok {
+					return nil
+				}
+				if options.OneFilesystem && id.device != rootID.device {
+					slog.Warn("Skipping directory on another filesystem", logging.PathKey, osPathname)
+					return godirwalk.SkipThis
+				}
+				if previous, seen := visited[id]; seen {
+					slog.Warn("Skipping directory already scanned", logging.PathKey, osPathname, "scanned_as", previous)
+					return godirwalk.SkipThis
+				}
+				visited[id] = osPathname
+				x.checkLayout(layout, osPathname, depotPath)
+				return nil
+			}
+			normalizedPath := depotAbsolutePath(rootPath, prefix, osPathname)
+			if strings.Count(normalizedPath, "/") <= 3 && !options.Shard.contains(x.normalizer, normalizedPath) {
+				return nil
+			}
+			if !filter.Match(librarianFile(normalizedPath)) {
+				x.filteredOut++
+				return nil
+			}
+			x.checkLayout(layout, osPathname, normalizedPath)
+			if strings.HasSuffix(normalizedPath, ",v") {
+				err := readRCSRevisions(osPathname, options.Throttle, options.Timeouts, func(revision string) { x.Add(normalizedPath + "/" + revision) })
+				if err != nil {
+					x.markUnreadable(normalizedPath, err)
+				}
+			} else {
+				x.Add(normalizedPath)
+				if x.sizes != nil {
+					// Files removed since they were listed are kept without a size
+					if info, err := x.statFile(osPathname); err == nil {
+						x.sizes[x.normalizer.Normalize(normalizedPath)] = info.Size()
+					}
+				}
+			}
+			if options.OnFile != nil {
+				options.OnFile(normalizedPath)
+			}
+			return nil
+		},
+		// Unreadable directories and files are recorded and skipped rather than stopping the walk,
+		// so that only the archives below them are unverifiable
+		ErrorCallback: func(osPathname string, err error) godirwalk.ErrorAction {
+			if ctx.Err() != nil {
+				return godirwalk.Halt
+			}
+			depotPath := depotAbsolutePath(rootPath, prefix, osPathname)
+			x.markUnreadableDir(walkTarget{dir: osPathname, prefix: strings.Trim(depotPath, "/"), skipped: skipped}, err)
+			return godirwalk.SkipNode
+		},
+		PostChildrenCallback: func(osPathname string, de *godirwalk.Dirent) error {
+			delete(layout, osPathname)
+			return nil
+		},
+		FollowSymbolicLinks: options.FollowSymlinks,
+		Unsorted:            true, // we don't need sorting and this is faster
+	})
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/wildcard"
+)
+
+// An RCS archive holding revisions 1.1 and 1.2, as p4d writes them for text files
+const readmeRCS = `head	1.2;
+access;
+symbols;
+locks; strict;
+comment	@# @;
+
+
+1.2
+date	2021.01.18.22.14.00;	author p4;	state Exp;
+branches;
+next	1.1;
+
+1.1
+date	2021.01.18.22.13.58;	author p4;	state Exp;
+branches;
+next	;
+
+
+desc
+@@
+
+
+1.2
+log
+@@
+text
+@Hello, world!
+@
+
+
+1.1
+log
+@@
+text
+@d1 1
+a1 1
+Hello
+@
+`
+
+// Creates a depot root holding some of the archives of the example checkpoint: data1.dat only has
+// revision 1.1, and the archive of //depot/path2/More.txt is missing
+func writeDepotRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	files := map[string]string{
+		"depot/path1/data1.dat,d/1.1.gz": "compressed",
+		"depot/path1/data2.dat,d/1.1.gz": "compressed",
+		"depot/path1/README.txt,v":       readmeRCS,
+	}
+	for path, content := range files {
+		path = filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func walkDepotRoot(t *testing.T, root string, filter *wildcard.Filter) *Index {
+	t.Helper()
+	normalizer, err := NewPathNormalizer(true, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := NewIndex(normalizer)
+	if err := index.Walk(context.Background(), root, filter, WalkOptions{}); err != nil {
+		t.Fatalf("Walk() returned %v", err)
+	}
+	return index
+}
+
+func TestWalk(t *testing.T) {
+	index := walkDepotRoot(t, writeDepotRoot(t), nil)
+	tests := []struct {
+		lbrFile string
+		lbrRev  string
+		lbrType int
+		want    bool
+	}{
+		{"//depot/path1/data1.dat", "1.1", 65539, true},
+		{"//depot/path1/data1.dat", "1.2", 65539, false},
+		{"//depot/path1/data2.dat", "1.1", 65539, true},
+		{"//depot/path1/README.txt", "1.1", 0, true},
+		{"//depot/path1/README.txt", "1.2", 0, true},
+		{"//depot/path1/README.txt", "1.3", 0, false},
+		{"//depot/path2/More.txt", "1.3", 0, false},
+	}
+	for _, test := range tests {
+		if _, got := index.HasRevision(test.lbrFile, test.lbrRev, test.lbrType); got != test.want {
+			t.Errorf("HasRevision(%v, %v) = %v, want %v", test.lbrFile, test.lbrRev, got, test.want)
+		}
+	}
+	if unreadable := index.Unreadable(); len(unreadable) > 0 {
+		t.Errorf("Walk() left unreadable paths %v", unreadable)
+	}
+}
+
+func TestWalkFilter(t *testing.T) {
+	filter, err := wildcard.NewFilter([]string{"//depot/.../README.txt"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := walkDepotRoot(t, writeDepotRoot(t), filter)
+	if _, ok := index.HasRevision("//depot/path1/README.txt", "1.2", 0); !ok {
+		t.Errorf("HasRevision() of a file selected by the filter = false, want true")
+	}
+	if _, ok := index.HasRevision("//depot/path1/data1.dat", "1.1", 65539); ok {
+		t.Errorf("HasRevision() of a file left out by the filter = true, want false")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	root := writeDepotRoot(t)
+	checkpoint := exampleCheckpoint(t)
+	var missing []string
+	result, err := Verify(context.Background(), bytes.NewReader(checkpoint), walkDepotRoot(t, root, nil), Options{
+		OnMissing: func(path string, record journal.Record) { missing = append(missing, path) },
+	})
+	if err != nil {
+		t.Fatalf("Verify() returned %v", err)
+	}
+	sort.Strings(missing)
+	want := []string{"//depot/path1/data1.dat,d/1.2", "//depot/path2/More.txt,v/1.3"}
+	if !reflect.DeepEqual(missing, want) {
+		t.Errorf("Verify() reported %v missing, want %v", missing, want)
+	}
+	if result.Processed != 6 || result.Missing != 2 || result.ByDepot["depot"].Missing != 2 {
+		t.Errorf("Verify() counted %v processed and %v missing, want 6 and 2", result.Processed, result.Missing)
+	}
+	if result.LastLine == 0 || result.Records["db.storage"] != 6 {
+		t.Errorf("Verify() read %v db.storage records up to line %v, want 6", result.Records["db.storage"], result.LastLine)
+	}
+}
+
+func TestVerifyRevTable(t *testing.T) {
+	root := writeDepotRoot(t)
+	checkpoint := exampleCheckpoint(t)
+	result, err := Verify(context.Background(), bytes.NewReader(checkpoint), walkDepotRoot(t, root, nil), Options{Table: RevTable})
+	if err != nil {
+		t.Fatalf("Verify() returned %v", err)
+	}
+	if result.Processed == 0 || result.Missing == 0 || result.Missing >= result.Processed {
+		t.Errorf("Verify() of db.rev counted %v processed and %v missing", result.Processed, result.Missing)
+	}
+	if _, err := Verify(context.Background(), bytes.NewReader(checkpoint), walkDepotRoot(t, root, nil), Options{Table: "have"}); err == nil {
+		t.Errorf("Verify() of an unknown table returned no error")
+	}
+}
+
+func TestVerifyMaxMissing(t *testing.T) {
+	checkpoint := exampleCheckpoint(t)
+	result, err := Verify(context.Background(), bytes.NewReader(checkpoint), walkDepotRoot(t, t.TempDir(), nil), Options{MaxMissing: 2})
+	if err != ErrMaxMissing || result.Missing != 2 {
+		t.Errorf("Verify() returned %v with %v missing, want ErrMaxMissing with 2", err, result.Missing)
+	}
+}
+
+func TestReadRCSRevisions(t *testing.T) {
+	root := writeDepotRoot(t)
+	var revisions []string
+	err := ReadRCSRevisions(filepath.Join(root, "depot", "path1", "README.txt,v"), func(revision string) {
+		revisions = append(revisions, revision)
+	})
+	if err != nil {
+		t.Fatalf("ReadRCSRevisions() returned %v", err)
+	}
+	if want := []string{"1.2", "1.1"}; !reflect.DeepEqual(revisions, want) {
+		t.Errorf("ReadRCSRevisions() = %v, want %v", revisions, want)
+	}
+}
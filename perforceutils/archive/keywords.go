@@ -0,0 +1,63 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// The keyword expansion bits of the file types of db.rev, see
+// https://www.perforce.com/perforce/doc.current/schema/#FileType
+const KeywordTypeMask = 0x30
+
+// Reports whether files of a db.rev file type have their RCS keywords expanded (+k and +ko)
+func HasKeywords(fileType int) bool {
+	return fileType&KeywordTypeMask != 0
+}
+
+// An expanded keyword such as "$Change: 1234 $". Keywords don't span lines.
+var expandedKeywordPattern = regexp.MustCompile(
+	`\$(Id|Header|Author|Date|DateUTC|DateTime|DateTimeUTC|DateTimeTZ|Change|File|Revision):[^$\n]*\$`)
+
+// Returns a content with its expanded RCS keywords collapsed, "$Id: //depot/main.c#3 $" becoming
+// "$Id$", which is how p4d stores and hashes the content of +k files
+func CollapseKeywords(content []byte) []byte {
+	return expandedKeywordPattern.ReplaceAll(content, []byte("$$$1$$"))
+}
+
+// Computes the MD5 digest of a content with its keywords collapsed, as "p4 verify" does for the
+// revisions of +k files (uppercase hexadecimal). The content is read line by line.
+func KeywordDigest(r io.Reader) (string, error) {
+	hash := md5.New()
+	reader := bufio.NewReaderSize(r, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		hash.Write(CollapseKeywords(line))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.ToUpper(hex.EncodeToString(hash.Sum(nil))), nil
+}
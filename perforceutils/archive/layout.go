@@ -0,0 +1,96 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The kinds of LayoutAnomaly
+const (
+	// A librarian file stored both as an RCS file (file,v) and as a directory of full files (file,d),
+	// as left by some conversions: p4d only reads the one of the storage type of each revision
+	MixedLayoutAnomaly = "rcs_and_full"
+	// A file,V file or file,D directory, which p4d doesn't find when case-sensitive: it only writes
+	// lowercase suffixes. Only reported by case-sensitive indexes.
+	UppercaseSuffixAnomaly = "uppercase_suffix"
+)
+
+// An archive layout found by Walk that confuses the librarian of p4d
+type LayoutAnomaly struct {
+	// The depot-absolute path of the librarian file, such as //depot/file.txt
+	Path string
+	// MixedLayoutAnomaly or UppercaseSuffixAnomaly
+	Kind string
+	// The depot-absolute paths found on disk, such as //depot/file.txt,v and //depot/file.txt,d
+	Found []string
+}
+
+// The ,v files and ,d directories seen in the directories being walked, keyed by directory and
+// by the normalized path of their librarian file. Both forms of a librarian file are in the same
+// directory, so a directory is forgotten once its children have been walked.
+type layoutTracker map[string]map[string]string
+
+// Returns the suffix of a ,v file or ,d directory as found on disk, or an empty string
+func layoutSuffix(name string) string {
+	if len(name) < 2 {
+		return ""
+	}
+	suffix := name[len(name)-2:]
+	if strings.EqualFold(suffix, ",v") || strings.EqualFold(suffix, ",d") {
+		return suffix
+	}
+	return ""
+}
+
+// Records a ,v file or ,d directory found by the walk, and the anomalies of its layout
+func (x *Index) checkLayout(tracker layoutTracker, osPathname string, depotPath string) {
+	suffix := layoutSuffix(depotPath)
+	if len(suffix) == 0 {
+		return
+	}
+	lbrFile := depotPath[:len(depotPath)-len(suffix)]
+	if suffix != strings.ToLower(suffix) && x.normalizer.caseSensitive {
+		x.layoutAnomalies = append(x.layoutAnomalies, LayoutAnomaly{Path: lbrFile, Kind: UppercaseSuffixAnomaly,
+			Found: []string{depotPath}})
+	}
+
+	dir := filepath.Dir(osPathname)
+	siblings, ok := tracker[dir]
+	if !ok {
+		siblings = make(map[string]string)
+		tracker[dir] = siblings
+	}
+	key := x.normalizer.Normalize(lbrFile)
+	other, ok := siblings[key]
+	if !ok {
+		siblings[key] = depotPath
+		return
+	}
+	if !strings.EqualFold(layoutSuffix(other), suffix) {
+		found := []string{other, depotPath}
+		sort.Strings(found)
+		x.layoutAnomalies = append(x.layoutAnomalies, LayoutAnomaly{Path: lbrFile, Kind: MixedLayoutAnomaly, Found: found})
+	}
+}
+
+// Returns the layout anomalies found by Walk, in the order found
+func (x *Index) LayoutAnomalies() []LayoutAnomaly {
+	return x.layoutAnomalies
+}
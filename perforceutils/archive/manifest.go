@@ -0,0 +1,160 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/lbr"
+	"github.com/google/perforce-utils/perforceutils/wildcard"
+)
+
+// The formats of the file listings read by ReadManifest
+const (
+	// One path per line, as written by find -printf '%P\n'. Anything after a tab is ignored, so that
+	// listings with sizes or dates (find -printf '%P\t%s\n') can be read too.
+	FindManifest = "find"
+	// An Amazon S3 inventory report in CSV, whose second column is the URL-encoded object key
+	S3InventoryManifest = "s3"
+)
+
+// Controls how ReadManifest maps the paths of a listing to depot paths
+type ManifestOptions struct {
+	// FindManifest (the default) or S3InventoryManifest
+	Format string
+	// Stripped from the paths of the listing to make them relative to the depot root, such as the
+	// depot root itself for absolute paths, or the key prefix of the backup in the bucket
+	Prefix string
+	// Only the top-level directories of this shard are read
+	Shard Shard
+	// The depots stored elsewhere than in a directory named after them, from db.depot. Their paths
+	// are matched as listed in db.depot, relative to the depot root or absolute.
+	Depots DepotMaps
+	// Depots whose files aren't read, such as graph depots holding git objects
+	SkipDepots map[string]bool
+}
+
+// Maps the paths of a listing to depot-absolute paths, through the depot directories
+type manifestMapper struct {
+	prefix string
+	// The directories of the remapped depots, longest first so that nested directories match first
+	dirs   []string
+	depots map[string]string
+}
+
+func newManifestMapper(options ManifestOptions) *manifestMapper {
+	m := &manifestMapper{prefix: filepath.ToSlash(options.Prefix), depots: make(map[string]string)}
+	for depot, dir := range options.Depots {
+		dir = strings.TrimSuffix(filepath.ToSlash(dir), "/")
+		m.dirs = append(m.dirs, dir)
+		m.depots[dir] = depot
+	}
+	sort.Slice(m.dirs, func(i, j int) bool { return len(m.dirs[i]) > len(m.dirs[j]) })
+	return m
+}
+
+// Returns the depot-absolute path of a listed file, such as //depot/file.txt,d/1.2.gz
+func (m *manifestMapper) depotPath(path string) string {
+	path = filepath.ToSlash(path)
+	for _, dir := range m.dirs {
+		if strings.HasPrefix(path, dir+"/") {
+			return "//" + m.depots[dir] + path[len(dir):]
+		}
+	}
+	path = strings.TrimPrefix(path, m.prefix)
+	for _, dir := range m.dirs {
+		if strings.HasPrefix(path, dir+"/") {
+			return "//" + m.depots[dir] + path[len(dir):]
+		}
+	}
+	return "//" + strings.TrimLeft(strings.TrimPrefix(path, "./"), "/")
+}
+
+// Adds the versioned files of a listing of the depot root to the index, instead of walking it, so
+// that backups and object store copies can be verified without access to the files. Only the
+// librarian files selected by filter are added.
+// RCS files can't be read from a listing: all the revisions of a listed RCS file count as present.
+// Reading stops with the error of ctx once it's done.
+func (x *Index) ReadManifest(ctx context.Context, r io.Reader, filter *wildcard.Filter, options ManifestOptions) error {
+	if x.bloom != nil {
+		return fmt.Errorf("a Bloom index confirms files on disk and can't be built from a manifest")
+	}
+	x.wholeRCSFiles = true
+	x.filter = filter
+	mapper := newManifestMapper(options)
+	add := func(path string) {
+		if len(path) == 0 {
+			return
+		}
+		depotPath := mapper.depotPath(path)
+		if options.SkipDepots[lbr.DepotName(depotPath)] || !options.Shard.contains(x.normalizer, depotPath) {
+			return
+		}
+		if !filter.Match(librarianFile(depotPath)) {
+			x.filteredOut++
+			return
+		}
+		x.Add(depotPath)
+	}
+
+	switch options.Format {
+	case "", FindManifest:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			path, _, _ := strings.Cut(strings.TrimSuffix(scanner.Text(), "\r"), "\t")
+			add(path)
+		}
+		return scanner.Err()
+	case S3InventoryManifest:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			row, err := reader.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if len(row) < 2 {
+				line, _ := reader.FieldPos(0)
+				return fmt.Errorf("line %v of the S3 inventory has no key column", line)
+			}
+			key, err := url.QueryUnescape(row[1])
+			if err != nil {
+				return fmt.Errorf("invalid key %q in the S3 inventory: %v", row[1], err)
+			}
+			add(key)
+		}
+	}
+	return fmt.Errorf("unknown manifest format %q, expected %v or %v", options.Format, FindManifest, S3InventoryManifest)
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Locks the calling goroutine to its thread and restricts the thread to a CPU, with
+// sched_setaffinity(2)
+func pinThread(cpu int) error {
+	runtime.LockOSThread()
+	mask := make([]uint64, cpu/64+1)
+	mask[cpu/64] |= 1 << (cpu % 64)
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return fmt.Errorf("error pinning hash worker to CPU %v: %v", cpu, errno)
+	}
+	return nil
+}
+
+// Returns the CPUs of a NUMA node, as listed under /sys
+func NodeCPUs(node int) ([]int, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/sys/devices/system/node/node%d/cpulist", node))
+	if err != nil {
+		return nil, fmt.Errorf("error reading the CPUs of NUMA node %v: %v", node, err)
+	}
+	return ParseCPUList(string(data))
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"errors"
+)
+
+// CPU affinity and NUMA topology are only read and set on Linux
+func pinThread(cpu int) error {
+	return errors.New("pinning hash workers to CPUs is only supported on Linux")
+}
+
+// Returns the CPUs of a NUMA node
+func NodeCPUs(node int) ([]int, error) {
+	return nil, errors.New("NUMA nodes are only supported on Linux")
+}
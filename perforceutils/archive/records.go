@@ -0,0 +1,246 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/google/perforce-utils/perforceutils/lbr"
+)
+
+// https://www.perforce.com/perforce/doc.current/schema/#FileType
+type ServerStorageType = lbr.ServerStorageType
+
+const (
+	RCSStorageType          = lbr.RCSStorageType
+	BinaryStorageType       = lbr.BinaryStorageType
+	TinyStorageType         = lbr.TinyStorageType
+	CompressedStorageType   = lbr.CompressedStorageType
+	TempObjStorageType      = lbr.TempObjStorageType
+	DetectTypeStorageType   = lbr.DetectTypeStorageType
+	CompressedTempObj       = lbr.CompressedTempObj
+	BinaryAccessStorageType = lbr.BinaryAccessStorageType
+	ExternalStorageType     = lbr.ExternalStorageType
+)
+
+// Returns the server storage type of a librarian file type
+func StorageType(lbrType int) ServerStorageType {
+	return lbr.StorageType(lbrType)
+}
+
+// https://www.perforce.com/perforce/doc.current/schema/#FileAction
+type FileAction int
+
+const (
+	AddFileAction       FileAction = 0
+	EditFileAction                 = 1
+	DeleteFileAction               = 2
+	BranchFileAction               = 3
+	IntegrateFileAction            = 4
+	ImportFileAction               = 5
+	PurgeFileAction                = 6
+	MoveFromFileAction             = 7
+	MoveToFileAction               = 8
+	ArchiveFileAction              = 9
+)
+
+// Reports whether revisions with this action have an archive file under the depot root
+func (a FileAction) HasArchive() bool {
+	return a != DeleteFileAction && a != PurgeFileAction && a != ArchiveFileAction
+}
+
+// The fields of the db.rev table, as indexes in journal.Record.Fields.
+// They are documented here: https://www.perforce.com/perforce/doc.current/schema/#db.rev.
+const (
+	DbRevFieldDepotFile = 0
+	DbRevFieldDepotRev  = 1
+	DbRevFieldType      = 2
+	DbRevFieldAction    = 3
+	DbRevFieldChange    = 4
+	DbRevFieldDate      = 5
+	DbRevFieldModTime   = 6
+	DbRevFieldDigest    = 7
+	DbRevFieldSize      = 8
+	DbRevFieldTraitLot  = 9
+	DbRevFieldLbrIsLazy = 10
+	DbRevFieldLbrFile   = 11
+	DbRevFieldLbrRev    = 12
+	DbRevFieldLbrType   = 13
+
+	DbRevFieldCount = 14
+)
+
+// The fields of the db.storage table, as indexes in journal.Record.Fields.
+// They are documented here: https://www.perforce.com/perforce/doc.current/schema/#db.storage.
+const (
+	DbStorageFieldLbrFile    = 0
+	DbStorageFieldLbrRev     = 1
+	DbStorageFieldLbrType    = 2
+	DbStorageFieldRefCount   = 3
+	DbStorageFieldDigest     = 4
+	DbStorageFieldSize       = 5
+	DbStorageFieldServerSize = 6
+	DbStorageFieldCompCksum  = 7
+	DbStorageFieldDate       = 8
+
+	DbStorageFieldCount = 9
+)
+
+// A db.rev record. The librarian fields tell where p4d reads the content from, which differs
+// from the depot file for lazy copies (branches sharing a common archive), remapped depots
+// and revisions whose archive is handled by an archive trigger.
+type RevRecord struct {
+	DepotFile string
+	DepotRev  int
+	Type      int
+	Action    FileAction
+	Change    int
+	Date      int64
+	Digest    string
+	Size      int64
+	TraitLot  int
+	LbrIsLazy bool
+	LbrFile   string
+	LbrRev    string
+	LbrType   int
+}
+
+// A db.storage record, describing one librarian file revision
+type StorageRecord struct {
+	LbrFile    string
+	LbrRev     string
+	LbrType    int
+	RefCount   int
+	Digest     string
+	Size       int64
+	ServerSize int64
+	CompCksum  string
+	Date       int64
+}
+
+// Parses the fields of a db.rev record
+func ParseRevRecord(fields []string) (*RevRecord, error) {
+	if len(fields) < DbRevFieldCount {
+		return nil, fmt.Errorf("expected %v fields, got %v", DbRevFieldCount, len(fields))
+	}
+
+	record := &RevRecord{
+		DepotFile: fields[DbRevFieldDepotFile],
+		Digest:    fields[DbRevFieldDigest],
+		LbrFile:   fields[DbRevFieldLbrFile],
+		LbrRev:    fields[DbRevFieldLbrRev],
+		LbrIsLazy: fields[DbRevFieldLbrIsLazy] != "0",
+	}
+
+	var action int
+	integers := []struct {
+		field int
+		value *int
+	}{
+		{DbRevFieldDepotRev, &record.DepotRev},
+		{DbRevFieldType, &record.Type},
+		{DbRevFieldAction, &action},
+		{DbRevFieldChange, &record.Change},
+		{DbRevFieldTraitLot, &record.TraitLot},
+		{DbRevFieldLbrType, &record.LbrType},
+	}
+	for _, integer := range integers {
+		value, err := strconv.Atoi(fields[integer.field])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse field %v: %v", integer.field, fields[integer.field])
+		}
+		*integer.value = value
+	}
+	record.Action = FileAction(action)
+
+	longs := []struct {
+		field int
+		value *int64
+	}{
+		{DbRevFieldDate, &record.Date},
+		{DbRevFieldSize, &record.Size},
+	}
+	for _, long := range longs {
+		value, err := strconv.ParseInt(fields[long.field], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse field %v: %v", long.field, fields[long.field])
+		}
+		*long.value = value
+	}
+
+	return record, nil
+}
+
+// Parses the fields of a db.storage record
+func ParseStorageRecord(fields []string) (*StorageRecord, error) {
+	if len(fields) < DbStorageFieldCount {
+		return nil, fmt.Errorf("expected %v fields, got %v", DbStorageFieldCount, len(fields))
+	}
+
+	record := &StorageRecord{
+		LbrFile:   fields[DbStorageFieldLbrFile],
+		LbrRev:    fields[DbStorageFieldLbrRev],
+		Digest:    fields[DbStorageFieldDigest],
+		CompCksum: fields[DbStorageFieldCompCksum],
+	}
+
+	var err error
+	if record.LbrType, err = strconv.Atoi(fields[DbStorageFieldLbrType]); err != nil {
+		return nil, fmt.Errorf("could not parse file type: %v", fields[DbStorageFieldLbrType])
+	}
+	if record.RefCount, err = strconv.Atoi(fields[DbStorageFieldRefCount]); err != nil {
+		return nil, fmt.Errorf("could not parse reference count: %v", fields[DbStorageFieldRefCount])
+	}
+
+	longs := []struct {
+		field int
+		value *int64
+	}{
+		{DbStorageFieldSize, &record.Size},
+		{DbStorageFieldServerSize, &record.ServerSize},
+		{DbStorageFieldDate, &record.Date},
+	}
+	for _, long := range longs {
+		value, err := strconv.ParseInt(fields[long.field], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse field %v: %v", long.field, fields[long.field])
+		}
+		*long.value = value
+	}
+
+	return record, nil
+}
+
+// Returns the librarian type a shelved revision is stored as. Shelved files are stored as full
+// files named after the shelving change (file,d/1.<change>.gz), even when their type is stored in
+// RCS files once submitted; p4d only writes RCS deltas on submit.
+func ShelvedStorageType(lbrType int) int {
+	return lbr.ShelvedStorageType(lbrType)
+}
+
+// Returns the path of the archive of a shelved revision, relative to the depot root.
+// Compressed archives may additionally have a .gz suffix.
+func ShelvedFilePath(lbrFile string, lbrRev string, lbrType int) string {
+	return lbr.ShelvedFilePath(lbrFile, lbrRev, lbrType)
+}
+
+// Returns the path of a librarian file revision, relative to the depot root.
+// Compressed revisions may additionally have a .gz suffix.
+func VersionedFilePath(lbrFile string, lbrRev string, lbrType int) string {
+	return lbr.VersionedFilePath(lbrFile, lbrRev, lbrType)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// A part of the depot path space, so that a verification can be spread across machines.
+// Paths are assigned to shards by a hash of their top-level directory (//depot/dir), so that
+// each shard walks whole directory trees and the partition doesn't depend on the files present.
+// The zero value covers all paths.
+type Shard struct {
+	// From 0 to Count-1
+	Index int
+	// The number of shards, 0 or 1 for no sharding
+	Count int
+}
+
+// Parses a shard written as "i/n", for example 0/4 for the first of 4 shards
+func ParseShard(value string) (Shard, error) {
+	var shard Shard
+	_, err := fmt.Sscanf(value, "%d/%d", &shard.Index, &shard.Count)
+	if err != nil || fmt.Sprintf("%d/%d", shard.Index, shard.Count) != value {
+		return Shard{}, fmt.Errorf("invalid shard %v, expected i/n", value)
+	}
+	if shard.Count < 1 || shard.Index < 0 || shard.Index >= shard.Count {
+		return Shard{}, fmt.Errorf("invalid shard %v, expected 0 <= i < n", value)
+	}
+	return shard, nil
+}
+
+func (s Shard) String() string {
+	if s.Count <= 1 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%d", s.Index, s.Count)
+}
+
+// Returns the top-level directory of a depot-absolute path, for example //depot/dir for
+// //depot/dir/file.txt,d/1.2.gz. The ,v and ,d suffixes are dropped so that files stored directly
+// under the depot directory have the same key in the checkpoint and on disk.
+func shardKey(path string) string {
+	parts := strings.SplitN(strings.TrimPrefix(path, "//"), "/", 3)
+	if len(parts) > 2 {
+		parts = parts[:2]
+	}
+	if len(parts) == 2 {
+		parts[1] = strings.TrimSuffix(strings.TrimSuffix(parts[1], ",v"), ",d")
+	}
+	return "//" + strings.Join(parts, "/")
+}
+
+// Reports whether a depot-absolute path belongs to the shard, comparing normalized paths so that
+// the names of the checkpoint and of the disk land in the same shard
+func (s Shard) contains(normalizer *PathNormalizer, path string) bool {
+	if s.Count <= 1 {
+		return true
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(normalizer.Normalize(shardKey(path))))
+	return int(hash.Sum32()%uint32(s.Count)) == s.Index
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Limits the rate of the disk accesses of Walk and Verify, so that scanning the live volume of a
+// server doesn't compete with p4d. A nil Throttle doesn't limit anything.
+type Throttle struct {
+	entries *rateLimiter
+	bytes   *rateLimiter
+}
+
+// Creates a throttle allowing entriesPerSecond directory entries to be walked and bytesPerSecond
+// bytes to be read; a limit of 0 or less disables that limit
+func NewThrottle(entriesPerSecond float64, bytesPerSecond float64) *Throttle {
+	return &Throttle{entries: newRateLimiter(entriesPerSecond), bytes: newRateLimiter(bytesPerSecond)}
+}
+
+// Waits until the next directory entry can be read
+func (t *Throttle) waitEntry() {
+	if t != nil {
+		t.entries.wait(1)
+	}
+}
+
+// Waits until n more bytes can be read
+func (t *Throttle) waitBytes(n int64) {
+	if t != nil {
+		t.bytes.wait(float64(n))
+	}
+}
+
+// Returns a reader waiting for the byte limit as it's read
+func (t *Throttle) reader(r io.Reader) io.Reader {
+	if t == nil || t.bytes == nil {
+		return r
+	}
+	return &throttledReader{r: r, throttle: t}
+}
+
+type throttledReader struct {
+	r        io.Reader
+	throttle *Throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.throttle.waitBytes(int64(n))
+	return n, err
+}
+
+// A token bucket holding up to a second of tokens. Consumers may take more tokens than available,
+// in which case they sleep until the debt is paid back.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	available float64
+	last      time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: rate, available: rate, last: time.Now()}
+}
+
+func (l *rateLimiter) wait(n float64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.available += now.Sub(l.last).Seconds() * l.rate
+	if l.available > l.rate {
+		l.available = l.rate
+	}
+	l.last = now
+	l.available -= n
+	if l.available < 0 {
+		time.Sleep(time.Duration(-l.available / l.rate * float64(time.Second)))
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/rcs"
+)
+
+// Bounds the time of the stat, open and read calls of Walk and Verify, and retries the ones that
+// fail transiently, so that a flaky NFS mount doesn't hang the whole scan. A call taking longer
+// than the timeout is abandoned and fails with os.ErrDeadlineExceeded, classified as
+// logging.TimeoutError: the goroutine making it stays blocked until the call returns, and the
+// scan goes on. A nil FileTimeouts makes the calls directly.
+type FileTimeouts struct {
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+	// One token per call in progress, including the abandoned ones still blocked, so that a dead
+	// mount doesn't pile up blocked threads
+	slots chan struct{}
+}
+
+// The maximum number of abandoned calls blocked at the same time. Once reached, calls wait for
+// one of them to return, up to the timeout.
+const maxBlockedCalls = 64
+
+// Creates timeouts abandoning the calls taking longer than timeout, and retrying the ones that
+// time out or fail with a transient error (such as a stale NFS handle) up to retries times, waiting
+// backoff before the first retry and twice as long before each next one
+func NewFileTimeouts(timeout time.Duration, retries int, backoff time.Duration) *FileTimeouts {
+	return &FileTimeouts{timeout: timeout, retries: retries, backoff: backoff, slots: make(chan struct{}, maxBlockedCalls)}
+}
+
+// Reports whether a failed call may succeed when retried
+func isTransient(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, syscall.ESTALE) ||
+		errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
+
+type callResult[T any] struct {
+	value T
+	err   error
+}
+
+// Makes a call with the timeouts of t, retrying it when it fails transiently. op and path describe
+// the call in its timeout error.
+func callWithTimeout[T any](t *FileTimeouts, op string, path string, fn func() (T, error)) (T, error) {
+	if t == nil {
+		return fn()
+	}
+	delay := t.backoff
+	for attempt := 0; ; attempt++ {
+		value, err := tryWithTimeout(t, op, path, fn)
+		// An abandoned read may still move the offset of its file, so reads aren't retried after
+		// a timeout
+		timedOut := errors.Is(err, os.ErrDeadlineExceeded)
+		if err == nil || !isTransient(err) || attempt >= t.retries || (timedOut && op == "read") {
+			return value, err
+		}
+		slog.Debug("Retrying", "op", op, logging.PathKey, path, "attempt", attempt+1, logging.Err(err))
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func tryWithTimeout[T any](t *FileTimeouts, op string, path string, fn func() (T, error)) (T, error) {
+	var zero T
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case t.slots <- struct{}{}:
+	case <-timer.C:
+		return zero, &fs.PathError{Op: op, Path: path, Err: os.ErrDeadlineExceeded}
+	}
+	// Buffered, so that an abandoned call can still complete
+	done := make(chan callResult[T], 1)
+	go func() {
+		value, err := fn()
+		<-t.slots
+		done <- callResult[T]{value, err}
+	}()
+	select {
+	case result := <-done:
+		return result.value, result.err
+	case <-timer.C:
+		slog.Debug("Abandoned file operation that timed out", "op", op, logging.PathKey, path, "timeout", t.timeout.String())
+		return zero, &fs.PathError{Op: op, Path: path, Err: os.ErrDeadlineExceeded}
+	}
+}
+
+// Returns the information of a file, as os.Stat
+func (t *FileTimeouts) stat(path string) (os.FileInfo, error) {
+	return callWithTimeout(t, "stat", path, func() (os.FileInfo, error) { return os.Stat(path) })
+}
+
+// Lists a directory with the information of its entries, as os.File.Readdir
+func (t *FileTimeouts) readDir(path string) ([]os.FileInfo, error) {
+	return callWithTimeout(t, "readdir", path, func() ([]os.FileInfo, error) {
+		dir, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer dir.Close()
+		return dir.Readdir(-1)
+	})
+}
+
+// Opens a file for reading, as os.Open
+func (t *FileTimeouts) open(path string) (*os.File, error) {
+	return callWithTimeout(t, "open", path, func() (*os.File, error) { return os.Open(path) })
+}
+
+// Returns a reader bounding the time of each read of r, a file opened from path
+func (t *FileTimeouts) reader(path string, r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &timeoutReader{r: r, path: path, timeouts: t}
+}
+
+type timeoutReader struct {
+	r        io.Reader
+	path     string
+	timeouts *FileTimeouts
+	// Set once a read timed out, as the reads after it can't tell where they start
+	err error
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	// Each attempt reads into its own buffer, which an abandoned read may still fill later
+	buffer, err := callWithTimeout(r.timeouts, "read", r.path, func() ([]byte, error) {
+		buffer := make([]byte, len(p))
+		n, err := r.r.Read(buffer)
+		if n > 0 {
+			// The bytes read aren't lost to a retry: the error comes back with the next read
+			err = nil
+		}
+		return buffer[:n], err
+	})
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		r.err = err
+	}
+	return copy(p, buffer), err
+}
+
+// Reads and parses an RCS file, as rcs.ReadFile, with the timeouts of t
+func readRCSFile(path string, t *FileTimeouts) (*rcs.File, error) {
+	if t == nil {
+		return rcs.ReadFile(path)
+	}
+	file, err := t.open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RCS file %v: %w", path, err)
+	}
+	defer file.Close()
+	content, err := io.ReadAll(t.reader(path, file))
+	if err != nil {
+		return nil, fmt.Errorf("error reading RCS file %v: %w", path, err)
+	}
+	parsed, err := rcs.Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing RCS file %v: %v", path, err)
+	}
+	return parsed, nil
+}
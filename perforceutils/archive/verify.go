@@ -0,0 +1,602 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package archive checks that the librarian files referenced by a checkpoint or journal are
+// present under the depot root. Unlike "p4 verify", it doesn't check md5 hashes.
+package archive
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/lbr"
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/rcs"
+	"github.com/google/perforce-utils/perforceutils/wildcard"
+)
+
+// The table listing the expected librarian files
+const (
+	// db.storage lists every librarian file revision once
+	StorageTable = "storage"
+	// db.rev is meant for journals predating the db.storage table
+	RevTable = "rev"
+)
+
+type Options struct {
+	// StorageTable (the default) or RevTable
+	Table string
+	// Only the librarian files selected by this filter are checked (all of them when nil). It should
+	// be the filter the index was built with: the records of the librarian files that one leaves out
+	// are counted in Result.OutOfIndexFilter instead of being reported missing.
+	Filter *wildcard.Filter
+	// Only the records dated in this window are checked (all of them when zero), the others are
+	// counted in Result.OutOfWindow
+	Window DateWindow
+	// Called for each librarian file revision missing from the index, with its path relative to the depot root
+	OnMissing func(path string, record journal.Record)
+	// Called instead of OnMissing for the revisions absent from the index because the directory or
+	// file holding them couldn't be read (see Index.Unreadable)
+	OnUnverifiable func(path string, unreadable UnreadablePath, record journal.Record)
+	// Called for each librarian file revision checked, present or not, such as to report progress
+	OnChecked func(path string, record journal.Record)
+	// Leaves out the records of the transactions a journal ends with unterminated, such as after a
+	// crash, whose archives may never have been written (see journal.ScanCommittedTables). They are
+	// counted in Result.PartialTransactionRecords.
+	SkipPartialTransactions bool
+	// Called for records that can't be parsed. Verification stops if it returns an error.
+	// Malformed records are skipped when it is nil.
+	OnMalformed func(record journal.Record, err error) error
+	// Verification stops with ErrMaxMissing once this many files are missing (0 for no limit)
+	MaxMissing int
+	// Skips the records up to this line of the checkpoint, as verified by an interrupted run
+	// (see Result.LastLine). The records are still read, for the shelved files of db.revsh.
+	ResumeAfterLine int
+	// Only librarian files of this shard are checked, as scanned by Walk with the same shard
+	Shard Shard
+	// Files of external storage types (+X) have no archive under the depot root: their content is
+	// provided by an archive trigger. They are skipped when CheckExternal is nil, otherwise it is
+	// called to tell whether the content exists. Files it returns an error for are not counted.
+	CheckExternal func(lbrFile string, lbrRev string, record journal.Record) (bool, error)
+	// Graph depots store git objects (loose or in packs) named after their hash, rather than
+	// librarian files: the records of their files are skipped and counted in Result.GraphSkipped
+	GraphDepots map[string]bool
+
+	// Compares the MD5 digest of the archives found under DepotRoot with the digest recorded in the
+	// checkpoint. The revisions of RCS archives are rebuilt from their deltas to be hashed.
+	VerifyDigests bool
+	DepotRoot     string
+	// The depots stored elsewhere than in a directory named after them, as given to Walk
+	Depots DepotMaps
+	// Digests computed in earlier runs, reused for unchanged archives when set
+	DigestCache *DigestCache
+	// Called for each archive whose content doesn't match the recorded digest
+	OnBadDigest func(path string, digest string, expected string, record journal.Record)
+	// Called for each compressed archive that can't be uncompressed to compute its digest
+	OnCorruptArchive func(path string, err error, record journal.Record)
+	// Limits the rate of the archive bytes read to compute digests (no limit when nil)
+	Throttle *Throttle
+	// Bounds the time of the stat and read calls made to compute digests (no timeout when nil)
+	Timeouts *FileTimeouts
+	// Hashes the full file archives in parallel on the workers of the pool, rather than one after
+	// the other while reading the checkpoint. OnBadDigest and OnCorruptArchive are then called from
+	// the workers, one call at a time.
+	HashPool *HashPool
+	// The depot root is on a network filesystem: the archives whose digest is computed are looked
+	// up in the listing of their directory, read once, rather than with a stat call each
+	NetworkFS bool
+	// Called for each archive found under another spelling than the path from the checkpoint, such as
+	// a different case. The index must track disk paths (see Index.TrackDiskPaths).
+	OnSpellingMismatch func(path string, diskPath string, record journal.Record)
+	// Called for each full file archive found smaller than recorded, as left by interrupted copies:
+	// empty while its revision isn't, or smaller than the size db.storage records for it as stored.
+	// The index must track sizes (see Index.TrackSizes).
+	OnTruncatedArchive func(path string, size int64, expected int64, record journal.Record)
+}
+
+// Returned by Verify, along with the counts so far, when Options.MaxMissing files are missing
+var ErrMaxMissing = errors.New("maximum number of missing files reached")
+
+type Counts struct {
+	// The number of librarian file revisions checked
+	Processed int
+	Missing   int
+	// The revisions that couldn't be told present or missing, as their directory couldn't be read
+	Unverifiable int
+	// The unverifiable revisions whose directory or file timed out when read (see FileTimeouts)
+	TimedOut int
+}
+
+type Result struct {
+	Counts
+	// The counts per depot, keyed by depot name
+	ByDepot map[string]*Counts
+	// Digest verification: archives hashed, digests reused from the cache, mismatches, compressed
+	// archives that can't be uncompressed, and archives that couldn't be hashed otherwise
+	DigestsComputed int
+	DigestsCached   int
+	BadDigests      int
+	CorruptArchives int
+	DigestsSkipped  int
+	// The archives that couldn't be hashed as reading them timed out, not counted in DigestsSkipped
+	DigestsTimedOut int
+	// The number of librarian files left to other shards
+	OutOfShard int
+	// The number of records dated outside of Options.Window
+	OutOfWindow int
+	// The number of records selected by Options.Filter (all the records verified when nil), and left
+	// out by it
+	InFilter    int
+	OutOfFilter int
+	// The records selected by Options.Filter whose librarian files were left out of the index by the
+	// filter it was built with, when the two differ
+	OutOfIndexFilter int
+	// Files of external storage types: skipped, checked with Options.CheckExternal (and counted in
+	// Processed), and that it failed to check
+	ExternalSkipped int
+	ExternalChecked int
+	ExternalErrors  int
+	// The number of librarian file revisions of graph depots skipped
+	GraphSkipped int
+	// The number of shelved archives checked (and counted in Processed)
+	Shelved int
+	// The number of archives found under another spelling than the path from the checkpoint
+	SpellingMismatches int
+	// The number of full file archives found smaller than recorded (see Options.OnTruncatedArchive)
+	TruncatedArchives int
+	// The number of records left out as they belong to unterminated transactions, with
+	// Options.SkipPartialTransactions
+	PartialTransactionRecords int
+	// The line of the last record verified, to resume an interrupted verification after it
+	LastLine int
+	// The number of records read, by table. When verifying db.storage, db.rev records are counted
+	// as well, to tell checkpoints of servers before 2019.1 (which have no db.storage table) apart.
+	Records map[string]int
+}
+
+// Returns the depot name of a depot-absolute path, for example "depot" for //depot/file.txt
+func DepotName(path string) string {
+	return lbr.DepotName(path)
+}
+
+// Verifies that the librarian files listed in the checkpoint or journal read from r are in the index.
+// Verification stops with the error of ctx once it's done, such as when the user interrupts the
+// run; Result.LastLine tells where to resume it from (see Options.ResumeAfterLine).
+func Verify(ctx context.Context, r io.Reader, index *Index, options Options) (Result, error) {
+	result := Result{ByDepot: make(map[string]*Counts), Records: make(map[string]int)}
+
+	table := "db.storage"
+	switch options.Table {
+	case "", StorageTable:
+	case RevTable:
+		table = "db.rev"
+	default:
+		return result, fmt.Errorf("unknown table %v, expected %v or %v", options.Table, StorageTable, RevTable)
+	}
+
+	malformed := func(record journal.Record, err error) error {
+		if options.OnMalformed == nil {
+			return nil
+		}
+		return options.OnMalformed(record, err)
+	}
+	// The last RCS file read, since db.storage lists the revisions of a file one after the other
+	var rcsFile *rcs.File
+	var rcsPath string
+	rcsDigest := func(path string, size int64, revision string) (string, error) {
+		if path != rcsPath {
+			// RCS files are read whole to be parsed
+			options.Throttle.waitBytes(size)
+			file, err := readRCSFile(path, options.Timeouts)
+			if err != nil {
+				return "", err
+			}
+			rcsFile, rcsPath = file, path
+		}
+		content, err := rcsFile.Content(revision)
+		if err != nil {
+			return "", err
+		}
+		return contentDigest(content), nil
+	}
+	statArchive := options.Timeouts.stat
+	if options.NetworkFS {
+		statArchive = newDirCache(options.Timeouts).stat
+	}
+	// Guards the digest counts of the result and the digest callbacks, as the archives hashed by
+	// Options.HashPool complete on its workers
+	var digestMu sync.Mutex
+	var pendingDigests sync.WaitGroup
+	compareDigest := func(record journal.Record, path string, digest string, expected string) {
+		if !strings.EqualFold(digest, expected) {
+			result.BadDigests++
+			if options.OnBadDigest != nil {
+				options.OnBadDigest(path, digest, expected, record)
+			}
+		}
+	}
+	// Counts an archive hashed, or that couldn't be, with digestMu held
+	hashed := func(record journal.Record, path string, archivePath string, info os.FileInfo, digest string, expected string, err error) {
+		if errors.Is(err, ErrCorruptArchive) {
+			result.CorruptArchives++
+			if options.OnCorruptArchive != nil {
+				options.OnCorruptArchive(path, err, record)
+			}
+			return
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			slog.Warn("Timed out computing digest", logging.PathKey, archivePath, logging.Err(err))
+			result.DigestsTimedOut++
+			return
+		}
+		if err != nil {
+			slog.Debug("Could not compute digest", logging.PathKey, archivePath, logging.Err(err))
+			result.DigestsSkipped++
+			return
+		}
+		result.DigestsComputed++
+		if options.DigestCache != nil {
+			options.DigestCache.Store(archivePath, info, digest)
+		}
+		compareDigest(record, path, digest, expected)
+	}
+	verifyDigest := func(record journal.Record, path string, lbrFile string, lbrRev string, lbrType int, expected string) {
+		archivePath := ArchiveFilePath(options.DepotRoot, options.Depots, lbrFile, lbrRev, lbrType)
+		rcsArchive := StorageType(lbrType) == RCSStorageType
+		statPath := archivePath
+		if rcsArchive {
+			// All the revisions are in the ,v file, and are cached as file,v/revision
+			statPath = filepath.Dir(archivePath)
+		}
+		info, err := statArchive(statPath)
+		if err != nil && !rcsArchive {
+			// The index finds the revisions stored in the other form than their type as well:
+			// uncompressed revisions of compressed types, and the other way around
+			if strings.HasSuffix(archivePath, ".gz") {
+				archivePath = strings.TrimSuffix(archivePath, ".gz")
+			} else {
+				archivePath += ".gz"
+			}
+			info, err = statArchive(archivePath)
+		}
+		if err != nil {
+			digestMu.Lock()
+			defer digestMu.Unlock()
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				slog.Warn("Timed out looking for archive to compute its digest", logging.PathKey, path, logging.Err(err))
+				result.DigestsTimedOut++
+			} else {
+				slog.Debug("Could not find archive to compute its digest", logging.PathKey, path, logging.Err(err))
+				result.DigestsSkipped++
+			}
+			return
+		}
+		digest, cached := "", false
+		if options.DigestCache != nil {
+			digest, cached = options.DigestCache.Lookup(archivePath, info)
+		}
+		if cached {
+			digestMu.Lock()
+			defer digestMu.Unlock()
+			result.DigestsCached++
+			compareDigest(record, path, digest, expected)
+			return
+		}
+		if rcsArchive {
+			digest, err = rcsDigest(statPath, info.Size(), lbrRev)
+			digestMu.Lock()
+			defer digestMu.Unlock()
+			hashed(record, path, archivePath, info, digest, expected, err)
+			return
+		}
+		// An archive found uncompressed is hashed as stored
+		lbrType = BinaryStorageType
+		if strings.HasSuffix(archivePath, ".gz") {
+			lbrType = CompressedStorageType
+		}
+		if options.HashPool != nil {
+			pendingDigests.Add(1)
+			options.HashPool.submit(func(h hash.Hash) {
+				defer pendingDigests.Done()
+				digest, n, err := archiveDigest(archivePath, lbrType, options.Throttle, options.Timeouts, h)
+				options.HashPool.done(n)
+				digestMu.Lock()
+				defer digestMu.Unlock()
+				hashed(record, path, archivePath, info, digest, expected, err)
+			})
+			return
+		}
+		digest, _, err = archiveDigest(archivePath, lbrType, options.Throttle, options.Timeouts, md5.New())
+		digestMu.Lock()
+		defer digestMu.Unlock()
+		hashed(record, path, archivePath, info, digest, expected, err)
+	}
+	checkSpelling := func(record journal.Record, path string) {
+		for _, candidate := range []string{path, path + ".gz"} {
+			if diskPath, ok := index.DiskPath(candidate); ok {
+				if diskPath != candidate {
+					result.SpellingMismatches++
+					options.OnSpellingMismatch(candidate, diskPath, record)
+				}
+				return
+			}
+		}
+	}
+	// Compares the size of a full file archive found by the walk with the size of the archive as
+	// stored (unknown for db.rev), or with the size of the revision for an empty archive
+	checkSize := func(record journal.Record, path string, lbrType int, storedSize int64, contentSize int64) {
+		size, ok := index.Size(path)
+		compressed := false
+		if !ok {
+			if size, ok = index.Size(path + ".gz"); !ok {
+				return
+			}
+			path, compressed = path+".gz", true
+		}
+		expected := storedSize
+		if expected <= 0 {
+			expected = contentSize
+		}
+		// An archive found in the other form than its type, compressed or not, can't be compared
+		// with the recorded size
+		storedAsRecorded := compressed == (StorageType(lbrType) == CompressedStorageType || StorageType(lbrType) == CompressedTempObj)
+		switch {
+		case size == 0 && expected > 0:
+		case storedSize > 0 && size < storedSize && storedAsRecorded:
+		default:
+			return
+		}
+		result.TruncatedArchives++
+		options.OnTruncatedArchive(path, size, expected, record)
+	}
+	check := func(record journal.Record, lbrFile string, lbrRev string, lbrType int, digest string, storedSize int64, contentSize int64) error {
+		if options.GraphDepots[DepotName(lbrFile)] {
+			result.GraphSkipped++
+			return nil
+		}
+		external := StorageType(lbrType) == ExternalStorageType
+		if external && options.CheckExternal == nil {
+			result.ExternalSkipped++
+			return nil
+		}
+		path, exists := VersionedFilePath(lbrFile, lbrRev, lbrType), false
+		if external {
+			var err error
+			if exists, err = options.CheckExternal(lbrFile, lbrRev, record); err != nil {
+				result.ExternalErrors++
+				return nil
+			}
+			result.ExternalChecked++
+		} else {
+			path, exists = index.HasRevision(lbrFile, lbrRev, lbrType)
+		}
+
+		depot, ok := result.ByDepot[DepotName(lbrFile)]
+		if !ok {
+			depot = &Counts{}
+			result.ByDepot[DepotName(lbrFile)] = depot
+		}
+		unreadable, unverifiable := UnreadablePath{}, false
+		if !exists && !external {
+			unreadable, unverifiable = index.Unverifiable(path)
+		}
+		if unverifiable {
+			result.Unverifiable++
+			depot.Unverifiable++
+			if unreadable.Class == logging.TimeoutError {
+				result.TimedOut++
+				depot.TimedOut++
+			}
+			if options.OnUnverifiable != nil {
+				options.OnUnverifiable(path, unreadable, record)
+			}
+		} else if !exists {
+			result.Missing++
+			depot.Missing++
+			if options.OnMissing != nil {
+				options.OnMissing(path, record)
+			}
+		} else if options.OnSpellingMismatch != nil && !external {
+			checkSpelling(record, path)
+		}
+		if exists && options.OnTruncatedArchive != nil && !external && StorageType(lbrType) != RCSStorageType {
+			checkSize(record, path, lbrType, storedSize, contentSize)
+		}
+		if exists && options.VerifyDigests && hasDigest(digest) && !external {
+			verifyDigest(record, path, lbrFile, lbrRev, lbrType, digest)
+		}
+		result.Processed++
+		depot.Processed++
+		if options.OnChecked != nil {
+			options.OnChecked(path, record)
+		}
+		if options.MaxMissing > 0 && result.Missing >= options.MaxMissing {
+			return ErrMaxMissing
+		}
+		return nil
+	}
+
+	// The walk matches the filter against the paths found on disk, and the verification against the
+	// paths of the checkpoint: both must select the same librarian files for the missing ones to be
+	// told apart from the ones left out of the walk
+	indexFilterDiffers := index.filter != nil && !index.filter.Equal(options.Filter)
+	if indexFilterDiffers {
+		slog.Warn("The index was built with another filter than the one of the verification, the records of the files it left out aren't verified",
+			"index_filter", index.filter.String(), "filter", options.Filter.String())
+	}
+	if options.Filter != nil && !options.Filter.CaseInsensitive() && index.normalizer != nil && !index.normalizer.caseSensitive {
+		slog.Warn("The filter is case-sensitive while the index isn't: archives spelled in another case on disk than in the checkpoint may be left out of the walk and reported missing",
+			"filter", options.Filter.String())
+	}
+	inFilter := func(lbrFile string) bool {
+		if !options.Filter.Match(lbrFile) {
+			result.OutOfFilter++
+			return false
+		}
+		result.InFilter++
+		if indexFilterDiffers && !index.filter.Match(lbrFile) {
+			result.OutOfIndexFilter++
+			return false
+		}
+		return true
+	}
+
+	// Lazy copies share the librarian file of the revision they were branched from
+	checked := make(map[string]bool)
+	// The archives of db.storage that belong to shelved files, keyed by librarian file and revision.
+	// db.revsh precedes db.storage in checkpoints.
+	shelved := make(map[string]bool)
+
+	// db.storagesh lists the archives of shelved files on recent servers, following db.storage
+	tables := map[string]bool{table: true, "db.rev": true, "db.revsh": true, "db.storagesh": table == "db.storage"}
+	scan := func(fn func(journal.Record) error) error { return journal.ScanTables(r, tables, fn) }
+	if options.SkipPartialTransactions {
+		scan = func(fn func(journal.Record) error) error {
+			var err error
+			result.PartialTransactionRecords, err = journal.ScanCommittedTables(r, tables, fn)
+			return err
+		}
+	}
+	verifyRecord := func(record journal.Record) error {
+		if record.Operation != journal.PutValue {
+			return nil
+		}
+		result.Records[record.Table]++
+		if record.Table == "db.revsh" {
+			rev, err := ParseRevRecord(record.Fields)
+			if err != nil {
+				return malformed(record, fmt.Errorf("could not parse db.revsh record: %v", err))
+			}
+			// Lazy copies refer to the archive of a submitted revision, which is checked as such
+			if !rev.Action.HasArchive() || rev.LbrIsLazy {
+				return nil
+			}
+			if table == "db.storage" {
+				shelved[rev.LbrFile+"\x00"+rev.LbrRev] = true
+				return nil
+			}
+			if record.LineNumber <= options.ResumeAfterLine {
+				return nil
+			}
+			if !inFilter(rev.LbrFile) {
+				return nil
+			}
+			if !options.Window.Contains(rev.Date) {
+				result.OutOfWindow++
+				return nil
+			}
+			if !options.Shard.contains(index.normalizer, rev.LbrFile) {
+				result.OutOfShard++
+				return nil
+			}
+			lbrType := ShelvedStorageType(rev.LbrType)
+			versionedFilePath := VersionedFilePath(rev.LbrFile, rev.LbrRev, lbrType)
+			if checked[versionedFilePath] {
+				return nil
+			}
+			checked[versionedFilePath] = true
+			result.Shelved++
+			return check(record, rev.LbrFile, rev.LbrRev, lbrType, rev.Digest, 0, rev.Size)
+		}
+		shelvedStorage := record.Table == "db.storagesh"
+		if (record.Table != table && !shelvedStorage) || record.LineNumber <= options.ResumeAfterLine {
+			return nil
+		}
+
+		if table == "db.storage" {
+			storage, err := ParseStorageRecord(record.Fields)
+			if err != nil {
+				return malformed(record, err)
+			}
+			if !inFilter(storage.LbrFile) {
+				return nil
+			}
+			if !options.Window.Contains(storage.Date) {
+				result.OutOfWindow++
+				return nil
+			}
+			if !options.Shard.contains(index.normalizer, storage.LbrFile) {
+				result.OutOfShard++
+				return nil
+			}
+			slog.Debug("Scanned", logging.PathKey, storage.LbrFile, logging.RevisionKey, storage.LbrRev,
+				"lbr_type", storage.LbrType, "storage_type", StorageType(storage.LbrType))
+			lbrType := storage.LbrType
+			if shelvedStorage || shelved[storage.LbrFile+"\x00"+storage.LbrRev] {
+				lbrType = ShelvedStorageType(lbrType)
+				// Shelved archives listed in both tables are only checked once
+				versionedFilePath := VersionedFilePath(storage.LbrFile, storage.LbrRev, lbrType)
+				if checked[versionedFilePath] {
+					return nil
+				}
+				checked[versionedFilePath] = true
+				result.Shelved++
+			}
+			return check(record, storage.LbrFile, storage.LbrRev, lbrType, storage.Digest, storage.ServerSize, storage.Size)
+		}
+
+		rev, err := ParseRevRecord(record.Fields)
+		if err != nil {
+			return malformed(record, fmt.Errorf("could not parse db.rev record: %v", err))
+		}
+		// The filter applies to the librarian file since that's what gets checked on disk
+		if !inFilter(rev.LbrFile) {
+			return nil
+		}
+		if !options.Window.Contains(rev.Date) {
+			result.OutOfWindow++
+			return nil
+		}
+		if !options.Shard.contains(index.normalizer, rev.LbrFile) {
+			result.OutOfShard++
+			return nil
+		}
+		slog.Debug("Scanned", "depot_file", rev.DepotFile, "depot_rev", rev.DepotRev, logging.PathKey, rev.LbrFile,
+			logging.RevisionKey, rev.LbrRev, "lbr_type", rev.LbrType)
+		if !rev.Action.HasArchive() {
+			return nil
+		}
+		versionedFilePath := VersionedFilePath(rev.LbrFile, rev.LbrRev, rev.LbrType)
+		if checked[versionedFilePath] {
+			return nil
+		}
+		checked[versionedFilePath] = true
+		return check(record, rev.LbrFile, rev.LbrRev, rev.LbrType, rev.Digest, 0, rev.Size)
+	}
+	err := scan(func(record journal.Record) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := verifyRecord(record); err != nil {
+			return err
+		}
+		result.LastLine = record.LineNumber
+		return nil
+	})
+	// The digests still being computed are counted before returning, even when verification stopped
+	pendingDigests.Wait()
+	return result, err
+}
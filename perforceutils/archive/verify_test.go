@@ -0,0 +1,100 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+)
+
+// The files of the graph depot "repo" of the example checkpoint, added to its db.storage table
+const graphDepotStorage = `@pv@ 1 @db.storage@ @//repo/project/README.md@ @1.1@ 0 1 271E0A48226C79CCA6C1FCDE43CDAC31 9 203 00000000000000000000000000000000 1611008038 
+@pv@ 1 @db.storage@ @//repo/project/main.go@ @1.1@ 65539 1 F1C9645DBC14EFDDC7D8A322685F26EB 10485760 10221 00000000000000000000000000000000 1611008038 
+`
+
+func exampleCheckpoint(t *testing.T) []byte {
+	t.Helper()
+	checkpoint, err := os.ReadFile("../testdata/example_journal.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return checkpoint
+}
+
+func checkpointWithGraphDepot(t *testing.T) []byte {
+	return append(exampleCheckpoint(t), graphDepotStorage...)
+}
+
+// Verifies the checkpoint against an empty depot root, returning the paths reported missing
+func verifyEmptyRoot(t *testing.T, checkpoint []byte, options Options) (Result, []string) {
+	t.Helper()
+	normalizer, err := NewPathNormalizer(true, "auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := NewIndex(normalizer)
+	if err := index.Walk(context.Background(), t.TempDir(), nil, WalkOptions{}); err != nil {
+		t.Fatalf("Walk() returned %v", err)
+	}
+	var missing []string
+	options.OnMissing = func(path string, record journal.Record) {
+		missing = append(missing, path)
+	}
+	result, err := Verify(context.Background(), bytes.NewReader(checkpoint), index, options)
+	if err != nil {
+		t.Fatalf("Verify() returned %v", err)
+	}
+	return result, missing
+}
+
+func TestVerifySkipsGraphDepots(t *testing.T) {
+	checkpoint := checkpointWithGraphDepot(t)
+	depotTypes, err := ReadDepotTypes(bytes.NewReader(checkpoint))
+	if err != nil {
+		t.Fatalf("ReadDepotTypes() returned %v", err)
+	}
+	result, missing := verifyEmptyRoot(t, checkpoint, Options{GraphDepots: GraphDepots(depotTypes)})
+	for _, path := range missing {
+		if strings.HasPrefix(path, "//repo/") {
+			t.Errorf("Verify() reported the graph depot file %v missing", path)
+		}
+	}
+	if result.GraphSkipped != 2 {
+		t.Errorf("Verify() skipped %v graph depot files, want 2", result.GraphSkipped)
+	}
+	if result.Missing != len(missing) || result.Missing == 0 {
+		t.Errorf("Verify() counted %v missing files and reported %v, want the files of //depot", result.Missing, len(missing))
+	}
+}
+
+func TestVerifyWithoutGraphDepots(t *testing.T) {
+	result, missing := verifyEmptyRoot(t, checkpointWithGraphDepot(t), Options{})
+	repoMissing := 0
+	for _, path := range missing {
+		if strings.HasPrefix(path, "//repo/") {
+			repoMissing++
+		}
+	}
+	if repoMissing != 2 || result.GraphSkipped != 0 {
+		t.Errorf("Verify() reported %v graph depot files missing and skipped %v, want 2 and 0", repoMissing, result.GraphSkipped)
+	}
+}
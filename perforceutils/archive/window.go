@@ -0,0 +1,94 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package archive
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The dates a verification or an extraction is restricted to, such as the days of a storage
+// incident. Records are selected by their date: when the archive was stored for db.storage, and the
+// submit date for db.rev. A zero Since or Until leaves the window open on that side.
+type DateWindow struct {
+	// Included
+	Since time.Time
+	// Excluded
+	Until time.Time
+}
+
+// Parses the -since and -until flags of the tools. Each is a date (2006-01-02, UTC), a time
+// (RFC 3339), or a duration before now such as 7d or 36h. Empty values leave the window open.
+func ParseDateWindow(since string, until string, now time.Time) (DateWindow, error) {
+	var w DateWindow
+	var err error
+	if w.Since, err = parseWindowDate(since, now); err != nil {
+		return w, fmt.Errorf("invalid -since: %v", err)
+	}
+	if w.Until, err = parseWindowDate(until, now); err != nil {
+		return w, fmt.Errorf("invalid -until: %v", err)
+	}
+	if !w.Since.IsZero() && !w.Until.IsZero() && !w.Since.Before(w.Until) {
+		return w, fmt.Errorf("-since (%v) must be before -until (%v)", w.Since.UTC().Format(time.RFC3339), w.Until.UTC().Format(time.RFC3339))
+	}
+	return w, nil
+}
+
+func parseWindowDate(value string, now time.Time) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		return date, nil
+	}
+	if date, err := time.Parse(time.RFC3339, value); err == nil {
+		return date, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if count, err := strconv.Atoi(days); err == nil && count >= 0 {
+			return now.AddDate(0, 0, -count), nil
+		}
+	}
+	if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+		return now.Add(-duration), nil
+	}
+	return time.Time{}, fmt.Errorf("expected a date (2006-01-02), a time (RFC 3339) or a duration (7d, 36h), got %q", value)
+}
+
+func (w DateWindow) IsZero() bool {
+	return w.Since.IsZero() && w.Until.IsZero()
+}
+
+// Reports whether a date of a record, in seconds since the epoch, is in the window
+func (w DateWindow) Contains(date int64) bool {
+	if !w.Since.IsZero() && date < w.Since.Unix() {
+		return false
+	}
+	return w.Until.IsZero() || date < w.Until.Unix()
+}
+
+func (w DateWindow) String() string {
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return "..."
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	return format(w.Since) + " - " + format(w.Until)
+}
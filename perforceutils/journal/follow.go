@@ -0,0 +1,87 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package journal
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// Reads a journal that p4d keeps appending to, like "tail -f"
+type follower struct {
+	path   string
+	file   *os.File
+	offset int64
+	poll   time.Duration
+	stop   <-chan struct{}
+}
+
+// Opens a live, uncompressed journal for reading from its beginning, waiting for more records at
+// its end instead of returning io.EOF, until stop is closed. The journal is reopened when it's
+// rotated ("p4d -jj" renames it and starts a new one) or truncated. The returned reader can be
+// passed to Scan.
+func Follow(path string, poll time.Duration, stop <-chan struct{}) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &follower{path: path, file: file, poll: poll, stop: stop}, nil
+}
+
+func (f *follower) Read(p []byte) (int, error) {
+	for {
+		n, err := f.file.Read(p)
+		f.offset += int64(n)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		// At the end of the file: check whether it was rotated before waiting for more
+		if info, err := os.Stat(f.path); err == nil {
+			current, currentErr := f.file.Stat()
+			switch {
+			case currentErr == nil && !os.SameFile(info, current):
+				file, err := os.Open(f.path)
+				if err != nil {
+					return 0, err
+				}
+				f.file.Close()
+				f.file, f.offset = file, 0
+				continue
+			case info.Size() < f.offset:
+				if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+					return 0, err
+				}
+				f.offset = 0
+				continue
+			}
+		}
+		select {
+		case <-f.stop:
+			return 0, io.EOF
+		case <-time.After(f.poll):
+		}
+	}
+}
+
+func (f *follower) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,451 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package journal reads Helix Core checkpoints and journals.
+//
+// Each journal record starts with an operation (such as @pv@ for a put value), followed for table
+// operations by the table version and name, and then the table fields. String values are quoted
+// with @ and may contain spaces, newlines and @ characters (escaped as @@).
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Journal record operations
+const (
+	PutValue          = "pv"
+	ReplaceValue      = "rv"
+	DeleteValue       = "dv"
+	VerifyValue       = "vv"
+	EndTransaction    = "ex"
+	BeginTransaction  = "bx"
+	MarkTransaction   = "mx"
+	NoteTransaction   = "nx"
+	CheckpointComment = "rc"
+)
+
+const (
+	// Table operations have an operation, version and table name before the table fields.
+	HeaderFieldCount = 3
+)
+
+// A journal record
+type Record struct {
+	// The operation, without its @-quoting (for example "pv")
+	Operation string
+	// The table version and name, for table operations only
+	Version int
+	Table   string
+	// The table fields with their @-quoting removed; for other operations, the fields after the operation
+	Fields []string
+	// The record as it appears in the journal, without the trailing newline
+	Raw string
+	// The line number (starting at 1) and byte offset where the record starts
+	LineNumber int
+	Offset     int64
+}
+
+// Returns the field at index i, or an empty string when the record is too short
+func (r *Record) Field(i int) string {
+	if i < 0 || i >= len(r.Fields) {
+		return ""
+	}
+	return r.Fields[i]
+}
+
+// Reports whether the record is a table operation (put, replace, delete or verify value)
+func (r *Record) IsTableOperation() bool {
+	return len(r.Table) > 0
+}
+
+// Reports whether a journal record is complete, i.e. it doesn't end inside an @-quoted value.
+// Quoted values (such as change descriptions) may span several lines.
+func IsComplete(raw string) bool {
+	return !inQuoteAfter(raw, false)
+}
+
+// Reports whether text ends inside an @-quoted value, given whether it starts inside one. Escaped
+// @ never span lines, so that Scan can carry the state from one line to the next.
+func inQuoteAfter(text string, inQuote bool) bool {
+	for i := 0; i < len(text); i++ {
+		if text[i] != '@' {
+			continue
+		}
+		if inQuote && i+1 < len(text) && text[i+1] == '@' {
+			// An escaped @ inside a quoted value
+			i++
+			continue
+		}
+		inQuote = !inQuote
+	}
+	return inQuote
+}
+
+// Splits a journal record into its fields, removing the @-quoting.
+// Unlike splitting on spaces, this supports any number of fields containing spaces.
+func Split(raw string) []string {
+	var fields []string
+	i := 0
+	for i < len(raw) {
+		switch raw[i] {
+		case ' ', '\r', '\n':
+			i++
+		case '@':
+			var value strings.Builder
+			i++
+			for i < len(raw) {
+				if raw[i] == '@' {
+					if i+1 < len(raw) && raw[i+1] == '@' {
+						value.WriteByte('@')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				value.WriteByte(raw[i])
+				i++
+			}
+			fields = append(fields, value.String())
+		default:
+			end := strings.IndexAny(raw[i:], " \r\n")
+			if end < 0 {
+				end = len(raw) - i
+			}
+			fields = append(fields, raw[i:i+end])
+			i += end
+		}
+	}
+	return fields
+}
+
+// Splits a journal record into its fields like Split, but keeps each field as it appears in the
+// record, @-quoting included. Joining them with spaces gives back an equivalent record.
+func Tokens(raw string) []string {
+	var tokens []string
+	i := 0
+	for i < len(raw) {
+		switch raw[i] {
+		case ' ', '\r', '\n':
+			i++
+		case '@':
+			start := i
+			i++
+			for i < len(raw) {
+				if raw[i] == '@' {
+					if i+1 < len(raw) && raw[i+1] == '@' {
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				i++
+			}
+			tokens = append(tokens, raw[start:i])
+		default:
+			end := strings.IndexAny(raw[i:], " \r\n")
+			if end < 0 {
+				end = len(raw) - i
+			}
+			tokens = append(tokens, raw[i:i+end])
+			i += end
+		}
+	}
+	return tokens
+}
+
+// Quotes a value as a journal field, escaping the @ it contains
+func Quote(value string) string {
+	return "@" + strings.ReplaceAll(value, "@", "@@") + "@"
+}
+
+// Parses a complete raw record
+func Parse(raw string) Record {
+	record := Record{Raw: raw}
+	fields := Split(raw)
+	if len(fields) == 0 {
+		return record
+	}
+	record.Operation = fields[0]
+	switch record.Operation {
+	case PutValue, ReplaceValue, DeleteValue, VerifyValue:
+		if len(fields) >= HeaderFieldCount {
+			if version, err := strconv.Atoi(fields[1]); err == nil {
+				record.Version = version
+				record.Table = fields[2]
+				record.Fields = fields[HeaderFieldCount:]
+				return record
+			}
+		}
+	}
+	record.Fields = fields[1:]
+	return record
+}
+
+// Returns a journal line with its line ending normalized to \n. Journals transferred with Windows
+// tools may have \r\n line endings, or several \r before the \n when converted twice, including
+// inside multi-line values.
+func normalizeLineEnding(line string) string {
+	if strings.HasSuffix(line, "\n") {
+		return strings.TrimRight(line, "\r\n") + "\n"
+	}
+	return strings.TrimRight(line, "\r")
+}
+
+// The longest record read by Scan, so that a corrupt journal, such as one ending inside a quoted
+// value, fails the scan rather than being read whole into memory (0 for no limit)
+var maxLineBytes = 10 * 1024 * 1024
+
+// Registers the -max-line-bytes flag of the tools reading checkpoints and journals
+func RegisterFlags(flags *flag.FlagSet) {
+	flags.IntVar(&maxLineBytes, "max-line-bytes", maxLineBytes, "Longest journal record read, in bytes, with the lines of its multi-line values (0 for no limit). Longer records, such as those of corrupt journals, stop the scan with an error.")
+}
+
+// Returns the limit set with -max-line-bytes
+func MaxLineBytes() int {
+	return maxLineBytes
+}
+
+// Returned by Scan, wrapped with the table and line of the record, for records longer than
+// -max-line-bytes
+var ErrRecordTooLong = errors.New("journal record too long")
+
+// The bytes of a record too long to be read kept to name its table
+const recordStartBytes = 256
+
+// Reads a line of at most limit bytes, newline included (no limit when negative). Longer lines
+// return ErrRecordTooLong with their start.
+func readLine(reader *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if limit >= 0 && len(line)+len(chunk) > limit {
+			line = append(line, chunk[:min(len(chunk), recordStartBytes)]...)
+			return string(line[:min(len(line), recordStartBytes)]), ErrRecordTooLong
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// Returns the error of a record longer than -max-line-bytes, naming its table from its start
+func recordTooLong(start string, line int) error {
+	start = start[:min(len(start), recordStartBytes)]
+	what := "record"
+	if table := Parse(start).Table; len(table) > 0 {
+		what = table + " record"
+	}
+	return fmt.Errorf("%v at line %d is longer than %d bytes, raise -max-line-bytes: %w", what, line, maxLineBytes, ErrRecordTooLong)
+}
+
+// Calls fn for every record read from r. Scanning stops at the first error returned by fn,
+// which is returned by Scan. Line endings are normalized to \n, in Record.Raw and in the values
+// spanning several lines, so that journals with \r\n or mixed line endings are read the same.
+// Records longer than -max-line-bytes stop the scan with ErrRecordTooLong.
+func Scan(r io.Reader, fn func(Record) error) error {
+	reader := bufio.NewReaderSize(r, 1024*1024)
+	var raw strings.Builder
+	lineNumber := 0
+	startLine := 1
+	offset := int64(0)
+	startOffset := int64(0)
+	// Whether the record read so far ends inside a quoted value, tracked line by line rather than
+	// over the whole record, as long values may span many lines
+	inQuote := false
+	for {
+		limit := -1
+		if maxLineBytes > 0 {
+			limit = maxLineBytes - raw.Len()
+		}
+		line, err := readLine(reader, limit)
+		if errors.Is(err, ErrRecordTooLong) {
+			return recordTooLong(raw.String()+line, startLine)
+		}
+		lineNumber++
+		offset += int64(len(line))
+		line = normalizeLineEnding(line)
+		raw.WriteString(line)
+		inQuote = inQuoteAfter(line, inQuote)
+		if err == nil && inQuote {
+			continue
+		}
+		if text := strings.TrimRight(raw.String(), "\r\n"); len(strings.TrimSpace(text)) > 0 {
+			record := Parse(text)
+			record.LineNumber = startLine
+			record.Offset = startOffset
+			if fnErr := fn(record); fnErr != nil {
+				return fnErr
+			}
+		}
+		raw.Reset()
+		inQuote = false
+		startLine = lineNumber + 1
+		startOffset = offset
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read error: %v", err)
+		}
+	}
+}
+
+// Calls fn for every table record of the given tables (all tables when tables is empty)
+func ScanTables(r io.Reader, tables map[string]bool, fn func(Record) error) error {
+	return Scan(r, func(record Record) error {
+		if !record.IsTableOperation() || (len(tables) > 0 && !tables[record.Table]) {
+			return nil
+		}
+		return fn(record)
+	})
+}
+
+// Calls fn for every table record of the given tables like ScanTables, following the transaction
+// markers: the records between a @bx@ and its @ex@ are held back until the @ex@ is read, as p4d only
+// commits them then. The records of transactions left unterminated, at the end of a journal written
+// by a server that crashed or followed by the @bx@ of another transaction, are dropped, and their
+// number is returned. Records outside of transactions, such as those of checkpoints, are passed on
+// as read.
+func ScanCommittedTables(r io.Reader, tables map[string]bool, fn func(Record) error) (int, error) {
+	dropped := 0
+	inTransaction := false
+	var pending []Record
+	err := Scan(r, func(record Record) error {
+		switch record.Operation {
+		case BeginTransaction:
+			if inTransaction {
+				dropped += len(pending)
+			}
+			inTransaction = true
+			pending = pending[:0]
+			return nil
+		case EndTransaction:
+			inTransaction = false
+			for _, held := range pending {
+				if err := fn(held); err != nil {
+					return err
+				}
+			}
+			pending = pending[:0]
+			return nil
+		}
+		if !record.IsTableOperation() || (len(tables) > 0 && !tables[record.Table]) {
+			return nil
+		}
+		if inTransaction {
+			pending = append(pending, record)
+			return nil
+		}
+		return fn(record)
+	})
+	if err == nil && inTransaction {
+		dropped += len(pending)
+	}
+	return dropped, err
+}
+
+// Opens a checkpoint or journal and calls fn for every table record of the given tables
+// (all tables when tables is empty)
+func ScanFile(path string, tables map[string]bool, fn func(Record) error) error {
+	file, err := Open(path)
+	if err != nil {
+		return fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+	return ScanTables(file, tables, fn)
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// A decompressing reader that also closes the underlying file
+type journalReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *journalReader) Close() error {
+	var err error
+	for _, closer := range r.closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// The path reading the standard input, to stream checkpoints from zcat, ssh or downloads
+const Stdin = "-"
+
+// Opens a checkpoint or journal, selecting a decompressor from the magic bytes of the file.
+// Gzip files may have several members (as produced by parallel checkpoints), zstd files are also supported.
+// The path Stdin reads the standard input, which can only be read once.
+func Open(path string) (io.ReadCloser, error) {
+	if path == Stdin {
+		return NewReader(os.Stdin)
+	}
+	file, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader.(*journalReader).closers = append(reader.(*journalReader).closers, file)
+	return reader, nil
+}
+
+// Wraps r with a decompressor selected from the magic bytes of the stream, if needed.
+// Closing the returned reader releases the decompressor but doesn't close r.
+func NewReader(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("gzip error: %v", err)
+		}
+		return &journalReader{Reader: gzipReader, closers: []io.Closer{gzipReader}}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zstdReader, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("zstd error: %v", err)
+		}
+		return &journalReader{Reader: zstdReader, closers: []io.Closer{zstdReader.IOReadCloser()}}, nil
+	default:
+		return &journalReader{Reader: buffered}, nil
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package journal
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"unquoted", "@pv@ 9 @db.rev@ 1 0", []string{"pv", "9", "db.rev", "1", "0"}},
+		{"spaces in a value", "@pv@ 0 @db.desc@ 1 @a b  c@ ", []string{"pv", "0", "db.desc", "1", "a b  c"}},
+		{"escaped @", "@pv@ 7 @db.user@ @joe@ @joe@@example.com@", []string{"pv", "7", "db.user", "joe", "joe@example.com"}},
+		{"empty value", "@pv@ 1 @db.depot@ @depot@ 0 @@ @depot/...@", []string{"pv", "1", "db.depot", "depot", "0", "", "depot/..."}},
+		{"only @", "@pv@ 0 @db.desc@ 1 @@@@@@", []string{"pv", "0", "db.desc", "1", "@@"}},
+		{"multi-line value", "@pv@ 0 @db.desc@ 1 @first\r\nsecond\n@ ", []string{"pv", "0", "db.desc", "1", "first\r\nsecond\n"}},
+		{"unterminated value", "@pv@ 0 @db.desc@ 1 @open", []string{"pv", "0", "db.desc", "1", "open"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Split(test.raw); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Split(%q) = %q, want %q", test.raw, got, test.want)
+			}
+		})
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", "@@"},
+		{"joe", "@joe@"},
+		{"joe@example.com", "@joe@@example.com@"},
+		{"@@", "@@@@@@"},
+		{"two words\nand a line", "@two words\nand a line@"},
+	}
+	for _, test := range tests {
+		got := Quote(test.value)
+		if got != test.want {
+			t.Errorf("Quote(%q) = %q, want %q", test.value, got, test.want)
+		}
+		if split := Split(got); len(split) != 1 || split[0] != test.value {
+			t.Errorf("Split(Quote(%q)) = %q, want the value back", test.value, split)
+		}
+	}
+}
+
+func TestIsComplete(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want bool
+	}{
+		{"@pv@ 9 @db.rev@ 1 0\n", true},
+		{"@pv@ 0 @db.desc@ 1 @first line\n", false},
+		{"@pv@ 0 @db.desc@ 1 @first line\nsecond@ \n", true},
+		{"@pv@ 0 @db.desc@ 1 @mail joe@@\n", false},
+		{"@pv@ 0 @db.desc@ 1 @mail joe@@example.com@\n", true},
+		{"@pv@ 0 @db.desc@ 1 @@\n", true},
+	}
+	for _, test := range tests {
+		if got := IsComplete(test.raw); got != test.want {
+			t.Errorf("IsComplete(%q) = %v, want %v", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		journal string
+		want    []Record
+	}{
+		{
+			name:    "records",
+			journal: "@pv@ 1 @db.counters@ @change@ @3@ \n@ex@ 123 1611008050\n",
+			want: []Record{
+				{Operation: PutValue, Version: 1, Table: "db.counters", Fields: []string{"change", "3"},
+					Raw: "@pv@ 1 @db.counters@ @change@ @3@ ", LineNumber: 1, Offset: 0},
+				{Operation: EndTransaction, Fields: []string{"123", "1611008050"},
+					Raw: "@ex@ 123 1611008050", LineNumber: 2, Offset: 35},
+			},
+		},
+		{
+			name:    "multi-line value",
+			journal: "@pv@ 0 @db.desc@ 1 @first\nmail joe@@\nexample.com@ \n@pv@ 1 @db.counters@ @change@ @1@ \n",
+			want: []Record{
+				{Operation: PutValue, Version: 0, Table: "db.desc", Fields: []string{"1", "first\nmail joe@\nexample.com"},
+					Raw: "@pv@ 0 @db.desc@ 1 @first\nmail joe@@\nexample.com@ ", LineNumber: 1, Offset: 0},
+				{Operation: PutValue, Version: 1, Table: "db.counters", Fields: []string{"change", "1"},
+					Raw: "@pv@ 1 @db.counters@ @change@ @1@ ", LineNumber: 4, Offset: 51},
+			},
+		},
+		{
+			name:    "crlf line endings",
+			journal: "@pv@ 0 @db.desc@ 1 @first\r\r\nsecond@ \r\n@pv@ 1 @db.counters@ @change@ @1@ \r\n",
+			want: []Record{
+				{Operation: PutValue, Version: 0, Table: "db.desc", Fields: []string{"1", "first\nsecond"},
+					Raw: "@pv@ 0 @db.desc@ 1 @first\nsecond@ ", LineNumber: 1, Offset: 0},
+				{Operation: PutValue, Version: 1, Table: "db.counters", Fields: []string{"change", "1"},
+					Raw: "@pv@ 1 @db.counters@ @change@ @1@ ", LineNumber: 3, Offset: 38},
+			},
+		},
+		{
+			name:    "blank lines and no final newline",
+			journal: "\n@pv@ 1 @db.counters@ @change@ @1@ \n\n@pv@ 1 @db.counters@ @journal@ @2@ ",
+			want: []Record{
+				{Operation: PutValue, Version: 1, Table: "db.counters", Fields: []string{"change", "1"},
+					Raw: "@pv@ 1 @db.counters@ @change@ @1@ ", LineNumber: 2, Offset: 1},
+				{Operation: PutValue, Version: 1, Table: "db.counters", Fields: []string{"journal", "2"},
+					Raw: "@pv@ 1 @db.counters@ @journal@ @2@ ", LineNumber: 4, Offset: 37},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []Record
+			err := Scan(strings.NewReader(test.journal), func(record Record) error {
+				got = append(got, record)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Scan() returned %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Scan() records =\n%+v\nwant\n%+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestScanMaxLineBytes(t *testing.T) {
+	defer func(limit int) { maxLineBytes = limit }(maxLineBytes)
+	maxLineBytes = 64
+	tests := []struct {
+		name    string
+		journal string
+		records int
+		wantErr string
+	}{
+		{
+			name:    "within the limit",
+			journal: "@pv@ 1 @db.counters@ @change@ @3@ \n@pv@ 0 @db.desc@ 1 @first\nsecond@ \n",
+			records: 2,
+		},
+		{
+			name:    "long line",
+			journal: "@pv@ 1 @db.counters@ @change@ @3@ \n@pv@ 0 @db.desc@ 1 @" + strings.Repeat("x", 100) + "@ \n",
+			records: 1,
+			wantErr: "db.desc record at line 2 is longer than 64 bytes",
+		},
+		{
+			name:    "unterminated quoted value",
+			journal: "@pv@ 1 @db.counters@ @change@ @3@ \n@pv@ 0 @db.desc@ 1 @first\n" + strings.Repeat("more lines\n", 10),
+			records: 1,
+			wantErr: "db.desc record at line 2 is longer than 64 bytes",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records := 0
+			err := Scan(strings.NewReader(test.journal), func(record Record) error {
+				records++
+				return nil
+			})
+			if records != test.records {
+				t.Errorf("Scan() read %v records, want %v", records, test.records)
+			}
+			if len(test.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("Scan() returned %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrRecordTooLong) || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Scan() returned %v, want ErrRecordTooLong with %q", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package jsonrpc serves the tools over JSON-RPC 2.0 with -jsonrpc, so that Python scripts and
+// automation frameworks can drive them and stream their results instead of parsing logs meant for
+// humans. Requests and responses are JSON objects, one per line, on the standard input and output;
+// the protocol is documented in the README of the repository.
+package jsonrpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Set by the -jsonrpc flag
+var enabled bool
+
+// Registers the -jsonrpc flag. describe lists the flags of the default flag set, so tools register
+// it there along with their own flags.
+func RegisterFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&enabled, "jsonrpc", false, "Serve JSON-RPC 2.0 requests on the standard input and output instead of running once.")
+}
+
+// The version of the protocol returned by describe, only raised by incompatible changes
+const ProtocolVersion = 1
+
+// Error codes, from the JSON-RPC 2.0 specification
+const (
+	ParseError     = -32700
+	InvalidRequest = -32600
+	MethodNotFound = -32601
+	InvalidParams  = -32602
+	// The run couldn't be started
+	StartError = -32000
+)
+
+// Whether -jsonrpc is set. Must be called after flag.Parse.
+func Enabled() bool {
+	return enabled
+}
+
+type request struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// An error response
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type response struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+type notification struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// The result of describe
+type Description struct {
+	Tool     string `json:"tool"`
+	Protocol int    `json:"protocol"`
+	Flags    []Flag `json:"flags"`
+}
+
+// A flag of the tool, as listed by describe
+type Flag struct {
+	Name    string `json:"name"`
+	Usage   string `json:"usage"`
+	Default string `json:"default"`
+}
+
+type runParams struct {
+	Args []string `json:"args"`
+}
+
+// The result of run
+type RunResult struct {
+	ExitCode int `json:"exit_code"`
+}
+
+type cancelParams struct {
+	ID json.RawMessage `json:"id"`
+}
+
+// The result of cancel
+type CancelResult struct {
+	Cancelled bool `json:"cancelled"`
+}
+
+// A line written by a run, sent as an output or stderr notification
+type lineParams struct {
+	ID   json.RawMessage `json:"id"`
+	Line string          `json:"line"`
+}
+
+// A log event of a run, sent as a log notification
+type logParams struct {
+	ID    json.RawMessage `json:"id"`
+	Event json.RawMessage `json:"event"`
+}
+
+type server struct {
+	tool       string
+	executable string
+
+	// Serializes the messages written to the output
+	outputMu sync.Mutex
+	encoder  *json.Encoder
+
+	// The runs in progress, keyed by the compacted JSON of their request id
+	runsMu sync.Mutex
+	runs   map[string]*exec.Cmd
+	wg     sync.WaitGroup
+}
+
+// Serves the requests read from in until its end, writing the responses and notifications to out,
+// then waits for the runs in progress to complete. Each run executes the tool again with the
+// arguments of the request, so that it behaves exactly as from the command line.
+func Serve(in io.Reader, out io.Writer) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error locating the executable: %v", err)
+	}
+	s := &server{
+		tool:       strings.TrimSuffix(filepath.Base(executable), ".exe"),
+		executable: executable,
+		encoder:    json.NewEncoder(out),
+		runs:       make(map[string]*exec.Cmd),
+	}
+	defer s.wg.Wait()
+
+	reader := bufio.NewReader(in)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			s.handle(line)
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading requests: %v", err)
+		}
+	}
+}
+
+func (s *server) send(message interface{}) {
+	s.outputMu.Lock()
+	defer s.outputMu.Unlock()
+	// The client going away ends the runs' output too, there is no one left to report it to
+	_ = s.encoder.Encode(message)
+}
+
+// Replies to a request, unless it's a notification (without id)
+func (s *server) reply(id json.RawMessage, result interface{}, err *Error) {
+	if len(id) == 0 {
+		return
+	}
+	s.send(response{Version: "2.0", ID: id, Result: result, Error: err})
+}
+
+func (s *server) notify(method string, params interface{}) {
+	s.send(notification{Version: "2.0", Method: method, Params: params})
+}
+
+func (s *server) handle(line []byte) {
+	var req request
+	if err := json.Unmarshal(line, &req); err != nil {
+		s.reply(json.RawMessage("null"), nil, &Error{Code: ParseError, Message: err.Error()})
+		return
+	}
+	if req.Version != "2.0" || len(req.Method) == 0 {
+		id := req.ID
+		if len(id) == 0 {
+			id = json.RawMessage("null")
+		}
+		s.reply(id, nil, &Error{Code: InvalidRequest, Message: `expected a "jsonrpc": "2.0" request with a method`})
+		return
+	}
+
+	switch req.Method {
+	case "describe":
+		s.reply(req.ID, s.describe(), nil)
+	case "run":
+		s.run(req)
+	case "cancel":
+		var params cancelParams
+		if err := json.Unmarshal(req.Params, &params); err != nil || len(params.ID) == 0 {
+			s.reply(req.ID, nil, &Error{Code: InvalidParams, Message: "expected the id of the run to cancel"})
+			return
+		}
+		s.reply(req.ID, CancelResult{Cancelled: s.cancel(params.ID)}, nil)
+	default:
+		s.reply(req.ID, nil, &Error{Code: MethodNotFound, Message: fmt.Sprintf("unknown method %v, expected describe, run or cancel", req.Method)})
+	}
+}
+
+func (s *server) describe() Description {
+	description := Description{Tool: s.tool, Protocol: ProtocolVersion, Flags: []Flag{}}
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name != "jsonrpc" {
+			description.Flags = append(description.Flags, Flag{Name: f.Name, Usage: f.Usage, Default: f.DefValue})
+		}
+	})
+	return description
+}
+
+// Returns the key of a request id in the runs map, the same for equivalent JSON
+func runKey(id json.RawMessage) string {
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, id); err != nil {
+		return string(id)
+	}
+	return compacted.String()
+}
+
+// Starts the tool with the arguments of the request. Its output and log events are sent as
+// notifications while it runs, and the response once it exits.
+func (s *server) run(req request) {
+	if len(req.ID) == 0 {
+		// The notifications of the run couldn't be told apart from the others
+		return
+	}
+	var params runParams
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		s.reply(req.ID, nil, &Error{Code: InvalidParams, Message: fmt.Sprintf("expected the arguments of the run: %v", err)})
+		return
+	}
+	for _, arg := range params.Args {
+		if name := strings.TrimLeft(arg, "-"); strings.HasPrefix(arg, "-") && (name == "jsonrpc" || strings.HasPrefix(name, "jsonrpc=")) {
+			s.reply(req.ID, nil, &Error{Code: InvalidParams, Message: "runs can't serve JSON-RPC themselves"})
+			return
+		}
+	}
+
+	key := runKey(req.ID)
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+	if _, ok := s.runs[key]; ok {
+		s.reply(req.ID, nil, &Error{Code: InvalidRequest, Message: fmt.Sprintf("a run with id %v is in progress", key)})
+		return
+	}
+
+	// Later flags override earlier ones, so the arguments may still set another log format
+	cmd := exec.Command(s.executable, append([]string{"-log-format=json"}, params.Args...)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		s.reply(req.ID, nil, &Error{Code: StartError, Message: err.Error()})
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		s.reply(req.ID, nil, &Error{Code: StartError, Message: err.Error()})
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		s.reply(req.ID, nil, &Error{Code: StartError, Message: fmt.Sprintf("error starting %v: %v", s.tool, err)})
+		return
+	}
+	s.runs[key] = cmd
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		var streams sync.WaitGroup
+		streams.Add(2)
+		go func() {
+			defer streams.Done()
+			readLines(stdout, func(line string) {
+				s.notify("output", lineParams{ID: req.ID, Line: line})
+			})
+		}()
+		go func() {
+			defer streams.Done()
+			readLines(stderr, func(line string) {
+				// Events are JSON objects, anything else (usage, panics) is passed as is
+				if strings.HasPrefix(line, "{") && json.Valid([]byte(line)) {
+					s.notify("log", logParams{ID: req.ID, Event: json.RawMessage(line)})
+				} else {
+					s.notify("stderr", lineParams{ID: req.ID, Line: line})
+				}
+			})
+		}()
+		// The pipes must be read to their end before waiting for the process
+		streams.Wait()
+		err := cmd.Wait()
+
+		s.runsMu.Lock()
+		delete(s.runs, key)
+		s.runsMu.Unlock()
+
+		result := RunResult{}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			result.ExitCode = exitErr.ExitCode()
+		} else if err != nil {
+			result.ExitCode = -1
+		}
+		s.reply(req.ID, result, nil)
+	}()
+}
+
+// Interrupts a run like Ctrl-C, which the tools handling it stop cleanly on. Returns false when no
+// run has this id.
+func (s *server) cancel(id json.RawMessage) bool {
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+	cmd, ok := s.runs[runKey(id)]
+	if !ok {
+		return false
+	}
+	// Windows can't interrupt another process
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		cmd.Process.Kill()
+	}
+	return true
+}
+
+// Calls fn with each line read from r, without its line ending
+func readLines(r io.Reader, fn func(line string)) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			fn(strings.TrimRight(line, "\r\n"))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lbr
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The bits of the file types of db.rev besides the storage type, see
+// https://www.perforce.com/perforce/doc.current/schema/#FileType
+const (
+	storageTypeMask    = 0xF
+	keywordsTypeBit    = 0x20
+	oldKeywordsTypeBit = 0x10
+	exclusiveTypeBit   = 0x40
+	executableTypeBit  = 0x20000
+	writableTypeBit    = 0x100000
+	modTimeTypeBit     = 0x200000
+	baseTypeMask       = 0xD0000
+)
+
+var baseTypeNames = map[int]string{
+	0x00000: "text",
+	0x10000: "binary",
+	0x40000: "symlink",
+	0x80000: "unicode",
+}
+
+// The legacy names of file types, see "p4 help filetypes"
+var fileTypeAliases = map[string]string{
+	"ctempobj": "binary+Sw",
+	"ctext":    "text+C",
+	"cxtext":   "text+Cx",
+	"ktext":    "text+k",
+	"kxtext":   "text+kx",
+	"ltext":    "text+F",
+	"tempobj":  "binary+FSw",
+	"ubinary":  "binary+F",
+	"uxbinary": "binary+Fx",
+	"xbinary":  "binary+x",
+	"xltext":   "text+Fx",
+	"xtempobj": "binary+Swx",
+	"xtext":    "text+x",
+	"xunicode": "unicode+x",
+}
+
+// A file type such as text+k or binary+lF. Types without a base type are partial, such as the "+l"
+// entries of typemaps, which only add modifiers to the type of the files. The number of revisions
+// stored (+S) and archive triggers (+X) aren't represented.
+type FileType struct {
+	// text, binary, symlink or unicode
+	Base string
+	// 'C', 'D' or 'F', or 0 for the default storage of the base type (+C for binary, +D otherwise)
+	Storage byte
+	// "k" or "ko" for files with their RCS keywords expanded
+	Keywords   string
+	Exclusive  bool
+	Executable bool
+	Writable   bool
+	ModTime    bool
+}
+
+func defaultStorage(base string) byte {
+	if base == "binary" {
+		return 'C'
+	}
+	return 'D'
+}
+
+func (t FileType) normalize() FileType {
+	if len(t.Base) > 0 && t.Storage == defaultStorage(t.Base) {
+		t.Storage = 0
+	}
+	return t
+}
+
+// Returns the base type (text, binary, symlink or unicode) of a file type of db.rev, or of a
+// librarian type of db.storage, or false for the base types not supported, such as utf16
+func BaseType(bits int) (string, bool) {
+	base, ok := baseTypeNames[bits&baseTypeMask]
+	return base, ok
+}
+
+// Decodes the file type of a db.rev record. Tiny files (stored in db.revtx) get the default
+// storage of their base type, as p4d picks it by itself.
+func DecodeFileType(bits int) (FileType, error) {
+	knownBits := storageTypeMask | keywordsTypeBit | oldKeywordsTypeBit | exclusiveTypeBit | executableTypeBit |
+		writableTypeBit | modTimeTypeBit | baseTypeMask
+	base, ok := baseTypeNames[bits&baseTypeMask]
+	if !ok || bits&^knownBits != 0 || bits&(keywordsTypeBit|oldKeywordsTypeBit) == oldKeywordsTypeBit {
+		return FileType{}, fmt.Errorf("unsupported file type %#x", bits)
+	}
+	t := FileType{
+		Base:       base,
+		Exclusive:  bits&exclusiveTypeBit != 0,
+		Executable: bits&executableTypeBit != 0,
+		Writable:   bits&writableTypeBit != 0,
+		ModTime:    bits&modTimeTypeBit != 0,
+	}
+	if bits&keywordsTypeBit != 0 {
+		t.Keywords = "k"
+		if bits&oldKeywordsTypeBit != 0 {
+			t.Keywords = "ko"
+		}
+	}
+	switch StorageType(bits) {
+	case RCSStorageType:
+		t.Storage = 'D'
+	case BinaryStorageType:
+		t.Storage = 'F'
+	case CompressedStorageType:
+		t.Storage = 'C'
+	case TinyStorageType:
+	default:
+		return FileType{}, fmt.Errorf("unsupported storage in file type %#x", bits)
+	}
+	return t.normalize(), nil
+}
+
+// Parses a file type such as "binary+l", "ktext" or "+w"
+func ParseFileType(text string) (FileType, error) {
+	name, modifiers, _ := strings.Cut(text, "+")
+	var t FileType
+	if len(name) > 0 {
+		if alias, ok := fileTypeAliases[name]; ok {
+			aliased, _ := ParseFileType(alias)
+			t = aliased
+		} else {
+			for _, base := range baseTypeNames {
+				if name == base {
+					t.Base = name
+				}
+			}
+			if len(t.Base) == 0 {
+				return FileType{}, fmt.Errorf("unknown file type %q", text)
+			}
+		}
+	} else if len(modifiers) == 0 {
+		return FileType{}, fmt.Errorf("empty file type")
+	}
+	for i := 0; i < len(modifiers); i++ {
+		switch c := modifiers[i]; c {
+		case 'k':
+			t.Keywords = "k"
+			if i+1 < len(modifiers) && modifiers[i+1] == 'o' {
+				t.Keywords = "ko"
+				i++
+			}
+		case 'l':
+			t.Exclusive = true
+		case 'x':
+			t.Executable = true
+		case 'w':
+			t.Writable = true
+		case 'm':
+			t.ModTime = true
+		case 'C', 'D', 'F':
+			t.Storage = c
+		case 'S':
+			for i+1 < len(modifiers) && modifiers[i+1] >= '0' && modifiers[i+1] <= '9' {
+				i++
+			}
+		case 'X':
+		default:
+			return FileType{}, fmt.Errorf("unknown modifier %q in file type %q", c, text)
+		}
+	}
+	return t.normalize(), nil
+}
+
+// Returns the librarian type of the archives of a file type such as "text", "binary+F" or "ctempobj",
+// as listed by p4 fstat -Oc: its base type and storage type bits, as in db.storage. The modifiers
+// without effect on the archives, such as +l or +x, are left out.
+func LibrarianType(text string) (int, error) {
+	name, modifiers, _ := strings.Cut(text, "+")
+	if alias, ok := fileTypeAliases[name]; ok {
+		aliasName, aliasModifiers, _ := strings.Cut(alias, "+")
+		name, modifiers = aliasName, aliasModifiers+modifiers
+	}
+	t, err := ParseFileType(name + "+" + modifiers)
+	if err != nil {
+		return 0, err
+	}
+	if t.Partial() {
+		return 0, fmt.Errorf("file type %q has no base type", text)
+	}
+	bits := 0
+	for baseBits, base := range baseTypeNames {
+		if base == t.Base {
+			bits = baseBits
+		}
+	}
+	storage := t.Storage
+	if storage == 0 {
+		storage = defaultStorage(t.Base)
+	}
+	switch {
+	// Archive triggers (+X) and the temporary objects (+S without a number of revisions) aren't
+	// represented in FileType
+	case strings.Contains(modifiers, "X"):
+		return bits | ExternalStorageType, nil
+	case strings.Contains(modifiers, "S") && !strings.ContainsAny(modifiers[strings.Index(modifiers, "S")+1:], "0123456789"):
+		if storage == 'C' {
+			return bits | CompressedTempObj, nil
+		}
+		return bits | TempObjStorageType, nil
+	case storage == 'F':
+		return bits | BinaryStorageType, nil
+	case storage == 'C':
+		return bits | CompressedStorageType, nil
+	}
+	return bits | int(RCSStorageType), nil
+}
+
+// Reports whether the type is partial, only adding modifiers
+func (t FileType) Partial() bool {
+	return len(t.Base) == 0
+}
+
+// Returns the type of a file once a type is applied to it: the other type itself, or this type
+// with its modifiers added when it's partial
+func (t FileType) With(other FileType) FileType {
+	if !other.Partial() {
+		return other
+	}
+	if other.Storage != 0 {
+		t.Storage = other.Storage
+	}
+	if len(other.Keywords) > 0 {
+		t.Keywords = other.Keywords
+	}
+	t.Exclusive = t.Exclusive || other.Exclusive
+	t.Executable = t.Executable || other.Executable
+	t.Writable = t.Writable || other.Writable
+	t.ModTime = t.ModTime || other.ModTime
+	return t.normalize()
+}
+
+// Formats the type with its modifiers, for example "text+kx" or "binary+lF"
+func (t FileType) String() string {
+	var modifiers strings.Builder
+	modifiers.WriteString(t.Keywords)
+	if t.ModTime {
+		modifiers.WriteByte('m')
+	}
+	if t.Writable {
+		modifiers.WriteByte('w')
+	}
+	if t.Executable {
+		modifiers.WriteByte('x')
+	}
+	if t.Exclusive {
+		modifiers.WriteByte('l')
+	}
+	if t.Storage != 0 {
+		modifiers.WriteByte(t.Storage)
+	}
+	if modifiers.Len() == 0 {
+		return t.Base
+	}
+	return t.Base + "+" + modifiers.String()
+}
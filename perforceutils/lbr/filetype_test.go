@@ -0,0 +1,77 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lbr
+
+import "testing"
+
+func TestDecodeFileType(t *testing.T) {
+	tests := []struct {
+		bits int
+		want string
+	}{
+		{0x0, "text"},
+		{0x10003, "binary"},
+		{0x10001, "binary+F"},
+		{0x20, "text+k"},
+		{0x30, "text+ko"},
+		{0x40, "text+l"},
+		{0x20000, "text+x"},
+		{0x80000, "unicode"},
+		{0x40000, "symlink"},
+	}
+	for _, test := range tests {
+		got, err := DecodeFileType(test.bits)
+		if err != nil {
+			t.Errorf("DecodeFileType(%#x) returned %v", test.bits, err)
+			continue
+		}
+		if got.String() != test.want {
+			t.Errorf("DecodeFileType(%#x) = %v, want %v", test.bits, got, test.want)
+		}
+	}
+	if _, err := DecodeFileType(0x10); err == nil {
+		t.Errorf("DecodeFileType(0x10) returned no error for the old keywords bit alone")
+	}
+}
+
+func TestParseFileType(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"binary+l", "binary+l"},
+		{"ktext", "text+k"},
+		{"ubinary", "binary+F"},
+		{"binary+C", "binary"},
+		{"+w", "+w"},
+	}
+	for _, test := range tests {
+		got, err := ParseFileType(test.text)
+		if err != nil {
+			t.Errorf("ParseFileType(%v) returned %v", test.text, err)
+			continue
+		}
+		if got.String() != test.want {
+			t.Errorf("ParseFileType(%v) = %v, want %v", test.text, got, test.want)
+		}
+	}
+	partial, _ := ParseFileType("+l")
+	base, _ := ParseFileType("binary")
+	if got := base.With(partial).String(); got != "binary+l" {
+		t.Errorf("binary with +l = %v, want binary+l", got)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package lbr maps the librarian records of a checkpoint (db.storage, db.rev and db.revsh) to the
+// archive files p4d stores them in under the depot root.
+package lbr
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+	"github.com/google/perforce-utils/perforceutils/schema"
+)
+
+// https://www.perforce.com/perforce/doc.current/schema/#FileType
+type ServerStorageType int
+
+const (
+	RCSStorageType          ServerStorageType = 0
+	BinaryStorageType                         = 1
+	TinyStorageType                           = 2
+	CompressedStorageType                     = 3
+	TempObjStorageType                        = 4
+	DetectTypeStorageType                     = 5
+	CompressedTempObj                         = 6
+	BinaryAccessStorageType                   = 7
+	ExternalStorageType                       = 8
+)
+
+// Returns the server storage type of a librarian file type
+func StorageType(lbrType int) ServerStorageType {
+	return ServerStorageType(lbrType & 0xF)
+}
+
+// Returns the path of a librarian file revision, relative to the depot root.
+// Compressed revisions may additionally have a .gz suffix.
+func VersionedFilePath(lbrFile string, lbrRev string, lbrType int) string {
+	if StorageType(lbrType) == RCSStorageType {
+		return lbrFile + ",v/" + lbrRev
+	}
+	return lbrFile + ",d/" + lbrRev
+}
+
+// Returns the librarian type a shelved revision is stored as. Shelved files are stored as full
+// files named after the shelving change (file,d/1.<change>.gz), even when their type is stored in
+// RCS files once submitted; p4d only writes RCS deltas on submit.
+func ShelvedStorageType(lbrType int) int {
+	if StorageType(lbrType) == RCSStorageType {
+		return lbrType&^0xF | CompressedStorageType
+	}
+	return lbrType
+}
+
+// Returns the path of the archive of a shelved revision, relative to the depot root.
+// Compressed archives may additionally have a .gz suffix.
+func ShelvedFilePath(lbrFile string, lbrRev string, lbrType int) string {
+	return VersionedFilePath(lbrFile, lbrRev, ShelvedStorageType(lbrType))
+}
+
+// Returns the depot name of a depot-absolute path, for example "depot" for //depot/file.txt
+func DepotName(path string) string {
+	name := strings.TrimPrefix(path, "//")
+	if i := strings.Index(name, "/"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// The archive directories of the depots whose Map field doesn't match their name, keyed by depot
+// name. Directories are relative to the depot root (server.depot.root, or the server root when it
+// isn't set), with forward slashes, unless they are absolute.
+type DepotMaps map[string]string
+
+var errDepotsRead = errors.New("depots read")
+
+var windowsRootPattern = regexp.MustCompile(`^[A-Za-z]:\\|^\\\\`)
+
+// Returns the archive directory of a depot Map field such as "depot/..." or "/mnt/archives/depot/..."
+func depotMapDir(depotMap string) string {
+	dir := strings.TrimSuffix(depotMap, "...")
+	if !isAbsolute(dir) {
+		dir = strings.ReplaceAll(dir, "\\", "/")
+	}
+	return strings.TrimRight(dir, "/\\")
+}
+
+func isAbsolute(dir string) bool {
+	return filepath.IsAbs(dir) || strings.HasPrefix(dir, "/") || windowsRootPattern.MatchString(dir)
+}
+
+// Calls fn for the depots of db.depot. Checkpoints write the records of a table together, but not
+// always in the order of the table names, so the records are read until another table follows
+// db.depot.
+func scanDepots(r io.Reader, fn func(depot schema.Depot)) error {
+	depotsSeen := false
+	err := journal.Scan(r, func(record journal.Record) error {
+		switch {
+		case !record.IsTableOperation():
+		case record.Table == "db.depot":
+			depotsSeen = true
+			var depot schema.Depot
+			if record.Operation != journal.PutValue || len(record.Fields) < len(schema.Tables["db.depot"].Fields) ||
+				schema.Unmarshal(record, &depot) != nil {
+				return nil
+			}
+			fn(depot)
+		case depotsSeen:
+			return errDepotsRead
+		}
+		return nil
+	})
+	if err != nil && err != errDepotsRead {
+		return err
+	}
+	return nil
+}
+
+// Reads the depots whose archives aren't stored in a directory named after them, from a
+// checkpoint. The records after db.depot aren't read.
+func ReadDepotMaps(r io.Reader) (DepotMaps, error) {
+	depots := make(DepotMaps)
+	err := scanDepots(r, func(depot schema.Depot) {
+		if dir := depotMapDir(depot.Map); len(dir) > 0 && dir != depot.Name {
+			depots[depot.Name] = dir
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return depots, nil
+}
+
+// The type of a depot, see https://www.perforce.com/perforce/doc.current/schema/#DepotType
+type DepotType int
+
+const (
+	LocalDepotType     DepotType = 0
+	RemoteDepotType              = 1
+	SpecDepotType                = 2
+	StreamDepotType              = 3
+	ArchiveDepotType             = 4
+	UnloadDepotType              = 5
+	TangentDepotType             = 6
+	GraphDepotType               = 7
+	ExtensionDepotType           = 8
+)
+
+// Reads the type of the depots of a checkpoint, keyed by depot name. The records after db.depot
+// aren't read.
+func ReadDepotTypes(r io.Reader) (map[string]DepotType, error) {
+	depots := make(map[string]DepotType)
+	err := scanDepots(r, func(depot schema.Depot) {
+		depots[depot.Name] = DepotType(depot.Type)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return depots, nil
+}
+
+// Returns the directory a depot is stored in under the depot root, or as an absolute path
+func (m DepotMaps) Dir(depotRoot string, depot string) string {
+	dir, ok := m[depot]
+	if !ok {
+		return filepath.Join(depotRoot, depot)
+	}
+	if isAbsolute(dir) {
+		return filepath.FromSlash(dir)
+	}
+	return filepath.Join(depotRoot, filepath.FromSlash(dir))
+}
+
+// Returns the location on disk of a depot-absolute path such as //depot/file.txt,d/1.2.gz
+func (m DepotMaps) Path(depotRoot string, path string) string {
+	depot := DepotName(path)
+	rest := strings.TrimPrefix(strings.TrimPrefix(path, "//"), depot)
+	return filepath.Join(m.Dir(depotRoot, depot), filepath.FromSlash(strings.TrimPrefix(rest, "/")))
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lbr
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadDepotTypes(t *testing.T) {
+	// db.upgrades and db.user come before db.depot in the example checkpoint
+	file, err := os.Open("../testdata/example_journal.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	got, err := ReadDepotTypes(file)
+	if err != nil {
+		t.Fatalf("ReadDepotTypes() returned %v", err)
+	}
+	want := map[string]DepotType{".p4-extensions": ExtensionDepotType, "depot": LocalDepotType, "repo": GraphDepotType}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDepotTypes() = %v, want %v", got, want)
+	}
+}
+
+func TestReadDepotMaps(t *testing.T) {
+	checkpoint := `@pv@ 0 @db.user@ @joe@ @joe@@example.com@ @@ 1611008019 1611008019 @joe@ @@ 0 @@ 0 0 0 0 0 0 
+@pv@ 1 @db.depot@ @depot@ 0 @@ @depot/...@ 
+@pv@ 1 @db.depot@ @archived@ 0 @@ @/mnt/archives/old/...@ 
+@pv@ 1 @db.depot@ @moved@ 0 @@ @other/moved/...@ 
+@pv@ 0 @db.domain@ @joe-ws@ 99 @@ @/home/joe@ @@ @@ @joe@ 1611008019 1611008019 0 @@ 0 @@ 0 
+@pv@ 1 @db.depot@ @late@ 0 @@ @elsewhere/...@ 
+`
+	got, err := ReadDepotMaps(strings.NewReader(checkpoint))
+	if err != nil {
+		t.Fatalf("ReadDepotMaps() returned %v", err)
+	}
+	// The records after the db.depot table aren't read
+	want := DepotMaps{"archived": "/mnt/archives/old", "moved": "other/moved"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDepotMaps() = %v, want %v", got, want)
+	}
+}
+
+func TestVersionedFilePath(t *testing.T) {
+	tests := []struct {
+		lbrFile string
+		lbrRev  string
+		lbrType int
+		want    string
+		shelved string
+	}{
+		// text, stored in RCS files once submitted
+		{"//depot/path1/README.txt", "1.2", 0, "//depot/path1/README.txt,v/1.2", "//depot/path1/README.txt,d/1.2"},
+		// binary, compressed full files
+		{"//depot/path1/data1.dat", "1.1", 65539, "//depot/path1/data1.dat,d/1.1", "//depot/path1/data1.dat,d/1.1"},
+		// binary+F, uncompressed full files
+		{"//depot/path1/image.png", "1.4", 65537, "//depot/path1/image.png,d/1.4", "//depot/path1/image.png,d/1.4"},
+	}
+	for _, test := range tests {
+		if got := VersionedFilePath(test.lbrFile, test.lbrRev, test.lbrType); got != test.want {
+			t.Errorf("VersionedFilePath(%v, %v, %v) = %v, want %v", test.lbrFile, test.lbrRev, test.lbrType, got, test.want)
+		}
+		if got := ShelvedFilePath(test.lbrFile, test.lbrRev, test.lbrType); got != test.shelved {
+			t.Errorf("ShelvedFilePath(%v, %v, %v) = %v, want %v", test.lbrFile, test.lbrRev, test.lbrType, got, test.shelved)
+		}
+	}
+}
+
+func TestDepotName(t *testing.T) {
+	for path, want := range map[string]string{
+		"//depot/path1/data1.dat": "depot",
+		"//repo/project/main.go":  "repo",
+		"//spec":                  "spec",
+	} {
+		if got := DepotName(path); got != want {
+			t.Errorf("DepotName(%v) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestDepotMapsPath(t *testing.T) {
+	maps := DepotMaps{"archived": "/mnt/archives/old", "moved": "other/moved"}
+	root := filepath.FromSlash("/p4/1/depots")
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"//depot/path1/data1.dat,d/1.1.gz", "/p4/1/depots/depot/path1/data1.dat,d/1.1.gz"},
+		{"//moved/file.txt,v", "/p4/1/depots/other/moved/file.txt,v"},
+		{"//archived/file.txt,v", "/mnt/archives/old/file.txt,v"},
+	}
+	for _, test := range tests {
+		if got, want := maps.Path(root, test.path), filepath.FromSlash(test.want); got != want {
+			t.Errorf("DepotMaps.Path(%v) = %v, want %v", test.path, got, want)
+		}
+	}
+}
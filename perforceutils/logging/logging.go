@@ -0,0 +1,144 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logging configures the log/slog logger of the tools. Events are written to the standard
+// error as text or, with -log-format=json, as one JSON object per line that log collectors
+// (Splunk, Cloud Logging, ...) can index by field.
+package logging
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Log formats
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+// Set by the -log-format and -log-level flags
+var (
+	format = TextFormat
+	level  = "info"
+
+	// The options set up from the flags, for SetOutput
+	handlerOptions = &slog.HandlerOptions{}
+)
+
+// Common attribute keys, so that events of all tools can be queried the same way
+const (
+	DepotKey      = "depot"
+	PathKey       = "path"
+	RevisionKey   = "revision"
+	TableKey      = "table"
+	LineKey       = "line"
+	OffsetKey     = "offset"
+	ErrorKey      = "error"
+	ErrorClassKey = "error_class"
+	CountKey      = "count"
+	BytesKey      = "bytes"
+	DurationKey   = "duration"
+)
+
+// Error classes
+const (
+	NotFoundError   = "not_found"
+	PermissionError = "permission"
+	MalformedError  = "malformed"
+	IOError         = "io"
+	// NFS file handles invalidated by the server, typically after a remount or failover
+	StaleHandleError = "stale_handle"
+	// File operations abandoned after a timeout, such as on a hung NFS mount
+	TimeoutError = "timeout"
+	OtherError   = "other"
+)
+
+// Returns the class of an error: not_found, permission, stale_handle, timeout, io or other.
+// Malformed input is reported by the caller, which knows the record that couldn't be parsed.
+func ErrorClass(err error) string {
+	var pathErr *fs.PathError
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return NotFoundError
+	case errors.Is(err, fs.ErrPermission):
+		return PermissionError
+	case errors.Is(err, syscall.ESTALE):
+		return StaleHandleError
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return TimeoutError
+	case errors.As(err, &pathErr):
+		return IOError
+	default:
+		return OtherError
+	}
+}
+
+// Returns the attributes describing an error
+func Err(err error) slog.Attr {
+	return slog.Group("", slog.Any(ErrorKey, err), slog.String(ErrorClassKey, ErrorClass(err)))
+}
+
+// Registers the -log-format and -log-level flags
+func RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&format, "log-format", format, "Log format: text or json.")
+	flags.StringVar(&level, "log-level", level, "Minimum level of the logged events: debug, info, warn or error.")
+}
+
+// Sets up the default logger from the -log-format and -log-level flags. verbose lowers the level to
+// debug, for the tools that have a -verbose flag. Must be called after flag.Parse.
+func Setup(verbose bool) error {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid -log-level %v, expected debug, info, warn or error", level)
+	}
+	if verbose {
+		minLevel = slog.LevelDebug
+	}
+	switch strings.ToLower(format) {
+	case TextFormat, JSONFormat:
+	default:
+		return fmt.Errorf("invalid -log-format %v, expected text or json", format)
+	}
+	handlerOptions = &slog.HandlerOptions{Level: minLevel}
+	SetOutput(os.Stderr)
+	return nil
+}
+
+// Writes the events to w from now on, with the format and level set up by Setup, such as while a
+// full screen interface takes over the terminal
+func SetOutput(w io.Writer) {
+	var handler slog.Handler
+	if strings.ToLower(format) == JSONFormat {
+		handler = slog.NewJSONHandler(w, handlerOptions)
+	} else {
+		handler = slog.NewTextHandler(w, handlerOptions)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// Logs an error and exits with a non-zero exit code
+func Fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics sends scan statistics to StatsD and/or Graphite, so that they can be graphed
+// alongside other Perforce infrastructure metrics.
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Sends gauges and timings to the configured endpoints. A nil *Emitter discards everything,
+// so tools can call it unconditionally.
+type Emitter struct {
+	prefix   string
+	statsd   net.Conn
+	graphite net.Conn
+	err      error
+}
+
+// Connects to a StatsD endpoint (UDP) and/or a Graphite plaintext endpoint (TCP), given as host:port.
+// Returns nil when both addresses are empty. Metric names are prefixed with prefix.
+func Dial(statsdAddress string, graphiteAddress string, prefix string) (*Emitter, error) {
+	if len(statsdAddress) == 0 && len(graphiteAddress) == 0 {
+		return nil, nil
+	}
+	e := &Emitter{prefix: strings.TrimSuffix(prefix, ".")}
+	var err error
+	if len(statsdAddress) > 0 {
+		if e.statsd, err = net.Dial("udp", statsdAddress); err != nil {
+			return nil, fmt.Errorf("statsd connection error: %v", err)
+		}
+	}
+	if len(graphiteAddress) > 0 {
+		if e.graphite, err = net.DialTimeout("tcp", graphiteAddress, 10*time.Second); err != nil {
+			e.Close()
+			return nil, fmt.Errorf("graphite connection error: %v", err)
+		}
+	}
+	return e, nil
+}
+
+var invalidNameCharacters = regexp.MustCompile(`[^A-Za-z0-9_\-]+`)
+
+// Turns a depot name or path into a single metric name component
+func Sanitize(name string) string {
+	return strings.Trim(invalidNameCharacters.ReplaceAllString(name, "_"), "_")
+}
+
+func (e *Emitter) name(name string) string {
+	if len(e.prefix) == 0 {
+		return name
+	}
+	return e.prefix + "." + name
+}
+
+func (e *Emitter) send(statsdLine string, graphiteLine string) {
+	if e.statsd != nil {
+		if _, err := e.statsd.Write([]byte(statsdLine)); err != nil && e.err == nil {
+			e.err = fmt.Errorf("statsd write error: %v", err)
+		}
+	}
+	if e.graphite != nil {
+		if _, err := e.graphite.Write([]byte(graphiteLine)); err != nil && e.err == nil {
+			e.err = fmt.Errorf("graphite write error: %v", err)
+		}
+	}
+}
+
+// Records the current value of a metric, such as a number of missing files
+func (e *Emitter) Gauge(name string, value int64) {
+	if e == nil {
+		return
+	}
+	name = e.name(name)
+	e.send(fmt.Sprintf("%v:%v|g", name, value), fmt.Sprintf("%v %v %v\n", name, value, time.Now().Unix()))
+}
+
+// Records a duration, in milliseconds
+func (e *Emitter) Timing(name string, duration time.Duration) {
+	if e == nil {
+		return
+	}
+	name = e.name(name)
+	milliseconds := duration.Milliseconds()
+	e.send(fmt.Sprintf("%v:%v|ms", name, milliseconds), fmt.Sprintf("%v %v %v\n", name, milliseconds, time.Now().Unix()))
+}
+
+// Closes the connections. Returns the first error that occurred while sending metrics.
+func (e *Emitter) Close() error {
+	if e == nil {
+		return nil
+	}
+	for _, conn := range []net.Conn{e.statsd, e.graphite} {
+		if conn != nil {
+			if err := conn.Close(); err != nil && e.err == nil {
+				e.err = err
+			}
+		}
+	}
+	return e.err
+}
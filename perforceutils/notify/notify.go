@@ -0,0 +1,159 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package notify sends the summary of a run, or the alerts of a long-running tool, to a Slack
+// webhook and/or by email, so that unattended runs surface problems without anyone reading their logs.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// The outcome of a run
+type Summary struct {
+	// The name of the tool, for example p4_find_missing_files
+	Tool string
+	// The error that ended the run, nil if it finished
+	Err      error
+	Scanned  int
+	Missing  int
+	Duration time.Duration
+	// The URL or path of the report of the run, if any
+	Report string
+}
+
+// The one-line summary, used as the email subject
+func (s Summary) Title() string {
+	host, _ := os.Hostname()
+	switch {
+	case s.Err != nil:
+		return fmt.Sprintf("%v on %v failed", s.Tool, host)
+	case s.Missing > 0:
+		return fmt.Sprintf("%v on %v: %v missing files", s.Tool, host, s.Missing)
+	}
+	return fmt.Sprintf("%v on %v: no missing files", s.Tool, host)
+}
+
+// The title followed by the details of the run
+func (s Summary) Text() string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "%v\n\n", s.Title())
+	if s.Err != nil {
+		fmt.Fprintf(&text, "Error: %v\n", s.Err)
+	}
+	fmt.Fprintf(&text, "Scanned: %v\nMissing: %v\nDuration: %v\n", s.Scanned, s.Missing, s.Duration.Round(time.Second))
+	if len(s.Report) > 0 {
+		fmt.Fprintf(&text, "Report: %v\n", s.Report)
+	}
+	return text.String()
+}
+
+// Sends summaries to the configured destinations. A nil *Notifier discards everything,
+// so tools can call it unconditionally.
+type Notifier struct {
+	slackWebhook string
+	// Comma-separated addresses
+	email      string
+	smtpServer string
+	from       string
+	client     *http.Client
+}
+
+// Returns a notifier posting to a Slack incoming webhook URL and/or emailing comma-separated
+// addresses through an SMTP server (host:port) that accepts mail without authentication, as
+// local relays do. Returns nil when both the webhook and the addresses are empty.
+func New(slackWebhook string, email string, smtpServer string, from string) *Notifier {
+	if len(slackWebhook) == 0 && len(email) == 0 {
+		return nil
+	}
+	if len(from) == 0 {
+		host, _ := os.Hostname()
+		from = "perforce-utils@" + host
+	}
+	return &Notifier{
+		slackWebhook: slackWebhook,
+		email:        email,
+		smtpServer:   smtpServer,
+		from:         from,
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Sends the summary to all the destinations. Returns the first error, after trying them all.
+func (n *Notifier) Send(summary Summary) error {
+	return n.SendAlert(summary.Title(), summary.Text())
+}
+
+// Sends a message that isn't the summary of a run, such as an alert raised by a long-running tool,
+// to all the destinations. The title is the email subject, the text the message body.
+func (n *Notifier) SendAlert(title string, text string) error {
+	if n == nil {
+		return nil
+	}
+	var firstErr error
+	if len(n.slackWebhook) > 0 {
+		firstErr = n.sendSlack(text)
+	}
+	if len(n.email) > 0 {
+		if err := n.sendEmail(title, text); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (n *Notifier) sendSlack(text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return fmt.Errorf("slack notification error: %v", err)
+	}
+	response, err := n.client.Post(n.slackWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("slack notification error: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack notification error: %v", response.Status)
+	}
+	return nil
+}
+
+func (n *Notifier) sendEmail(title string, text string) error {
+	var to []string
+	for _, address := range strings.Split(n.email, ",") {
+		if address = strings.TrimSpace(address); len(address) > 0 {
+			to = append(to, address)
+		}
+	}
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %v\r\n", n.from)
+	fmt.Fprintf(&message, "To: %v\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: %v\r\n", title)
+	fmt.Fprintf(&message, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+	if err := smtp.SendMail(n.smtpServer, nil, n.from, to, []byte(message.String())); err != nil {
+		return fmt.Errorf("email notification error: %v", err)
+	}
+	return nil
+}
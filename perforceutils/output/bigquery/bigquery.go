@@ -0,0 +1,320 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bigquery registers the bigquery output format, which loads tables into BigQuery.
+// The destination is a table, project.dataset.table, replaced by a load job once all the rows
+// are written. Credentials are the application default credentials, as with gcloud.
+package bigquery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+	"golang.org/x/oauth2/google"
+)
+
+func init() {
+	output.RegisterFormat("bigquery", newWriter)
+}
+
+const (
+	apiURL    = "https://bigquery.googleapis.com/bigquery/v2/projects/"
+	uploadURL = "https://bigquery.googleapis.com/upload/bigquery/v2/projects/"
+	scope     = "https://www.googleapis.com/auth/bigquery"
+
+	pollInterval = 2 * time.Second
+)
+
+type tableReference struct {
+	ProjectID string `json:"projectId"`
+	DatasetID string `json:"datasetId"`
+	TableID   string `json:"tableId"`
+}
+
+type field struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Mode        string `json:"mode"`
+	Description string `json:"description,omitempty"`
+}
+
+type jobError struct {
+	Reason   string `json:"reason"`
+	Location string `json:"location"`
+	Message  string `json:"message"`
+}
+
+// The parts of a job resource used to start a load job and follow it
+type job struct {
+	Configuration struct {
+		Load struct {
+			DestinationTable tableReference `json:"destinationTable"`
+			Schema           struct {
+				Fields []field `json:"fields"`
+			} `json:"schema"`
+			SourceFormat      string `json:"sourceFormat"`
+			WriteDisposition  string `json:"writeDisposition"`
+			CreateDisposition string `json:"createDisposition"`
+		} `json:"load"`
+	} `json:"configuration"`
+	JobReference struct {
+		ProjectID string `json:"projectId,omitempty"`
+		JobID     string `json:"jobId,omitempty"`
+		Location  string `json:"location,omitempty"`
+	} `json:"jobReference"`
+	Status struct {
+		State       string     `json:"state,omitempty"`
+		ErrorResult *jobError  `json:"errorResult,omitempty"`
+		Errors      []jobError `json:"errors,omitempty"`
+	} `json:"status"`
+}
+
+// Writes the rows as JSON lines to a temporary file, loaded by Commit
+type writer struct {
+	destination tableReference
+	table       output.Table
+	temp        *os.File
+	buffer      *bufio.Writer
+	fields      []field
+	types       []string
+	done        bool
+	err         error
+}
+
+// Parses project.dataset.table, or project:dataset.table as bq writes it
+func parseDestination(destination string) (tableReference, error) {
+	parts := strings.Split(strings.Replace(destination, ":", ".", 1), ".")
+	if len(parts) != 3 || len(parts[0]) == 0 || len(parts[1]) == 0 || len(parts[2]) == 0 {
+		return tableReference{}, fmt.Errorf("invalid BigQuery table %q, expected project.dataset.table", destination)
+	}
+	return tableReference{ProjectID: parts[0], DatasetID: parts[1], TableID: parts[2]}, nil
+}
+
+func newWriter(destination string, table output.Table) (output.Writer, error) {
+	reference, err := parseDestination(destination)
+	if err != nil {
+		return nil, err
+	}
+	temp, err := os.CreateTemp("", "bigquery-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file: %v", err)
+	}
+	return &writer{destination: reference, table: table, temp: temp, buffer: bufio.NewWriter(temp)}, nil
+}
+
+// Column names only have letters, digits and underscores, and don't start with a digit
+func columnName(name string) string {
+	sanitized := []byte(name)
+	for i, c := range sanitized {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			sanitized[i] = '_'
+		}
+	}
+	if len(sanitized) == 0 || (sanitized[0] >= '0' && sanitized[0] <= '9') {
+		return "_" + string(sanitized)
+	}
+	return string(sanitized)
+}
+
+func fieldType(outputType string) string {
+	switch outputType {
+	case "integer":
+		return "INTEGER"
+	case "timestamp":
+		return "TIMESTAMP"
+	case "boolean":
+		return "BOOLEAN"
+	}
+	return "STRING"
+}
+
+func (w *writer) Write(row []string) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.fields == nil {
+		for _, name := range row {
+			columnType := w.table.ColumnType(name)
+			w.types = append(w.types, columnType)
+			w.fields = append(w.fields, field{
+				Name:        columnName(name),
+				Type:        fieldType(columnType),
+				Mode:        "NULLABLE",
+				Description: w.table.ColumnDescription(name),
+			})
+		}
+		return nil
+	}
+	var line bytes.Buffer
+	line.WriteByte('{')
+	for i, field := range w.fields {
+		value := interface{}(nil)
+		if i < len(row) {
+			value = output.TypedValue(w.types[i], row[i])
+		}
+		if seconds, ok := value.(int64); ok && w.types[i] == "timestamp" {
+			value = time.Unix(seconds, 0).UTC().Format("2006-01-02 15:04:05")
+		}
+		if i > 0 {
+			line.WriteByte(',')
+		}
+		encoded, _ := json.Marshal(value)
+		fmt.Fprintf(&line, "%q:%s", field.Name, encoded)
+	}
+	line.WriteString("}\n")
+	if _, err := w.buffer.Write(line.Bytes()); err != nil {
+		w.err = fmt.Errorf("error writing temporary file: %v", err)
+	}
+	return w.err
+}
+
+// Starts a load job replacing the table, uploading the rows with a resumable upload
+func (w *writer) startLoad(ctx context.Context, client *http.Client) (*job, error) {
+	var load job
+	load.Configuration.Load.DestinationTable = w.destination
+	load.Configuration.Load.Schema.Fields = w.fields
+	load.Configuration.Load.SourceFormat = "NEWLINE_DELIMITED_JSON"
+	load.Configuration.Load.WriteDisposition = "WRITE_TRUNCATE"
+	load.Configuration.Load.CreateDisposition = "CREATE_IF_NEEDED"
+	body, err := json.Marshal(&load)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		uploadURL+url.PathEscape(w.destination.ProjectID)+"/jobs?uploadType=resumable", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error starting the upload: %v", response.Status)
+	}
+	session := response.Header.Get("Location")
+
+	if _, err := w.temp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	info, err := w.temp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	request, err = http.NewRequestWithContext(ctx, http.MethodPut, session, w.temp)
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = info.Size()
+	started := &job{}
+	if err := do(client, request, started); err != nil {
+		return nil, fmt.Errorf("error uploading the rows: %v", err)
+	}
+	return started, nil
+}
+
+// Sends a request and decodes its JSON response
+func do(client *http.Client, request *http.Request, response interface{}) error {
+	result, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+	if result.StatusCode != http.StatusOK && result.StatusCode != http.StatusCreated {
+		message, _ := io.ReadAll(io.LimitReader(result.Body, 4096))
+		return fmt.Errorf("%v: %s", result.Status, bytes.TrimSpace(message))
+	}
+	return json.NewDecoder(result.Body).Decode(response)
+}
+
+// Polls the load job until it's done
+func (w *writer) wait(ctx context.Context, client *http.Client, load *job) error {
+	jobID := load.JobReference.JobID
+	jobURL := apiURL + url.PathEscape(load.JobReference.ProjectID) + "/jobs/" + url.PathEscape(jobID) +
+		"?location=" + url.QueryEscape(load.JobReference.Location)
+	for load.Status.State != "DONE" {
+		time.Sleep(pollInterval)
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, jobURL, nil)
+		if err != nil {
+			return err
+		}
+		load = &job{}
+		if err := do(client, request, load); err != nil {
+			return fmt.Errorf("error getting the state of load job %v: %v", jobID, err)
+		}
+	}
+	if result := load.Status.ErrorResult; result != nil {
+		for _, detail := range load.Status.Errors {
+			slog.Error("Load job error", "reason", detail.Reason, "location", detail.Location, logging.ErrorKey, detail.Message)
+		}
+		return fmt.Errorf("load job %v failed: %v", jobID, result.Message)
+	}
+	return nil
+}
+
+func (w *writer) Commit() error {
+	if w.done {
+		return fmt.Errorf("table %v already loaded", w.table.Name)
+	}
+	defer w.Close()
+	if w.err == nil && w.fields == nil {
+		w.err = fmt.Errorf("error loading %v: no header", w.table.Name)
+	}
+	if w.err == nil {
+		if err := w.buffer.Flush(); err != nil {
+			w.err = fmt.Errorf("error writing temporary file: %v", err)
+		}
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	ctx := context.Background()
+	client, err := google.DefaultClient(ctx, scope)
+	if err != nil {
+		return fmt.Errorf("error getting BigQuery credentials: %v", err)
+	}
+	load, err := w.startLoad(ctx, client)
+	if err != nil {
+		return fmt.Errorf("error loading %v.%v.%v: %v", w.destination.ProjectID, w.destination.DatasetID, w.destination.TableID, err)
+	}
+	slog.Info("Started load job", "job", load.JobReference.JobID, "table", w.destination.DatasetID+"."+w.destination.TableID)
+	return w.wait(ctx, client, load)
+}
+
+func (w *writer) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.temp.Close()
+	return os.Remove(w.temp.Name())
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The options of the CSV written by the tools, for the loaders that can't read the default:
+// comma-separated, quoted only when needed, and nothing for empty values
+var (
+	csvDelimiter = ","
+	csvQuoteAll  = false
+	csvNullAs    = ""
+)
+
+// Registers the -delimiter, -quote-all and -null-as flags of the tools writing or reading CSV
+func RegisterCSVFlags(flags *flag.FlagSet) {
+	flags.StringVar(&csvDelimiter, "delimiter", csvDelimiter, "Field delimiter of the csv output, a single character (\\t for tabs).")
+	flags.BoolVar(&csvQuoteAll, "quote-all", csvQuoteAll, "Quote every field of the csv output, not only the ones that need it.")
+	flags.StringVar(&csvNullAs, "null-as", csvNullAs, "Written unquoted in place of the empty fields of the csv output, such as \\N.")
+}
+
+// Returns the delimiter given with -delimiter
+func csvComma() (rune, error) {
+	delimiter := csvDelimiter
+	if delimiter == `\t` {
+		return '\t', nil
+	}
+	comma, size := utf8.DecodeRuneInString(delimiter)
+	if size == 0 || size != len(delimiter) || comma == utf8.RuneError || comma == '"' || comma == '\r' || comma == '\n' {
+		return 0, fmt.Errorf("invalid csv delimiter %q, expected a single character other than a quote or a newline", delimiter)
+	}
+	return comma, nil
+}
+
+// Checks the options of the csv output, so that tools can report them before reading their input
+func CheckCSVOptions() error {
+	_, err := csvComma()
+	return err
+}
+
+// Writes CSV rows with the options given with -delimiter, -quote-all and -null-as, and otherwise
+// exactly as encoding/csv does. Like csv.Writer, errors are returned by Error once flushed.
+type CSVWriter struct {
+	// Writes the rows when only the delimiter is changed
+	csv *csv.Writer
+	// Writes the rows quoted or with null values
+	buffer *bufio.Writer
+	comma  rune
+	err    error
+}
+
+func NewCSVWriter(w io.Writer) *CSVWriter {
+	comma, err := csvComma()
+	if csvQuoteAll || len(csvNullAs) > 0 {
+		return &CSVWriter{buffer: bufio.NewWriter(w), comma: comma, err: err}
+	}
+	writer := csv.NewWriter(w)
+	if err == nil {
+		writer.Comma = comma
+	}
+	return &CSVWriter{csv: writer, comma: comma, err: err}
+}
+
+// Reports whether encoding/csv quotes a field, or whether the field would read as a null value
+func (w *CSVWriter) needsQuotes(field string) bool {
+	if len(field) == 0 {
+		return false
+	}
+	if field == csvNullAs || field == `\.` || strings.ContainsRune(field, w.comma) || strings.ContainsAny(field, "\"\r\n") {
+		return true
+	}
+	first, _ := utf8.DecodeRuneInString(field)
+	return unicode.IsSpace(first)
+}
+
+func (w *CSVWriter) Write(row []string) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.csv != nil {
+		return w.csv.Write(row)
+	}
+	for i, field := range row {
+		if i > 0 {
+			w.buffer.WriteRune(w.comma)
+		}
+		switch {
+		case len(field) == 0 && len(csvNullAs) > 0:
+			// Loaders tell null values from strings by the quotes
+			w.buffer.WriteString(csvNullAs)
+		case csvQuoteAll || w.needsQuotes(field):
+			w.buffer.WriteByte('"')
+			w.buffer.WriteString(strings.ReplaceAll(field, `"`, `""`))
+			w.buffer.WriteByte('"')
+		default:
+			w.buffer.WriteString(field)
+		}
+	}
+	_, w.err = w.buffer.WriteString("\n")
+	return w.err
+}
+
+func (w *CSVWriter) Flush() {
+	if w.csv != nil {
+		w.csv.Flush()
+	} else if w.err == nil {
+		w.err = w.buffer.Flush()
+	}
+}
+
+func (w *CSVWriter) Error() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.csv != nil {
+		return w.csv.Error()
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Sets the csv options for a test through their flags, restoring the defaults once it ends
+func setCSVOptions(t *testing.T, delimiter string, quoteAll bool, nullAs string) {
+	t.Cleanup(func() {
+		csvDelimiter, csvQuoteAll, csvNullAs = ",", false, ""
+	})
+	flags := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	RegisterCSVFlags(flags)
+	args := []string{"-delimiter=" + delimiter, "-quote-all=" + strconv.FormatBool(quoteAll), "-null-as=" + nullAs}
+	if err := flags.Parse(args); err != nil {
+		t.Fatalf("Parse(%q) failed: %v", args, err)
+	}
+}
+
+var testRows = [][]string{
+	{"LibrarianFile", "LibrarianRevision", "Description"},
+	{"//depot/a,b.txt", "1.1", ""},
+	{"//depot/say \"hi\".txt", "1.2", " leading space"},
+	{"//depot/multi.txt", "1.3", "first\nsecond"},
+	{"//depot/null.txt", "1.4", `\N`},
+	{"//depot/end.txt", "1.5", `\.`},
+}
+
+func TestCSVWriter(t *testing.T) {
+	tests := []struct {
+		name      string
+		delimiter string
+		quoteAll  bool
+		nullAs    string
+		want      string
+	}{
+		{
+			name:      "default",
+			delimiter: ",",
+			want: "LibrarianFile,LibrarianRevision,Description\n" +
+				"\"//depot/a,b.txt\",1.1,\n" +
+				"\"//depot/say \"\"hi\"\".txt\",1.2,\" leading space\"\n" +
+				"//depot/multi.txt,1.3,\"first\nsecond\"\n" +
+				"//depot/null.txt,1.4,\\N\n" +
+				"//depot/end.txt,1.5,\"\\.\"\n",
+		},
+		{
+			name:      "tab delimiter",
+			delimiter: `\t`,
+			want: "LibrarianFile\tLibrarianRevision\tDescription\n" +
+				"//depot/a,b.txt\t1.1\t\n" +
+				"\"//depot/say \"\"hi\"\".txt\"\t1.2\t\" leading space\"\n" +
+				"//depot/multi.txt\t1.3\t\"first\nsecond\"\n" +
+				"//depot/null.txt\t1.4\t\\N\n" +
+				"//depot/end.txt\t1.5\t\"\\.\"\n",
+		},
+		{
+			name:      "quote all",
+			delimiter: ";",
+			quoteAll:  true,
+			want: "\"LibrarianFile\";\"LibrarianRevision\";\"Description\"\n" +
+				"\"//depot/a,b.txt\";\"1.1\";\"\"\n" +
+				"\"//depot/say \"\"hi\"\".txt\";\"1.2\";\" leading space\"\n" +
+				"\"//depot/multi.txt\";\"1.3\";\"first\nsecond\"\n" +
+				"\"//depot/null.txt\";\"1.4\";\"\\N\"\n" +
+				"\"//depot/end.txt\";\"1.5\";\"\\.\"\n",
+		},
+		{
+			name:      "null as",
+			delimiter: ",",
+			nullAs:    `\N`,
+			want: "LibrarianFile,LibrarianRevision,Description\n" +
+				"\"//depot/a,b.txt\",1.1,\\N\n" +
+				"\"//depot/say \"\"hi\"\".txt\",1.2,\" leading space\"\n" +
+				"//depot/multi.txt,1.3,\"first\nsecond\"\n" +
+				"//depot/null.txt,1.4,\"\\N\"\n" +
+				"//depot/end.txt,1.5,\"\\.\"\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setCSVOptions(t, test.delimiter, test.quoteAll, test.nullAs)
+			var out strings.Builder
+			writer := NewCSVWriter(&out)
+			for _, row := range testRows {
+				if err := writer.Write(row); err != nil {
+					t.Fatalf("Write(%q) returned %v", row, err)
+				}
+			}
+			writer.Flush()
+			if err := writer.Error(); err != nil {
+				t.Fatalf("Error() = %v", err)
+			}
+			if out.String() != test.want {
+				t.Errorf("wrote\n%v\nwant\n%v", out.String(), test.want)
+			}
+
+			// The rows read back are the ones written, whatever the options
+			path := filepath.Join(t.TempDir(), "rows.csv")
+			if err := os.WriteFile(path, []byte(out.String()), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var read [][]string
+			err := ReadRows(path, func(row []string) error {
+				read = append(read, append([]string{}, row...))
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("ReadRows() returned %v", err)
+			}
+			if !reflect.DeepEqual(read, testRows) {
+				t.Errorf("ReadRows() = %q, want %q", read, testRows)
+			}
+		})
+	}
+}
+
+func TestCSVWriterInvalidDelimiter(t *testing.T) {
+	for _, delimiter := range []string{"", "ab", `"`, "\n", "\r"} {
+		setCSVOptions(t, delimiter, false, "")
+		if err := CheckCSVOptions(); err == nil {
+			t.Errorf("CheckCSVOptions() accepted the delimiter %q", delimiter)
+		}
+		writer := NewCSVWriter(&strings.Builder{})
+		if err := writer.Write([]string{"a"}); err == nil {
+			t.Errorf("Write() with the delimiter %q succeeded, want an error", delimiter)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package output writes the files produced by the tools so that they only appear once complete:
+// an interrupted or failed run leaves the previous file, if any, instead of a truncated one that
+// a loader would ingest.
+package output
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The path that writes to the standard output
+const Stdout = "-"
+
+// An output written to a temporary file in the directory of its destination, and renamed over it
+// by Commit. Outputs to the standard output are written through directly.
+type File struct {
+	path   string
+	temp   *os.File
+	writer *bufio.Writer
+	done   bool
+}
+
+// Creates the output for a path; an empty path or Stdout writes to the standard output.
+// The temporary file is hidden and doesn't have the extension of the destination, so that it isn't
+// picked up by loaders reading a directory.
+func Create(path string) (*File, error) {
+	if len(path) == 0 || path == Stdout {
+		return &File{writer: bufio.NewWriter(os.Stdout)}, nil
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("error creating %v: %v", path, err)
+	}
+	// Temporary files are only readable by their owner, unlike the files the tools used to create
+	if err := temp.Chmod(0644); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return nil, fmt.Errorf("error creating %v: %v", path, err)
+	}
+	return &File{path: path, temp: temp, writer: bufio.NewWriter(temp)}, nil
+}
+
+// The destination path, or Stdout
+func (f *File) Name() string {
+	if f.temp == nil {
+		return Stdout
+	}
+	return f.path
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	return f.writer.Write(p)
+}
+
+func (f *File) WriteString(s string) (int, error) {
+	return f.writer.WriteString(s)
+}
+
+// Completes the output: the temporary file is renamed to the destination, replacing it.
+func (f *File) Commit() error {
+	if f.done {
+		return fmt.Errorf("output %v already closed", f.Name())
+	}
+	f.done = true
+	err := f.writer.Flush()
+	if f.temp == nil {
+		if err != nil {
+			return fmt.Errorf("error writing to the standard output: %v", err)
+		}
+		return nil
+	}
+	if closeErr := f.temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.temp.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.temp.Name())
+		return fmt.Errorf("error writing %v: %v", f.path, err)
+	}
+	return nil
+}
+
+// Discards the output unless it was committed, leaving the destination untouched. Meant to be
+// deferred right after Create.
+func (f *File) Close() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	if f.temp == nil {
+		return f.writer.Flush()
+	}
+	f.temp.Close()
+	return os.Remove(f.temp.Name())
+}
+
+// Writes a file with fn, replacing the destination only when fn and the write succeed
+func WriteFile(path string, fn func(w io.Writer) error) error {
+	file, err := Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := fn(file); err != nil {
+		return err
+	}
+	return file.Commit()
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package parquet registers the parquet output format, which writes tables to Parquet files
+// with columns typed from the schema of the table, and reads them back for output.ReadRows.
+package parquet
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/parquet-go/parquet-go"
+)
+
+func init() {
+	output.RegisterFormat("parquet", newWriter)
+}
+
+// Rows are buffered in memory until a row group is complete
+const rowGroupRows = 1 << 20
+
+// Writes the rows to a File, in row groups compressed with Snappy
+type writer struct {
+	file    *output.File
+	table   output.Table
+	parquet *parquet.Writer
+	// The type and the index in the Parquet schema of each column of the header; the columns of
+	// a Parquet schema are sorted by name
+	types   []string
+	indexes []int
+	rows    []parquet.Row
+	err     error
+}
+
+func newWriter(destination string, table output.Table) (output.Writer, error) {
+	if len(destination) == 0 || destination == output.Stdout {
+		return nil, fmt.Errorf("the parquet format needs an output file")
+	}
+	file, err := output.Create(destination)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{file: file, table: table}, nil
+}
+
+func columnNode(columnType string) parquet.Node {
+	switch columnType {
+	case "integer":
+		return parquet.Optional(parquet.Int(64))
+	case "timestamp":
+		return parquet.Optional(parquet.Timestamp(parquet.Millisecond))
+	case "boolean":
+		return parquet.Optional(parquet.Leaf(parquet.BooleanType))
+	}
+	return parquet.Optional(parquet.String())
+}
+
+func (w *writer) writeHeader(header []string) error {
+	group := make(parquet.Group)
+	for _, name := range header {
+		if _, ok := group[name]; ok {
+			return fmt.Errorf("duplicate column %v", name)
+		}
+		columnType := w.table.ColumnType(name)
+		group[name] = columnNode(columnType)
+		w.types = append(w.types, columnType)
+	}
+	schema := parquet.NewSchema(w.table.Name, group)
+	for _, name := range header {
+		leaf, _ := schema.Lookup(name)
+		w.indexes = append(w.indexes, leaf.ColumnIndex)
+	}
+	w.parquet = parquet.NewWriter(w.file, schema, parquet.Compression(&parquet.Snappy))
+	return nil
+}
+
+func (w *writer) value(column int, value string) parquet.Value {
+	typed := output.TypedValue(w.types[column], value)
+	if typed == nil {
+		return parquet.NullValue().Level(0, 0, w.indexes[column])
+	}
+	var converted parquet.Value
+	switch typed := typed.(type) {
+	case int64:
+		if w.types[column] == "timestamp" {
+			typed *= int64(time.Second / time.Millisecond)
+		}
+		converted = parquet.Int64Value(typed)
+	case bool:
+		converted = parquet.BooleanValue(typed)
+	case string:
+		converted = parquet.ByteArrayValue([]byte(typed))
+	}
+	return converted.Level(0, 1, w.indexes[column])
+}
+
+func (w *writer) Write(row []string) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.parquet == nil {
+		if w.err = w.writeHeader(row); w.err != nil {
+			w.err = fmt.Errorf("error writing parquet: %v", w.err)
+		}
+		return w.err
+	}
+	values := make(parquet.Row, len(w.indexes))
+	for i := range w.indexes {
+		value := ""
+		if i < len(row) {
+			value = row[i]
+		}
+		values[w.indexes[i]] = w.value(i, value)
+	}
+	w.rows = append(w.rows, values)
+	if len(w.rows) >= rowGroupRows {
+		w.err = w.flush()
+	}
+	return w.err
+}
+
+// Writes the buffered rows as a row group
+func (w *writer) flush() error {
+	if _, err := w.parquet.WriteRows(w.rows); err != nil {
+		return fmt.Errorf("error writing parquet: %v", err)
+	}
+	w.rows = w.rows[:0]
+	if err := w.parquet.Flush(); err != nil {
+		return fmt.Errorf("error writing parquet: %v", err)
+	}
+	return nil
+}
+
+func (w *writer) Commit() error {
+	if w.err == nil && w.parquet == nil {
+		w.err = fmt.Errorf("error writing parquet: no header")
+	}
+	if w.err == nil && len(w.rows) > 0 {
+		w.err = w.flush()
+	}
+	if w.err == nil {
+		if err := w.parquet.Close(); err != nil {
+			w.err = fmt.Errorf("error writing parquet: %v", err)
+		}
+	}
+	if w.err != nil {
+		w.file.Close()
+		return w.err
+	}
+	return w.file.Commit()
+}
+
+func (w *writer) Close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parquet
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/output"
+	"github.com/parquet-go/parquet-go"
+)
+
+func init() {
+	output.RegisterReader([]byte("PAR1"), readRows)
+}
+
+// Returns the divisor converting the values of a timestamp column to seconds, or 0 for the other
+// columns
+func timestampDivisor(node parquet.Node) int64 {
+	logicalType := node.Type().LogicalType()
+	if logicalType == nil || logicalType.Timestamp == nil {
+		return 0
+	}
+	switch unit := logicalType.Timestamp.Unit; {
+	case unit.Micros != nil:
+		return 1000 * 1000
+	case unit.Nanos != nil:
+		return 1000 * 1000 * 1000
+	}
+	return 1000
+}
+
+// Reads back the rows of a Parquet file, with the columns in the order of its schema (by name)
+func readRows(path string, fn func(row []string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	reader := parquet.NewReader(file)
+	defer reader.Close()
+	columns := reader.Schema().Columns()
+	header := make([]string, len(columns))
+	divisors := make([]int64, len(columns))
+	for i, path := range columns {
+		header[i] = strings.Join(path, ".")
+		if leaf, ok := reader.Schema().Lookup(path...); ok {
+			divisors[i] = timestampDivisor(leaf.Node)
+		}
+	}
+	if err := fn(header); err != nil {
+		return err
+	}
+
+	rows := make([]parquet.Row, 1024)
+	row := make([]string, len(columns))
+	for {
+		n, err := reader.ReadRows(rows)
+		for _, values := range rows[:n] {
+			for i := range row {
+				row[i] = ""
+			}
+			for _, value := range values {
+				column := value.Column()
+				if column < 0 || column >= len(row) || value.IsNull() {
+					continue
+				}
+				switch value.Kind() {
+				case parquet.Boolean:
+					row[column] = strconv.FormatBool(value.Boolean())
+				case parquet.Int32, parquet.Int64:
+					number := value.Int64()
+					if value.Kind() == parquet.Int32 {
+						number = int64(value.Int32())
+					}
+					if divisors[column] > 0 {
+						number /= divisors[column]
+					}
+					row[column] = strconv.FormatInt(number, 10)
+				default:
+					row[column] = string(value.ByteArray())
+				}
+			}
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading parquet %v: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Reads back the rows of a table written by a tool, calling fn for each; the first row is the
+// header. Values are returned as written to CSV: empty for null values, and timestamps in seconds.
+type ReadRowsFunc func(path string, fn func(row []string) error) error
+
+type rowReader struct {
+	magic []byte
+	read  ReadRowsFunc
+}
+
+var rowReaders []rowReader
+
+// Makes a format whose files start with magic readable by ReadRows. CSV is built in; the other
+// formats register themselves from their own packages, as imported by the tools reading them.
+func RegisterReader(magic []byte, fn ReadRowsFunc) {
+	rowReaders = append(rowReaders, rowReader{magic: magic, read: fn})
+}
+
+// Reads the rows of a file written by a tool in one of the readable formats, selected from the
+// magic bytes of the file: CSV, compressed with gzip or not (as written with -output-dir), and the
+// registered formats. The first row passed to fn is the header. The unquoted CSV fields equal to
+// -null-as are read as empty, so the tools read back the CSV they write with the same options.
+func ReadRows(path string, fn func(row []string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open file error: %v", err)
+	}
+	defer file.Close()
+
+	buffered := bufio.NewReaderSize(file, 64*1024)
+	magic, _ := buffered.Peek(4)
+	for _, reader := range rowReaders {
+		if bytes.HasPrefix(magic, reader.magic) {
+			return reader.read(path, fn)
+		}
+	}
+	var r io.Reader = buffered
+	if bytes.HasPrefix(magic, []byte{0x1f, 0x8b}) {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf("gzip error: %v", err)
+		}
+		defer gzipReader.Close()
+		r = gzipReader
+	}
+	return readCSVRows(path, r, fn)
+}
+
+// Returns the delimiter of a CSV file, the first character of the header that can't be part of a
+// column name, as the file may have been written with -delimiter
+func sniffComma(r *bufio.Reader) rune {
+	header, _ := r.Peek(r.Size())
+	if end := bytes.IndexByte(header, '\n'); end >= 0 {
+		header = header[:end]
+	}
+	for len(header) > 0 {
+		char, size := utf8.DecodeRune(header)
+		if char == '\r' {
+			break
+		}
+		if char != '"' && char != '_' && !unicode.IsLetter(char) && !unicode.IsDigit(char) {
+			return char
+		}
+		header = header[size:]
+	}
+	return ','
+}
+
+// Keeps the bytes of the CSV not yet consumed by csv.Reader, from the start of the current record,
+// so that the fields equal to -null-as can be told quoted (the string) from unquoted (a null value)
+type recordingReader struct {
+	r    io.Reader
+	data []byte
+	// The input offset and line number of the first byte of data
+	offset int64
+	line   int
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.data = append(r.data, p[:n]...)
+	return n, err
+}
+
+// Reports whether the field starting at a line and column (a byte index from 1) is quoted
+func (r *recordingReader) quoted(line int, column int) bool {
+	data := r.data
+	for ; line > r.line; line-- {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			return false
+		}
+		data = data[end+1:]
+	}
+	return column <= len(data) && data[column-1] == '"'
+}
+
+// Drops the bytes before an input offset, once consumed
+func (r *recordingReader) discard(offset int64) {
+	consumed := r.data[:offset-r.offset]
+	r.line += bytes.Count(consumed, []byte{'\n'})
+	r.data = append(r.data[:0], r.data[len(consumed):]...)
+	r.offset = offset
+}
+
+func readCSVRows(path string, r io.Reader, fn func(row []string) error) error {
+	recording := &recordingReader{r: r, line: 1}
+	if len(csvNullAs) > 0 {
+		r = recording
+	}
+	buffered := bufio.NewReaderSize(r, 64*1024)
+	reader := csv.NewReader(buffered)
+	reader.Comma = sniffComma(buffered)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %v: %v", path, err)
+		}
+		if r == recording {
+			// The writer quotes the strings equal to -null-as
+			for i, field := range row {
+				if field == csvNullAs && !recording.quoted(reader.FieldPos(i)) {
+					row[i] = ""
+				}
+			}
+			recording.discard(reader.InputOffset())
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// A column of a CSV output. Columns are only ever appended to a schema, so that the layout of an
+// older version is a prefix of the current one and loaders can keep reading the columns they know.
+type Column struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	// The schema version the column was added in
+	Since int `json:"since"`
+}
+
+// The documented layout of a CSV output, written next to it as a .schema.json sidecar
+type Schema struct {
+	Tool    string   `json:"tool"`
+	Version int      `json:"version"`
+	Columns []Column `json:"columns"`
+}
+
+// The suffix of the sidecar file describing a CSV output
+const SchemaSuffix = ".schema.json"
+
+// Returns the current version of the schema, that of its newest column
+func (s Schema) Latest() int {
+	latest := 0
+	for _, column := range s.Columns {
+		if column.Since > latest {
+			latest = column.Since
+		}
+	}
+	return latest
+}
+
+// Returns the layout of an older version of the schema
+func (s Schema) Select(version int) (Schema, error) {
+	if version < 1 || version > s.Latest() {
+		return Schema{}, fmt.Errorf("unknown schema version %v, expected 1 to %v", version, s.Latest())
+	}
+	selected := Schema{Tool: s.Tool, Version: version}
+	for _, column := range s.Columns {
+		if column.Since <= version {
+			selected.Columns = append(selected.Columns, column)
+		}
+	}
+	return selected, nil
+}
+
+// Returns the header row of the CSV
+func (s Schema) Header() []string {
+	header := make([]string, len(s.Columns))
+	for i, column := range s.Columns {
+		header[i] = column.Name
+	}
+	return header
+}
+
+// Truncates a row holding the columns of the current version to the columns of this version
+func (s Schema) Row(row []string) []string {
+	if len(row) > len(s.Columns) {
+		return row[:len(s.Columns)]
+	}
+	return row
+}
+
+// Writes the schema as JSON
+func (s Schema) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(s)
+}
+
+// Writes the schema sidecar of a CSV output, replacing it only once complete
+func WriteSchema(csvPath string, schema Schema) error {
+	return WriteFile(csvPath+SchemaSuffix, schema.Write)
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sqlite registers the sqlite output format, which writes tables to a SQLite database
+// file, replacing the table of the same name and leaving the other tables of the database.
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/google/perforce-utils/perforceutils/output"
+
+	// Registers the pure Go SQLite driver, so that the tools don't need cgo
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	output.RegisterFormat("sqlite", newWriter)
+}
+
+// Writes the rows in a transaction, so that the table is only replaced once complete
+type writer struct {
+	db     *sql.DB
+	tx     *sql.Tx
+	table  output.Table
+	insert *sql.Stmt
+	types  []string
+	done   bool
+	err    error
+}
+
+func newWriter(destination string, table output.Table) (output.Writer, error) {
+	if len(destination) == 0 || destination == output.Stdout {
+		return nil, fmt.Errorf("the sqlite format needs a database file")
+	}
+	db, err := sql.Open("sqlite", destination)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %v: %v", destination, err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error opening %v: %v", destination, err)
+	}
+	return &writer{db: db, tx: tx, table: table}, nil
+}
+
+func quote(identifier string) string {
+	return `"` + strings.ReplaceAll(identifier, `"`, `""`) + `"`
+}
+
+// Integers, timestamps and booleans are stored as integers, the others as text
+func columnType(outputType string) string {
+	switch outputType {
+	case "integer", "timestamp", "boolean":
+		return "INTEGER"
+	}
+	return "TEXT"
+}
+
+func (w *writer) createTable(header []string) error {
+	columns := make([]string, len(header))
+	placeholders := make([]string, len(header))
+	for i, name := range header {
+		w.types = append(w.types, w.table.ColumnType(name))
+		columns[i] = quote(name) + " " + columnType(w.types[i])
+		placeholders[i] = "?"
+	}
+	statements := []string{
+		"DROP TABLE IF EXISTS " + quote(w.table.Name),
+		"CREATE TABLE " + quote(w.table.Name) + " (" + strings.Join(columns, ", ") + ")",
+	}
+	for _, statement := range statements {
+		if _, err := w.tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	var err error
+	w.insert, err = w.tx.Prepare("INSERT INTO " + quote(w.table.Name) + " VALUES (" + strings.Join(placeholders, ", ") + ")")
+	return err
+}
+
+func (w *writer) Write(row []string) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.insert == nil {
+		if err := w.createTable(row); err != nil {
+			w.err = fmt.Errorf("error creating table %v: %v", w.table.Name, err)
+		}
+		return w.err
+	}
+	values := make([]interface{}, len(w.types))
+	for i := range values {
+		if i < len(row) {
+			values[i] = output.TypedValue(w.types[i], row[i])
+		}
+	}
+	if _, err := w.insert.Exec(values...); err != nil {
+		w.err = fmt.Errorf("error inserting into table %v: %v", w.table.Name, err)
+	}
+	return w.err
+}
+
+func (w *writer) Commit() error {
+	if w.done {
+		return fmt.Errorf("table %v already written", w.table.Name)
+	}
+	if w.err == nil && w.insert == nil {
+		w.err = fmt.Errorf("error creating table %v: no header", w.table.Name)
+	}
+	if w.err != nil {
+		w.Close()
+		return w.err
+	}
+	w.done = true
+	w.insert.Close()
+	err := w.tx.Commit()
+	if closeErr := w.db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error writing table %v: %v", w.table.Name, err)
+	}
+	return nil
+}
+
+func (w *writer) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if w.insert != nil {
+		w.insert.Close()
+	}
+	w.tx.Rollback()
+	return w.db.Close()
+}
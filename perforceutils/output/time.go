@@ -0,0 +1,67 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The time zone of the dates written as RFC 3339 timestamps, so that loaders and spreadsheets don't
+// each convert the dates in seconds since the epoch, and get daylight saving time wrong
+var timeZone = "UTC"
+
+// Registers the -tz flag of the tools writing RFC 3339 timestamps with FormatTimestamp
+func RegisterTimeZoneFlag(flags *flag.FlagSet) {
+	flags.StringVar(&timeZone, "tz", timeZone, "Time zone of the RFC 3339 timestamps written next to the dates in seconds since the epoch, such as America/Los_Angeles (Local for the time zone of this machine).")
+}
+
+var (
+	locationOnce sync.Once
+	location     *time.Location
+	locationErr  error
+)
+
+// Returns the time zone given with -tz
+func Location() (*time.Location, error) {
+	locationOnce.Do(func() {
+		location, locationErr = time.LoadLocation(timeZone)
+		if locationErr != nil {
+			locationErr = fmt.Errorf("invalid time zone %q: %v", timeZone, locationErr)
+		}
+	})
+	return location, locationErr
+}
+
+// Checks the time zone given with -tz, so that tools can report it before reading their input
+func CheckTimeZone() error {
+	_, err := Location()
+	return err
+}
+
+// Formats a date in seconds since the epoch as an RFC 3339 timestamp in the time zone of -tz,
+// such as 2021-01-18T14:13:58-08:00. Dates that aren't set (0) are empty, and so is every date
+// when the time zone is invalid.
+func FormatTimestamp(seconds int64) string {
+	location, err := Location()
+	if err != nil || seconds == 0 {
+		return ""
+	}
+	return time.Unix(seconds, 0).In(location).Format(time.RFC3339)
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Writes the rows of a table in one of the registered formats. The first row written is the
+// header. Like Files, the rows only replace the destination once committed.
+//
+// Write errors are also returned by Commit, so that callers can check them once.
+type Writer interface {
+	Write(row []string) error
+	// Completes the output, replacing the previous file or table at the destination
+	Commit() error
+	// Discards the output unless it was committed. Meant to be deferred right after NewWriter.
+	Close() error
+}
+
+// A table written by a tool: its name, used by the formats that store several tables, and the
+// types of its columns. Columns missing from the schema are strings.
+type Table struct {
+	Name   string
+	Schema Schema
+}
+
+// Returns the type of a column, from the schema of the table
+func (t Table) ColumnType(name string) string {
+	for _, column := range t.Schema.Columns {
+		if column.Name == name {
+			return column.Type
+		}
+	}
+	return "string"
+}
+
+// Returns the description of a column, from the schema of the table
+func (t Table) ColumnDescription(name string) string {
+	for _, column := range t.Schema.Columns {
+		if column.Name == name {
+			return column.Description
+		}
+	}
+	return ""
+}
+
+// Creates a Writer for a destination: a path, or a table of a database or service
+type NewWriterFunc func(destination string, table Table) (Writer, error)
+
+var writerFormats = make(map[string]NewWriterFunc)
+
+// Makes a format available to NewWriter. csv and json are built in; the formats depending on
+// other modules (parquet, sqlite and bigquery) register themselves from their own packages, which
+// only the tools offering them import, so that the others don't link their dependencies.
+func RegisterFormat(name string, fn NewWriterFunc) {
+	writerFormats[name] = fn
+}
+
+// Returns the names of the registered formats
+func Formats() []string {
+	names := make([]string, 0, len(writerFormats))
+	for name := range writerFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The usage of the -format flag of the tools writing tables
+func FormatUsage() string {
+	return "Output format: " + strings.Join(Formats(), ", ") + "."
+}
+
+// Returns an error for a format that isn't registered, or for invalid csv options, so that tools
+// can check their flags before reading their input
+func CheckFormat(format string) error {
+	if _, ok := writerFormats[format]; !ok {
+		return fmt.Errorf("unknown output format %v, expected one of %v", format, strings.Join(Formats(), ", "))
+	}
+	if format == "csv" {
+		return CheckCSVOptions()
+	}
+	return nil
+}
+
+// Creates a Writer for a table in a registered format
+func NewWriter(format string, destination string, table Table) (Writer, error) {
+	if err := CheckFormat(format); err != nil {
+		return nil, err
+	}
+	return writerFormats[format](destination, table)
+}
+
+// Writes a table with fn, replacing the destination only when fn and the writes succeed. Like
+// WriteFile, for the tools that write a single table.
+func WriteTable(format string, destination string, table Table, fn func(w Writer) error) error {
+	out, err := NewWriter(format, destination, table)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := fn(out); err != nil {
+		return err
+	}
+	return out.Commit()
+}
+
+// Converts a value to the type of its column, for the formats that have types: integers and
+// timestamps (seconds since the epoch) to int64, booleans to bool, and the others unchanged.
+// Empty values and values that don't parse as their type are nil.
+func TypedValue(columnType string, value string) interface{} {
+	if len(value) == 0 {
+		return nil
+	}
+	switch columnType {
+	case "integer", "timestamp":
+		if number, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return number
+		}
+		return nil
+	case "boolean":
+		if boolean, err := strconv.ParseBool(value); err == nil {
+			return boolean
+		}
+		return nil
+	}
+	return value
+}
+
+func init() {
+	RegisterFormat("csv", newCSVWriter)
+	RegisterFormat("json", newJSONWriter)
+}
+
+// Writes the rows as CSV to a File
+type csvWriter struct {
+	file *File
+	csv  *CSVWriter
+}
+
+func newCSVWriter(destination string, table Table) (Writer, error) {
+	file, err := Create(destination)
+	if err != nil {
+		return nil, err
+	}
+	return &csvWriter{file: file, csv: NewCSVWriter(file)}, nil
+}
+
+func (w *csvWriter) Write(row []string) error {
+	return w.csv.Write(row)
+}
+
+func (w *csvWriter) Commit() error {
+	w.csv.Flush()
+	if err := w.csv.Error(); err != nil {
+		w.file.Close()
+		return fmt.Errorf("error writing csv: %v", err)
+	}
+	return w.file.Commit()
+}
+
+func (w *csvWriter) Close() error {
+	return w.file.Close()
+}
+
+// Writes the rows to a File as JSON lines: an object per row, with the columns of the header
+// as keys, in order, and the values typed from the schema of the table
+type jsonWriter struct {
+	file   *File
+	table  Table
+	header []string
+	types  []string
+	line   bytes.Buffer
+	err    error
+}
+
+func newJSONWriter(destination string, table Table) (Writer, error) {
+	file, err := Create(destination)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonWriter{file: file, table: table}, nil
+}
+
+func (w *jsonWriter) Write(row []string) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.header == nil {
+		w.header = append([]string{}, row...)
+		for _, name := range w.header {
+			w.types = append(w.types, w.table.ColumnType(name))
+		}
+		return nil
+	}
+	w.line.Reset()
+	w.line.WriteByte('{')
+	for i, name := range w.header {
+		value := interface{}(nil)
+		if i < len(row) {
+			value = TypedValue(w.types[i], row[i])
+		}
+		if i > 0 {
+			w.line.WriteByte(',')
+		}
+		key, _ := json.Marshal(name)
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			w.err = fmt.Errorf("error writing json: %v", err)
+			return w.err
+		}
+		w.line.Write(key)
+		w.line.WriteByte(':')
+		w.line.Write(encoded)
+	}
+	w.line.WriteString("}\n")
+	if _, err := w.file.Write(w.line.Bytes()); err != nil {
+		w.err = fmt.Errorf("error writing json: %v", err)
+	}
+	return w.err
+}
+
+func (w *jsonWriter) Commit() error {
+	if w.err != nil {
+		w.file.Close()
+		return w.err
+	}
+	return w.file.Commit()
+}
+
+func (w *jsonWriter) Close() error {
+	return w.file.Close()
+}
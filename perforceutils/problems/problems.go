@@ -0,0 +1,146 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package problems writes the reports of the tools checking the consistency of checkpoints: the
+// problems they found, sorted so that each run lists the same ones first, and truncated to
+// -max-problems once all of them are counted.
+package problems
+
+import (
+	"flag"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/perforce-utils/perforceutils/logging"
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+// The options of a report, set by the flags of the tool
+type Options struct {
+	// The file or table to write the problems to, the standard output by default
+	Output string
+	// The output format, one of output.Formats
+	Format string
+	// The number of problems listed, the others are only counted; 0 lists all of them
+	MaxProblems int
+	// Whether to log each problem listed, for logging.Setup
+	Verbose bool
+}
+
+// Registers the -output, -format, -max-problems and -verbose flags of a tool reporting problems.
+// The formats listed are those registered when it's called.
+func (o *Options) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&o.Output, "output", output.Stdout, "File or table to write the problems to, replaced only once complete (the standard output by default).")
+	flags.StringVar(&o.Format, "format", "csv", output.FormatUsage())
+	flags.IntVar(&o.MaxProblems, "max-problems", 1000, "Maximum number of problems to list, the others are only counted (0 for no limit).")
+	flags.BoolVar(&o.Verbose, "verbose", false, "Verbose output.")
+}
+
+// The problems found by a tool, as rows with a value per column of the header
+type Report struct {
+	options Options
+	table   output.Table
+	header  []string
+	rows    [][]string
+}
+
+// Creates an empty report, written to the table of a format that stores tables
+func NewReport(options Options, table output.Table, header []string) *Report {
+	return &Report{options: options, table: table, header: header}
+}
+
+// Adds a problem, with a value per column of the header
+func (r *Report) Add(row ...string) {
+	r.rows = append(r.rows, row)
+}
+
+// Returns the number of problems added, listed or not
+func (r *Report) Total() int {
+	return len(r.rows)
+}
+
+// Sorts the problems on their columns in order, keeps the first -max-problems of them and writes
+// them to -output in -format, replaced only once complete. Each problem listed is logged at the debug level
+// with message, and a warning tells how many were left out.
+func (r *Report) Write(message string) error {
+	sort.SliceStable(r.rows, func(i, j int) bool {
+		return less(r.rows[i], r.rows[j])
+	})
+	listed := r.rows
+	if r.options.MaxProblems > 0 && len(listed) > r.options.MaxProblems {
+		listed = listed[:r.options.MaxProblems]
+	}
+	keys := make([]string, len(r.header))
+	for i, name := range r.header {
+		keys[i] = logKey(name)
+	}
+	for _, row := range listed {
+		attrs := make([]any, 0, 2*len(row))
+		for i, value := range row {
+			attrs = append(attrs, keys[i], value)
+		}
+		slog.Debug(message, attrs...)
+	}
+	err := output.WriteTable(r.options.Format, r.options.Output, r.table, func(out output.Writer) error {
+		out.Write(r.header)
+		for _, row := range listed {
+			out.Write(row)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(r.rows) > len(listed) {
+		slog.Warn("Only listed the first problems", logging.CountKey, len(listed), "total", len(r.rows))
+	}
+	return nil
+}
+
+// Compares two rows column by column: as numbers when both values are integers, so that
+// revisions and offsets sort in order, and as strings otherwise
+func less(a []string, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		x, errX := strconv.ParseInt(a[i], 10, 64)
+		y, errY := strconv.ParseInt(b[i], 10, 64)
+		if errX == nil && errY == nil {
+			return x < y
+		}
+		return a[i] < b[i]
+	}
+	return len(a) < len(b)
+}
+
+// Converts a column name such as LibrarianFile to the snake case of the log keys, librarian_file
+func logKey(name string) string {
+	var key strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				key.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		key.WriteRune(r)
+	}
+	return key.String()
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package problems
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/perforce-utils/perforceutils/output"
+)
+
+func TestReportWrite(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxProblems int
+		want        string
+	}{
+		{
+			name: "all",
+			want: "DepotFile,Rev,Problem\n" +
+				"//depot/a.txt,2,missing\n" +
+				"//depot/a.txt,10,stale\n" +
+				"//depot/b.txt,1,missing\n",
+		},
+		{
+			name:        "truncated after sorting",
+			maxProblems: 2,
+			want: "DepotFile,Rev,Problem\n" +
+				"//depot/a.txt,2,missing\n" +
+				"//depot/a.txt,10,stale\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "problems.csv")
+			options := Options{Output: path, Format: "csv", MaxProblems: test.maxProblems}
+			report := NewReport(options, output.Table{Name: "problems"}, []string{"DepotFile", "Rev", "Problem"})
+			report.Add("//depot/b.txt", "1", "missing")
+			report.Add("//depot/a.txt", "10", "stale")
+			report.Add("//depot/a.txt", "2", "missing")
+			if err := report.Write("Problem"); err != nil {
+				t.Fatalf("Write() failed: %v", err)
+			}
+			if report.Total() != 3 {
+				t.Errorf("Total() = %v, want 3", report.Total())
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("Write() wrote %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLogKey(t *testing.T) {
+	for name, want := range map[string]string{"LibrarianFile": "librarian_file", "RefCount": "ref_count", "Problem": "problem"} {
+		if got := logKey(name); got != want {
+			t.Errorf("logKey(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rcs
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Splits an RCS file into words, @strings@ and the ; and : separators, as described in rcsfile(5)
+type tokenizer struct {
+	content  []byte
+	position int
+	peeked   *token
+}
+
+type token struct {
+	text     []byte
+	isString bool
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// Returns the next token, or nil at the end of the file
+func (t *tokenizer) next() (*token, error) {
+	if t.peeked != nil {
+		next := t.peeked
+		t.peeked = nil
+		return next, nil
+	}
+	for t.position < len(t.content) && isSpace(t.content[t.position]) {
+		t.position++
+	}
+	if t.position >= len(t.content) {
+		return nil, nil
+	}
+
+	start := t.position
+	switch t.content[start] {
+	case ';', ':':
+		t.position++
+		return &token{text: t.content[start:t.position]}, nil
+	case '@':
+		// Strings end at a single @, and @@ stands for @. They are only copied when they contain @@.
+		t.position++
+		var text []byte
+		segment := t.position
+		for {
+			end := bytes.IndexByte(t.content[t.position:], '@')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at byte %v", start)
+			}
+			t.position += end
+			if t.position+1 < len(t.content) && t.content[t.position+1] == '@' {
+				text = append(text, t.content[segment:t.position+1]...)
+				t.position += 2
+				segment = t.position
+				continue
+			}
+			if text == nil {
+				text = t.content[segment:t.position:t.position]
+			} else {
+				text = append(text, t.content[segment:t.position]...)
+			}
+			t.position++
+			return &token{text: text, isString: true}, nil
+		}
+	}
+	for t.position < len(t.content) && !isSpace(t.content[t.position]) &&
+		t.content[t.position] != ';' && t.content[t.position] != ':' && t.content[t.position] != '@' {
+		t.position++
+	}
+	return &token{text: t.content[start:t.position]}, nil
+}
+
+func (t *tokenizer) peek() (*token, error) {
+	if t.peeked == nil {
+		next, err := t.next()
+		if err != nil {
+			return nil, err
+		}
+		t.peeked = next
+	}
+	return t.peeked, nil
+}
+
+// Reads the values of a phrase up to its semicolon
+func (t *tokenizer) phrase() ([]string, error) {
+	var values []string
+	for {
+		next, err := t.next()
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			return nil, fmt.Errorf("unterminated phrase at byte %v", t.position)
+		}
+		if !next.isString && string(next.text) == ";" {
+			return values, nil
+		}
+		values = append(values, string(next.text))
+	}
+}
+
+func (t *tokenizer) string() ([]byte, error) {
+	next, err := t.next()
+	if err != nil {
+		return nil, err
+	}
+	if next == nil || !next.isString {
+		return nil, fmt.Errorf("expected a string at byte %v", t.position)
+	}
+	return next.text, nil
+}
+
+// Revision numbers start with a digit, keywords with a letter
+func isNumber(next *token) bool {
+	return next != nil && !next.isString && len(next.text) > 0 && next.text[0] >= '0' && next.text[0] <= '9'
+}
+
+// Parses the content of an RCS file: the admin phrases, the delta of each revision, the
+// description, and the log and text of each revision
+func Parse(content []byte) (*File, error) {
+	file := &File{byNumber: make(map[string]*Revision)}
+	revision := func(number string) *Revision {
+		if existing, ok := file.byNumber[number]; ok {
+			return existing
+		}
+		created := &Revision{Number: number}
+		file.byNumber[number] = created
+		file.revisions = append(file.revisions, created)
+		return created
+	}
+
+	t := &tokenizer{content: content}
+	for {
+		next, err := t.next()
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			break
+		}
+		if next.isString {
+			return nil, fmt.Errorf("unexpected string at byte %v", t.position)
+		}
+		word := string(next.text)
+
+		switch {
+		case word == "desc":
+			if _, err := t.string(); err != nil {
+				return nil, err
+			}
+		case !isNumber(next):
+			// Admin phrases (head, access, symbols, locks, strict, comment, expand) and newphrases
+			values, err := t.phrase()
+			if err != nil {
+				return nil, err
+			}
+			if word == "head" && len(values) > 0 {
+				file.Head = values[0]
+			}
+		default:
+			current := revision(word)
+			following, err := t.peek()
+			if err != nil {
+				return nil, err
+			}
+			if following != nil && !following.isString && string(following.text) == "log" {
+				if err := parseDeltaText(t, current); err != nil {
+					return nil, fmt.Errorf("revision %v: %v", word, err)
+				}
+				continue
+			}
+			if err := parseDelta(t, current); err != nil {
+				return nil, fmt.Errorf("revision %v: %v", word, err)
+			}
+		}
+	}
+
+	if len(file.Head) == 0 {
+		return nil, fmt.Errorf("no head revision")
+	}
+	if _, ok := file.byNumber[file.Head]; !ok {
+		return nil, fmt.Errorf("head revision %v not found", file.Head)
+	}
+	return file, nil
+}
+
+// Parses the phrases of a delta (date, author, state, branches, next), up to the next revision
+// number or the description
+func parseDelta(t *tokenizer, revision *Revision) error {
+	for {
+		next, err := t.peek()
+		if err != nil {
+			return err
+		}
+		if next == nil || next.isString || isNumber(next) || string(next.text) == "desc" {
+			return nil
+		}
+		t.next()
+		values, err := t.phrase()
+		if err != nil {
+			return err
+		}
+		value := ""
+		if len(values) > 0 {
+			value = values[0]
+		}
+		switch string(next.text) {
+		case "date":
+			revision.Date = value
+		case "author":
+			revision.Author = value
+		case "state":
+			revision.State = value
+		case "next":
+			revision.Next = value
+		case "branches":
+			revision.Branches = values
+		}
+	}
+}
+
+// Parses the log and text of a revision, skipping the newphrases between them
+func parseDeltaText(t *tokenizer, revision *Revision) error {
+	t.next()
+	log, err := t.string()
+	if err != nil {
+		return err
+	}
+	revision.Log = string(log)
+	for {
+		next, err := t.next()
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return fmt.Errorf("missing text")
+		}
+		if !next.isString && string(next.text) == "text" {
+			break
+		}
+		if _, err := t.phrase(); err != nil {
+			return err
+		}
+	}
+	text, err := t.string()
+	if err != nil {
+		return err
+	}
+	revision.text = text
+	return nil
+}
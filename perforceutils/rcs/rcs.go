@@ -0,0 +1,250 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package rcs reads the RCS ,v archives Helix Core stores text files in, and reconstructs the
+// content of their revisions without p4d.
+//
+// The head revision is stored in full and each older revision as a reverse delta (an ed-style
+// script) from the revision after it, so revisions are rebuilt by walking the trunk from the head.
+// Helix Core doesn't create branch revisions (1.2.1.3), but files imported from RCS or CVS can
+// have them: they're stored as forward deltas from their branch point (1.2), and are rebuilt from
+// there.
+package rcs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returned by Content for revisions that are not in the file or can't be reached from the head
+var ErrUnknownRevision = errors.New("unknown revision")
+
+// A revision of an RCS file, from its delta and deltatext entries
+type Revision struct {
+	Number string
+	// As written in the file, for example 2021.01.18.22.14.00 (UTC)
+	Date   string
+	Author string
+	State  string
+	// The previous revision on the trunk, or the next one on a branch; empty for the last one
+	Next string
+	// The first revision of each branch starting at this revision
+	Branches []string
+	Log      string
+
+	// The full text for the head revision, otherwise the delta from the revision it follows:
+	// the next newer one on the trunk, the previous one or the branch point on a branch
+	text []byte
+}
+
+// Parses the date of the revision; dates before 2000 have a two-digit year
+func (r *Revision) Time() (time.Time, error) {
+	date := r.Date
+	if strings.Index(date, ".") == 2 {
+		date = "19" + date
+	}
+	return time.Parse("2006.01.02.15.04.05", date)
+}
+
+// A parsed RCS file
+type File struct {
+	Head string
+	// The revisions in the order of the file, which is newest first for Helix Core archives
+	revisions []*Revision
+	byNumber  map[string]*Revision
+
+	// The last revision rebuilt, to continue from there when older revisions are requested in turn
+	cursor      *Revision
+	cursorLines [][]byte
+}
+
+// Reads and parses an RCS file
+func ReadFile(path string) (*File, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading RCS file %v: %w", path, err)
+	}
+	file, err := Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing RCS file %v: %v", path, err)
+	}
+	return file, nil
+}
+
+// Returns the revisions of the file, in the order of the file
+func (f *File) Revisions() []*Revision {
+	return f.revisions
+}
+
+// Returns a revision by number
+func (f *File) Revision(number string) (*Revision, bool) {
+	revision, ok := f.byNumber[number]
+	return revision, ok
+}
+
+// Rebuilds the full content of a revision by applying the deltas from the head revision, and
+// for branch revisions from their branch point
+func (f *File) Content(number string) ([]byte, error) {
+	lines, err := f.lines(number)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join(lines, nil), nil
+}
+
+func (f *File) lines(number string) ([][]byte, error) {
+	target, ok := f.byNumber[number]
+	if !ok {
+		return nil, fmt.Errorf("%w %v", ErrUnknownRevision, number)
+	}
+
+	// Continue from the last revision rebuilt when the target follows it, older on the trunk or
+	// newer on the same branch
+	revision, lines := f.cursor, f.cursorLines
+	if revision == nil || !f.follows(revision, target) {
+		if point, ok := branchPoint(number); ok {
+			pointLines, err := f.lines(point)
+			if err != nil {
+				return nil, err
+			}
+			first, err := f.branchStart(point, number)
+			if err != nil {
+				return nil, err
+			}
+			if lines, err = applyDelta(pointLines, first.text); err != nil {
+				return nil, fmt.Errorf("error applying the delta of revision %v: %v", first.Number, err)
+			}
+			revision = first
+		} else {
+			head, ok := f.byNumber[f.Head]
+			if !ok {
+				return nil, fmt.Errorf("%w %v (head)", ErrUnknownRevision, f.Head)
+			}
+			revision, lines = head, splitLines(head.text)
+		}
+	}
+	for revision != target {
+		next, ok := f.byNumber[revision.Next]
+		if !ok || len(revision.Next) == 0 {
+			return nil, fmt.Errorf("%w %v: not reachable from %v", ErrUnknownRevision, number, revision.Number)
+		}
+		var err error
+		if lines, err = applyDelta(lines, next.text); err != nil {
+			return nil, fmt.Errorf("error applying the delta of revision %v: %v", next.Number, err)
+		}
+		revision = next
+	}
+	f.cursor, f.cursorLines = revision, lines
+	return lines, nil
+}
+
+// Returns the revision a branch revision starts from, 1.2 for 1.2.1.3
+func branchPoint(number string) (string, bool) {
+	parts := strings.Split(number, ".")
+	if len(parts) < 4 || len(parts)%2 != 0 {
+		return "", false
+	}
+	return strings.Join(parts[:len(parts)-2], "."), true
+}
+
+// Returns the first revision of the branch of number that starts at point, 1.2.1.1 for 1.2.1.3
+func (f *File) branchStart(point string, number string) (*Revision, error) {
+	pointRevision, ok := f.byNumber[point]
+	if !ok {
+		return nil, fmt.Errorf("%w %v: branch point %v not found", ErrUnknownRevision, number, point)
+	}
+	branch := number[:strings.LastIndex(number, ".")+1]
+	for _, first := range pointRevision.Branches {
+		if strings.HasPrefix(first, branch) && !strings.Contains(first[len(branch):], ".") {
+			if revision, ok := f.byNumber[first]; ok {
+				return revision, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w %v: no branch at %v", ErrUnknownRevision, number, point)
+}
+
+// Reports whether target is reached from revision by following the next revisions
+func (f *File) follows(revision *Revision, target *Revision) bool {
+	for i := 0; revision != nil && i <= len(f.revisions); i++ {
+		if revision == target {
+			return true
+		}
+		revision = f.byNumber[revision.Next]
+	}
+	return false
+}
+
+// Splits text into lines, keeping the line endings
+func splitLines(text []byte) [][]byte {
+	var lines [][]byte
+	for len(text) > 0 {
+		end := bytes.IndexByte(text, '\n') + 1
+		if end == 0 {
+			end = len(text)
+		}
+		lines = append(lines, text[:end:end])
+		text = text[end:]
+	}
+	return lines
+}
+
+// Applies an RCS delta: "a L N" adds the N lines that follow after line L of the source, and
+// "d L N" deletes N lines starting at line L. Line numbers refer to the source.
+func applyDelta(source [][]byte, delta []byte) ([][]byte, error) {
+	script := splitLines(delta)
+	result := make([][]byte, 0, len(source))
+	position := 0
+	for i := 0; i < len(script); i++ {
+		command := strings.TrimSpace(string(script[i]))
+		if len(command) == 0 {
+			return nil, fmt.Errorf("empty delta command")
+		}
+		operation := command[0]
+		// The line number follows the letter, with or without a space (a12 3)
+		arguments := strings.Fields(command[1:])
+		if (operation != 'a' && operation != 'd') || len(arguments) != 2 {
+			return nil, fmt.Errorf("invalid delta command %q", command)
+		}
+		line, lineErr := strconv.Atoi(arguments[0])
+		count, countErr := strconv.Atoi(arguments[1])
+		if lineErr != nil || countErr != nil || count < 0 {
+			return nil, fmt.Errorf("invalid delta command %q", command)
+		}
+
+		if operation == 'd' {
+			if line < 1 || line-1 < position || line-1+count > len(source) {
+				return nil, fmt.Errorf("delete of lines %v-%v out of order or range", line, line+count-1)
+			}
+			result = append(result, source[position:line-1]...)
+			position = line - 1 + count
+			continue
+		}
+		if line < position || line > len(source) || i+1+count > len(script) {
+			return nil, fmt.Errorf("add after line %v out of order or range", line)
+		}
+		result = append(result, source[position:line]...)
+		position = line
+		result = append(result, script[i+1:i+1+count]...)
+		i += count
+	}
+	return append(result, source[position:]...), nil
+}
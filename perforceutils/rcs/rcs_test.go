@@ -0,0 +1,192 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rcs
+
+import (
+	"errors"
+	"testing"
+)
+
+// Three trunk revisions and a branch from 1.2, with an escaped @ in the text
+const testFile = `head	1.3;
+access;
+symbols;
+locks; strict;
+comment	@# @;
+
+
+1.3
+date	2021.01.18.22.14.00;	author p4;	state Exp;
+branches;
+next	1.2;
+
+1.2
+date	2021.01.18.22.13.00;	author p4;	state Exp;
+branches
+	1.2.1.1;
+next	1.1;
+
+1.1
+date	99.12.31.23.59.59;	author joe;	state Exp;
+branches;
+next	;
+
+1.2.1.1
+date	2021.01.19.08.00.00;	author p4;	state Exp;
+branches;
+next	;
+
+
+desc
+@@
+
+
+1.3
+log
+@third
+@
+text
+@line one
+line two changed
+mail joe@@example.com
+@
+
+
+1.2
+log
+@second
+@
+text
+@d2 1
+a2 1
+line two
+@
+
+
+1.1
+log
+@first
+@
+text
+@d3 1
+@
+
+
+1.2.1.1
+log
+@branch
+@
+text
+@a3 1
+branch line
+@
+`
+
+func TestParse(t *testing.T) {
+	file, err := Parse([]byte(testFile))
+	if err != nil {
+		t.Fatalf("Parse() returned %v", err)
+	}
+	if file.Head != "1.3" {
+		t.Errorf("Head = %q, want 1.3", file.Head)
+	}
+	tests := []struct {
+		number string
+		author string
+		log    string
+		next   string
+	}{
+		{"1.3", "p4", "third\n", "1.2"},
+		{"1.2", "p4", "second\n", "1.1"},
+		{"1.1", "joe", "first\n", ""},
+		{"1.2.1.1", "p4", "branch\n", ""},
+	}
+	if len(file.Revisions()) != len(tests) {
+		t.Errorf("got %v revisions, want %v", len(file.Revisions()), len(tests))
+	}
+	for _, test := range tests {
+		revision, ok := file.Revision(test.number)
+		if !ok {
+			t.Errorf("Revision(%v) not found", test.number)
+			continue
+		}
+		if revision.Author != test.author || revision.Log != test.log || revision.Next != test.next {
+			t.Errorf("Revision(%v) = author %q, log %q, next %q, want %q, %q, %q", test.number,
+				revision.Author, revision.Log, revision.Next, test.author, test.log, test.next)
+		}
+	}
+	if branch, _ := file.Revision("1.2"); len(branch.Branches) != 1 || branch.Branches[0] != "1.2.1.1" {
+		t.Errorf("Revision(1.2).Branches = %q, want [1.2.1.1]", branch.Branches)
+	}
+	if old, _ := file.Revision("1.1"); old != nil {
+		date, err := old.Time()
+		if err != nil || date.Year() != 1999 {
+			t.Errorf("Revision(1.1).Time() = %v, %v, want a date in 1999", date, err)
+		}
+	}
+}
+
+func TestContent(t *testing.T) {
+	file, err := Parse([]byte(testFile))
+	if err != nil {
+		t.Fatalf("Parse() returned %v", err)
+	}
+	tests := []struct {
+		number string
+		want   string
+	}{
+		{"1.3", "line one\nline two changed\nmail joe@example.com\n"},
+		{"1.2", "line one\nline two\nmail joe@example.com\n"},
+		{"1.1", "line one\nline two\n"},
+		{"1.2.1.1", "line one\nline two\nmail joe@example.com\nbranch line\n"},
+		// Requested again, out of order, to rebuild from the head rather than the last revision
+		{"1.2", "line one\nline two\nmail joe@example.com\n"},
+		{"1.3", "line one\nline two changed\nmail joe@example.com\n"},
+	}
+	for _, test := range tests {
+		content, err := file.Content(test.number)
+		if err != nil {
+			t.Errorf("Content(%v) returned %v", test.number, err)
+			continue
+		}
+		if string(content) != test.want {
+			t.Errorf("Content(%v) = %q, want %q", test.number, content, test.want)
+		}
+	}
+	if _, err := file.Content("1.4"); !errors.Is(err, ErrUnknownRevision) {
+		t.Errorf("Content(1.4) returned %v, want ErrUnknownRevision", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"empty", ""},
+		{"no head", "access;\nsymbols;\n\n1.1\ndate\t2021.01.18.22.14.00;\tauthor p4;\tstate Exp;\nbranches;\nnext\t;\n\ndesc\n@@\n"},
+		{"unknown head", "head\t1.2;\naccess;\n\n1.1\ndate\t2021.01.18.22.14.00;\tauthor p4;\tstate Exp;\nbranches;\nnext\t;\n\ndesc\n@@\n"},
+		{"unterminated string", "head\t1.1;\n\n1.1\ndate\t2021.01.18.22.14.00;\tauthor p4;\tstate Exp;\nbranches;\nnext\t;\n\ndesc\n@never closed\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Parse([]byte(test.content)); err == nil {
+				t.Errorf("Parse() succeeded, want an error")
+			}
+		})
+	}
+}
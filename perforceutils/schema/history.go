@@ -0,0 +1,77 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+// The layouts of older record versions of the tables, for converting records between versions.
+// Tables missing here, and versions missing for a table, are only known in their current layout.
+var History = map[string][]Table{
+	"db.change": {
+		{Version: 3, Fields: changeFields[:7]},
+		{Version: 4, Fields: changeFields[:8]},
+		{Version: 5, Fields: changeFields[:10]},
+	},
+	"db.changex": {
+		{Version: 3, Fields: changeFields[:7]},
+		{Version: 4, Fields: changeFields[:8]},
+		{Version: 5, Fields: changeFields[:10]},
+	},
+	"db.have": {
+		{Version: 2, Fields: []string{
+			"clientFile", "depotFile", "haveRev", "type"}},
+	},
+	"db.rev": {
+		{Version: 8, Fields: revFieldsWithoutSize},
+	},
+	"db.revdx": {
+		{Version: 8, Fields: revFieldsWithoutSize},
+	},
+	"db.revhx": {
+		{Version: 8, Fields: revFieldsWithoutSize},
+	},
+	"db.revsh": {
+		{Version: 8, Fields: revFieldsWithoutSize},
+	},
+	"db.user": {
+		{Version: 6, Fields: []string{
+			"user", "email", "jobView", "updateDate", "accessDate", "fullName", "password",
+			"strength", "ticket", "endDate", "type", "passDate", "passExpire", "attempts"}},
+	},
+	"db.working": {
+		{Version: 9, Fields: []string{
+			"clientFile", "depotFile", "client", "user", "haveRev", "workRev", "isVirtual", "type",
+			"action", "change", "modTime", "isLocked", "digest", "size", "traitLot", "tampered",
+			"clientType"}},
+	},
+}
+
+// The fields of db.rev before the size of the revisions was recorded
+var revFieldsWithoutSize = []string{
+	"depotFile", "depotRev", "type", "action", "change", "date", "modTime",
+	"digest", "traitLot", "lbrIsLazy", "lbrFile", "lbrRev", "lbrType"}
+
+// Returns the layout of a record version of a table, current or older, or false if it isn't known
+func Layout(table string, version int) (Table, bool) {
+	if current, ok := Tables[table]; ok && current.Version == version {
+		return current, true
+	}
+	for _, older := range History[table] {
+		if older.Version == version {
+			return older, true
+		}
+	}
+	return Table{}, false
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+var changeKey = []string{"change"}
+
+var revKey = []string{"depotFile", "depotRev"}
+
+var storageKey = []string{"lbrFile", "lbrRev"}
+
+// The fields identifying the records of the tables of the registry, which p4d keeps them ordered by
+var keyFields = map[string][]string{
+	"db.bodytext":  {"key", "attr"},
+	"db.change":    changeKey,
+	"db.changex":   changeKey,
+	"db.config":    {"serverName", "name"},
+	"db.counters":  {"name"},
+	"db.depot":     {"name"},
+	"db.desc":      {"descKey"},
+	"db.domain":    {"name"},
+	"db.excl":      {"depotFile"},
+	"db.group":     {"user", "group", "type"},
+	"db.have":      {"clientFile"},
+	"db.integed":   {"toFile", "fromFile", "startFromRev", "endFromRev", "startToRev", "endToRev"},
+	"db.label":     {"name", "depotFile"},
+	"db.locks":     {"depotFile", "client"},
+	"db.protect":   {"seq"},
+	"db.rev":       revKey,
+	"db.revdx":     revKey,
+	"db.revhx":     revKey,
+	"db.revsh":     revKey,
+	"db.storage":   storageKey,
+	"db.storagesh": storageKey,
+	"db.stream":    {"stream"},
+	"db.trigger":   {"seq"},
+	"db.typemapx":  {"seq"},
+	"db.user":      {"user"},
+	"db.view":      {"name", "seq"},
+	"db.working":   {"clientFile"},
+}
+
+// Returns the indexes in journal.Record.Fields of the key fields of a record version of a table,
+// or false when the layout of the version isn't known
+func KeyIndexes(table string, version int) ([]int, bool) {
+	names, ok := keyFields[table]
+	if !ok {
+		return nil, false
+	}
+	layout, ok := Layout(table, version)
+	if !ok {
+		return nil, false
+	}
+	indexes := make([]int, len(names))
+	for i, name := range names {
+		if indexes[i] = layout.Index(name); indexes[i] < 0 {
+			return nil, false
+		}
+	}
+	return indexes, true
+}
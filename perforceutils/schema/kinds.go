@@ -0,0 +1,82 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+// The kind of the values of a field. Journals write strings between @ and numbers as they are, so
+// the kind also tells how to write a field without a value: @@ for strings and 0 for numbers.
+type Kind int
+
+const (
+	StringKind Kind = iota
+	NumberKind
+)
+
+func fieldSet(names ...string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+var changeStringFields = fieldSet("client", "user", "description", "root", "importer", "identity", "stream")
+
+var revStringFields = fieldSet("depotFile", "digest", "lbrFile", "lbrRev")
+
+var storageStringFields = fieldSet("lbrFile", "lbrRev", "digest", "compCksum")
+
+// The string fields of the tables of the registry, current and older layouts alike; the other
+// fields of these tables hold numbers
+var stringFields = map[string]map[string]bool{
+	"db.bodytext":  fieldSet("key", "text"),
+	"db.change":    changeStringFields,
+	"db.changex":   changeStringFields,
+	"db.config":    fieldSet("serverName", "name", "value"),
+	"db.counters":  fieldSet("name", "value"),
+	"db.depot":     fieldSet("name", "extra", "map"),
+	"db.desc":      fieldSet("description"),
+	"db.domain":    fieldSet("name", "extra", "mount", "mount2", "mount3", "owner", "description", "stream", "serverId"),
+	"db.excl":      fieldSet("depotFile", "client", "user"),
+	"db.group":     fieldSet("user", "group"),
+	"db.have":      fieldSet("clientFile", "depotFile"),
+	"db.integed":   fieldSet("toFile", "fromFile"),
+	"db.label":     fieldSet("name", "depotFile"),
+	"db.locks":     fieldSet("depotFile", "client", "user"),
+	"db.protect":   fieldSet("user", "host", "depotFile", "subPath"),
+	"db.rev":       revStringFields,
+	"db.revdx":     revStringFields,
+	"db.revhx":     revStringFields,
+	"db.revsh":     revStringFields,
+	"db.storage":   storageStringFields,
+	"db.storagesh": storageStringFields,
+	"db.stream":    fieldSet("stream", "parent", "title", "preview"),
+	"db.trigger":   fieldSet("name", "depotFile", "trigger", "action"),
+	"db.typemapx":  fieldSet("depotFile"),
+	"db.user":      fieldSet("user", "email", "jobView", "fullName", "password", "ticket", "auth"),
+	"db.view":      fieldSet("name", "viewFile", "depotFile"),
+	"db.working":   fieldSet("clientFile", "depotFile", "client", "user", "digest", "movedFile"),
+}
+
+// Returns the kind of a field of a table. The fields of tables missing from the registry are
+// taken for strings.
+func FieldKind(table string, field string) Kind {
+	strings, ok := stringFields[table]
+	if !ok || strings[field] {
+		return StringKind
+	}
+	return NumberKind
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package schema describes the db.* tables of Helix Core checkpoints and decodes their records into
+// typed structs.
+//
+// Field names follow https://www.perforce.com/perforce/doc.current/schema/. Records written by older
+// servers may have fewer fields than the registered version; the missing fields are left at their
+// zero value.
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+)
+
+// The layout of a db.* table as understood by the perforce-utils parsers
+type Table struct {
+	Version int
+	Fields  []string
+}
+
+// Returns the index of a field in journal.Record.Fields, or -1 if the table doesn't have it
+func (t Table) Index(field string) int {
+	for i, name := range t.Fields {
+		if name == field {
+			return i
+		}
+	}
+	return -1
+}
+
+var changeFields = []string{
+	"change", "descKey", "client", "user", "date", "status", "description",
+	"root", "importer", "identity", "access", "update", "stream"}
+
+var revFields = []string{
+	"depotFile", "depotRev", "type", "action", "change", "date", "modTime",
+	"digest", "size", "traitLot", "lbrIsLazy", "lbrFile", "lbrRev", "lbrType"}
+
+// The fields of db.storage, shared by db.storagesh for the archives of shelved files
+var storageFields = []string{
+	"lbrFile", "lbrRev", "lbrType", "refCount", "digest", "size", "serverSize",
+	"compCksum", "date"}
+
+// The tables and record versions the perforce-utils parsers know about.
+// When a new server release changes a table, this registry needs to be updated along with the parsers.
+var Tables = map[string]Table{
+	"db.bodytext": {Version: 1, Fields: []string{
+		"key", "attr", "text"}},
+	"db.change":  {Version: 6, Fields: changeFields},
+	"db.changex": {Version: 6, Fields: changeFields},
+	"db.config": {Version: 1, Fields: []string{
+		"serverName", "name", "value"}},
+	"db.counters": {Version: 1, Fields: []string{
+		"name", "value"}},
+	"db.depot": {Version: 1, Fields: []string{
+		"name", "type", "extra", "map"}},
+	"db.desc": {Version: 0, Fields: []string{
+		"descKey", "description"}},
+	"db.domain": {Version: 7, Fields: []string{
+		"name", "type", "extra", "mount", "mount2", "mount3", "owner", "updateDate",
+		"accessDate", "options", "description", "stream", "serverId", "contents"}},
+	"db.excl": {Version: 1, Fields: []string{
+		"depotFile", "client", "user"}},
+	"db.group": {Version: 7, Fields: []string{
+		"user", "group", "type", "maxResults", "maxScanRows", "maxLockTime",
+		"maxOpenFiles", "timeout", "passTimeout"}},
+	"db.have": {Version: 3, Fields: []string{
+		"clientFile", "depotFile", "haveRev", "type", "time"}},
+	"db.integed": {Version: 7, Fields: []string{
+		"toFile", "fromFile", "startFromRev", "endFromRev", "startToRev", "endToRev", "how", "change"}},
+	"db.label": {Version: 7, Fields: []string{
+		"name", "depotFile", "haveRev"}},
+	"db.locks": {Version: 3, Fields: []string{
+		"depotFile", "client", "user", "action", "isLocked", "change"}},
+	"db.protect": {Version: 4, Fields: []string{
+		"seq", "isGroup", "user", "host", "perm", "mapFlag", "depotFile", "subPath", "update"}},
+	"db.rev":       {Version: 9, Fields: revFields},
+	"db.revdx":     {Version: 9, Fields: revFields},
+	"db.revhx":     {Version: 9, Fields: revFields},
+	"db.revsh":     {Version: 9, Fields: revFields},
+	"db.storage":   {Version: 1, Fields: storageFields},
+	"db.storagesh": {Version: 1, Fields: storageFields},
+	"db.stream": {Version: 2, Fields: []string{
+		"stream", "parent", "title", "type", "preview", "change", "copyChg",
+		"mergeChg", "highChg", "hash", "status", "parentView"}},
+	"db.trigger": {Version: 2, Fields: []string{
+		"seq", "name", "mapFlag", "depotFile", "trigger", "action"}},
+	"db.typemapx": {Version: 1, Fields: []string{
+		"seq", "type", "mapFlag", "depotFile"}},
+	"db.user": {Version: 7, Fields: []string{
+		"user", "email", "jobView", "updateDate", "accessDate", "fullName", "password",
+		"strength", "ticket", "endDate", "type", "passDate", "passExpire", "attempts", "auth"}},
+	"db.view": {Version: 1, Fields: []string{
+		"name", "seq", "mapFlag", "viewFile", "depotFile"}},
+	"db.working": {Version: 10, Fields: []string{
+		"clientFile", "depotFile", "client", "user", "haveRev", "workRev", "isVirtual", "type",
+		"action", "change", "modTime", "isLocked", "digest", "size", "traitLot", "tampered",
+		"clientType", "movedFile"}},
+}
+
+// Returned by Unmarshal for records of tables missing from Tables
+var ErrUnknownTable = errors.New("unknown table")
+
+// The positions in journal.Record.Fields of the struct fields, by struct type and table
+type layoutKey struct {
+	t     reflect.Type
+	table string
+}
+
+var layouts sync.Map
+
+// Returns the index in the record fields of each field of a struct, or -1 for untagged fields
+func layout(t reflect.Type, table string) ([]int, error) {
+	key := layoutKey{t, table}
+	if cached, ok := layouts.Load(key); ok {
+		return cached.([]int), nil
+	}
+	schema, ok := Tables[table]
+	if !ok {
+		return nil, fmt.Errorf("%w %v", ErrUnknownTable, table)
+	}
+	indexes := make([]int, t.NumField())
+	for i := range indexes {
+		indexes[i] = -1
+		name, ok := t.Field(i).Tag.Lookup("p4")
+		if !ok {
+			continue
+		}
+		if indexes[i] = schema.Index(name); indexes[i] < 0 {
+			return nil, fmt.Errorf("%v has no field %v", table, name)
+		}
+	}
+	layouts.Store(key, indexes)
+	return indexes, nil
+}
+
+// Decodes the fields of a table record into the struct pointed to by v. Struct fields are matched
+// to the table fields by their p4 tag, and may be strings, integers or booleans.
+//
+//	var rev schema.Rev
+//	err := schema.Unmarshal(record, &rev)
+func Unmarshal(record journal.Record, v any) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Pointer || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("cannot unmarshal into %T, a struct pointer is required", v)
+	}
+	value = value.Elem()
+	indexes, err := layout(value.Type(), record.Table)
+	if err != nil {
+		return err
+	}
+	for i, index := range indexes {
+		if index < 0 {
+			continue
+		}
+		field := record.Field(index)
+		target := value.Field(i)
+		switch target.Kind() {
+		case reflect.String:
+			target.SetString(field)
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			if len(field) == 0 {
+				target.SetInt(0)
+				continue
+			}
+			n, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				return fmt.Errorf("could not parse %v field %v: %v", record.Table, Tables[record.Table].Fields[index], field)
+			}
+			target.SetInt(n)
+		case reflect.Bool:
+			target.SetBool(len(field) > 0 && field != "0")
+		default:
+			return fmt.Errorf("unsupported type %v for %v field %v", target.Type(), record.Table, Tables[record.Table].Fields[index])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/google/perforce-utils/perforceutils/journal"
+)
+
+func TestUnmarshal(t *testing.T) {
+	file, err := os.Open("../testdata/example_journal.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var revs []Rev
+	var storages []Storage
+	err = journal.ScanTables(file, map[string]bool{"db.rev": true, "db.storage": true}, func(record journal.Record) error {
+		if record.Table == "db.rev" {
+			var rev Rev
+			err := Unmarshal(record, &rev)
+			revs = append(revs, rev)
+			return err
+		}
+		var storage Storage
+		err := Unmarshal(record, &storage)
+		storages = append(storages, storage)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Unmarshal() returned %v", err)
+	}
+	wantRev := Rev{DepotFile: "//depot/path1/data1.dat", DepotRev: 2, Type: 65539, Action: 1, Change: 2,
+		Date: 1611008040, ModTime: 1611008039, Digest: "F1C9645DBC14EFDDC7D8A322685F26EB", Size: 10485760,
+		LbrFile: "//depot/path1/data1.dat", LbrRev: "1.2", LbrType: 65539}
+	if len(revs) == 0 || !reflect.DeepEqual(revs[0], wantRev) {
+		t.Errorf("first db.rev record = %+v, want %+v", revs, wantRev)
+	}
+	wantStorage := Storage{LbrFile: "//depot/path1/data1.dat", LbrRev: "1.1", LbrType: 65539, RefCount: 1,
+		Digest: "F1C9645DBC14EFDDC7D8A322685F26EB", Size: 10485760, ServerSize: 10221,
+		CompCksum: "00000000000000000000000000000000", Date: 1611008038}
+	if len(storages) != 6 || !reflect.DeepEqual(storages[0], wantStorage) {
+		t.Errorf("db.storage records = %+v, want 6 starting with %+v", storages, wantStorage)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var rev Rev
+	if err := Unmarshal(journal.Parse("@pv@ 1 @db.unknown@ @x@ "), &rev); !errors.Is(err, ErrUnknownTable) {
+		t.Errorf("Unmarshal() of an unknown table returned %v, want ErrUnknownTable", err)
+	}
+	if err := Unmarshal(journal.Parse("@pv@ 9 @db.rev@ @//depot/a@ x 0 "), &rev); err == nil {
+		t.Errorf("Unmarshal() of a non-numeric depotRev returned no error")
+	}
+	if err := Unmarshal(journal.Parse("@pv@ 9 @db.rev@ @//depot/a@ 1 "), rev); err == nil {
+		t.Errorf("Unmarshal() into a struct value returned no error")
+	}
+	// Records of older servers may have fewer fields
+	var short Rev
+	if err := Unmarshal(journal.Parse("@pv@ 9 @db.rev@ @//depot/a@ 3 "), &short); err != nil || short.DepotRev != 3 || short.LbrRev != "" {
+		t.Errorf("Unmarshal() of a short record = %+v, %v", short, err)
+	}
+}
+
+func TestLayout(t *testing.T) {
+	current, ok := Layout("db.rev", Tables["db.rev"].Version)
+	if !ok || current.Index("size") < 0 {
+		t.Errorf("Layout() of the current db.rev = %v, %v, want the size field", current, ok)
+	}
+	older, ok := Layout("db.rev", 8)
+	if !ok || older.Index("size") >= 0 || older.Index("lbrType") != 12 {
+		t.Errorf("Layout() of db.rev version 8 = %v, %v, want no size field", older, ok)
+	}
+	if _, ok := Layout("db.rev", 1); ok {
+		t.Errorf("Layout() of db.rev version 1 returned a layout")
+	}
+	indexes, ok := KeyIndexes("db.rev", 8)
+	if !ok || !reflect.DeepEqual(indexes, []int{0, 1}) {
+		t.Errorf("KeyIndexes(db.rev, 8) = %v, %v, want [0 1]", indexes, ok)
+	}
+	if FieldKind("db.rev", "depotFile") != StringKind || FieldKind("db.rev", "size") != NumberKind {
+		t.Errorf("FieldKind() of db.rev depotFile and size = %v and %v", FieldKind("db.rev", "depotFile"), FieldKind("db.rev", "size"))
+	}
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+// A changelist of db.change, see https://www.perforce.com/perforce/doc.current/schema/#db.change
+type Change struct {
+	Change      int    `p4:"change"`
+	DescKey     int    `p4:"descKey"`
+	Client      string `p4:"client"`
+	User        string `p4:"user"`
+	Date        int64  `p4:"date"`
+	Status      int    `p4:"status"`
+	Description string `p4:"description"`
+	Root        string `p4:"root"`
+	Importer    string `p4:"importer"`
+	Identity    string `p4:"identity"`
+	Access      int64  `p4:"access"`
+	Update      int64  `p4:"update"`
+	Stream      string `p4:"stream"`
+}
+
+// A configurable of db.config, see https://www.perforce.com/perforce/doc.current/schema/#db.config
+type Config struct {
+	ServerName string `p4:"serverName"`
+	Name       string `p4:"name"`
+	Value      string `p4:"value"`
+}
+
+// A counter of db.counters, see https://www.perforce.com/perforce/doc.current/schema/#db.counters
+type Counter struct {
+	Name  string `p4:"name"`
+	Value string `p4:"value"`
+}
+
+// A depot of db.depot, see https://www.perforce.com/perforce/doc.current/schema/#db.depot
+type Depot struct {
+	Name  string `p4:"name"`
+	Type  int    `p4:"type"`
+	Extra string `p4:"extra"`
+	Map   string `p4:"map"`
+}
+
+// A changelist description of db.desc, see https://www.perforce.com/perforce/doc.current/schema/#db.desc
+type Desc struct {
+	DescKey     int    `p4:"descKey"`
+	Description string `p4:"description"`
+}
+
+// A client, label, branch, stream or depot of db.domain, see
+// https://www.perforce.com/perforce/doc.current/schema/#db.domain. Type is the character code of the
+// domain type, such as 'c' (99) for clients.
+type Domain struct {
+	Name        string `p4:"name"`
+	Type        int    `p4:"type"`
+	Extra       string `p4:"extra"`
+	Mount       string `p4:"mount"`
+	Mount2      string `p4:"mount2"`
+	Mount3      string `p4:"mount3"`
+	Owner       string `p4:"owner"`
+	UpdateDate  int64  `p4:"updateDate"`
+	AccessDate  int64  `p4:"accessDate"`
+	Options     int    `p4:"options"`
+	Description string `p4:"description"`
+	Stream      string `p4:"stream"`
+	ServerID    string `p4:"serverId"`
+	Contents    int    `p4:"contents"`
+}
+
+// A group membership of db.group, see https://www.perforce.com/perforce/doc.current/schema/#db.group
+type Group struct {
+	User         string `p4:"user"`
+	Group        string `p4:"group"`
+	Type         int    `p4:"type"`
+	MaxResults   int64  `p4:"maxResults"`
+	MaxScanRows  int64  `p4:"maxScanRows"`
+	MaxLockTime  int64  `p4:"maxLockTime"`
+	MaxOpenFiles int64  `p4:"maxOpenFiles"`
+	Timeout      int64  `p4:"timeout"`
+	PassTimeout  int64  `p4:"passTimeout"`
+}
+
+// A file synced to a client, of db.have, see https://www.perforce.com/perforce/doc.current/schema/#db.have
+type Have struct {
+	ClientFile string `p4:"clientFile"`
+	DepotFile  string `p4:"depotFile"`
+	HaveRev    int    `p4:"haveRev"`
+	Type       int    `p4:"type"`
+	Time       int64  `p4:"time"`
+}
+
+// A file revision tagged by a label, of db.label, see https://www.perforce.com/perforce/doc.current/schema/#db.label
+type Label struct {
+	Name      string `p4:"name"`
+	DepotFile string `p4:"depotFile"`
+	HaveRev   int    `p4:"haveRev"`
+}
+
+// A line of the protections table, of db.protect, see https://www.perforce.com/perforce/doc.current/schema/#db.protect
+type Protect struct {
+	Seq       int    `p4:"seq"`
+	IsGroup   bool   `p4:"isGroup"`
+	User      string `p4:"user"`
+	Host      string `p4:"host"`
+	Perm      int    `p4:"perm"`
+	MapFlag   int    `p4:"mapFlag"`
+	DepotFile string `p4:"depotFile"`
+	SubPath   string `p4:"subPath"`
+	Update    int64  `p4:"update"`
+}
+
+// A file revision of db.rev, see https://www.perforce.com/perforce/doc.current/schema/#db.rev.
+// It also decodes the records of db.revdx, db.revhx and db.revsh, which share its layout.
+type Rev struct {
+	DepotFile string `p4:"depotFile"`
+	DepotRev  int    `p4:"depotRev"`
+	Type      int    `p4:"type"`
+	Action    int    `p4:"action"`
+	Change    int    `p4:"change"`
+	Date      int64  `p4:"date"`
+	ModTime   int64  `p4:"modTime"`
+	Digest    string `p4:"digest"`
+	Size      int64  `p4:"size"`
+	TraitLot  int    `p4:"traitLot"`
+	LbrIsLazy bool   `p4:"lbrIsLazy"`
+	LbrFile   string `p4:"lbrFile"`
+	LbrRev    string `p4:"lbrRev"`
+	LbrType   int    `p4:"lbrType"`
+}
+
+// A librarian file revision of db.storage, or of db.storagesh for shelved files, see
+// https://www.perforce.com/perforce/doc.current/schema/#db.storage
+type Storage struct {
+	LbrFile    string `p4:"lbrFile"`
+	LbrRev     string `p4:"lbrRev"`
+	LbrType    int    `p4:"lbrType"`
+	RefCount   int    `p4:"refCount"`
+	Digest     string `p4:"digest"`
+	Size       int64  `p4:"size"`
+	ServerSize int64  `p4:"serverSize"`
+	CompCksum  string `p4:"compCksum"`
+	Date       int64  `p4:"date"`
+}
+
+// A stream of db.stream, see https://www.perforce.com/perforce/doc.current/schema/#db.stream
+type Stream struct {
+	Stream     string `p4:"stream"`
+	Parent     string `p4:"parent"`
+	Title      string `p4:"title"`
+	Type       int    `p4:"type"`
+	Preview    string `p4:"preview"`
+	Change     int    `p4:"change"`
+	CopyChg    int    `p4:"copyChg"`
+	MergeChg   int    `p4:"mergeChg"`
+	HighChg    int    `p4:"highChg"`
+	Hash       int64  `p4:"hash"`
+	Status     int    `p4:"status"`
+	ParentView int    `p4:"parentView"`
+}
+
+// A line of the triggers table, of db.trigger, see https://www.perforce.com/perforce/doc.current/schema/#db.trigger
+type Trigger struct {
+	Seq       int    `p4:"seq"`
+	Name      string `p4:"name"`
+	MapFlag   int    `p4:"mapFlag"`
+	DepotFile string `p4:"depotFile"`
+	Trigger   string `p4:"trigger"`
+	Action    string `p4:"action"`
+}
+
+// A typemap entry of db.typemapx. Type is a file type, either as the bits of db.rev or as its name.
+type TypeMap struct {
+	Seq       int    `p4:"seq"`
+	Type      string `p4:"type"`
+	MapFlag   int    `p4:"mapFlag"`
+	DepotFile string `p4:"depotFile"`
+}
+
+// A user of db.user, see https://www.perforce.com/perforce/doc.current/schema/#db.user
+type User struct {
+	User       string `p4:"user"`
+	Email      string `p4:"email"`
+	JobView    string `p4:"jobView"`
+	UpdateDate int64  `p4:"updateDate"`
+	AccessDate int64  `p4:"accessDate"`
+	FullName   string `p4:"fullName"`
+	Password   string `p4:"password"`
+	Strength   int    `p4:"strength"`
+	Ticket     string `p4:"ticket"`
+	EndDate    int64  `p4:"endDate"`
+	Type       int    `p4:"type"`
+	PassDate   int64  `p4:"passDate"`
+	PassExpire int64  `p4:"passExpire"`
+	Attempts   int    `p4:"attempts"`
+	Auth       string `p4:"auth"`
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package scope splits the reports of the tools between the teams owning the depot paths of their
+// findings, so that on servers hosting many projects each team only receives its own.
+//
+// A scope map lists a depot path prefix and the team owning it per line:
+//
+//	# Prefix           Team
+//	//depot/game/...   game
+//	//depot/engine/    engine
+//	//depot/engine/ml/ ml
+//
+// The longest matching prefix owns a path; a prefix listed for several teams is shared by them.
+package scope
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The team of the paths no prefix of the map matches, so that no finding is left out
+const Unowned = "unowned"
+
+type prefixOwners struct {
+	prefix string
+	teams  []string
+}
+
+// A scope map, from depot path prefixes to the teams owning them
+type Map struct {
+	// Longest prefixes first
+	prefixes []prefixOwners
+	teams    []string
+}
+
+// Reads a scope map file
+func ReadMap(path string) (*Map, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseMap(file)
+}
+
+// Parses a scope map: a prefix and a team per line, separated by spaces, with # starting comments.
+// Prefixes may contain spaces, team names can't.
+func ParseMap(r io.Reader) (*Map, error) {
+	owners := make(map[string][]string)
+	teams := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		separator := strings.LastIndexAny(line, " \t")
+		if separator < 0 {
+			return nil, fmt.Errorf("line %v: expected a depot path prefix and a team", lineNumber)
+		}
+		prefix := strings.TrimSuffix(strings.TrimSpace(line[:separator]), "...")
+		team := line[separator+1:]
+		if !strings.HasPrefix(prefix, "//") {
+			return nil, fmt.Errorf("line %v: %q is not a depot path", lineNumber, prefix)
+		}
+		if team == Unowned || strings.ContainsAny(team, `/\`) {
+			return nil, fmt.Errorf("line %v: invalid team name %q", lineNumber, team)
+		}
+		owners[prefix] = append(owners[prefix], team)
+		teams[team] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(owners) == 0 {
+		return nil, fmt.Errorf("empty scope map")
+	}
+	m := &Map{}
+	for prefix, prefixTeams := range owners {
+		m.prefixes = append(m.prefixes, prefixOwners{prefix: prefix, teams: prefixTeams})
+	}
+	sort.Slice(m.prefixes, func(i, j int) bool {
+		return len(m.prefixes[i].prefix) > len(m.prefixes[j].prefix)
+	})
+	for team := range teams {
+		m.teams = append(m.teams, team)
+	}
+	sort.Strings(m.teams)
+	return m, nil
+}
+
+// Returns the teams of the map, sorted
+func (m *Map) Teams() []string {
+	return m.teams
+}
+
+// Returns the teams owning a depot path, or Unowned. Directories may be given without their
+// trailing slash.
+func (m *Map) Owners(path string) []string {
+	path += "/"
+	for _, entry := range m.prefixes {
+		if strings.HasPrefix(path, entry.prefix) {
+			return entry.teams
+		}
+	}
+	return []string{Unowned}
+}
+
+// Splits items between the teams owning their depot path, keeping their order. Every team of the
+// map is returned, without items if it owns none of them, so that the reports of a team are
+// replaced even when it no longer has findings; Unowned is only returned with items.
+func Split[T any](m *Map, items []T, path func(T) string) map[string][]T {
+	split := make(map[string][]T)
+	for _, team := range m.teams {
+		split[team] = nil
+	}
+	for _, item := range items {
+		for _, team := range m.Owners(path(item)) {
+			split[team] = append(split[team], item)
+		}
+	}
+	return split
+}
+
+// Returns the file of the report of a team: the team name is inserted before the extension of
+// the file, such as missing.game.csv for missing.csv
+func Destination(destination string, team string) string {
+	extension := filepath.Ext(destination)
+	return strings.TrimSuffix(destination, extension) + "." + team + extension
+}
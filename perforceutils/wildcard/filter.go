@@ -0,0 +1,189 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wildcard
+
+import (
+	"sort"
+	"strings"
+)
+
+// A list of patterns selecting depot paths, such as "//depot/.../*.uasset" and "-//depot/builds/...".
+// As in client views, the last pattern matching a path decides: paths matching an exclusion (starting
+// with -) are left out. Paths matching no pattern are selected only when all patterns are exclusions.
+type Filter struct {
+	entries         []filterEntry
+	hasIncludes     bool
+	caseInsensitive bool
+}
+
+type filterEntry struct {
+	pattern *Pattern
+	exclude bool
+	// Whether the pattern selects a whole directory, such as //depot/builds/...
+	directory bool
+	// The path given without wildcards, also matched itself
+	path string
+}
+
+// Compiles a list of patterns into a filter. Patterns without wildcards, such as //depot/main, select
+// the path itself and everything below it.
+func NewFilter(patterns []string, caseInsensitive bool) (*Filter, error) {
+	filter := &Filter{caseInsensitive: caseInsensitive}
+	for _, text := range patterns {
+		entry := filterEntry{}
+		if strings.HasPrefix(text, "-") {
+			entry.exclude = true
+			text = text[1:]
+		} else {
+			text = strings.TrimPrefix(text, "+")
+		}
+		pattern, err := Compile(text, caseInsensitive)
+		if err != nil {
+			return nil, err
+		}
+		if pattern.literal == text {
+			entry.path = strings.TrimSuffix(text, "/")
+			if pattern, err = Compile(strings.TrimSuffix(text, "/")+"/...", caseInsensitive); err != nil {
+				return nil, err
+			}
+		}
+		entry.pattern = pattern
+		entry.directory = len(pattern.literal) == len(pattern.text)-len("...") && strings.HasSuffix(pattern.text, "...")
+		filter.entries = append(filter.entries, entry)
+		filter.hasIncludes = filter.hasIncludes || !entry.exclude
+	}
+	return filter, nil
+}
+
+// Reports whether a depot path is selected. A nil filter selects all paths.
+func (f *Filter) Match(path string) bool {
+	if f == nil {
+		return true
+	}
+	for i := len(f.entries) - 1; i >= 0; i-- {
+		entry := f.entries[i]
+		if entry.pattern.Match(path) || (len(entry.path) > 0 && f.equal(path, entry.path)) {
+			return !entry.exclude
+		}
+	}
+	return !f.hasIncludes
+}
+
+func (f *Filter) equal(a string, b string) bool {
+	if f.caseInsensitive {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+func (f *Filter) hasPrefix(s string, prefix string) bool {
+	if f.caseInsensitive {
+		return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+	}
+	return strings.HasPrefix(s, prefix)
+}
+
+// Reports whether no path below a depot directory, such as //depot/builds, can be selected, so that
+// the directory doesn't need to be listed
+func (f *Filter) SkipsDir(dir string) bool {
+	if f == nil {
+		return false
+	}
+	dir = strings.TrimSuffix(dir, "/") + "/"
+	for i := len(f.entries) - 1; i >= 0; i-- {
+		entry := f.entries[i]
+		literal := entry.pattern.literal
+		if entry.exclude {
+			if entry.directory && f.hasPrefix(dir, literal) {
+				return true
+			}
+		} else if f.hasPrefix(dir, literal) || f.hasPrefix(literal, dir) {
+			return false
+		} else if len(entry.path) > 0 && f.equal(dir, entry.path+",d/") {
+			// The archives of a file named without wildcards are in its ,d directory
+			return false
+		}
+	}
+	return f.hasIncludes
+}
+
+// Returns the depot directories holding all the selected paths, such as //depot for
+// //depot/.../*.uasset, or nil when paths may be selected anywhere. Directories below another one
+// of the list are left out.
+func (f *Filter) Roots() []string {
+	if f == nil || !f.hasIncludes {
+		return nil
+	}
+	var roots []string
+	for _, entry := range f.entries {
+		if entry.exclude {
+			continue
+		}
+		literal := entry.pattern.literal
+		// A path without wildcards may name a file, whose archives are next to it rather than below
+		if len(entry.path) > 0 {
+			literal = entry.path
+		}
+		root := literal[:strings.LastIndex(literal, "/")+1]
+		// Patterns such as //... or //*/main match any depot
+		if len(strings.Trim(root, "/")) == 0 {
+			return nil
+		}
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	kept := roots[:0]
+	for _, root := range roots {
+		if len(kept) > 0 && f.hasPrefix(root, kept[len(kept)-1]) {
+			continue
+		}
+		kept = append(kept, root)
+	}
+	for i, root := range kept {
+		kept[i] = strings.TrimSuffix(root, "/")
+	}
+	return kept
+}
+
+// Reports whether the filter matches paths regardless of case
+func (f *Filter) CaseInsensitive() bool {
+	return f != nil && f.caseInsensitive
+}
+
+// Reports whether two filters select the same paths the same way: the same patterns, in the same
+// order, with the same case handling. Nil filters are only equal to each other.
+func (f *Filter) Equal(other *Filter) bool {
+	if f == nil || other == nil {
+		return f == other
+	}
+	return f.caseInsensitive == other.caseInsensitive && f.String() == other.String()
+}
+
+// Returns the patterns, with /... added to the directories
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	texts := make([]string, len(f.entries))
+	for i, entry := range f.entries {
+		texts[i] = entry.pattern.text
+		if entry.exclude {
+			texts[i] = "-" + texts[i]
+		}
+	}
+	return strings.Join(texts, " ")
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package wildcard matches depot paths against the Perforce wildcards used by file arguments,
+// views and typemaps: "..." matches anything including slashes, "*" and "%%1" to "%%9" anything
+// within a directory.
+package wildcard
+
+import (
+	"regexp"
+	"strings"
+)
+
+// A compiled depot path pattern, such as //depot/.../*.png
+type Pattern struct {
+	text string
+	// The path up to its first wildcard
+	literal string
+	// The literal part when matching is case-sensitive, to skip most paths without running the
+	// regular expression
+	prefix string
+	regexp *regexp.Regexp
+}
+
+// Compiles a depot path pattern. Paths are matched as written, special characters in file names
+// being escaped as %40 for @, %23 for #, %25 for % and %2A for *.
+func Compile(path string, caseInsensitive bool) (*Pattern, error) {
+	var expr strings.Builder
+	if caseInsensitive {
+		expr.WriteString("(?i)")
+	}
+	expr.WriteString("^")
+	prefixEnd := -1
+	literalStart := 0
+	for i := 0; i < len(path); {
+		wildcard, length := "", 0
+		switch {
+		case strings.HasPrefix(path[i:], "..."):
+			wildcard, length = ".*", 3
+		case path[i] == '*':
+			wildcard, length = "[^/]*", 1
+		case strings.HasPrefix(path[i:], "%%") && i+2 < len(path) && path[i+2] >= '0' && path[i+2] <= '9':
+			wildcard, length = "[^/]*", 3
+		default:
+			i++
+			continue
+		}
+		if prefixEnd < 0 {
+			prefixEnd = i
+		}
+		expr.WriteString(regexp.QuoteMeta(path[literalStart:i]))
+		expr.WriteString(wildcard)
+		i += length
+		literalStart = i
+	}
+	expr.WriteString(regexp.QuoteMeta(path[literalStart:]))
+	expr.WriteString("$")
+
+	compiled, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, err
+	}
+	pattern := &Pattern{text: path, literal: path, regexp: compiled}
+	if prefixEnd >= 0 {
+		pattern.literal = path[:prefixEnd]
+	}
+	// Case folding can change the length of a prefix, the regular expression handles it alone
+	if !caseInsensitive {
+		pattern.prefix = pattern.literal
+	}
+	return pattern, nil
+}
+
+// Reports whether a depot path matches the pattern
+func (p *Pattern) Match(path string) bool {
+	return strings.HasPrefix(path, p.prefix) && p.regexp.MatchString(path)
+}
+
+// Returns the pattern as given to Compile
+func (p *Pattern) String() string {
+	return p.text
+}
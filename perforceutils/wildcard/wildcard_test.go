@@ -0,0 +1,190 @@
+/*
+Copyright 2021 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wildcard
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern         string
+		caseInsensitive bool
+		path            string
+		want            bool
+	}{
+		{"//depot/...", false, "//depot/main/a.txt", true},
+		{"//depot/...", false, "//other/main/a.txt", false},
+		{"//depot/*.txt", false, "//depot/a.txt", true},
+		{"//depot/*.txt", false, "//depot/main/a.txt", false},
+		{"//depot/.../*.png", false, "//depot/main/art/logo.png", true},
+		{"//depot/%%1/a.txt", false, "//depot/main/a.txt", true},
+		{"//depot/%%1/a.txt", false, "//depot/main/dev/a.txt", false},
+		{"//depot/a.txt", false, "//depot/a.txt", true},
+		{"//depot/a.txt", false, "//depot/a.txt.bak", false},
+		{"//depot/a+b(1).txt", false, "//depot/a+b(1).txt", true},
+		{"//Depot/Main/...", false, "//depot/main/a.txt", false},
+		{"//Depot/Main/...", true, "//depot/main/a.txt", true},
+		{"//depot/*.TXT", true, "//depot/a.txt", true},
+	}
+	for _, test := range tests {
+		pattern, err := Compile(test.pattern, test.caseInsensitive)
+		if err != nil {
+			t.Fatalf("Compile(%q) returned %v", test.pattern, err)
+		}
+		if got := pattern.Match(test.path); got != test.want {
+			t.Errorf("Compile(%q, %v).Match(%q) = %v, want %v", test.pattern, test.caseInsensitive, test.path, got, test.want)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		name            string
+		patterns        []string
+		caseInsensitive bool
+		// Paths selected and left out by the filter
+		match   []string
+		noMatch []string
+		// Directories SkipsDir is true and false for
+		skipped    []string
+		notSkipped []string
+		roots      []string
+	}{
+		{
+			name:       "include",
+			patterns:   []string{"//depot/main/..."},
+			match:      []string{"//depot/main/a.txt", "//depot/main/sub/b.txt"},
+			noMatch:    []string{"//depot/dev/a.txt", "//other/main/a.txt"},
+			skipped:    []string{"//depot/dev", "//other"},
+			notSkipped: []string{"//depot", "//depot/main", "//depot/main/sub"},
+			roots:      []string{"//depot/main"},
+		},
+		{
+			name:       "last pattern decides",
+			patterns:   []string{"//depot/...", "-//depot/builds/...", "//depot/builds/keep/..."},
+			match:      []string{"//depot/main/a.txt", "//depot/builds/keep/a.zip"},
+			noMatch:    []string{"//depot/builds/a.zip"},
+			skipped:    []string{"//other"},
+			notSkipped: []string{"//depot/builds", "//depot/builds/keep"},
+			roots:      []string{"//depot"},
+		},
+		{
+			name:       "exclusions only",
+			patterns:   []string{"-//depot/builds/...", "-//.../*.tmp"},
+			match:      []string{"//depot/main/a.txt", "//other/a.txt"},
+			noMatch:    []string{"//depot/builds/a.zip", "//depot/main/a.tmp"},
+			skipped:    []string{"//depot/builds", "//depot/builds/old"},
+			notSkipped: []string{"//depot/main", "//other"},
+		},
+		{
+			name:       "path without wildcards",
+			patterns:   []string{"//depot/main/a.txt"},
+			match:      []string{"//depot/main/a.txt", "//depot/main/a.txt/below"},
+			noMatch:    []string{"//depot/main/b.txt", "//depot/main/a.txt.bak"},
+			skipped:    []string{"//depot/dev"},
+			notSkipped: []string{"//depot/main", "//depot/main/a.txt,d"},
+			roots:      []string{"//depot/main"},
+		},
+		{
+			name:            "case-insensitive",
+			patterns:        []string{"//Depot/Main/...", "-//depot/main/*.TMP"},
+			caseInsensitive: true,
+			match:           []string{"//depot/main/a.txt", "//DEPOT/MAIN/b.txt"},
+			noMatch:         []string{"//depot/main/a.tmp", "//depot/dev/a.txt"},
+			skipped:         []string{"//DEPOT/dev"},
+			notSkipped:      []string{"//depot/MAIN"},
+			roots:           []string{"//Depot/Main"},
+		},
+		{
+			name:     "any depot",
+			patterns: []string{"//.../*.png", "//depot/main/..."},
+			match:    []string{"//any/where/logo.png", "//depot/main/a.txt"},
+			noMatch:  []string{"//any/where/a.txt"},
+		},
+		{
+			name:     "nested roots",
+			patterns: []string{"//depot/main/art/...", "//depot/main/...", "//other/*.txt"},
+			roots:    []string{"//depot/main", "//other"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := NewFilter(test.patterns, test.caseInsensitive)
+			if err != nil {
+				t.Fatalf("NewFilter(%q) returned %v", test.patterns, err)
+			}
+			for _, path := range test.match {
+				if !filter.Match(path) {
+					t.Errorf("Match(%q) = false, want true", path)
+				}
+			}
+			for _, path := range test.noMatch {
+				if filter.Match(path) {
+					t.Errorf("Match(%q) = true, want false", path)
+				}
+			}
+			for _, dir := range test.skipped {
+				if !filter.SkipsDir(dir) {
+					t.Errorf("SkipsDir(%q) = false, want true", dir)
+				}
+			}
+			for _, dir := range test.notSkipped {
+				if filter.SkipsDir(dir) {
+					t.Errorf("SkipsDir(%q) = true, want false", dir)
+				}
+			}
+			if got := filter.Roots(); !reflect.DeepEqual(got, test.roots) {
+				t.Errorf("Roots() = %q, want %q", got, test.roots)
+			}
+		})
+	}
+}
+
+func TestNilFilter(t *testing.T) {
+	var filter *Filter
+	if !filter.Match("//depot/a.txt") || filter.SkipsDir("//depot") || filter.Roots() != nil || filter.CaseInsensitive() {
+		t.Errorf("a nil filter must select every path")
+	}
+	if !filter.Equal(nil) {
+		t.Errorf("a nil filter must equal nil")
+	}
+	other, err := NewFilter([]string{"//depot/..."}, false)
+	if err != nil {
+		t.Fatalf("NewFilter() returned %v", err)
+	}
+	if filter.Equal(other) || other.Equal(filter) {
+		t.Errorf("a nil filter must only equal nil")
+	}
+}
+
+func TestFilterString(t *testing.T) {
+	filter, err := NewFilter([]string{"+//depot/main", "-//depot/main/builds/...", "//depot/*.txt"}, false)
+	if err != nil {
+		t.Fatalf("NewFilter() returned %v", err)
+	}
+	want := "//depot/main/... -//depot/main/builds/... //depot/*.txt"
+	if got := filter.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	same, _ := NewFilter([]string{"//depot/main/...", "-//depot/main/builds/...", "//depot/*.txt"}, false)
+	folded, _ := NewFilter([]string{"//depot/main/...", "-//depot/main/builds/...", "//depot/*.txt"}, true)
+	if !filter.Equal(same) || filter.Equal(folded) {
+		t.Errorf("Equal() must compare the patterns and the case handling")
+	}
+}